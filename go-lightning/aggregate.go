@@ -0,0 +1,60 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+)
+
+// genotypeCount returns the number of training set samples that have
+// the genotype represented by a one-hot column.
+func genotypeCount(onehot []bool) int {
+	n := 0
+	for _, v := range onehot {
+		if v {
+			n++
+		}
+	}
+	return n
+}
+
+// writeOnehotAggregates writes a CSV file with the site-level
+// statistics of each one-hot column: the number of training set
+// samples with the column's genotype (out of total), minor allele
+// frequency, and p-value. Columns suppressed by -min-group-size have
+// NaN count, frequency, and p-value.
+func writeOnehotAggregates(fnm string, total int, xrefs []onehotXref) error {
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriterSize(f, 1<<20)
+	_, err = fmt.Fprint(bufw, "ColumnID,Column,Tag,Variant,Hom,Count,Total,MAF,PValue\n")
+	if err != nil {
+		return err
+	}
+	for i, xref := range xrefs {
+		hom := 0
+		if xref.hom {
+			hom = 1
+		}
+		count := fmt.Sprintf("%d", xref.count)
+		if xref.suppressed {
+			count = "NaN"
+		}
+		_, err = fmt.Fprintf(bufw, "%s,%d,%d,%d,%d,%s,%d,%g,%g\n", xref.columnID(), i, xref.tag, xref.variant, hom, count, total, xref.maf, xref.pvalue)
+		if err != nil {
+			return err
+		}
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
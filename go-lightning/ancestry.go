@@ -0,0 +1,101 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+)
+
+// ancestryAF returns the allele frequency of a tile variant in each
+// ancestry group, given the hom and het one-hot columns for the
+// variant (see homhet2maf) and the group index of each training set
+// sample (see sampleStrata). Groups with no samples have frequency
+// 0.
+func ancestryAF(homhet [][]bool, groups []int, ngroups int) []float64 {
+	n := make([]int, ngroups)
+	total := make([]int, ngroups)
+	for i, g := range groups {
+		total[g] += 2
+		if homhet[0][i] {
+			n[g] += 2
+		} else if homhet[1][i] {
+			n[g]++
+		}
+	}
+	af := make([]float64, ngroups)
+	for g := range af {
+		if total[g] > 0 {
+			af[g] = float64(n[g]) / float64(total[g])
+		}
+	}
+	return af
+}
+
+// ancestryPolymorphic returns true if a variant with the given
+// allele frequency is polymorphic in a population, i.e., its minor
+// allele frequency is non-zero and at least minFrequency.
+func ancestryPolymorphic(af, minFrequency float64) bool {
+	maf := af
+	if maf > 0.5 {
+		maf = 1 - maf
+	}
+	return maf > 0 && maf >= minFrequency
+}
+
+// writeAncestryAF writes a CSV file with the allele frequency of
+// each one-hot column's tile variant in each ancestry group.
+func writeAncestryAF(fnm string, names []string, xrefs []onehotXref) error {
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriterSize(f, 1<<20)
+	_, err = fmt.Fprint(bufw, "ColumnID,Column,Tag,Variant,Hom,AF")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		_, err = fmt.Fprintf(bufw, ",AF:%s", name)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprint(bufw, "\n")
+	if err != nil {
+		return err
+	}
+	for i, xref := range xrefs {
+		hom := 0
+		if xref.hom {
+			hom = 1
+		}
+		_, err = fmt.Fprintf(bufw, "%s,%d,%d,%d,%d,%g", xref.columnID(), i, xref.tag, xref.variant, hom, xref.maf)
+		if err != nil {
+			return err
+		}
+		for g := range names {
+			af := 0.0
+			if g < len(xref.ancestryAF) {
+				af = xref.ancestryAF[g]
+			}
+			_, err = fmt.Fprintf(bufw, ",%g", af)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprint(bufw, "\n")
+		if err != nil {
+			return err
+		}
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,49 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"os"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type ancestrySuite struct{}
+
+var _ = check.Suite(&ancestrySuite{})
+
+func (s *ancestrySuite) TestAncestryAF(c *check.C) {
+	groups := []int{0, 0, 1, 1, 1}
+	hom := []bool{true, false, false, false, true}
+	het := []bool{false, true, true, false, false}
+	c.Check(ancestryAF([][]bool{hom, het}, groups, 3), check.DeepEquals, []float64{3.0 / 4, 3.0 / 6, 0})
+}
+
+func (s *ancestrySuite) TestAncestryPolymorphic(c *check.C) {
+	c.Check(ancestryPolymorphic(0, 0), check.Equals, false)
+	c.Check(ancestryPolymorphic(1, 0), check.Equals, false)
+	c.Check(ancestryPolymorphic(0.01, 0), check.Equals, true)
+	c.Check(ancestryPolymorphic(0.99, 0), check.Equals, true)
+	c.Check(ancestryPolymorphic(0.01, 0.05), check.Equals, false)
+	c.Check(ancestryPolymorphic(0.9, 0.05), check.Equals, true)
+	c.Check(ancestryPolymorphic(0.99, 0.05), check.Equals, false)
+}
+
+func (s *ancestrySuite) TestWriteAncestryAF(c *check.C) {
+	fnm := c.MkDir() + "/onehot-ancestry-af.csv"
+	err := writeAncestryAF(fnm, []string{"AFR", "EUR"}, []onehotXref{
+		{tag: 5, variant: 2, hom: true, maf: 0.25, ancestryAF: []float64{0.5, 0.125}},
+		{tag: 5, variant: 2, maf: 0.25},
+	})
+	c.Assert(err, check.IsNil)
+	buf, err := os.ReadFile(fnm)
+	c.Assert(err, check.IsNil)
+	lines := strings.Split(string(buf), "\n")
+	c.Check(lines, check.HasLen, 4)
+	c.Check(lines[0], check.Equals, "ColumnID,Column,Tag,Variant,Hom,AF,AF:AFR,AF:EUR")
+	c.Check(lines[1], check.Matches, `[^,]+,0,5,2,1,0.25,0.5,0.125`)
+	c.Check(lines[2], check.Matches, `[^,]+,1,5,2,0,0.25,0,0`)
+}
@@ -24,6 +24,7 @@ import (
 )
 
 type anno2vcf struct {
+	manifest manifestOptions
 }
 
 func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
@@ -39,9 +40,12 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
 	projectUUID := flags.String("project", "", "project `UUID` for output data")
 	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
 	inputDir := flags.String("input-dir", "./in", "input `directory`")
 	outputDir := flags.String("output-dir", "./out", "output `directory`")
-	err = flags.Parse(args)
+	cmd.manifest.Flags(flags)
+	err = parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		err = nil
 		return 0
@@ -69,7 +73,11 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 			KeepCache:   2,
 			APIAccess:   true,
 		}
+		containerOpts.Apply(&runner, stdout)
 		err = runner.TranslatePaths(inputDir)
+		if err == nil {
+			err = cmd.manifest.TranslatePaths(&runner)
+		}
 		if err != nil {
 			return 1
 		}
@@ -78,9 +86,13 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 			"-input-dir", *inputDir,
 			"-output-dir", "/mnt/output",
 		}
+		runner.Args = append(runner.Args, cmd.manifest.Args()...)
 		var output string
 		output, err = runner.Run()
-		if err != nil {
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
 			return 1
 		}
 		fmt.Fprintln(stdout, output)
@@ -133,7 +145,7 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 			lines := bytes.Split(buf, []byte{'\n'})
 			calls := map[string][]*call{}
 			for lineIdx, line := range lines {
-				if len(line) == 0 {
+				if len(line) == 0 || isAnnotationHeader(line) {
 					continue
 				}
 				if lineIdx&0xff == 0 && thr.Err() != nil {
@@ -275,5 +287,9 @@ func (cmd *anno2vcf) RunCommand(prog string, args []string, stdin io.Reader, std
 	if err != nil {
 		return 1
 	}
+	err = cmd.manifest.Write(*outputDir, args, []string{*inputDir})
+	if err != nil {
+		return 1
+	}
 	return 0
 }
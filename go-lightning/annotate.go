@@ -29,8 +29,10 @@ import (
 type annotatecmd struct {
 	dropTiles        []bool
 	variantHash      bool
+	provenance       bool
 	maxTileSize      int
-	tag2tagid        map[string]tagID
+	format           string // annotationFormatV1 or annotationFormatV2
+	excludeTags      excludeTags
 	reportAnnotation func(tag tagID, outcol int, variant tileVariantID, refname string, seqname string, pdi hgvs.Variant)
 }
 
@@ -47,11 +49,17 @@ func (cmd *annotatecmd) RunCommand(prog string, args []string, stdin io.Reader,
 	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
 	projectUUID := flags.String("project", "", "project `UUID` for output data")
 	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
 	inputFilename := flags.String("i", "-", "input `file` (library)")
 	outputFilename := flags.String("o", "-", "output `file`")
 	flags.BoolVar(&cmd.variantHash, "variant-hash", false, "output variant hash instead of index")
+	flags.BoolVar(&cmd.provenance, "provenance", false, "append source file and timestamp for each tile variant (if recorded by \"import -provenance\")")
 	flags.IntVar(&cmd.maxTileSize, "max-tile-size", 50000, "don't try to make annotations for tiles bigger than given `size`")
-	err = flags.Parse(args)
+	flags.StringVar(&cmd.format, "format", annotationFormatV1, "output `format`: v1 (tag,outcol,variant[,refname],hgvs) or v2 (version line and header row, then the same columns as slice-numpy annotations: tag,outcol,variant,hgvs,chrom,pos,ref,alt,left[,refname])")
+	seqSpillDir := flags.String("sequence-spill-dir", "", "store tile sequences in a temp file in `dir` instead of RAM")
+	excludeTagsFilename := flags.String("exclude-tags", "", excludeTagsUsage)
+	err = parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		err = nil
 		return 0
@@ -60,6 +68,8 @@ func (cmd *annotatecmd) RunCommand(prog string, args []string, stdin io.Reader,
 	} else if flags.NArg() > 0 {
 		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
 		return 2
+	} else if err = checkAnnotationFormat(cmd.format); err != nil {
+		return 2
 	}
 
 	if *pprof != "" {
@@ -80,20 +90,33 @@ func (cmd *annotatecmd) RunCommand(prog string, args []string, stdin io.Reader,
 			VCPUs:       16,
 			Priority:    *priority,
 		}
-		err = runner.TranslatePaths(inputFilename)
+		containerOpts.Apply(&runner, stdout)
+		err = runner.TranslatePaths(inputFilename, excludeTagsFilename)
 		if err != nil {
 			return 1
 		}
-		runner.Args = []string{"annotate", "-local=true", fmt.Sprintf("-variant-hash=%v", cmd.variantHash), "-max-tile-size", strconv.Itoa(cmd.maxTileSize), "-i", *inputFilename, "-o", "/mnt/output/tilevariants.csv"}
+		if *seqSpillDir != "" {
+			runner.Mounts["/tmp/lightning-seq"] = map[string]interface{}{"kind": "tmp", "capacity": 500000000000}
+			*seqSpillDir = "/tmp/lightning-seq"
+		}
+		runner.Args = []string{"annotate", "-local=true", fmt.Sprintf("-variant-hash=%v", cmd.variantHash), fmt.Sprintf("-provenance=%v", cmd.provenance), "-format=" + cmd.format, "-max-tile-size", strconv.Itoa(cmd.maxTileSize), "-sequence-spill-dir=" + *seqSpillDir, "-exclude-tags=" + *excludeTagsFilename, "-i", *inputFilename, "-o", "/mnt/output/tilevariants.csv"}
 		var output string
 		output, err = runner.Run()
-		if err != nil {
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
 			return 1
 		}
 		fmt.Fprintln(stdout, output+"/tilevariants.csv")
 		return 0
 	}
 
+	cmd.excludeTags, err = loadExcludeTags(*excludeTagsFilename)
+	if err != nil {
+		return 1
+	}
+
 	var input io.ReadCloser
 	if *inputFilename == "-" {
 		input = ioutil.NopCloser(stdin)
@@ -120,7 +143,10 @@ func (cmd *annotatecmd) RunCommand(prog string, args []string, stdin io.Reader,
 	tilelib := &tileLibrary{
 		retainNoCalls:       true,
 		retainTileSequences: true,
+		trackProvenance:     cmd.provenance,
+		seqSpillDir:         *seqSpillDir,
 	}
+	defer tilelib.Close()
 	err = tilelib.LoadGob(context.Background(), input, strings.HasSuffix(*inputFilename, ".gz"))
 	if err != nil {
 		return 1
@@ -129,6 +155,10 @@ func (cmd *annotatecmd) RunCommand(prog string, args []string, stdin io.Reader,
 	if err != nil {
 		return 1
 	}
+	err = tilelib.Close()
+	if err != nil {
+		return 1
+	}
 	err = bufw.Flush()
 	if err != nil {
 		return 1
@@ -149,15 +179,10 @@ func (cmd *annotatecmd) exportTileDiffs(outw io.Writer, tilelib *tileLibrary) er
 	if len(tagset) == 0 {
 		return errors.New("cannot annotate library without tags")
 	}
-	taglen := len(tagset[0])
 	var refs []string
 	for name := range tilelib.refseqs {
 		refs = append(refs, name)
 	}
-	cmd.tag2tagid = make(map[string]tagID, len(tagset))
-	for tagid, tagseq := range tagset {
-		cmd.tag2tagid[string(tagseq)] = tagID(tagid)
-	}
 	sort.Strings(refs)
 	log.Infof("len(refs) %d", len(refs))
 
@@ -178,6 +203,19 @@ func (cmd *annotatecmd) exportTileDiffs(outw io.Writer, tilelib *tileLibrary) er
 		nseqs += len(refcs)
 	}
 
+	if cmd.format == annotationFormatV2 {
+		var extra []string
+		if len(refs) > 1 {
+			extra = append(extra, "refname")
+		}
+		if cmd.provenance {
+			extra = append(extra, "source", "sourcetime")
+		}
+		var hdr strings.Builder
+		writeAnnotationHeader(&hdr, extra...)
+		outch <- hdr.String()
+	}
+
 	throttle := &throttle{Max: runtime.NumCPU()*2 + nseqs*2 + 1}
 	defer throttle.Wait()
 
@@ -197,7 +235,7 @@ func (cmd *annotatecmd) exportTileDiffs(outw io.Writer, tilelib *tileLibrary) er
 			}
 			go func() {
 				defer throttle.Release()
-				throttle.Report(cmd.annotateSequence(throttle, outch, tilelib, taglen, refname, seqname, refcs[seqname], len(refs) > 1))
+				throttle.Report(cmd.annotateSequence(throttle, outch, tilelib, refname, seqname, refcs[seqname], len(refs) > 1))
 			}()
 		}
 	}
@@ -205,11 +243,13 @@ func (cmd *annotatecmd) exportTileDiffs(outw io.Writer, tilelib *tileLibrary) er
 	return throttle.Err()
 }
 
-func (cmd *annotatecmd) annotateSequence(throttle *throttle, outch chan<- string, tilelib *tileLibrary, taglen int, refname, seqname string, reftiles []tileLibRef, refnamecol bool) error {
+func (cmd *annotatecmd) annotateSequence(throttle *throttle, outch chan<- string, tilelib *tileLibrary, refname, seqname string, reftiles []tileLibRef, refnamecol bool) error {
+	taglib := tilelib.taglib
 	refnamefield := ""
 	if refnamecol {
 		refnamefield = "," + trimFilenameForLabel(refname)
 	}
+	v2 := cmd.format == annotationFormatV2
 	var refseq []byte
 	// tilestart[123] is the index into refseq
 	// where the tile for tag 123 was placed.
@@ -217,9 +257,10 @@ func (cmd *annotatecmd) annotateSequence(throttle *throttle, outch chan<- string
 	tileend := map[tagID]int{}
 	for _, libref := range reftiles {
 		if libref.Variant < 1 {
-			return fmt.Errorf("reference %q seq %q uses variant zero at tag %d", refname, seqname, libref.Tag)
+			return diagnoseTag(fmt.Errorf("reference %q seq %q uses variant zero at tag %d", refname, seqname, libref.Tag), "annotating reference", "", libref.Tag)
 		}
 		seq := tilelib.TileVariantSequence(libref)
+		taglen := taglib.TagLen(libref.Tag)
 		if len(seq) < taglen {
 			return fmt.Errorf("reference %q seq %q uses tile %d variant %d with sequence len %d < taglen %d", refname, seqname, libref.Tag, libref.Variant, len(seq), taglen)
 		}
@@ -248,6 +289,9 @@ func (cmd *annotatecmd) annotateSequence(throttle *throttle, outch chan<- string
 		outcol++
 		// Must shadow outcol var to use safely in goroutine below.
 		outcol := outcol
+		if cmd.excludeTags[tag] {
+			continue
+		}
 		refstart, ok := tilestart[tag]
 		if !ok {
 			// Tag didn't place on this reference
@@ -262,15 +306,14 @@ func (cmd *annotatecmd) annotateSequence(throttle *throttle, outch chan<- string
 			tileseq := tilelib.TileVariantSequence(tileLibRef{Tag: tag, Variant: variant})
 			if len(tileseq) == 0 {
 				continue
-			} else if len(tileseq) < taglen {
+			} else if taglen := taglib.TagLen(tag); len(tileseq) < taglen {
 				return fmt.Errorf("tilevar %d,%d has sequence len %d < taglen %d", tag, variant, len(tileseq), taglen)
 			}
 			var refpart []byte
-			endtag := string(tileseq[len(tileseq)-taglen:])
-			if endtagid, ok := cmd.tag2tagid[endtag]; !ok {
+			if endtagid, ok := taglib.EndTag(tileseq); !ok {
 				// Tile variant doesn't end on a tag, so it can only place at the end of a chromosome.
 				refpart = refseq[refstart:]
-				log.Warnf("%x tilevar %d,%d endtag not in ref: %s", hash[:13], tag, variant, endtag)
+				log.Warnf("%x tilevar %d,%d endtag not in ref: %s", hash[:13], tag, variant, tileseq[len(tileseq)-taglib.TagLen(tag):])
 			} else if refendtagstart, ok := tilestart[endtagid]; !ok {
 				// Ref ends a chromsome with a (possibly very large) variant of this tile, but genomes with this tile don't.
 				// Give up. (TODO: something smarter)
@@ -278,8 +321,8 @@ func (cmd *annotatecmd) annotateSequence(throttle *throttle, outch chan<- string
 				continue
 			} else {
 				// Non-terminal tile vs. non-terminal reference.
-				refpart = refseq[refstart : refendtagstart+taglen]
-				log.Tracef("\n%x tilevar %d,%d endtag %s endtagid %d refendtagstart %d", hash[:13], tag, variant, endtag, endtagid, refendtagstart)
+				refpart = refseq[refstart : refendtagstart+taglib.TagLen(endtagid)]
+				log.Tracef("\n%x tilevar %d,%d endtagid %d refendtagstart %d", hash[:13], tag, variant, endtagid, refendtagstart)
 			}
 			if len(refpart) > cmd.maxTileSize {
 				log.Warnf("%x tilevar %d,%d skipping long diff, ref %s seq %s pos %d ref len %d", hash[:13], tag, variant, refname, seqname, refstart, len(refpart))
@@ -303,7 +346,16 @@ func (cmd *annotatecmd) annotateSequence(throttle *throttle, outch chan<- string
 					} else {
 						varid = fmt.Sprintf("%d", variant)
 					}
-					outch <- fmt.Sprintf("%d,%d,%s%s,%s:g.%s\n", tag, outcol, varid, refnamefield, seqname, diff.String())
+					provfields := ""
+					if cmd.provenance {
+						src, _ := tilelib.Provenance(tileLibRef{Tag: tag, Variant: variant})
+						provfields = "," + src.csvFields()
+					}
+					if v2 {
+						outch <- fmt.Sprintf("%d,%d,%s,%s:g.%s,%s,%d,%s,%s,%s%s%s\n", tag, outcol, varid, seqname, diff.String(), seqname, diff.Position, diff.Ref, diff.New, diff.Left, refnamefield, provfields)
+					} else {
+						outch <- fmt.Sprintf("%d,%d,%s%s,%s:g.%s%s\n", tag, outcol, varid, refnamefield, seqname, diff.String(), provfields)
+					}
 					if cmd.reportAnnotation != nil {
 						cmd.reportAnnotation(tag, outcol, variant, refname, seqname, diff)
 					}
@@ -0,0 +1,100 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Tile variant annotations (annotate output, slice-numpy
+// matrix*.annotations.csv) are CSV files with one row per HGVS
+// variant in each tile variant.
+//
+// In format v2 ("annotate -format=v2", "slice-numpy
+// -annotation-format=v2"), both commands use the same columns:
+//
+//	tag      tag ID
+//	outcol   tile index in the output matrix (columns 2*outcol and 2*outcol+1)
+//	variant  tile variant ID (annotate -variant-hash: hash prefix)
+//	hgvs     HGVS ID, e.g., "chr1:g.123A>G" ("=" for a reference tile, empty for a tile variant that could not be diffed)
+//	chrom    reference sequence name
+//	pos      1-based position of the variant (or the tile, if hgvs is "=" or empty)
+//	ref      reference allele (empty for an insertion)
+//	alt      alternate allele (empty for a deletion)
+//	left     reference base before an insertion or deletion
+//
+// followed by any command-specific columns (annotate: refname if the
+// library has more than one reference, source and sourcetime with
+// -provenance). The first line is annotationVersionLine, and the
+// second is a header row with the column names.
+//
+// Format v1 (the default) has no version line or header
+// row. slice-numpy v1 has the same columns as v2; annotate v1 has
+// tag,outcol,variant[,refname],hgvs[,source,sourcetime].
+const (
+	annotationFormatV1    = "v1"
+	annotationFormatV2    = "v2"
+	annotationVersionLine = "#lightning-annotations,v2"
+)
+
+var annotationColumns = []string{"tag", "outcol", "variant", "hgvs", "chrom", "pos", "ref", "alt", "left"}
+
+func checkAnnotationFormat(format string) error {
+	if format != annotationFormatV1 && format != annotationFormatV2 {
+		return fmt.Errorf("invalid annotation format %q: must be %q or %q", format, annotationFormatV1, annotationFormatV2)
+	}
+	return nil
+}
+
+// writeAnnotationHeader writes the v2 version line and header row,
+// with the given command-specific columns after the standard ones.
+func writeAnnotationHeader(w io.Writer, extra ...string) error {
+	_, err := fmt.Fprintf(w, "%s\n%s\n", annotationVersionLine, strings.Join(append(append([]string(nil), annotationColumns...), extra...), ","))
+	return err
+}
+
+// isAnnotationHeader returns true if line is the version line or
+// header row of a v2 annotations file.
+func isAnnotationHeader(line []byte) bool {
+	return bytes.HasPrefix(line, []byte{'#'}) || bytes.HasPrefix(line, []byte("tag,"))
+}
+
+// prependAnnotationHeader converts the v1 slice-numpy annotations
+// file fnm to v2 by adding the version line and header row.
+func prependAnnotationHeader(fnm string) error {
+	in, err := os.Open(fnm)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(fnm + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	bufw := bufio.NewWriterSize(out, 1<<20)
+	err = writeAnnotationHeader(bufw)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(bufw, in)
+	if err != nil {
+		return err
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(fnm+".tmp", fnm)
+}
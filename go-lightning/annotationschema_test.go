@@ -0,0 +1,37 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type annotationSchemaSuite struct{}
+
+var _ = check.Suite(&annotationSchemaSuite{})
+
+func (s *annotationSchemaSuite) TestPrependHeader(c *check.C) {
+	fnm := c.MkDir() + "/matrix.annotations.csv"
+	c.Assert(os.WriteFile(fnm, []byte("3,0,1,=,chr1,100,,,\n3,0,2,chr1:g.105A>G,chr1,105,A,G,\n"), 0666), check.IsNil)
+	c.Assert(prependAnnotationHeader(fnm), check.IsNil)
+	buf, err := os.ReadFile(fnm)
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, `#lightning-annotations,v2
+tag,outcol,variant,hgvs,chrom,pos,ref,alt,left
+3,0,1,=,chr1,100,,,
+3,0,2,chr1:g.105A>G,chr1,105,A,G,
+`)
+	_, err = os.Stat(fnm + ".tmp")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	c.Check(isAnnotationHeader([]byte(annotationVersionLine)), check.Equals, true)
+	c.Check(isAnnotationHeader([]byte("tag,outcol,variant,hgvs,chrom,pos,ref,alt,left")), check.Equals, true)
+	c.Check(isAnnotationHeader([]byte("3,0,1,=,chr1,100,,,")), check.Equals, false)
+
+	c.Check(checkAnnotationFormat("v2"), check.IsNil)
+	c.Check(checkAnnotationFormat("v3"), check.ErrorMatches, `invalid annotation format "v3".*`)
+}
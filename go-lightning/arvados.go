@@ -10,6 +10,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -17,6 +18,7 @@ import (
 	"net/url"
 	"os"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -190,6 +192,26 @@ reconnect:
 
 var refreshTicker = time.NewTicker(5 * time.Second)
 
+// Bounds of the interval between container request state checks in
+// polling mode (see NoWebsocket).
+const (
+	stateWaitMin = 5 * time.Second
+	stateWaitMax = time.Minute
+)
+
+// nextStateWait returns the interval before the next container
+// request state check in polling mode: stateWaitMin if the state
+// changed since the last check, otherwise twice the previous
+// interval, up to stateWaitMax.
+func nextStateWait(wait time.Duration, changed bool) time.Duration {
+	if changed {
+		return stateWaitMin
+	} else if wait *= 2; wait > stateWaitMax {
+		return stateWaitMax
+	}
+	return wait
+}
+
 type arvadosContainerRunner struct {
 	Client      *arvados.Client
 	Name        string
@@ -198,12 +220,67 @@ type arvadosContainerRunner struct {
 	APIAccess   bool
 	VCPUs       int
 	RAM         int64
-	Prog        string // if empty, run /proc/self/exe
+	Prog        string // if empty, upload and run the current executable
 	Args        []string
 	Mounts      map[string]map[string]interface{}
 	Priority    int
+
+	// SecretMounts are passed to the container like Mounts, but
+	// Arvados does not store their content in Keep or return it
+	// in API responses (see AddSecretFile).
+	SecretMounts map[string]map[string]interface{}
+
 	KeepCache   int // cache buffers per VCPU (0 for default)
 	Preemptible bool
+
+	// If DryRun is non-nil, RunContext writes the container
+	// request to DryRun (as JSON) instead of submitting it, and
+	// returns errDryRun.
+	DryRun io.Writer
+
+	// If LogDir is non-empty, RunContext saves the container
+	// logs, a listing of the output collection, and a cost report
+	// in LogDir/{container request UUID}/ after the container
+	// finishes, and adds the cost to LogDir/cost.json.
+	LogDir string
+
+	// If NoWebsocket is true, RunContext monitors the container
+	// by polling the API server instead of listening for events
+	// on a websocket connection, which doesn't work through some
+	// proxies.
+	NoWebsocket bool
+
+	federation *federationInfo // see remoteCluster
+}
+
+// errDryRun is returned by RunContext when
+// the container request was printed instead of submitted.
+var errDryRun = errors.New("dry run: container request not submitted")
+
+var dryRunMtx sync.Mutex
+
+// containerOptions are the command line options that control how a
+// command submits and monitors its containers.
+type containerOptions struct {
+	dryRun      bool
+	saveLogs    string
+	noWebsocket bool
+}
+
+func (co *containerOptions) Flags(flags *flag.FlagSet) {
+	flags.BoolVar(&co.dryRun, "dry-run", false, "print container requests instead of submitting them")
+	flags.StringVar(&co.saveLogs, "save-logs", "", "after each container finishes, save its logs, output listing, and cost report in local `directory`")
+	flags.BoolVar(&co.noWebsocket, "no-websocket", false, "monitor containers by polling the API server instead of using a websocket connection")
+}
+
+// Apply sets up runner according to the options. With -dry-run,
+// container requests are printed to stdout.
+func (co *containerOptions) Apply(runner *arvadosContainerRunner, stdout io.Writer) {
+	if co.dryRun {
+		runner.DryRun = stdout
+	}
+	runner.LogDir = co.saveLogs
+	runner.NoWebsocket = co.noWebsocket
 }
 
 func (runner *arvadosContainerRunner) Run() (string, error) {
@@ -228,16 +305,29 @@ func (runner *arvadosContainerRunner) RunContext(ctx context.Context) (string, e
 	prog := runner.Prog
 	if prog == "" {
 		prog = "/mnt/cmd/lightning"
-		cmdUUID, err := runner.makeCommandCollection()
-		if err != nil {
-			return "", err
+		cmdUUID := "(lightning binary collection)"
+		if runner.DryRun == nil {
+			var err error
+			cmdUUID, err = runner.makeCommandCollection()
+			if err != nil {
+				return "", err
+			}
 		}
 		mounts["/mnt/cmd"] = map[string]interface{}{
 			"kind": "collection",
 			"uuid": cmdUUID,
 		}
 	}
-	command := append([]string{prog}, runner.Args...)
+	command := []string{prog}
+	if runner.Prog == "" && len(runner.Args) > 0 {
+		// Pass the Keep tuning flags (see parseFlags) to the
+		// lightning subcommand.
+		command = append(command, runner.Args[0])
+		command = append(command, keepArgs()...)
+		command = append(command, runner.Args[1:]...)
+	} else {
+		command = append(command, runner.Args...)
+	}
 
 	priority := runner.Priority
 	if priority < 1 {
@@ -257,29 +347,57 @@ func (runner *arvadosContainerRunner) RunContext(ctx context.Context) (string, e
 	if *outname == "" {
 		outname = nil
 	}
+	env := map[string]string{
+		"GOMAXPROCS": fmt.Sprintf("%d", rc.VCPUs),
+	}
+	env[errorJSONEnv] = "/mnt/output/error.json"
+	crAttrs := map[string]interface{}{
+		"owner_uuid":          runner.ProjectUUID,
+		"name":                runner.Name,
+		"container_image":     "lightning-runtime",
+		"command":             command,
+		"mounts":              mounts,
+		"use_existing":        true,
+		"output_path":         "/mnt/output",
+		"output_name":         outname,
+		"runtime_constraints": rc,
+		"priority":            runner.Priority,
+		"state":               arvados.ContainerRequestStateCommitted,
+		"scheduling_parameters": arvados.SchedulingParameters{
+			Preemptible: runner.Preemptible,
+			Partitions:  []string{},
+		},
+		"environment":         env,
+		"container_count_max": 1,
+	}
+	if len(runner.SecretMounts) > 0 {
+		crAttrs["secret_mounts"] = runner.SecretMounts
+	}
+	if runner.DryRun != nil {
+		if len(runner.SecretMounts) > 0 {
+			redacted := map[string]map[string]interface{}{}
+			for path, mnt := range runner.SecretMounts {
+				redacted[path] = map[string]interface{}{"kind": mnt["kind"], "content": "(redacted)"}
+			}
+			crAttrs["secret_mounts"] = redacted
+		}
+		buf, err := json.MarshalIndent(crAttrs, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		// Batches can run concurrently: don't interleave
+		// their output.
+		dryRunMtx.Lock()
+		defer dryRunMtx.Unlock()
+		_, err = fmt.Fprintf(runner.DryRun, "%s\n", buf)
+		if err != nil {
+			return "", err
+		}
+		return "", errDryRun
+	}
 	var cr arvados.ContainerRequest
 	err := runner.Client.RequestAndDecode(&cr, "POST", "arvados/v1/container_requests", nil, map[string]interface{}{
-		"container_request": map[string]interface{}{
-			"owner_uuid":          runner.ProjectUUID,
-			"name":                runner.Name,
-			"container_image":     "lightning-runtime",
-			"command":             command,
-			"mounts":              mounts,
-			"use_existing":        true,
-			"output_path":         "/mnt/output",
-			"output_name":         outname,
-			"runtime_constraints": rc,
-			"priority":            runner.Priority,
-			"state":               arvados.ContainerRequestStateCommitted,
-			"scheduling_parameters": arvados.SchedulingParameters{
-				Preemptible: runner.Preemptible,
-				Partitions:  []string{},
-			},
-			"environment": map[string]string{
-				"GOMAXPROCS": fmt.Sprintf("%d", rc.VCPUs),
-			},
-			"container_count_max": 1,
-		},
+		"container_request": crAttrs,
 	})
 	if err != nil {
 		return "", err
@@ -290,6 +408,10 @@ func (runner *arvadosContainerRunner) RunContext(ctx context.Context) (string, e
 	logch := make(chan eventMessage)
 	client := arvadosClient{Client: runner.Client}
 	defer client.Close()
+	// containerUUID is the container whose logs we are
+	// following; subscribedUUID is the container whose events we
+	// are subscribed to (always "" if NoWebsocket).
+	containerUUID := ""
 	subscribedUUID := ""
 	defer func() {
 		if subscribedUUID != "" {
@@ -318,16 +440,22 @@ func (runner *arvadosContainerRunner) RunContext(ctx context.Context) (string, e
 			log.Printf("container request state: %s", cr.State)
 			lastState = cr.State
 		}
-		if subscribedUUID != cr.ContainerUUID {
+		if containerUUID != cr.ContainerUUID {
 			fmt.Fprint(os.Stderr, neednewline)
 			neednewline = ""
 			if subscribedUUID != "" {
 				log.Printf("unsubscribe container UUID: %s", subscribedUUID)
 				client.Unsubscribe(logch, subscribedUUID)
+				subscribedUUID = ""
+			}
+			if runner.NoWebsocket {
+				log.Printf("container UUID: %s", cr.ContainerUUID)
+			} else {
+				log.Printf("subscribe container UUID: %s", cr.ContainerUUID)
+				client.Subscribe(logch, cr.ContainerUUID)
+				subscribedUUID = cr.ContainerUUID
 			}
-			log.Printf("subscribe container UUID: %s", cr.ContainerUUID)
-			client.Subscribe(logch, cr.ContainerUUID)
-			subscribedUUID = cr.ContainerUUID
+			containerUUID = cr.ContainerUUID
 			logTell = map[string]int64{}
 		}
 	}
@@ -337,6 +465,17 @@ func (runner *arvadosContainerRunner) RunContext(ctx context.Context) (string, e
 	var logWait = logWaitMin
 	var logWaitDone = time.After(logWait)
 	var reCrunchstat = regexp.MustCompile(`mem .* (\d+) rss`)
+
+	// In polling mode, check the container request state at
+	// adaptive intervals (instead of using refreshTicker),
+	// backing off while nothing changes.
+	var refreshC = refreshTicker.C
+	var stateWait = stateWaitMin
+	var stateWaitDone <-chan time.Time
+	if runner.NoWebsocket {
+		refreshC = nil
+		stateWaitDone = time.After(stateWait)
+	}
 waitctr:
 	for cr.State != arvados.ContainerRequestStateFinal {
 		select {
@@ -350,8 +489,13 @@ waitctr:
 				log.Errorf("error while trying to cancel container request %s: %s", cr.UUID, err)
 			}
 			break waitctr
-		case <-refreshTicker.C:
+		case <-refreshC:
+			refreshCR()
+		case <-stateWaitDone:
+			prevState, prevContainer := cr.State, cr.ContainerUUID
 			refreshCR()
+			stateWait = nextStateWait(stateWait, cr.State != prevState || cr.ContainerUUID != prevContainer)
+			stateWaitDone = time.After(stateWait)
 		case msg := <-logch:
 			if msg.EventType == "update" {
 				refreshCR()
@@ -431,16 +575,42 @@ waitctr:
 	err = runner.Client.RequestAndDecode(&c, "GET", "arvados/v1/containers/"+cr.ContainerUUID, nil, nil)
 	if err != nil {
 		return "", err
-	} else if c.State != arvados.ContainerStateComplete {
+	}
+	cost := runner.containerCost(cr, c)
+	log.Printf("container request %s: %s", cr.UUID, cost)
+	if runner.LogDir != "" {
+		err := runner.saveLogs(cr)
+		if err != nil {
+			log.Errorf("error saving logs for container request %s: %s", cr.UUID, err)
+		}
+		err = cost.save(runner.LogDir)
+		if err != nil {
+			log.Errorf("error saving cost report for container request %s: %s", cr.UUID, err)
+		}
+	}
+	if c.State != arvados.ContainerStateComplete {
 		return "", fmt.Errorf("container did not complete: %s", c.State)
 	} else if c.ExitCode != 0 {
-		return "", fmt.Errorf("container exited %d", c.ExitCode)
+		cerr := &containerError{ExitCode: c.ExitCode}
+		if cr.OutputUUID != "" {
+			cerr.Diagnostic, err = fetchErrorJSON(runner.Client, cr.OutputUUID)
+			if err != nil {
+				log.Errorf("error retrieving error.json from output %s: %s", cr.OutputUUID, err)
+			}
+		}
+		return "", cerr
 	}
 	return cr.OutputUUID, err
 }
 
 var collectionInPathRe = regexp.MustCompile(`^(.*/)?([0-9a-f]{32}\+[0-9]+|[0-9a-z]{5}-[0-9a-z]{5}-[0-9a-z]{15})(/.*)?$`)
 
+// TranslatePaths adds collection mounts for the given paths (which
+// must refer to collections by UUID or portable data hash) and
+// changes them to the corresponding paths inside the container.
+// Collections on federated remote clusters are mounted via local
+// proxy collections (see proxyRemoteCollection), so their data is
+// read from the remote cluster without copying it first.
 func (runner *arvadosContainerRunner) TranslatePaths(paths ...*string) error {
 	if runner.Mounts == nil {
 		runner.Mounts = make(map[string]map[string]interface{})
@@ -460,7 +630,20 @@ func (runner *arvadosContainerRunner) TranslatePaths(paths ...*string) error {
 				"kind": "collection",
 			}
 			if len(collID) == 27 {
-				mnt["uuid"] = collID
+				mountUUID := collID
+				cluster, err := runner.remoteCluster(collID)
+				if err != nil {
+					return err
+				}
+				if cluster != "" && runner.DryRun != nil {
+					log.Printf("dry run: not creating local collection for %s on remote cluster %s", collID, cluster)
+				} else if cluster != "" {
+					mountUUID, err = runner.proxyRemoteCollection(collID)
+					if err != nil {
+						return err
+					}
+				}
+				mnt["uuid"] = mountUUID
 			} else {
 				mnt["portable_data_hash"] = collID
 			}
@@ -471,12 +654,39 @@ func (runner *arvadosContainerRunner) TranslatePaths(paths ...*string) error {
 	return nil
 }
 
+// AddSecretFile adds a secret mount at path in the container, with
+// the content of the local file fnm. Unlike TranslatePaths, this is
+// suitable for private keys and other credentials.
+func (runner *arvadosContainerRunner) AddSecretFile(path, fnm string) error {
+	buf, err := os.ReadFile(fnm)
+	if err != nil {
+		return err
+	}
+	if runner.SecretMounts == nil {
+		runner.SecretMounts = map[string]map[string]interface{}{}
+	}
+	runner.SecretMounts[path] = map[string]interface{}{
+		"kind":    "text",
+		"content": string(buf),
+	}
+	return nil
+}
+
 var mtxMakeCommandCollection sync.Mutex
 
 func (runner *arvadosContainerRunner) makeCommandCollection() (string, error) {
 	mtxMakeCommandCollection.Lock()
 	defer mtxMakeCommandCollection.Unlock()
-	exe, err := ioutil.ReadFile("/proc/self/exe")
+	if runtime.GOOS != "linux" {
+		// The binary is uploaded and run in a Linux
+		// container, so it has to be a Linux build.
+		return "", fmt.Errorf("cannot run containers from a %s build of lightning: use -local, or run a linux build", runtime.GOOS)
+	}
+	exepath, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	exe, err := ioutil.ReadFile(exepath)
 	if err != nil {
 		return "", err
 	}
@@ -603,27 +813,47 @@ func open(fnm string) (file, error) {
 	siteFSMtx.Lock()
 	defer siteFSMtx.Unlock()
 	if siteFS == nil {
-		log.Info("setting up Arvados client")
-		ac, err := arvadosclient.New(arvadosClientFromEnv)
+		err := setupKeepClient()
 		if err != nil {
 			return nil, err
 		}
-		ac.Client = arvados.DefaultSecureClient
-		keepClient = keepclient.New(ac)
-		// Don't use keepclient's default short timeouts.
-		keepClient.HTTPClient = arvados.DefaultSecureClient
-		keepClient.BlockCache = &keepclient.BlockCache{MaxBlocks: 4}
 		siteFS = arvadosClientFromEnv.SiteFileSystem(keepClient)
 	} else {
-		keepClient.BlockCache.MaxBlocks += 2
+		keepClient.BlockCache.MaxBlocks += keepBlocksPerFile
 	}
 
 	log.Infof("reading %q from %s using Arvados client", collectionPath, collectionUUID)
-	f, err := siteFS.Open("by_id/" + collectionUUID + collectionPath)
+	path := "by_id/" + collectionUUID + collectionPath
+	f, err := siteFS.Open(path)
 	if err != nil {
+		keepClient.BlockCache.MaxBlocks -= keepBlocksPerFile
 		return nil, err
 	}
-	return &reduceCacheOnClose{file: f}, nil
+	return &reduceCacheOnClose{file: &retryFile{
+		file:   f,
+		name:   fnm,
+		reopen: func() (file, error) { return siteFS.Open(path) },
+	}}, nil
+}
+
+// setupKeepClient initializes keepClient. Caller must have siteFSMtx
+// locked.
+func setupKeepClient() error {
+	if keepClient != nil {
+		return nil
+	}
+	log.Info("setting up Arvados client")
+	ac, err := arvadosclient.New(arvadosClientFromEnv)
+	if err != nil {
+		return err
+	}
+	ac.Client = arvados.DefaultSecureClient
+	keepClient = keepclient.New(ac)
+	// Don't use keepclient's default short timeouts.
+	keepClient.HTTPClient = arvados.DefaultSecureClient
+	keepClient.Retries = keepReadRetries
+	keepClient.BlockCache = &keepclient.BlockCache{MaxBlocks: 2 * keepBlocksPerFile}
+	return nil
 }
 
 type reduceCacheOnClose struct {
@@ -632,6 +862,6 @@ type reduceCacheOnClose struct {
 }
 
 func (rc *reduceCacheOnClose) Close() error {
-	rc.once.Do(func() { keepClient.BlockCache.MaxBlocks -= 2 })
+	rc.once.Do(func() { keepClient.BlockCache.MaxBlocks -= keepBlocksPerFile })
 	return rc.file.Close()
 }
@@ -0,0 +1,125 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"gopkg.in/check.v1"
+)
+
+type arvadosSuite struct{}
+
+var _ = check.Suite(&arvadosSuite{})
+
+func (s *arvadosSuite) TestDryRun(c *check.C) {
+	var buf bytes.Buffer
+	runner := arvadosContainerRunner{
+		Name:        "lightning test",
+		ProjectUUID: "zzzzz-j7d0g-123456789012345",
+		RAM:         1 << 30,
+		VCPUs:       2,
+		Priority:    123,
+		Args:        []string{"export", "-local=true", "-input-dir", "/mnt/input"},
+		DryRun:      &buf,
+	}
+	output, err := runner.Run()
+	c.Check(err, check.Equals, errDryRun)
+	c.Check(output, check.Equals, "")
+
+	var cr struct {
+		OwnerUUID          string                            `json:"owner_uuid"`
+		Name               string                            `json:"name"`
+		Command            []string                          `json:"command"`
+		Mounts             map[string]map[string]interface{} `json:"mounts"`
+		Priority           int                               `json:"priority"`
+		RuntimeConstraints struct {
+			RAM   int64 `json:"ram"`
+			VCPUs int   `json:"vcpus"`
+		} `json:"runtime_constraints"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &cr)
+	c.Assert(err, check.IsNil)
+	c.Check(cr.OwnerUUID, check.Equals, runner.ProjectUUID)
+	c.Check(cr.Name, check.Equals, "lightning test")
+	c.Check(cr.Command, check.DeepEquals, []string{"/mnt/cmd/lightning", "export", "-keep-block-cache=2", "-keep-retries=5", "-local=true", "-input-dir", "/mnt/input"})
+	c.Check(cr.Priority, check.Equals, 123)
+	c.Check(cr.RuntimeConstraints.RAM, check.Equals, int64(1<<30))
+	c.Check(cr.RuntimeConstraints.VCPUs, check.Equals, 2)
+	c.Check(cr.Mounts["/mnt/output"]["writable"], check.Equals, true)
+	c.Check(cr.Mounts["/mnt/cmd"], check.NotNil)
+}
+
+func (s *arvadosSuite) TestRemoteCluster(c *check.C) {
+	runner := arvadosContainerRunner{
+		Client: &arvados.Client{},
+		federation: &federationInfo{
+			UUIDPrefix:  "zzzzz",
+			RemoteHosts: map[string]string{"yyyyy": "yyyyy.example.com"},
+		},
+	}
+	cluster, err := runner.remoteCluster("zzzzz-4zz18-123456789012345")
+	c.Check(err, check.IsNil)
+	c.Check(cluster, check.Equals, "")
+	cluster, err = runner.remoteCluster("yyyyy-4zz18-123456789012345")
+	c.Check(err, check.IsNil)
+	c.Check(cluster, check.Equals, "yyyyy")
+	cluster, err = runner.remoteCluster("d41d8cd98f00b204e9800998ecf8427e+0")
+	c.Check(err, check.IsNil)
+	c.Check(cluster, check.Equals, "")
+	_, err = runner.remoteCluster("xxxxx-4zz18-123456789012345")
+	c.Check(err, check.ErrorMatches, `collection xxxxx-4zz18-123456789012345 belongs to cluster xxxxx, which is not a configured remote cluster of zzzzz`)
+
+	// In dry-run mode, remote collections are mounted directly
+	runner.DryRun = &bytes.Buffer{}
+	path := "yyyyy-4zz18-123456789012345/foo.gob"
+	c.Assert(runner.TranslatePaths(&path), check.IsNil)
+	c.Check(path, check.Equals, "/mnt/yyyyy-4zz18-123456789012345/foo.gob")
+	c.Check(runner.Mounts["/mnt/yyyyy-4zz18-123456789012345"]["uuid"], check.Equals, "yyyyy-4zz18-123456789012345")
+}
+
+func (s *arvadosSuite) TestStateWait(c *check.C) {
+	wait := stateWaitMin
+	var waits []time.Duration
+	for i := 0; i < 6; i++ {
+		wait = nextStateWait(wait, false)
+		waits = append(waits, wait)
+	}
+	c.Check(waits, check.DeepEquals, []time.Duration{
+		10 * time.Second,
+		20 * time.Second,
+		40 * time.Second,
+		time.Minute,
+		time.Minute,
+		time.Minute,
+	})
+	c.Check(nextStateWait(time.Minute, true), check.Equals, stateWaitMin)
+	c.Check(nextStateWait(20*time.Second, true), check.Equals, stateWaitMin)
+}
+
+func (s *arvadosSuite) TestContainerOptions(c *check.C) {
+	var stdout bytes.Buffer
+	for _, trial := range []struct {
+		args   []string
+		dryRun bool
+	}{
+		{nil, false},
+		{[]string{"-dry-run", "-save-logs=/tmp/logs", "-no-websocket"}, true},
+	} {
+		var co containerOptions
+		flags := flag.NewFlagSet("", flag.ContinueOnError)
+		co.Flags(flags)
+		c.Assert(flags.Parse(trial.args), check.IsNil)
+		var runner arvadosContainerRunner
+		co.Apply(&runner, &stdout)
+		c.Check(runner.DryRun != nil, check.Equals, trial.dryRun)
+		c.Check(runner.LogDir, check.Equals, map[bool]string{true: "/tmp/logs"}[trial.dryRun])
+		c.Check(runner.NoWebsocket, check.Equals, trial.dryRun)
+	}
+}
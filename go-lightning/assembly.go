@@ -0,0 +1,176 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TileAssembly tiles the contigs of an assembly (e.g., from long
+// reads). Unlike the chromosome sequences handled by TileFasta, a
+// contig can be any part of a chromosome, in either orientation.
+//
+// Each contig is anchored by finding tags in the contig and in its
+// reverse complement, and using whichever orientation yields the
+// longer chain of tags in reference order. Tiles are generated only
+// between consecutive anchors, so the partial tiles at the ends of
+// each contig don't get added to the library, and tags that aren't
+// covered by any contig are left as no-calls.
+//
+// This is experimental.
+func (tilelib *tileLibrary) TileAssembly(filelabel string, rdr io.Reader) (tileSeq, []importStats, error) {
+	ret := tileSeq{}
+	var stats []importStats
+	var totalLength, totalUnanchored int
+	var src tileVariantSource
+	if tilelib.trackProvenance {
+		src = tileVariantSource{Source: filelabel, Time: time.Now().Unix()}
+	}
+	in := bufio.NewReaderSize(rdr, 1<<20)
+	for {
+		seqlabel, seq, err := readFastaSequence(in)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		fwd, err := tilelib.assemblyAnchors(seq)
+		if err != nil {
+			return nil, nil, err
+		}
+		rc := reverseComplement(seq)
+		rev, err := tilelib.assemblyAnchors(rc)
+		if err != nil {
+			return nil, nil, err
+		}
+		reversed := len(rev) > len(fwd)
+		anchors := fwd
+		if reversed {
+			seq, anchors = rc, rev
+		}
+
+		var path []tileLibRef
+		anchored := 0
+		if len(anchors) > 1 {
+			path = make([]tileLibRef, len(anchors)-1)
+			for i := range path {
+				startpos := anchors[i].pos
+				endpos := anchors[i+1].pos + anchors[i+1].taglen
+				path[i] = tilelib.getRefFrom(anchors[i].tagid, seq[startpos:endpos], false, src)
+			}
+			anchored = anchors[len(anchors)-1].pos + anchors[len(anchors)-1].taglen - anchors[0].pos
+		}
+		if len(path) > 0 {
+			ret[seqlabel] = path
+		}
+		totalLength += len(seq)
+		totalUnanchored += len(seq) - anchored
+		log.Debugf("%s %s length %d anchors %d reversed %v unanchored %d", filelabel, seqlabel, len(seq), len(anchors), reversed, len(seq)-anchored)
+		stats = append(stats, importStats{
+			InputFile:        filelabel,
+			InputLabel:       seqlabel,
+			InputLength:      len(seq),
+			InputCoverage:    countBases(seq),
+			PathLength:       len(path),
+			Reversed:         reversed,
+			UnanchoredLength: len(seq) - anchored,
+		})
+	}
+	if totalLength > 0 {
+		log.Printf("%s tiled %d of %d contigs, unanchored %d of %d bases (%.2f%%)", filelabel, len(ret), len(stats), totalUnanchored, totalLength, 100*float64(totalUnanchored)/float64(totalLength))
+	} else {
+		log.Warnf("%s contains no sequence data", filelabel)
+	}
+	return ret, stats, nil
+}
+
+type assemblyAnchor struct {
+	pos    int
+	tagid  tagID
+	taglen int
+}
+
+// assemblyAnchors returns the longest chain of tags that appear in
+// seq in reference order, ignoring tags that appear more than once.
+func (tilelib *tileLibrary) assemblyAnchors(seq []byte) ([]assemblyAnchor, error) {
+	var found []assemblyAnchor
+	count := map[tagID]int{}
+	err := tilelib.taglib.FindAll(bufio.NewReader(bytes.NewReader(seq)), nil, func(tagid tagID, pos, taglen int) {
+		found = append(found, assemblyAnchor{pos: pos, tagid: tagid, taglen: taglen})
+		count[tagid]++
+	})
+	if err != nil {
+		return nil, err
+	}
+	unique := found[:0]
+	for _, a := range found {
+		if count[a.tagid] == 1 {
+			unique = append(unique, a)
+		}
+	}
+	keep := longestIncreasingSubsequence(len(unique), func(i int) int { return int(unique[i].tagid) })
+	chain := make([]assemblyAnchor, len(keep))
+	for i, x := range keep {
+		chain[i] = unique[x]
+	}
+	return chain, nil
+}
+
+// readFastaSequence returns the label and (lowercased) sequence of
+// the next sequence in a fasta file, or io.EOF if there are no more
+// sequences.
+func readFastaSequence(in *bufio.Reader) (string, []byte, error) {
+	var label string
+	for {
+		line, err := in.ReadBytes('\n')
+		if len(line) > 0 && line[0] == '>' {
+			label = string(bytes.TrimRight(line[1:], "\r\n"))
+			break
+		} else if err != nil {
+			return "", nil, err
+		}
+	}
+	var seq []byte
+	for {
+		if buf, err := in.Peek(1); err == io.EOF || (err == nil && buf[0] == '>') {
+			break
+		}
+		line, err := in.ReadBytes('\n')
+		seq = append(seq, bytes.ToLower(bytes.TrimRight(line, "\r\n"))...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", nil, err
+		}
+	}
+	return label, seq, nil
+}
+
+var complement = func() [256]byte {
+	var c [256]byte
+	for i := range c {
+		c[i] = 'n'
+	}
+	for _, pair := range []string{"ac", "ca", "gt", "tg"} {
+		c[pair[0]] = pair[1]
+		c[pair[0]-'a'+'A'] = pair[1]
+	}
+	return c
+}()
+
+// reverseComplement returns the reverse complement of a (lowercase)
+// sequence. Non-ACGT bytes become 'n'.
+func reverseComplement(seq []byte) []byte {
+	rc := make([]byte, len(seq))
+	for i, b := range seq {
+		rc[len(seq)-1-i] = complement[b]
+	}
+	return rc
+}
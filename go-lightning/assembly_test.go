@@ -0,0 +1,40 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *tilelibSuite) TestTileAssembly(c *check.C) {
+	tag := func(i int) string { return strings.TrimSuffix(s.tag[i], "\n") }
+	contig := "acgtacgtac" + tag(1) + "cccccccccc" + tag(2) + "gggggggggg" + tag(3) + "tttt"
+	rc := string(reverseComplement([]byte(contig)))
+	c.Check(string(reverseComplement([]byte(rc))), check.Equals, contig)
+
+	tilelib := &tileLibrary{taglib: &s.taglib}
+	tseq, stats, err := tilelib.TileAssembly("test-label", bytes.NewBufferString(
+		">fwd contig\n"+contig[:50]+"\n"+contig[50:]+"\n"+
+			">rev\r\n"+strings.ToUpper(rc)+"\r\n"+
+			">unanchored\n"+"acgtacgtacgtacgt"+tag(4)+"\n"))
+	c.Assert(err, check.IsNil)
+	c.Check(tseq, check.DeepEquals, tileSeq{
+		"fwd contig": []tileLibRef{{1, 1}, {2, 1}},
+		"rev":        []tileLibRef{{1, 1}, {2, 1}},
+	})
+	c.Assert(stats, check.HasLen, 3)
+	c.Check(stats[0].InputLabel, check.Equals, "fwd contig")
+	c.Check(stats[0].InputLength, check.Equals, len(contig))
+	c.Check(stats[0].Reversed, check.Equals, false)
+	c.Check(stats[0].UnanchoredLength, check.Equals, 14)
+	c.Check(stats[1].InputLabel, check.Equals, "rev")
+	c.Check(stats[1].Reversed, check.Equals, true)
+	c.Check(stats[1].UnanchoredLength, check.Equals, 14)
+	c.Check(stats[2].PathLength, check.Equals, 0)
+	c.Check(stats[2].UnanchoredLength, check.Equals, 16+len(tag(4)))
+}
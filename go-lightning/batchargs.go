@@ -48,7 +48,9 @@ func (b *batchArgs) RunBatches(ctx context.Context, runFunc func(context.Context
 			outputs[batch] = out
 			if err != nil {
 				wg.Error(err)
-				cancel()
+				if err != errDryRun {
+					cancel()
+				}
 			}
 		}()
 	}
@@ -0,0 +1,82 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// bedComplement reads BED intervals, sorted by position within each
+// chromosome, and writes the intervals not covered by them (like
+// "bedtools complement"). Only chromosomes that appear in the input
+// are included in the output. If a chromosome's size is not in
+// chrSize, the gap after its last interval is omitted.
+func bedComplement(regions io.Reader, w io.Writer, chrSize map[string]int) error {
+	var (
+		chr  string
+		end  int // end of covered region so far on chr
+		done = map[string]bool{}
+	)
+	emit := func(chr string, start, end int) error {
+		if start >= end {
+			return nil
+		}
+		_, err := fmt.Fprintf(w, "%s\t%d\t%d\n", chr, start, end)
+		return err
+	}
+	finish := func() error {
+		if chr == "" {
+			return nil
+		}
+		done[chr] = true
+		size, ok := chrSize[chr]
+		if !ok {
+			log.Warnf("bedComplement: size of %q is unknown, not masking after %d", chr, end)
+			return nil
+		}
+		return emit(chr, end, size)
+	}
+	scanner := bufio.NewScanner(regions)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 3 {
+			return fmt.Errorf("line %d: expected at least 3 fields, found %d", lineno, len(fields))
+		}
+		start, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return fmt.Errorf("line %d: invalid start %q", lineno, fields[1])
+		}
+		stop, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return fmt.Errorf("line %d: invalid end %q", lineno, fields[2])
+		}
+		if fields[0] != chr {
+			if err := finish(); err != nil {
+				return err
+			}
+			chr = fields[0]
+			if done[chr] {
+				return fmt.Errorf("line %d: input is not sorted: chromosome %q appears in more than one place", lineno, chr)
+			}
+			end = 0
+		}
+		if err := emit(chr, end, start); err != nil {
+			return err
+		}
+		if stop > end {
+			end = stop
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return finish()
+}
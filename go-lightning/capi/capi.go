@@ -0,0 +1,197 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+// Command capi is a C shared library for querying lightning
+// libraries from other languages (see lightning.py for a Python
+// wrapper). Build with:
+//
+//	make capi/liblightning.so
+//
+// which also writes the C header capi/liblightning.h.
+//
+// Functions that return a pointer return NULL on error, and
+// functions that return an integer return -1 on error. In either
+// case, lightning_last_error returns the error message. Strings and
+// buffers returned by these functions must be released with
+// lightning_free.
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"sync"
+	"unsafe"
+
+	"github.com/arvados/lightning/go-lightning/libio"
+)
+
+var (
+	mtx        sync.Mutex
+	libraries  = map[C.int64_t]*library{}
+	nextHandle = C.int64_t(1)
+	lastError  string
+)
+
+var errBadHandle = errors.New("invalid library handle")
+
+func setError(err error) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	lastError = err.Error()
+}
+
+func getLibrary(h C.int64_t) (*library, error) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	lib, ok := libraries[h]
+	if !ok {
+		return nil, errBadHandle
+	}
+	return lib, nil
+}
+
+// lightning_open loads the library file (or directory of library
+// files) at path, and returns a handle for use with the other
+// functions.
+//
+//export lightning_open
+func lightning_open(path *C.char) C.int64_t {
+	lib, err := loadLibrary(C.GoString(path))
+	if err != nil {
+		setError(err)
+		return -1
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	h := nextHandle
+	nextHandle++
+	libraries[h] = lib
+	return h
+}
+
+// lightning_close releases the memory used by a library.
+//
+//export lightning_close
+func lightning_close(h C.int64_t) C.int {
+	mtx.Lock()
+	defer mtx.Unlock()
+	if _, ok := libraries[h]; !ok {
+		lastError = errBadHandle.Error()
+		return -1
+	}
+	delete(libraries, h)
+	return 0
+}
+
+// lightning_last_error returns the message from the most recent
+// error.
+//
+//export lightning_last_error
+func lightning_last_error() *C.char {
+	mtx.Lock()
+	defer mtx.Unlock()
+	return C.CString(lastError)
+}
+
+// lightning_free releases a string or buffer returned by one of the
+// other functions.
+//
+//export lightning_free
+func lightning_free(p unsafe.Pointer) {
+	C.free(p)
+}
+
+// lightning_tag_count returns the number of tags in the library's
+// tag set.
+//
+//export lightning_tag_count
+func lightning_tag_count(h C.int64_t) C.int64_t {
+	lib, err := getLibrary(h)
+	if err != nil {
+		setError(err)
+		return -1
+	}
+	return C.int64_t(len(lib.tagset))
+}
+
+// lightning_sample_count returns the number of samples in the
+// library.
+//
+//export lightning_sample_count
+func lightning_sample_count(h C.int64_t) C.int64_t {
+	lib, err := getLibrary(h)
+	if err != nil {
+		setError(err)
+		return -1
+	}
+	return C.int64_t(len(lib.names))
+}
+
+// lightning_sample_name returns the name of the i'th sample (in
+// sorted order).
+//
+//export lightning_sample_name
+func lightning_sample_name(h C.int64_t, i C.int64_t) *C.char {
+	lib, err := getLibrary(h)
+	if err != nil {
+		setError(err)
+		return nil
+	}
+	if i < 0 || int(i) >= len(lib.names) {
+		setError(errors.New("sample index out of range"))
+		return nil
+	}
+	return C.CString(lib.names[i])
+}
+
+// lightning_tile_variant returns the sequence of the given tile
+// variant, and stores its length in *length. The sequence is not
+// NUL-terminated.
+//
+//export lightning_tile_variant
+func lightning_tile_variant(h C.int64_t, tag C.int32_t, variant C.uint16_t, length *C.size_t) *C.char {
+	lib, err := getLibrary(h)
+	if err != nil {
+		setError(err)
+		return nil
+	}
+	seq, err := lib.tileVariant(libio.TagID(tag), libio.TileVariantID(variant))
+	if err != nil {
+		setError(err)
+		return nil
+	}
+	*length = C.size_t(len(seq))
+	return (*C.char)(C.CBytes(seq))
+}
+
+// lightning_sample_path writes the tile variants called in the given
+// sample for tags [start, end) to out, which must have room for
+// 2*(end-start) values (two per tag, one for each phase; 0 means no
+// call). It returns the number of values written.
+//
+//export lightning_sample_path
+func lightning_sample_path(h C.int64_t, sample *C.char, start, end C.int32_t, out *C.uint16_t) C.int64_t {
+	lib, err := getLibrary(h)
+	if err != nil {
+		setError(err)
+		return -1
+	}
+	path, err := lib.samplePath(C.GoString(sample), libio.TagID(start), libio.TagID(end))
+	if err != nil {
+		setError(err)
+		return -1
+	}
+	if len(path) > 0 {
+		dst := unsafe.Slice((*libio.TileVariantID)(unsafe.Pointer(out)), len(path))
+		copy(dst, path)
+	}
+	return C.int64_t(len(path))
+}
+
+func main() {}
@@ -0,0 +1,132 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/arvados/lightning/go-lightning/libio"
+)
+
+// library is an in-memory index of a lightning library, loaded by
+// lightning_open.
+type library struct {
+	tagset    [][]byte
+	sequences map[libio.TileLibRef][]byte
+	genomes   map[string][]libio.CompactGenome
+	names     []string
+}
+
+// loadLibrary reads a library file, or all *.gob and *.gob.gz files
+// in a directory (e.g., the output of "lightning slice").
+func loadLibrary(path string) (*library, error) {
+	fnms := []string{path}
+	if fi, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if fi.IsDir() {
+		fnms = nil
+		for _, pattern := range []string{"*.gob", "*.gob.gz"} {
+			matches, err := filepath.Glob(filepath.Join(path, pattern))
+			if err != nil {
+				return nil, err
+			}
+			fnms = append(fnms, matches...)
+		}
+		if len(fnms) == 0 {
+			return nil, fmt.Errorf("%s: no *.gob or *.gob.gz files in directory", path)
+		}
+		sort.Strings(fnms)
+	}
+	lib := &library{
+		sequences: map[libio.TileLibRef][]byte{},
+		genomes:   map[string][]libio.CompactGenome{},
+	}
+	for _, fnm := range fnms {
+		err := lib.load(fnm)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fnm, err)
+		}
+	}
+	for name := range lib.genomes {
+		lib.names = append(lib.names, name)
+	}
+	sort.Strings(lib.names)
+	return lib, nil
+}
+
+func (lib *library) load(fnm string) error {
+	f, err := os.Open(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rdr, err := libio.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	return rdr.Read(libio.Handlers{
+		TagSet: func(tagset [][]byte) error {
+			if lib.tagset == nil {
+				lib.tagset = tagset
+			}
+			return nil
+		},
+		TileVariant: func(tv *libio.TileVariant) error {
+			if len(tv.Sequence) > 0 {
+				lib.sequences[libio.TileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = tv.Sequence
+			}
+			return nil
+		},
+		CompactGenome: func(cg *libio.CompactGenome) error {
+			lib.genomes[cg.Name] = append(lib.genomes[cg.Name], *cg)
+			return nil
+		},
+	})
+}
+
+// tileVariant returns the sequence of the given tile variant.
+func (lib *library) tileVariant(tag libio.TagID, variant libio.TileVariantID) ([]byte, error) {
+	seq, ok := lib.sequences[libio.TileLibRef{Tag: tag, Variant: variant}]
+	if !ok {
+		return nil, fmt.Errorf("tile variant %d.%d not found in library (or library was written without sequences)", tag, variant)
+	}
+	return seq, nil
+}
+
+// samplePath returns the tile variants (two per tag, one for each
+// phase) called in the given sample for tags [start, end). Tags
+// that are not covered by the library are returned as 0 (no call).
+func (lib *library) samplePath(name string, start, end libio.TagID) ([]libio.TileVariantID, error) {
+	cgs, ok := lib.genomes[name]
+	if !ok {
+		return nil, fmt.Errorf("sample %q not found in library", name)
+	}
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("invalid tag range [%d, %d)", start, end)
+	}
+	path := make([]libio.TileVariantID, 2*int(end-start))
+	for _, cg := range cgs {
+		cgend := cg.EndTag
+		if cgend == 0 {
+			cgend = cg.StartTag + libio.TagID(len(cg.Variants)/2)
+		}
+		for tag := start; tag < end; tag++ {
+			if tag < cg.StartTag || tag >= cgend {
+				continue
+			}
+			i := int(tag-cg.StartTag) * 2
+			if i+1 >= len(cg.Variants) {
+				continue
+			}
+			j := int(tag-start) * 2
+			path[j], path[j+1] = cg.Variants[i], cg.Variants[i+1]
+		}
+	}
+	return path, nil
+}
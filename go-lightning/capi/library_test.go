@@ -0,0 +1,60 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/arvados/lightning/go-lightning/libio"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type librarySuite struct{}
+
+var _ = check.Suite(&librarySuite{})
+
+func (s *librarySuite) TestLoad(c *check.C) {
+	tmpdir := c.MkDir()
+	for i, fnm := range []string{"library1.gob.gz", "library2.gob"} {
+		f, err := os.Create(tmpdir + "/" + fnm)
+		c.Assert(err, check.IsNil)
+		w := libio.NewWriter(f, i == 0)
+		start := libio.TagID(i * 2)
+		c.Assert(w.WriteTileVariants([]libio.TileVariant{
+			{Tag: start, Variant: 1, Sequence: []byte("acgt")},
+			{Tag: start + 1, Variant: 2, Sequence: []byte("ggcc")},
+		}), check.IsNil)
+		c.Assert(w.WriteCompactGenomes([]libio.CompactGenome{
+			{Name: "sample1", Variants: []libio.TileVariantID{1, 1, 2, 0}, StartTag: start, EndTag: start + 2},
+		}), check.IsNil)
+		c.Assert(w.Close(), check.IsNil)
+		c.Assert(f.Close(), check.IsNil)
+	}
+
+	lib, err := loadLibrary(tmpdir)
+	c.Assert(err, check.IsNil)
+	c.Check(lib.names, check.DeepEquals, []string{"sample1"})
+
+	seq, err := lib.tileVariant(3, 2)
+	c.Check(err, check.IsNil)
+	c.Check(string(seq), check.Equals, "ggcc")
+	_, err = lib.tileVariant(3, 1)
+	c.Check(err, check.ErrorMatches, `tile variant 3\.1 not found.*`)
+
+	path, err := lib.samplePath("sample1", 1, 5)
+	c.Check(err, check.IsNil)
+	c.Check(path, check.DeepEquals, []libio.TileVariantID{2, 0, 1, 1, 2, 0, 0, 0})
+	_, err = lib.samplePath("sample2", 0, 1)
+	c.Check(err, check.ErrorMatches, `sample "sample2" not found.*`)
+
+	lib, err = loadLibrary(tmpdir + "/library2.gob")
+	c.Assert(err, check.IsNil)
+	path, err = lib.samplePath("sample1", 0, 3)
+	c.Check(err, check.IsNil)
+	c.Check(path, check.DeepEquals, []libio.TileVariantID{0, 0, 0, 0, 1, 1})
+}
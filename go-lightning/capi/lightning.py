@@ -0,0 +1,125 @@
+# Copyright (C) The Lightning Authors. All rights reserved.
+#
+# SPDX-License-Identifier: AGPL-3.0
+
+"""Query lightning libraries from Python.
+
+Build the shared library first:
+
+    make capi/liblightning.so
+
+Then:
+
+    import lightning
+    lib = lightning.Library('library.gob.gz')
+    lib.samples()                  # ['sample1', 'sample2', ...]
+    lib.tile_variant(123, 2)       # b'acgt...'
+    lib.sample_path('sample1', 0, 100)  # [1, 1, 2, 1, ...]
+
+Set LIGHTNING_LIB to the path of liblightning.so if it is not next
+to this file.
+"""
+
+import ctypes
+import os
+
+_libpath = os.environ.get(
+    'LIGHTNING_LIB',
+    os.path.join(os.path.dirname(os.path.abspath(__file__)), 'liblightning.so'))
+_c = ctypes.CDLL(_libpath)
+
+_c.lightning_open.argtypes = [ctypes.c_char_p]
+_c.lightning_open.restype = ctypes.c_int64
+_c.lightning_close.argtypes = [ctypes.c_int64]
+_c.lightning_close.restype = ctypes.c_int
+_c.lightning_last_error.argtypes = []
+_c.lightning_last_error.restype = ctypes.c_void_p
+_c.lightning_free.argtypes = [ctypes.c_void_p]
+_c.lightning_free.restype = None
+_c.lightning_tag_count.argtypes = [ctypes.c_int64]
+_c.lightning_tag_count.restype = ctypes.c_int64
+_c.lightning_sample_count.argtypes = [ctypes.c_int64]
+_c.lightning_sample_count.restype = ctypes.c_int64
+_c.lightning_sample_name.argtypes = [ctypes.c_int64, ctypes.c_int64]
+_c.lightning_sample_name.restype = ctypes.c_void_p
+_c.lightning_tile_variant.argtypes = [ctypes.c_int64, ctypes.c_int32, ctypes.c_uint16, ctypes.POINTER(ctypes.c_size_t)]
+_c.lightning_tile_variant.restype = ctypes.c_void_p
+_c.lightning_sample_path.argtypes = [ctypes.c_int64, ctypes.c_char_p, ctypes.c_int32, ctypes.c_int32, ctypes.POINTER(ctypes.c_uint16)]
+_c.lightning_sample_path.restype = ctypes.c_int64
+
+
+class LightningError(Exception):
+    pass
+
+
+def _error():
+    p = _c.lightning_last_error()
+    try:
+        return LightningError(ctypes.string_at(p).decode())
+    finally:
+        _c.lightning_free(p)
+
+
+def _string(p):
+    if not p:
+        raise _error()
+    try:
+        return ctypes.string_at(p).decode()
+    finally:
+        _c.lightning_free(p)
+
+
+class Library:
+    """A lightning library file, or a directory of library files,
+    loaded into memory."""
+
+    def __init__(self, path):
+        self._h = _c.lightning_open(os.fsencode(path))
+        if self._h < 0:
+            raise _error()
+
+    def close(self):
+        if self._h >= 0:
+            _c.lightning_close(self._h)
+            self._h = -1
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *args):
+        self.close()
+
+    def __del__(self):
+        self.close()
+
+    def tag_count(self):
+        n = _c.lightning_tag_count(self._h)
+        if n < 0:
+            raise _error()
+        return n
+
+    def samples(self):
+        n = _c.lightning_sample_count(self._h)
+        if n < 0:
+            raise _error()
+        return [_string(_c.lightning_sample_name(self._h, i)) for i in range(n)]
+
+    def tile_variant(self, tag, variant):
+        """Return the sequence of the given tile variant, as bytes."""
+        length = ctypes.c_size_t()
+        p = _c.lightning_tile_variant(self._h, tag, variant, ctypes.byref(length))
+        if not p:
+            raise _error()
+        try:
+            return ctypes.string_at(p, length.value)
+        finally:
+            _c.lightning_free(p)
+
+    def sample_path(self, sample, start, end):
+        """Return the tile variants called in the given sample for tags
+        start..end-1: two per tag (one for each phase), 0 for no call."""
+        out = (ctypes.c_uint16 * (2 * max(end - start, 0)))()
+        n = _c.lightning_sample_path(self._h, sample.encode(), start, end, out)
+        if n < 0:
+            raise _error()
+        return list(out[:n])
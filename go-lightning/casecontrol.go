@@ -0,0 +1,105 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+)
+
+// caseControlStats summarizes a one-hot column's association with
+// case/control status in the training set.
+type caseControlStats struct {
+	caseAF    float64 // frequency of the column's tile variant in cases
+	controlAF float64 // frequency of the column's tile variant in controls
+	oddsRatio float64 // odds ratio of the column's genotype (hom or het)
+	ciLow     float64 // lower bound of 95% confidence interval of oddsRatio
+	ciHigh    float64 // upper bound of 95% confidence interval of oddsRatio
+}
+
+// caseControlAF returns the allele frequency of a tile variant among
+// cases and controls, given the hom and het one-hot columns for the
+// variant (see homhet2maf).
+func caseControlAF(homhet [][]bool, cases []bool) (caseAF, controlAF float64) {
+	var n, total [2]int // [0] = cases, [1] = controls
+	for i, isCase := range cases {
+		g := 1
+		if isCase {
+			g = 0
+		}
+		total[g] += 2
+		if homhet[0][i] {
+			n[g] += 2
+		} else if homhet[1][i] {
+			n[g]++
+		}
+	}
+	if total[0] > 0 {
+		caseAF = float64(n[0]) / float64(total[0])
+	}
+	if total[1] > 0 {
+		controlAF = float64(n[1]) / float64(total[1])
+	}
+	return
+}
+
+// oddsRatio returns the odds ratio of x between cases and controls,
+// and its 95% confidence interval (Woolf's method). If any cell of
+// the 2x2 table is zero, 0.5 is added to all cells (Haldane-Anscombe
+// correction).
+func oddsRatio(x, cases []bool) (or, lo, hi float64) {
+	var a, b, c, d float64 // x&case, x&control, !x&case, !x&control
+	for i, isCase := range cases {
+		switch {
+		case x[i] && isCase:
+			a++
+		case x[i]:
+			b++
+		case isCase:
+			c++
+		default:
+			d++
+		}
+	}
+	if a == 0 || b == 0 || c == 0 || d == 0 {
+		a, b, c, d = a+0.5, b+0.5, c+0.5, d+0.5
+	}
+	or = a * d / (b * c)
+	se := math.Sqrt(1/a + 1/b + 1/c + 1/d)
+	return or, or * math.Exp(-1.96*se), or * math.Exp(1.96*se)
+}
+
+// writeCaseControlStats writes a CSV file with the p-value and
+// case/control statistics of each one-hot column.
+func writeCaseControlStats(fnm string, xrefs []onehotXref) error {
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriterSize(f, 1<<20)
+	_, err = fmt.Fprint(bufw, "ColumnID,Column,Tag,Variant,Hom,PValue,CaseAF,ControlAF,OddsRatio,OddsRatioCILow,OddsRatioCIHigh\n")
+	if err != nil {
+		return err
+	}
+	for i, xref := range xrefs {
+		hom := 0
+		if xref.hom {
+			hom = 1
+		}
+		cc := xref.caseControl
+		_, err = fmt.Fprintf(bufw, "%s,%d,%d,%d,%d,%g,%g,%g,%g,%g,%g\n", xref.columnID(), i, xref.tag, xref.variant, hom, xref.pvalue, cc.caseAF, cc.controlAF, cc.oddsRatio, cc.ciLow, cc.ciHigh)
+		if err != nil {
+			return err
+		}
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
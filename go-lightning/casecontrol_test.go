@@ -0,0 +1,62 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"math"
+	"os"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type caseControlSuite struct{}
+
+var _ = check.Suite(&caseControlSuite{})
+
+func (s *caseControlSuite) TestCaseControlAF(c *check.C) {
+	cases := []bool{true, true, false, false, false}
+	hom := []bool{true, false, false, false, true}
+	het := []bool{false, true, true, false, false}
+	caseAF, controlAF := caseControlAF([][]bool{hom, het}, cases)
+	c.Check(caseAF, check.Equals, 3.0/4)
+	c.Check(controlAF, check.Equals, 3.0/6)
+
+	caseAF, controlAF = caseControlAF([][]bool{{false}, {true}}, []bool{false})
+	c.Check(caseAF, check.Equals, 0.0)
+	c.Check(controlAF, check.Equals, 0.5)
+}
+
+func (s *caseControlSuite) TestOddsRatio(c *check.C) {
+	// x&case=3, x&control=1, !x&case=2, !x&control=4
+	x := []bool{true, true, true, true, false, false, false, false, false, false}
+	cases := []bool{true, true, true, false, true, true, false, false, false, false}
+	or, lo, hi := oddsRatio(x, cases)
+	c.Check(or, check.Equals, 6.0)
+	se := math.Sqrt(1.0/3 + 1 + 1.0/2 + 1.0/4)
+	c.Check(math.Abs(lo-6*math.Exp(-1.96*se)) < 1e-9, check.Equals, true, check.Commentf("lo %v", lo))
+	c.Check(math.Abs(hi-6*math.Exp(1.96*se)) < 1e-9, check.Equals, true, check.Commentf("hi %v", hi))
+
+	// zero cell => Haldane-Anscombe correction
+	or, lo, hi = oddsRatio([]bool{true, false, false}, []bool{true, true, false})
+	c.Check(or, check.Equals, (1.5*1.5)/(0.5*1.5))
+	c.Check(lo < or && or < hi, check.Equals, true)
+}
+
+func (s *caseControlSuite) TestWriteCaseControlStats(c *check.C) {
+	fnm := c.MkDir() + "/onehot-case-control.csv"
+	err := writeCaseControlStats(fnm, []onehotXref{
+		{tag: 5, variant: 2, hom: true, pvalue: 0.25, caseControl: caseControlStats{0.5, 0.25, 3, 0.5, 18}},
+		{tag: 5, variant: 2, pvalue: 1},
+	})
+	c.Assert(err, check.IsNil)
+	buf, err := os.ReadFile(fnm)
+	c.Assert(err, check.IsNil)
+	lines := strings.Split(string(buf), "\n")
+	c.Check(lines, check.HasLen, 4)
+	c.Check(lines[0], check.Equals, "ColumnID,Column,Tag,Variant,Hom,PValue,CaseAF,ControlAF,OddsRatio,OddsRatioCILow,OddsRatioCIHigh")
+	c.Check(lines[1], check.Matches, `[^,]+,0,5,2,1,0.25,0.5,0.25,3,0.5,18`)
+	c.Check(lines[2], check.Matches, `[^,]+,1,5,2,0,1,0,0,0,0,0`)
+}
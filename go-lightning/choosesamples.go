@@ -5,7 +5,7 @@
 package lightning
 
 import (
-	"bytes"
+	"encoding/csv"
 	"errors"
 	"flag"
 	"fmt"
@@ -14,7 +14,6 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
-	"regexp"
 	"sort"
 	"strings"
 
@@ -23,7 +22,17 @@ import (
 )
 
 type chooseSamples struct {
-	filter filter
+	filter    Filter
+	matchMode string // "substring" or "exact"
+}
+
+// sampleMatchProblem describes a case-control file entry that did
+// not map cleanly onto exactly one sample ID.
+type sampleMatchProblem struct {
+	File      string
+	Pattern   string
+	Problem   string // "unmatched", "ambiguous", or "conflict"
+	SampleIDs []string
 }
 
 func (cmd *chooseSamples) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
@@ -42,14 +51,21 @@ func (cmd *chooseSamples) run(prog string, args []string, stdin io.Reader, stdou
 	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
 	projectUUID := flags.String("project", "", "project `UUID` for output data")
 	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
 	inputDir := flags.String("input-dir", "./in", "input `directory`")
 	outputDir := flags.String("output-dir", "./out", "output `directory`")
 	trainingSetSize := flags.Float64("training-set-size", 0.8, "number (or proportion, if <=1) of eligible samples to assign to the training set")
-	caseControlFilename := flags.String("case-control-file", "", "tsv file or directory indicating cases and controls (if directory, all .tsv files will be read)")
-	caseControlColumn := flags.String("case-control-column", "", "name of case/control column in case-control files (value must be 0 for control, 1 for case)")
+	caseControlFilename := flags.String("case-control-file", "", "tsv/csv file or directory indicating cases and controls (if directory, all files will be read)")
+	caseControlColumn := flags.String("case-control-column", "", "name of case/control column in case-control files, case-insensitive (value must be 0 for control, 1 for case)")
+	sampleIDColumn := flags.String("sample-id-column", "", "name of sample ID column in case-control files, case-insensitive (default: first column)")
+	delimiter := flags.String("case-control-delimiter", "", "field delimiter in case-control files: a single character, or \"tab\" (default: comma for *.csv files, otherwise tab)")
+	caseControlProperties := flags.String("case-control-properties", "", "read sample IDs and case/control values from the properties of the given Arvados `UUIDs` (comma-separated project, collection, and container request UUIDs; a project means all collections and container requests in it), using -case-control-column as the case/control property name")
+	sampleIDProperty := flags.String("sample-id-property", "sample_id", "name of sample ID `property` when using -case-control-properties")
+	flags.StringVar(&cmd.matchMode, "match", "substring", "how to match sample IDs in case-control files to genome names: `substring` or exact")
 	randSeed := flags.Int64("random-seed", 0, "PRNG seed")
 	cmd.filter.Flags(flags)
-	err := flags.Parse(args)
+	err := parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		return nil
 	} else if err != nil {
@@ -57,8 +73,17 @@ func (cmd *chooseSamples) run(prog string, args []string, stdin io.Reader, stdou
 	} else if flags.NArg() > 0 {
 		return fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
 	}
-	if (*caseControlFilename == "") != (*caseControlColumn == "") {
-		return errors.New("must provide both -case-control-file and -case-control-column, or neither")
+	if (*caseControlFilename == "" && *caseControlProperties == "") != (*caseControlColumn == "") {
+		return errors.New("must provide -case-control-column if and only if -case-control-file or -case-control-properties is provided")
+	}
+	if cmd.matchMode != "substring" && cmd.matchMode != "exact" {
+		return fmt.Errorf("invalid -match value %q: must be substring or exact", cmd.matchMode)
+	}
+	if *delimiter != "" {
+		_, err = parseDelimiter(*delimiter)
+		if err != nil {
+			return err
+		}
 	}
 
 	if *pprof != "" {
@@ -78,7 +103,11 @@ func (cmd *chooseSamples) run(prog string, args []string, stdin io.Reader, stdou
 			KeepCache:   2,
 			APIAccess:   true,
 		}
+		containerOpts.Apply(&runner, stdout)
 		err = runner.TranslatePaths(inputDir, caseControlFilename)
+		if err == nil {
+			err = cmd.filter.TranslatePaths(&runner)
+		}
 		if err != nil {
 			return err
 		}
@@ -88,13 +117,21 @@ func (cmd *chooseSamples) run(prog string, args []string, stdin io.Reader, stdou
 			"-output-dir=/mnt/output",
 			"-case-control-file=" + *caseControlFilename,
 			"-case-control-column=" + *caseControlColumn,
+			"-sample-id-column=" + *sampleIDColumn,
+			"-case-control-delimiter=" + *delimiter,
+			"-case-control-properties=" + *caseControlProperties,
+			"-sample-id-property=" + *sampleIDProperty,
+			"-match=" + cmd.matchMode,
 			"-training-set-size=" + fmt.Sprintf("%f", *trainingSetSize),
 			"-random-seed=" + fmt.Sprintf("%d", *randSeed),
 		}
 		runner.Args = append(runner.Args, cmd.filter.Args()...)
 		var output string
 		output, err = runner.Run()
-		if err != nil {
+		if err == errDryRun {
+			err = nil
+			return nil
+		} else if err != nil {
 			return err
 		}
 		fmt.Fprintln(stdout, output)
@@ -116,18 +153,15 @@ func (cmd *chooseSamples) run(prog string, args []string, stdin io.Reader, stdou
 		return err
 	}
 
-	matchGenome, err := regexp.Compile(cmd.filter.MatchGenome)
+	genomes, err := cmd.filter.GenomeSelector()
 	if err != nil {
-		err = fmt.Errorf("-match-genome: invalid regexp: %q", cmd.filter.MatchGenome)
 		return err
 	}
 
 	var sampleIDs []string
-	err = DecodeLibrary(in0, strings.HasSuffix(infiles[0], ".gz"), func(ent *LibraryEntry) error {
+	err = DecodeLibraryHeader(in0, strings.HasSuffix(infiles[0], ".gz"), DecodeOptions{SkipGenomeVariants: true}, func(ent *LibraryEntry) error {
 		for _, cg := range ent.CompactGenomes {
-			if matchGenome.MatchString(cg.Name) {
-				sampleIDs = append(sampleIDs, cg.Name)
-			}
+			sampleIDs = append(sampleIDs, cg.Name)
 		}
 		return nil
 	})
@@ -136,15 +170,47 @@ func (cmd *chooseSamples) run(prog string, args []string, stdin io.Reader, stdou
 	}
 	in0.Close()
 
+	sampleIDs, err = genomes.Select(sampleIDs)
+	if err != nil {
+		return err
+	}
 	if len(sampleIDs) == 0 {
-		err = fmt.Errorf("no genomes found matching regexp %q", cmd.filter.MatchGenome)
+		err = fmt.Errorf("no genomes found matching %s", genomes)
 		return err
 	}
 	sort.Strings(sampleIDs)
-	caseControl, err := cmd.loadCaseControlFiles(*caseControlFilename, *caseControlColumn, sampleIDs)
+	var caseControl map[int]bool
+	var problems []sampleMatchProblem
+	if *caseControlProperties != "" {
+		var tables []caseControlTable
+		if *caseControlFilename != "" {
+			tables, err = readCaseControlFiles(*caseControlFilename, *sampleIDColumn, *delimiter)
+			if err != nil {
+				return err
+			}
+		}
+		var records []map[string]string
+		records, err = loadArvadosProperties(arvadosClientFromEnv, *caseControlProperties)
+		if err != nil {
+			return err
+		}
+		tables = append(tables, caseControlTable{
+			source: *caseControlProperties,
+			rows:   propertyTable(records, *sampleIDProperty, []string{*caseControlColumn}),
+		})
+		caseControl, problems, err = cmd.matchCaseControl(tables, *caseControlColumn, sampleIDs)
+	} else {
+		caseControl, problems, err = cmd.loadCaseControlFiles(*caseControlFilename, *caseControlColumn, *sampleIDColumn, *delimiter, sampleIDs)
+	}
 	if err != nil {
 		return err
 	}
+	if *caseControlFilename != "" || *caseControlProperties != "" {
+		err = writeSampleMatchReport(*outputDir+"/sample-match-report.csv", problems)
+		if err != nil {
+			return err
+		}
+	}
 	if len(caseControl) == 0 {
 		err = fmt.Errorf("fatal: 0 cases, 0 controls, nothing to do")
 		return err
@@ -219,84 +285,225 @@ func (cmd *chooseSamples) run(prog string, args []string, stdin io.Reader, stdou
 
 // Read case/control file(s). Returned map m has m[i]==true if
 // sampleIDs[i] is case, m[i]==false if sampleIDs[i] is control.
-func (cmd *chooseSamples) loadCaseControlFiles(path, colname string, sampleIDs []string) (map[int]bool, error) {
+// Entries that do not match exactly one sample, and samples matched
+// by more than one entry, are returned as sampleMatchProblems.
+//
+// Sample IDs are taken from the column named idcolname, or the first
+// column if idcolname is empty. If delimiter is empty, it is chosen
+// based on each file's name (comma for *.csv, otherwise tab).
+func (cmd *chooseSamples) loadCaseControlFiles(path, colname, idcolname, delimiter string, sampleIDs []string) (map[int]bool, []sampleMatchProblem, error) {
 	if path == "" {
 		// all samples are control group
 		cc := make(map[int]bool, len(sampleIDs))
 		for i := range sampleIDs {
 			cc[i] = false
 		}
-		return cc, nil
+		return cc, nil, nil
+	}
+	tables, err := readCaseControlFiles(path, idcolname, delimiter)
+	if err != nil {
+		return nil, nil, err
 	}
+	return cmd.matchCaseControl(tables, colname, sampleIDs)
+}
+
+// caseControlTable is the content of a case/control file (or
+// equivalent data from another source), header row first.
+type caseControlTable struct {
+	source    string // filename, for error messages and reports
+	rows      [][]string
+	idcolname string // name of sample ID column (empty means first column)
+}
+
+// readCaseControlFiles reads the case/control file at path, or all
+// files in path if it is a directory.
+func readCaseControlFiles(path, idcolname, delimiter string) ([]caseControlTable, error) {
 	infiles, err := allFiles(path, nil)
 	if err != nil {
 		return nil, err
 	}
+	var tables []caseControlTable
+	for _, infile := range infiles {
+		rows, err := readDelimitedFile(infile, delimiter)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, caseControlTable{source: infile, rows: rows, idcolname: idcolname})
+	}
+	return tables, nil
+}
+
+// matchCaseControl matches the entries in the given case/control
+// tables against sampleIDs. See loadCaseControlFiles.
+func (cmd *chooseSamples) matchCaseControl(tables []caseControlTable, colname string, sampleIDs []string) (map[int]bool, []sampleMatchProblem, error) {
+	var problems []sampleMatchProblem
 	// index in sampleIDs => case(true) / control(false)
 	cc := map[int]bool{}
 	// index in sampleIDs => true if matched by multiple patterns in case/control files
 	dup := map[int]bool{}
-	for _, infile := range infiles {
-		f, err := open(infile)
-		if err != nil {
-			return nil, err
+	// index in sampleIDs => patterns that matched it
+	matchedBy := map[int][]string{}
+	for _, table := range tables {
+		infile, rows := table.source, table.rows
+		if len(rows) == 0 {
+			continue
 		}
-		buf, err := io.ReadAll(f)
-		f.Close()
-		if err != nil {
-			return nil, err
+		header := rows[0]
+		ccCol := findColumn(header, colname)
+		if ccCol < 0 {
+			return nil, nil, fmt.Errorf("%s: no column named %q in header row %q", infile, colname, header)
 		}
-		ccCol := -1
-		for _, tsv := range bytes.Split(buf, []byte{'\n'}) {
-			if len(tsv) == 0 {
-				continue
+		idCol := 0
+		if table.idcolname != "" {
+			idCol = findColumn(header, table.idcolname)
+			if idCol < 0 {
+				return nil, nil, fmt.Errorf("%s: no column named %q in header row %q", infile, table.idcolname, header)
 			}
-			split := strings.Split(string(tsv), "\t")
-			if ccCol < 0 {
-				// header row
-				for col, name := range split {
-					if name == colname {
-						ccCol = col
-						break
-					}
-				}
-				if ccCol < 0 {
-					return nil, fmt.Errorf("%s: no column named %q in header row %q", infile, colname, tsv)
-				}
+		}
+		for _, split := range rows[1:] {
+			if len(split) <= ccCol || len(split) <= idCol {
 				continue
 			}
-			if len(split) <= ccCol {
+			pattern := strings.TrimSpace(split[idCol])
+			if pattern == "" {
 				continue
 			}
-			pattern := split[0]
-			found := -1
+			ccValue := strings.TrimSpace(split[ccCol])
+			var matches []int
 			for i, name := range sampleIDs {
-				if strings.Contains(name, pattern) {
-					if found >= 0 {
-						log.Warnf("pattern %q in %s matches multiple sample IDs (%q, %q)", pattern, infile, sampleIDs[found], name)
-					}
-					if dup[i] {
-						continue
-					} else if _, ok := cc[i]; ok {
-						log.Warnf("multiple patterns match sample ID %q, omitting from cases/controls", name)
-						dup[i] = true
-						delete(cc, i)
-						continue
-					}
-					found = i
-					if split[ccCol] == "0" {
-						cc[found] = false
-					}
-					if split[ccCol] == "1" {
-						cc[found] = true
-					}
+				if cmd.sampleIDMatches(name, pattern) {
+					matches = append(matches, i)
 				}
 			}
-			if found < 0 {
+			if len(matches) == 0 {
 				log.Warnf("pattern %q in %s does not match any genome IDs", pattern, infile)
+				problems = append(problems, sampleMatchProblem{File: infile, Pattern: pattern, Problem: "unmatched"})
 				continue
 			}
+			if len(matches) > 1 {
+				var names []string
+				for _, i := range matches {
+					names = append(names, sampleIDs[i])
+				}
+				log.Warnf("pattern %q in %s matches multiple sample IDs (%q)", pattern, infile, names)
+				problems = append(problems, sampleMatchProblem{File: infile, Pattern: pattern, Problem: "ambiguous", SampleIDs: names})
+				if cmd.matchMode == "exact" {
+					// An exact match is expected to
+					// identify a single sample.
+					continue
+				}
+			}
+			for _, i := range matches {
+				matchedBy[i] = append(matchedBy[i], pattern)
+				if dup[i] {
+					continue
+				} else if _, ok := cc[i]; ok {
+					log.Warnf("multiple patterns match sample ID %q, omitting from cases/controls", sampleIDs[i])
+					dup[i] = true
+					delete(cc, i)
+					continue
+				}
+				if ccValue == "0" {
+					cc[i] = false
+				}
+				if ccValue == "1" {
+					cc[i] = true
+				}
+			}
+		}
+	}
+	var dups []int
+	for i := range dup {
+		dups = append(dups, i)
+	}
+	sort.Ints(dups)
+	for _, i := range dups {
+		problems = append(problems, sampleMatchProblem{Pattern: strings.Join(matchedBy[i], " "), Problem: "conflict", SampleIDs: []string{sampleIDs[i]}})
+	}
+	return cc, problems, nil
+}
+
+// sampleIDMatches returns true if the given case/control file entry
+// matches the given genome name, according to cmd.matchMode.
+func (cmd *chooseSamples) sampleIDMatches(name, pattern string) bool {
+	if cmd.matchMode == "exact" {
+		return name == pattern || trimFilenameForLabel(name) == pattern
+	}
+	return strings.Contains(name, pattern)
+}
+
+// writeSampleMatchReport writes a CSV file listing case/control file
+// entries that were unmatched or ambiguous, and samples that were
+// matched by more than one entry (conflict).
+func writeSampleMatchReport(fnm string, problems []sampleMatchProblem) error {
+	log.Infof("writing sample match report to %s (%d problems)", fnm, len(problems))
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"File", "Pattern", "Problem", "SampleIDs"})
+	for _, p := range problems {
+		w.Write([]string{p.File, p.Pattern, p.Problem, strings.Join(p.SampleIDs, " ")})
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return fmt.Errorf("write %s: %w", fnm, err)
+	}
+	return f.Close()
+}
+
+// readDelimitedFile reads all rows from a CSV/TSV file. Quoted fields
+// are supported, and rows may have different numbers of fields.
+func readDelimitedFile(infile, delimiter string) ([][]string, error) {
+	if delimiter == "" {
+		delimiter = "tab"
+		if strings.HasSuffix(strings.TrimSuffix(strings.ToLower(infile), ".gz"), ".csv") {
+			delimiter = ","
+		}
+	}
+	comma, err := parseDelimiter(delimiter)
+	if err != nil {
+		return nil, err
+	}
+	f, err := zopen(infile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rdr := csv.NewReader(f)
+	rdr.Comma = comma
+	rdr.FieldsPerRecord = -1
+	rdr.LazyQuotes = true
+	rows, err := rdr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", infile, err)
+	}
+	return rows, nil
+}
+
+// parseDelimiter returns the field delimiter indicated by s, which
+// is either a single character or "tab".
+func parseDelimiter(s string) (rune, error) {
+	switch {
+	case strings.EqualFold(s, "tab") || s == "\\t" || s == "\t":
+		return '\t', nil
+	case len([]rune(s)) == 1 && s != "\"" && s != "\n" && s != "\r":
+		return []rune(s)[0], nil
+	default:
+		return 0, fmt.Errorf("invalid delimiter %q", s)
+	}
+}
+
+// findColumn returns the index of the column whose name matches
+// colname (ignoring case and surrounding whitespace), or -1 if there
+// is none.
+func findColumn(header []string, colname string) int {
+	for col, name := range header {
+		if strings.EqualFold(strings.TrimSpace(name), strings.TrimSpace(colname)) {
+			return col
 		}
 	}
-	return cc, nil
+	return -1
 }
@@ -0,0 +1,118 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type chooseSamplesSuite struct{}
+
+var _ = check.Suite(&chooseSamplesSuite{})
+
+func (s *chooseSamplesSuite) TestLoadCaseControlCSV(c *check.C) {
+	tmpdir := c.MkDir()
+	err := os.WriteFile(tmpdir+"/pheno.csv", []byte(`"Notes","Sample ID",cc
+"foo, bar",input1,1
+baz,input2,0
+`), 0600)
+	c.Assert(err, check.IsNil)
+	sampleIDs := []string{"pipeline1/input1", "pipeline1/input2", "pipeline1/input3"}
+	cc, _, err := (&chooseSamples{}).loadCaseControlFiles(tmpdir+"/pheno.csv", "CC", "sample id", "", sampleIDs)
+	c.Assert(err, check.IsNil)
+	c.Check(cc, check.DeepEquals, map[int]bool{0: true, 1: false})
+
+	// same data, semicolon-delimited
+	err = os.WriteFile(tmpdir+"/pheno.txt", []byte(`Notes;Sample ID;CC
+"foo; bar";input1;1
+baz;input2;0
+`), 0600)
+	c.Assert(err, check.IsNil)
+	cc, _, err = (&chooseSamples{}).loadCaseControlFiles(tmpdir+"/pheno.txt", "cc", "Sample ID", ";", sampleIDs)
+	c.Assert(err, check.IsNil)
+	c.Check(cc, check.DeepEquals, map[int]bool{0: true, 1: false})
+
+	_, _, err = (&chooseSamples{}).loadCaseControlFiles(tmpdir+"/pheno.txt", "cc", "SampleID", ";", sampleIDs)
+	c.Check(err, check.ErrorMatches, `.*no column named "SampleID".*`)
+}
+
+func (s *chooseSamplesSuite) TestParseDelimiter(c *check.C) {
+	for in, expect := range map[string]rune{
+		"tab": '\t',
+		"TAB": '\t',
+		`\t`:  '\t',
+		",":   ',',
+		";":   ';',
+		"|":   '|',
+	} {
+		r, err := parseDelimiter(in)
+		c.Check(err, check.IsNil)
+		c.Check(r, check.Equals, expect)
+	}
+	for _, in := range []string{"", `"`, ",,", "\n"} {
+		_, err := parseDelimiter(in)
+		c.Check(err, check.NotNil)
+	}
+}
+
+func (s *chooseSamplesSuite) TestMatchExact(c *check.C) {
+	tmpdir := c.MkDir()
+	err := os.WriteFile(tmpdir+"/pheno.tsv", []byte(`SampleID	CC
+input1	1
+input2	0
+input3	0
+input	1
+`), 0600)
+	c.Assert(err, check.IsNil)
+	sampleIDs := []string{"pipeline1/input1.1.fasta", "pipeline1/input2.1.fasta", "pipeline1dup/input2.1.fasta", "pipeline1/input20.1.fasta"}
+
+	cmd := &chooseSamples{matchMode: "exact"}
+	cc, problems, err := cmd.loadCaseControlFiles(tmpdir+"/pheno.tsv", "CC", "", "", sampleIDs)
+	c.Assert(err, check.IsNil)
+	c.Check(cc, check.DeepEquals, map[int]bool{0: true})
+	c.Check(problems, check.DeepEquals, []sampleMatchProblem{
+		{File: tmpdir + "/pheno.tsv", Pattern: "input2", Problem: "ambiguous", SampleIDs: []string{"pipeline1/input2.1.fasta", "pipeline1dup/input2.1.fasta"}},
+		{File: tmpdir + "/pheno.tsv", Pattern: "input3", Problem: "unmatched"},
+		{File: tmpdir + "/pheno.tsv", Pattern: "input", Problem: "unmatched"},
+	})
+
+	err = writeSampleMatchReport(tmpdir+"/report.csv", problems)
+	c.Assert(err, check.IsNil)
+	buf, err := os.ReadFile(tmpdir + "/report.csv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, `File,Pattern,Problem,SampleIDs
+`+tmpdir+`/pheno.tsv,input2,ambiguous,pipeline1/input2.1.fasta pipeline1dup/input2.1.fasta
+`+tmpdir+`/pheno.tsv,input3,unmatched,
+`+tmpdir+`/pheno.tsv,input,unmatched,
+`)
+
+	// in substring mode, "input" matches all samples, so they
+	// all conflict with the more specific patterns
+	cmd = &chooseSamples{matchMode: "substring"}
+	cc, problems, err = cmd.loadCaseControlFiles(tmpdir+"/pheno.tsv", "CC", "", "", sampleIDs)
+	c.Assert(err, check.IsNil)
+	c.Check(cc, check.HasLen, 0)
+	c.Check(problems, check.HasLen, 7)
+}
+
+func (s *chooseSamplesSuite) TestMatchCaseControlProperties(c *check.C) {
+	records := []map[string]string{
+		flattenProperties(map[string]interface{}{"sample_id": "input1", "affected": true}),
+		flattenProperties(map[string]interface{}{"sample_id": "input2", "affected": float64(0)}),
+		flattenProperties(map[string]interface{}{"affected": "1"}), // no sample ID
+		flattenProperties(map[string]interface{}{"sample_id": "input9", "affected": "1"}),
+	}
+	tables := []caseControlTable{{
+		source: "zzzzz-j7d0g-zzzzzzzzzzzzzzz",
+		rows:   propertyTable(records, "sample_id", []string{"affected"}),
+	}}
+	sampleIDs := []string{"pipeline1/input1", "pipeline1/input2", "pipeline1/input3"}
+	cc, problems, err := (&chooseSamples{matchMode: "exact"}).matchCaseControl(tables, "affected", sampleIDs)
+	c.Assert(err, check.IsNil)
+	c.Check(cc, check.DeepEquals, map[int]bool{0: true, 1: false})
+	c.Check(problems, check.DeepEquals, []sampleMatchProblem{{File: "zzzzz-j7d0g-zzzzzzzzzzzzzzz", Pattern: "input9", Problem: "unmatched"}})
+}
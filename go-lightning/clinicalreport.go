@@ -0,0 +1,578 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/arvados/lightning/go-lightning/hgvs"
+	log "github.com/sirupsen/logrus"
+)
+
+// clinicalReport lists the ClinVar variants with a given clinical
+// significance (by default pathogenic/likely pathogenic) carried by
+// each sample in a library.
+type clinicalReport struct {
+	significance  map[string]bool // lower case CLNSIG values to report
+	maxTileSize   int
+	contigAliases contigAliasOptions
+}
+
+// clinvarVariant is a ClinVar VCF record (one alt allele).
+type clinvarVariant struct {
+	Chrom        string   `json:"chrom"`
+	Position     int      `json:"position"` // 1-based, VCF style
+	Ref          string   `json:"ref"`
+	Alt          string   `json:"alt"`
+	ID           string   `json:"clinvar_id"`
+	Significance string   `json:"significance"`
+	ReviewStatus string   `json:"review_status,omitempty"`
+	Condition    string   `json:"condition,omitempty"`
+	Genes        []string `json:"genes"`
+}
+
+// clinicalFinding is a reportable variant carried by a sample.
+type clinicalFinding struct {
+	clinvarVariant
+	HGVS     string   `json:"hgvs"`
+	Zygosity string   `json:"zygosity"` // "homozygous", "heterozygous", or "unknown" if the other haplotype is not called
+	Tiles    []string `json:"tiles"`    // "tag.variant" of the tile variants that contain it
+}
+
+type clinicalSample struct {
+	Sample   string            `json:"sample"`
+	Variants []clinicalFinding `json:"variants"`
+}
+
+// clinvarMatch is a reportable variant found in the annotations of a
+// tile variant.
+type clinvarMatch struct {
+	cv   *clinvarVariant
+	hgvs string
+}
+
+func (cmd *clinicalReport) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
+	inputDir := flags.String("input-dir", "./in", "input `directory`")
+	outputDir := flags.String("output-dir", "./out", "output `directory`")
+	clinvarFilename := flags.String("clinvar", "", "ClinVar VCF `file` (may be gzip-compressed)")
+	genesFilename := flags.String("genes", "", "report genes from gene models in GFF/GTF `file` (features of type \"gene\") instead of ClinVar GENEINFO")
+	significance := flags.String("significance", "Pathogenic,Likely_pathogenic,Pathogenic/Likely_pathogenic", "report ClinVar variants whose CLNSIG is one of the given comma-separated `values`")
+	writeHTML := flags.Bool("html", true, "write clinical-report.html in addition to clinical-report.json")
+	flags.IntVar(&cmd.maxTileSize, "max-tile-size", 50000, "don't try to make annotations for tiles bigger than given `size`")
+	cmd.contigAliases.Flags(flags)
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	} else if *clinvarFilename == "" {
+		err = errors.New("-clinvar argument is required")
+		return 2
+	}
+	cmd.significance = map[string]bool{}
+	for _, sig := range strings.Split(*significance, ",") {
+		if sig = strings.TrimSpace(sig); sig != "" {
+			cmd.significance[strings.ToLower(sig)] = true
+		}
+	}
+	if len(cmd.significance) == 0 {
+		err = errors.New("-significance must not be empty")
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		runner := arvadosContainerRunner{
+			Name:        "lightning clinical-report",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         240000000000,
+			VCPUs:       32,
+			Priority:    *priority,
+			KeepCache:   2,
+			APIAccess:   true,
+		}
+		containerOpts.Apply(&runner, stdout)
+		err = runner.TranslatePaths(inputDir, clinvarFilename, genesFilename)
+		if err == nil {
+			err = cmd.contigAliases.TranslatePaths(&runner)
+		}
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"clinical-report", "-local=true",
+			"-pprof", ":6060",
+			"-input-dir", *inputDir,
+			"-output-dir", "/mnt/output",
+			"-clinvar", *clinvarFilename,
+			"-genes", *genesFilename,
+			"-significance", *significance,
+			"-html=" + fmt.Sprintf("%v", *writeHTML),
+			"-max-tile-size", fmt.Sprintf("%d", cmd.maxTileSize),
+		}
+		runner.Args = append(runner.Args, cmd.contigAliases.Args()...)
+		var output string
+		output, err = runner.Run()
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output+"/clinical-report.json")
+		return 0
+	}
+
+	err = cmd.contigAliases.Load()
+	if err != nil {
+		return 1
+	}
+	clinvar, err := cmd.loadClinVar(*clinvarFilename)
+	if err != nil {
+		return 1
+	}
+	if *genesFilename != "" {
+		var genes geneModels
+		genes, err = loadGeneModels(*genesFilename)
+		if err != nil {
+			return 1
+		}
+		for _, cv := range clinvar {
+			cv.Genes = genes.Overlapping(cv.Chrom, cv.Position, cv.Position+len(cv.Ref)-1)
+		}
+	}
+
+	tilelib := &tileLibrary{
+		retainNoCalls:       true,
+		retainTileSequences: true,
+		compactGenomes:      map[string][]tileVariantID{},
+	}
+	err = tilelib.LoadDir(context.Background(), *inputDir)
+	if err != nil {
+		return 1
+	}
+	matches, err := cmd.annotate(tilelib, clinvar)
+	if err != nil {
+		return 1
+	}
+	samples := cmd.findings(tilelib, matches)
+	err = writeClinicalReportJSON(*outputDir+"/clinical-report.json", samples)
+	if err != nil {
+		return 1
+	}
+	if *writeHTML {
+		err = writeClinicalReportHTML(*outputDir+"/clinical-report.html", samples)
+		if err != nil {
+			return 1
+		}
+	}
+	return 0
+}
+
+// clinvarKey returns the lookup key for a variant. Contig names are
+// compared in canonical form, so a "chr1" library matches a ClinVar
+// VCF that uses "1".
+func clinvarKey(chrom string, pos int, ref, alt string) string {
+	return fmt.Sprintf("%s:%d:%s:%s", canonicalContig(chrom), pos, strings.ToUpper(ref), strings.ToUpper(alt))
+}
+
+// loadClinVar returns the records in the given ClinVar VCF file
+// whose clinical significance is one of cmd.significance, indexed by
+// clinvarKey.
+func (cmd *clinicalReport) loadClinVar(fnm string) (map[string]*clinvarVariant, error) {
+	log.Printf("reading %s", fnm)
+	f, err := zopen(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	db, err := cmd.parseClinVar(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	log.Printf("%s: %d variants with requested clinical significance", fnm, len(db))
+	return db, nil
+}
+
+func (cmd *clinicalReport) parseClinVar(r io.Reader) (map[string]*clinvarVariant, error) {
+	db := map[string]*clinvarVariant{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Bytes()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := bytes.Split(line, []byte{'\t'})
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("line %d: wrong number of fields (%d < %d)", lineno, len(fields), 8)
+		}
+		pos, err := strconv.Atoi(string(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: cannot parse POS %q", lineno, fields[1])
+		}
+		info := map[string]string{}
+		for _, kv := range bytes.Split(fields[7], []byte{';'}) {
+			if i := bytes.IndexByte(kv, '='); i >= 0 {
+				info[string(kv[:i])] = string(kv[i+1:])
+			}
+		}
+		sig := info["CLNSIG"]
+		if !cmd.reportable(sig) {
+			continue
+		}
+		var genes []string
+		for _, gene := range strings.Split(info["GENEINFO"], "|") {
+			if i := strings.IndexByte(gene, ':'); i >= 0 {
+				gene = gene[:i]
+			}
+			if gene != "" {
+				genes = append(genes, gene)
+			}
+		}
+		chrom, ref := string(fields[0]), string(fields[3])
+		for _, alt := range strings.Split(string(fields[4]), ",") {
+			if alt == "." || alt == "" || strings.HasPrefix(alt, "<") {
+				// no alt, or symbolic allele
+				continue
+			}
+			db[clinvarKey(chrom, pos, ref, alt)] = &clinvarVariant{
+				Chrom:        chrom,
+				Position:     pos,
+				Ref:          ref,
+				Alt:          alt,
+				ID:           string(fields[2]),
+				Significance: sig,
+				ReviewStatus: info["CLNREVSTAT"],
+				Condition:    info["CLNDN"],
+				Genes:        genes,
+			}
+		}
+	}
+	return db, scanner.Err()
+}
+
+// reportable returns true if the given CLNSIG value (e.g.,
+// "Pathogenic|risk_factor") includes one of the requested
+// significance values.
+func (cmd *clinicalReport) reportable(clnsig string) bool {
+	for _, sig := range strings.FieldsFunc(clnsig, func(r rune) bool { return r == '|' || r == ',' }) {
+		if cmd.significance[strings.ToLower(sig)] {
+			return true
+		}
+	}
+	return false
+}
+
+// annotate returns the reportable ClinVar variants contained in each
+// tile variant. Only tiles whose reference tiles intersect a ClinVar
+// variant are annotated.
+func (cmd *clinicalReport) annotate(tilelib *tileLibrary, clinvar map[string]*clinvarVariant) (map[tileLibRef][]clinvarMatch, error) {
+	matches := map[tileLibRef][]clinvarMatch{}
+	if len(tilelib.refseqs) == 0 {
+		return nil, errors.New("library has no reference sequences, cannot find ClinVar variants")
+	}
+	var cvmask mask
+	for _, cv := range clinvar {
+		cvmask.Add(cv.Chrom, cv.Position-1, cv.Position-1+len(cv.Ref))
+	}
+	cvmask.Freeze()
+	dropTiles, err := dropTilesOutsideMask(&cvmask, tilelib.refseqs, tilelib.taglib.taglen, len(tilelib.variant), func(libref tileLibRef) int {
+		return len(tilelib.TileVariantSequence(libref))
+	})
+	if err != nil {
+		return nil, err
+	}
+	var mtx sync.Mutex
+	err = (&annotatecmd{
+		maxTileSize: cmd.maxTileSize,
+		dropTiles:   dropTiles,
+		reportAnnotation: func(tag tagID, _ int, variant tileVariantID, refname string, seqname string, pdi hgvs.Variant) {
+			padded := pdi.PadLeft()
+			cv := clinvar[clinvarKey(seqname, padded.Position, padded.Ref, padded.New)]
+			if cv == nil {
+				return
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			libref := tileLibRef{Tag: tag, Variant: variant}
+			matches[libref] = append(matches[libref], clinvarMatch{cv: cv, hgvs: seqname + ":g." + pdi.String()})
+		},
+	}).exportTileDiffs(ioutil.Discard, tilelib)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("found %d tile variants containing reportable ClinVar variants", len(matches))
+	return matches, nil
+}
+
+// findings returns the reportable variants carried by each sample in
+// tilelib, sorted by sample name and then by position.
+func (cmd *clinicalReport) findings(tilelib *tileLibrary, matches map[tileLibRef][]clinvarMatch) []clinicalSample {
+	tags := map[tagID]bool{}
+	for libref := range matches {
+		tags[libref.Tag] = true
+	}
+	var names []string
+	for name := range tilelib.compactGenomes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	samples := make([]clinicalSample, 0, len(names))
+	for _, name := range names {
+		cg := tilelib.compactGenomes[name]
+		type carried struct {
+			clinvarMatch
+			present [2]bool // haplotypes that have the variant
+			called  [2]bool // haplotypes called at a tile containing the variant
+			tiles   []string
+		}
+		found := map[*clinvarVariant]*carried{}
+		for tag := range tags {
+			var phases [2]tileVariantID
+			for phase := range phases {
+				if i := int(tag)*2 + phase; i < len(cg) {
+					phases[phase] = cg[i]
+				}
+			}
+			for phase, v := range phases {
+				for _, m := range matches[tileLibRef{Tag: tag, Variant: v}] {
+					c := found[m.cv]
+					if c == nil {
+						c = &carried{clinvarMatch: m}
+						found[m.cv] = c
+					}
+					c.present[phase] = true
+					c.called[0] = c.called[0] || phases[0] != 0
+					c.called[1] = c.called[1] || phases[1] != 0
+					c.tiles = append(c.tiles, fmt.Sprintf("%d.%d", tag, v))
+				}
+			}
+		}
+		sample := clinicalSample{Sample: name, Variants: []clinicalFinding{}}
+		for _, c := range found {
+			zygosity := "unknown"
+			if c.present[0] && c.present[1] {
+				zygosity = "homozygous"
+			} else if c.called[0] && c.called[1] {
+				zygosity = "heterozygous"
+			}
+			sort.Strings(c.tiles)
+			sample.Variants = append(sample.Variants, clinicalFinding{
+				clinvarVariant: *c.cv,
+				HGVS:           c.hgvs,
+				Zygosity:       zygosity,
+				Tiles:          uniqueStrings(c.tiles),
+			})
+		}
+		sort.Slice(sample.Variants, func(i, j int) bool {
+			a, b := sample.Variants[i], sample.Variants[j]
+			if a.Chrom != b.Chrom {
+				return a.Chrom < b.Chrom
+			} else if a.Position != b.Position {
+				return a.Position < b.Position
+			}
+			return a.Alt < b.Alt
+		})
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// uniqueStrings returns the sorted input slice without duplicates.
+func uniqueStrings(in []string) []string {
+	out := in[:0]
+	for i, s := range in {
+		if i == 0 || s != in[i-1] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// geneModels has the gene intervals from a GFF/GTF file, keyed by
+// canonical contig name.
+type geneModels map[string][]geneModel
+
+type geneModel struct {
+	start int // 1-based
+	end   int // 1-based, inclusive
+	name  string
+}
+
+// loadGeneModels reads the "gene" features from the given GFF3/GTF
+// file, which may be gzip-compressed. A gene's name is taken from its
+// gene_name, Name, or gene_id attribute, whichever is found first.
+func loadGeneModels(fnm string) (geneModels, error) {
+	log.Printf("reading %s", fnm)
+	f, err := zopen(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	genes := geneModels{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Bytes()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := bytes.Split(line, []byte{'\t'})
+		if len(fields) < 9 {
+			return nil, fmt.Errorf("%s line %d: cannot parse input line as GFF/GTF: %q", fnm, lineno, line)
+		} else if string(fields[2]) != "gene" {
+			continue
+		}
+		start, err1 := strconv.Atoi(string(fields[3]))
+		end, err2 := strconv.Atoi(string(fields[4]))
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("%s line %d: cannot parse input line as GFF/GTF: %q", fnm, lineno, line)
+		}
+		var name string
+		for _, attr := range []string{"gene_name", "Name", "gene_id"} {
+			if values := gffAttribute(fields[8], attr); len(values) > 0 {
+				name = values[0]
+				break
+			}
+		}
+		if name == "" {
+			continue
+		}
+		contig := canonicalContig(string(fields[0]))
+		genes[contig] = append(genes[contig], geneModel{start: start, end: end, name: name})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	for _, models := range genes {
+		sort.Slice(models, func(i, j int) bool { return models[i].start < models[j].start })
+	}
+	return genes, nil
+}
+
+// Overlapping returns the sorted names of the genes that overlap the
+// given 1-based, inclusive interval.
+func (genes geneModels) Overlapping(chrom string, start, end int) []string {
+	models := genes[canonicalContig(chrom)]
+	// models are sorted by start, so we can stop at the first
+	// one that starts after end.
+	n := sort.Search(len(models), func(i int) bool { return models[i].start > end })
+	var names []string
+	for _, gm := range models[:n] {
+		if gm.end >= start {
+			names = append(names, gm.name)
+		}
+	}
+	sort.Strings(names)
+	return uniqueStrings(names)
+}
+
+func writeClinicalReportJSON(fnm string, samples []clinicalSample) error {
+	log.Infof("writing %s", fnm)
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriter(f)
+	enc := json.NewEncoder(bufw)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(samples)
+	if err != nil {
+		return err
+	}
+	if err := bufw.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+var clinicalReportTemplate = template.Must(template.New("clinical-report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>lightning clinical report</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; }
+</style>
+</head>
+<body>
+{{range .}}
+<h2>{{.Sample}}</h2>
+{{if .Variants}}
+<table>
+<tr><th>Position</th><th>Ref</th><th>Alt</th><th>HGVS</th><th>Genes</th><th>Zygosity</th><th>Significance</th><th>Condition</th><th>Review status</th><th>ClinVar ID</th></tr>
+{{range .Variants}}
+<tr><td>{{.Chrom}}:{{.Position}}</td><td>{{.Ref}}</td><td>{{.Alt}}</td><td>{{.HGVS}}</td><td>{{range $i, $g := .Genes}}{{if $i}}, {{end}}{{$g}}{{end}}</td><td>{{.Zygosity}}</td><td>{{.Significance}}</td><td>{{.Condition}}</td><td>{{.ReviewStatus}}</td><td>{{.ID}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>No reportable variants found.</p>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+func writeClinicalReportHTML(fnm string, samples []clinicalSample) error {
+	log.Infof("writing %s", fnm)
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriter(f)
+	err = clinicalReportTemplate.Execute(bufw, samples)
+	if err != nil {
+		return err
+	}
+	if err := bufw.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
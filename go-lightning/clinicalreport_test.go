@@ -0,0 +1,117 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type clinicalReportSuite struct{}
+
+var _ = check.Suite(&clinicalReportSuite{})
+
+func (s *clinicalReportSuite) TestParseClinVar(c *check.C) {
+	cmd := &clinicalReport{significance: map[string]bool{"pathogenic": true, "likely_pathogenic": true}}
+	db, err := cmd.parseClinVar(strings.NewReader(`##fileformat=VCFv4.1
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO
+1	100	1001	A	G,T	.	.	CLNSIG=Pathogenic|risk_factor;GENEINFO=GENE1:1|GENE2:2;CLNDN=Disease_A
+1	200	1002	C	T	.	.	CLNSIG=Benign;GENEINFO=GENE1:1
+chr2	300	1003	G	<DEL>	.	.	CLNSIG=Pathogenic
+chr2	400	1004	G	GA	.	.	CLNSIG=Likely_pathogenic;CLNREVSTAT=criteria_provided,_single_submitter
+`))
+	c.Assert(err, check.IsNil)
+	c.Check(db, check.HasLen, 3)
+	cv := db[clinvarKey("chr1", 100, "a", "t")]
+	c.Assert(cv, check.NotNil)
+	c.Check(cv.ID, check.Equals, "1001")
+	c.Check(cv.Genes, check.DeepEquals, []string{"GENE1", "GENE2"})
+	c.Check(cv.Condition, check.Equals, "Disease_A")
+	cv = db[clinvarKey("2", 400, "G", "GA")]
+	c.Assert(cv, check.NotNil)
+	c.Check(cv.ReviewStatus, check.Equals, "criteria_provided,_single_submitter")
+	c.Check(db[clinvarKey("1", 200, "C", "T")], check.IsNil)
+
+	_, err = cmd.parseClinVar(strings.NewReader("1\tx\t1\tA\tG\t.\t.\tCLNSIG=Pathogenic\n"))
+	c.Check(err, check.ErrorMatches, `line 1: cannot parse POS.*`)
+}
+
+func (s *clinicalReportSuite) TestGeneModels(c *check.C) {
+	tmpdir := c.MkDir()
+	err := ioutil.WriteFile(tmpdir+"/genes.gtf", []byte(`# test
+chr1	test	gene	10	50	.	+	.	gene_id "G1"; gene_name "GENEA";
+chr1	test	exon	10	20	.	+	.	gene_id "G1"; gene_name "GENEA";
+chr1	test	gene	40	90	.	+	.	gene_id "G2";
+`), 0666)
+	c.Assert(err, check.IsNil)
+	genes, err := loadGeneModels(tmpdir + "/genes.gtf")
+	c.Assert(err, check.IsNil)
+	c.Check(genes.Overlapping("1", 5, 9), check.HasLen, 0)
+	c.Check(genes.Overlapping("1", 5, 10), check.DeepEquals, []string{"GENEA"})
+	c.Check(genes.Overlapping("chr1", 45, 45), check.DeepEquals, []string{"G2", "GENEA"})
+	c.Check(genes.Overlapping("chr1", 91, 100), check.HasLen, 0)
+	c.Check(genes.Overlapping("chr2", 45, 45), check.HasLen, 0)
+}
+
+func (s *clinicalReportSuite) TestClinicalReport(c *check.C) {
+	tmpdir := c.MkDir()
+	exited := (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-output-tiles",
+		"-save-incomplete-tiles",
+		"-o", tmpdir + "/library.gob",
+		"testdata/ref.fasta",
+		"testdata/pipeline1",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	err := ioutil.WriteFile(tmpdir+"/clinvar.vcf", []byte(`##fileformat=VCFv4.1
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO
+1	41	1001	T	A	.	.	CLNSIG=Pathogenic;GENEINFO=GENE1:1;CLNDN=Disease_A
+1	42	1002	T	A	.	.	CLNSIG=Benign;GENEINFO=GENE1:1
+`), 0666)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(tmpdir+"/genes.gtf", []byte("chr1\ttest\tgene\t30\t60\t.\t+\t.\tgene_name \"GENE2\";\n"), 0666)
+	c.Assert(err, check.IsNil)
+
+	exited = (&clinicalReport{}).RunCommand("clinical-report", []string{
+		"-local=true",
+		"-input-dir=" + tmpdir + "/library.gob",
+		"-output-dir=" + tmpdir,
+		"-clinvar=" + tmpdir + "/clinvar.vcf",
+		"-genes=" + tmpdir + "/genes.gtf",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	buf, err := ioutil.ReadFile(tmpdir + "/clinical-report.json")
+	c.Assert(err, check.IsNil)
+	c.Logf("%s", buf)
+	var samples []clinicalSample
+	err = json.Unmarshal(buf, &samples)
+	c.Assert(err, check.IsNil)
+	c.Assert(samples, check.HasLen, 2)
+	c.Check(samples[0].Sample, check.Equals, "testdata/pipeline1/input1.1.fasta")
+	c.Assert(samples[0].Variants, check.HasLen, 1)
+	c.Check(samples[0].Variants[0].ID, check.Equals, "1001")
+	c.Check(samples[0].Variants[0].HGVS, check.Equals, "chr1:g.41T>A")
+	c.Check(samples[0].Variants[0].Zygosity, check.Equals, "heterozygous")
+	c.Check(samples[0].Variants[0].Genes, check.DeepEquals, []string{"GENE2"})
+	c.Check(samples[1].Variants, check.HasLen, 0)
+
+	buf, err = ioutil.ReadFile(tmpdir + "/clinical-report.html")
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Matches, `(?ms).*chr1:g\.41T&gt;A.*heterozygous.*Disease_A.*No reportable variants found.*`)
+
+	exited = (&clinicalReport{}).RunCommand("clinical-report", []string{
+		"-local=true",
+		"-input-dir=" + tmpdir + "/library.gob",
+		"-output-dir=" + tmpdir,
+	}, nil, os.Stderr, os.Stderr)
+	c.Check(exited, check.Equals, 2)
+}
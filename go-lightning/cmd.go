@@ -33,6 +33,7 @@ var (
 		"flake":              &flakecmd{},
 		"slice":              &slicecmd{},
 		"slice-numpy":        &sliceNumpy{},
+		"concat-matrix":      &concatMatrix{},
 		"tiling-stats":       &tilingStats{},
 		"anno2vcf":           &anno2vcf{},
 		"numpy-comvar":       &numpyComVar{},
@@ -41,12 +42,33 @@ var (
 		"plot":               &pythonPlot{},
 		"pca-plot":           &pythonPlot{},
 		"manhattan-plot":     &manhattanPlot{},
+		"manhattan-data":     &manhattanData{},
 		"diff-fasta":         &diffFasta{},
 		"stats":              &statscmd{},
 		"merge":              &merger{},
 		"dump":               &dump{},
 		"dumpgob":            &dumpGob{},
+		"extract-sample":     &extractSample{},
+		"extract-regions":    &extractRegions{},
+		"refs":               &refsCmd{},
+		"info":               &infocmd{},
+		"tile-alignment":     &tileAlign{},
 		"choose-samples":     &chooseSamples{},
+		"verify-manifest":    &verifyManifest{},
+		"retile":             &retilecmd{},
+		"private-variants":   &privateVariants{},
+		"mendel":             &mendelcmd{},
+		"phasing-stats":      &phasingcmd{},
+		"fetch-output":       &fetchOutput{},
+		"fetch-ref":          &fetchRef{},
+		"plan":               &plancmd{},
+		"collapse":           &collapsecmd{},
+		"train":              &traincmd{},
+		"ibd":                &ibdcmd{},
+		"cnv":                &cnvcmd{},
+		"clinical-report":    &clinicalReport{},
+		"help":               &helpcmd{},
+		"commands":           &commandscmd{},
 	})
 )
 
@@ -64,7 +86,26 @@ func Main() {
 		// print version (then run subcommand)
 		cmd.Version.RunCommand("lightning", nil, nil, os.Stderr, os.Stderr)
 	}
-	os.Exit(handler.RunCommand(os.Args[0], os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+	errorJSON := os.Getenv(errorJSONEnv)
+	if errorJSON == "" {
+		os.Exit(handler.RunCommand(os.Args[0], os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+	}
+	// Running in a container: if the command fails, write
+	// error.json so the caller can report the reason.
+	stderr := &lastLineWriter{w: os.Stderr}
+	logrus.StandardLogger().Out = stderr
+	exitCode := handler.RunCommand(os.Args[0], os.Args[1:], os.Stdin, os.Stdout, stderr)
+	if exitCode != 0 {
+		command := ""
+		if len(os.Args) > 1 {
+			command = os.Args[1]
+		}
+		err := writeErrorJSON(errorJSON, failureDiagnostic(command, exitCode, stderr.Last()))
+		if err != nil {
+			logrus.Errorf("error writing %s: %s", errorJSON, err)
+		}
+	}
+	os.Exit(exitCode)
 }
 
 type buildDockerImage struct{}
@@ -80,7 +121,7 @@ func (cmd *buildDockerImage) RunCommand(prog string, args []string, stdin io.Rea
 RUN DEBIAN_FRONTEND=noninteractive \
   apt-get update && \
   apt-get dist-upgrade -y && \
-  apt-get install -y --no-install-recommends bcftools bedtools samtools python2 python3-sklearn python3-matplotlib python3-pip ca-certificates && \
+  apt-get install -y --no-install-recommends bcftools samtools python2 python3-sklearn python3-matplotlib python3-pip ca-certificates && \
   apt-get clean && \
   pip3 install qmplot
 `), 0644)
@@ -0,0 +1,457 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	log "github.com/sirupsen/logrus"
+)
+
+// cnvcmd finds candidate deletions (and other copy number variants)
+// in each genome: runs of tags where a haplotype has no-calls or no
+// tile at all, and spanning tiles that are much shorter than the
+// corresponding reference sequence.
+type cnvcmd struct {
+	filter Filter
+	params cnvParams
+}
+
+type cnvParams struct {
+	minTags     int // minimum number of tags in a no-call segment
+	minLength   int // minimum no-call segment length in reference bases
+	minDeletion int // minimum number of missing bases for a spanning tile to count as a deletion
+}
+
+// cnvVariant describes a tile variant at one tag of a reference
+// path.
+type cnvVariant struct {
+	nocall  bool // sequence is not known (low quality tile variant)
+	span    int  // number of reference tiles covered (>1 for spanning tiles), or 0 if unknown
+	deleted int  // number of reference bases missing, if span > 1
+}
+
+// cnvPath is a reference path with a description of each tile
+// variant at each tag.
+type cnvPath struct {
+	ibdPath
+	variants [][]cnvVariant // variants[i][v-1] describes variant v at tags[i]
+}
+
+// cnvSegment is a run of tags on a reference sequence where one
+// haplotype of a genome has no-calls, no tiles, or spanning tiles
+// with deletions.
+type cnvSegment struct {
+	phase            int
+	seqname          string
+	start, end       int // 0-based, end exclusive
+	startTag, endTag tagID
+	tags             int // tags in the segment
+	nocalls          int // tags with no-calls or no tile
+	spanned          int // tags covered by spanning tiles with deletions
+	deleted          int // reference bases missing from spanning tiles
+}
+
+// Type returns "deletion" if the segment includes spanning tiles
+// with deletions, otherwise "nocall".
+func (seg cnvSegment) Type() string {
+	if seg.spanned > 0 {
+		return "deletion"
+	}
+	return "nocall"
+}
+
+type cnvSampleResult struct {
+	sample   string
+	segments []cnvSegment
+}
+
+func (cmd *cnvcmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
+	inputDir := flags.String("input-dir", "./in", "input `directory`")
+	outputDir := flags.String("output-dir", "./out", "output `directory`")
+	ref := flags.String("ref", "", "name of reference to use for coordinates (required if the library has more than one)")
+	flags.IntVar(&cmd.params.minTags, "min-tags", 5, "report no-call segments with at least `N` tags")
+	flags.IntVar(&cmd.params.minLength, "min-length", 1000, "report no-call segments at least `N` reference bases long")
+	flags.IntVar(&cmd.params.minDeletion, "min-deletion", 50, "report spanning tiles that are at least `N` bases shorter than the reference as deletions")
+	threads := flags.Int("threads", runtime.GOMAXPROCS(0), "scan up to `N` genomes concurrently")
+	cmd.filter.GenomeFlags(flags)
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	} else if cmd.params.minDeletion < 1 {
+		err = fmt.Errorf("invalid -min-deletion %d: must be at least 1", cmd.params.minDeletion)
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		runner := arvadosContainerRunner{
+			Name:        "lightning cnv",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         240000000000,
+			VCPUs:       32,
+			Priority:    *priority,
+			KeepCache:   2,
+			APIAccess:   true,
+		}
+		containerOpts.Apply(&runner, stdout)
+		err = runner.TranslatePaths(inputDir)
+		if err == nil {
+			err = cmd.filter.TranslatePaths(&runner)
+		}
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"cnv", "-local=true",
+			"-pprof", ":6060",
+			"-input-dir", *inputDir,
+			"-output-dir", "/mnt/output",
+			"-ref", *ref,
+			"-min-tags", fmt.Sprintf("%d", cmd.params.minTags),
+			"-min-length", fmt.Sprintf("%d", cmd.params.minLength),
+			"-min-deletion", fmt.Sprintf("%d", cmd.params.minDeletion),
+			"-threads", fmt.Sprintf("%d", runner.VCPUs),
+		}
+		runner.Args = append(runner.Args, cmd.filter.GenomeArgs()...)
+		var output string
+		output, err = runner.Run()
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output)
+		return 0
+	}
+
+	genomes, err := cmd.filter.GenomeSelector()
+	if err != nil {
+		return 1
+	}
+	tilelib := &tileLibrary{
+		retainNoCalls:       true,
+		retainTileSequences: true,
+		compactGenomes:      map[string][]tileVariantID{},
+	}
+	err = tilelib.LoadDir(context.Background(), *inputDir)
+	if err != nil {
+		return 1
+	}
+	var names []string
+	for name := range tilelib.compactGenomes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	names, err = genomes.Select(names)
+	if err != nil {
+		return 1
+	}
+	if len(names) == 0 {
+		err = fmt.Errorf("no genomes found matching %s", genomes)
+		return 1
+	}
+	refpaths, err := ibdPaths(tilelib, *ref)
+	if err != nil {
+		return 1
+	}
+	paths := cnvPaths(tilelib, refpaths, cmd.params.minDeletion)
+
+	log.Infof("scanning %d genomes", len(names))
+	results := make([]cnvSampleResult, len(names))
+	progress := newProgress("cnv: genomes", len(names))
+	todo := make(chan int, len(names))
+	for i := range names {
+		todo <- i
+	}
+	close(todo)
+	var wg sync.WaitGroup
+	for t := 0; t < *threads; t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				results[i] = cnvSampleResult{
+					sample:   trimFilenameForLabel(names[i]),
+					segments: findCNV(tilelib.compactGenomes[names[i]], paths, cmd.params),
+				}
+				progress.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	progress.Done()
+
+	err = writeCNVSegments(*outputDir+"/cnv-segments.bed", results)
+	if err != nil {
+		return 1
+	}
+	err = writeCNVSummary(*outputDir+"/cnv-summary.csv", results)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// cnvPaths returns the given reference paths, with a description of
+// each tile variant at each tag. A spanning tile variant is a
+// deletion if it is at least minDeletion bases shorter than the
+// reference tiles it covers.
+func cnvPaths(tilelib *tileLibrary, refpaths []ibdPath, minDeletion int) []cnvPath {
+	paths := make([]cnvPath, len(refpaths))
+	for p, refpath := range refpaths {
+		index := make(map[tagID]int, len(refpath.tags))
+		for i, tag := range refpath.tags {
+			index[tag] = i
+		}
+		path := cnvPath{ibdPath: refpath, variants: make([][]cnvVariant, len(refpath.tags))}
+		for i, tag := range refpath.tags {
+			if int(tag) >= len(tilelib.variant) {
+				continue
+			}
+			variants := make([]cnvVariant, len(tilelib.variant[tag]))
+			for vi := range variants {
+				seq := tilelib.TileVariantSequence(tileLibRef{Tag: tag, Variant: tileVariantID(vi + 1)})
+				if len(seq) == 0 {
+					variants[vi].nocall = true
+					continue
+				}
+				endtag, ok := tilelib.taglib.EndTag(seq)
+				if !ok {
+					if i == len(refpath.tags)-1 {
+						// last tile of the
+						// reference sequence
+						variants[vi].span = 1
+					}
+					continue
+				}
+				j, ok := index[endtag]
+				if !ok || j <= i {
+					continue
+				}
+				variants[vi].span = j - i
+				if missing := refpath.end[j-1] - refpath.start[i] - len(seq); j > i+1 && missing >= minDeletion {
+					variants[vi].deleted = missing
+				}
+			}
+			path.variants[i] = variants
+		}
+		paths[p] = path
+	}
+	return paths
+}
+
+// findCNV returns the candidate CNV segments in both haplotypes of
+// the given genome, sorted by reference sequence and position.
+func findCNV(cg []tileVariantID, paths []cnvPath, params cnvParams) []cnvSegment {
+	var segments []cnvSegment
+	for _, path := range paths {
+		var pathSegments []cnvSegment
+		for phase := 0; phase < 2; phase++ {
+			pathSegments = append(pathSegments, findCNVPath(cg, phase, path, params)...)
+		}
+		sort.SliceStable(pathSegments, func(i, j int) bool {
+			return pathSegments[i].start < pathSegments[j].start
+		})
+		segments = append(segments, pathSegments...)
+	}
+	return segments
+}
+
+// findCNVPath returns the candidate CNV segments on the given
+// reference path in the given phase of a genome.
+func findCNVPath(cg []tileVariantID, phase int, path cnvPath, params cnvParams) []cnvSegment {
+	var segments []cnvSegment
+	runStart, runEnd := -1, -1
+	var seg cnvSegment
+	endRun := func() {
+		if runStart >= 0 && (seg.spanned > 0 || (seg.tags >= params.minTags && path.end[runEnd]-path.start[runStart] >= params.minLength)) {
+			seg.phase = phase
+			seg.seqname = path.seqname
+			seg.start = path.start[runStart]
+			seg.end = path.end[runEnd]
+			seg.startTag = path.tags[runStart]
+			seg.endTag = path.tags[runEnd]
+			segments = append(segments, seg)
+		}
+		runStart, runEnd = -1, -1
+		seg = cnvSegment{}
+	}
+	// Tags before path index covered are covered by the most
+	// recent tile variant, which is a deletion if coverDeleted
+	// is true. If unknownSpan is true, the most recent tile
+	// variant's end tag was not found on this path, so tags with
+	// no tile are assumed to be covered by it.
+	covered, coverDeleted, unknownSpan := 0, false, false
+	for i, tag := range path.tags {
+		var v tileVariantID
+		if int(tag)*2+phase < len(cg) {
+			v = cg[int(tag)*2+phase]
+		}
+		signal := false
+		switch {
+		case v == 0 && i < covered:
+			if coverDeleted {
+				signal = true
+				seg.spanned++
+			}
+		case v == 0 && unknownSpan:
+		case v == 0:
+			signal = true
+			seg.nocalls++
+		case int(v) > len(path.variants[i]):
+			// unknown variant, shouldn't happen
+			covered, coverDeleted, unknownSpan = i+1, false, false
+		default:
+			info := path.variants[i][v-1]
+			covered, coverDeleted, unknownSpan = i+1, false, false
+			switch {
+			case info.nocall:
+				signal = true
+				seg.nocalls++
+			case info.span == 0:
+				unknownSpan = true
+			case info.deleted > 0:
+				covered, coverDeleted = i+info.span, true
+				signal = true
+				seg.spanned++
+				seg.deleted += info.deleted
+			default:
+				covered = i + info.span
+			}
+		}
+		if !signal {
+			endRun()
+			continue
+		}
+		if runStart < 0 {
+			runStart = i
+		}
+		runEnd = i
+		seg.tags++
+	}
+	endRun()
+	return segments
+}
+
+// homozygousLength returns the total length of the regions covered
+// by segments in both phases.
+func homozygousLength(segments []cnvSegment) int {
+	total := 0
+	for _, a := range segments {
+		if a.phase != 0 {
+			continue
+		}
+		for _, b := range segments {
+			if b.phase != 1 || b.seqname != a.seqname {
+				continue
+			}
+			start, end := a.start, a.end
+			if start < b.start {
+				start = b.start
+			}
+			if end > b.end {
+				end = b.end
+			}
+			if start < end {
+				total += end - start
+			}
+		}
+	}
+	return total
+}
+
+func writeCNVSegments(fnm string, results []cnvSampleResult) error {
+	log.Infof("writing %s", fnm)
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriterSize(f, 1<<20)
+	fmt.Fprint(bufw, "#chrom\tstart\tend\tname\tscore\tstrand\tphase\ttype\ttags\tnocalls\tspanned\tdeleted\n")
+	for _, r := range results {
+		for _, seg := range r.segments {
+			fmt.Fprintf(bufw, "%s\t%d\t%d\t%s\t0\t.\t%d\t%s\t%d\t%d\t%d\t%d\n", seg.seqname, seg.start, seg.end, r.sample, seg.phase+1, seg.Type(), seg.tags, seg.nocalls, seg.spanned, seg.deleted)
+		}
+	}
+	if err := bufw.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func writeCNVSummary(fnm string, results []cnvSampleResult) error {
+	log.Infof("writing %s", fnm)
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"Sample", "Segments", "Deletions", "TotalLength", "LongestSegment", "HomozygousLength"})
+	for _, r := range results {
+		deletions, total, longest := 0, 0, 0
+		for _, seg := range r.segments {
+			if seg.spanned > 0 {
+				deletions++
+			}
+			total += seg.end - seg.start
+			if longest < seg.end-seg.start {
+				longest = seg.end - seg.start
+			}
+		}
+		w.Write([]string{r.sample,
+			fmt.Sprintf("%d", len(r.segments)),
+			fmt.Sprintf("%d", deletions),
+			fmt.Sprintf("%d", total),
+			fmt.Sprintf("%d", longest),
+			fmt.Sprintf("%d", homozygousLength(r.segments)),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,56 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"gopkg.in/check.v1"
+)
+
+type cnvSuite struct{}
+
+var _ = check.Suite(&cnvSuite{})
+
+func (s *cnvSuite) TestFindCNV(c *check.C) {
+	path := cnvPath{ibdPath: ibdPath{seqname: "chr1"}}
+	for tag := 0; tag < 10; tag++ {
+		path.tags = append(path.tags, tagID(tag))
+		path.start = append(path.start, tag*100)
+		path.end = append(path.end, tag*100+124)
+		// variant 1 is a normal tile, variant 2 is a
+		// no-call, variant 3 is a spanning tile covering 3
+		// tags with a 200-base deletion, variant 4 is a
+		// spanning tile covering 2 tags with no deletion
+		path.variants = append(path.variants, []cnvVariant{
+			{span: 1},
+			{nocall: true},
+			{span: 3, deleted: 200},
+			{span: 2},
+		})
+	}
+	params := cnvParams{minTags: 3, minLength: 200, minDeletion: 50}
+	cg := interleave(
+		[]tileVariantID{1, 2, 2, 0, 1, 3, 0, 0, 1, 1},
+		[]tileVariantID{1, 4, 0, 1, 2, 0, 1, 2, 1, 1})
+	c.Check(findCNV(cg, []cnvPath{path}, params), check.DeepEquals, []cnvSegment{
+		{phase: 0, seqname: "chr1", start: 100, end: 424, startTag: 1, endTag: 3, tags: 3, nocalls: 3},
+		{phase: 0, seqname: "chr1", start: 500, end: 824, startTag: 5, endTag: 7, tags: 3, spanned: 3, deleted: 200},
+	})
+
+	// Runs shorter than -min-tags are not reported, but
+	// deletions are.
+	params.minTags = 4
+	segments := findCNV(cg, []cnvPath{path}, params)
+	c.Check(segments, check.HasLen, 1)
+	c.Check(segments[0].Type(), check.Equals, "deletion")
+}
+
+func (s *cnvSuite) TestHomozygousLength(c *check.C) {
+	c.Check(homozygousLength([]cnvSegment{
+		{phase: 1, seqname: "chr1", start: 50, end: 150},
+		{phase: 0, seqname: "chr1", start: 100, end: 300},
+		{phase: 1, seqname: "chr1", start: 250, end: 400},
+		{phase: 1, seqname: "chr2", start: 100, end: 300},
+	}), check.Equals, 100)
+}
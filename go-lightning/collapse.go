@@ -0,0 +1,333 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	log "github.com/sirupsen/logrus"
+)
+
+// collapsedVariant records a tile variant that was replaced by a
+// near-identical representative variant.
+type collapsedVariant struct {
+	Tag            tagID
+	Hash           tileHash // collapsed variant
+	Representative tileHash
+	Distance       int // edit distance between the two sequences
+	Uses           int // number of haplotypes that had the collapsed variant
+}
+
+// CollapseVariants replaces rarely used tile variants (used by at
+// most maxUses haplotypes) in tilelib.compactGenomes with more
+// common variants of the same tag, if the edit distance between the
+// two sequences is at most maxDistance. This reduces the number of
+// distinct variants caused by sequencing errors.
+//
+// Variants used by reference sequences are never collapsed. The
+// collapsed variants become unreferenced, so callers should use
+// Tidy to remove them.
+func (tilelib *tileLibrary) CollapseVariants(maxDistance, maxUses int) []collapsedVariant {
+	inref := map[tileLibRef]bool{}
+	for _, refseq := range tilelib.refseqs {
+		for _, librefs := range refseq {
+			for _, libref := range librefs {
+				inref[libref] = true
+			}
+		}
+	}
+	remap := make([]map[tileVariantID]tileVariantID, len(tilelib.variant))
+	collapsed := make([][]collapsedVariant, len(tilelib.variant))
+	throttle := throttle{Max: runtime.NumCPU() + 1}
+	for tag, variants := range tilelib.variant {
+		tag, variants := tagID(tag), variants
+		if len(variants) < 2 {
+			continue
+		}
+		throttle.Acquire()
+		go func() {
+			defer throttle.Release()
+			uses := make([]int, len(variants))
+			for _, cg := range tilelib.compactGenomes {
+				for phase := 0; phase < 2; phase++ {
+					cgi := int(tag)*2 + phase
+					if cgi < len(cg) && cg[cgi] > 0 && int(cg[cgi]) <= len(variants) {
+						uses[cg[cgi]-1]++
+					}
+				}
+			}
+			// Consider the most common variants first, so
+			// each variant is collapsed into the most
+			// common representative within range.
+			order := make([]int, len(variants))
+			for i := range order {
+				order[i] = i
+			}
+			sort.SliceStable(order, func(i, j int) bool {
+				return uses[order[i]] > uses[order[j]]
+			})
+			seqs := make([][]byte, len(variants))
+			for _, i := range order {
+				seqs[i] = tilelib.hashSequence(variants[i])
+			}
+			isrep := make([]bool, len(variants))
+			for _, i := range order {
+				id := tileVariantID(i + 1)
+				if uses[i] == 0 || uses[i] > maxUses || inref[tileLibRef{Tag: tag, Variant: id}] || seqs[i] == nil {
+					isrep[i] = true
+					continue
+				}
+				for _, r := range order {
+					// A representative must be a reference
+					// variant, or a more common variant that
+					// hasn't itself been collapsed.
+					if r == i || seqs[r] == nil || !inref[tileLibRef{Tag: tag, Variant: tileVariantID(r + 1)}] && !(isrep[r] && uses[r] > uses[i]) {
+						continue
+					}
+					dist, ok := boundedEditDistance(seqs[i], seqs[r], maxDistance)
+					if !ok {
+						continue
+					}
+					if remap[tag] == nil {
+						remap[tag] = map[tileVariantID]tileVariantID{}
+					}
+					remap[tag][id] = tileVariantID(r + 1)
+					collapsed[tag] = append(collapsed[tag], collapsedVariant{
+						Tag:            tag,
+						Hash:           variants[i],
+						Representative: variants[r],
+						Distance:       dist,
+						Uses:           uses[i],
+					})
+					break
+				}
+				if remap[tag][id] == 0 {
+					isrep[i] = true
+				}
+			}
+		}()
+	}
+	throttle.Wait()
+
+	var wg sync.WaitGroup
+	for _, cg := range tilelib.compactGenomes {
+		cg := cg
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx, variant := range cg {
+				tag := idx / 2
+				if tag < len(remap) && remap[tag] != nil {
+					if rep, ok := remap[tag][variant]; ok {
+						cg[idx] = rep
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var ret []collapsedVariant
+	for _, cvs := range collapsed {
+		ret = append(ret, cvs...)
+	}
+	return ret
+}
+
+// boundedEditDistance returns the Levenshtein distance between a and
+// b, and true, if it is at most k. Otherwise it returns false.
+func boundedEditDistance(a, b []byte, k int) (int, bool) {
+	if d := len(a) - len(b); d > k || -d > k {
+		return 0, false
+	}
+	const inf = 1 << 30
+	// Only cells within k of the diagonal can have distance
+	// <= k, so row[j-i+k] holds the distance for a[:i], b[:j].
+	width := 2*k + 1
+	prev := make([]int, width)
+	cur := make([]int, width)
+	for d := range prev {
+		j := d - k
+		if j >= 0 && j <= len(b) {
+			prev[d] = j
+		} else {
+			prev[d] = inf
+		}
+	}
+	for i := 1; i <= len(a); i++ {
+		rowmin := inf
+		for d := range cur {
+			j := i + d - k
+			cur[d] = inf
+			if j < 0 || j > len(b) {
+				continue
+			}
+			if j == 0 {
+				cur[d] = i
+			} else {
+				best := prev[d] // substitution or match
+				if a[i-1] != b[j-1] {
+					best++
+				}
+				if d+1 < width && prev[d+1]+1 < best {
+					best = prev[d+1] + 1 // deletion from a
+				}
+				if d > 0 && cur[d-1]+1 < best {
+					best = cur[d-1] + 1 // insertion into a
+				}
+				cur[d] = best
+			}
+			if cur[d] < rowmin {
+				rowmin = cur[d]
+			}
+		}
+		if rowmin > k {
+			return 0, false
+		}
+		prev, cur = cur, prev
+	}
+	dist := prev[len(b)-len(a)+k]
+	return dist, dist <= k
+}
+
+type collapsecmd struct{}
+
+func (cmd *collapsecmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
+	inputDir := flags.String("input-dir", "./in", "input `directory`")
+	outputDir := flags.String("output-dir", "./out", "output `directory`")
+	maxDistance := flags.Int("max-distance", 1, "collapse a tile variant into a more common variant if the edit distance between them is at most `k`")
+	maxUses := flags.Int("max-uses", 1, "only collapse tile variants that appear in at most `N` haplotypes")
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	} else if *maxDistance < 1 {
+		err = fmt.Errorf("invalid -max-distance %d: must be at least 1", *maxDistance)
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		runner := arvadosContainerRunner{
+			Name:        "lightning collapse",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         700000000000,
+			VCPUs:       96,
+			Priority:    *priority,
+			KeepCache:   2,
+			APIAccess:   true,
+		}
+		containerOpts.Apply(&runner, stdout)
+		err = runner.TranslatePaths(inputDir)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"collapse", "-local=true",
+			"-pprof", ":6060",
+			"-input-dir", *inputDir,
+			"-output-dir", "/mnt/output",
+			"-max-distance", fmt.Sprintf("%d", *maxDistance),
+			"-max-uses", fmt.Sprintf("%d", *maxUses),
+		}
+		var output string
+		output, err = runner.Run()
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output)
+		return 0
+	}
+
+	tilelib := &tileLibrary{
+		retainNoCalls:       true,
+		retainTileSequences: true,
+		compactGenomes:      map[string][]tileVariantID{},
+	}
+	err = tilelib.LoadDir(context.Background(), *inputDir)
+	if err != nil {
+		return 1
+	}
+
+	log.Info("collapsing")
+	collapsed := tilelib.CollapseVariants(*maxDistance, *maxUses)
+	log.Infof("collapsed %d tile variants", len(collapsed))
+	log.Info("tidying")
+	tilelib.Tidy()
+	err = tilelib.WriteDir(*outputDir)
+	if err != nil {
+		return 1
+	}
+	err = writeCollapsedVariants(*outputDir+"/collapsed.tsv", tilelib, collapsed)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// writeCollapsedVariants writes a TSV file recording each collapsed
+// variant and the ID (after Tidy) of the variant that replaced it.
+func writeCollapsedVariants(fnm string, tilelib *tileLibrary, collapsed []collapsedVariant) error {
+	f, err := os.OpenFile(fnm, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriter(f)
+	fmt.Fprintf(bufw, "tag\tvariant_hash\trepresentative_variant\trepresentative_hash\tdistance\tuses\n")
+	for _, cv := range collapsed {
+		rep := 0
+		for i, hash := range tilelib.variant[cv.Tag] {
+			if hash == cv.Representative {
+				rep = i + 1
+				break
+			}
+		}
+		fmt.Fprintf(bufw, "%d\t%x\t%d\t%x\t%d\t%d\n", cv.Tag, cv.Hash, rep, cv.Representative, cv.Distance, cv.Uses)
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
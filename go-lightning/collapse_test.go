@@ -0,0 +1,70 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *tilelibSuite) TestCollapseVariants(c *check.C) {
+	tag := func(i int) string { return strings.TrimSuffix(s.tag[i], "\n") }
+	tilelib := &tileLibrary{taglib: &s.taglib, retainTileSequences: true}
+	common := tilelib.getRef(0, []byte(tag(0)+"aaaaaaaaaa"+tag(1)), false)
+	near := tilelib.getRef(0, []byte(tag(0)+"aaaaacaaaa"+tag(1)), false)
+	far := tilelib.getRef(0, []byte(tag(0)+"cccccccccc"+tag(1)), false)
+	other := tilelib.getRef(1, []byte(tag(1)+"gggggggggg"+tag(2)), false)
+	reset := func() {
+		tilelib.compactGenomes = map[string][]tileVariantID{
+			"g1": {common.Variant, common.Variant, other.Variant, other.Variant},
+			"g2": {common.Variant, near.Variant, other.Variant, 0},
+			"g3": {far.Variant, 0, 0, 0},
+		}
+	}
+
+	reset()
+	collapsed := tilelib.CollapseVariants(1, 0)
+	c.Check(collapsed, check.HasLen, 0)
+	c.Check(tilelib.compactGenomes["g2"], check.DeepEquals, []tileVariantID{common.Variant, near.Variant, other.Variant, 0})
+
+	reset()
+	collapsed = tilelib.CollapseVariants(1, 1)
+	c.Assert(collapsed, check.HasLen, 1)
+	c.Check(collapsed[0].Tag, check.Equals, tagID(0))
+	c.Check(collapsed[0].Distance, check.Equals, 1)
+	c.Check(collapsed[0].Uses, check.Equals, 1)
+	c.Check(tilelib.compactGenomes["g1"], check.DeepEquals, []tileVariantID{common.Variant, common.Variant, other.Variant, other.Variant})
+	c.Check(tilelib.compactGenomes["g2"], check.DeepEquals, []tileVariantID{common.Variant, common.Variant, other.Variant, 0})
+	c.Check(tilelib.compactGenomes["g3"], check.DeepEquals, []tileVariantID{far.Variant, 0, 0, 0})
+
+	tilelib.Tidy()
+	c.Check(tilelib.variant[0], check.HasLen, 2)
+}
+
+func (s *tilelibSuite) TestBoundedEditDistance(c *check.C) {
+	for _, trial := range []struct {
+		a, b string
+		k    int
+		dist int
+		ok   bool
+	}{
+		{"acgt", "acgt", 0, 0, true},
+		{"acgt", "acct", 0, 0, false},
+		{"acgt", "acct", 1, 1, true},
+		{"acgt", "agt", 1, 1, true},
+		{"acgt", "acgtt", 1, 1, true},
+		{"acgt", "tgca", 2, 0, false},
+		{"acgt", "tgca", 4, 4, true},
+		{"", "aa", 1, 0, false},
+		{"", "aa", 2, 2, true},
+	} {
+		dist, ok := boundedEditDistance([]byte(trial.a), []byte(trial.b), trial.k)
+		c.Check(ok, check.Equals, trial.ok, check.Commentf("%+v", trial))
+		if ok {
+			c.Check(dist, check.Equals, trial.dist, check.Commentf("%+v", trial))
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// columnID returns a stable identifier for a one-hot column, of the
+// form "{tag}:{variant hash}:{hom|het}".
+//
+// Unlike column positions and (frequency-ranked) variant numbers,
+// which depend on the input chunks, sample set, and filters, the
+// column ID depends only on the tag, the tile sequence, and
+// zygosity. So, provided the same tag library is used, a column in
+// one slice-numpy run can be matched with the corresponding column
+// in another.
+func (xref *onehotXref) columnID() string {
+	zygosity := "het"
+	if xref.hom {
+		zygosity = "hom"
+	}
+	return fmt.Sprintf("%d:%x:%s", xref.tag, xref.hash, zygosity)
+}
+
+// writeColumnIDs writes a CSV file mapping the stable column ID of
+// each one-hot column (see columnID) to its position in the
+// corresponding onehot matrix.
+func writeColumnIDs(fnm string, xrefs []onehotXref) error {
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriterSize(f, 1<<20)
+	_, err = fmt.Fprint(bufw, "ColumnID,Column\n")
+	if err != nil {
+		return err
+	}
+	for i := range xrefs {
+		_, err = fmt.Fprintf(bufw, "%s,%d\n", xrefs[i].columnID(), i)
+		if err != nil {
+			return err
+		}
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeChromosomes writes a CSV file listing the given chromosome
+// names, so the chromosome row of onehot-columns output (an index
+// into this list) can be translated to a name.
+func writeChromosomes(fnm string, names []string) error {
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriter(f)
+	_, err = fmt.Fprint(bufw, "Index,Chromosome\n")
+	if err != nil {
+		return err
+	}
+	for i, name := range names {
+		_, err = fmt.Fprintf(bufw, "%d,%s\n", i, name)
+		if err != nil {
+			return err
+		}
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// loadChromosomes reads a file written by writeChromosomes, and
+// returns the chromosome names in order.
+func loadChromosomes(fnm string) ([]string, error) {
+	f, err := os.Open(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	var names []string
+	for i, row := range rows {
+		if i == 0 {
+			// header
+			continue
+		}
+		if len(row) != 2 || row[0] != strconv.Itoa(i-1) {
+			return nil, fmt.Errorf("%s: unexpected row %q", fnm, row)
+		}
+		names = append(names, row[1])
+	}
+	return names, nil
+}
+
+// loadColumnIDs reads a file written by writeColumnIDs, and returns
+// a map of column ID to column position.
+func loadColumnIDs(fnm string) (map[string]int, error) {
+	f, err := os.Open(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(bufio.NewReader(f)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	if len(rows) < 1 || len(rows[0]) != 2 || rows[0][0] != "ColumnID" {
+		return nil, fmt.Errorf("%s: missing or unexpected header row", fnm)
+	}
+	ids := make(map[string]int, len(rows)-1)
+	for _, row := range rows[1:] {
+		col, err := strconv.Atoi(row[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: cannot parse column %q: %w", fnm, row[1], err)
+		}
+		ids[row[0]] = col
+	}
+	return ids, nil
+}
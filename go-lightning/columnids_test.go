@@ -0,0 +1,36 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"gopkg.in/check.v1"
+)
+
+type columnIDsSuite struct{}
+
+var _ = check.Suite(&columnIDsSuite{})
+
+func (s *columnIDsSuite) TestRoundTrip(c *check.C) {
+	xrefs := []onehotXref{
+		{tag: 3, variant: 2, hom: true, hash: [32]byte{1, 2, 3}},
+		{tag: 3, variant: 2, hom: false, hash: [32]byte{1, 2, 3}},
+		// same tag and hash, different variant number (e.g.,
+		// from a run with a different sample set) => same ID
+		{tag: 3, variant: 5, hom: true, hash: [32]byte{1, 2, 3}},
+		{tag: 4, variant: 2, hom: true, hash: [32]byte{4}},
+	}
+	c.Check(xrefs[0].columnID(), check.Equals, "3:0102030000000000000000000000000000000000000000000000000000000000:hom")
+	c.Check(xrefs[1].columnID(), check.Equals, "3:0102030000000000000000000000000000000000000000000000000000000000:het")
+	c.Check(xrefs[2].columnID(), check.Equals, xrefs[0].columnID())
+
+	fnm := c.MkDir() + "/ids.csv"
+	c.Assert(writeColumnIDs(fnm, xrefs[:2]), check.IsNil)
+	ids, err := loadColumnIDs(fnm)
+	c.Assert(err, check.IsNil)
+	c.Check(ids, check.DeepEquals, map[string]int{
+		xrefs[0].columnID(): 0,
+		xrefs[1].columnID(): 1,
+	})
+}
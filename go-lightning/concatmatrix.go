@@ -0,0 +1,317 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type concatMatrix struct{}
+
+func (cmd *concatMatrix) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	inputDir := flags.String("input-dir", ".", "input `directory` (output of slice-numpy without -merge-output, containing chunk-tag-offset.csv and matrix.NNNN.npy files)")
+	outputFilename := flags.String("o", "", "write all chunks' matrix columns, in tag order, to a single numpy `file`")
+	tags := flags.String("tags", "", "print the matrix file and column (and, with -o, the column in the concatenated matrix) of the first column of each of the given comma-separated `tag IDs`")
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	} else if *outputFilename == "" && *tags == "" {
+		err = errors.New("nothing to do: specify -o and/or -tags")
+		return 2
+	}
+	var lookup []tagID
+	for _, s := range strings.Split(*tags, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		var tag int
+		tag, err = strconv.Atoi(s)
+		if err != nil || tag < 0 {
+			err = fmt.Errorf("invalid tag ID %q in -tags", s)
+			return 2
+		}
+		lookup = append(lookup, tagID(tag))
+	}
+
+	idx, err := loadChunkMatrixIndex(*inputDir)
+	if err != nil {
+		return 1
+	}
+	if *outputFilename != "" {
+		err = idx.Concat(*outputFilename)
+		if err != nil {
+			return 1
+		}
+	}
+	if len(lookup) > 0 {
+		w := csv.NewWriter(stdout)
+		header := []string{"tag", "file", "column"}
+		if *outputFilename != "" {
+			header = append(header, "concat_column")
+		}
+		w.Write(header)
+		for _, tag := range lookup {
+			var chunk, col int
+			chunk, col, err = idx.Lookup(tag)
+			if err != nil {
+				return 1
+			}
+			row := []string{fmt.Sprintf("%d", tag), idx.chunks[chunk].File, fmt.Sprintf("%d", col)}
+			if *outputFilename != "" {
+				row = append(row, fmt.Sprintf("%d", idx.colOffset[chunk]+col))
+			}
+			w.Write(row)
+		}
+		w.Flush()
+		err = w.Error()
+		if err != nil {
+			return 1
+		}
+	}
+	return 0
+}
+
+// chunkTagOffset is an entry in the chunk-tag-offset.csv file
+// written by slice-numpy: the matrix file for one input chunk, and
+// the first tag in the chunk.
+type chunkTagOffset struct {
+	File     string // filename, relative to the slice-numpy output directory
+	StartTag tagID
+	EndTag   tagID // start tag of the next chunk, or -1 for the last chunk
+}
+
+// readChunkTagOffsets reads dir/chunk-tag-offset.csv, and returns
+// its entries sorted by tag.
+func readChunkTagOffsets(dir string) ([]chunkTagOffset, error) {
+	fnm := dir + "/chunk-tag-offset.csv"
+	f, err := open(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	var chunks []chunkTagOffset
+	for i, row := range rows {
+		if len(row) < 2 {
+			return nil, fmt.Errorf("%s line %d: expected 2 fields, got %d", fnm, i+1, len(row))
+		}
+		tag, err := strconv.Atoi(row[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid tag offset %q", fnm, i+1, row[1])
+		}
+		chunks = append(chunks, chunkTagOffset{File: row[0], StartTag: tagID(tag)})
+	}
+	if len(chunks) == 0 {
+		return nil, fmt.Errorf("%s: no chunks", fnm)
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].StartTag < chunks[j].StartTag })
+	for i := range chunks {
+		if i+1 < len(chunks) {
+			chunks[i].EndTag = chunks[i+1].StartTag
+		} else {
+			chunks[i].EndTag = -1
+		}
+	}
+	return chunks, nil
+}
+
+// chunkMatrixIndex maps tags to columns of the per-chunk matrices
+// written by slice-numpy.
+type chunkMatrixIndex struct {
+	dir       string
+	chunks    []chunkTagOffset
+	rows      int
+	dtype     string // numpy type, e.g., "i2", or "f4" with -missing-encoding=nan
+	size      int    // bytes per element
+	cols      []int  // cols[i] is the number of columns in chunk i
+	colOffset []int  // colOffset[i] is the first column of chunk i in the concatenated matrix
+	outcols   []map[tagID]int
+}
+
+// loadChunkMatrixIndex reads chunk-tag-offset.csv and the headers of
+// the chunk matrix files in dir.
+func loadChunkMatrixIndex(dir string) (*chunkMatrixIndex, error) {
+	chunks, err := readChunkTagOffsets(dir)
+	if err != nil {
+		return nil, err
+	}
+	idx := &chunkMatrixIndex{dir: dir, chunks: chunks, outcols: make([]map[tagID]int, len(chunks))}
+	offset := 0
+	for i, chunk := range chunks {
+		dtype, size, rows, cols, err := idx.readHeader(chunk.File)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			idx.rows, idx.dtype, idx.size = rows, dtype, size
+		} else if rows != idx.rows || dtype != idx.dtype {
+			return nil, fmt.Errorf("%s: shape (%d, %d) and dtype %s do not match %s (%d rows, dtype %s)", chunk.File, rows, cols, dtype, chunks[0].File, idx.rows, idx.dtype)
+		}
+		idx.cols = append(idx.cols, cols)
+		idx.colOffset = append(idx.colOffset, offset)
+		offset += cols
+	}
+	return idx, nil
+}
+
+func (idx *chunkMatrixIndex) readHeader(fnm string) (dtype string, size, rows, cols int, err error) {
+	f, err := open(idx.dir + "/" + fnm)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	dtype, size, rows, cols, err = readNumpyHeader(bufio.NewReader(f))
+	if err != nil {
+		err = fmt.Errorf("%s: %w", fnm, err)
+	}
+	return
+}
+
+// Lookup returns the chunk containing the given tag, and the first
+// of the tag's two columns in that chunk's matrix.
+//
+// The column is found in the chunk's annotations file if possible.
+// If the annotations file does not exist, or does not mention the
+// tag (e.g., no tile variants after filtering) but the chunk has a
+// pair of columns for every tag, the column is computed from the
+// tag's offset in the chunk.
+func (idx *chunkMatrixIndex) Lookup(tag tagID) (chunk, col int, err error) {
+	chunk = sort.Search(len(idx.chunks), func(i int) bool { return idx.chunks[i].StartTag > tag }) - 1
+	if chunk < 0 || (idx.chunks[chunk].EndTag >= 0 && tag >= idx.chunks[chunk].EndTag) {
+		return 0, 0, fmt.Errorf("tag %d is not in any chunk", tag)
+	}
+	c := idx.chunks[chunk]
+	outcols, err := idx.loadOutcols(chunk)
+	if err != nil {
+		return 0, 0, err
+	}
+	if outcol, ok := outcols[tag]; ok {
+		return chunk, outcol * 2, nil
+	}
+	col = int(tag-c.StartTag) * 2
+	if outcols == nil && col < idx.cols[chunk] {
+		return chunk, col, nil
+	}
+	if c.EndTag >= 0 && idx.cols[chunk] == int(c.EndTag-c.StartTag)*2 {
+		return chunk, col, nil
+	}
+	return 0, 0, fmt.Errorf("cannot find column for tag %d in %s (it might have been filtered out)", tag, c.File)
+}
+
+// loadOutcols returns the tag => outcol mapping from the given
+// chunk's annotations file, or nil if there is no annotations file.
+func (idx *chunkMatrixIndex) loadOutcols(chunk int) (map[tagID]int, error) {
+	if idx.outcols[chunk] != nil {
+		return idx.outcols[chunk], nil
+	}
+	fnm := idx.dir + "/" + strings.TrimSuffix(idx.chunks[chunk].File, ".npy") + ".annotations.csv"
+	buf, err := os.ReadFile(fnm)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	outcols := map[tagID]int{}
+	for _, line := range bytes.Split(buf, []byte{'\n'}) {
+		if len(line) == 0 || isAnnotationHeader(line) {
+			continue
+		}
+		fields := bytes.SplitN(line, []byte{','}, 3)
+		if len(fields) < 3 {
+			continue
+		}
+		tag, err := strconv.Atoi(string(fields[0]))
+		if err != nil {
+			continue
+		}
+		outcol, err := strconv.Atoi(string(fields[1]))
+		if err != nil {
+			continue
+		}
+		outcols[tagID(tag)] = outcol
+	}
+	idx.outcols[chunk] = outcols
+	return outcols, nil
+}
+
+// Concat writes a numpy file with the same rows and dtype as the
+// chunk matrices (int8, int16, or float32 if slice-numpy was run with
+// -missing-encoding=nan), and all of their columns, in chunk order.
+func (idx *chunkMatrixIndex) Concat(fnm string) error {
+	rdrs := make([]*bufio.Reader, len(idx.chunks))
+	for i, chunk := range idx.chunks {
+		f, err := open(idx.dir + "/" + chunk.File)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rdrs[i] = bufio.NewReaderSize(f, 1<<20)
+		_, _, _, _, err = readNumpyHeader(rdrs[i])
+		if err != nil {
+			return fmt.Errorf("%s: %w", chunk.File, err)
+		}
+	}
+	totalcols := 0
+	for _, cols := range idx.cols {
+		totalcols += cols
+	}
+	log.Infof("writing %s: %d rows, %d columns from %d chunks", fnm, idx.rows, totalcols, len(idx.chunks))
+	out, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	bufw := bufio.NewWriterSize(out, 1<<24)
+	descr := "<" + idx.dtype
+	if idx.size == 1 {
+		descr = "|" + idx.dtype
+	}
+	err = writeNumpyHeader(bufw, descr, idx.rows, totalcols)
+	if err != nil {
+		return err
+	}
+	for row := 0; row < idx.rows; row++ {
+		for i, rdr := range rdrs {
+			_, err = io.CopyN(bufw, rdr, int64(idx.cols[i]*idx.size))
+			if err != nil {
+				return fmt.Errorf("%s: row %d: %w", idx.chunks[i].File, row, err)
+			}
+		}
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,124 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"math"
+	"os"
+
+	"github.com/kshedden/gonpy"
+	"gopkg.in/check.v1"
+)
+
+type concatMatrixSuite struct{}
+
+var _ = check.Suite(&concatMatrixSuite{})
+
+func (s *concatMatrixSuite) TestConcat(c *check.C) {
+	tmpdir := c.MkDir()
+	// chunk 0 has tags 0-2, with a pair of columns for each tag
+	c.Assert(writeNumpyInt16(tmpdir+"/matrix.0000.npy", []int16{
+		0, 1, 1, 1, 2, 0,
+		1, 0, 0, 0, 1, 2,
+	}, 2, 6), check.IsNil)
+	// chunk 1 has tags 3-5, but tag 4 was skipped (outcol 1 is
+	// tag 5)
+	c.Assert(writeNumpyInt16(tmpdir+"/matrix.0001.npy", []int16{
+		3, 4, 5, 6,
+		7, 8, 9, 10,
+	}, 2, 4), check.IsNil)
+	c.Assert(os.WriteFile(tmpdir+"/matrix.0001.annotations.csv", []byte(annotationVersionLine+`
+tag,outcol,variant,hgvs,chrom,pos,ref,alt,left
+3,0,1,=,chr1,100,,,
+5,1,2,chr1:g.205A>G,chr1,205,A,G,
+`), 0666), check.IsNil)
+	c.Assert(os.WriteFile(tmpdir+"/chunk-tag-offset.csv", []byte("\"matrix.0001.npy\",3\n\"matrix.0000.npy\",0\n"), 0666), check.IsNil)
+
+	var stdout bytes.Buffer
+	exited := (&concatMatrix{}).RunCommand("concat-matrix", []string{
+		"-input-dir=" + tmpdir,
+		"-o=" + tmpdir + "/matrix.npy",
+		"-tags=1,5,3",
+	}, nil, &stdout, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	c.Check(stdout.String(), check.Equals, `tag,file,column,concat_column
+1,matrix.0000.npy,2,2
+5,matrix.0001.npy,2,8
+3,matrix.0001.npy,0,6
+`)
+
+	f, err := os.Open(tmpdir + "/matrix.npy")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	npy, err := gonpy.NewReader(f)
+	c.Assert(err, check.IsNil)
+	c.Check(npy.Shape, check.DeepEquals, []int{2, 10})
+	data, err := npy.GetInt16()
+	c.Assert(err, check.IsNil)
+	c.Check(data, check.DeepEquals, []int16{
+		0, 1, 1, 1, 2, 0, 3, 4, 5, 6,
+		1, 0, 0, 0, 1, 2, 7, 8, 9, 10,
+	})
+
+	// tag 4 was filtered out, tag 7 is past the end of the last
+	// chunk
+	for _, tag := range []string{"4", "7"} {
+		exited = (&concatMatrix{}).RunCommand("concat-matrix", []string{
+			"-input-dir=" + tmpdir,
+			"-tags=" + tag,
+		}, nil, &stdout, os.Stderr)
+		c.Check(exited, check.Equals, 1)
+	}
+
+	exited = (&concatMatrix{}).RunCommand("concat-matrix", []string{"-input-dir=" + tmpdir}, nil, &stdout, os.Stderr)
+	c.Check(exited, check.Equals, 2)
+}
+
+func (s *concatMatrixSuite) TestConcatFloat32(c *check.C) {
+	tmpdir := c.MkDir()
+	writeFloat32 := func(fnm string, data []float32, rows, cols int) {
+		f, err := os.Create(fnm)
+		c.Assert(err, check.IsNil)
+		defer f.Close()
+		npw, err := gonpy.NewWriter(nopCloser{f})
+		c.Assert(err, check.IsNil)
+		npw.Shape = []int{rows, cols}
+		c.Assert(npw.WriteFloat32(data), check.IsNil)
+	}
+	nan := float32(math.NaN())
+	writeFloat32(tmpdir+"/matrix.0000.npy", []float32{1, nan, 2, 0}, 2, 2)
+	writeFloat32(tmpdir+"/matrix.0001.npy", []float32{3, 4, nan, 5}, 2, 2)
+	c.Assert(os.WriteFile(tmpdir+"/chunk-tag-offset.csv", []byte("\"matrix.0000.npy\",0\n\"matrix.0001.npy\",1\n"), 0666), check.IsNil)
+
+	exited := (&concatMatrix{}).RunCommand("concat-matrix", []string{
+		"-input-dir=" + tmpdir,
+		"-o=" + tmpdir + "/matrix.npy",
+	}, nil, os.Stdout, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	f, err := os.Open(tmpdir + "/matrix.npy")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	npy, err := gonpy.NewReader(f)
+	c.Assert(err, check.IsNil)
+	c.Check(npy.Shape, check.DeepEquals, []int{2, 4})
+	data, err := npy.GetFloat32()
+	c.Assert(err, check.IsNil)
+	c.Assert(data, check.HasLen, 8)
+	c.Check(math.IsNaN(float64(data[1])), check.Equals, true)
+	c.Check(math.IsNaN(float64(data[6])), check.Equals, true)
+	data[1], data[6] = -1, -1
+	c.Check(data, check.DeepEquals, []float32{1, -1, 3, 4, 2, 0, -1, 5})
+
+	// chunks with different dtypes cannot be concatenated
+	c.Assert(writeNumpyInt16(tmpdir+"/matrix.0001.npy", []int16{3, 4, 0, 5}, 2, 2), check.IsNil)
+	var stderr bytes.Buffer
+	exited = (&concatMatrix{}).RunCommand("concat-matrix", []string{
+		"-input-dir=" + tmpdir,
+		"-o=" + tmpdir + "/matrix.npy",
+	}, nil, os.Stdout, &stderr)
+	c.Check(exited, check.Equals, 1)
+	c.Check(stderr.String(), check.Matches, `matrix.0001.npy: shape \(2, 2\) and dtype i2 do not match matrix.0000.npy \(2 rows, dtype f4\)\n`)
+}
@@ -0,0 +1,148 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// lightningConfig is the content of a config file that provides
+// default flag values, e.g.:
+//
+//	defaults:
+//	  # used by every subcommand that has these flags
+//	  project: zzzzz-j7d0g-0123456789abcde
+//	  priority: 600
+//	commands:
+//	  # used by "lightning export" only
+//	  export:
+//	    ref: /path/to/ref.fasta
+//	    output-format: pvcf
+type lightningConfig struct {
+	Defaults map[string]interface{}            `yaml:"defaults"`
+	Commands map[string]map[string]interface{} `yaml:"commands"`
+}
+
+const (
+	configFileEnv     = "LIGHTNING_CONFIG"
+	defaultConfigFile = "lightning.yaml"
+	configEnvPrefix   = "LIGHTNING_"
+)
+
+// parseFlags is like flags.Parse(args), except that it first sets
+// flag values from the config file (the file named by
+// $LIGHTNING_CONFIG, or lightning.yaml in the current directory if
+// that exists) and from environment variables named after the flags
+// (e.g., LIGHTNING_OUTPUT_DIR for -output-dir).
+//
+// Command line flags take precedence over environment variables,
+// which take precedence over the "commands" section of the config
+// file, which takes precedence over the "defaults" section.
+//
+// parseFlags also adds the flags that apply to every command (see
+// keepFlags).
+func parseFlags(flags *flag.FlagSet, prog string, args []string) error {
+	keepFlags(flags)
+	err := loadFlagConfig(flags, prog)
+	if err == nil {
+		err = loadFlagEnv(flags)
+	}
+	if err == nil {
+		err = flags.Parse(args)
+	}
+	if err == nil {
+		err = checkKeepFlags()
+	}
+	if planned, ok := flags.Output().(*plannedStep); ok {
+		planned.flags, planned.err = flags, err
+		return errPlanned
+	}
+	return err
+}
+
+func loadFlagConfig(flags *flag.FlagSet, prog string) error {
+	fnm := os.Getenv(configFileEnv)
+	if fnm == "" {
+		fnm = defaultConfigFile
+		if _, err := os.Stat(fnm); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	buf, err := ioutil.ReadFile(fnm)
+	if err != nil {
+		return err
+	}
+	var cfg lightningConfig
+	err = yaml.UnmarshalStrict(buf, &cfg)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fnm, err)
+	}
+	// Flags in the defaults section are skipped if this command
+	// doesn't have them.
+	for name, val := range cfg.Defaults {
+		if flags.Lookup(name) == nil {
+			continue
+		}
+		err = setFlagValue(flags, name, val)
+		if err != nil {
+			return fmt.Errorf("%s: defaults: %w", fnm, err)
+		}
+	}
+	subcmd := prog
+	if i := strings.LastIndex(prog, " "); i >= 0 {
+		subcmd = prog[i+1:]
+	}
+	for name, val := range cfg.Commands[subcmd] {
+		if flags.Lookup(name) == nil {
+			return fmt.Errorf("%s: commands: %s: no such flag -%s", fnm, subcmd, name)
+		}
+		err = setFlagValue(flags, name, val)
+		if err != nil {
+			return fmt.Errorf("%s: commands: %s: %w", fnm, subcmd, err)
+		}
+	}
+	return nil
+}
+
+func setFlagValue(flags *flag.FlagSet, name string, val interface{}) error {
+	switch val.(type) {
+	case string, bool, int, float64:
+	default:
+		return fmt.Errorf("%s: value must be a string, number, or boolean", name)
+	}
+	err := flags.Set(name, fmt.Sprint(val))
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// flagEnvName returns the name of the environment variable that
+// overrides the given flag, e.g., LIGHTNING_GVCF_REGIONS_PY for
+// -gvcf-regions.py.
+func flagEnvName(name string) string {
+	return configEnvPrefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+}
+
+func loadFlagEnv(flags *flag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		env := flagEnvName(f.Name)
+		val, ok := os.LookupEnv(env)
+		if !ok || err != nil {
+			return
+		}
+		if e := flags.Set(f.Name, val); e != nil {
+			err = fmt.Errorf("%s: %w", env, e)
+		}
+	})
+	return err
+}
@@ -0,0 +1,104 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type configSuite struct{}
+
+var _ = check.Suite(&configSuite{})
+
+func (s *configSuite) SetUpTest(c *check.C) {
+	for _, env := range []string{configFileEnv, "LIGHTNING_PRIORITY", "LIGHTNING_OUTPUT_DIR"} {
+		os.Unsetenv(env)
+	}
+}
+
+func (s *configSuite) TearDownTest(c *check.C) {
+	s.SetUpTest(c)
+}
+
+func (s *configSuite) testFlags() (*flag.FlagSet, *string, *int, *string, *bool) {
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	project := flags.String("project", "", "project")
+	priority := flags.Int("priority", 500, "priority")
+	outputDir := flags.String("output-dir", "./out", "output dir")
+	local := flags.Bool("local", false, "local")
+	return flags, project, priority, outputDir, local
+}
+
+func (s *configSuite) TestPrecedence(c *check.C) {
+	fnm := c.MkDir() + "/lightning.yaml"
+	err := ioutil.WriteFile(fnm, []byte(`
+defaults:
+  project: zzzzz-j7d0g-000000000000000
+  priority: 600
+  local: true
+  not-a-flag-here: ignored
+commands:
+  export:
+    priority: 700
+    output-dir: /tmp/export
+`), 0666)
+	c.Assert(err, check.IsNil)
+	os.Setenv(configFileEnv, fnm)
+
+	flags, project, priority, outputDir, local := s.testFlags()
+	err = parseFlags(flags, "lightning export", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(*project, check.Equals, "zzzzz-j7d0g-000000000000000")
+	c.Check(*priority, check.Equals, 700)
+	c.Check(*outputDir, check.Equals, "/tmp/export")
+	c.Check(*local, check.Equals, true)
+
+	// other commands get only the defaults
+	flags, _, priority, outputDir, _ = s.testFlags()
+	err = parseFlags(flags, "lightning slice", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(*priority, check.Equals, 600)
+	c.Check(*outputDir, check.Equals, "./out")
+
+	// environment overrides config file, command line
+	// overrides environment
+	os.Setenv("LIGHTNING_PRIORITY", "800")
+	os.Setenv("LIGHTNING_OUTPUT_DIR", "/tmp/env")
+	flags, _, priority, outputDir, _ = s.testFlags()
+	err = parseFlags(flags, "lightning export", []string{"-priority=900"})
+	c.Assert(err, check.IsNil)
+	c.Check(*priority, check.Equals, 900)
+	c.Check(*outputDir, check.Equals, "/tmp/env")
+}
+
+func (s *configSuite) TestErrors(c *check.C) {
+	fnm := c.MkDir() + "/lightning.yaml"
+	os.Setenv(configFileEnv, fnm)
+	for _, trial := range []struct {
+		config string
+		errRe  string
+	}{
+		{"commands:\n  export:\n    no-such-flag: 1\n", `.*no such flag -no-such-flag`},
+		{"defaults:\n  priority: high\n", `.*priority: .*invalid syntax.*`},
+		{"defaults:\n  project: [a, b]\n", `.*project: value must be a string, number, or boolean`},
+		{"default:\n  project: x\n", `.*field default not found.*`},
+	} {
+		err := ioutil.WriteFile(fnm, []byte(trial.config), 0666)
+		c.Assert(err, check.IsNil)
+		flags, _, _, _, _ := s.testFlags()
+		err = parseFlags(flags, "lightning export", nil)
+		c.Check(err, check.ErrorMatches, trial.errRe)
+	}
+
+	os.Unsetenv(configFileEnv)
+	os.Setenv("LIGHTNING_PRIORITY", "high")
+	flags, _, _, _, _ := s.testFlags()
+	err := parseFlags(flags, "lightning export", nil)
+	c.Check(err, check.ErrorMatches, `LIGHTNING_PRIORITY: .*`)
+}
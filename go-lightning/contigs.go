@@ -0,0 +1,175 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Contig names are compared in canonical form, so regions files,
+// references, and libraries that use different naming conventions
+// ("chr1" vs. "1", "chrM" vs. "MT", "NC_000001.11") refer to the
+// same contigs.
+//
+// Additional aliases can be listed in a file given with the
+// -contig-aliases flag, one "alias canonical-name" pair per line,
+// e.g.:
+//
+//	# alias   canonical
+//	CM000663.2  1
+//	chr1_KI270706v1_random  1_KI270706v1_random
+var contigAliasTable map[string]string
+
+// RefSeq accessions of the primary assembly chromosomes, e.g.,
+// NC_000001.11 (GRCh38 chr1), NC_000023.10 (GRCh37 chrX).
+var refseqChromosomeRe = regexp.MustCompile(`^NC_0000(\d\d)\.\d+$`)
+
+// contigAliasOptions is the -contig-aliases option shared by
+// commands that compare contig names.
+type contigAliasOptions struct {
+	filename string
+}
+
+func (ca *contigAliasOptions) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&ca.filename, "contig-aliases", "", "load additional contig name aliases from `file` (one \"alias canonical-name\" pair per line)")
+}
+
+// Load loads the alias file (if any) for use by canonicalContig. It
+// must be called before any contig names are compared.
+func (ca *contigAliasOptions) Load() error {
+	aliases, err := loadContigAliases(ca.filename)
+	if err != nil {
+		return err
+	}
+	contigAliasTable = aliases
+	return nil
+}
+
+// TranslatePaths converts the alias filename (if any) to a path
+// inside the container.
+func (ca *contigAliasOptions) TranslatePaths(runner *arvadosContainerRunner) error {
+	if ca.filename == "" {
+		return nil
+	}
+	return runner.TranslatePaths(&ca.filename)
+}
+
+// Args returns command line arguments that pass the alias file to a
+// container.
+func (ca *contigAliasOptions) Args() []string {
+	return []string{"-contig-aliases=" + ca.filename}
+}
+
+// loadContigAliases reads an alias table from the given file. An
+// empty filename yields an empty table.
+func loadContigAliases(fnm string) (map[string]string, error) {
+	aliases := map[string]string{}
+	if fnm == "" {
+		return aliases, nil
+	}
+	buf, err := ioutil.ReadFile(fnm)
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		} else if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: line %d: expected \"alias canonical-name\"", fnm, i+1)
+		}
+		aliases[fields[0]] = fields[1]
+	}
+	log.Printf("loaded %d contig aliases from %s", len(aliases), fnm)
+	return aliases, nil
+}
+
+// canonicalContig returns the canonical form of the given contig
+// name: the alias loaded by contigAliasOptions.Load if there is one,
+// otherwise the name without any "chr" prefix, with M renamed to MT
+// and RefSeq chromosome accessions renamed to chromosome numbers.
+func canonicalContig(name string) string {
+	if canonical, ok := contigAliasTable[name]; ok {
+		return canonical
+	}
+	name = strings.TrimPrefix(name, "chr")
+	if name == "M" {
+		return "MT"
+	}
+	if m := refseqChromosomeRe.FindStringSubmatch(name); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		switch {
+		case n >= 1 && n <= 22:
+			return strconv.Itoa(n)
+		case n == 23:
+			return "X"
+		case n == 24:
+			return "Y"
+		}
+	}
+	if name == "NC_012920.1" {
+		return "MT"
+	}
+	return name
+}
+
+// contigNameStyles are the allowed values of the
+// -output-contig-names flag.
+var contigNameStyles = map[string]func(string) string{
+	"keep":    func(name string) string { return name },
+	"ensembl": canonicalContig,
+	"ucsc": func(name string) string {
+		name = canonicalContig(name)
+		if name == "MT" {
+			return "chrM"
+		}
+		return "chr" + name
+	},
+}
+
+// contigOrderKey is a sort key for contig names (see contigOrder).
+type contigOrderKey struct {
+	rank int
+	name string
+}
+
+func (k contigOrderKey) less(other contigOrderKey) bool {
+	if k.rank != other.rank {
+		return k.rank < other.rank
+	}
+	return k.name < other.name
+}
+
+// contigOrder returns a key that sorts contig names in the
+// conventional order (1, 2, ..., 22, X, Y, MT, then any others
+// alphabetically), regardless of naming convention.
+func contigOrder(name string) contigOrderKey {
+	name = canonicalContig(name)
+	if n, err := strconv.Atoi(name); err == nil {
+		return contigOrderKey{rank: n}
+	}
+	switch name {
+	case "X":
+		return contigOrderKey{rank: 1000}
+	case "Y":
+		return contigOrderKey{rank: 1001}
+	case "MT":
+		return contigOrderKey{rank: 1002}
+	}
+	return contigOrderKey{rank: 1003, name: name}
+}
+
+// chromLess reports whether contig a sorts before contig b (see
+// contigOrder).
+func chromLess(a, b string) bool {
+	return contigOrder(a).less(contigOrder(b))
+}
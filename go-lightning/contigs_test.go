@@ -0,0 +1,115 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type contigsSuite struct{}
+
+var _ = check.Suite(&contigsSuite{})
+
+func (s *contigsSuite) TearDownTest(c *check.C) {
+	os.Unsetenv("LIGHTNING_CONTIG_ALIASES")
+	contigAliasTable = nil
+}
+
+func (s *contigsSuite) TestCanonical(c *check.C) {
+	for in, out := range map[string]string{
+		"chr1":         "1",
+		"1":            "1",
+		"chrX":         "X",
+		"chrM":         "MT",
+		"MT":           "MT",
+		"NC_000001.11": "1",
+		"NC_000023.10": "X",
+		"NC_000024.10": "Y",
+		"NC_012920.1":  "MT",
+		"chrUn_gl0001": "Un_gl0001",
+	} {
+		c.Check(canonicalContig(in), check.Equals, out, check.Commentary(in))
+	}
+	c.Check(contigNameStyles["ucsc"]("MT"), check.Equals, "chrM")
+	c.Check(contigNameStyles["ucsc"]("NC_000002.12"), check.Equals, "chr2")
+	c.Check(contigNameStyles["ensembl"]("chr2"), check.Equals, "2")
+	c.Check(contigNameStyles["keep"]("chr2"), check.Equals, "chr2")
+}
+
+func (s *contigsSuite) TestAliasFile(c *check.C) {
+	fnm := c.MkDir() + "/aliases.txt"
+	err := ioutil.WriteFile(fnm, []byte("# comment\nCM000663.2\t1\n\nmychr2 2\n"), 0666)
+	c.Assert(err, check.IsNil)
+	ca := contigAliasOptions{filename: fnm}
+	c.Assert(ca.Load(), check.IsNil)
+	c.Check(canonicalContig("CM000663.2"), check.Equals, "1")
+	c.Check(canonicalContig("mychr2"), check.Equals, "2")
+	c.Check(canonicalContig("chr3"), check.Equals, "3")
+	c.Check(ca.Args(), check.DeepEquals, []string{"-contig-aliases=" + fnm})
+
+	var m mask
+	m.Add("CM000663.2", 100, 200)
+	m.Add("chr2", 100, 200)
+	m.Freeze()
+	c.Check(m.Check("chr1", 150, 160), check.Equals, true)
+	c.Check(m.Check("1", 150, 160), check.Equals, true)
+	c.Check(m.Check("mychr2", 150, 160), check.Equals, true)
+	c.Check(m.Check("chr3", 150, 160), check.Equals, false)
+
+	// no file => no aliases
+	c.Assert((&contigAliasOptions{}).Load(), check.IsNil)
+	c.Check(canonicalContig("CM000663.2"), check.Equals, "CM000663.2")
+
+	err = ioutil.WriteFile(fnm, []byte("a b c\n"), 0666)
+	c.Assert(err, check.IsNil)
+	c.Check(ca.Load(), check.ErrorMatches, `.*/aliases.txt: line 1: expected "alias canonical-name"`)
+	ca.filename = fnm + ".missing"
+	c.Check(ca.Load(), check.NotNil)
+}
+
+// The alias file can be given in the environment or config file,
+// like any other flag, and a bad alias file is reported before the
+// command does any work.
+func (s *contigsSuite) TestAliasFlag(c *check.C) {
+	tmpdir := c.MkDir()
+	fnm := tmpdir + "/aliases.txt"
+	err := ioutil.WriteFile(fnm, []byte("chr1 1 extra\n"), 0666)
+	c.Assert(err, check.IsNil)
+	os.Setenv("LIGHTNING_CONTIG_ALIASES", fnm)
+
+	var ca contigAliasOptions
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	ca.Flags(flags)
+	c.Assert(parseFlags(flags, "lightning test", nil), check.IsNil)
+	c.Check(ca.filename, check.Equals, fnm)
+
+	var stderr bytes.Buffer
+	exited := (&extractRegions{}).RunCommand("lightning extract-regions", []string{
+		"-local=true",
+		"-i", tmpdir + "/nonexistent",
+		"-regions", tmpdir + "/nonexistent.bed",
+	}, nil, ioutil.Discard, &stderr)
+	c.Check(exited, check.Equals, 1)
+	c.Check(stderr.String(), check.Matches, `.*/aliases.txt: line 1: .*\n`)
+}
+
+func (s *contigsSuite) TestRenameContigs(c *check.C) {
+	refseq := map[string][]tileLibRef{"1": {{Tag: 1, Variant: 1}}, "MT": nil}
+	renamed, err := renameContigs(refseq, contigNameStyles["ucsc"])
+	c.Check(err, check.IsNil)
+	c.Check(renamed, check.HasLen, 2)
+	c.Check(renamed["chr1"], check.HasLen, 1)
+	_, ok := renamed["chrM"]
+	c.Check(ok, check.Equals, true)
+
+	refseq["chr1"] = nil
+	_, err = renameContigs(refseq, contigNameStyles["ensembl"])
+	c.Check(err, check.ErrorMatches, `contigs .* would both be renamed to "1"`)
+}
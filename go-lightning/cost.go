@@ -0,0 +1,219 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	costFromCluster  = "cluster"  // reported by the Arvados cluster
+	costFromEstimate = "estimate" // instance price * run time
+)
+
+// containerCost describes the compute resources used by a single
+// container request, and what they cost.
+type containerCost struct {
+	Stage                string // e.g., "lightning import"
+	Name                 string // container request name, e.g., "lightning import (batch 1 of 4)"
+	ContainerRequestUUID string
+	ContainerUUID        string
+	InstanceType         string     `json:",omitempty"` // cloud provider instance type, if known
+	Preemptible          bool       `json:",omitempty"`
+	Price                float64    `json:",omitempty"` // instance price per hour, if known
+	StartedAt            *time.Time `json:",omitempty"`
+	FinishedAt           *time.Time `json:",omitempty"`
+	Duration             float64    // seconds
+	Cost                 float64
+	CostSource           string // costFromCluster, costFromEstimate, or "" if unknown
+}
+
+// nodeInfo is the subset of the node.json file (saved by crunch-run
+// in the container log collection) that we use to determine the
+// instance type and price.
+type nodeInfo struct {
+	ProviderType string
+	Price        float64
+	Preemptible  bool
+}
+
+func (cc containerCost) String() string {
+	s := fmt.Sprintf("ran for %s", (time.Duration(cc.Duration) * time.Second).String())
+	if cc.InstanceType != "" {
+		s += " on " + cc.InstanceType
+	}
+	switch cc.CostSource {
+	case costFromCluster:
+		s += fmt.Sprintf(", cost %.2f", cc.Cost)
+	case costFromEstimate:
+		s += fmt.Sprintf(", estimated cost %.2f", cc.Cost)
+	default:
+		s += ", cost unknown"
+	}
+	return s
+}
+
+// containerCost returns the resources used by the given (finished)
+// container request and container. If the cluster doesn't report
+// the container's cost, it is estimated from the instance price
+// recorded in the log collection.
+func (runner *arvadosContainerRunner) containerCost(cr arvados.ContainerRequest, c arvados.Container) containerCost {
+	stage := runner.Name
+	if i := strings.Index(stage, " (batch "); i >= 0 {
+		stage = stage[:i]
+	}
+	cc := containerCost{
+		Stage:                stage,
+		Name:                 cr.Name,
+		ContainerRequestUUID: cr.UUID,
+		ContainerUUID:        c.UUID,
+		StartedAt:            c.StartedAt,
+		FinishedAt:           c.FinishedAt,
+	}
+	if c.StartedAt != nil && c.FinishedAt != nil {
+		cc.Duration = c.FinishedAt.Sub(*c.StartedAt).Seconds()
+	}
+	if cr.LogUUID != "" {
+		node, err := runner.nodeInfo(cr.LogUUID)
+		if err != nil {
+			log.Warnf("cannot determine instance type for container %s: %s", c.UUID, err)
+		} else {
+			cc.InstanceType = node.ProviderType
+			cc.Price = node.Price
+			cc.Preemptible = node.Preemptible
+		}
+	}
+	if c.Cost > 0 {
+		cc.Cost = c.Cost
+		cc.CostSource = costFromCluster
+	} else if cc.Price > 0 && cc.Duration > 0 {
+		cc.Cost = cc.Price * cc.Duration / 3600
+		cc.CostSource = costFromEstimate
+	}
+	return cc
+}
+
+func (runner *arvadosContainerRunner) nodeInfo(logUUID string) (nodeInfo, error) {
+	var node nodeInfo
+	fs, err := collectionFS(runner.Client, logUUID)
+	if err != nil {
+		return node, err
+	}
+	f, err := fs.Open("node.json")
+	if err != nil {
+		return node, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&node)
+	if err != nil {
+		return node, fmt.Errorf("node.json: %w", err)
+	}
+	return node, nil
+}
+
+// costReport is the content of the cost.json file that accumulates
+// the costs of all container requests saved in a log directory.
+type costReport struct {
+	Total  float64
+	Stages []stageCost
+	Runs   []containerCost
+}
+
+type stageCost struct {
+	Stage       string
+	Runs        int
+	Duration    float64 // seconds, total for all runs
+	Cost        float64 // total for all runs with known cost
+	UnknownCost int     // number of runs with unknown cost
+}
+
+// summarize recomputes the per-stage totals from report.Runs.
+func (report *costReport) summarize() {
+	report.Total = 0
+	report.Stages = nil
+	idx := map[string]int{}
+	for _, cc := range report.Runs {
+		i, ok := idx[cc.Stage]
+		if !ok {
+			i = len(report.Stages)
+			idx[cc.Stage] = i
+			report.Stages = append(report.Stages, stageCost{Stage: cc.Stage})
+		}
+		sc := &report.Stages[i]
+		sc.Runs++
+		sc.Duration += cc.Duration
+		if cc.CostSource == "" {
+			sc.UnknownCost++
+		}
+		sc.Cost += cc.Cost
+		report.Total += cc.Cost
+	}
+	sort.Slice(report.Stages, func(i, j int) bool {
+		return report.Stages[i].Stage < report.Stages[j].Stage
+	})
+}
+
+// costReportMtx prevents concurrent batches from losing each
+// other's updates to cost.json.
+var costReportMtx sync.Mutex
+
+// save writes cc to dir/{container request UUID}/cost.json, and
+// adds it to the aggregate report in dir/cost.json.
+func (cc containerCost) save(dir string) error {
+	buf, err := json.MarshalIndent(cc, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Join(dir, cc.ContainerRequestUUID), 0777)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, cc.ContainerRequestUUID, "cost.json"), append(buf, '\n'), 0666)
+	if err != nil {
+		return err
+	}
+
+	costReportMtx.Lock()
+	defer costReportMtx.Unlock()
+	fnm := filepath.Join(dir, "cost.json")
+	var report costReport
+	buf, err = ioutil.ReadFile(fnm)
+	if err == nil {
+		err = json.Unmarshal(buf, &report)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fnm, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	runs := report.Runs[:0]
+	for _, run := range report.Runs {
+		if run.ContainerRequestUUID != cc.ContainerRequestUUID {
+			runs = append(runs, run)
+		}
+	}
+	report.Runs = append(runs, cc)
+	report.summarize()
+	buf, err = json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(fnm+".tmp", append(buf, '\n'), 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(fnm+".tmp", fnm)
+}
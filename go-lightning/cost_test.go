@@ -0,0 +1,56 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"gopkg.in/check.v1"
+)
+
+type costSuite struct{}
+
+var _ = check.Suite(&costSuite{})
+
+func (s *costSuite) TestSaveAggregate(c *check.C) {
+	dir := c.MkDir()
+	for _, cc := range []containerCost{
+		{Stage: "lightning import", ContainerRequestUUID: "zzzzz-xvhdp-000000000000001", Duration: 3600, Cost: 2, CostSource: costFromCluster},
+		{Stage: "lightning import", ContainerRequestUUID: "zzzzz-xvhdp-000000000000002", Duration: 1800, Cost: 0.5, CostSource: costFromEstimate},
+		{Stage: "lightning export", ContainerRequestUUID: "zzzzz-xvhdp-000000000000003", Duration: 60},
+		// same container request again: replaces the
+		// earlier entry instead of counting it twice
+		{Stage: "lightning import", ContainerRequestUUID: "zzzzz-xvhdp-000000000000002", Duration: 1800, Cost: 1, CostSource: costFromEstimate},
+	} {
+		c.Assert(cc.save(dir), check.IsNil)
+	}
+
+	buf, err := ioutil.ReadFile(dir + "/cost.json")
+	c.Assert(err, check.IsNil)
+	var report costReport
+	err = json.Unmarshal(buf, &report)
+	c.Assert(err, check.IsNil)
+	c.Check(report.Runs, check.HasLen, 3)
+	c.Check(report.Total, check.Equals, 3.0)
+	c.Check(report.Stages, check.DeepEquals, []stageCost{
+		{Stage: "lightning export", Runs: 1, Duration: 60, UnknownCost: 1},
+		{Stage: "lightning import", Runs: 2, Duration: 5400, Cost: 3},
+	})
+
+	buf, err = ioutil.ReadFile(dir + "/zzzzz-xvhdp-000000000000002/cost.json")
+	c.Assert(err, check.IsNil)
+	var cc containerCost
+	err = json.Unmarshal(buf, &cc)
+	c.Assert(err, check.IsNil)
+	c.Check(cc.Cost, check.Equals, 1.0)
+}
+
+func (s *costSuite) TestString(c *check.C) {
+	cc := containerCost{InstanceType: "m5.large", Duration: 90, Cost: 0.0123, CostSource: costFromEstimate}
+	c.Check(cc.String(), check.Equals, "ran for 1m30s on m5.large, estimated cost 0.01")
+	cc = containerCost{Duration: 5}
+	c.Check(cc.String(), check.Equals, "ran for 5s, cost unknown")
+}
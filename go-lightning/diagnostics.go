@@ -0,0 +1,190 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// errorJSONEnv is the environment variable that tells Main where to
+// write an error.json file (see diagnostic) if the command fails.
+// arvadosContainerRunner sets it to /mnt/output/error.json, so the
+// caller can retrieve it from the output collection.
+const errorJSONEnv = "LIGHTNING_ERROR_JSON"
+
+// diagnostic is a machine-readable description of a command failure,
+// written to error.json.
+type diagnostic struct {
+	Command  string `json:"command"`
+	ExitCode int    `json:"exit_code"`
+	Message  string `json:"message"`
+	Phase    string `json:"phase,omitempty"` // e.g., "reading input", "merging output"
+	File     string `json:"file,omitempty"`  // offending input file, if known
+	Tag      *tagID `json:"tag,omitempty"`   // offending tag, if known
+}
+
+func (d *diagnostic) String() string {
+	s := d.Message
+	if d.Phase != "" {
+		s += " (phase: " + d.Phase
+		if d.File != "" {
+			s += ", file: " + d.File
+		}
+		if d.Tag != nil {
+			s += fmt.Sprintf(", tag: %d", *d.Tag)
+		}
+		s += ")"
+	}
+	return s
+}
+
+// diagnosticError annotates an error with the phase, file, and tag
+// where it occurred. Its Error() is the same as the wrapped error's,
+// so wrapping an error doesn't change the message printed by the
+// command.
+type diagnosticError struct {
+	phase string
+	file  string
+	tag   *tagID
+	err   error
+}
+
+func (e *diagnosticError) Error() string { return e.err.Error() }
+func (e *diagnosticError) Unwrap() error { return e.err }
+
+var (
+	lastDiagnosticError    *diagnosticError
+	lastDiagnosticErrorMtx sync.Mutex
+)
+
+// diagnose returns err annotated with the given phase and file (file
+// may be empty), for error.json. If err is nil, it returns nil.
+func diagnose(err error, phase, file string) error {
+	return newDiagnosticError(err, phase, file, nil)
+}
+
+// diagnoseTag is like diagnose, but also records the offending tag.
+func diagnoseTag(err error, phase, file string, tag tagID) error {
+	return newDiagnosticError(err, phase, file, &tag)
+}
+
+func newDiagnosticError(err error, phase, file string, tag *tagID) error {
+	if err == nil {
+		return nil
+	}
+	derr := &diagnosticError{phase: phase, file: file, tag: tag, err: err}
+	lastDiagnosticErrorMtx.Lock()
+	lastDiagnosticError = derr
+	lastDiagnosticErrorMtx.Unlock()
+	return derr
+}
+
+// lastLineWriter passes writes through to w, and remembers the last
+// non-empty line written.
+type lastLineWriter struct {
+	w    io.Writer
+	mtx  sync.Mutex
+	buf  []byte
+	last string
+}
+
+func (llw *lastLineWriter) Write(p []byte) (int, error) {
+	llw.mtx.Lock()
+	llw.buf = append(llw.buf, p...)
+	for {
+		eol := bytes.IndexByte(llw.buf, '\n')
+		if eol < 0 {
+			break
+		}
+		if line := bytes.TrimSpace(llw.buf[:eol]); len(line) > 0 {
+			llw.last = string(line)
+		}
+		llw.buf = llw.buf[eol+1:]
+	}
+	llw.mtx.Unlock()
+	return llw.w.Write(p)
+}
+
+// Last returns the last non-empty line written so far.
+func (llw *lastLineWriter) Last() string {
+	llw.mtx.Lock()
+	defer llw.mtx.Unlock()
+	if line := bytes.TrimSpace(llw.buf); len(line) > 0 {
+		return string(line)
+	}
+	return llw.last
+}
+
+// failureDiagnostic returns a diagnostic for a command that exited
+// with the given code after printing message (typically its error
+// message) as the last line of stderr. If message is the message of
+// the most recent diagnosticError, the diagnostic includes its phase,
+// file, and tag.
+func failureDiagnostic(command string, exitCode int, message string) *diagnostic {
+	d := &diagnostic{
+		Command:  command,
+		ExitCode: exitCode,
+		Message:  message,
+	}
+	lastDiagnosticErrorMtx.Lock()
+	derr := lastDiagnosticError
+	lastDiagnosticErrorMtx.Unlock()
+	if derr != nil && derr.Error() == message {
+		d.Phase, d.File, d.Tag = derr.phase, derr.file, derr.tag
+	}
+	return d
+}
+
+// writeErrorJSON writes d to the given file.
+func writeErrorJSON(fnm string, d *diagnostic) error {
+	buf, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fnm, append(buf, '\n'), 0666)
+}
+
+// fetchErrorJSON returns the diagnostic written to error.json in the
+// given output collection, or nil if there is none.
+func fetchErrorJSON(client *arvados.Client, outputUUID string) (*diagnostic, error) {
+	fs, err := collectionFS(client, outputUUID)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.Open("error.json")
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var d diagnostic
+	err = json.NewDecoder(f).Decode(&d)
+	if err != nil {
+		return nil, fmt.Errorf("error.json: %w", err)
+	}
+	return &d, nil
+}
+
+// containerError is returned by arvadosContainerRunner when the
+// container exits non-zero.
+type containerError struct {
+	ExitCode   int
+	Diagnostic *diagnostic // from error.json, or nil if not available
+}
+
+func (e *containerError) Error() string {
+	if e.Diagnostic == nil {
+		return fmt.Sprintf("container exited %d", e.ExitCode)
+	}
+	return fmt.Sprintf("container exited %d: %s: %s", e.ExitCode, e.Diagnostic.Command, e.Diagnostic)
+}
@@ -0,0 +1,59 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type diagnosticsSuite struct{}
+
+var _ = check.Suite(&diagnosticsSuite{})
+
+func (s *diagnosticsSuite) TestLastLineWriter(c *check.C) {
+	var buf bytes.Buffer
+	llw := &lastLineWriter{w: &buf}
+	c.Check(llw.Last(), check.Equals, "")
+	fmt.Fprintf(llw, "first line\nsecond ")
+	c.Check(llw.Last(), check.Equals, "second")
+	fmt.Fprintf(llw, "line\n\n  \n")
+	c.Check(llw.Last(), check.Equals, "second line")
+	c.Check(buf.String(), check.Equals, "first line\nsecond line\n\n  \n")
+}
+
+func (s *diagnosticsSuite) TestFailureDiagnostic(c *check.C) {
+	err := diagnoseTag(errors.New("bad tile"), "reading input", "lib.0003.gob.gz", 1234)
+	c.Check(err, check.ErrorMatches, "bad tile")
+
+	d := failureDiagnostic("slice-numpy", 1, "bad tile")
+	c.Check(d.Phase, check.Equals, "reading input")
+	c.Check(d.File, check.Equals, "lib.0003.gob.gz")
+	c.Assert(d.Tag, check.NotNil)
+	c.Check(*d.Tag, check.Equals, tagID(1234))
+
+	fnm := c.MkDir() + "/error.json"
+	c.Assert(writeErrorJSON(fnm, d), check.IsNil)
+	buf, err := os.ReadFile(fnm)
+	c.Assert(err, check.IsNil)
+	var got diagnostic
+	c.Assert(json.Unmarshal(buf, &got), check.IsNil)
+	c.Check(got, check.DeepEquals, *d)
+	cerr := &containerError{ExitCode: 1, Diagnostic: &got}
+	c.Check(cerr, check.ErrorMatches, `container exited 1: slice-numpy: bad tile \(phase: reading input, file: lib.0003.gob.gz, tag: 1234\)`)
+
+	// Last stderr line is not from the diagnosed error: use the
+	// message alone.
+	d = failureDiagnostic("slice-numpy", 2, "flag provided but not defined: -foo")
+	c.Check(d.Message, check.Equals, "flag provided but not defined: -foo")
+	c.Check(d.Phase, check.Equals, "")
+	c.Check(d.Tag, check.IsNil)
+	c.Check((&containerError{ExitCode: 2}).Error(), check.Equals, "container exited 2")
+}
@@ -29,7 +29,7 @@ func (cmd *diffFasta) RunCommand(prog string, args []string, stdin io.Reader, st
 	offset := flags.Int("offset", 0, "coordinate offset")
 	sequence := flags.String("sequence", "chr1", "sequence label")
 	timeout := flags.Duration("timeout", 0, "timeout (examples: \"1s\", \"1ms\")")
-	err = flags.Parse(args)
+	err = parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		err = nil
 		return 0
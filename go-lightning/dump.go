@@ -13,7 +13,6 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
-	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
@@ -27,9 +26,11 @@ import (
 )
 
 type dump struct {
-	filter       filter
-	cgnames      []string
-	selectedTags map[tagID]bool
+	filter        Filter
+	contigAliases contigAliasOptions
+	cgnames       []string
+	selectedTags  map[tagID]bool
+	provenance    bool
 }
 
 func (cmd *dump) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
@@ -47,14 +48,20 @@ func (cmd *dump) run(prog string, args []string, stdin io.Reader, stdout, stderr
 	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
 	projectUUID := flags.String("project", "", "project `UUID` for output data")
 	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
 	inputDir := flags.String("input-dir", "./in", "input `directory`")
 	outputDir := flags.String("output-dir", "./out", "output `directory`")
 	ref := flags.String("ref", "", "reference name (if blank, choose last one that appears in input)")
-	regionsFilename := flags.String("regions", "", "only output columns/annotations that intersect regions in specified bed `file`")
+	regionsFilename := flags.String("regions", "", "only output columns/annotations that intersect regions in specified bed/gff/gtf `files` (comma-separated list of filenames or glob patterns)")
 	expandRegions := flags.Int("expand-regions", 0, "expand specified regions by `N` base pairs on each side`")
+	var rfilter regionsFilter
+	rfilter.Flags(flags)
 	selectedTags := flags.String("tags", "", "tag numbers to dump")
+	flags.BoolVar(&cmd.provenance, "provenance", false, "add source and first-seen columns to variants.csv (if recorded by \"import -provenance\")")
 	cmd.filter.Flags(flags)
-	err := flags.Parse(args)
+	cmd.contigAliases.Flags(flags)
+	err := parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		return nil
 	} else if err != nil {
@@ -80,7 +87,17 @@ func (cmd *dump) run(prog string, args []string, stdin io.Reader, stdout, stderr
 			KeepCache:   2,
 			APIAccess:   true,
 		}
-		err = runner.TranslatePaths(inputDir, regionsFilename)
+		containerOpts.Apply(&runner, stdout)
+		err = runner.TranslatePaths(inputDir)
+		if err == nil {
+			err = rfilter.TranslatePaths(&runner, regionsFilename)
+		}
+		if err == nil {
+			err = cmd.filter.TranslatePaths(&runner)
+		}
+		if err == nil {
+			err = cmd.contigAliases.TranslatePaths(&runner)
+		}
 		if err != nil {
 			return err
 		}
@@ -91,16 +108,27 @@ func (cmd *dump) run(prog string, args []string, stdin io.Reader, stdout, stderr
 			"-regions=" + *regionsFilename,
 			"-expand-regions=" + fmt.Sprintf("%d", *expandRegions),
 			"-tags=" + *selectedTags,
+			"-provenance=" + fmt.Sprintf("%v", cmd.provenance),
 		}
 		runner.Args = append(runner.Args, cmd.filter.Args()...)
+		runner.Args = append(runner.Args, rfilter.Args()...)
+		runner.Args = append(runner.Args, cmd.contigAliases.Args()...)
 		output, err := runner.Run()
-		if err != nil {
+		if err == errDryRun {
+			err = nil
+			return nil
+		} else if err != nil {
 			return err
 		}
 		fmt.Fprintln(stdout, output)
 		return nil
 	}
 
+	err = cmd.contigAliases.Load()
+	if err != nil {
+		return err
+	}
+
 	if *selectedTags != "" {
 		cmd.selectedTags = map[tagID]bool{}
 		for _, tagstr := range strings.Split(*selectedTags, ",") {
@@ -120,25 +148,28 @@ func (cmd *dump) run(prog string, args []string, stdin io.Reader, stdout, stderr
 		return fmt.Errorf("no input files found in %s", *inputDir)
 	}
 	sort.Strings(infiles)
+	if err = checkTagSets(infiles); err != nil {
+		return err
+	}
 
 	var refseq map[string][]tileLibRef
 	var reftiledata = make(map[tileLibRef][]byte, 11000000)
+	var reftilesource = map[tileLibRef]tileVariantSource{}
 	in0, err := open(infiles[0])
 	if err != nil {
 		return err
 	}
 
-	matchGenome, err := regexp.Compile(cmd.filter.MatchGenome)
+	genomes, err := cmd.filter.GenomeSelector()
 	if err != nil {
-		err = fmt.Errorf("-match-genome: invalid regexp: %q", cmd.filter.MatchGenome)
 		return err
 	}
 
 	cmd.cgnames = nil
-	taglen := -1
+	var taglen []int
 	DecodeLibrary(in0, strings.HasSuffix(infiles[0], ".gz"), func(ent *LibraryEntry) error {
 		if len(ent.TagSet) > 0 {
-			taglen = len(ent.TagSet[0])
+			taglen = tagLengths(ent.TagSet)
 		}
 		for _, cseq := range ent.CompactSequences {
 			if cseq.Name == *ref || *ref == "" {
@@ -146,13 +177,14 @@ func (cmd *dump) run(prog string, args []string, stdin io.Reader, stdout, stderr
 			}
 		}
 		for _, cg := range ent.CompactGenomes {
-			if matchGenome.MatchString(cg.Name) {
-				cmd.cgnames = append(cmd.cgnames, cg.Name)
-			}
+			cmd.cgnames = append(cmd.cgnames, cg.Name)
 		}
 		for _, tv := range ent.TileVariants {
 			if tv.Ref {
 				reftiledata[tileLibRef{tv.Tag, tv.Variant}] = tv.Sequence
+				if cmd.provenance && tv.Source != "" {
+					reftilesource[tileLibRef{tv.Tag, tv.Variant}] = tileVariantSource{tv.Source, tv.SourceTime}
+				}
 			}
 		}
 		return nil
@@ -164,11 +196,15 @@ func (cmd *dump) run(prog string, args []string, stdin io.Reader, stdout, stderr
 	if refseq == nil {
 		return fmt.Errorf("%s: reference sequence not found", infiles[0])
 	}
-	if taglen < 0 {
+	if taglen == nil {
 		return fmt.Errorf("tagset not found")
 	}
+	cmd.cgnames, err = genomes.Select(cmd.cgnames)
+	if err != nil {
+		return err
+	}
 	if len(cmd.cgnames) == 0 {
-		return fmt.Errorf("no genomes found matching regexp %q", cmd.filter.MatchGenome)
+		return fmt.Errorf("no genomes found matching %s", genomes)
 	}
 	sort.Strings(cmd.cgnames)
 
@@ -178,12 +214,14 @@ func (cmd *dump) run(prog string, args []string, stdin io.Reader, stdout, stderr
 		seqname  string // chr1
 		pos      int    // distance from start of chromosome to starttag
 		tiledata []byte // acgtggcaa...
+		source   tileVariantSource
 	}
 	isdup := map[tagID]bool{}
 	reftile := map[tagID]*reftileinfo{}
 	for seqname, cseq := range refseq {
 		pos := 0
-		for _, libref := range cseq {
+		overlap := 0
+		for i, libref := range cseq {
 			tiledata := reftiledata[libref]
 			if len(tiledata) == 0 {
 				return fmt.Errorf("missing tiledata for tag %d variant %d in %s in ref", libref.Tag, libref.Variant, seqname)
@@ -201,30 +239,46 @@ func (cmd *dump) run(prog string, args []string, stdin io.Reader, stdout, stderr
 					variant:  libref.Variant,
 					tiledata: tiledata,
 					pos:      pos,
+					source:   reftilesource[libref],
 				}
 			}
-			pos += len(tiledata) - taglen
+			overlap = pathOverlap(taglen, cseq, i)
+			pos += len(tiledata) - overlap
 		}
-		log.Printf("... %s done, len %d", seqname, pos+taglen)
+		log.Printf("... %s done, len %d", seqname, pos+overlap)
 	}
 
 	var mask *mask
 	if *regionsFilename != "" {
 		log.Printf("loading regions from %s", *regionsFilename)
-		mask, err = makeMask(*regionsFilename, *expandRegions)
+		for seqname := range refseq {
+			rfilter.contigs = append(rfilter.contigs, seqname)
+		}
+		mask, err = makeMask(*regionsFilename, *expandRegions, rfilter)
 		if err != nil {
 			return err
 		}
 		log.Printf("before applying mask, len(reftile) == %d", len(reftile))
 		log.Printf("deleting reftile entries for regions outside %d intervals", mask.Len())
 		for tag, rt := range reftile {
-			if !mask.Check(strings.TrimPrefix(rt.seqname, "chr"), rt.pos, rt.pos+len(rt.tiledata)) {
+			if !mask.Check(rt.seqname, rt.pos, rt.pos+len(rt.tiledata)) {
 				delete(reftile, tag)
 			}
 		}
 		log.Printf("after applying mask, len(reftile) == %d", len(reftile))
 	}
 
+	// [selectedStart, selectedEnd) is the smallest tag range
+	// that includes all selected tags.
+	var selectedStart, selectedEnd tagID
+	for tag := range cmd.selectedTags {
+		if selectedEnd == 0 || tag < selectedStart {
+			selectedStart = tag
+		}
+		if tag >= selectedEnd {
+			selectedEnd = tag + 1
+		}
+	}
 	if cmd.selectedTags != nil {
 		log.Printf("deleting reftile entries other than %d selected tags", len(cmd.selectedTags))
 		for tag := range reftile {
@@ -258,7 +312,18 @@ func (cmd *dump) run(prog string, args []string, stdin io.Reader, stdout, stderr
 			}
 			defer f.Close()
 			log.Infof("%04d: reading %s", infileIdx, infile)
-			err = DecodeLibrary(f, strings.HasSuffix(infile, ".gz"), func(ent *LibraryEntry) error {
+			decode := func(cb func(*LibraryEntry) error) error {
+				return DecodeLibrary(f, strings.HasSuffix(infile, ".gz"), cb)
+			}
+			if cmd.selectedTags != nil {
+				// Skip the parts of indexed
+				// slices that don't contain
+				// any selected tags.
+				decode = func(cb func(*LibraryEntry) error) error {
+					return DecodeLibraryTagRange(f, selectedStart, selectedEnd, cb)
+				}
+			}
+			err = decode(func(ent *LibraryEntry) error {
 				for _, tv := range ent.TileVariants {
 					if tv.Ref {
 						continue
@@ -280,7 +345,7 @@ func (cmd *dump) run(prog string, args []string, stdin io.Reader, stdout, stderr
 					seq[tv.Tag] = variants
 				}
 				for _, cg := range ent.CompactGenomes {
-					if !matchGenome.MatchString(cg.Name) {
+					if !genomes.Match(cg.Name) {
 						continue
 					}
 					// pad to full slice size
@@ -382,8 +447,26 @@ func (cmd *dump) run(prog string, args []string, stdin io.Reader, stdout, stderr
 				}
 				variants := seq[tag]
 
+				var sources []tileVariantSource
+				if cmd.provenance {
+					// sources[v] is the earliest
+					// source of any original
+					// variant that was renumbered
+					// to v.
+					sources = make([]tileVariantSource, maxv+1)
+					for v, tv := range variants {
+						if src := (tileVariantSource{tv.Source, tv.SourceTime}); src.earlierThan(sources[remap[v]]) {
+							sources[remap[v]] = src
+						}
+					}
+				}
+
 				mtx.Lock()
-				fmt.Fprintf(dumpVariantsW, "%d,%d,1,%s,%d,%s\n", tag, rt.variant, rt.seqname, rt.pos+1, bytes.ToUpper(rt.tiledata))
+				if cmd.provenance {
+					fmt.Fprintf(dumpVariantsW, "%d,%d,1,%s,%d,%s,%s\n", tag, rt.variant, rt.seqname, rt.pos+1, bytes.ToUpper(rt.tiledata), rt.source.csvFields())
+				} else {
+					fmt.Fprintf(dumpVariantsW, "%d,%d,1,%s,%d,%s\n", tag, rt.variant, rt.seqname, rt.pos+1, bytes.ToUpper(rt.tiledata))
+				}
 				mtx.Unlock()
 
 				done := make([]bool, maxv+1)
@@ -395,7 +478,11 @@ func (cmd *dump) run(prog string, args []string, stdin io.Reader, stdout, stderr
 						done[v] = true
 					}
 					mtx.Lock()
-					fmt.Fprintf(dumpVariantsW, "%d,%d,0,%s,%d,%s\n", tag, v, rt.seqname, rt.pos+1, bytes.ToUpper(tv.Sequence))
+					if cmd.provenance {
+						fmt.Fprintf(dumpVariantsW, "%d,%d,0,%s,%d,%s,%s\n", tag, v, rt.seqname, rt.pos+1, bytes.ToUpper(tv.Sequence), sources[v].csvFields())
+					} else {
+						fmt.Fprintf(dumpVariantsW, "%d,%d,0,%s,%d,%s\n", tag, v, rt.seqname, rt.pos+1, bytes.ToUpper(tv.Sequence))
+					}
 					mtx.Unlock()
 				}
 			}
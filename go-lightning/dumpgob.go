@@ -34,9 +34,11 @@ func (cmd *dumpGob) RunCommand(prog string, args []string, stdin io.Reader, stdo
 	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
 	projectUUID := flags.String("project", "", "project `UUID` for output data")
 	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
 	inputFilename := flags.String("i", "-", "input `file` (library)")
 	outputFilename := flags.String("o", "-", "output `file`")
-	err = flags.Parse(args)
+	err = parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		err = nil
 		return 0
@@ -66,6 +68,7 @@ func (cmd *dumpGob) RunCommand(prog string, args []string, stdin io.Reader, stdo
 			VCPUs:       1,
 			Priority:    *priority,
 		}
+		containerOpts.Apply(&runner, stdout)
 		err = runner.TranslatePaths(inputFilename)
 		if err != nil {
 			return 1
@@ -73,7 +76,10 @@ func (cmd *dumpGob) RunCommand(prog string, args []string, stdin io.Reader, stdo
 		runner.Args = []string{"dumpgob", "-local=true", fmt.Sprintf("-pprof=%v", *pprof), "-i", *inputFilename, "-o", "/mnt/output/dumpgob.txt"}
 		var output string
 		output, err = runner.Run()
-		if err != nil {
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
 			return 1
 		}
 		fmt.Fprintln(stdout, output+"/dumpgob.txt")
@@ -98,6 +104,9 @@ func (cmd *dumpGob) RunCommand(prog string, args []string, stdin io.Reader, stdo
 			fmt.Fprintf(stderr, "ent %d\n", n)
 		}
 		n++
+		if ent.TagSetSize > 0 {
+			fmt.Fprintf(bufw, "ent %d: TagSetHeader, len %d, hash %x\n", n, ent.TagSetSize, ent.TagSetHash)
+		}
 		if len(ent.TagSet) > 0 {
 			fmt.Fprintf(bufw, "ent %d: TagSet, len %d, taglen %d\n", n, len(ent.TagSet), len(ent.TagSet[0]))
 		}
@@ -0,0 +1,67 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// excludeTags is a set of tags to skip, loaded from an -exclude-tags
+// file. A nil excludeTags excludes nothing.
+type excludeTags map[tagID]bool
+
+const excludeTagsUsage = "skip the tags listed in `file` (one tag ID per line, or a csv file with tag IDs in the first column, such as the output of stats -tag-stats after removing the rows to keep)"
+
+// loadExcludeTags reads a list of tag IDs from fnm. Each line has a
+// tag ID, optionally followed by a comma and other fields, so a
+// filtered copy of the stats -tag-stats output can be used
+// directly. Blank lines, lines starting with "#", and a header line
+// starting with "Tag," are ignored.
+//
+// If fnm is "", loadExcludeTags returns nil.
+func loadExcludeTags(fnm string) (excludeTags, error) {
+	if fnm == "" {
+		return nil, nil
+	}
+	f, err := zopen(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	exclude := excludeTags{}
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || (lineno == 1 && strings.HasPrefix(line, "Tag,")) {
+			continue
+		}
+		field, _, _ := strings.Cut(line, ",")
+		tag, err := strconv.ParseUint(strings.TrimSpace(field), 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: invalid tag ID %q", fnm, lineno, field)
+		}
+		exclude[tagID(tag)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	return exclude, nil
+}
+
+// apply replaces the genomes' variants at excluded tags with 0
+// (no-call), the same way Filter drops tiles.
+func (exclude excludeTags) apply(cgs map[string][]tileVariantID) {
+	for tag := range exclude {
+		for _, cg := range cgs {
+			if len(cg) > int(tag)*2+1 {
+				cg[tag*2] = 0
+				cg[tag*2+1] = 0
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type excludeTagsSuite struct{}
+
+var _ = check.Suite(&excludeTagsSuite{})
+
+func (s *excludeTagsSuite) TestLoad(c *check.C) {
+	tmpdir := c.MkDir()
+	exclude, err := loadExcludeTags("")
+	c.Check(err, check.IsNil)
+	c.Check(exclude, check.IsNil)
+	c.Check(exclude[3], check.Equals, false)
+
+	c.Assert(os.WriteFile(tmpdir+"/list", []byte("# comment\n3\n\n 5 \n"), 0666), check.IsNil)
+	exclude, err = loadExcludeTags(tmpdir + "/list")
+	c.Check(err, check.IsNil)
+	c.Check(exclude, check.DeepEquals, excludeTags{3: true, 5: true})
+
+	c.Assert(os.WriteFile(tmpdir+"/tag-stats.csv", []byte("Tag,Variants,Placed,MinLength,MaxLength,MeanLength,LengthSD\n7,120,4,8,20,14.7,5.0\n"), 0666), check.IsNil)
+	exclude, err = loadExcludeTags(tmpdir + "/tag-stats.csv")
+	c.Check(err, check.IsNil)
+	c.Check(exclude, check.DeepEquals, excludeTags{7: true})
+
+	c.Assert(os.WriteFile(tmpdir+"/bad", []byte("3\nchr1\n"), 0666), check.IsNil)
+	_, err = loadExcludeTags(tmpdir + "/bad")
+	c.Check(err, check.ErrorMatches, `.*/bad: line 2: invalid tag ID "chr1"`)
+}
+
+func (s *excludeTagsSuite) TestApply(c *check.C) {
+	cgs := map[string][]tileVariantID{
+		"a": {1, 1, 2, 1, 1, 3},
+		"b": {1, 1},
+	}
+	excludeTags{1: true}.apply(cgs)
+	c.Check(cgs["a"], check.DeepEquals, []tileVariantID{1, 1, 0, 0, 1, 3})
+	c.Check(cgs["b"], check.DeepEquals, []tileVariantID{1, 1})
+}
+
+func (s *excludeTagsSuite) TestGetRef(c *check.C) {
+	tilelib := &tileLibrary{retainNoCalls: true, excludeTags: excludeTags{1: true}}
+	c.Check(tilelib.getRef(1, []byte("acgtacgt"), false), check.Equals, tileLibRef{Tag: 1})
+	c.Check(tilelib.getRef(1, []byte("acgtacgt"), true), check.Equals, tileLibRef{Tag: 1, Variant: 1})
+	c.Check(tilelib.getRef(2, []byte("acgtacgt"), false), check.Equals, tileLibRef{Tag: 2, Variant: 1})
+}
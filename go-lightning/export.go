@@ -8,14 +8,15 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	_ "net/http/pprof"
-	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
@@ -34,6 +35,20 @@ import (
 type tvVariant struct {
 	hgvs.Variant
 	librefs map[tileLibRef]bool
+	// haploid is true if this is the second phase of a genome on
+	// a haploid chromosome, and it has the same allele as the
+	// first phase, i.e., it is not a separate call.
+	haploid bool
+}
+
+// markHaploid sets the haploid flag on the second-phase entries of
+// varslice that have the same allele as the first phase.
+func markHaploid(varslice []tvVariant) {
+	for i := 0; i+1 < len(varslice); i += 2 {
+		if varslice[i+1].Ref == varslice[i].Ref && varslice[i+1].New == varslice[i].New {
+			varslice[i+1].haploid = true
+		}
+	}
 }
 
 type outputFormat interface {
@@ -51,8 +66,19 @@ var outputFormats = map[string]func() outputFormat{
 	},
 	"hgvs-onehot": func() outputFormat { return formatHGVSOneHot{} },
 	"hgvs":        func() outputFormat { return formatHGVS{} },
-	"pvcf":        func() outputFormat { return formatPVCF{} },
-	"vcf":         func() outputFormat { return formatVCF{} },
+	"jsonl": func() outputFormat {
+		return &formatJSONL{records: map[string][]jsonlRecord{}}
+	},
+	"pvcf":  func() outputFormat { return formatPVCF{} },
+	"sites": func() outputFormat { return &formatSites{} },
+	"vcf":   func() outputFormat { return formatVCF{} },
+}
+
+// aggregateFormats are the output formats that have no per-sample
+// data, and can therefore be used with -aggregate-only.
+var aggregateFormats = map[string]bool{
+	"sites": true,
+	"vcf":   true,
 }
 
 type exporter struct {
@@ -60,9 +86,24 @@ type exporter struct {
 	outputPerChrom bool
 	compress       bool
 	maxTileSize    int
-	filter         filter
+	filter         Filter
+	manifest       manifestOptions
+	contigAliases  contigAliasOptions
 	maxPValue      float64
 	cases          []bool
+	// if >0, write pvcf output in shards of this many samples
+	samplesPerShard int
+	// contig naming style for output (see contigNameStyles)
+	contigNames string
+	// if true, refuse to write any per-sample output
+	aggregateOnly bool
+	// if true, export each genome to its own subdirectory
+	outputPerSample bool
+	// number of genomes to export concurrently with outputPerSample
+	perSampleThreads int
+	// chromosomes to write as haploid in vcf, pvcf, and sites
+	// output (nil = none)
+	haploidChromosome *regexp.Regexp
 }
 
 func (cmd *exporter) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
@@ -79,19 +120,33 @@ func (cmd *exporter) RunCommand(prog string, args []string, stdin io.Reader, std
 	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
 	projectUUID := flags.String("project", "", "project `UUID` for output data")
 	priority := flags.Int("priority", 500, "container request priority")
-	refname := flags.String("ref", "", "reference genome `name`")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
+	refname := flags.String("ref", "", "reference genome `name`, comma-separated list of names, or \"all\" (with more than one reference, output files for each reference are written in a subdirectory of -output-dir named after the reference file, and the reference filename is inserted before the extension of the -output-bed filename)")
 	inputDir := flags.String("input-dir", ".", "input `directory`")
 	cases := flags.String("cases", "", "file indicating which genomes are positive cases (for computing p-values)")
 	flags.Float64Var(&cmd.maxPValue, "p-value", 1, "do chi square test and omit columns with p-value above this threshold")
 	outputDir := flags.String("output-dir", ".", "output `directory`")
-	outputFormatStr := flags.String("output-format", "hgvs", "output `format`: hgvs, pvcf, or vcf")
+	outputCollectionName := flags.String("output-collection", "", "with -local, write output files directly into a new Arvados collection with the given `name` (in the -project project) instead of -output-dir; -output-labels and -output-bed files are also written to the collection if they are in -output-dir")
+	outputFormatStr := flags.String("output-format", "hgvs", "output `format`: hgvs, jsonl, pvcf, sites (VCF with allele counts, frequencies, and p-values), or vcf")
 	outputBed := flags.String("output-bed", "", "also output bed `file`")
 	flags.BoolVar(&cmd.outputPerChrom, "output-per-chromosome", true, "output one file per chromosome")
 	flags.BoolVar(&cmd.compress, "z", false, "write gzip-compressed output files")
+	flags.IntVar(&cmd.samplesPerShard, "samples-per-shard", 0, "write pvcf output in separate files for each block of `N` samples, plus a shards.json manifest (0 = no sharding)")
+	flags.StringVar(&cmd.contigNames, "output-contig-names", "keep", "contig naming `style` for output: keep (as in reference), ucsc (chr1, chrM), or ensembl (1, MT)")
 	labelsFilename := flags.String("output-labels", "", "also output genome labels csv `file`")
 	flags.IntVar(&cmd.maxTileSize, "max-tile-size", 50000, "don't try to make annotations for tiles bigger than given `size`")
+	seqSpillDir := flags.String("sequence-spill-dir", "", "store tile sequences in a temp file in `dir` instead of RAM")
+	cmd.manifest.Flags(flags)
+	excludeTagsFilename := flags.String("exclude-tags", "", excludeTagsUsage)
+	flags.StringVar(&cmd.filter.GenomeList, "pick-list", "", "deprecated alias for -genome-list: keep only genomes whose names or labels are listed in `file`, one per line")
+	flags.BoolVar(&cmd.outputPerSample, "output-per-sample", false, "write each genome's output files to a separate subdirectory of -output-dir, named after the genome's label")
+	flags.IntVar(&cmd.perSampleThreads, "per-sample-threads", 4, "with -output-per-sample, export up to `N` genomes concurrently")
+	haploidChromosome := flags.String("haploid-chromosome", "", "in vcf, pvcf, and sites output, treat chromosomes that match the given `regexp` (e.g., '^(chr)?MT?$') as haploid: count each genome's allele once, and write a single-allele genotype, or major/secondary genotype if the genome's second phase has a different (heteroplasmic) allele (see 'lightning import -haploid-chromosome')")
+	flags.BoolVar(&cmd.aggregateOnly, "aggregate-only", false, "only write site-level aggregates, never per-sample genotypes or names (requires -output-format=sites or vcf; not compatible with -output-labels)")
 	cmd.filter.Flags(flags)
-	err = flags.Parse(args)
+	cmd.contigAliases.Flags(flags)
+	err = parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		err = nil
 		return 0
@@ -108,6 +163,52 @@ func (cmd *exporter) RunCommand(prog string, args []string, stdin io.Reader, std
 	} else {
 		cmd.outputFormat = f()
 	}
+	if _, ok := contigNameStyles[cmd.contigNames]; !ok {
+		err = fmt.Errorf("invalid -output-contig-names %q", cmd.contigNames)
+		return 2
+	}
+	if *haploidChromosome != "" {
+		cmd.haploidChromosome, err = regexp.Compile(*haploidChromosome)
+		if err != nil {
+			return 2
+		}
+	}
+	if cmd.aggregateOnly {
+		if !aggregateFormats[*outputFormatStr] {
+			err = fmt.Errorf("-aggregate-only is not compatible with -output-format=%s (use sites or vcf)", *outputFormatStr)
+			return 2
+		} else if *labelsFilename != "" {
+			err = errors.New("-aggregate-only is not compatible with -output-labels")
+			return 2
+		}
+	}
+	if cmd.outputPerSample {
+		if cmd.aggregateOnly || cmd.samplesPerShard > 0 || *outputBed != "" {
+			err = errors.New("-output-per-sample is not compatible with -aggregate-only, -samples-per-shard, or -output-bed")
+			return 2
+		} else if cmd.perSampleThreads < 1 {
+			err = errors.New("-per-sample-threads must be at least 1")
+			return 2
+		}
+	}
+	if cmd.samplesPerShard > 0 {
+		if _, ok := cmd.outputFormat.(formatPVCF); !ok {
+			err = errors.New("-samples-per-shard is only supported with -output-format=pvcf")
+			return 2
+		} else if !cmd.outputPerChrom {
+			err = errors.New("-samples-per-shard requires -output-per-chromosome=true")
+			return 2
+		}
+	}
+	if *outputCollectionName != "" {
+		if !*runlocal {
+			err = errors.New("-output-collection is only supported with -local=true (in container mode, output is always saved in a collection)")
+			return 2
+		} else if cmd.manifest.Enabled() {
+			err = errors.New("-write-manifest is not supported with -output-collection")
+			return 2
+		}
+	}
 
 	if *pprof != "" {
 		go func() {
@@ -132,10 +233,25 @@ func (cmd *exporter) RunCommand(prog string, args []string, stdin io.Reader, std
 			Priority:    *priority,
 			APIAccess:   true,
 		}
-		err = runner.TranslatePaths(inputDir, cases)
+		containerOpts.Apply(&runner, stdout)
+		err = runner.TranslatePaths(inputDir, cases, excludeTagsFilename)
+		if err == nil {
+			err = cmd.filter.TranslatePaths(&runner)
+		}
+		if err == nil {
+			err = cmd.manifest.TranslatePaths(&runner)
+		}
+		if err == nil {
+			err = cmd.contigAliases.TranslatePaths(&runner)
+		}
 		if err != nil {
 			return 1
 		}
+		if *seqSpillDir != "" {
+			runner.RAM = 250000000000
+			runner.Mounts["/tmp/lightning-seq"] = map[string]interface{}{"kind": "tmp", "capacity": 500000000000}
+			*seqSpillDir = "/tmp/lightning-seq"
+		}
 		if *outputBed != "" {
 			if strings.Contains(*outputBed, "/") {
 				err = fmt.Errorf("cannot use -output-bed filename %q containing '/' char", *outputBed)
@@ -151,47 +267,90 @@ func (cmd *exporter) RunCommand(prog string, args []string, stdin io.Reader, std
 			"-p-value", fmt.Sprintf("%f", cmd.maxPValue),
 			"-output-format", *outputFormatStr,
 			"-output-bed", *outputBed,
-			"-output-labels", "/mnt/output/labels.csv",
 			"-output-per-chromosome=" + fmt.Sprintf("%v", cmd.outputPerChrom),
 			"-max-tile-size", fmt.Sprintf("%d", cmd.maxTileSize),
 			"-input-dir", *inputDir,
 			"-output-dir", "/mnt/output",
 			"-z=" + fmt.Sprintf("%v", cmd.compress),
+			"-samples-per-shard=" + fmt.Sprintf("%d", cmd.samplesPerShard),
+			"-output-contig-names=" + cmd.contigNames,
+			"-sequence-spill-dir=" + *seqSpillDir,
+			"-exclude-tags=" + *excludeTagsFilename,
+			"-aggregate-only=" + fmt.Sprintf("%v", cmd.aggregateOnly),
+			"-output-per-sample=" + fmt.Sprintf("%v", cmd.outputPerSample),
+			"-per-sample-threads=" + fmt.Sprintf("%d", cmd.perSampleThreads),
+			"-haploid-chromosome=" + *haploidChromosome,
+		}
+		if !cmd.aggregateOnly {
+			runner.Args = append(runner.Args, "-output-labels", "/mnt/output/labels.csv")
 		}
 		runner.Args = append(runner.Args, cmd.filter.Args()...)
+		runner.Args = append(runner.Args, cmd.manifest.Args()...)
+		runner.Args = append(runner.Args, cmd.contigAliases.Args()...)
 		var output string
 		output, err = runner.Run()
-		if err != nil {
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
 			return 1
 		}
 		fmt.Fprintln(stdout, output)
 		return 0
 	}
 
+	err = cmd.contigAliases.Load()
+	if err != nil {
+		return 1
+	}
+
+	ctx, cancel := interruptContext(context.Background())
+	defer cancel()
+
+	var outcoll *outputCollection
+	if *outputCollectionName != "" {
+		outcoll, err = newOutputCollection(*outputDir)
+		if err != nil {
+			return 1
+		}
+		defer outcoll.Release()
+	}
+
 	var cgs []CompactGenome
 	tilelib := &tileLibrary{
 		retainNoCalls:       true,
 		retainTileSequences: true,
+		seqSpillDir:         *seqSpillDir,
 		compactGenomes:      map[string][]tileVariantID{},
 	}
-	err = tilelib.LoadDir(context.Background(), *inputDir)
+	defer tilelib.Close()
+	err = tilelib.LoadDir(ctx, *inputDir)
 	if err != nil {
 		return 1
 	}
 
-	refseq, ok := tilelib.refseqs[*refname]
-	if !ok {
-		err = fmt.Errorf("reference name %q not found in input; have %v", *refname, func() (names []string) {
-			for name := range tilelib.refseqs {
-				names = append(names, name)
-			}
-			return
-		}())
+	refnames, err := exportRefNames(*refname, tilelib.refseqs)
+	if err != nil {
 		return 1
 	}
+	var refdirs []string
+	if len(refnames) > 1 {
+		refdirs, err = exportRefDirs(refnames)
+		if err != nil {
+			return 1
+		}
+	}
 
 	log.Infof("filtering: %+v", cmd.filter)
-	cmd.filter.Apply(tilelib)
+	err = cmd.filter.Apply(tilelib)
+	if err != nil {
+		return 1
+	}
+	exclude, err := loadExcludeTags(*excludeTagsFilename)
+	if err != nil {
+		return 1
+	}
+	exclude.apply(tilelib.compactGenomes)
 
 	names := cgnames(tilelib)
 	for _, name := range names {
@@ -199,8 +358,8 @@ func (cmd *exporter) RunCommand(prog string, args []string, stdin io.Reader, std
 	}
 	if *labelsFilename != "" {
 		log.Infof("writing labels to %s", *labelsFilename)
-		var f *os.File
-		f, err = os.OpenFile(*labelsFilename, os.O_CREATE|os.O_WRONLY, 0777)
+		var f io.WriteCloser
+		f, err = create(*labelsFilename)
 		if err != nil {
 			return 1
 		}
@@ -257,37 +416,175 @@ func (cmd *exporter) RunCommand(prog string, args []string, stdin io.Reader, std
 		}
 	}
 
+	for i, name := range refnames {
+		outdir, bedfnm := *outputDir, *outputBed
+		if len(refnames) > 1 {
+			outdir = filepath.Join(outdir, refdirs[i])
+			if bedfnm != "" {
+				ext := filepath.Ext(bedfnm)
+				bedfnm = strings.TrimSuffix(bedfnm, ext) + "." + refdirs[i] + ext
+			}
+			log.Infof("exporting reference %q to %s", name, outdir)
+			err = mkdirAll(outdir)
+			if err != nil {
+				return 1
+			}
+			cmd.outputFormat = outputFormats[*outputFormatStr]()
+		}
+		if cmd.outputPerSample {
+			err = cmd.exportPerSample(ctx, outdir, *outputFormatStr, tilelib, tilelib.refseqs[name], cgs)
+		} else {
+			err = cmd.exportRef(ctx, outdir, bedfnm, tilelib, tilelib.refseqs[name], cgs)
+		}
+		if err != nil {
+			return 1
+		}
+	}
+	err = tilelib.Close()
+	if err != nil {
+		return 1
+	}
+	inputs := []string{*inputDir}
+	for _, fnm := range []string{*cases, *excludeTagsFilename} {
+		if fnm != "" {
+			inputs = append(inputs, fnm)
+		}
+	}
+	err = cmd.manifest.Write(*outputDir, args, inputs)
+	if err != nil {
+		return 1
+	}
+	if outcoll != nil {
+		var coll arvados.Collection
+		coll, err = outcoll.Save(*outputCollectionName, *projectUUID)
+		if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, coll.UUID)
+	}
+	return 0
+}
+
+// exportRefNames returns the reference names selected by the -ref
+// argument, which is a single name, a comma-separated list of names,
+// or "all".
+func exportRefNames(arg string, refseqs map[string]map[string][]tileLibRef) ([]string, error) {
+	var have []string
+	for name := range refseqs {
+		have = append(have, name)
+	}
+	sort.Strings(have)
+	if arg == "all" {
+		if len(have) == 0 {
+			return nil, errors.New("no reference sequences found in input")
+		}
+		return have, nil
+	}
+	var names []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(arg, ",") {
+		if _, ok := refseqs[name]; !ok {
+			return nil, fmt.Errorf("reference name %q not found in input; have %v", name, have)
+		} else if seen[name] {
+			return nil, fmt.Errorf("reference name %q specified more than once", name)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// exportRefDirs returns the output subdirectory name for each of the
+// given reference names, i.e., the last path component of the
+// reference name (typically the filename of the reference FASTA).
+func exportRefDirs(names []string) ([]string, error) {
+	dirs := make([]string, len(names))
+	seen := map[string]string{}
+	for i, name := range names {
+		dir := filepath.Base(name)
+		if dir == "." || dir == ".." || dir == "/" {
+			return nil, fmt.Errorf("cannot export multiple references: cannot choose an output directory name for reference %q", name)
+		} else if other, ok := seen[dir]; ok {
+			return nil, fmt.Errorf("cannot export multiple references: references %q and %q would both be written to subdirectory %q", other, name, dir)
+		}
+		seen[dir] = name
+		dirs[i] = dir
+	}
+	return dirs, nil
+}
+
+// exportRef exports the variants relative to the given reference
+// sequence to outdir, and (if bedfnm is not empty) writes the
+// corresponding bed file.
+func (cmd *exporter) exportRef(ctx context.Context, outdir, bedfnm string, tilelib *tileLibrary, refseq map[string][]tileLibRef, cgs []CompactGenome) error {
+	refseq, err := renameContigs(refseq, contigNameStyles[cmd.contigNames])
+	if err != nil {
+		return err
+	}
 	var bedout io.Writer
-	var bedfile *os.File
+	var bedfile io.WriteCloser
 	var bedbufw *bufio.Writer
-	if *outputBed != "" {
-		bedfile, err = os.OpenFile(*outputBed, os.O_CREATE|os.O_WRONLY, 0666)
+	if bedfnm != "" {
+		bedfile, err = create(bedfnm)
 		if err != nil {
-			return 1
+			return err
 		}
 		defer bedfile.Close()
 		bedbufw = bufio.NewWriterSize(bedfile, 16*1024*1024)
 		bedout = bedbufw
 	}
-
-	err = cmd.export(*outputDir, bedout, tilelib, refseq, cgs)
+	if cmd.samplesPerShard > 0 {
+		err = cmd.exportShards(ctx, outdir, bedout, tilelib, refseq, cgs)
+	} else {
+		err = cmd.export(ctx, outdir, bedout, tilelib, refseq, cgs)
+	}
 	if err != nil {
-		return 1
+		return err
 	}
 	if bedout != nil {
 		err = bedbufw.Flush()
 		if err != nil {
-			return 1
+			return err
 		}
-		err = bedfile.Close()
-		if err != nil {
-			return 1
+		return bedfile.Close()
+	}
+	return nil
+}
+
+// exportPerSample exports each genome in cgs to a subdirectory of
+// outdir named after the genome's label, running up to
+// cmd.perSampleThreads exports at a time. Each export gets its own
+// instance of the given output format.
+func (cmd *exporter) exportPerSample(ctx context.Context, outdir, format string, tilelib *tileLibrary, refseq map[string][]tileLibRef, cgs []CompactGenome) error {
+	dirs := make([]string, len(cgs))
+	seen := map[string]string{}
+	for i, cg := range cgs {
+		label := trimFilenameForLabel(cg.Name)
+		if other, dup := seen[label]; dup {
+			return fmt.Errorf("cannot use -output-per-sample: genomes %q and %q have the same label %q", other, cg.Name, label)
 		}
+		seen[label] = cg.Name
+		dirs[i] = filepath.Join(outdir, label)
 	}
-	return 0
+	throttle := throttle{Max: cmd.perSampleThreads}
+	for i, cg := range cgs {
+		i, cg := i, cg
+		throttle.Go(func() error {
+			err := mkdirAll(dirs[i])
+			if err != nil {
+				return err
+			}
+			log.Infof("exporting genome %q to %s", cg.Name, dirs[i])
+			sub := *cmd
+			sub.outputFormat = outputFormats[format]()
+			sub.cases = cmd.cases[i : i+1]
+			return sub.exportRef(ctx, dirs[i], "", tilelib, refseq, []CompactGenome{cg})
+		})
+	}
+	return throttle.Wait()
 }
 
-func (cmd *exporter) export(outdir string, bedout io.Writer, tilelib *tileLibrary, refseq map[string][]tileLibRef, cgs []CompactGenome) error {
+func (cmd *exporter) export(ctx context.Context, outdir string, bedout io.Writer, tilelib *tileLibrary, refseq map[string][]tileLibRef, cgs []CompactGenome) error {
 	var seqnames []string
 	var missing []tileLibRef
 	for seqname, librefs := range refseq {
@@ -324,6 +621,9 @@ func (cmd *exporter) export(outdir string, bedout io.Writer, tilelib *tileLibrar
 				defer merges.Done()
 				log.Infof("writing %s %s", seqname, label)
 				scanner := bufio.NewScanner(pr)
+				// jsonl lines can be long (one
+				// sample's variants on a chromosome)
+				scanner.Buffer(make([]byte, 1<<20), 1<<30)
 				for scanner.Scan() {
 					mtx.Lock()
 					dst.Write(scanner.Bytes())
@@ -340,12 +640,12 @@ func (cmd *exporter) export(outdir string, bedout io.Writer, tilelib *tileLibrar
 			if cmd.compress {
 				fnm += ".gz"
 			}
-			f, err := os.OpenFile(fnm, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+			f, err := create(fnm)
 			if err != nil {
 				return err
 			}
 			defer f.Close()
-			log.Infof("writing %q", f.Name())
+			log.Infof("writing %q", fnm)
 			outw[i] = f
 			if cmd.compress {
 				z := pgzip.NewWriter(f)
@@ -362,7 +662,7 @@ func (cmd *exporter) export(outdir string, bedout io.Writer, tilelib *tileLibrar
 		if cmd.compress {
 			fnm += ".gz"
 		}
-		f, err := os.OpenFile(fnm, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+		f, err := create(fnm)
 		if err != nil {
 			return err
 		}
@@ -397,11 +697,16 @@ func (cmd *exporter) export(outdir string, bedout io.Writer, tilelib *tileLibrar
 				defer bedw.Close()
 			}
 			outwb := bufio.NewWriterSize(outw, 8*1024*1024)
-			eachVariant(bedw, tilelib.taglib.keylen, seqname, refseq[seqname], tilelib, cgs, cmd.outputFormat.PadLeft(), cmd.maxTileSize, func(varslice []tvVariant) {
+			haploid := cmd.isHaploid(seqname)
+			err := eachVariant(ctx, bedw, seqname, refseq[seqname], tilelib, cgs, cmd.outputFormat.PadLeft(), cmd.maxTileSize, func(varslice []tvVariant) {
+				if haploid {
+					markHaploid(varslice)
+				}
 				err := cmd.outputFormat.Print(outwb, seqname, varslice)
 				throttle.Report(err)
 			})
-			err := cmd.outputFormat.Finish(outdir, outwb, seqname)
+			throttle.Report(err)
+			err = cmd.outputFormat.Finish(outdir, outwb, seqname)
 			throttle.Report(err)
 			err = outwb.Flush()
 			throttle.Report(err)
@@ -415,29 +720,46 @@ func (cmd *exporter) export(outdir string, bedout io.Writer, tilelib *tileLibrar
 	return throttle.Err()
 }
 
+// isHaploid returns true if the given chromosome matches
+// -haploid-chromosome.
+func (cmd *exporter) isHaploid(seqname string) bool {
+	return cmd.haploidChromosome != nil && cmd.haploidChromosome.MatchString(seqname)
+}
+
+// renameContigs returns a copy of refseq with each contig renamed
+// by the given func.
+func renameContigs(refseq map[string][]tileLibRef, rename func(string) string) (map[string][]tileLibRef, error) {
+	renamed := make(map[string][]tileLibRef, len(refseq))
+	from := map[string]string{}
+	for seqname, librefs := range refseq {
+		newname := rename(seqname)
+		if prev, dup := from[newname]; dup {
+			return nil, fmt.Errorf("contigs %q and %q would both be renamed to %q", prev, seqname, newname)
+		}
+		from[newname] = seqname
+		renamed[newname] = librefs
+	}
+	return renamed, nil
+}
+
 // Align genome tiles to reference tiles, call callback func on each
 // variant, and (if bedw is not nil) write tile coverage to bedw.
-func eachVariant(bedw io.Writer, taglen int, seqname string, reftiles []tileLibRef, tilelib *tileLibrary, cgs []CompactGenome, padLeft bool, maxTileSize int, callback func(varslice []tvVariant)) {
-	t0 := time.Now()
-	progressbar := time.NewTicker(time.Minute)
-	defer progressbar.Stop()
+//
+// If ctx is cancelled, eachVariant stops early and returns
+// context.Cause(ctx).
+func eachVariant(ctx context.Context, bedw io.Writer, seqname string, reftiles []tileLibRef, tilelib *tileLibrary, cgs []CompactGenome, padLeft bool, maxTileSize int, callback func(varslice []tvVariant)) error {
+	progress := newProgress("exportSeq: "+seqname+": refstep", len(reftiles))
+	defer progress.Done()
 	var outmtx sync.Mutex
 	defer outmtx.Lock()
+	taglen := tilelib.taglib.taglen
 	refpos := 0
 	variantAt := map[int][]tvVariant{} // variantAt[chromOffset][genomeIndex*2+phase]
 	for refstep, libref := range reftiles {
-		select {
-		case <-progressbar.C:
-			var eta interface{}
-			if refstep > 0 {
-				fin := t0.Add(time.Duration(float64(time.Now().Sub(t0)) * float64(len(reftiles)) / float64(refstep)))
-				eta = fmt.Sprintf("%v (%v)", fin.Format(time.RFC3339), fin.Sub(time.Now()))
-			} else {
-				eta = "N/A"
-			}
-			log.Printf("exportSeq: %s: refstep %d of %d, %.0f/s, ETA %v", seqname, refstep, len(reftiles), float64(refstep)/time.Now().Sub(t0).Seconds(), eta)
-		default:
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
 		}
+		progress.Add(1)
 		diffs := map[tileLibRef][]hgvs.Variant{}
 		refseq := tilelib.TileVariantSequence(libref)
 		tagcoverage := 0 // number of times the start tag was found in genomes -- max is len(cgs)*2
@@ -472,7 +794,11 @@ func eachVariant(bedw io.Writer, taglen int, seqname string, reftiles []tileLibR
 					// the tag at the end of the
 					// genomeseq sequence.
 					refstepend := refstep + 1
-					for refstepend < len(reftiles) && len(refSequence) >= taglen && !bytes.EqualFold(refSequence[len(refSequence)-taglen:], genomeseq[len(genomeseq)-taglen:]) && len(refSequence) <= maxTileSize {
+					for refstepend < len(reftiles) && len(refSequence) <= maxTileSize {
+						endtaglen := taglen[reftiles[refstepend].Tag]
+						if len(refSequence) < endtaglen || len(genomeseq) < endtaglen || bytes.EqualFold(refSequence[len(refSequence)-endtaglen:], genomeseq[len(genomeseq)-endtaglen:]) {
+							break
+						}
 						if &refSequence[0] == &refseq[0] {
 							refSequence = append([]byte(nil), refSequence...)
 						}
@@ -506,7 +832,8 @@ func eachVariant(bedw io.Writer, taglen int, seqname string, reftiles []tileLibR
 				}
 			}
 		}
-		refpos += len(refseq) - taglen
+		overlap := pathOverlap(taglen, reftiles, refstep)
+		refpos += len(refseq) - overlap
 
 		// Flush entries from variantAt that are behind
 		// refpos. Flush all entries if this is the last
@@ -558,12 +885,12 @@ func eachVariant(bedw io.Writer, taglen int, seqname string, reftiles []tileLibR
 			}
 		}()
 		if bedw != nil && len(refseq) > 0 {
-			tilestart := refpos - len(refseq) + taglen
+			tilestart := refpos - len(refseq) + overlap
 			tileend := refpos
 			if !lastrefstep {
-				tileend += taglen
+				tileend += overlap
 			}
-			thickstart := tilestart + taglen
+			thickstart := tilestart + taglen[libref.Tag]
 			if refstep == 0 {
 				thickstart = 0
 			}
@@ -582,6 +909,7 @@ func eachVariant(bedw io.Writer, taglen int, seqname string, reftiles []tileLibR
 				thickstart, thickend)
 		}
 	}
+	return nil
 }
 
 func bucketVarsliceByRef(varslice []tvVariant) map[string]map[string]int {
@@ -595,6 +923,11 @@ func bucketVarsliceByRef(varslice []tvVariant) map[string]map[string]int {
 			// no-call
 			continue
 		}
+		if v.haploid {
+			// same allele as first phase on a haploid
+			// chromosome
+			continue
+		}
 		alts := byref[v.Ref]
 		if alts == nil {
 			alts = map[string]int{}
@@ -638,6 +971,88 @@ func (formatVCF) Print(out io.Writer, seqname string, varslice []tvVariant) erro
 	return nil
 }
 
+// formatSites writes a sites-only VCF with the allele count (AC),
+// number of called alleles (AN), and allele frequency (AF) of each
+// variant, and (if cases are given) the chi-squared p-value (P) of
+// each alt allele's association with case/control status.
+type formatSites struct {
+	cases     []bool
+	maxPValue float64
+}
+
+func (*formatSites) MaxGoroutines() int                     { return 0 }
+func (*formatSites) Filename() string                       { return "sites.vcf" }
+func (*formatSites) PadLeft() bool                          { return true }
+func (*formatSites) Finish(string, io.Writer, string) error { return nil }
+func (f *formatSites) Head(out io.Writer, cgs []CompactGenome, cases []bool, p float64) error {
+	f.cases = nil
+	for _, c := range cases {
+		if c {
+			f.cases = cases
+			break
+		}
+	}
+	f.maxPValue = p
+	_, err := fmt.Fprint(out, `##fileformat=VCFv4.2
+##INFO=<ID=AC,Number=A,Type=Integer,Description="Allele count">
+##INFO=<ID=AN,Number=1,Type=Integer,Description="Number of called alleles">
+##INFO=<ID=AF,Number=A,Type=Float,Description="Allele frequency">
+##INFO=<ID=P,Number=A,Type=Float,Description="Chi-squared p-value (cases vs. controls)">
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO
+`)
+	return err
+}
+func (f *formatSites) Print(out io.Writer, seqname string, varslice []tvVariant) error {
+	an := 0
+	for _, v := range varslice {
+		if v.New != "-" && !v.haploid {
+			an++
+		}
+	}
+	for ref, alts := range bucketVarsliceByRef(varslice) {
+		altslice := make([]string, 0, len(alts))
+		for alt := range alts {
+			altslice = append(altslice, alt)
+		}
+		sort.Strings(altslice)
+
+		var ac, af, p []string
+		var keep []string
+		for _, alt := range altslice {
+			if f.cases != nil {
+				var chi2x, chi2y []bool
+				for i, v := range varslice {
+					if v.New == "-" || v.haploid {
+						continue
+					}
+					chi2x = append(chi2x, v.Ref == ref && v.New == alt)
+					chi2y = append(chi2y, f.cases[i/2])
+				}
+				pv := pvalue(chi2x, chi2y)
+				if f.maxPValue < 1 && !(pv <= f.maxPValue) {
+					continue
+				}
+				p = append(p, fmt.Sprintf("%g", pv))
+			}
+			keep = append(keep, alt)
+			ac = append(ac, strconv.Itoa(alts[alt]))
+			af = append(af, fmt.Sprintf("%g", float64(alts[alt])/float64(an)))
+		}
+		if len(keep) == 0 {
+			continue
+		}
+		info := "AC=" + strings.Join(ac, ",") + ";AN=" + strconv.Itoa(an) + ";AF=" + strings.Join(af, ",")
+		if p != nil {
+			info += ";P=" + strings.Join(p, ",")
+		}
+		_, err := fmt.Fprintf(out, "%s\t%d\t.\t%s\t%s\t.\t.\t%s\n", seqname, varslice[0].Position, ref, strings.Join(keep, ","), info)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type formatPVCF struct{}
 
 func (formatPVCF) MaxGoroutines() int                     { return 0 }
@@ -654,7 +1069,15 @@ func (formatPVCF) Head(out io.Writer, cgs []CompactGenome, cases []bool, p float
 	return err
 }
 
-func (formatPVCF) Print(out io.Writer, seqname string, varslice []tvVariant) error {
+func (f formatPVCF) Print(out io.Writer, seqname string, varslice []tvVariant) error {
+	return f.printShards([]io.Writer{out}, seqname, varslice, len(varslice)/2)
+}
+
+// printShards writes the given variants to outs, with
+// samplesPerShard samples (genotype columns) written to each
+// output. The site columns (CHROM, POS, REF, ALT, etc.) are computed
+// from all samples, so they are identical in all outputs.
+func (formatPVCF) printShards(outs []io.Writer, seqname string, varslice []tvVariant, samplesPerShard int) error {
 	for ref, alts := range bucketVarsliceByRef(varslice) {
 		altslice := make([]string, 0, len(alts))
 		for alt := range alts {
@@ -664,30 +1087,41 @@ func (formatPVCF) Print(out io.Writer, seqname string, varslice []tvVariant) err
 		for i, a := range altslice {
 			alts[a] = i + 1
 		}
-		_, err := fmt.Fprintf(out, "%s\t%d\t.\t%s\t%s\t.\t.\t.\tGT", seqname, varslice[0].Position, ref, strings.Join(altslice, ","))
-		if err != nil {
-			return err
-		}
-		for i := 0; i < len(varslice); i += 2 {
-			v1, v2 := varslice[i], varslice[i+1]
-			a1, a2 := alts[v1.New], alts[v2.New]
-			if v1.Ref != ref {
-				// variant on allele 0 belongs on a
-				// different output line -- same
-				// chr,pos but different "ref" length
-				a1 = 0
-			}
-			if v2.Ref != ref {
-				a2 = 0
-			}
-			_, err := fmt.Fprintf(out, "\t%d/%d", a1, a2)
+		for shard, out := range outs {
+			_, err := fmt.Fprintf(out, "%s\t%d\t.\t%s\t%s\t.\t.\t.\tGT", seqname, varslice[0].Position, ref, strings.Join(altslice, ","))
+			if err != nil {
+				return err
+			}
+			end := (shard + 1) * samplesPerShard * 2
+			if end > len(varslice) {
+				end = len(varslice)
+			}
+			for i := shard * samplesPerShard * 2; i < end; i += 2 {
+				v1, v2 := varslice[i], varslice[i+1]
+				a1, a2 := alts[v1.New], alts[v2.New]
+				if v1.Ref != ref {
+					// variant on allele 0 belongs on a
+					// different output line -- same
+					// chr,pos but different "ref" length
+					a1 = 0
+				}
+				if v2.Ref != ref {
+					a2 = 0
+				}
+				var err error
+				if v2.haploid {
+					_, err = fmt.Fprintf(out, "\t%d", a1)
+				} else {
+					_, err = fmt.Fprintf(out, "\t%d/%d", a1, a2)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			_, err = out.Write([]byte{'\n'})
 			if err != nil {
 				return err
 			}
-		}
-		_, err = out.Write([]byte{'\n'})
-		if err != nil {
-			return err
 		}
 	}
 	return nil
@@ -879,7 +1313,7 @@ func (f *formatHGVSNumpy) Finish(outdir string, _ io.Writer, seqname string) err
 			}
 		}
 	}
-	outf, err := os.OpenFile(outdir+"/matrix."+seqname+".npy", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0777)
+	outf, err := create(outdir + "/matrix." + seqname + ".npy")
 	if err != nil {
 		return err
 	}
@@ -908,3 +1342,99 @@ func (f *formatHGVSNumpy) Finish(outdir string, _ io.Writer, seqname string) err
 	}
 	return nil
 }
+
+// formatJSONL writes one JSON object per line for each sample on
+// each chromosome, listing the sample's non-reference variants in
+// HGVS notation, e.g.:
+//
+//	{"sample":"input1","chromosome":"chr1","variants":[{"hgvs":"chr1:g.41T>A","genotype":"1/0"}],"no_calls":0}
+//
+// Genotypes are listed in phase order, as in pvcf output.
+type formatJSONL struct {
+	sync.Mutex
+	samples []string
+	records map[string][]jsonlRecord // records[seqname][genomeidx]
+}
+
+type jsonlRecord struct {
+	Sample     string         `json:"sample"`
+	Chromosome string         `json:"chromosome"`
+	Variants   []jsonlVariant `json:"variants"`
+	NoCalls    int            `json:"no_calls"`
+}
+
+type jsonlVariant struct {
+	HGVS     string `json:"hgvs"`
+	Genotype string `json:"genotype"`
+}
+
+func (*formatJSONL) MaxGoroutines() int { return 0 }
+func (*formatJSONL) Filename() string   { return "out.jsonl" }
+func (*formatJSONL) PadLeft() bool      { return false }
+func (f *formatJSONL) Head(out io.Writer, cgs []CompactGenome, cases []bool, p float64) error {
+	f.Lock()
+	defer f.Unlock()
+	f.samples = make([]string, len(cgs))
+	for i, cg := range cgs {
+		f.samples[i] = trimFilenameForLabel(cg.Name)
+	}
+	return nil
+}
+func (f *formatJSONL) Print(out io.Writer, seqname string, varslice []tvVariant) error {
+	f.Lock()
+	records := f.records[seqname]
+	if records == nil {
+		records = make([]jsonlRecord, len(f.samples))
+		for i, name := range f.samples {
+			records[i] = jsonlRecord{Sample: name, Chromosome: seqname, Variants: []jsonlVariant{}}
+		}
+		f.records[seqname] = records
+	}
+	f.Unlock()
+	// Each seqname is printed by a single goroutine, so records
+	// can be updated without holding the lock.
+	for i := 0; i < len(varslice)/2; i++ {
+		var1, var2 := varslice[i*2], varslice[i*2+1]
+		if var1.New == "-" || var2.New == "-" {
+			records[i].NoCalls++
+			continue
+		}
+		if var1.Variant == var2.Variant {
+			if var1.Ref != var1.New {
+				records[i].Variants = append(records[i].Variants, jsonlVariant{seqname + ":g." + var1.String(), "1/1"})
+			}
+			continue
+		}
+		for phase, v := range []hgvs.Variant{var1.Variant, var2.Variant} {
+			if v.Ref == v.New {
+				continue
+			}
+			gt := "1/0"
+			if phase == 1 {
+				gt = "0/1"
+			}
+			records[i].Variants = append(records[i].Variants, jsonlVariant{seqname + ":g." + v.String(), gt})
+		}
+	}
+	return nil
+}
+func (f *formatJSONL) Finish(outdir string, out io.Writer, seqname string) error {
+	f.Lock()
+	records := f.records[seqname]
+	delete(f.records, seqname)
+	f.Unlock()
+	if records == nil {
+		// no variants called on this chromosome
+		for _, name := range f.samples {
+			records = append(records, jsonlRecord{Sample: name, Chromosome: seqname, Variants: []jsonlVariant{}})
+		}
+	}
+	enc := json.NewEncoder(out)
+	for _, rec := range records {
+		err := enc.Encode(rec)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
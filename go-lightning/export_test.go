@@ -5,10 +5,13 @@
 package lightning
 
 import (
+	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"os/exec"
 
+	"github.com/arvados/lightning/go-lightning/hgvs"
 	"github.com/kshedden/gonpy"
 	"gopkg.in/check.v1"
 )
@@ -92,6 +95,75 @@ chr2.472G>A	1	0
 1,"input2","out.tsv"
 `)
 
+	exited = (&exporter{}).RunCommand("export", []string{
+		"-local=true",
+		"-input-dir=" + input,
+		"-output-dir=" + tmpdir,
+		"-output-format=jsonl",
+		"-ref=testdata/ref.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Check(exited, check.Equals, 0)
+	jf, err := os.Open(tmpdir + "/out.chr1.jsonl")
+	c.Assert(err, check.IsNil)
+	var records []jsonlRecord
+	dec := json.NewDecoder(jf)
+	for dec.More() {
+		var rec jsonlRecord
+		c.Assert(dec.Decode(&rec), check.IsNil)
+		records = append(records, rec)
+	}
+	jf.Close()
+	c.Assert(records, check.HasLen, 2)
+	c.Check(records[0].Sample, check.Equals, "input1")
+	c.Check(records[0].Chromosome, check.Equals, "chr1")
+	c.Check(records[0].Variants, check.HasLen, 7)
+	genotype := map[string]string{}
+	for _, v := range records[0].Variants {
+		genotype[v.HGVS] = v.Genotype
+	}
+	c.Check(genotype["chr1:g.1_3delinsGGC"], check.Equals, "1/1")
+	c.Check(genotype["chr1:g.41T>A"], check.Equals, "1/0")
+	c.Check(genotype["chr1:g.161A>T"], check.Equals, "0/1")
+	c.Check(records[1].Sample, check.Equals, "input2")
+	c.Check(records[1].Variants, check.HasLen, 0)
+
+	err = ioutil.WriteFile(tmpdir+"/picklist.txt", []byte("# genomes to export\ninput1\n"), 0644)
+	c.Assert(err, check.IsNil)
+	pickdir := c.MkDir()
+	exited = (&exporter{}).RunCommand("export", []string{
+		"-local=true",
+		"-input-dir=" + input,
+		"-output-dir=" + pickdir,
+		"-output-format=hgvs",
+		"-pick-list=" + tmpdir + "/picklist.txt",
+		"-output-per-sample",
+		"-ref=testdata/ref.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Check(exited, check.Equals, 0)
+	output, err = ioutil.ReadFile(pickdir + "/input1/out.chr1.tsv")
+	c.Check(err, check.IsNil)
+	c.Check(string(output), check.Matches, `(?ms).*41T>A.*`)
+	_, err = os.Stat(pickdir + "/input2")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	err = ioutil.WriteFile(tmpdir+"/genomes.txt", []byte("input2\n"), 0644)
+	c.Assert(err, check.IsNil)
+	listdir := c.MkDir()
+	exited = (&exporter{}).RunCommand("export", []string{
+		"-local=true",
+		"-input-dir=" + input,
+		"-output-dir=" + listdir,
+		"-output-format=hgvs",
+		"-genome-list=" + tmpdir + "/genomes.txt",
+		"-output-per-sample",
+		"-ref=testdata/ref.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Check(exited, check.Equals, 0)
+	_, err = os.Stat(listdir + "/input2")
+	c.Check(err, check.IsNil)
+	_, err = os.Stat(listdir + "/input1")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
 	exited = (&exporter{}).RunCommand("export", []string{
 		"-local=true",
 		"-input-dir=" + input,
@@ -128,6 +200,50 @@ chr2	471	.	G	A	.	.	.	GT	0/1	0/0
 chr2	472	.	G	A	.	.	.	GT	0/1	0/0
 `))
 
+	shardDir := c.MkDir()
+	exited = (&exporter{}).RunCommand("export", []string{
+		"-local=true",
+		"-input-dir=" + input,
+		"-output-dir=" + shardDir,
+		"-output-format=pvcf",
+		"-samples-per-shard=1",
+		"-ref=testdata/ref.fasta",
+	}, os.Stderr, os.Stderr, os.Stderr)
+	c.Check(exited, check.Equals, 0)
+	output, err = ioutil.ReadFile(shardDir + "/out.chr1.shard0000.vcf")
+	c.Check(err, check.IsNil)
+	c.Check(sortLines(string(output)), check.Equals, sortLines(`##FORMAT=<ID=GT,Number=1,Type=String,Description="Genotype">
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	testdata/pipeline1/input1.1.fasta
+chr1	1	.	NNN	GGC	.	.	.	GT	1/1
+chr1	41	.	T	A	.	.	.	GT	1/0
+chr1	42	.	T	A	.	.	.	GT	1/0
+chr1	161	.	A	T	.	.	.	GT	0/1
+chr1	178	.	A	T	.	.	.	GT	0/1
+chr1	221	.	TCCA	T	.	.	.	GT	1/1
+chr1	302	.	TTTT	AAAA	.	.	.	GT	0/1
+`))
+	output, err = ioutil.ReadFile(shardDir + "/out.chr1.shard0001.vcf")
+	c.Check(err, check.IsNil)
+	c.Check(sortLines(string(output)), check.Equals, sortLines(`##FORMAT=<ID=GT,Number=1,Type=String,Description="Genotype">
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	testdata/pipeline1/input2.1.fasta
+chr1	1	.	NNN	GGC	.	.	.	GT	0/0
+chr1	41	.	T	A	.	.	.	GT	0/0
+chr1	42	.	T	A	.	.	.	GT	0/0
+chr1	161	.	A	T	.	.	.	GT	0/0
+chr1	178	.	A	T	.	.	.	GT	0/0
+chr1	221	.	TCCA	T	.	.	.	GT	0/0
+chr1	302	.	TTTT	AAAA	.	.	.	GT	0/0
+`))
+	var shards pvcfShardManifest
+	buf, err := ioutil.ReadFile(shardDir + "/shards.json")
+	c.Assert(err, check.IsNil)
+	c.Check(json.Unmarshal(buf, &shards), check.IsNil)
+	c.Check(shards.Samples, check.Equals, 2)
+	c.Assert(shards.Shards, check.HasLen, 2)
+	c.Check(shards.Shards[1].FirstSample, check.Equals, 1)
+	c.Check(shards.Shards[1].Samples, check.DeepEquals, []string{"testdata/pipeline1/input2.1.fasta"})
+	c.Check(shards.Shards[1].Files["chr2"], check.Equals, "out.chr2.shard0001.vcf")
+
 	exited = (&exporter{}).RunCommand("export", []string{
 		"-local=true",
 		"-input-dir=" + input,
@@ -162,6 +278,31 @@ chr2	471	.	G	A	.	.	AC=1
 chr2	472	.	G	A	.	.	AC=1
 `))
 
+	exited = (&exporter{}).RunCommand("export", []string{
+		"-local=true",
+		"-input-dir=" + input,
+		"-output-dir=" + tmpdir,
+		"-output-format=sites",
+		"-aggregate-only",
+		"-ref=testdata/ref.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Check(exited, check.Equals, 0)
+	output, err = ioutil.ReadFile(tmpdir + "/sites.chr1.vcf")
+	c.Check(err, check.IsNil)
+	c.Log(string(output))
+	c.Check(string(output), check.Matches, `(?ms)##fileformat=VCFv4.2\n.*\nchr1\t41\t\.\tT\tA\t\.\t\.\tAC=1;AN=4;AF=0\.25\n.*`)
+	c.Check(string(output), check.Not(check.Matches), `(?ms).*input1.*`)
+
+	exited = (&exporter{}).RunCommand("export", []string{
+		"-local=true",
+		"-input-dir=" + input,
+		"-output-dir=" + tmpdir,
+		"-output-format=pvcf",
+		"-aggregate-only",
+		"-ref=testdata/ref.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Check(exited, check.Equals, 2)
+
 	c.Logf("export hgvs-numpy")
 	outdir := c.MkDir()
 	exited = (&exporter{}).RunCommand("export", []string{
@@ -240,3 +381,49 @@ chr2	472	.	G	A	.	.	AC=1
 	c.Check(exited, check.Equals, 0)
 
 }
+
+func (s *exportSuite) TestRefNames(c *check.C) {
+	refseqs := map[string]map[string][]tileLibRef{
+		"hg19": nil,
+		"hg38": nil,
+	}
+	names, err := exportRefNames("hg38", refseqs)
+	c.Check(err, check.IsNil)
+	c.Check(names, check.DeepEquals, []string{"hg38"})
+	names, err = exportRefNames("hg38,hg19", refseqs)
+	c.Check(err, check.IsNil)
+	c.Check(names, check.DeepEquals, []string{"hg38", "hg19"})
+	names, err = exportRefNames("all", refseqs)
+	c.Check(err, check.IsNil)
+	c.Check(names, check.DeepEquals, []string{"hg19", "hg38"})
+	_, err = exportRefNames("hg38,hg18", refseqs)
+	c.Check(err, check.ErrorMatches, `reference name "hg18" not found in input; have \[hg19 hg38\]`)
+	_, err = exportRefNames("hg38,hg38", refseqs)
+	c.Check(err, check.ErrorMatches, `.* specified more than once`)
+
+	dirs, err := exportRefDirs([]string{"/data/hg19.fa.gz", "/data/hg38.fa.gz"})
+	c.Check(err, check.IsNil)
+	c.Check(dirs, check.DeepEquals, []string{"hg19.fa.gz", "hg38.fa.gz"})
+	_, err = exportRefDirs([]string{"/a/ref.fa", "/b/ref.fa"})
+	c.Check(err, check.ErrorMatches, `cannot export multiple references: references "/a/ref.fa" and "/b/ref.fa" would both .*`)
+}
+
+func (s *exportSuite) TestHaploid(c *check.C) {
+	snp := hgvs.Variant{Position: 10, Ref: "A", New: "G"}
+	ref := hgvs.Variant{Position: 10}
+	// genome 0 has the variant (homoplasmic), genome 1 has it
+	// as the major allele with ref as the secondary allele
+	// (heteroplasmic)
+	varslice := []tvVariant{{Variant: snp}, {Variant: snp}, {Variant: snp}, {Variant: ref}}
+	markHaploid(varslice)
+	c.Check(varslice[1].haploid, check.Equals, true)
+	c.Check(varslice[3].haploid, check.Equals, false)
+
+	var buf bytes.Buffer
+	c.Assert(formatPVCF{}.Print(&buf, "chrM", varslice), check.IsNil)
+	c.Check(buf.String(), check.Equals, "chrM\t10\t.\tA\tG\t.\t.\t.\tGT\t1\t1/0\n")
+
+	buf.Reset()
+	c.Assert((&formatSites{}).Print(&buf, "chrM", varslice), check.IsNil)
+	c.Check(buf.String(), check.Equals, "chrM\t10\t.\tA\tG\t.\t.\tAC=2;AN=3;AF=0.6666666666666666\n")
+}
@@ -30,7 +30,11 @@ import (
 )
 
 type exportNumpy struct {
-	filter filter
+	filter        Filter
+	missing       missingEncoding
+	haploBlocks   haplotypeBlocks
+	manifest      manifestOptions
+	contigAliases contigAliasOptions
 }
 
 func (cmd *exportNumpy) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
@@ -46,17 +50,26 @@ func (cmd *exportNumpy) RunCommand(prog string, args []string, stdin io.Reader,
 	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
 	projectUUID := flags.String("project", "", "project `UUID` for output data")
 	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
 	inputDir := flags.String("input-dir", "./in", "input `directory`")
 	outputDir := flags.String("output-dir", "./out", "output `directory`")
 	annotationsFilename := flags.String("output-annotations", "", "output `file` for tile variant annotations csv")
+	selectHGVSFilename := flags.String("select-hgvs", "", "only output hgvs columns listed in `file` (one HGVS ID like chr1:g.123A>G, or position range like chr1:1000-2000, per line) in the per-chromosome {seqname}.npy matrices, and skip chromosomes with no selected columns")
 	librefsFilename := flags.String("output-onehot2tilevar", "", "when using -one-hot, create csv `file` mapping column# to tag# and variant#")
 	labelsFilename := flags.String("output-labels", "", "output `file` for genome labels csv")
-	regionsFilename := flags.String("regions", "", "only output columns/annotations that intersect regions in specified bed `file`")
+	regionsFilename := flags.String("regions", "", "only output columns/annotations that intersect regions in specified bed/gff/gtf `files` (comma-separated list of filenames or glob patterns)")
 	expandRegions := flags.Int("expand-regions", 0, "expand specified regions by `N` base pairs on each side`")
+	var rfilter regionsFilter
+	rfilter.Flags(flags)
 	onehot := flags.Bool("one-hot", false, "recode tile variants as one-hot")
 	chunks := flags.Int("chunks", 1, "split output into `N` numpy files")
 	cmd.filter.Flags(flags)
-	err = flags.Parse(args)
+	cmd.contigAliases.Flags(flags)
+	cmd.missing.Flags(flags)
+	cmd.haploBlocks.Flags(flags)
+	cmd.manifest.Flags(flags)
+	err = parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		err = nil
 		return 0
@@ -65,6 +78,10 @@ func (cmd *exportNumpy) RunCommand(prog string, args []string, stdin io.Reader,
 	} else if flags.NArg() > 0 {
 		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
 		return 2
+	} else if err = cmd.missing.Check(); err != nil {
+		return 2
+	} else if err = cmd.haploBlocks.Check(); err != nil {
+		return 2
 	}
 
 	if *pprof != "" {
@@ -84,7 +101,20 @@ func (cmd *exportNumpy) RunCommand(prog string, args []string, stdin io.Reader,
 			KeepCache:   1,
 			APIAccess:   true,
 		}
-		err = runner.TranslatePaths(inputDir, regionsFilename)
+		containerOpts.Apply(&runner, stdout)
+		err = runner.TranslatePaths(inputDir, selectHGVSFilename)
+		if err == nil {
+			err = rfilter.TranslatePaths(&runner, regionsFilename)
+		}
+		if err == nil {
+			err = cmd.filter.TranslatePaths(&runner)
+		}
+		if err == nil {
+			err = cmd.manifest.TranslatePaths(&runner)
+		}
+		if err == nil {
+			err = cmd.contigAliases.TranslatePaths(&runner)
+		}
 		if err != nil {
 			return 1
 		}
@@ -99,29 +129,58 @@ func (cmd *exportNumpy) RunCommand(prog string, args []string, stdin io.Reader,
 			"-regions", *regionsFilename,
 			"-expand-regions", fmt.Sprintf("%d", *expandRegions),
 			"-chunks", fmt.Sprintf("%d", *chunks),
+			"-select-hgvs", *selectHGVSFilename,
 		}
 		runner.Args = append(runner.Args, cmd.filter.Args()...)
+		runner.Args = append(runner.Args, rfilter.Args()...)
+		runner.Args = append(runner.Args, cmd.missing.Args()...)
+		runner.Args = append(runner.Args, cmd.haploBlocks.Args()...)
+		runner.Args = append(runner.Args, cmd.manifest.Args()...)
+		runner.Args = append(runner.Args, cmd.contigAliases.Args()...)
 		var output string
 		output, err = runner.Run()
-		if err != nil {
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
 			return 1
 		}
 		fmt.Fprintln(stdout, output+"/matrix.npy")
 		return 0
 	}
 
+	err = cmd.contigAliases.Load()
+	if err != nil {
+		return 1
+	}
+
+	var selectHGVS *hgvsSelection
+	if *selectHGVSFilename != "" {
+		selectHGVS, err = loadHGVSSelection(*selectHGVSFilename)
+		if err != nil {
+			return 1
+		}
+		log.Infof("loaded %d hgvs selections from %s", selectHGVS.Len(), *selectHGVSFilename)
+	}
+
+	ctx, cancel := interruptContext(context.Background())
+	defer cancel()
+
 	tilelib := &tileLibrary{
 		retainNoCalls:       true,
 		retainTileSequences: true,
 		compactGenomes:      map[string][]tileVariantID{},
 	}
-	err = tilelib.LoadDir(context.Background(), *inputDir)
+	err = tilelib.LoadDir(ctx, *inputDir)
 	if err != nil {
 		return 1
 	}
 
 	log.Info("filtering")
-	cmd.filter.Apply(tilelib)
+	err = cmd.filter.Apply(tilelib)
+	if err != nil {
+		return 1
+	}
 	log.Info("tidying")
 	tilelib.Tidy()
 
@@ -153,20 +212,32 @@ func (cmd *exportNumpy) RunCommand(prog string, args []string, stdin io.Reader,
 	}
 
 	log.Info("determining which tiles intersect given regions")
-	dropTiles, err := chooseTiles(tilelib, *regionsFilename, *expandRegions)
+	dropTiles, err := chooseTiles(tilelib, *regionsFilename, *expandRegions, rfilter)
+	if err != nil {
+		return 1
+	}
+
+	err = cmd.haploBlocks.Write(*outputDir, tilelib, names, lowqual, dropTiles)
 	if err != nil {
 		return 1
 	}
 
 	annotation2tvs := map[string]map[hgvs.Variant][]tileLibRef{}
-	if *annotationsFilename != "" {
-		log.Info("writing annotations")
+	if *annotationsFilename != "" || selectHGVS != nil {
 		var annow io.WriteCloser
-		annow, err = os.OpenFile(*annotationsFilename, os.O_CREATE|os.O_WRONLY, 0666)
-		if err != nil {
-			return 1
+		if *annotationsFilename == "" {
+			// -select-hgvs needs annotations, but
+			// the caller didn't ask for the file.
+			log.Info("annotating")
+			annow = nopCloser{ioutil.Discard}
+		} else {
+			log.Info("writing annotations")
+			annow, err = os.OpenFile(*annotationsFilename, os.O_CREATE|os.O_WRONLY, 0666)
+			if err != nil {
+				return 1
+			}
+			defer annow.Close()
 		}
-		defer annow.Close()
 		var mtx sync.Mutex
 		err = (&annotatecmd{
 			maxTileSize: 5000,
@@ -199,6 +270,9 @@ func (cmd *exportNumpy) RunCommand(prog string, args []string, stdin io.Reader,
 			log.Infof("choosing hgvs columns for seq %s", seqname)
 			var pdis []hgvs.Variant
 			for pdi, librefs := range pdivars {
+				if selectHGVS != nil && !selectHGVS.Match(seqname, pdi) {
+					continue
+				}
 				// Include this HGVS column if it was
 				// seen in a variant of any
 				// non-dropped tile.
@@ -209,6 +283,10 @@ func (cmd *exportNumpy) RunCommand(prog string, args []string, stdin io.Reader,
 					}
 				}
 			}
+			if selectHGVS != nil && len(pdis) == 0 {
+				log.Infof("no selected hgvs columns for seq %s", seqname)
+				return
+			}
 			sort.Slice(pdis, func(i, j int) bool {
 				if cmp := pdis[i].Position - pdis[j].Position; cmp != 0 {
 					return cmp < 0
@@ -332,6 +410,20 @@ func (cmd *exportNumpy) RunCommand(prog string, args []string, stdin io.Reader,
 		if err != nil {
 			return 1
 		}
+		if !*onehot {
+			_, _, err = cmd.missing.Apply(fnm, tileMatrixMissing)
+			if err != nil {
+				return 1
+			}
+		}
+	}
+	inputs := []string{*inputDir}
+	if *selectHGVSFilename != "" {
+		inputs = append(inputs, *selectHGVSFilename)
+	}
+	err = cmd.manifest.Write(*outputDir, args, inputs)
+	if err != nil {
+		return 1
 	}
 	return 0
 }
@@ -407,17 +499,69 @@ func cgs2array(tilelib *tileLibrary, names []string, lowqual []map[tileVariantID
 	return
 }
 
-func makeMask(regionsFilename string, expandRegions int) (*mask, error) {
-	log.Printf("makeMask: reading %s", regionsFilename)
-	rfile, err := zopen(regionsFilename)
+// makeMask returns a mask of the regions in the given files (a
+// comma-separated list of filenames and glob patterns). See
+// regionsFilter for options.
+func makeMask(regionsFilename string, expandRegions int, rfilter regionsFilter) (*mask, error) {
+	keep, err := rfilter.compiled()
 	if err != nil {
 		return nil, err
 	}
-	defer rfile.Close()
-	regions, err := io.ReadAll(rfile)
+	fnms, err := regionsFiles(regionsFilename)
 	if err != nil {
 		return nil, err
 	}
+	var masks []*mask
+	for _, fnm := range fnms {
+		m, err := readRegionsFile(fnm, expandRegions, keep, rfilter.contigs)
+		if err != nil {
+			return nil, err
+		}
+		masks = append(masks, m)
+	}
+	mask := masks[0]
+	if len(masks) > 1 {
+		log.Printf("makeMask: combining %d regions files (%s)", len(masks), rfilter.combine)
+		if rfilter.combine == "intersection" {
+			mask = intersectMasks(masks)
+		} else {
+			mask = unionMasks(masks)
+		}
+	}
+	mask.inverted = rfilter.invert
+	log.Print("makeMask: mask.Freeze")
+	mask.Freeze()
+	return mask, nil
+}
+
+// readRegionsFile returns a mask of the regions in the given
+// BED/GFF/GTF file, which may be gzip-compressed. If contigs is
+// non-empty and the file has a tabix index, only the regions on
+// those contigs are read.
+func readRegionsFile(regionsFilename string, expandRegions int, keep func([][]byte) (bool, error), contigs []string) (*mask, error) {
+	var regions []byte
+	indexed := false
+	if len(contigs) > 0 && strings.HasSuffix(regionsFilename, ".gz") {
+		var err error
+		regions, indexed, err = readTabixContigs(regionsFilename, contigs)
+		if err != nil {
+			return nil, err
+		} else if indexed {
+			log.Printf("makeMask: read %d bytes for %d contigs from %s using tabix index", len(regions), len(contigs), regionsFilename)
+		}
+	}
+	if !indexed {
+		log.Printf("makeMask: reading %s", regionsFilename)
+		rfile, err := zopen(regionsFilename)
+		if err != nil {
+			return nil, err
+		}
+		defer rfile.Close()
+		regions, err = io.ReadAll(rfile)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	log.Print("makeMask: building mask")
 	var mask mask
@@ -430,13 +574,15 @@ func makeMask(regionsFilename string, expandRegions int) (*mask, error) {
 			continue
 		}
 		refseqname := string(fields[0])
-		if strings.HasPrefix(refseqname, "chr") {
-			refseqname = refseqname[3:]
-		}
 		start, err1 := strconv.Atoi(string(fields[1]))
 		end, err2 := strconv.Atoi(string(fields[2]))
 		if err1 == nil && err2 == nil {
 			// BED
+			if keep != nil {
+				return nil, errors.New("-regions-feature-type and -regions-attribute require a GFF/GTF regions file")
+			}
+		} else if len(fields) < 5 {
+			return nil, fmt.Errorf("%s: cannot parse input line as BED or GFF/GTF: %q", regionsFilename, line)
 		} else {
 			start, err1 = strconv.Atoi(string(fields[3]))
 			end, err2 = strconv.Atoi(string(fields[4]))
@@ -444,21 +590,31 @@ func makeMask(regionsFilename string, expandRegions int) (*mask, error) {
 				// GFF/GTF
 				end++
 			} else {
-				return nil, fmt.Errorf("cannot parse input line as BED or GFF/GTF: %q", line)
+				return nil, fmt.Errorf("%s: cannot parse input line as BED or GFF/GTF: %q", regionsFilename, line)
+			}
+			if keep != nil {
+				if ok, err := keep(fields); err != nil {
+					return nil, err
+				} else if !ok {
+					continue
+				}
 			}
 		}
 		mask.Add(refseqname, start-expandRegions, end+expandRegions)
 	}
-	log.Print("makeMask: mask.Freeze")
-	mask.Freeze()
 	return &mask, nil
 }
 
-func chooseTiles(tilelib *tileLibrary, regionsFilename string, expandRegions int) (drop []bool, err error) {
+func chooseTiles(tilelib *tileLibrary, regionsFilename string, expandRegions int, rfilter regionsFilter) (drop []bool, err error) {
 	if regionsFilename == "" {
 		return
 	}
-	mask, err := makeMask(regionsFilename, expandRegions)
+	for _, refseq := range tilelib.refseqs {
+		for seqname := range refseq {
+			rfilter.contigs = append(rfilter.contigs, seqname)
+		}
+	}
+	mask, err := makeMask(regionsFilename, expandRegions, rfilter)
 	if err != nil {
 		return
 	}
@@ -468,9 +624,21 @@ func chooseTiles(tilelib *tileLibrary, regionsFilename string, expandRegions int
 		err = errors.New("cannot choose tiles by region in a library without tags")
 		return
 	}
-	taglen := len(tagset[0])
-
 	log.Print("chooseTiles: check ref tiles")
+	drop, err = dropTilesOutsideMask(mask, tilelib.refseqs, tilelib.taglib.taglen, len(tilelib.variant), func(libref tileLibRef) int {
+		return len(tilelib.TileVariantSequence(libref))
+	})
+	if err != nil {
+		return
+	}
+	log.Print("chooseTiles: done")
+	return
+}
+
+// dropTilesOutsideMask returns drop[tag]==true for each of the ntags
+// tags whose reference tiles do not intersect mask. seqlen returns
+// the sequence length of the given reference tile variant.
+func dropTilesOutsideMask(mask *mask, refseqs map[string]map[string][]tileLibRef, taglen []int, ntags int, seqlen func(tileLibRef) int) (drop []bool, err error) {
 	// Find position+size of each reference tile, and if it
 	// intersects any of the desired regions, set drop[tag]=false.
 	//
@@ -484,36 +652,31 @@ func chooseTiles(tilelib *tileLibrary, regionsFilename string, expandRegions int
 	// variants are spanning tiles, i.e., where the reference tile
 	// does not intersect the desired regions, but a spanning tile
 	// from a genome does.
-	drop = make([]bool, len(tilelib.variant))
+	drop = make([]bool, ntags)
 	for i := range drop {
 		drop[i] = true
 	}
-	for refname, refseqs := range tilelib.refseqs {
-		for refseqname, reftiles := range refseqs {
-			if strings.HasPrefix(refseqname, "chr") {
-				refseqname = refseqname[3:]
-			}
+	for refname, seqs := range refseqs {
+		for refseqname, reftiles := range seqs {
 			tileend := 0
-			for _, libref := range reftiles {
+			for i, libref := range reftiles {
 				if libref.Variant < 1 {
 					err = fmt.Errorf("reference %q seq %q uses variant zero at tag %d", refname, refseqname, libref.Tag)
 					return
 				}
-				seq := tilelib.TileVariantSequence(libref)
-				if len(seq) < taglen {
-					err = fmt.Errorf("reference %q seq %q uses tile %d variant %d with sequence len %d < taglen %d", refname, refseqname, libref.Tag, libref.Variant, len(seq), taglen)
+				size := seqlen(libref)
+				if size < taglen[libref.Tag] {
+					err = fmt.Errorf("reference %q seq %q uses tile %d variant %d with sequence len %d < taglen %d", refname, refseqname, libref.Tag, libref.Variant, size, taglen[libref.Tag])
 					return
 				}
 				tilestart := tileend
-				tileend = tilestart + len(seq) - taglen
+				tileend = tilestart + size - pathOverlap(taglen, reftiles, i)
 				if mask.Check(refseqname, tilestart, tileend) {
 					drop[libref.Tag] = false
 				}
 			}
 		}
 	}
-
-	log.Print("chooseTiles: done")
 	return
 }
 
@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"os"
 
+	"github.com/arvados/lightning/go-lightning/hgvs"
 	"github.com/kshedden/gonpy"
 	"gopkg.in/check.v1"
 )
@@ -51,6 +52,41 @@ func (s *exportNumpySuite) TestFastaToNumpy(c *check.C) {
 	c.Logf("%s", string(annotations))
 	c.Check(string(annotations), check.Matches, `(?ms)(.*\n)?1,1,2,chr1:g.84_85insACTGCGATCTGA\n.*`)
 	c.Check(string(annotations), check.Matches, `(?ms)(.*\n)?1,1,1,chr1:g.87_96delinsGCATCTGCA\n.*`)
+
+	// Same, but only one hgvs column.
+	seldir := c.MkDir()
+	err = ioutil.WriteFile(seldir+"/select.txt", []byte("# comment\nchr1:g.84_85insACTGCGATCTGA\n"), 0644)
+	c.Assert(err, check.IsNil)
+	exited = (&exportNumpy{}).RunCommand("export-numpy", []string{"-local=true", "-input-dir", tmpdir, "-output-dir", seldir, "-select-hgvs", seldir + "/select.txt"}, &buffer, os.Stderr, os.Stderr)
+	c.Check(exited, check.Equals, 0)
+	columns, err := ioutil.ReadFile(seldir + "/chr1.columns.csv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(columns), check.Equals, "chr1:g.84_85insACTGCGATCTGA\n")
+	f, err = os.Open(seldir + "/chr1.npy")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	npy, err = gonpy.NewReader(f)
+	c.Assert(err, check.IsNil)
+	c.Check(npy.Shape, check.DeepEquals, []int{1, 2})
+}
+
+func (s *exportNumpySuite) TestLoadHGVSSelection(c *check.C) {
+	fnm := c.MkDir() + "/select.csv"
+	err := ioutil.WriteFile(fnm, []byte("chr1:g.100A>G,extra\n\nchr2:1000-2000\nchr2:3000\n"), 0644)
+	c.Assert(err, check.IsNil)
+	sel, err := loadHGVSSelection(fnm)
+	c.Assert(err, check.IsNil)
+	c.Check(sel.Len(), check.Equals, 3)
+	c.Check(sel.Match("chr1", hgvs.Variant{Position: 100, Ref: "A", New: "G"}), check.Equals, true)
+	c.Check(sel.Match("chr1", hgvs.Variant{Position: 100, Ref: "A", New: "C"}), check.Equals, false)
+	c.Check(sel.Match("chr2", hgvs.Variant{Position: 1000, Ref: "A", New: "C"}), check.Equals, true)
+	c.Check(sel.Match("chr2", hgvs.Variant{Position: 2001, Ref: "A", New: "C"}), check.Equals, false)
+	c.Check(sel.Match("chr2", hgvs.Variant{Position: 3000, Ref: "A", New: "C"}), check.Equals, true)
+
+	err = ioutil.WriteFile(fnm, []byte("chr2:2000-1000\n"), 0644)
+	c.Assert(err, check.IsNil)
+	_, err = loadHGVSSelection(fnm)
+	c.Check(err, check.ErrorMatches, `.* line 1: end position is before start position.*`)
 }
 
 func sortUints(variants []int16) {
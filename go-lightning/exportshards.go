@@ -0,0 +1,165 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/pgzip"
+	log "github.com/sirupsen/logrus"
+)
+
+// pvcfShardManifest describes the files written by exportShards. It
+// is saved as shards.json in the output directory.
+type pvcfShardManifest struct {
+	SamplesPerShard int
+	Samples         int
+	Shards          []pvcfShard
+}
+
+type pvcfShard struct {
+	Shard       int
+	FirstSample int               // index of first sample in this shard
+	Samples     []string          // sample names, in column order
+	Files       map[string]string // seqname => filename (relative to output directory)
+}
+
+// syncWriter serializes calls to Write, so callers that write whole
+// lines can share an io.Writer.
+type syncWriter struct {
+	w   io.Writer
+	mtx sync.Mutex
+}
+
+func (sw *syncWriter) Write(p []byte) (int, error) {
+	sw.mtx.Lock()
+	defer sw.mtx.Unlock()
+	return sw.w.Write(p)
+}
+
+// exportShards is like export, but writes pvcf output in
+// column-sharded files: one file per chromosome per block of
+// cmd.samplesPerShard samples. All shards of a given chromosome have
+// the same site lines, so they can be processed independently or
+// pasted back together.
+func (cmd *exporter) exportShards(ctx context.Context, outdir string, bedout io.Writer, tilelib *tileLibrary, refseq map[string][]tileLibRef, cgs []CompactGenome) error {
+	pvcf := formatPVCF{}
+	var seqnames []string
+	for seqname := range refseq {
+		seqnames = append(seqnames, seqname)
+	}
+	sort.Strings(seqnames)
+
+	manifest := pvcfShardManifest{
+		SamplesPerShard: cmd.samplesPerShard,
+		Samples:         len(cgs),
+	}
+	for start := 0; start < len(cgs); start += cmd.samplesPerShard {
+		end := start + cmd.samplesPerShard
+		if end > len(cgs) {
+			end = len(cgs)
+		}
+		shard := pvcfShard{
+			Shard:       len(manifest.Shards),
+			FirstSample: start,
+			Files:       map[string]string{},
+		}
+		for _, cg := range cgs[start:end] {
+			shard.Samples = append(shard.Samples, cg.Name)
+		}
+		for _, seqname := range seqnames {
+			fnm := strings.Replace(pvcf.Filename(), ".", fmt.Sprintf(".%s.shard%04d.", seqname, shard.Shard), 1)
+			if cmd.compress {
+				fnm += ".gz"
+			}
+			shard.Files[seqname] = fnm
+		}
+		manifest.Shards = append(manifest.Shards, shard)
+	}
+
+	var bedw io.Writer
+	if bedout != nil {
+		bedw = &syncWriter{w: bedout}
+	}
+
+	throttle := throttle{Max: runtime.NumCPU()}
+	log.Infof("assembling %d sequences in %d shards in %d goroutines", len(seqnames), len(manifest.Shards), throttle.Max)
+	for _, seqname := range seqnames {
+		seqname := seqname
+		throttle.Acquire()
+		go func() {
+			defer throttle.Release()
+			outs := make([]io.Writer, len(manifest.Shards))
+			var closers []io.Closer
+			defer func() {
+				for _, c := range closers {
+					c.Close()
+				}
+			}()
+			var bufws []*bufio.Writer
+			for i, shard := range manifest.Shards {
+				fnm := filepath.Join(outdir, shard.Files[seqname])
+				f, err := create(fnm)
+				if err != nil {
+					throttle.Report(err)
+					return
+				}
+				closers = append(closers, f)
+				log.Infof("writing %q", fnm)
+				var w io.Writer = f
+				if cmd.compress {
+					z := pgzip.NewWriter(f)
+					closers = append([]io.Closer{z}, closers...)
+					w = z
+				}
+				bufw := bufio.NewWriterSize(w, 1024*1024)
+				bufws = append(bufws, bufw)
+				outs[i] = bufw
+				err = pvcf.Head(bufw, cgs[shard.FirstSample:shard.FirstSample+len(shard.Samples)], nil, cmd.maxPValue)
+				if err != nil {
+					throttle.Report(err)
+					return
+				}
+			}
+			haploid := cmd.isHaploid(seqname)
+			err := eachVariant(ctx, bedw, seqname, refseq[seqname], tilelib, cgs, pvcf.PadLeft(), cmd.maxTileSize, func(varslice []tvVariant) {
+				if haploid {
+					markHaploid(varslice)
+				}
+				err := pvcf.printShards(outs, seqname, varslice, cmd.samplesPerShard)
+				throttle.Report(err)
+			})
+			throttle.Report(err)
+			for _, bufw := range bufws {
+				throttle.Report(bufw.Flush())
+			}
+			for _, c := range closers {
+				throttle.Report(c.Close())
+			}
+			closers = nil
+		}()
+	}
+	throttle.Wait()
+	if err := throttle.Err(); err != nil {
+		return err
+	}
+
+	fnm := filepath.Join(outdir, "shards.json")
+	log.Infof("writing %q", fnm)
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(fnm, append(buf, '\n'), 0666)
+}
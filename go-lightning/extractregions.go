@@ -0,0 +1,351 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/arvados/lightning/go-lightning/libio"
+	log "github.com/sirupsen/logrus"
+)
+
+// extractRegions writes a library containing only the tags whose
+// reference tiles intersect the given regions.
+type extractRegions struct{}
+
+func (cmd *extractRegions) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
+	inputFilename := flags.String("i", "-", "input library `file`, or directory containing the output of a single import or slice")
+	outputFilename := flags.String("o", "-", "output library `file` (gzip-compressed if name ends in .gz)")
+	regionsFilename := flags.String("regions", "", "only keep tags whose reference tiles intersect regions in specified bed/gff/gtf `files` (comma-separated list of filenames or glob patterns)")
+	expandRegions := flags.Int("expand-regions", 0, "expand specified regions by `N` base pairs on each side`")
+	var rfilter regionsFilter
+	rfilter.Flags(flags)
+	var contigAliases contigAliasOptions
+	contigAliases.Flags(flags)
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	} else if *regionsFilename == "" {
+		err = errors.New("-regions argument is required")
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		if *outputFilename != "-" {
+			err = errors.New("cannot specify output file in container mode: not implemented")
+			return 1
+		}
+		runner := arvadosContainerRunner{
+			Name:        "lightning extract-regions",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         16000000000,
+			VCPUs:       2,
+			Priority:    *priority,
+		}
+		containerOpts.Apply(&runner, stdout)
+		err = runner.TranslatePaths(inputFilename)
+		if err == nil {
+			err = rfilter.TranslatePaths(&runner, regionsFilename)
+		}
+		if err == nil {
+			err = contigAliases.TranslatePaths(&runner)
+		}
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"extract-regions", "-local=true",
+			fmt.Sprintf("-pprof=%v", *pprof),
+			"-i", *inputFilename,
+			"-o", "/mnt/output/library.gob.gz",
+			"-regions=" + *regionsFilename,
+			"-expand-regions=" + fmt.Sprintf("%d", *expandRegions),
+		}
+		runner.Args = append(runner.Args, rfilter.Args()...)
+		runner.Args = append(runner.Args, contigAliases.Args()...)
+		var output string
+		output, err = runner.Run()
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output+"/library.gob.gz")
+		return 0
+	}
+
+	err = contigAliases.Load()
+	if err != nil {
+		return 1
+	}
+	infiles, err := allFiles(*inputFilename, matchGobFile)
+	if err != nil {
+		return 1
+	} else if len(infiles) == 0 {
+		err = fmt.Errorf("no input files found in %s", *inputFilename)
+		return 1
+	}
+	err = checkTagSets(infiles)
+	if err != nil {
+		return 1
+	}
+	mask, err := makeMask(*regionsFilename, *expandRegions, rfilter)
+	if err != nil {
+		return 1
+	}
+
+	var output io.WriteCloser
+	if *outputFilename == "-" {
+		output = nopCloser{stdout}
+	} else {
+		output, err = os.OpenFile(*outputFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+		if err != nil {
+			return 1
+		}
+		defer output.Close()
+	}
+	err = extractRegionsLibrary(infiles, mask, output, strings.HasSuffix(*outputFilename, ".gz"))
+	if err != nil {
+		return 1
+	}
+	err = output.Close()
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// extractRegionsLibrary copies the parts of the given library files
+// that pertain to tags whose reference tiles intersect mask.
+//
+// The output has the full tag set; tile variants (including
+// reference tiles) for the selected tags only; reference sequences
+// with the unselected tiles removed; and CompactGenomes trimmed to
+// the range of selected tags (with StartTag/EndTag adjusted
+// accordingly, and variant zero for unselected tags within that
+// range). Note that reference positions computed from the trimmed
+// reference sequences are therefore only meaningful when the
+// selected tags are contiguous and start at the beginning of a
+// chromosome.
+func extractRegionsLibrary(infiles []string, mask *mask, w io.Writer, gz bool) error {
+	// First pass: get tag set and reference sequences.
+	var tagset [][]byte
+	var cseqs []CompactSequence
+	seenCseq := map[string]bool{}
+	for _, infile := range infiles {
+		err := decodeLibraryFile(infile, func(ent *LibraryEntry) error {
+			if len(ent.TagSet) > 0 && tagset == nil {
+				tagset = ent.TagSet
+			}
+			for _, cseq := range ent.CompactSequences {
+				if !seenCseq[cseq.Name] {
+					seenCseq[cseq.Name] = true
+					cseqs = append(cseqs, cseq)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(tagset) == 0 {
+		return errors.New("cannot choose tiles by region in a library without tags")
+	} else if len(cseqs) == 0 {
+		return errors.New("cannot choose tiles by region in a library without reference sequences")
+	}
+
+	// Second pass: get the sequence lengths of the reference
+	// tiles, and use them to decide which tags to keep.
+	refseqs := map[string]map[string][]tileLibRef{}
+	reflen := map[tileLibRef]int{}
+	for _, cseq := range cseqs {
+		refseqs[cseq.Name] = cseq.TileSequences
+		for _, tseq := range cseq.TileSequences {
+			for _, libref := range tseq {
+				if libref.Variant > 0 {
+					reflen[libref] = -1
+				}
+			}
+		}
+	}
+	for _, infile := range infiles {
+		err := decodeLibraryFile(infile, func(ent *LibraryEntry) error {
+			for _, tv := range ent.TileVariants {
+				libref := tileLibRef{Tag: tv.Tag, Variant: tv.Variant}
+				if _, ok := reflen[libref]; ok {
+					reflen[libref] = len(tv.Sequence)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for libref, n := range reflen {
+		if n < 0 {
+			return fmt.Errorf("reference tile variant %d for tag %d was not found in the input library", libref.Variant, libref.Tag)
+		}
+	}
+	taglen := make([]int, len(tagset))
+	for i, tag := range tagset {
+		taglen[i] = len(tag)
+	}
+	drop, err := dropTilesOutsideMask(mask, refseqs, taglen, len(tagset), func(libref tileLibRef) int {
+		return reflen[libref]
+	})
+	if err != nil {
+		return err
+	}
+	start, end := tagID(len(drop)), tagID(0)
+	for tag, d := range drop {
+		if !d {
+			if tagID(tag) < start {
+				start = tagID(tag)
+			}
+			end = tagID(tag) + 1
+		}
+	}
+	if end == 0 {
+		return errors.New("no reference tiles intersect the given regions")
+	}
+	log.Infof("extract-regions: keeping %d tags in range %d..%d", len(drop)-countTrue(drop), start, end-1)
+
+	// Third pass: copy the selected tile variants and trimmed
+	// genomes.
+	lw := libio.NewWriter(w, gz)
+	if err := lw.WriteTagSet(tagset); err != nil {
+		return err
+	}
+	ntv, ncg := 0, 0
+	for _, infile := range infiles {
+		err := decodeLibraryFile(infile, func(ent *LibraryEntry) error {
+			var tvs []TileVariant
+			for _, tv := range ent.TileVariants {
+				if int(tv.Tag) < len(drop) && !drop[tv.Tag] {
+					tvs = append(tvs, tv)
+				}
+			}
+			if len(tvs) > 0 {
+				ntv += len(tvs)
+				if err := lw.WriteTileVariants(tvs); err != nil {
+					return err
+				}
+			}
+			var cgs []CompactGenome
+			for _, cg := range ent.CompactGenomes {
+				if trimmed, ok := trimCompactGenome(cg, start, end, drop); ok {
+					cgs = append(cgs, trimmed)
+				}
+			}
+			if len(cgs) > 0 {
+				ncg += len(cgs)
+				if err := lw.WriteCompactGenomes(cgs); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for i, cseq := range cseqs {
+		trimmed := CompactSequence{Name: cseq.Name, TileSequences: map[string][]tileLibRef{}}
+		for seqname, tseq := range cseq.TileSequences {
+			var keep []tileLibRef
+			for _, libref := range tseq {
+				if !drop[libref.Tag] {
+					keep = append(keep, libref)
+				}
+			}
+			if len(keep) > 0 {
+				trimmed.TileSequences[seqname] = keep
+			}
+		}
+		cseqs[i] = trimmed
+	}
+	if err := lw.WriteCompactSequences(cseqs); err != nil {
+		return err
+	}
+	log.Infof("extract-regions: wrote %d tile variants, %d genome segments, %d reference sequences", ntv, ncg, len(cseqs))
+	return lw.Close()
+}
+
+// trimCompactGenome returns the part of cg that covers tags
+// start..end-1, with variant zero at tags where drop[tag] is true.
+// It returns false if cg has no variants in that range.
+func trimCompactGenome(cg CompactGenome, start, end tagID, drop []bool) (CompactGenome, bool) {
+	cgend := cg.StartTag + tagID(len(cg.Variants)/2)
+	if start < cg.StartTag {
+		start = cg.StartTag
+	}
+	if end > cgend {
+		end = cgend
+	}
+	if start >= end {
+		return CompactGenome{}, false
+	}
+	trimmed := CompactGenome{
+		Name:     cg.Name,
+		Variants: make([]tileVariantID, (end-start)*2),
+		StartTag: start,
+		EndTag:   end,
+	}
+	copy(trimmed.Variants, cg.Variants[(start-cg.StartTag)*2:(end-cg.StartTag)*2])
+	for tag := start; tag < end; tag++ {
+		if drop[tag] {
+			trimmed.Variants[(tag-start)*2] = 0
+			trimmed.Variants[(tag-start)*2+1] = 0
+		}
+	}
+	return trimmed, true
+}
+
+func countTrue(bs []bool) int {
+	n := 0
+	for _, b := range bs {
+		if b {
+			n++
+		}
+	}
+	return n
+}
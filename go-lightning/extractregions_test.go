@@ -0,0 +1,90 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type extractRegionsSuite struct{}
+
+var _ = check.Suite(&extractRegionsSuite{})
+
+func (s *extractRegionsSuite) TestExtractRegions(c *check.C) {
+	tmpdir := c.MkDir()
+	exited := (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-output-tiles",
+		"-save-incomplete-tiles",
+		"-o", tmpdir + "/library.gob",
+		"testdata/ref.fasta",
+		"testdata/pipeline1",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	err := ioutil.WriteFile(tmpdir+"/chr1-12-100.bed", []byte("chr1\t12\t100\ttest.1\n"), 0644)
+	c.Assert(err, check.IsNil)
+	exited = (&extractRegions{}).RunCommand("extract-regions", []string{
+		"-local=true",
+		"-i", tmpdir + "/library.gob",
+		"-o", tmpdir + "/regions.gob.gz",
+		"-regions", tmpdir + "/chr1-12-100.bed",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	ntagsIn := 0
+	tagsIn := map[tagID]bool{}
+	err = decodeLibraryFile(tmpdir+"/library.gob", func(ent *LibraryEntry) error {
+		if len(ent.TagSet) > 0 {
+			ntagsIn = len(ent.TagSet)
+		}
+		for _, tv := range ent.TileVariants {
+			tagsIn[tv.Tag] = true
+		}
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+
+	var cgs []CompactGenome
+	var cseqs []CompactSequence
+	ntags := 0
+	tags := map[tagID]bool{}
+	err = decodeLibraryFile(tmpdir+"/regions.gob.gz", func(ent *LibraryEntry) error {
+		if len(ent.TagSet) > 0 {
+			ntags = len(ent.TagSet)
+		}
+		for _, tv := range ent.TileVariants {
+			tags[tv.Tag] = true
+		}
+		cgs = append(cgs, ent.CompactGenomes...)
+		cseqs = append(cseqs, ent.CompactSequences...)
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(ntags, check.Equals, ntagsIn)
+	c.Check(len(tags) > 0, check.Equals, true)
+	c.Check(len(tags) < len(tagsIn), check.Equals, true)
+	c.Assert(cseqs, check.HasLen, 1)
+	c.Check(cseqs[0].TileSequences, check.HasLen, 1)
+	for _, tseq := range cseqs[0].TileSequences {
+		for _, libref := range tseq {
+			c.Check(tags[libref.Tag], check.Equals, true)
+		}
+	}
+	c.Assert(len(cgs) > 1, check.Equals, true)
+	for _, cg := range cgs {
+		c.Check(cg.EndTag > cg.StartTag, check.Equals, true)
+		c.Check(cg.Variants, check.HasLen, int(cg.EndTag-cg.StartTag)*2)
+		for i, v := range cg.Variants {
+			if v > 0 {
+				c.Check(tags[cg.StartTag+tagID(i/2)], check.Equals, true)
+			}
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/arvados/lightning/go-lightning/libio"
+	log "github.com/sirupsen/logrus"
+)
+
+// extractSample writes a minimal library containing a single
+// genome: the tag set, the reference sequences, the named sample's
+// CompactGenome, and only the tile variants referenced by those.
+type extractSample struct{}
+
+func (cmd *extractSample) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
+	inputFilename := flags.String("i", "-", "input library `file`, or directory containing the output of a single import or slice")
+	outputFilename := flags.String("o", "-", "output library `file` (gzip-compressed if name ends in .gz)")
+	name := flags.String("name", "", "`name` of sample to extract")
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	} else if *name == "" {
+		err = errors.New("-name argument is required")
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		if *outputFilename != "-" {
+			err = errors.New("cannot specify output file in container mode: not implemented")
+			return 1
+		}
+		runner := arvadosContainerRunner{
+			Name:        "lightning extract-sample",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         16000000000,
+			VCPUs:       2,
+			Priority:    *priority,
+		}
+		containerOpts.Apply(&runner, stdout)
+		err = runner.TranslatePaths(inputFilename)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"extract-sample", "-local=true", fmt.Sprintf("-pprof=%v", *pprof), "-i", *inputFilename, "-o", "/mnt/output/library.gob.gz", "-name", *name}
+		var output string
+		output, err = runner.Run()
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output+"/library.gob.gz")
+		return 0
+	}
+
+	infiles, err := allFiles(*inputFilename, matchGobFile)
+	if err != nil {
+		return 1
+	} else if len(infiles) == 0 {
+		err = fmt.Errorf("no input files found in %s", *inputFilename)
+		return 1
+	}
+	err = checkTagSets(infiles)
+	if err != nil {
+		return 1
+	}
+
+	var output io.WriteCloser
+	if *outputFilename == "-" {
+		output = nopCloser{stdout}
+	} else {
+		output, err = os.OpenFile(*outputFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+		if err != nil {
+			return 1
+		}
+		defer output.Close()
+	}
+	err = extractSampleLibrary(infiles, *name, output, strings.HasSuffix(*outputFilename, ".gz"))
+	if err != nil {
+		return 1
+	}
+	err = output.Close()
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// extractSampleLibrary reads the given library files twice: first to
+// collect the tag set, reference sequences, and the named genome
+// (which may be split across several files by "slice"), then to
+// collect the tile variants they reference. It writes the result to
+// w as a single library.
+func extractSampleLibrary(infiles []string, name string, w io.Writer, gz bool) error {
+	var tagset [][]byte
+	var cseqs []CompactSequence
+	var parts []CompactGenome
+	seenCseq := map[string]bool{}
+	for _, infile := range infiles {
+		err := decodeLibraryFile(infile, func(ent *LibraryEntry) error {
+			if len(ent.TagSet) > 0 && tagset == nil {
+				tagset = ent.TagSet
+			}
+			for _, cseq := range ent.CompactSequences {
+				if !seenCseq[cseq.Name] {
+					seenCseq[cseq.Name] = true
+					cseqs = append(cseqs, cseq)
+				}
+			}
+			for _, cg := range ent.CompactGenomes {
+				if cg.Name == name {
+					parts = append(parts, cg)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(parts) == 0 {
+		return fmt.Errorf("sample %q not found in %v", name, infiles)
+	}
+	cg := mergeCompactGenomes(parts)
+
+	want := map[tileLibRef]bool{}
+	for i, v := range cg.Variants {
+		if v > 0 {
+			want[tileLibRef{Tag: cg.StartTag + tagID(i/2), Variant: v}] = true
+		}
+	}
+	for _, cseq := range cseqs {
+		for _, tseq := range cseq.TileSequences {
+			for _, libref := range tseq {
+				if libref.Variant > 0 {
+					want[libref] = true
+				}
+			}
+		}
+	}
+
+	var tvs []TileVariant
+	found := map[tileLibRef]bool{}
+	for _, infile := range infiles {
+		err := decodeLibraryFile(infile, func(ent *LibraryEntry) error {
+			for _, tv := range ent.TileVariants {
+				libref := tileLibRef{Tag: tv.Tag, Variant: tv.Variant}
+				if want[libref] && !found[libref] {
+					found[libref] = true
+					tvs = append(tvs, tv)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(found) < len(want) {
+		log.Warnf("extract-sample: %d of %d referenced tile variants were not found in the input library", len(want)-len(found), len(want))
+	}
+	log.Infof("extract-sample: writing %d reference sequences and %d tile variants for sample %q", len(cseqs), len(tvs), name)
+
+	lw := libio.NewWriter(w, gz)
+	if tagset != nil {
+		if err := lw.WriteTagSet(tagset); err != nil {
+			return err
+		}
+	}
+	if len(tvs) > 0 {
+		if err := lw.WriteTileVariants(tvs); err != nil {
+			return err
+		}
+	}
+	if len(cseqs) > 0 {
+		if err := lw.WriteCompactSequences(cseqs); err != nil {
+			return err
+		}
+	}
+	if err := lw.WriteCompactGenomes([]CompactGenome{cg}); err != nil {
+		return err
+	}
+	return lw.Close()
+}
+
+// mergeCompactGenomes combines the parts of a genome that "slice"
+// split across multiple files (each covering StartTag..EndTag) into a
+// single CompactGenome. A single unsplit genome is returned as is.
+func mergeCompactGenomes(parts []CompactGenome) CompactGenome {
+	if len(parts) == 1 && parts[0].StartTag == 0 {
+		return parts[0]
+	}
+	var end tagID
+	for _, cg := range parts {
+		if e := cg.StartTag + tagID(len(cg.Variants)/2); e > end {
+			end = e
+		}
+	}
+	merged := CompactGenome{
+		Name:     parts[0].Name,
+		Variants: make([]tileVariantID, end*2),
+		EndTag:   end,
+	}
+	for _, cg := range parts {
+		copy(merged.Variants[cg.StartTag*2:], cg.Variants)
+	}
+	return merged
+}
+
+func decodeLibraryFile(fnm string, cb func(*LibraryEntry) error) error {
+	f, err := open(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return DecodeLibrary(bufio.NewReaderSize(f, 64*1024*1024), strings.HasSuffix(fnm, ".gz"), cb)
+}
@@ -0,0 +1,84 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type extractSampleSuite struct{}
+
+var _ = check.Suite(&extractSampleSuite{})
+
+func (s *extractSampleSuite) TestExtractSample(c *check.C) {
+	tmpdir := c.MkDir()
+	exited := (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-output-tiles",
+		"-save-incomplete-tiles",
+		"-o", tmpdir + "/library.gob",
+		"testdata/ref.fasta",
+		"testdata/pipeline1",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	var names []string
+	ntvIn := 0
+	err := decodeLibraryFile(tmpdir+"/library.gob", func(ent *LibraryEntry) error {
+		for _, cg := range ent.CompactGenomes {
+			names = append(names, cg.Name)
+		}
+		ntvIn += len(ent.TileVariants)
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(len(names) > 1, check.Equals, true)
+
+	exited = (&extractSample{}).RunCommand("extract-sample", []string{
+		"-local=true",
+		"-i", tmpdir + "/library.gob",
+		"-o", tmpdir + "/sample.gob.gz",
+		"-name", names[0],
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	var tagset [][]byte
+	var cgs []CompactGenome
+	var cseqs []CompactSequence
+	have := map[tileLibRef]bool{}
+	err = decodeLibraryFile(tmpdir+"/sample.gob.gz", func(ent *LibraryEntry) error {
+		if len(ent.TagSet) > 0 {
+			tagset = ent.TagSet
+		}
+		cgs = append(cgs, ent.CompactGenomes...)
+		cseqs = append(cseqs, ent.CompactSequences...)
+		for _, tv := range ent.TileVariants {
+			have[tileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = true
+		}
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(tagset, check.Not(check.HasLen), 0)
+	c.Check(cseqs, check.Not(check.HasLen), 0)
+	c.Assert(cgs, check.HasLen, 1)
+	c.Check(cgs[0].Name, check.Equals, names[0])
+	for i, v := range cgs[0].Variants {
+		if v > 0 {
+			c.Check(have[tileLibRef{Tag: tagID(i / 2), Variant: v}], check.Equals, true)
+		}
+	}
+	c.Check(len(have) < ntvIn, check.Equals, true)
+
+	exited = (&extractSample{}).RunCommand("extract-sample", []string{
+		"-local=true",
+		"-i", tmpdir + "/library.gob",
+		"-o", tmpdir + "/nonexistent.gob",
+		"-name", "nonexistent",
+	}, nil, os.Stderr, os.Stderr)
+	c.Check(exited, check.Equals, 1)
+}
@@ -0,0 +1,179 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sortLinesExternal copies the lines of infile to outfile, sorted by
+// the given comparison function, using temporary files named
+// {tmpprefix}{N} to hold sorted runs so that no more than
+// approximately maxBytes of input is held in memory at a time. The
+// sort is stable.
+func sortLinesExternal(infile, outfile, tmpprefix string, maxBytes int, less func(a, b []byte) bool) error {
+	in, err := os.Open(infile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	scanner := bufio.NewScanner(bufio.NewReaderSize(in, 1<<20))
+	scanner.Buffer(nil, 64*1024*1024)
+
+	var runs []string
+	defer func() {
+		for _, fnm := range runs {
+			os.Remove(fnm)
+		}
+	}()
+	var lines [][]byte
+	size := 0
+	flush := func() error {
+		sort.SliceStable(lines, func(i, j int) bool { return less(lines[i], lines[j]) })
+		fnm := fmt.Sprintf("%s%d", tmpprefix, len(runs))
+		runs = append(runs, fnm)
+		err := writeLines(fnm, lines)
+		lines, size = nil, 0
+		return err
+	}
+	for scanner.Scan() {
+		line := append([]byte(nil), scanner.Bytes()...)
+		lines = append(lines, line)
+		size += len(line)
+		if size >= maxBytes {
+			err = flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		// everything fit in memory
+		sort.SliceStable(lines, func(i, j int) bool { return less(lines[i], lines[j]) })
+		return writeLines(outfile, lines)
+	}
+	if len(lines) > 0 {
+		err = flush()
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("sortLinesExternal: merging %d sorted runs into %s", len(runs), outfile)
+	return mergeSortedRuns(runs, outfile, less)
+}
+
+func writeLines(fnm string, lines [][]byte) error {
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriterSize(f, 1<<20)
+	for _, line := range lines {
+		bufw.Write(line)
+		bufw.WriteByte('\n')
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// mergeSortedRuns merges the given files, each already sorted, into
+// outfile. Where lines compare equal, lines from earlier runs come
+// first.
+func mergeSortedRuns(runs []string, outfile string, less func(a, b []byte) bool) error {
+	out, err := os.Create(outfile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	bufw := bufio.NewWriterSize(out, 1<<20)
+	h := &runHeap{less: less}
+	for i, fnm := range runs {
+		f, err := os.Open(fnm)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(bufio.NewReaderSize(f, 1<<20))
+		scanner.Buffer(nil, 64*1024*1024)
+		r := &runReader{idx: i, scanner: scanner}
+		if err = r.next(); err == io.EOF {
+			continue
+		} else if err != nil {
+			return err
+		}
+		h.runs = append(h.runs, r)
+	}
+	heap.Init(h)
+	for h.Len() > 0 {
+		r := h.runs[0]
+		bufw.Write(r.line)
+		bufw.WriteByte('\n')
+		if err = r.next(); err == io.EOF {
+			heap.Pop(h)
+		} else if err != nil {
+			return err
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+type runReader struct {
+	idx     int
+	scanner *bufio.Scanner
+	line    []byte
+}
+
+func (r *runReader) next() error {
+	if r.scanner.Scan() {
+		r.line = r.scanner.Bytes()
+		return nil
+	} else if err := r.scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+type runHeap struct {
+	runs []*runReader
+	less func(a, b []byte) bool
+}
+
+func (h *runHeap) Len() int { return len(h.runs) }
+func (h *runHeap) Less(i, j int) bool {
+	a, b := h.runs[i], h.runs[j]
+	if h.less(a.line, b.line) {
+		return true
+	} else if h.less(b.line, a.line) {
+		return false
+	}
+	return a.idx < b.idx
+}
+func (h *runHeap) Swap(i, j int)      { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+func (h *runHeap) Push(x interface{}) { h.runs = append(h.runs, x.(*runReader)) }
+func (h *runHeap) Pop() interface{} {
+	r := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return r
+}
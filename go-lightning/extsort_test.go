@@ -0,0 +1,79 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type extSortSuite struct{}
+
+var _ = check.Suite(&extSortSuite{})
+
+func (s *extSortSuite) TestSortLinesExternal(c *check.C) {
+	tmpdir := c.MkDir()
+	var in, expect []string
+	for i := 0; i < 100; i++ {
+		// key is i%7, value is i: equal keys must stay in
+		// input order
+		in = append(in, fmt.Sprintf("%d,%03d", (i*3)%7, i))
+	}
+	for k := 0; k < 7; k++ {
+		for _, line := range in {
+			if line[0] == byte('0'+k) {
+				expect = append(expect, line)
+			}
+		}
+	}
+	err := os.WriteFile(tmpdir+"/in", []byte(strings.Join(in, "\n")+"\n"), 0666)
+	c.Assert(err, check.IsNil)
+	less := func(a, b []byte) bool { return a[0] < b[0] }
+	for _, maxBytes := range []int{1 << 20, 100, 1} {
+		err = sortLinesExternal(tmpdir+"/in", tmpdir+"/out", tmpdir+"/tmp.", maxBytes, less)
+		c.Assert(err, check.IsNil)
+		buf, err := os.ReadFile(tmpdir + "/out")
+		c.Assert(err, check.IsNil)
+		c.Check(strings.Split(string(bytes.TrimSuffix(buf, []byte{'\n'})), "\n"), check.DeepEquals, expect, check.Commentf("maxBytes=%d", maxBytes))
+		tmpfiles, err := filepath.Glob(tmpdir + "/tmp.*")
+		c.Check(err, check.IsNil)
+		c.Check(tmpfiles, check.HasLen, 0)
+	}
+}
+
+func (s *extSortSuite) TestWriteSortedAnnotations(c *check.C) {
+	tmpdir := c.MkDir()
+	err := os.WriteFile(tmpdir+"/matrix.annotations.csv", []byte(`5,0,2,chr2:g.10A>G,chr2,10,A,G,
+5,0,3,chr2:g.5C>T,chr2,5,C,T,
+6,1,2,chrX:g.1A>G,chrX,1,A,G,
+7,2,2,chr10:g.7A>G,chr10,7,A,G,
+8,3,2,chr1:g.7A>G,chr1,7,A,G,
+9,4,2,chr1:g.7A>C,chr1,7,A,C,
+`), 0666)
+	c.Assert(err, check.IsNil)
+	tilePos := []tilePosition{
+		{seqname: "chr2", pos: 1, ok: true},
+		{seqname: "chrX", pos: 1, ok: true},
+		{seqname: "chr10", pos: 1, ok: true},
+		{seqname: "chr1", pos: 5, ok: true},
+		{},
+	}
+	err = writeSortedAnnotations(tmpdir, tmpdir, tilePos)
+	c.Assert(err, check.IsNil)
+	buf, err := os.ReadFile(tmpdir + "/matrix.sorted.annotations.csv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, `8,3,2,chr1:g.7A>G,chr1,7,A,G,
+9,4,2,chr1:g.7A>C,chr1,7,A,C,
+5,0,3,chr2:g.5C>T,chr2,5,C,T,
+5,0,2,chr2:g.10A>G,chr2,10,A,G,
+7,2,2,chr10:g.7A>G,chr10,7,A,G,
+6,1,2,chrX:g.1A>G,chrX,1,A,G,
+`)
+}
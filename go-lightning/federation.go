@@ -0,0 +1,97 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"fmt"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	log "github.com/sirupsen/logrus"
+)
+
+// Property used to identify local proxy collections created by
+// proxyRemoteCollection.
+const remoteSourceProperty = "lightning_remote_source"
+
+// federationInfo is the part of the API discovery document that
+// describes the local cluster's federation.
+type federationInfo struct {
+	UUIDPrefix  string            `json:"uuidPrefix"`
+	RemoteHosts map[string]string `json:"remoteHosts"`
+}
+
+// remoteCluster returns the ID of the remote cluster that owns the
+// given collection UUID, or "" if the UUID belongs to the local
+// cluster (or is a portable data hash, which is looked up across
+// the federation by the API server itself).
+func (runner *arvadosContainerRunner) remoteCluster(collID string) (string, error) {
+	if len(collID) != 27 || runner.Client == nil {
+		return "", nil
+	}
+	if runner.federation == nil {
+		var fi federationInfo
+		err := runner.Client.RequestAndDecode(&fi, "GET", "discovery/v1/apis/arvados/v1/rest", nil, nil)
+		if err != nil {
+			return "", fmt.Errorf("error getting cluster ID from discovery document: %w", err)
+		}
+		runner.federation = &fi
+	}
+	cluster := collID[:5]
+	if cluster == runner.federation.UUIDPrefix {
+		return "", nil
+	}
+	if _, ok := runner.federation.RemoteHosts[cluster]; !ok {
+		return "", fmt.Errorf("collection %s belongs to cluster %s, which is not a configured remote cluster of %s", collID, cluster, runner.federation.UUIDPrefix)
+	}
+	return cluster, nil
+}
+
+// proxyRemoteCollection returns the UUID of a local collection with
+// the same content as the given collection on a federated remote
+// cluster, creating one in runner.ProjectUUID if needed. Only the
+// manifest is copied: its block locators carry remote signatures,
+// so Keep fetches the data from the remote cluster when the
+// container reads it.
+func (runner *arvadosContainerRunner) proxyRemoteCollection(remoteUUID string) (string, error) {
+	var remote arvados.Collection
+	err := runner.Client.RequestAndDecode(&remote, "GET", "arvados/v1/collections/"+remoteUUID, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("error getting remote collection %s: %w", remoteUUID, err)
+	}
+	var existing arvados.CollectionList
+	err = runner.Client.RequestAndDecode(&existing, "GET", "arvados/v1/collections", nil, arvados.ListOptions{
+		Limit: 1,
+		Count: "none",
+		Filters: []arvados.Filter{
+			{Attr: "owner_uuid", Operator: "=", Operand: runner.ProjectUUID},
+			{Attr: "portable_data_hash", Operator: "=", Operand: remote.PortableDataHash},
+			{Attr: "properties." + remoteSourceProperty, Operator: "=", Operand: remoteUUID},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(existing.Items) > 0 {
+		log.Printf("using existing local collection %s for remote collection %s", existing.Items[0].UUID, remoteUUID)
+		return existing.Items[0].UUID, nil
+	}
+	var local arvados.Collection
+	err = runner.Client.RequestAndDecode(&local, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"ensure_unique_name": true,
+		"collection": map[string]interface{}{
+			"owner_uuid":    runner.ProjectUUID,
+			"name":          fmt.Sprintf("lightning input from %s", remoteUUID),
+			"manifest_text": remote.ManifestText,
+			"properties": map[string]interface{}{
+				remoteSourceProperty: remoteUUID,
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error creating local collection for remote collection %s: %w", remoteUUID, err)
+	}
+	log.Printf("created local collection %s for remote collection %s (%s)", local.UUID, remoteUUID, remote.PortableDataHash)
+	return local.UUID, nil
+}
@@ -0,0 +1,221 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	log "github.com/sirupsen/logrus"
+)
+
+// fetchOutput downloads the output (and optionally the logs) of a
+// finished container request to a local directory.
+type fetchOutput struct{}
+
+func (cmd *fetchOutput) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s [options] container-request-uuid destination-dir\n", prog)
+		flags.PrintDefaults()
+	}
+	withLogs := flags.Bool("logs", false, "also download container logs (to destination-dir/log)")
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	uuid, dst := flags.Arg(0), flags.Arg(1)
+
+	var cr arvados.ContainerRequest
+	err = arvadosClientFromEnv.RequestAndDecode(&cr, "GET", "arvados/v1/container_requests/"+uuid, nil, nil)
+	if err != nil {
+		return 1
+	}
+	if cr.State != arvados.ContainerRequestStateFinal {
+		err = fmt.Errorf("container request %s is not finished (state is %s)", uuid, cr.State)
+		return 1
+	} else if cr.OutputUUID == "" {
+		err = fmt.Errorf("container request %s has no output collection", uuid)
+		return 1
+	}
+	fs, err := collectionFS(arvadosClientFromEnv, cr.OutputUUID)
+	if err != nil {
+		return 1
+	}
+	log.Printf("downloading output collection %s to %s", cr.OutputUUID, dst)
+	err = copyCollectionFiles(fs, dst)
+	if err != nil {
+		return 1
+	}
+	if *withLogs {
+		if cr.LogUUID == "" {
+			err = fmt.Errorf("container request %s has no log collection", uuid)
+			return 1
+		}
+		fs, err = collectionFS(arvadosClientFromEnv, cr.LogUUID)
+		if err != nil {
+			return 1
+		}
+		log.Printf("downloading log collection %s to %s", cr.LogUUID, filepath.Join(dst, "log"))
+		err = copyCollectionFiles(fs, filepath.Join(dst, "log"))
+		if err != nil {
+			return 1
+		}
+	}
+	fmt.Fprintln(stdout, dst)
+	return 0
+}
+
+// collectionFS returns a filesystem for reading the given collection.
+func collectionFS(client *arvados.Client, uuid string) (arvados.CollectionFileSystem, error) {
+	var coll arvados.Collection
+	err := client.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+uuid, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	ac, err := arvadosclient.New(client)
+	if err != nil {
+		return nil, err
+	}
+	kc := keepclient.New(ac)
+	return coll.FileSystem(client, kc)
+}
+
+// walkCollection calls fn for each regular file in fs, in lexical
+// order. The path passed to fn is relative to the top level of fs.
+func walkCollection(fs http.FileSystem, fn func(path string, fi os.FileInfo) error) error {
+	return walkCollectionDir(fs, ".", fn)
+}
+
+func walkCollectionDir(fs http.FileSystem, dir string, fn func(path string, fi os.FileInfo) error) error {
+	f, err := fs.Open(dir)
+	if err != nil {
+		return err
+	}
+	fis, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %w", dir, err)
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	for _, fi := range fis {
+		fpath := path.Join(dir, fi.Name())
+		if fi.IsDir() {
+			err = walkCollectionDir(fs, fpath, fn)
+		} else {
+			err = fn(fpath, fi)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyCollectionFiles copies all files in fs to the local directory
+// dst, creating dst and subdirectories as needed.
+func copyCollectionFiles(fs http.FileSystem, dst string) error {
+	return walkCollection(fs, func(fpath string, fi os.FileInfo) error {
+		outfnm := filepath.Join(dst, filepath.FromSlash(fpath))
+		err := os.MkdirAll(filepath.Dir(outfnm), 0777)
+		if err != nil {
+			return err
+		}
+		in, err := fs.Open(fpath)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.Create(outfnm)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		n, err := io.Copy(out, in)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fpath, err)
+		} else if n != fi.Size() {
+			return fmt.Errorf("%s: copied %d bytes, expected %d", fpath, n, fi.Size())
+		}
+		return out.Close()
+	})
+}
+
+// writeCollectionListing writes one line for each file in fs,
+// giving its size and path.
+func writeCollectionListing(w io.Writer, fs http.FileSystem) error {
+	return walkCollection(fs, func(fpath string, fi os.FileInfo) error {
+		_, err := fmt.Fprintf(w, "%d %s\n", fi.Size(), fpath)
+		return err
+	})
+}
+
+// saveLogs copies the log collection of a finished container request,
+// and a listing of its output collection, to a subdirectory of
+// runner.LogDir named after the container request UUID.
+func (runner *arvadosContainerRunner) saveLogs(cr arvados.ContainerRequest) error {
+	dir := filepath.Join(runner.LogDir, cr.UUID)
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return err
+	}
+	if cr.LogUUID == "" {
+		return errors.New("container request has no log collection")
+	}
+	fs, err := collectionFS(runner.Client, cr.LogUUID)
+	if err != nil {
+		return err
+	}
+	err = copyCollectionFiles(fs, filepath.Join(dir, "log"))
+	if err != nil {
+		return err
+	}
+	if cr.OutputUUID == "" {
+		log.Printf("saved container logs in %s", dir)
+		return nil
+	}
+	fs, err = collectionFS(runner.Client, cr.OutputUUID)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, "output.txt"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = writeCollectionListing(f, fs)
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	log.Printf("saved container logs and output listing in %s", dir)
+	return nil
+}
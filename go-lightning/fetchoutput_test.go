@@ -0,0 +1,53 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type fetchOutputSuite struct{}
+
+var _ = check.Suite(&fetchOutputSuite{})
+
+func (s *fetchOutputSuite) TestCopyCollectionFiles(c *check.C) {
+	src := c.MkDir()
+	err := os.MkdirAll(src+"/sub/dir", 0777)
+	c.Assert(err, check.IsNil)
+	for fnm, data := range map[string]string{
+		"stderr.txt":      "hello\n",
+		"sub/dir/foo.csv": "a,b\n1,2\n",
+		"sub/empty":       "",
+	} {
+		err = ioutil.WriteFile(src+"/"+fnm, []byte(data), 0666)
+		c.Assert(err, check.IsNil)
+	}
+
+	var listing bytes.Buffer
+	err = writeCollectionListing(&listing, http.Dir(src))
+	c.Assert(err, check.IsNil)
+	c.Check(listing.String(), check.Equals, `6 stderr.txt
+8 sub/dir/foo.csv
+0 sub/empty
+`)
+
+	dst := c.MkDir() + "/fetched"
+	err = copyCollectionFiles(http.Dir(src), dst)
+	c.Assert(err, check.IsNil)
+	buf, err := ioutil.ReadFile(dst + "/sub/dir/foo.csv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "a,b\n1,2\n")
+	buf, err = ioutil.ReadFile(dst + "/stderr.txt")
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "hello\n")
+	fi, err := os.Stat(dst + "/sub/empty")
+	c.Assert(err, check.IsNil)
+	c.Check(fi.Size(), check.Equals, int64(0))
+}
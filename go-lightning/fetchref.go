@@ -0,0 +1,458 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/pgzip"
+	log "github.com/sirupsen/logrus"
+)
+
+// refPresets are well-known reference builds that can be fetched
+// by name.
+var refPresets = map[string]string{
+	"hg19":                "https://hgdownload.soe.ucsc.edu/goldenPath/hg19/bigZips/hg19.fa.gz",
+	"hg38":                "https://hgdownload.soe.ucsc.edu/goldenPath/hg38/bigZips/hg38.fa.gz",
+	"grch38-analysis-set": "https://ftp.ncbi.nlm.nih.gov/genomes/all/GCA/000/001/405/GCA_000001405.15_GRCh38/seqs_for_alignment_pipelines.ucsc_ids/GCA_000001405.15_GRCh38_no_alt_analysis_set.fna.gz",
+}
+
+const fetchRefLineWidth = 60
+
+// fetchRef downloads a reference genome, normalizes contig names,
+// verifies checksums, and writes an uncompressed fasta file with a
+// samtools-compatible .fai index, a .md5 file listing the MD5 digest
+// of each contig (as in the M5 tag of a SAM @SQ header), and a
+// .source file listing the SHA-256 and MD5 digests of the downloaded
+// file.
+type fetchRef struct {
+	chrPrefix string
+	match     *regexp.Regexp
+}
+
+func (cmd *fetchRef) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		var presets []string
+		for name := range refPresets {
+			presets = append(presets, name)
+		}
+		sort.Strings(presets)
+		fmt.Fprintf(flags.Output(), "usage: %s [options] {preset|url|file}\n\npresets: %s\n\noptions:\n", prog, strings.Join(presets, ", "))
+		flags.PrintDefaults()
+	}
+	outputDir := flags.String("output-dir", defaultRefDir(), "store reference in `directory`")
+	outputName := flags.String("o", "", "output fasta `filename` in output-dir (default: preset name, or base name of url without .gz)")
+	flags.StringVar(&cmd.chrPrefix, "chr-prefix", "add", "`add`, remove, or keep \"chr\" prefix on contig names")
+	matchChromosome := flags.String("match-chromosome", ".*", "only keep contigs whose names (after adding/removing chr prefix) match the given `regexp`")
+	sha256sum := flags.String("sha256", "", "verify SHA-256 `digest` of downloaded file")
+	md5sum := flags.String("md5", "", "verify MD5 `digest` of downloaded file")
+	contigMD5 := flags.String("contig-md5", "", "verify contig sequences using MD5 digests listed in `file` (one \"name digest\" pair per line)")
+	force := flags.Bool("force", false, "download again even if the output file already exists")
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	switch cmd.chrPrefix {
+	case "add", "remove", "keep":
+	default:
+		err = fmt.Errorf("invalid -chr-prefix %q: must be add, remove, or keep", cmd.chrPrefix)
+		return 2
+	}
+	cmd.match, err = regexp.Compile(*matchChromosome)
+	if err != nil {
+		return 2
+	}
+	src := flags.Arg(0)
+	name := *outputName
+	if preset, ok := refPresets[src]; ok {
+		if name == "" {
+			name = src + ".fa"
+		}
+		src = preset
+	} else if name == "" {
+		name = strings.TrimSuffix(filepath.Base(src), ".gz")
+	}
+	var want map[string]string
+	if *contigMD5 != "" {
+		want, err = readContigMD5(*contigMD5, cmd.normalizeName)
+		if err != nil {
+			return 1
+		}
+		for name := range want {
+			if !cmd.match.MatchString(name) {
+				delete(want, name)
+			}
+		}
+	}
+
+	err = os.MkdirAll(*outputDir, 0777)
+	if err != nil {
+		return 1
+	}
+	outfnm := filepath.Join(*outputDir, name)
+	hashes := []fileHash{
+		{"SHA-256", sha256.New(), *sha256sum},
+		{"MD5", md5.New(), *md5sum},
+	}
+	if !*force {
+		if digests, e := existingRef(outfnm, hashes); e == nil {
+			log.Printf("%s already exists, verifying checksums (use -force to download again)", outfnm)
+			err = checkContigMD5(want, digests)
+			if err != nil {
+				return 1
+			}
+			fmt.Fprintln(stdout, outfnm)
+			return 0
+		} else if !os.IsNotExist(e) {
+			log.Printf("%s: %s, downloading again", outfnm, e)
+		}
+	}
+
+	digests, err := cmd.fetch(src, outfnm, hashes)
+	if err != nil {
+		return 1
+	}
+	err = checkContigMD5(want, digests)
+	if err != nil {
+		os.Remove(outfnm + ".md5")
+		return 1
+	}
+	fmt.Fprintln(stdout, outfnm)
+	return 0
+}
+
+// defaultRefDir returns $LIGHTNING_REF_DIR if set, otherwise
+// ~/.cache/lightning/ref.
+func defaultRefDir() string {
+	if dir := os.Getenv("LIGHTNING_REF_DIR"); dir != "" {
+		return dir
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "lightning", "ref")
+	}
+	return "."
+}
+
+// fileHash computes a digest of the downloaded file, and (if expect
+// is not empty) verifies it.
+type fileHash struct {
+	label  string
+	hash   hash.Hash
+	expect string
+}
+
+// existingRef returns the contig digests of a previously fetched
+// reference, or an error if the fasta file or its index is missing,
+// or the previously downloaded file does not match the expected
+// digests in hashes.
+func existingRef(outfnm string, hashes []fileHash) (map[string]string, error) {
+	digests, err := readContigMD5(outfnm+".md5", nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, fnm := range []string{outfnm, outfnm + ".fai"} {
+		_, err = os.Stat(fnm)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sums, err := readContigMD5(outfnm+".source", nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hashes {
+		if h.expect != "" && !strings.EqualFold(sums[h.label], h.expect) {
+			return nil, fmt.Errorf("%s digest of previously downloaded file is %q, expected %s", h.label, sums[h.label], h.expect)
+		}
+	}
+	return digests, nil
+}
+
+// normalizeName applies the -chr-prefix option to a contig name.
+func (cmd *fetchRef) normalizeName(name string) string {
+	switch cmd.chrPrefix {
+	case "add":
+		if !strings.HasPrefix(name, "chr") {
+			if name == "MT" {
+				name = "M"
+			}
+			name = "chr" + name
+		}
+	case "remove":
+		name = strings.TrimPrefix(name, "chr")
+		if name == "M" {
+			name = "MT"
+		}
+	}
+	return name
+}
+
+// fetch downloads src (a URL or local file), writes the normalized
+// fasta file, index, and digests, and returns the digest of each
+// contig. It returns an error if the downloaded file does not match
+// the expected digests in hashes.
+func (cmd *fetchRef) fetch(src, outfnm string, hashes []fileHash) (map[string]string, error) {
+	var rdr io.ReadCloser
+	if strings.Contains(src, "://") {
+		log.Printf("downloading %s", src)
+		resp, err := http.Get(src)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s: %s", src, resp.Status)
+		}
+		rdr = resp.Body
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		rdr = f
+	}
+	defer rdr.Close()
+	var in io.Reader = rdr
+	for _, h := range hashes {
+		in = io.TeeReader(in, h.hash)
+	}
+	bufin := bufio.NewReaderSize(in, 1<<20)
+	if magic, _ := bufin.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := pgzip.NewReader(bufin)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		in = gz
+	} else {
+		in = bufin
+	}
+
+	// Write to temp files and rename after verifying, so a
+	// failed download doesn't leave a file that looks complete.
+	tmpfnm := outfnm + ".tmp"
+	outf, err := os.OpenFile(tmpfnm, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpfnm)
+	defer outf.Close()
+	fai, digests, err := cmd.normalize(in, outf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", src, err)
+	}
+	// Read any remaining data (e.g., a trailer after the gzip
+	// stream) so the file digests cover the whole file.
+	_, err = io.Copy(io.Discard, bufin)
+	if err != nil {
+		return nil, err
+	}
+	sums := map[string]string{}
+	for _, h := range hashes {
+		got := hex.EncodeToString(h.hash.Sum(nil))
+		if h.expect != "" && !strings.EqualFold(got, h.expect) {
+			return nil, fmt.Errorf("%s: %s digest mismatch: expected %s, got %s", src, h.label, h.expect, got)
+		}
+		sums[h.label] = got
+	}
+	if len(digests) == 0 {
+		return nil, fmt.Errorf("%s: no contigs match -match-chromosome regexp %q", src, cmd.match)
+	}
+	err = outf.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(outfnm+".fai", fai, 0666)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(tmpfnm, outfnm)
+	if err != nil {
+		return nil, err
+	}
+	// The .md5 file is written last: existingRef treats it as a
+	// sign that the previous download completed.
+	err = writeContigMD5(outfnm+".source", sums)
+	if err != nil {
+		return nil, err
+	}
+	err = writeContigMD5(outfnm+".md5", digests)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("wrote %s (%d contigs)", outfnm, len(digests))
+	return digests, nil
+}
+
+// normalize copies fasta data from in to out, renaming contigs,
+// skipping contigs that don't match cmd.match, and wrapping lines at
+// fetchRefLineWidth bases. It returns the .fai index data and the
+// MD5 digest of each contig's (uppercase) sequence.
+func (cmd *fetchRef) normalize(in io.Reader, out io.Writer) ([]byte, map[string]string, error) {
+	bufw := bufio.NewWriterSize(out, 1<<20)
+	var fai bytes.Buffer
+	digests := map[string]string{}
+	var offset int64
+	var name string
+	var keep bool
+	var seqlen int64
+	var seqoffset int64
+	var linepos int
+	h := md5.New()
+	write := func(p []byte) {
+		n, _ := bufw.Write(p)
+		offset += int64(n)
+	}
+	finish := func() {
+		if !keep {
+			return
+		}
+		if linepos > 0 {
+			write([]byte{'\n'})
+			linepos = 0
+		}
+		fmt.Fprintf(&fai, "%s\t%d\t%d\t%d\t%d\n", name, seqlen, seqoffset, fetchRefLineWidth, fetchRefLineWidth+1)
+		digests[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 1<<20), 1<<30)
+	for scanner.Scan() {
+		line := bytes.TrimRight(scanner.Bytes(), "\r")
+		if len(line) > 0 && line[0] == '>' {
+			finish()
+			fields := strings.Fields(string(line[1:]))
+			if len(fields) == 0 {
+				return nil, nil, errors.New("fasta header with no contig name")
+			}
+			name = cmd.normalizeName(fields[0])
+			if _, dup := digests[name]; dup {
+				return nil, nil, fmt.Errorf("duplicate contig name %q", name)
+			}
+			keep = cmd.match.MatchString(name)
+			if !keep {
+				continue
+			}
+			write([]byte(">" + name + "\n"))
+			seqoffset = offset
+			seqlen = 0
+			h.Reset()
+			continue
+		}
+		if !keep {
+			continue
+		}
+		line = bytes.ToUpper(line)
+		h.Write(line)
+		seqlen += int64(len(line))
+		for len(line) > 0 {
+			n := fetchRefLineWidth - linepos
+			if n > len(line) {
+				n = len(line)
+			}
+			write(line[:n])
+			line = line[n:]
+			linepos += n
+			if linepos == fetchRefLineWidth {
+				write([]byte{'\n'})
+				linepos = 0
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	finish()
+	if err := bufw.Flush(); err != nil {
+		return nil, nil, err
+	}
+	return fai.Bytes(), digests, nil
+}
+
+// readContigMD5 reads "name digest" pairs from the given file. If
+// normalize is not nil, it is applied to each name.
+func readContigMD5(fnm string, normalize func(string) string) (map[string]string, error) {
+	buf, err := os.ReadFile(fnm)
+	if err != nil {
+		return nil, err
+	}
+	digests := map[string]string{}
+	for i, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		} else if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: line %d: expected \"name digest\"", fnm, i+1)
+		}
+		name := fields[0]
+		if normalize != nil {
+			name = normalize(name)
+		}
+		digests[name] = strings.ToLower(fields[1])
+	}
+	return digests, nil
+}
+
+// writeContigMD5 writes "name digest" pairs to the given file, sorted
+// by name. It is also used for the .source file, where the names are
+// digest algorithms.
+func writeContigMD5(fnm string, digests map[string]string) error {
+	names := make([]string, 0, len(digests))
+	for name := range digests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s\t%s\n", name, digests[name])
+	}
+	return os.WriteFile(fnm, buf.Bytes(), 0666)
+}
+
+// checkContigMD5 returns an error if any of the wanted digests are
+// missing or different in got.
+func checkContigMD5(want, got map[string]string) error {
+	var problems []string
+	for name, digest := range want {
+		if g, ok := got[name]; !ok {
+			problems = append(problems, fmt.Sprintf("contig %s: missing", name))
+		} else if g != digest {
+			problems = append(problems, fmt.Sprintf("contig %s: MD5 mismatch: expected %s, got %s", name, digest, g))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return errors.New(strings.Join(problems, "\n"))
+}
@@ -0,0 +1,137 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type fetchRefSuite struct{}
+
+var _ = check.Suite(&fetchRefSuite{})
+
+const fetchRefTestFasta = ">1 first contig\nacgtacgt\nAC\n>2\nGGGG\n>MT\nTT\n>GL000192.1\nNNNN\n"
+
+func (s *fetchRefSuite) TestFetch(c *check.C) {
+	var gzbuf bytes.Buffer
+	zw := gzip.NewWriter(&gzbuf)
+	zw.Write([]byte(fetchRefTestFasta))
+	zw.Close()
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(gzbuf.Bytes())
+	}))
+	defer srv.Close()
+
+	tmpdir := c.MkDir()
+	md5hex := func(seq string) string { return fmt.Sprintf("%x", md5.Sum([]byte(seq))) }
+	err := ioutil.WriteFile(tmpdir+"/contigs.md5", []byte("1\t"+md5hex("ACGTACGTAC")+"\nchr2 "+md5hex("GGGG")+"\n"), 0666)
+	c.Assert(err, check.IsNil)
+
+	var stdout bytes.Buffer
+	exited := (&fetchRef{}).RunCommand("lightning fetch-ref", []string{
+		"-output-dir=" + tmpdir,
+		"-match-chromosome=^chr([0-9]+|M)$",
+		"-contig-md5=" + tmpdir + "/contigs.md5",
+		fmt.Sprintf("-sha256=%x", sha256.Sum256(gzbuf.Bytes())),
+		srv.URL + "/test.fa.gz",
+	}, nil, &stdout, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	c.Check(stdout.String(), check.Equals, tmpdir+"/test.fa\n")
+	c.Check(requests, check.Equals, 1)
+
+	buf, err := ioutil.ReadFile(tmpdir + "/test.fa")
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, ">chr1\nACGTACGTAC\n>chr2\nGGGG\n>chrM\nTT\n")
+	buf, err = ioutil.ReadFile(tmpdir + "/test.fa.fai")
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "chr1\t10\t6\t60\t61\nchr2\t4\t23\t60\t61\nchrM\t2\t34\t60\t61\n")
+	buf, err = ioutil.ReadFile(tmpdir + "/test.fa.md5")
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "chr1\t"+md5hex("ACGTACGTAC")+"\nchr2\t"+md5hex("GGGG")+"\nchrM\t"+md5hex("TT")+"\n")
+
+	// already downloaded
+	stdout.Reset()
+	exited = (&fetchRef{}).RunCommand("lightning fetch-ref", []string{
+		"-output-dir=" + tmpdir,
+		"-contig-md5=" + tmpdir + "/contigs.md5",
+		srv.URL + "/test.fa.gz",
+	}, nil, &stdout, os.Stderr)
+	c.Check(exited, check.Equals, 0)
+	c.Check(requests, check.Equals, 1)
+	buf, err = ioutil.ReadFile(tmpdir + "/test.fa.source")
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, fmt.Sprintf("MD5\t%x\nSHA-256\t%x\n", md5.Sum(gzbuf.Bytes()), sha256.Sum256(gzbuf.Bytes())))
+
+	// already downloaded, and matches expected digest
+	exited = (&fetchRef{}).RunCommand("lightning fetch-ref", []string{
+		"-output-dir=" + tmpdir,
+		fmt.Sprintf("-md5=%x", md5.Sum(gzbuf.Bytes())),
+		srv.URL + "/test.fa.gz",
+	}, nil, &stdout, os.Stderr)
+	c.Check(exited, check.Equals, 0)
+	c.Check(requests, check.Equals, 1)
+
+	// already downloaded, but doesn't match expected digest, so
+	// download again (and fail)
+	var stderr bytes.Buffer
+	exited = (&fetchRef{}).RunCommand("lightning fetch-ref", []string{
+		"-output-dir=" + tmpdir,
+		"-md5=0000",
+		srv.URL + "/test.fa.gz",
+	}, nil, &stdout, &stderr)
+	c.Check(exited, check.Equals, 1)
+	c.Check(requests, check.Equals, 2)
+	c.Check(stderr.String(), check.Matches, `(?ms).*MD5 digest mismatch.*`)
+
+	// fasta file is missing, so download again
+	err = os.Remove(tmpdir + "/test.fa")
+	c.Assert(err, check.IsNil)
+	exited = (&fetchRef{}).RunCommand("lightning fetch-ref", []string{
+		"-output-dir=" + tmpdir,
+		srv.URL + "/test.fa.gz",
+	}, nil, &stdout, os.Stderr)
+	c.Check(exited, check.Equals, 0)
+	c.Check(requests, check.Equals, 3)
+	_, err = os.Stat(tmpdir + "/test.fa")
+	c.Check(err, check.IsNil)
+
+	// checksum mismatches
+	stderr.Reset()
+	exited = (&fetchRef{}).RunCommand("lightning fetch-ref", []string{
+		"-output-dir=" + tmpdir,
+		"-o=test2.fa",
+		"-sha256=0000",
+		srv.URL + "/test.fa.gz",
+	}, nil, &stdout, &stderr)
+	c.Check(exited, check.Equals, 1)
+	c.Check(stderr.String(), check.Matches, `(?ms).*SHA-256 digest mismatch.*`)
+	_, err = os.Stat(tmpdir + "/test2.fa")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	err = ioutil.WriteFile(tmpdir+"/contigs.md5", []byte("chr2 "+md5hex("GGGA")+"\n"), 0666)
+	c.Assert(err, check.IsNil)
+	stderr.Reset()
+	exited = (&fetchRef{}).RunCommand("lightning fetch-ref", []string{
+		"-output-dir=" + tmpdir,
+		"-o=test3.fa",
+		"-chr-prefix=remove",
+		"-contig-md5=" + tmpdir + "/contigs.md5",
+		srv.URL + "/test.fa.gz",
+	}, nil, &stdout, &stderr)
+	c.Check(exited, check.Equals, 1)
+	c.Check(stderr.String(), check.Matches, `contig 2: MD5 mismatch.*\n`)
+}
@@ -7,6 +7,7 @@ package lightning
 import (
 	"bufio"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -16,36 +17,333 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	log "github.com/sirupsen/logrus"
 )
 
-type filter struct {
-	MaxVariants int
-	MinCoverage float64
-	MaxTag      int
-	MatchGenome string
+// Filter drops tiles and genomes from a library. The zero value
+// drops all tiles; use NewFilter (or Flags) to get the defaults, which
+// don't drop anything.
+//
+// A Filter can be saved and loaded as JSON.
+type Filter struct {
+	MaxVariants int     // drop tiles with more than MaxVariants variants (-1 = no limit)
+	MinCoverage float64 // drop tiles with coverage less than MinCoverage across all haplotypes
+	MaxTag      int     // drop tiles with tag ID > MaxTag (-1 = no limit)
+
+	// Drop genomes whose fraction of called (non-zero) tile
+	// variants, across the whole library, is less than
+	// MinSampleCoverage.
+	MinSampleCoverage float64
+
+	// Genome selection (see GenomeSelector)
+	MatchGenome   string // keep genomes whose names match this regexp
+	ExcludeGenome string // drop genomes whose names match this regexp ("" = none)
+	GenomeList    string // if non-empty, keep only genomes listed in this file
+
+	// Per-genome coverage computed by the last call to Apply or
+	// ApplyCompactGenomes, if MinSampleCoverage > 0 (see
+	// WriteSampleCoverage).
+	sampleCoverage []sampleCoverage
+}
+
+// FilterOption sets a Filter parameter. See NewFilter.
+type FilterOption func(*Filter)
+
+// WithMaxVariants drops tiles with more than n variants.
+func WithMaxVariants(n int) FilterOption {
+	return func(f *Filter) { f.MaxVariants = n }
+}
+
+// WithMinCoverage drops tiles with coverage less than p (0 < p ≤ 1)
+// across all haplotypes.
+func WithMinCoverage(p float64) FilterOption {
+	return func(f *Filter) { f.MinCoverage = p }
+}
+
+// WithMaxTag drops tiles with tag ID > n.
+func WithMaxTag(n int) FilterOption {
+	return func(f *Filter) { f.MaxTag = n }
+}
+
+// WithMinSampleCoverage drops genomes with less than p (0 < p ≤ 1) of
+// their tile variants called.
+func WithMinSampleCoverage(p float64) FilterOption {
+	return func(f *Filter) { f.MinSampleCoverage = p }
+}
+
+// WithMatchGenome keeps genomes whose names match the given regexp,
+// and drops the rest.
+func WithMatchGenome(re string) FilterOption {
+	return func(f *Filter) { f.MatchGenome = re }
+}
+
+// WithExcludeGenome drops genomes whose names match the given regexp.
+func WithExcludeGenome(re string) FilterOption {
+	return func(f *Filter) { f.ExcludeGenome = re }
+}
+
+// WithGenomeList keeps only the genomes listed in the given file (see
+// GenomeSelector).
+func WithGenomeList(fnm string) FilterOption {
+	return func(f *Filter) { f.GenomeList = fnm }
+}
+
+// NewFilter returns a Filter with the default parameters (the same
+// as the command line defaults), modified by the given options.
+func NewFilter(opts ...FilterOption) (*Filter, error) {
+	f := &Filter{MaxVariants: -1, MaxTag: -1}
+	for _, opt := range opts {
+		opt(f)
+	}
+	err := f.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Validate returns an error if the filter parameters are unusable.
+func (f *Filter) Validate() error {
+	if f.MinCoverage < 0 || f.MinCoverage > 1 {
+		return fmt.Errorf("invalid min coverage %v: must be between 0 and 1", f.MinCoverage)
+	}
+	if f.MinSampleCoverage < 0 || f.MinSampleCoverage > 1 {
+		return fmt.Errorf("invalid min sample coverage %v: must be between 0 and 1", f.MinSampleCoverage)
+	}
+	if _, err := regexp.Compile(f.MatchGenome); err != nil {
+		return fmt.Errorf("invalid match-genome regexp: %w", err)
+	}
+	if _, err := regexp.Compile(f.ExcludeGenome); err != nil {
+		return fmt.Errorf("invalid exclude-genome regexp: %w", err)
+	}
+	return nil
 }
 
-func (f *filter) Flags(flags *flag.FlagSet) {
+// UnmarshalJSON loads filter parameters from JSON. Parameters that
+// are missing from the JSON data get the default values.
+func (f *Filter) UnmarshalJSON(data []byte) error {
+	type plainFilter Filter
+	tmp := plainFilter{MaxVariants: -1, MaxTag: -1}
+	err := json.Unmarshal(data, &tmp)
+	if err != nil {
+		return err
+	}
+	*f = Filter(tmp)
+	return f.Validate()
+}
+
+// Flags adds command line flags that set the filter parameters.
+func (f *Filter) Flags(flags *flag.FlagSet) {
 	flags.IntVar(&f.MaxVariants, "max-variants", -1, "drop tiles with more than `N` variants")
 	flags.Float64Var(&f.MinCoverage, "min-coverage", 0, "drop tiles with coverage less than `P` across all haplotypes (0 < P ≤ 1)")
 	flags.IntVar(&f.MaxTag, "max-tag", -1, "drop tiles with tag ID > `N`")
+	flags.Float64Var(&f.MinSampleCoverage, "min-sample-coverage", 0, "drop genomes with less than `P` of their tile variants called, across the whole library (0 < P ≤ 1)")
+	f.GenomeFlags(flags)
+}
+
+// GenomeFlags adds command line flags that set the genome selection
+// parameters only. It is used by commands that select genomes but
+// don't filter tiles.
+func (f *Filter) GenomeFlags(flags *flag.FlagSet) {
 	flags.StringVar(&f.MatchGenome, "match-genome", "", "keep genomes whose names contain `regexp`, drop the rest")
+	flags.StringVar(&f.ExcludeGenome, "exclude-genome", "", "drop genomes whose names contain `regexp`")
+	flags.StringVar(&f.GenomeList, "genome-list", "", "keep only genomes whose names or labels are listed in `file`, one per line")
 }
 
-func (f *filter) Args() []string {
-	return []string{
+// Args returns command line arguments that reproduce the filter
+// parameters (see Flags).
+func (f *Filter) Args() []string {
+	return append([]string{
 		fmt.Sprintf("-max-variants=%d", f.MaxVariants),
 		fmt.Sprintf("-min-coverage=%f", f.MinCoverage),
 		fmt.Sprintf("-max-tag=%d", f.MaxTag),
+		fmt.Sprintf("-min-sample-coverage=%f", f.MinSampleCoverage),
+	}, f.GenomeArgs()...)
+}
+
+// GenomeArgs returns command line arguments that reproduce the
+// genome selection parameters (see GenomeFlags).
+func (f *Filter) GenomeArgs() []string {
+	return []string{
 		fmt.Sprintf("-match-genome=%s", f.MatchGenome),
+		fmt.Sprintf("-exclude-genome=%s", f.ExcludeGenome),
+		fmt.Sprintf("-genome-list=%s", f.GenomeList),
+	}
+}
+
+// TranslatePaths updates the -genome-list file (if any) to refer to
+// the corresponding path in the container.
+func (f *Filter) TranslatePaths(runner *arvadosContainerRunner) error {
+	return runner.TranslatePaths(&f.GenomeList)
+}
+
+// GenomeSelector selects genomes by name according to the
+// MatchGenome, ExcludeGenome, and GenomeList parameters of a Filter.
+// The regexps are compiled and the list file is loaded once, by
+// (*Filter).GenomeSelector.
+type GenomeSelector struct {
+	match   *regexp.Regexp
+	exclude *regexp.Regexp  // nil if no genomes are excluded
+	list    map[string]bool // nil if there is no genome list
+	desc    string
+}
+
+// GenomeSelector returns a GenomeSelector that implements the
+// filter's genome selection parameters.
+func (f *Filter) GenomeSelector() (*GenomeSelector, error) {
+	gs := &GenomeSelector{desc: fmt.Sprintf("-match-genome=%q", f.MatchGenome)}
+	var err error
+	gs.match, err = regexp.Compile(f.MatchGenome)
+	if err != nil {
+		return nil, fmt.Errorf("invalid match-genome regexp: %w", err)
+	}
+	if f.ExcludeGenome != "" {
+		gs.exclude, err = regexp.Compile(f.ExcludeGenome)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude-genome regexp: %w", err)
+		}
+		gs.desc += fmt.Sprintf(" -exclude-genome=%q", f.ExcludeGenome)
 	}
+	if f.GenomeList != "" {
+		names, err := loadGenomeList(f.GenomeList)
+		if err != nil {
+			return nil, err
+		}
+		gs.list = make(map[string]bool, len(names))
+		for _, name := range names {
+			gs.list[name] = true
+		}
+		gs.desc += fmt.Sprintf(" -genome-list=%q", f.GenomeList)
+	}
+	return gs, nil
+}
+
+// String returns a description of the selection criteria, suitable
+// for error messages.
+func (gs *GenomeSelector) String() string {
+	return gs.desc
+}
+
+// Match returns true if the named genome is selected. A genome is
+// selected if its name matches MatchGenome, does not match
+// ExcludeGenome, and either its name or its label (see
+// trimFilenameForLabel) is listed in GenomeList.
+func (gs *GenomeSelector) Match(name string) bool {
+	if !gs.match.MatchString(name) {
+		return false
+	}
+	if gs.exclude != nil && gs.exclude.MatchString(name) {
+		return false
+	}
+	if gs.list != nil && !gs.list[name] && !gs.list[trimFilenameForLabel(name)] {
+		return false
+	}
+	return true
+}
+
+// Select returns the selected names, in the given order. It returns
+// an error if a name in GenomeList does not match the name or label
+// of any of the given genomes (whether or not the genome is dropped
+// by MatchGenome or ExcludeGenome).
+func (gs *GenomeSelector) Select(names []string) ([]string, error) {
+	var found map[string]bool
+	if gs.list != nil {
+		found = make(map[string]bool, len(gs.list))
+	}
+	var selected []string
+	for _, name := range names {
+		if found != nil {
+			if gs.list[name] {
+				found[name] = true
+			}
+			if label := trimFilenameForLabel(name); gs.list[label] {
+				found[label] = true
+			}
+		}
+		if gs.Match(name) {
+			selected = append(selected, name)
+		}
+	}
+	var missing []string
+	for name := range gs.list {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("%d genomes in genome list not found in input: %q", len(missing), missing)
+	}
+	return selected, nil
+}
+
+// loadGenomeList returns the genome names listed in the given file,
+// one per line (see Filter.GenomeList). Blank lines and lines
+// starting with "#" are ignored.
+func loadGenomeList(fnm string) ([]string, error) {
+	f, err := zopen(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("%s: no genome names listed", fnm)
+	}
+	return names, nil
 }
 
-func (f *filter) Apply(tilelib *tileLibrary) {
+// Apply filters the genomes in tilelib in place. Genomes are
+// selected (see GenomeSelector) and low-coverage genomes are dropped
+// (see MinSampleCoverage) before the tile filters are applied.
+func (f *Filter) Apply(tilelib *tileLibrary) error {
+	gs, err := f.GenomeSelector()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(tilelib.compactGenomes))
+	for name := range tilelib.compactGenomes {
+		names = append(names, name)
+	}
+	if _, err := gs.Select(names); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !gs.Match(name) {
+			delete(tilelib.compactGenomes, name)
+		}
+	}
+
+	// Drop genomes with less than f.MinSampleCoverage, before
+	// computing tile coverage.
+	if f.MinSampleCoverage > 0 {
+		called := make(map[string]int, len(tilelib.compactGenomes))
+		for name, cg := range tilelib.compactGenomes {
+			called[name] = countCalled(cg)
+		}
+		f.sampleCoverage = sampleCoverages(called, len(tilelib.variant), f.MinSampleCoverage)
+		for _, sc := range f.sampleCoverage {
+			if sc.Dropped {
+				delete(tilelib.compactGenomes, sc.Name)
+			}
+		}
+	}
+
 	// Zero out variants at tile positions that have more than
 	// f.MaxVariants tile variants.
 	if f.MaxVariants >= 0 {
@@ -105,21 +403,123 @@ TAG:
 			}
 		}
 	}
+	return nil
+}
 
-	re, err := regexp.Compile(f.MatchGenome)
+// ApplyCompactGenomes filters the given genomes, and returns the
+// genomes that are selected by f.GenomeSelector() and meet
+// f.MinSampleCoverage. The Variants slices of the given genomes are
+// modified in place.
+func (f *Filter) ApplyCompactGenomes(cgs []CompactGenome) ([]CompactGenome, error) {
+	gs, err := f.GenomeSelector()
 	if err != nil {
-		log.Errorf("invalid regexp %q does not match anything, dropping all genomes", f.MatchGenome)
+		return nil, err
 	}
-	for name := range tilelib.compactGenomes {
-		if !re.MatchString(name) {
-			delete(tilelib.compactGenomes, name)
+	names := make([]string, len(cgs))
+	for i, cg := range cgs {
+		names[i] = cg.Name
+	}
+	if _, err := gs.Select(names); err != nil {
+		return nil, err
+	}
+	kept := cgs[:0]
+	for _, cg := range cgs {
+		if gs.Match(cg.Name) {
+			kept = append(kept, cg)
 		}
 	}
+	cgs = kept
+
+	if f.MinSampleCoverage > 0 {
+		ntags := 0
+		called := make(map[string]int, len(cgs))
+		for _, cg := range cgs {
+			if ntags < len(cg.Variants)/2 {
+				ntags = len(cg.Variants) / 2
+			}
+			called[cg.Name] = countCalled(cg.Variants)
+		}
+		f.sampleCoverage = sampleCoverages(called, ntags, f.MinSampleCoverage)
+		dropped := map[string]bool{}
+		for _, sc := range f.sampleCoverage {
+			dropped[sc.Name] = sc.Dropped
+		}
+		kept := cgs[:0]
+		for _, cg := range cgs {
+			if !dropped[cg.Name] {
+				kept = append(kept, cg)
+			}
+		}
+		cgs = kept
+	}
+
+	ntags := 0
+	for _, cg := range cgs {
+		if ntags < len(cg.Variants)/2 {
+			ntags = len(cg.Variants) / 2
+		}
+		if f.MaxVariants < 0 {
+			continue
+		}
+		for idx, variant := range cg.Variants {
+			if variant > tileVariantID(f.MaxVariants) {
+				for _, cg := range cgs {
+					if len(cg.Variants) > idx {
+						cg.Variants[idx & ^1] = 0
+						cg.Variants[idx|1] = 0
+					}
+				}
+			}
+		}
+	}
+
+	if f.MaxTag >= 0 && ntags > f.MaxTag {
+		ntags = f.MaxTag
+		for i, cg := range cgs {
+			if len(cg.Variants) > f.MaxTag*2 {
+				cgs[i].Variants = cg.Variants[:f.MaxTag*2]
+			}
+		}
+	}
+
+	if f.MinCoverage > 0 {
+		mincov := int(f.MinCoverage * float64(len(cgs)*2))
+		cov := make([]int, ntags)
+		for _, cg := range cgs {
+			for idx, variant := range cg.Variants {
+				if variant > 0 {
+					cov[idx>>1]++
+				}
+			}
+		}
+		for tag, c := range cov {
+			if c < mincov {
+				for _, cg := range cgs {
+					if len(cg.Variants) > tag*2 {
+						cg.Variants[tag*2] = 0
+						cg.Variants[tag*2+1] = 0
+					}
+				}
+			}
+		}
+	}
+
+	return cgs, nil
+}
+
+// WriteSampleCoverage writes the per-genome coverage computed by the
+// last call to Apply or ApplyCompactGenomes to a CSV file. It is an
+// error to call WriteSampleCoverage if MinSampleCoverage is zero.
+func (f *Filter) WriteSampleCoverage(fnm string) error {
+	if f.sampleCoverage == nil {
+		return errors.New("no sample coverage data: -min-sample-coverage not specified")
+	}
+	return writeSampleCoverage(fnm, f.sampleCoverage)
 }
 
 type filtercmd struct {
 	output io.Writer
-	filter
+	Filter
 }
 
 func (cmd *filtercmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
@@ -135,10 +535,13 @@ func (cmd *filtercmd) RunCommand(prog string, args []string, stdin io.Reader, st
 	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
 	projectUUID := flags.String("project", "", "project `UUID` for output data")
 	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
 	inputFilename := flags.String("i", "-", "input `file`")
 	outputFilename := flags.String("o", "-", "output `file`")
-	cmd.filter.Flags(flags)
-	err = flags.Parse(args)
+	coverageFilename := flags.String("output-sample-coverage", "", "write per-genome coverage to csv `file` (requires -min-sample-coverage)")
+	cmd.Filter.Flags(flags)
+	err = parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		err = nil
 		return 0
@@ -147,6 +550,9 @@ func (cmd *filtercmd) RunCommand(prog string, args []string, stdin io.Reader, st
 	} else if flags.NArg() > 0 {
 		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
 		return 2
+	} else if *coverageFilename != "" && cmd.MinSampleCoverage == 0 {
+		err = errors.New("-output-sample-coverage does not make sense without -min-sample-coverage")
+		return 2
 	}
 	cmd.output = stdout
 
@@ -157,7 +563,7 @@ func (cmd *filtercmd) RunCommand(prog string, args []string, stdin io.Reader, st
 	}
 
 	if !*runlocal {
-		if *outputFilename != "-" {
+		if *outputFilename != "-" || *coverageFilename != "" {
 			err = errors.New("cannot specify output file in container mode: not implemented")
 			return 1
 		}
@@ -169,20 +575,28 @@ func (cmd *filtercmd) RunCommand(prog string, args []string, stdin io.Reader, st
 			VCPUs:       2,
 			Priority:    *priority,
 		}
+		containerOpts.Apply(&runner, stdout)
 		err = runner.TranslatePaths(inputFilename)
+		if err == nil {
+			err = cmd.Filter.TranslatePaths(&runner)
+		}
 		if err != nil {
 			return 1
 		}
 		runner.Args = []string{"filter", "-local=true",
 			"-i", *inputFilename,
 			"-o", "/mnt/output/library.gob",
-			"-max-variants", fmt.Sprintf("%d", cmd.MaxVariants),
-			"-min-coverage", fmt.Sprintf("%f", cmd.MinCoverage),
-			"-max-tag", fmt.Sprintf("%d", cmd.MaxTag),
 		}
+		if cmd.MinSampleCoverage > 0 {
+			runner.Args = append(runner.Args, "-output-sample-coverage", "/mnt/output/sample-coverage.csv")
+		}
+		runner.Args = append(runner.Args, cmd.Filter.Args()...)
 		var output string
 		output, err = runner.Run()
-		if err != nil {
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
 			return 1
 		}
 		fmt.Fprintln(stdout, output+"/library.gob")
@@ -211,57 +625,16 @@ func (cmd *filtercmd) RunCommand(prog string, args []string, stdin io.Reader, st
 	log.Printf("reading done, %d genomes", len(cgs))
 
 	log.Print("filtering")
-	ntags := 0
-	for _, cg := range cgs {
-		if ntags < len(cg.Variants)/2 {
-			ntags = len(cg.Variants) / 2
-		}
-		if cmd.MaxVariants < 0 {
-			continue
-		}
-		for idx, variant := range cg.Variants {
-			if variant > tileVariantID(cmd.MaxVariants) {
-				for _, cg := range cgs {
-					if len(cg.Variants) > idx {
-						cg.Variants[idx & ^1] = 0
-						cg.Variants[idx|1] = 0
-					}
-				}
-			}
-		}
-	}
-
-	if cmd.MaxTag >= 0 && ntags > cmd.MaxTag {
-		ntags = cmd.MaxTag
-		for i, cg := range cgs {
-			if len(cg.Variants) > cmd.MaxTag*2 {
-				cgs[i].Variants = cg.Variants[:cmd.MaxTag*2]
-			}
-		}
+	cgs, err = cmd.ApplyCompactGenomes(cgs)
+	if err != nil {
+		return 1
 	}
-
-	if cmd.MinCoverage > 0 {
-		mincov := int(cmd.MinCoverage * float64(len(cgs)*2))
-		cov := make([]int, ntags)
-		for _, cg := range cgs {
-			for idx, variant := range cg.Variants {
-				if variant > 0 {
-					cov[idx>>1]++
-				}
-			}
-		}
-		for tag, c := range cov {
-			if c < mincov {
-				for _, cg := range cgs {
-					if len(cg.Variants) > tag*2 {
-						cg.Variants[tag*2] = 0
-						cg.Variants[tag*2+1] = 0
-					}
-				}
-			}
+	if *coverageFilename != "" {
+		err = cmd.WriteSampleCoverage(*coverageFilename)
+		if err != nil {
+			return 1
 		}
 	}
-
 	log.Print("filtering done")
 
 	var outfile io.WriteCloser
@@ -0,0 +1,167 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+
+	"gopkg.in/check.v1"
+)
+
+type filterSuite struct{}
+
+var _ = check.Suite(&filterSuite{})
+
+func (s *filterSuite) TestNewFilter(c *check.C) {
+	f, err := NewFilter()
+	c.Assert(err, check.IsNil)
+	c.Check(*f, check.DeepEquals, Filter{MaxVariants: -1, MaxTag: -1})
+
+	f, err = NewFilter(WithMaxVariants(3), WithMinCoverage(0.5), WithMaxTag(100), WithMatchGenome("^input1"), WithExcludeGenome("x"), WithGenomeList("list.txt"))
+	c.Assert(err, check.IsNil)
+	c.Check(*f, check.DeepEquals, Filter{MaxVariants: 3, MinCoverage: 0.5, MaxTag: 100, MatchGenome: "^input1", ExcludeGenome: "x", GenomeList: "list.txt"})
+
+	// Args() reproduces the same filter when parsed by Flags()
+	var parsed Filter
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	parsed.Flags(flags)
+	c.Assert(flags.Parse(f.Args()), check.IsNil)
+	c.Check(parsed, check.DeepEquals, *f)
+
+	_, err = NewFilter(WithMinCoverage(2))
+	c.Check(err, check.ErrorMatches, `invalid min coverage.*`)
+	_, err = NewFilter(WithMatchGenome("("))
+	c.Check(err, check.ErrorMatches, `invalid match-genome regexp.*`)
+	_, err = NewFilter(WithExcludeGenome("("))
+	c.Check(err, check.ErrorMatches, `invalid exclude-genome regexp.*`)
+}
+
+func (s *filterSuite) TestJSON(c *check.C) {
+	f, err := NewFilter(WithMaxTag(10), WithMatchGenome("foo"))
+	c.Assert(err, check.IsNil)
+	buf, err := json.Marshal(f)
+	c.Assert(err, check.IsNil)
+	var loaded Filter
+	c.Assert(json.Unmarshal(buf, &loaded), check.IsNil)
+	c.Check(loaded, check.DeepEquals, *f)
+
+	// missing fields get default values
+	loaded = Filter{}
+	c.Assert(json.Unmarshal([]byte(`{"MinCoverage":0.25}`), &loaded), check.IsNil)
+	c.Check(loaded, check.DeepEquals, Filter{MaxVariants: -1, MinCoverage: 0.25, MaxTag: -1})
+
+	c.Check(json.Unmarshal([]byte(`{"MinCoverage":-1}`), &loaded), check.NotNil)
+}
+
+func (s *filterSuite) TestApplyCompactGenomes(c *check.C) {
+	cgs := []CompactGenome{
+		{Name: "input1", Variants: []tileVariantID{1, 1, 1, 2, 1, 3}},
+		{Name: "input2", Variants: []tileVariantID{1, 1, 0, 0, 1, 1}},
+		{Name: "other", Variants: []tileVariantID{1, 1, 0, 0, 4, 1}},
+	}
+	f, err := NewFilter(WithMatchGenome("^input"), WithMaxVariants(2))
+	c.Assert(err, check.IsNil)
+	cgs, err = f.ApplyCompactGenomes(cgs)
+	c.Assert(err, check.IsNil)
+	c.Check(cgs, check.DeepEquals, []CompactGenome{
+		{Name: "input1", Variants: []tileVariantID{1, 1, 1, 2, 0, 0}},
+		{Name: "input2", Variants: []tileVariantID{1, 1, 0, 0, 0, 0}},
+	})
+
+	f, err = NewFilter(WithMinCoverage(0.75), WithMaxTag(1))
+	c.Assert(err, check.IsNil)
+	cgs, err = f.ApplyCompactGenomes(cgs)
+	c.Assert(err, check.IsNil)
+	c.Check(cgs, check.DeepEquals, []CompactGenome{
+		{Name: "input1", Variants: []tileVariantID{1, 1}},
+		{Name: "input2", Variants: []tileVariantID{1, 1}},
+	})
+}
+
+func (s *filterSuite) TestMinSampleCoverage(c *check.C) {
+	cgs := []CompactGenome{
+		{Name: "input1", Variants: []tileVariantID{1, 1, 1, 2, 0, 0}},
+		{Name: "input2", Variants: []tileVariantID{1, 1, 0, 0, 0, 0}},
+		{Name: "input3", Variants: []tileVariantID{1, 1, 1, 1, 1, 1}},
+	}
+	f, err := NewFilter(WithMinSampleCoverage(0.5))
+	c.Assert(err, check.IsNil)
+	cgs, err = f.ApplyCompactGenomes(cgs)
+	c.Assert(err, check.IsNil)
+	c.Check(cgs, check.HasLen, 2)
+	c.Check(cgs[0].Name, check.Equals, "input1")
+	c.Check(cgs[1].Name, check.Equals, "input3")
+
+	fnm := c.MkDir() + "/sample-coverage.csv"
+	c.Assert(f.WriteSampleCoverage(fnm), check.IsNil)
+	buf, err := ioutil.ReadFile(fnm)
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, `Index,SampleID,Called,Total,Coverage,Dropped
+0,input1,4,6,0.666667,false
+1,input2,2,6,0.333333,true
+2,input3,6,6,1.000000,false
+`)
+
+	_, err = NewFilter(WithMinSampleCoverage(1.5))
+	c.Check(err, check.ErrorMatches, `invalid min sample coverage.*`)
+	f, err = NewFilter()
+	c.Assert(err, check.IsNil)
+	c.Check(f.WriteSampleCoverage(fnm), check.ErrorMatches, `no sample coverage data.*`)
+}
+
+func (s *filterSuite) TestGenomeSelector(c *check.C) {
+	fnm := c.MkDir() + "/genomes.txt"
+	err := ioutil.WriteFile(fnm, []byte("# comment\n\nsample1\n testdata/sample3.2.fasta \n"), 0644)
+	c.Assert(err, check.IsNil)
+	names, err := loadGenomeList(fnm)
+	c.Assert(err, check.IsNil)
+	c.Check(names, check.DeepEquals, []string{"sample1", "testdata/sample3.2.fasta"})
+
+	all := []string{
+		"testdata/sample1.1.fasta",
+		"testdata/sample2.1.fasta",
+		"testdata/sample3.2.fasta",
+	}
+	f, err := NewFilter(WithGenomeList(fnm))
+	c.Assert(err, check.IsNil)
+	gs, err := f.GenomeSelector()
+	c.Assert(err, check.IsNil)
+	selected, err := gs.Select(all)
+	c.Check(err, check.IsNil)
+	c.Check(selected, check.DeepEquals, []string{"testdata/sample1.1.fasta", "testdata/sample3.2.fasta"})
+	_, err = gs.Select(all[:2])
+	c.Check(err, check.ErrorMatches, `1 genomes in genome list not found in input: \["testdata/sample3.2.fasta"\]`)
+
+	f, err = NewFilter(WithMatchGenome("sample[12]"), WithExcludeGenome("2"))
+	c.Assert(err, check.IsNil)
+	gs, err = f.GenomeSelector()
+	c.Assert(err, check.IsNil)
+	selected, err = gs.Select(all)
+	c.Check(err, check.IsNil)
+	c.Check(selected, check.DeepEquals, []string{"testdata/sample1.1.fasta"})
+	c.Check(gs.String(), check.Equals, `-match-genome="sample[12]" -exclude-genome="2"`)
+
+	// the tile filter and the genome selector are applied together
+	tilelib := &tileLibrary{
+		compactGenomes: map[string][]tileVariantID{
+			"testdata/sample1.1.fasta": {1, 1, 1, 1},
+			"testdata/sample2.1.fasta": {1, 1, 0, 0},
+			"testdata/sample3.2.fasta": {1, 1, 0, 1},
+		},
+	}
+	f, err = NewFilter(WithExcludeGenome("sample2"), WithGenomeList(fnm))
+	c.Assert(err, check.IsNil)
+	c.Check(f.Apply(tilelib), check.IsNil)
+	c.Check(tilelib.compactGenomes, check.HasLen, 2)
+	_, ok := tilelib.compactGenomes["testdata/sample2.1.fasta"]
+	c.Check(ok, check.Equals, false)
+
+	err = ioutil.WriteFile(fnm, []byte("# nothing\n"), 0644)
+	c.Assert(err, check.IsNil)
+	_, err = f.GenomeSelector()
+	c.Check(err, check.ErrorMatches, `.*no genome names listed`)
+}
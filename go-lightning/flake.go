@@ -17,7 +17,7 @@ import (
 )
 
 type flakecmd struct {
-	filter filter
+	filter Filter
 }
 
 func (cmd *flakecmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
@@ -33,10 +33,12 @@ func (cmd *flakecmd) RunCommand(prog string, args []string, stdin io.Reader, std
 	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
 	projectUUID := flags.String("project", "", "project `UUID` for output data")
 	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
 	inputDir := flags.String("input-dir", "./in", "input `directory`")
 	outputDir := flags.String("output-dir", "./out", "output `directory`")
 	cmd.filter.Flags(flags)
-	err = flags.Parse(args)
+	err = parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		err = nil
 		return 0
@@ -64,7 +66,11 @@ func (cmd *flakecmd) RunCommand(prog string, args []string, stdin io.Reader, std
 			KeepCache:   2,
 			APIAccess:   true,
 		}
+		containerOpts.Apply(&runner, stdout)
 		err = runner.TranslatePaths(inputDir)
+		if err == nil {
+			err = cmd.filter.TranslatePaths(&runner)
+		}
 		if err != nil {
 			return 1
 		}
@@ -72,13 +78,14 @@ func (cmd *flakecmd) RunCommand(prog string, args []string, stdin io.Reader, std
 			"-pprof", ":6060",
 			"-input-dir", *inputDir,
 			"-output-dir", "/mnt/output",
-			"-max-variants", fmt.Sprintf("%d", cmd.filter.MaxVariants),
-			"-min-coverage", fmt.Sprintf("%f", cmd.filter.MinCoverage),
-			"-max-tag", fmt.Sprintf("%d", cmd.filter.MaxTag),
 		}
+		runner.Args = append(runner.Args, cmd.filter.Args()...)
 		var output string
 		output, err = runner.Run()
-		if err != nil {
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
 			return 1
 		}
 		fmt.Fprintln(stdout, output)
@@ -96,7 +103,10 @@ func (cmd *flakecmd) RunCommand(prog string, args []string, stdin io.Reader, std
 	}
 
 	log.Info("filtering")
-	cmd.filter.Apply(tilelib)
+	err = cmd.filter.Apply(tilelib)
+	if err != nil {
+		return 1
+	}
 	log.Info("tidying")
 	tilelib.Tidy()
 	err = tilelib.WriteDir(*outputDir)
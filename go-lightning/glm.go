@@ -30,14 +30,16 @@ func normalize(a []float64) {
 	}
 }
 
-// Logistic regression.
-//
-// onehot is the observed outcome, in same order as sampleInfo, but
-// shorter because it only has entries for samples with
-// isTraining==true.
-func glmPvalueFunc(sampleInfo []sampleInfo, nPCA int) func(onehot []bool) float64 {
-	pcaNames := make([]string, 0, nPCA)
-	data := make([][]statmodel.Dtype, 0, nPCA)
+// glmCovariates returns the first nPCA PCA components (or all of
+// them, if there are fewer) and all covariates of the training set
+// samples, normalized, along with a name for each.
+func glmCovariates(sampleInfo []sampleInfo, nPCA int) ([][]statmodel.Dtype, []string) {
+	if len(sampleInfo) > 0 && nPCA > len(sampleInfo[0].pcaComponents) {
+		nPCA = len(sampleInfo[0].pcaComponents)
+	}
+	_, covariateNames := sampleInfoColumnNames(sampleInfo)
+	pcaNames := make([]string, 0, nPCA+len(covariateNames))
+	data := make([][]statmodel.Dtype, 0, nPCA+len(covariateNames))
 	for pca := 0; pca < nPCA; pca++ {
 		series := make([]statmodel.Dtype, 0, len(sampleInfo))
 		for _, si := range sampleInfo {
@@ -49,6 +51,30 @@ func glmPvalueFunc(sampleInfo []sampleInfo, nPCA int) func(onehot []bool) float6
 		data = append(data, series)
 		pcaNames = append(pcaNames, fmt.Sprintf("pca%d", pca))
 	}
+	for _, name := range covariateNames {
+		series := make([]statmodel.Dtype, 0, len(sampleInfo))
+		for _, si := range sampleInfo {
+			if si.isTraining {
+				series = append(series, si.covariates[name])
+			}
+		}
+		normalize(series)
+		data = append(data, series)
+		pcaNames = append(pcaNames, "cov:"+name)
+	}
+	return data, pcaNames
+}
+
+// Logistic regression.
+//
+// onehot is the observed outcome, in same order as sampleInfo, but
+// shorter because it only has entries for samples with
+// isTraining==true.
+//
+// The first nPCA PCA components (or all of them, if there are fewer)
+// and all covariates are used as covariates in the model.
+func glmPvalueFunc(sampleInfo []sampleInfo, nPCA int) func(onehot []bool) float64 {
+	data, pcaNames := glmCovariates(sampleInfo, nPCA)
 
 	outcome := make([]statmodel.Dtype, 0, len(sampleInfo))
 	constants := make([]statmodel.Dtype, 0, len(sampleInfo))
@@ -111,3 +137,107 @@ func glmPvalueFunc(sampleInfo []sampleInfo, nPCA int) func(onehot []bool) float6
 		return dist.Survival(-2 * (logCov - logComp))
 	}
 }
+
+// Fixed-effect meta-analysis of per-stratum logistic regressions.
+//
+// strata[i] is the stratum of the i'th training set sample (i.e.,
+// same order as onehot, see glmPvalueFunc). The variant coefficient
+// is estimated separately in each stratum, using the same covariates
+// as glmPvalueFunc, and the estimates are combined with
+// inverse-variance weights. Strata where the variant or the outcome
+// is constant, or the model cannot be fitted, are skipped.
+func glmMetaPvalueFunc(sampleInfo []sampleInfo, nPCA int, strata []int, nstrata int) func(onehot []bool) float64 {
+	covariates, covariateNames := glmCovariates(sampleInfo, nPCA)
+	names := append([]string{"outcome", "variant", "constants"}, covariateNames...)
+	// rows[k] = training set indices of samples in stratum k
+	rows := make([][]int, nstrata)
+	for i, k := range strata {
+		rows[k] = append(rows[k], i)
+	}
+	var outcome []statmodel.Dtype
+	for _, si := range sampleInfo {
+		if si.isTraining {
+			if si.isCase {
+				outcome = append(outcome, 1)
+			} else {
+				outcome = append(outcome, 0)
+			}
+		}
+	}
+	subset := func(series []statmodel.Dtype, rows []int) []statmodel.Dtype {
+		sub := make([]statmodel.Dtype, len(rows))
+		for i, row := range rows {
+			sub[i] = series[row]
+		}
+		return sub
+	}
+	// stratumData[k] = outcome, (placeholder for variant),
+	// constants, covariates for stratum k
+	stratumData := make([][][]statmodel.Dtype, nstrata)
+	for k, rows := range rows {
+		constants := make([]statmodel.Dtype, len(rows))
+		for i := range constants {
+			constants[i] = 1
+		}
+		data := [][]statmodel.Dtype{subset(outcome, rows), nil, constants}
+		for _, series := range covariates {
+			data = append(data, subset(series, rows))
+		}
+		stratumData[k] = data
+	}
+	dist := distuv.ChiSquared{K: 1}
+
+	// fit returns the variant coefficient and its standard error
+	// in the given stratum, or ok=false if it cannot be
+	// estimated.
+	fit := func(k int, onehot []bool) (beta, se float64, ok bool) {
+		defer func() {
+			if recover() != nil {
+				ok = false
+			}
+		}()
+		variant := make([]statmodel.Dtype, len(rows[k]))
+		var nvariant, ncase int
+		for i, row := range rows[k] {
+			if onehot[row] {
+				variant[i] = 1
+				nvariant++
+			}
+			if outcome[row] == 1 {
+				ncase++
+			}
+		}
+		if nvariant == 0 || nvariant == len(variant) || ncase == 0 || ncase == len(variant) {
+			return 0, 0, false
+		}
+		data := append([][]statmodel.Dtype(nil), stratumData[k]...)
+		data[1] = variant
+		model, err := glm.NewGLM(statmodel.NewDataset(data, names), "outcome", names[1:], glmConfig)
+		if err != nil {
+			return 0, 0, false
+		}
+		result := model.Fit()
+		beta, se = result.Params()[0], result.StdErr()[0]
+		if math.IsNaN(beta) || math.IsNaN(se) || math.IsInf(se, 0) || se <= 0 {
+			return 0, 0, false
+		}
+		return beta, se, true
+	}
+
+	return func(onehot []bool) float64 {
+		var sumw, sumwb float64
+		for k := range rows {
+			beta, se, ok := fit(k, onehot)
+			if !ok {
+				continue
+			}
+			w := 1 / (se * se)
+			sumw += w
+			sumwb += w * beta
+		}
+		if sumw == 0 {
+			return math.NaN()
+		}
+		return dist.Survival(sumwb * sumwb / sumw)
+	}
+}
@@ -10,48 +10,163 @@ import (
 	"io"
 	"io/ioutil"
 	_ "net/http/pprof"
+	"reflect"
+	"sync"
 
+	"github.com/arvados/lightning/go-lightning/libio"
 	"github.com/klauspost/pgzip"
 	"golang.org/x/crypto/blake2b"
 )
 
-type CompactGenome struct {
-	Name     string
-	Variants []tileVariantID
+// The library file types are defined in the libio package so they
+// can be used by other programs; see libio for compatibility
+// guarantees.
+type (
+	CompactGenome   = libio.CompactGenome
+	CompactSequence = libio.CompactSequence
+	TileVariant     = libio.TileVariant
+	LibraryEntry    = libio.LibraryEntry
+	Heteroplasmy    = libio.Heteroplasmy
+)
+
+func ReadCompactGenomes(rdr io.Reader, gz bool) ([]CompactGenome, error) {
+	var ret []CompactGenome
+	err := DecodeLibraryOptions(rdr, gz, DecodeOptions{SkipTileVariants: true}, func(ent *LibraryEntry) error {
+		ret = append(ret, ent.CompactGenomes...)
+		return nil
+	})
+	return ret, err
+}
+
+func DecodeLibrary(rdr io.Reader, gz bool, cb func(*LibraryEntry) error) error {
+	return DecodeLibraryOptions(rdr, gz, DecodeOptions{}, cb)
+}
+
+// DecodeOptions select the parts of a library that
+// DecodeLibraryOptions decodes and passes to its callback. Skipped
+// parts are not allocated, which saves memory and GC time when the
+// caller only needs metadata.
+type DecodeOptions struct {
+	SkipTileVariants   bool // omit TileVariants
+	SkipSequences      bool // omit TileVariant sequences (Sequence is nil)
+	SkipGenomes        bool // omit CompactGenomes
+	SkipGenomeVariants bool // omit CompactGenome variants (only Name, StartTag, and EndTag are populated)
+
+	// If EndTag > 0, only pass tile variants and (trimmed)
+	// genomes for tags in the range [StartTag, EndTag).
 	StartTag tagID
 	EndTag   tagID
 }
 
-type CompactSequence struct {
-	Name          string
-	TileSequences map[string][]tileLibRef
+// tileVariantNoSequence has the fields of TileVariant except
+// Sequence, so gob skips sequences when decoding into it.
+type tileVariantNoSequence struct {
+	Tag        tagID
+	Ref        bool
+	Variant    tileVariantID
+	Blake2b    [blake2b.Size256]byte
+	Source     string
+	SourceTime int64
 }
 
-type TileVariant struct {
-	Tag      tagID
-	Ref      bool
-	Variant  tileVariantID
-	Blake2b  [blake2b.Size256]byte
-	Sequence []byte
+// compactGenomeNoVariants has the fields of CompactGenome except
+// Variants.
+type compactGenomeNoVariants struct {
+	Name     string
+	StartTag tagID
+	EndTag   tagID
 }
 
-type LibraryEntry struct {
-	TagSet           [][]byte
-	CompactGenomes   []CompactGenome
-	CompactSequences []CompactSequence
-	TileVariants     []TileVariant
+var decodeTypes sync.Map // DecodeOptions (with zero tag range) => reflect.Type
+
+// decodeType returns a struct type with the LibraryEntry fields
+// selected by opts, for use as a gob decoding target.
+func (opts DecodeOptions) decodeType() reflect.Type {
+	key := opts
+	key.StartTag, key.EndTag = 0, 0
+	if t, ok := decodeTypes.Load(key); ok {
+		return t.(reflect.Type)
+	}
+	fields := []reflect.StructField{
+		{Name: "TagSet", Type: reflect.TypeOf([][]byte(nil))},
+		{Name: "CompactSequences", Type: reflect.TypeOf([]CompactSequence(nil))},
+		{Name: "TagSetHash", Type: reflect.TypeOf([blake2b.Size256]byte{})},
+		{Name: "TagSetSize", Type: reflect.TypeOf(0)},
+	}
+	if opts.SkipGenomeVariants {
+		fields = append(fields, reflect.StructField{Name: "CompactGenomes", Type: reflect.TypeOf([]compactGenomeNoVariants(nil))})
+	} else if !opts.SkipGenomes {
+		fields = append(fields, reflect.StructField{Name: "CompactGenomes", Type: reflect.TypeOf([]CompactGenome(nil))})
+	}
+	if opts.SkipSequences && !opts.SkipTileVariants {
+		fields = append(fields, reflect.StructField{Name: "TileVariants", Type: reflect.TypeOf([]tileVariantNoSequence(nil))})
+	} else if !opts.SkipTileVariants {
+		fields = append(fields, reflect.StructField{Name: "TileVariants", Type: reflect.TypeOf([]TileVariant(nil))})
+	}
+	t := reflect.StructOf(fields)
+	decodeTypes.Store(key, t)
+	return t
 }
 
-func ReadCompactGenomes(rdr io.Reader, gz bool) ([]CompactGenome, error) {
-	var ret []CompactGenome
-	err := DecodeLibrary(rdr, gz, func(ent *LibraryEntry) error {
-		ret = append(ret, ent.CompactGenomes...)
-		return nil
-	})
-	return ret, err
+// libraryEntry converts v (a value of opts.decodeType()) to a
+// LibraryEntry, applying the tag range filter.
+func (opts DecodeOptions) libraryEntry(v reflect.Value) *LibraryEntry {
+	ent := &LibraryEntry{
+		TagSet:           v.FieldByName("TagSet").Interface().([][]byte),
+		CompactSequences: v.FieldByName("CompactSequences").Interface().([]CompactSequence),
+		TagSetHash:       v.FieldByName("TagSetHash").Interface().([blake2b.Size256]byte),
+		TagSetSize:       v.FieldByName("TagSetSize").Interface().(int),
+	}
+	if opts.SkipGenomeVariants && !opts.SkipGenomes {
+		for _, cg := range v.FieldByName("CompactGenomes").Interface().([]compactGenomeNoVariants) {
+			ent.CompactGenomes = append(ent.CompactGenomes, CompactGenome{Name: cg.Name, StartTag: cg.StartTag, EndTag: cg.EndTag})
+		}
+	} else if !opts.SkipGenomes {
+		ent.CompactGenomes = v.FieldByName("CompactGenomes").Interface().([]CompactGenome)
+	}
+	if opts.SkipSequences && !opts.SkipTileVariants {
+		tvs := v.FieldByName("TileVariants").Interface().([]tileVariantNoSequence)
+		if len(tvs) > 0 {
+			ent.TileVariants = make([]TileVariant, len(tvs))
+			for i, tv := range tvs {
+				ent.TileVariants[i] = TileVariant{
+					Tag:        tv.Tag,
+					Ref:        tv.Ref,
+					Variant:    tv.Variant,
+					Blake2b:    tv.Blake2b,
+					Source:     tv.Source,
+					SourceTime: tv.SourceTime,
+				}
+			}
+		}
+	} else if !opts.SkipTileVariants {
+		ent.TileVariants = v.FieldByName("TileVariants").Interface().([]TileVariant)
+	}
+	opts.filterTagRange(ent)
+	return ent
 }
 
-func DecodeLibrary(rdr io.Reader, gz bool, cb func(*LibraryEntry) error) error {
+// filterTagRange removes tile variants outside the tag range, and
+// trims genomes to the tag range.
+func (opts DecodeOptions) filterTagRange(ent *LibraryEntry) {
+	if opts.EndTag <= 0 {
+		return
+	}
+	keep := ent.TileVariants[:0]
+	for _, tv := range ent.TileVariants {
+		if tv.Tag >= opts.StartTag && tv.Tag < opts.EndTag {
+			keep = append(keep, tv)
+		}
+	}
+	ent.TileVariants = keep
+	for i, cg := range ent.CompactGenomes {
+		ent.CompactGenomes[i] = libio.TrimCompactGenome(cg, opts.StartTag, opts.EndTag)
+	}
+}
+
+// DecodeLibraryOptions is like DecodeLibrary, but only decodes the
+// parts of the library selected by opts.
+func DecodeLibraryOptions(rdr io.Reader, gz bool, opts DecodeOptions, cb func(*LibraryEntry) error) error {
 	zrdr := ioutil.NopCloser(rdr)
 	var err error
 	if gz {
@@ -62,17 +177,90 @@ func DecodeLibrary(rdr io.Reader, gz bool, cb func(*LibraryEntry) error) error {
 		defer zrdr.Close()
 	}
 	dec := gob.NewDecoder(zrdr)
+	if opts == (DecodeOptions{}) {
+		for {
+			var ent LibraryEntry
+			err = dec.Decode(&ent)
+			if err == io.EOF {
+				return zrdr.Close()
+			} else if err != nil {
+				return err
+			}
+			err = cb(&ent)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	t := opts.decodeType()
 	for {
-		var ent LibraryEntry
-		err = dec.Decode(&ent)
+		v := reflect.New(t)
+		err = dec.DecodeValue(v)
 		if err == io.EOF {
 			return zrdr.Close()
 		} else if err != nil {
 			return err
 		}
-		err = cb(&ent)
+		err = cb(opts.libraryEntry(v.Elem()))
 		if err != nil {
 			return err
 		}
 	}
 }
+
+// DecodeLibraryHeader is like DecodeLibraryOptions, but only passes
+// the tag set, reference sequences, and genomes to cb (never tile
+// variants). If the library file is indexed (see
+// libio.WriteIndexed), the tile variant blocks are not read at all,
+// so this takes seconds even for large slice files.
+func DecodeLibraryHeader(rs io.ReadSeeker, gz bool, opts DecodeOptions, cb func(*LibraryEntry) error) error {
+	opts.SkipTileVariants = true
+	h := libio.Handlers{
+		TagSet: func(tagset [][]byte) error {
+			return cb(&LibraryEntry{TagSet: tagset})
+		},
+		CompactSequence: func(cs *CompactSequence) error {
+			return cb(&LibraryEntry{CompactSequences: []CompactSequence{*cs}})
+		},
+	}
+	if !opts.SkipGenomes {
+		h.CompactGenome = func(cg *CompactGenome) error {
+			ent := &LibraryEntry{CompactGenomes: []CompactGenome{*cg}}
+			if opts.SkipGenomeVariants {
+				ent.CompactGenomes[0].Variants = nil
+			}
+			opts.filterTagRange(ent)
+			return cb(ent)
+		}
+	}
+	indexed, err := libio.ReadHeader(rs, h)
+	if err != nil || indexed {
+		return err
+	}
+	if _, err = rs.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return DecodeLibraryOptions(rs, gz, opts, cb)
+}
+
+// DecodeLibraryTagRange is like DecodeLibrary, but only passes
+// tile variants and (trimmed) genomes for tags in the range [start,
+// end) to cb. If the library file is indexed (see
+// libio.WriteIndexed), only the relevant parts of the file are
+// decompressed.
+func DecodeLibraryTagRange(rs io.ReadSeeker, start, end tagID, cb func(*LibraryEntry) error) error {
+	return libio.ReadTagRange(rs, start, end, libio.Handlers{
+		TagSet: func(tagset [][]byte) error {
+			return cb(&LibraryEntry{TagSet: tagset})
+		},
+		TileVariant: func(tv *TileVariant) error {
+			return cb(&LibraryEntry{TileVariants: []TileVariant{*tv}})
+		},
+		CompactGenome: func(cg *CompactGenome) error {
+			return cb(&LibraryEntry{CompactGenomes: []CompactGenome{*cg}})
+		},
+		CompactSequence: func(cs *CompactSequence) error {
+			return cb(&LibraryEntry{CompactSequences: []CompactSequence{*cs}})
+		},
+	})
+}
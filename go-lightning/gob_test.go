@@ -0,0 +1,113 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/arvados/lightning/go-lightning/libio"
+	"gopkg.in/check.v1"
+)
+
+type gobSuite struct{}
+
+var _ = check.Suite(&gobSuite{})
+
+func (s *gobSuite) encodeLibrary(c *check.C) []byte {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	c.Assert(enc.Encode(LibraryEntry{TagSet: [][]byte{[]byte("aaaa"), []byte("cccc"), []byte("gggg")}}), check.IsNil)
+	c.Assert(enc.Encode(LibraryEntry{TileVariants: []TileVariant{
+		{Tag: 0, Variant: 1, Sequence: []byte("aaaatttt")},
+		{Tag: 1, Variant: 1, Sequence: []byte("cccctttt"), Source: "x"},
+		{Tag: 2, Variant: 1, Sequence: []byte("ggggtttt")},
+	}}), check.IsNil)
+	c.Assert(enc.Encode(LibraryEntry{CompactGenomes: []CompactGenome{
+		{Name: "sample1", StartTag: 0, EndTag: 3, Variants: []tileVariantID{1, 1, 1, 1, 1, 1}},
+	}}), check.IsNil)
+	return buf.Bytes()
+}
+
+func (s *gobSuite) decode(c *check.C, data []byte, opts DecodeOptions) (tvs []TileVariant, cgs []CompactGenome, ntags int) {
+	err := DecodeLibraryOptions(bytes.NewReader(data), false, opts, func(ent *LibraryEntry) error {
+		tvs = append(tvs, ent.TileVariants...)
+		cgs = append(cgs, ent.CompactGenomes...)
+		ntags += len(ent.TagSet)
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	return
+}
+
+func (s *gobSuite) TestDecodeOptions(c *check.C) {
+	data := s.encodeLibrary(c)
+
+	tvs, cgs, ntags := s.decode(c, data, DecodeOptions{})
+	c.Check(tvs, check.HasLen, 3)
+	c.Check(string(tvs[1].Sequence), check.Equals, "cccctttt")
+	c.Check(cgs, check.HasLen, 1)
+	c.Check(cgs[0].Variants, check.HasLen, 6)
+	c.Check(ntags, check.Equals, 3)
+
+	tvs, cgs, ntags = s.decode(c, data, DecodeOptions{SkipSequences: true})
+	c.Check(tvs, check.HasLen, 3)
+	c.Check(tvs[1].Sequence, check.IsNil)
+	c.Check(tvs[1].Source, check.Equals, "x")
+	c.Check(cgs, check.HasLen, 1)
+	c.Check(ntags, check.Equals, 3)
+
+	tvs, cgs, _ = s.decode(c, data, DecodeOptions{SkipTileVariants: true, SkipGenomeVariants: true})
+	c.Check(tvs, check.HasLen, 0)
+	c.Check(cgs, check.HasLen, 1)
+	c.Check(cgs[0].Name, check.Equals, "sample1")
+	c.Check(cgs[0].Variants, check.IsNil)
+
+	tvs, cgs, ntags = s.decode(c, data, DecodeOptions{SkipTileVariants: true, SkipGenomes: true})
+	c.Check(tvs, check.HasLen, 0)
+	c.Check(cgs, check.HasLen, 0)
+	c.Check(ntags, check.Equals, 3)
+
+	tvs, cgs, _ = s.decode(c, data, DecodeOptions{StartTag: 1, EndTag: 2})
+	c.Assert(tvs, check.HasLen, 1)
+	c.Check(tvs[0].Tag, check.Equals, tagID(1))
+	c.Assert(cgs, check.HasLen, 1)
+	c.Check(cgs[0].StartTag, check.Equals, tagID(1))
+	c.Check(cgs[0].EndTag, check.Equals, tagID(2))
+	c.Check(cgs[0].Variants, check.DeepEquals, []tileVariantID{1, 1})
+}
+
+func (s *gobSuite) TestDecodeLibraryHeader(c *check.C) {
+	var indexed bytes.Buffer
+	err := libio.WriteIndexed(&indexed,
+		[][]byte{[]byte("aaaa"), []byte("cccc"), []byte("gggg")},
+		nil,
+		[]CompactGenome{{Name: "sample1", StartTag: 0, EndTag: 3, Variants: []tileVariantID{1, 1, 1, 1, 1, 1}}},
+		[]TileVariant{{Tag: 0, Variant: 1, Sequence: []byte("aaaatttt")}},
+		1)
+	c.Assert(err, check.IsNil)
+	for _, trial := range []struct {
+		data []byte
+		gz   bool
+	}{
+		{s.encodeLibrary(c), false},
+		{indexed.Bytes(), true},
+	} {
+		var ntvs, ntags int
+		var cgs []CompactGenome
+		err := DecodeLibraryHeader(bytes.NewReader(trial.data), trial.gz, DecodeOptions{SkipGenomeVariants: true}, func(ent *LibraryEntry) error {
+			ntvs += len(ent.TileVariants)
+			ntags += len(ent.TagSet)
+			cgs = append(cgs, ent.CompactGenomes...)
+			return nil
+		})
+		c.Check(err, check.IsNil)
+		c.Check(ntvs, check.Equals, 0)
+		c.Check(ntags, check.Equals, 3)
+		c.Assert(cgs, check.HasLen, 1)
+		c.Check(cgs[0].Name, check.Equals, "sample1")
+		c.Check(cgs[0].Variants, check.IsNil)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// gvcfRegionsParams determine which gVCF records are considered
+// called. This is a port of gvcf_regions.py (see ../gvcf_regions).
+type gvcfRegionsParams struct {
+	// Whether sites that don't appear in the gVCF are called
+	// (hom-ref), as in Complete Genomics output.
+	unreportedIsCalled bool
+	// Ignore lines containing any of these phrases.
+	ignorePhrases []string
+	// Minimum GQ for a record to be called (<0 = no minimum).
+	minGQ int
+	// Minimum QUAL for a record to be called (<0 = no minimum).
+	minQUAL float64
+	// If non-empty, a record must contain one of these phrases
+	// to be called.
+	passPhrases []string
+}
+
+// gvcfTypes are the presets for the vcf2fasta -gvcf-type flag.
+var gvcfTypes = map[string]gvcfRegionsParams{
+	"gatk": {
+		minGQ:   5,
+		minQUAL: -1,
+	},
+	"freebayes": {
+		minGQ:       -1,
+		minQUAL:     -1,
+		passPhrases: []string{"PASS"},
+	},
+	"complete_genomics": {
+		unreportedIsCalled: true,
+		ignorePhrases:      []string{"CNV", "INS:ME"},
+		minGQ:              -1,
+		minQUAL:            -1,
+		passPhrases:        []string{"PASS"},
+	},
+	"complete_genomics_pass_all": {
+		unreportedIsCalled: true,
+		ignorePhrases:      []string{"CNV", "INS:ME"},
+		minGQ:              -1,
+		minQUAL:            -1,
+	},
+	"": {
+		minGQ:   -1,
+		minQUAL: -1,
+	},
+}
+
+// gvcfRegions reads a gVCF file and writes the called regions to
+// bedw in BED format.
+func gvcfRegions(rdr io.Reader, bedw io.Writer, params gvcfRegionsParams) error {
+	var (
+		regionChrom   string
+		regionStart   int
+		prevBlockEnd  int
+		prevBlockCall bool
+	)
+	emit := func(end int) error {
+		_, err := fmt.Fprintf(bedw, "%s\t%d\t%d\n", regionChrom, regionStart, end)
+		return err
+	}
+	scanner := bufio.NewScanner(rdr)
+	scanner.Buffer(make([]byte, 1<<20), 1<<30)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Bytes()
+		if len(line) == 0 || line[0] == '#' || containsAny(line, params.ignorePhrases) {
+			continue
+		}
+		fields := bytes.Split(bytes.TrimRight(line, "\r"), []byte{'\t'})
+		if len(fields) < 8 {
+			return fmt.Errorf("line %d: expected at least 8 fields, found %d", lineno, len(fields))
+		}
+		chrom := string(fields[0])
+		lineStart, lineEnd, err := gvcfBedRegion(fields)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineno, err)
+		}
+		called := gvcfIsCalled(line, fields, params)
+
+		if regionChrom != chrom {
+			// We assume a chromosome starts and ends
+			// with a string of Ns.
+			if regionChrom != "" && prevBlockCall {
+				if err := emit(prevBlockEnd); err != nil {
+					return err
+				}
+			}
+			regionChrom = chrom
+			if called {
+				regionStart = lineStart
+				prevBlockCall = true
+			} else {
+				prevBlockCall = false
+			}
+			prevBlockEnd = lineEnd
+		} else if lineStart > prevBlockEnd {
+			// gap between previous block and this line
+			if prevBlockCall {
+				if params.unreportedIsCalled {
+					if !called {
+						if err := emit(lineStart); err != nil {
+							return err
+						}
+						prevBlockCall = false
+					}
+				} else {
+					if err := emit(prevBlockEnd); err != nil {
+						return err
+					}
+					if called {
+						regionStart = lineStart
+					} else {
+						prevBlockCall = false
+					}
+				}
+			} else {
+				if params.unreportedIsCalled {
+					regionStart = prevBlockEnd
+					if called {
+						prevBlockCall = true
+					} else if err := emit(lineStart); err != nil {
+						return err
+					}
+				} else if called {
+					regionStart = lineStart
+					prevBlockCall = true
+				}
+			}
+			prevBlockEnd = lineEnd
+		} else if lineStart == prevBlockEnd {
+			// back to back, no gap
+			if prevBlockCall && !called {
+				if err := emit(lineStart); err != nil {
+					return err
+				}
+				prevBlockCall = false
+			} else if !prevBlockCall && called {
+				regionStart = lineStart
+				prevBlockCall = true
+			}
+			prevBlockEnd = lineEnd
+		} else if prevBlockCall && called && lineEnd > prevBlockEnd {
+			// overlapping
+			prevBlockEnd = lineEnd
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if regionChrom != "" && prevBlockCall {
+		return emit(prevBlockEnd)
+	}
+	return nil
+}
+
+// gvcfBedRegion returns the BED (0-based, half-open) interval
+// covered by a gVCF record, using the END tag in the INFO field if
+// present.
+func gvcfBedRegion(fields [][]byte) (int, int, error) {
+	pos, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid POS %q", fields[1])
+	}
+	start := pos - 1
+	if pos == 0 {
+		start = 0
+	}
+	for _, info := range bytes.Split(fields[7], []byte{';'}) {
+		if bytes.HasPrefix(info, []byte("END=")) {
+			end, err := strconv.Atoi(string(info[4:]))
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid END %q", info[4:])
+			}
+			return start, end, nil
+		}
+	}
+	return start, pos - 1 + len(fields[3]), nil
+}
+
+func gvcfIsCalled(line []byte, fields [][]byte, params gvcfRegionsParams) bool {
+	if params.minGQ >= 0 {
+		gq, _ := strconv.Atoi(gvcfSampleField(fields, "GQ"))
+		if gq < params.minGQ {
+			return false
+		}
+	}
+	if params.minQUAL >= 0 {
+		qual, err := strconv.ParseFloat(string(fields[5]), 64)
+		if err != nil || qual < params.minQUAL {
+			return false
+		}
+	}
+	if len(params.passPhrases) > 0 && !containsAny(line, params.passPhrases) {
+		return false
+	}
+	return !strings.Contains(gvcfSampleField(fields, "GT"), ".")
+}
+
+// gvcfSampleField returns the value of the given FORMAT key for the
+// first sample, or "" if not present.
+func gvcfSampleField(fields [][]byte, key string) string {
+	if len(fields) < 10 {
+		return ""
+	}
+	sample := bytes.Split(fields[9], []byte{':'})
+	for i, k := range bytes.Split(fields[8], []byte{':'}) {
+		if string(k) == key {
+			if i < len(sample) {
+				return string(sample[i])
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+func containsAny(line []byte, phrases []string) bool {
+	for _, phrase := range phrases {
+		if bytes.Contains(line, []byte(phrase)) {
+			return true
+		}
+	}
+	return false
+}
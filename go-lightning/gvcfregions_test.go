@@ -0,0 +1,69 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type gvcfRegionsSuite struct{}
+
+var _ = check.Suite(&gvcfRegionsSuite{})
+
+// Expected outputs were generated by gvcf_regions.py.
+func (s *gvcfRegionsSuite) TestPresets(c *check.C) {
+	gvcf := `##fileformat=VCFv4.2
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	sample
+chr1	1	.	A	<NON_REF>	.	.	END=100	GT:GQ	0/0:30
+chr1	101	.	C	T	50	PASS	.	GT:GQ	0/1:40
+chr1	102	.	G	<NON_REF>	.	.	END=150	GT:GQ	0/0:3
+chr1	151	.	T	<NON_REF>	.	.	END=200	GT:GQ	0/0:20
+chr1	250	.	A	<NON_REF>	.	.	END=300	GT:GQ	./.:20
+chr1	301	.	ACGT	A	60	PASS	.	GT:GQ	1/1:60
+chr1	310	.	A	<NON_REF>	.	.	END=320	GT:GQ	0/0:99
+chr2	10	.	A	<NON_REF>	.	.	END=20	GT:GQ	0/0:10
+chr2	30	.	C	G	.	PASS	.	GT	1|0
+chr2	40	.	C	<CNV>	.	PASS	END=60	GT	1|0
+chr2	70	.	C	G	.	FAIL	.	GT	1|0
+`
+	for gvcfType, expect := range map[string]string{
+		"gatk":                       "chr1\t0\t101\nchr1\t150\t200\nchr1\t300\t304\nchr1\t309\t320\nchr2\t9\t20\n",
+		"freebayes":                  "chr1\t100\t101\nchr1\t300\t304\nchr2\t29\t30\nchr2\t39\t60\n",
+		"complete_genomics":          "chr1\t100\t101\nchr1\t200\t249\nchr1\t300\t309\nchr2\t20\t69\n",
+		"complete_genomics_pass_all": "chr1\t0\t249\nchr1\t300\t320\nchr2\t9\t70\n",
+	} {
+		c.Logf("gvcf type %s", gvcfType)
+		var bed bytes.Buffer
+		err := gvcfRegions(strings.NewReader(gvcf), &bed, gvcfTypes[gvcfType])
+		c.Check(err, check.IsNil)
+		c.Check(bed.String(), check.Equals, expect)
+	}
+}
+
+func (s *gvcfRegionsSuite) TestErrors(c *check.C) {
+	var bed bytes.Buffer
+	err := gvcfRegions(strings.NewReader("chr1\tx\t.\tA\t.\t.\t.\t.\n"), &bed, gvcfTypes["gatk"])
+	c.Check(err, check.ErrorMatches, `line 1: invalid POS "x"`)
+	err = gvcfRegions(strings.NewReader("chr1\t1\t.\n"), &bed, gvcfTypes["gatk"])
+	c.Check(err, check.ErrorMatches, `line 1: expected at least 8 fields, found 3`)
+	err = gvcfRegions(strings.NewReader(""), &bed, gvcfTypes["gatk"])
+	c.Check(err, check.IsNil)
+	c.Check(bed.String(), check.Equals, "")
+}
+
+func (s *gvcfRegionsSuite) TestBedComplement(c *check.C) {
+	regions := "chr1\t0\t101\nchr1\t150\t200\nchr1\t160\t180\nchr1\t190\t250\nchr1\t300\t400\nchr2\t9\t20\nchr3\t5\t10\n"
+	var out bytes.Buffer
+	err := bedComplement(strings.NewReader(regions), &out, map[string]int{"chr1": 1000, "chr2": 20, "chr4": 50})
+	c.Assert(err, check.IsNil)
+	c.Check(out.String(), check.Equals, "chr1\t101\t150\nchr1\t250\t300\nchr1\t400\t1000\nchr2\t0\t9\nchr3\t0\t5\n")
+
+	out.Reset()
+	err = bedComplement(strings.NewReader("chr1\t0\t10\nchr2\t0\t10\nchr1\t20\t30\n"), &out, nil)
+	c.Check(err, check.ErrorMatches, `line 3: .*chr1.*`)
+}
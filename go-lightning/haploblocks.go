@@ -0,0 +1,189 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kshedden/gonpy"
+	log "github.com/sirupsen/logrus"
+)
+
+// haplotypeBlocks exports, for each genome, the sequence of tile
+// variant IDs in each window of consecutive tags on each phase, as
+// a string ("1-3-1-2") or a hash of that string. Two haplotypes with
+// the same string (or hash) in a window have the same tile variants
+// at every tag in the window.
+type haplotypeBlocks struct {
+	window int    // tags per window, 0 = don't export
+	format string // "string" or "hash"
+}
+
+func (hb *haplotypeBlocks) Flags(flags *flag.FlagSet) {
+	flags.IntVar(&hb.window, "haplotype-blocks", 0, "also write haplotype block features for windows of `N` consecutive tags (0 = don't)")
+	flags.StringVar(&hb.format, "haplotype-block-format", "hash", "write haplotype blocks as `format` \"string\" (haplotype-blocks.csv) or \"hash\" (haplotype-blocks.npy)")
+}
+
+// Args returns command line arguments that reproduce the haplotype
+// block parameters (see Flags).
+func (hb *haplotypeBlocks) Args() []string {
+	return []string{
+		fmt.Sprintf("-haplotype-blocks=%d", hb.window),
+		"-haplotype-block-format=" + hb.format,
+	}
+}
+
+// Check returns an error if the flags are not valid.
+func (hb *haplotypeBlocks) Check() error {
+	if hb.window < 0 {
+		return fmt.Errorf("invalid -haplotype-blocks value %d: must not be negative", hb.window)
+	} else if hb.format != "string" && hb.format != "hash" {
+		return fmt.Errorf("invalid -haplotype-block-format %q: must be string or hash", hb.format)
+	}
+	return nil
+}
+
+// haplotypeWindows returns the [start, end) tag ranges of the
+// windows of the given size, skipping windows where all tags are
+// dropped.
+func haplotypeWindows(ntags, window int, dropTiles []bool) [][2]int {
+	var windows [][2]int
+	for start := 0; start < ntags; start += window {
+		end := start + window
+		if end > ntags {
+			end = ntags
+		}
+		for tag := start; tag < end; tag++ {
+			if tag >= len(dropTiles) || !dropTiles[tag] {
+				windows = append(windows, [2]int{start, end})
+				break
+			}
+		}
+	}
+	return windows
+}
+
+// haplotypeBlock returns the tile variant IDs of the given phase of
+// cg at the non-dropped tags in [start, end), joined by "-", or "" if
+// any of them is a no-call or low quality.
+func haplotypeBlock(cg []tileVariantID, phase, start, end int, lowqual []map[tileVariantID]bool, dropTiles []bool) string {
+	var buf []byte
+	for tag := start; tag < end; tag++ {
+		if tag < len(dropTiles) && dropTiles[tag] {
+			continue
+		}
+		if tag*2+phase >= len(cg) {
+			return ""
+		}
+		v := cg[tag*2+phase]
+		if v == 0 || (tag < len(lowqual) && lowqual[tag][v]) {
+			return ""
+		}
+		if len(buf) > 0 {
+			buf = append(buf, '-')
+		}
+		buf = strconv.AppendInt(buf, int64(v), 10)
+	}
+	return string(buf)
+}
+
+// haplotypeBlockHash returns a 64-bit hash of a haplotype block
+// string, or 0 if the string is empty (no-call).
+func haplotypeBlockHash(s string) int64 {
+	if s == "" {
+		return 0
+	}
+	h := fnv.New64a()
+	io.WriteString(h, s)
+	if sum := int64(h.Sum64()); sum != 0 {
+		return sum
+	}
+	return 1
+}
+
+// Write writes haplotype-block-windows.csv and either
+// haplotype-blocks.csv or haplotype-blocks.npy to outputDir. Rows
+// are in the same order as names; in the numpy matrix, window w
+// phase p is column 2w+p.
+func (hb *haplotypeBlocks) Write(outputDir string, tilelib *tileLibrary, names []string, lowqual []map[tileVariantID]bool, dropTiles []bool) error {
+	if hb.window == 0 {
+		return nil
+	}
+	windows := haplotypeWindows(len(tilelib.variant), hb.window, dropTiles)
+	log.Infof("writing haplotype blocks (%d windows of %d tags, format %s)", len(windows), hb.window, hb.format)
+	var buf strings.Builder
+	buf.WriteString("Window,StartTag,EndTag\n")
+	for w, win := range windows {
+		fmt.Fprintf(&buf, "%d,%d,%d\n", w, win[0], win[1])
+	}
+	err := os.WriteFile(outputDir+"/haplotype-block-windows.csv", []byte(buf.String()), 0666)
+	if err != nil {
+		return err
+	}
+
+	if hb.format == "hash" {
+		data := make([]int64, len(names)*len(windows)*2)
+		for row, name := range names {
+			cg := tilelib.compactGenomes[name]
+			for w, win := range windows {
+				for phase := 0; phase < 2; phase++ {
+					data[(row*len(windows)+w)*2+phase] = haplotypeBlockHash(haplotypeBlock(cg, phase, win[0], win[1], lowqual, dropTiles))
+				}
+			}
+		}
+		f, err := os.Create(outputDir + "/haplotype-blocks.npy")
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		bufw := bufio.NewWriter(f)
+		npw, err := gonpy.NewWriter(nopCloser{bufw})
+		if err != nil {
+			return err
+		}
+		npw.Shape = []int{len(names), len(windows) * 2}
+		err = npw.WriteInt64(data)
+		if err != nil {
+			return err
+		}
+		err = bufw.Flush()
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	f, err := os.Create(outputDir + "/haplotype-blocks.csv")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriterSize(f, 1<<20)
+	fmt.Fprint(bufw, "Label,Window,Haplotype1,Haplotype2\n")
+	for _, name := range names {
+		cg := tilelib.compactGenomes[name]
+		label := trimFilenameForLabel(name)
+		for w, win := range windows {
+			_, err = fmt.Fprintf(bufw, "%s,%d,%s,%s\n", label, w,
+				haplotypeBlock(cg, 0, win[0], win[1], lowqual, dropTiles),
+				haplotypeBlock(cg, 1, win[0], win[1], lowqual, dropTiles))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
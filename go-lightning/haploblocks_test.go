@@ -0,0 +1,46 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"gopkg.in/check.v1"
+)
+
+type haploBlocksSuite struct{}
+
+var _ = check.Suite(&haploBlocksSuite{})
+
+func (s *haploBlocksSuite) TestWindows(c *check.C) {
+	c.Check(haplotypeWindows(7, 3, nil), check.DeepEquals, [][2]int{{0, 3}, {3, 6}, {6, 7}})
+	c.Check(haplotypeWindows(7, 3, []bool{false, false, false, true, true, true}), check.DeepEquals, [][2]int{{0, 3}, {6, 7}})
+}
+
+func (s *haploBlocksSuite) TestBlocks(c *check.C) {
+	// tags 0..3, phases interleaved
+	cg := []tileVariantID{1, 2, 3, 1, 1, 0, 2, 4}
+	lowqual := []map[tileVariantID]bool{nil, nil, nil, {4: true}}
+	c.Check(haplotypeBlock(cg, 0, 0, 2, lowqual, nil), check.Equals, "1-3")
+	c.Check(haplotypeBlock(cg, 1, 0, 2, lowqual, nil), check.Equals, "2-1")
+	c.Check(haplotypeBlock(cg, 0, 2, 4, lowqual, nil), check.Equals, "1-2")
+	// no-call at tag 2 phase 1, low quality at tag 3 phase 1
+	c.Check(haplotypeBlock(cg, 1, 2, 3, lowqual, nil), check.Equals, "")
+	c.Check(haplotypeBlock(cg, 1, 3, 4, lowqual, nil), check.Equals, "")
+	// dropped tags are skipped
+	c.Check(haplotypeBlock(cg, 1, 0, 4, lowqual, []bool{false, false, true, true}), check.Equals, "2-1")
+	// short genome (tags beyond end of cg) is a no-call
+	c.Check(haplotypeBlock(cg, 0, 3, 5, lowqual, nil), check.Equals, "")
+
+	c.Check(haplotypeBlockHash(""), check.Equals, int64(0))
+	c.Check(haplotypeBlockHash("1-3"), check.Not(check.Equals), int64(0))
+	c.Check(haplotypeBlockHash("1-3"), check.Equals, haplotypeBlockHash("1-3"))
+	c.Check(haplotypeBlockHash("1-3"), check.Not(check.Equals), haplotypeBlockHash("13"))
+}
+
+func (s *haploBlocksSuite) TestCheck(c *check.C) {
+	c.Check((&haplotypeBlocks{window: 10, format: "hash"}).Check(), check.IsNil)
+	c.Check((&haplotypeBlocks{window: 10, format: "string"}).Check(), check.IsNil)
+	c.Check((&haplotypeBlocks{window: -1, format: "hash"}).Check(), check.ErrorMatches, `invalid -haplotype-blocks.*`)
+	c.Check((&haplotypeBlocks{window: 10, format: "hex"}).Check(), check.ErrorMatches, `invalid -haplotype-block-format.*`)
+}
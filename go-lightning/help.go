@@ -0,0 +1,216 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// commandSummaries has a one-line description of each subcommand
+// in handler, for "lightning help" and "lightning commands".
+var commandSummaries = map[string]string{
+	"version":            "print version information",
+	"ref2genome":         "convert a reference fasta file to a genome (gob) file",
+	"vcf2fasta":          "convert VCF files to per-haplotype fasta files",
+	"import":             "tile fasta, VCF, or PGEN genomes and write a tile library",
+	"annotate":           "write HGVS annotations for tile variants in a library",
+	"export":             "export genomes from a library to VCF/pVCF/HGVS files",
+	"export-numpy":       "export a tile variant matrix from a library to numpy files",
+	"flake":              "filter a library and write the result as a new library",
+	"slice":              "split libraries into chunks by tag, for slice-numpy",
+	"slice-numpy":        "build tile variant, one-hot, and HGVS matrices from sliced libraries",
+	"concat-matrix":      "stitch slice-numpy chunk matrices together and map tags to matrix columns",
+	"tiling-stats":       "write per-tile statistics and a bed file of tile positions",
+	"anno2vcf":           "convert annotation csv files to VCF",
+	"numpy-comvar":       "list common variants in an exported numpy matrix",
+	"filter":             "remove tile variants and genomes from a library by coverage, frequency, or name",
+	"build-docker-image": "build the lightning-runtime docker image used by plot commands",
+	"plot":               "plot PCA results (same as pca-plot)",
+	"pca-plot":           "plot PCA results",
+	"manhattan-plot":     "plot a Manhattan plot of slice-numpy p-values",
+	"manhattan-data":     "write sorted p-value tables and Manhattan/QQ plot images from slice-numpy output",
+	"diff-fasta":         "compare two fasta files and print HGVS differences",
+	"stats":              "print summary statistics about a library",
+	"merge":              "merge multiple libraries into one",
+	"dump":               "write a tile variant table (with sequences) from a library",
+	"dumpgob":            "print the raw contents of a library file",
+	"extract-sample":     "write a minimal library containing a single genome",
+	"extract-regions":    "write a library containing only the tags in given regions",
+	"refs":               "list the reference sequences in a library",
+	"info":               "print a JSON summary of a library (samples, tags, variants, references)",
+	"tile-alignment":     "show all variants of a tile aligned against the reference",
+	"choose-samples":     "assign samples to training/validation sets and write samples.csv",
+	"verify-manifest":    "check output files against a manifest.json (and signature)",
+	"retile":             "re-tile an existing library using a different tag set",
+	"private-variants":   "find tile variants that occur only in a given group of samples",
+	"mendel":             "check trios for Mendelian inconsistencies",
+	"phasing-stats":      "compare sample phasing against a truth set",
+	"fetch-output":       "download the output of a finished container request",
+	"fetch-ref":          "download and normalize a reference genome",
+	"plan":               "check the flags and inputs of a multi-step plan without running it",
+	"collapse":           "replace rare tile variants with near-identical common variants",
+	"train":              "fit a logistic regression model on one-hot slice-numpy output",
+	"ibd":                "find long runs of identical tile variants shared by pairs of haplotypes",
+	"cnv":                "find candidate deletions from runs of no-calls and short spanning tiles in each genome",
+	"clinical-report":    "list ClinVar pathogenic variants carried by each sample, with zygosity (JSON/HTML)",
+	"help":               "show a command's description and flags",
+	"commands":           "list all commands and their flags (optionally as JSON)",
+}
+
+// commandInfo describes a subcommand and its flags, as reported by
+// "lightning commands -json".
+type commandInfo struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Flags       []flagInfo `json:"flags"` // nil if the command's flags cannot be inspected
+}
+
+type flagInfo struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"` // "bool", "string", "int", "duration", etc.
+	Default string `json:"default"`
+	Usage   string `json:"usage"`
+}
+
+// commandFlags returns the flags accepted by the named command,
+// without running it, or nil if the command doesn't parse its flags
+// with parseFlags (see plan).
+func commandFlags(name string) []flagInfo {
+	h, ok := handler[name]
+	if !ok || planUnsupported[name] {
+		return nil
+	}
+	planned := inspectFlags(h, "lightning "+name, []string{"-help"})
+	if planned.flags == nil {
+		return nil
+	}
+	flags := []flagInfo{}
+	planned.flags.VisitAll(func(f *flag.Flag) {
+		typ, usage := flag.UnquoteUsage(f)
+		if typ == "" {
+			typ = "bool"
+		}
+		flags = append(flags, flagInfo{
+			Name:    f.Name,
+			Type:    typ,
+			Default: f.DefValue,
+			Usage:   usage,
+		})
+	})
+	return flags
+}
+
+// commandNames returns the names of all subcommands, sorted, not
+// including the "-version" and "--version" aliases.
+func commandNames() []string {
+	var names []string
+	for name := range handler {
+		if name[0] != '-' {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+type helpcmd struct{}
+
+func (cmd *helpcmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s [command]\n", prog)
+	}
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 1 {
+		flags.Usage()
+		return 2
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprintf(stdout, "usage: lightning command [options]\n\ncommands:\n")
+		tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+		for _, name := range commandNames() {
+			fmt.Fprintf(tw, "  %s\t%s\n", name, commandSummaries[name])
+		}
+		tw.Flush()
+		fmt.Fprintf(stdout, "\nRun \"lightning help command\" for the options accepted by a command.\n")
+		return 0
+	}
+	name := flags.Arg(0)
+	h, ok := handler[name]
+	if !ok {
+		err = fmt.Errorf("unknown command %q (run \"lightning help\" for a list of commands)", name)
+		return 2
+	}
+	fmt.Fprintf(stdout, "lightning %s: %s\n\n", name, commandSummaries[name])
+	if planUnsupported[name] {
+		return 0
+	}
+	// The command prints its own usage message (to the "stderr"
+	// we pass it) when given -help.
+	h.RunCommand("lightning "+name, []string{"-help"}, nil, stdout, stdout)
+	return 0
+}
+
+type commandscmd struct{}
+
+func (cmd *commandscmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	asJSON := flags.Bool("json", false, "print commands, descriptions, and flags as JSON")
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	}
+	if !*asJSON {
+		for _, name := range commandNames() {
+			fmt.Fprintln(stdout, name)
+		}
+		return 0
+	}
+	var cmds []commandInfo
+	for _, name := range commandNames() {
+		cmds = append(cmds, commandInfo{
+			Name:        name,
+			Description: commandSummaries[name],
+			Flags:       commandFlags(name),
+		})
+	}
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(cmds)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
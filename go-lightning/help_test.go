@@ -0,0 +1,72 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type helpSuite struct{}
+
+var _ = check.Suite(&helpSuite{})
+
+func (s *helpSuite) TestAllCommandsHaveSummaries(c *check.C) {
+	for _, name := range commandNames() {
+		c.Check(commandSummaries[name], check.Not(check.Equals), "", check.Commentf("command %q", name))
+	}
+	for name := range commandSummaries {
+		_, ok := handler[name]
+		c.Check(ok, check.Equals, true, check.Commentf("summary for nonexistent command %q", name))
+	}
+}
+
+func (s *helpSuite) TestHelpList(c *check.C) {
+	var stdout bytes.Buffer
+	exited := (&helpcmd{}).RunCommand("lightning help", nil, nil, &stdout, os.Stderr)
+	c.Check(exited, check.Equals, 0)
+	c.Check(stdout.String(), check.Matches, `(?ms).*\n  slice-numpy +build tile variant.*`)
+	c.Check(stdout.String(), check.Not(check.Matches), `(?ms).*--version.*`)
+}
+
+func (s *helpSuite) TestHelpCommand(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	exited := (&helpcmd{}).RunCommand("lightning help", []string{"slice-numpy"}, nil, &stdout, &stderr)
+	c.Check(exited, check.Equals, 0)
+	c.Check(stdout.String(), check.Matches, `(?ms)lightning slice-numpy: build tile variant.*\n.*-merge-output\n.*`)
+
+	exited = (&helpcmd{}).RunCommand("lightning help", []string{"nonexistent"}, nil, &stdout, &stderr)
+	c.Check(exited, check.Equals, 2)
+	c.Check(stderr.String(), check.Matches, `unknown command "nonexistent".*\n`)
+}
+
+func (s *helpSuite) TestCommandsJSON(c *check.C) {
+	var stdout bytes.Buffer
+	exited := (&commandscmd{}).RunCommand("lightning commands", []string{"-json"}, nil, &stdout, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	var cmds []commandInfo
+	err := json.Unmarshal(stdout.Bytes(), &cmds)
+	c.Assert(err, check.IsNil)
+	found := map[string]commandInfo{}
+	for _, ci := range cmds {
+		found[ci.Name] = ci
+	}
+	c.Check(found["version"].Flags, check.IsNil)
+	flags := map[string]flagInfo{}
+	for _, f := range found["slice-numpy"].Flags {
+		flags[f.Name] = f
+	}
+	c.Check(flags["merge-output"], check.DeepEquals, flagInfo{Name: "merge-output", Type: "bool", Default: "false", Usage: "merge output into one matrix.npy and one matrix.annotations.csv"})
+	c.Check(flags["threads"].Type, check.Equals, "int")
+	c.Check(flags["input-dir"].Type, check.Equals, "directory")
+
+	stdout.Reset()
+	exited = (&commandscmd{}).RunCommand("lightning commands", nil, nil, &stdout, os.Stderr)
+	c.Check(exited, check.Equals, 0)
+	c.Check(stdout.String(), check.Matches, `(?ms).*\nslice-numpy\n.*`)
+}
@@ -0,0 +1,236 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Haploid chromosome (e.g., chrM) support for "lightning import".
+//
+// A genome's tile variants on a haploid chromosome are coded in both
+// phases, so downstream tools see the chromosome as homozygous
+// unless told otherwise (see -haploid-chromosome in export and
+// slice-numpy). With -heteroplasmy-min-af, the first phase is the
+// major haplotype and the second phase is the secondary haplotype,
+// built from the allele fractions in the input VCF.
+
+// majorAF is the minimum allele fraction of a variant in the major
+// haplotype.
+const majorAF = 0.5
+
+// haploidVariant is a variant on a haploid chromosome, with the
+// fraction of reads that support the alt allele.
+type haploidVariant struct {
+	pos int // 1-based position
+	ref []byte
+	alt []byte
+	af  float64
+}
+
+// readHaploidVariants returns the first sample's variants on the
+// chromosomes in VCF data that match re, sorted by position. The
+// allele fraction of each alt allele is taken from FORMAT/AF if
+// present, otherwise from the number of copies in GT (e.g., 1 for
+// "1", 0.5 for "0/1").
+func readHaploidVariants(rdr io.Reader, re *regexp.Regexp) (map[string][]haploidVariant, error) {
+	variants := map[string][]haploidVariant{}
+	scanner := bufio.NewScanner(rdr)
+	scanner.Buffer(make([]byte, 1<<20), 1<<30)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Bytes()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := bytes.Split(line, []byte{'\t'})
+		if len(fields) < 10 || !re.Match(fields[0]) {
+			continue
+		}
+		pos, err := strconv.Atoi(string(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid position %q", lineno, fields[1])
+		}
+		alts := strings.Split(string(fields[4]), ",")
+		afs := make([]float64, len(alts))
+		gtIdx, afIdx := -1, -1
+		for i, key := range bytes.Split(fields[8], []byte{':'}) {
+			switch string(key) {
+			case "GT":
+				gtIdx = i
+			case "AF":
+				afIdx = i
+			}
+		}
+		sample := bytes.Split(fields[9], []byte{':'})
+		if afIdx >= 0 && afIdx < len(sample) && string(sample[afIdx]) != "." {
+			for i, af := range strings.Split(string(sample[afIdx]), ",") {
+				if i >= len(afs) {
+					break
+				}
+				afs[i], err = strconv.ParseFloat(af, 64)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid AF %q", lineno, sample[afIdx])
+				}
+			}
+		} else if gtIdx >= 0 && gtIdx < len(sample) {
+			alleles := strings.FieldsFunc(string(sample[gtIdx]), func(r rune) bool { return r == '/' || r == '|' })
+			for _, a := range alleles {
+				if i, err := strconv.Atoi(a); err == nil && i > 0 && i <= len(afs) {
+					afs[i-1] += 1 / float64(len(alleles))
+				}
+			}
+		}
+		chrom := string(fields[0])
+		for i, alt := range alts {
+			if afs[i] <= 0 || !isPlainAllele(alt) || !isPlainAllele(string(fields[3])) {
+				continue
+			}
+			variants[chrom] = append(variants[chrom], haploidVariant{
+				pos: pos,
+				ref: bytes.ToLower(fields[3]),
+				alt: bytes.ToLower([]byte(alt)),
+				af:  afs[i],
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, vs := range variants {
+		sort.SliceStable(vs, func(i, j int) bool { return vs[i].pos < vs[j].pos })
+	}
+	return variants, nil
+}
+
+// haploidVariantsFor returns the variants for the given reference
+// sequence, allowing for the presence/absence of a "chr" prefix.
+func haploidVariantsFor(variants map[string][]haploidVariant, seqname string) []haploidVariant {
+	for _, try := range []string{seqname, "chr" + seqname, strings.TrimPrefix(seqname, "chr")} {
+		if vs, ok := variants[try]; ok {
+			return vs
+		}
+	}
+	return nil
+}
+
+// applyHaploidVariants returns a copy of refseq with the variants
+// whose allele fraction is at least minAF applied. Variants that
+// overlap an already-applied variant, or whose REF allele does not
+// match refseq, are skipped.
+func applyHaploidVariants(refseq []byte, variants []haploidVariant, minAF float64) (seq []byte, skipped int) {
+	seq = make([]byte, 0, len(refseq))
+	cursor := 0
+	for _, v := range variants {
+		if v.af < minAF {
+			continue
+		}
+		p := v.pos - 1
+		if p < cursor || p+len(v.ref) > len(refseq) || !bytes.Equal(refseq[p:p+len(v.ref)], v.ref) {
+			skipped++
+			continue
+		}
+		seq = append(seq, refseq[cursor:p]...)
+		seq = append(seq, v.alt...)
+		cursor = p + len(v.ref)
+	}
+	return append(seq, refseq[cursor:]...), skipped
+}
+
+// heteroplasmyFractions returns, for each tag on refseq whose tile
+// contains a secondary variant (allele fraction at least minAF but
+// less than majorAF), the highest allele fraction of those variants.
+func heteroplasmyFractions(taglib *tagLibrary, refseq []byte, variants []haploidVariant, minAF float64) (map[tagID]float32, error) {
+	type foundtag struct {
+		tag tagID
+		pos int
+	}
+	var found []foundtag
+	err := taglib.FindAll(bufio.NewReader(bytes.NewReader(refseq)), nil, func(tag tagID, pos, taglen int) {
+		found = append(found, foundtag{tag, pos})
+	})
+	if err != nil {
+		return nil, err
+	}
+	fractions := map[tagID]float32{}
+	record := func(tag tagID, af float64) {
+		if fractions[tag] < float32(af) {
+			fractions[tag] = float32(af)
+		}
+	}
+	for _, v := range variants {
+		if v.af < minAF || v.af >= majorAF {
+			continue
+		}
+		p := v.pos - 1
+		i := sort.Search(len(found), func(i int) bool { return found[i].pos > p }) - 1
+		if i < 0 {
+			continue
+		}
+		record(found[i].tag, v.af)
+		if i > 0 && p < found[i].pos+taglib.TagLen(found[i].tag) {
+			// variant is in the tag at the end of the
+			// previous tile, too
+			record(found[i-1].tag, v.af)
+		}
+	}
+	return fractions, nil
+}
+
+// haploidCalls holds a genome's tile variants on haploid
+// chromosomes.
+type haploidCalls struct {
+	tags []tagID // tags on haploid chromosomes in the first haplotype
+
+	// The following are only populated with
+	// -heteroplasmy-min-af (vcf inputs).
+	major     []tileVariantID // major[tag] is the major haplotype's tile variant
+	secondary []tileVariantID // secondary[tag] is the secondary haplotype's tile variant
+	fractions map[tagID]float32
+}
+
+// apply updates the given per-phase variants so the tile variants on
+// haploid chromosomes are coded in both phases, or (if there are
+// major and secondary haplotypes) so the first phase holds the major
+// haplotype and the second phase holds the secondary haplotype. It
+// returns the tags where the secondary tile variant differs from the
+// major tile variant.
+func (hc *haploidCalls) apply(variants [][]tileVariantID) []Heteroplasmy {
+	set := func(phase int, tag tagID, v tileVariantID) {
+		for len(variants[phase]) <= int(tag) {
+			variants[phase] = append(variants[phase], 0)
+		}
+		variants[phase][tag] = v
+	}
+	for _, tag := range hc.tags {
+		var v tileVariantID
+		if int(tag) < len(variants[0]) {
+			v = variants[0][tag]
+		}
+		set(1, tag, v)
+	}
+	var het []Heteroplasmy
+	for tag, v := range hc.major {
+		if v == 0 {
+			continue
+		}
+		set(0, tagID(tag), v)
+		sv := v
+		if tag < len(hc.secondary) && hc.secondary[tag] > 0 {
+			sv = hc.secondary[tag]
+		}
+		set(1, tagID(tag), sv)
+		if sv != v {
+			het = append(het, Heteroplasmy{Tag: tagID(tag), Fraction: hc.fractions[tagID(tag)]})
+		}
+	}
+	return het
+}
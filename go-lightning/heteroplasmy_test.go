@@ -0,0 +1,81 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"regexp"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type heteroplasmySuite struct{}
+
+var _ = check.Suite(&heteroplasmySuite{})
+
+const heteroplasmyTestVCF = `##fileformat=VCFv4.2
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	sample
+chr1	3	.	A	G	.	PASS	.	GT:AF	0/1:0.5
+chrM	3	.	A	G	.	PASS	.	GT:AF	1:0.98
+chrM	5	.	C	T	.	PASS	.	GT:AF	0/1:0.2
+chrM	7	.	G	A,C	.	PASS	.	GT:AF	1/2:0.6,0.3
+chrM	9	.	T	<DEL>	.	PASS	.	GT	1
+chrM	11	.	A	T	.	PASS	.	GT	1
+`
+
+func (s *heteroplasmySuite) TestReadHaploidVariants(c *check.C) {
+	variants, err := readHaploidVariants(strings.NewReader(heteroplasmyTestVCF), regexp.MustCompile(`^(chr)?MT?$`))
+	c.Assert(err, check.IsNil)
+	c.Check(variants, check.HasLen, 1)
+	c.Check(variants["chrM"], check.DeepEquals, []haploidVariant{
+		{pos: 3, ref: []byte("a"), alt: []byte("g"), af: 0.98},
+		{pos: 5, ref: []byte("c"), alt: []byte("t"), af: 0.2},
+		{pos: 7, ref: []byte("g"), alt: []byte("a"), af: 0.6},
+		{pos: 7, ref: []byte("g"), alt: []byte("c"), af: 0.3},
+		{pos: 11, ref: []byte("a"), alt: []byte("t"), af: 1},
+	})
+	c.Check(haploidVariantsFor(variants, "M"), check.HasLen, 5)
+	c.Check(haploidVariantsFor(variants, "chr1"), check.IsNil)
+
+	refseq := []byte("ttatcaggtta")
+	major, skipped := applyHaploidVariants(refseq, variants["chrM"], majorAF)
+	c.Check(string(major), check.Equals, "ttgtcaagttt")
+	c.Check(skipped, check.Equals, 0)
+	secondary, skipped := applyHaploidVariants(refseq, variants["chrM"], 0.1)
+	c.Check(string(secondary), check.Equals, "ttgttaagttt")
+	c.Check(skipped, check.Equals, 1)
+}
+
+func (s *heteroplasmySuite) TestHeteroplasmyFractions(c *check.C) {
+	taglib := &tagLibrary{}
+	err := taglib.setTags([][]byte{[]byte("ggggccccaaaa"), []byte("ttttggggcccc")})
+	c.Assert(err, check.IsNil)
+	refseq := []byte("ggggccccaaaa" + "acacacacac" + "ttttggggcccc" + "tgtgtgtgtg")
+	fractions, err := heteroplasmyFractions(taglib, refseq, []haploidVariant{
+		{pos: 15, af: 0.2},
+		{pos: 25, af: 0.3}, // in tag 1, which is also the end of tile 0
+		{pos: 30, af: 0.9}, // major variant
+		{pos: 40, af: 0.05},
+	}, 0.1)
+	c.Assert(err, check.IsNil)
+	c.Check(fractions, check.DeepEquals, map[tagID]float32{0: 0.3, 1: 0.3})
+}
+
+func (s *heteroplasmySuite) TestApply(c *check.C) {
+	hc := &haploidCalls{tags: []tagID{2, 3}}
+	variants := [][]tileVariantID{{1, 1, 4, 4}, {1, 2, 9}}
+	c.Check(hc.apply(variants), check.HasLen, 0)
+	c.Check(variants, check.DeepEquals, [][]tileVariantID{{1, 1, 4, 4}, {1, 2, 4, 4}})
+
+	hc = &haploidCalls{
+		tags:      []tagID{2, 3},
+		major:     []tileVariantID{0, 0, 5, 6},
+		secondary: []tileVariantID{0, 0, 5, 7},
+		fractions: map[tagID]float32{3: 0.25},
+	}
+	variants = [][]tileVariantID{{1, 1, 4, 4}, {1, 2, 9}}
+	c.Check(hc.apply(variants), check.DeepEquals, []Heteroplasmy{{Tag: 3, Fraction: 0.25}})
+	c.Check(variants, check.DeepEquals, [][]tileVariantID{{1, 1, 5, 6}, {1, 2, 5, 7}})
+}
@@ -0,0 +1,319 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// hgvsKey identifies a variant by its reference coordinates and
+// alleles, regardless of how its HGVS ID is formatted.
+type hgvsKey struct {
+	seqname string
+	pos     int
+	ref     string
+	alt     string
+}
+
+func (k hgvsKey) less(other hgvsKey) bool {
+	if k.seqname != other.seqname {
+		return k.seqname < other.seqname
+	} else if k.pos != other.pos {
+		return k.pos < other.pos
+	} else if k.ref != other.ref {
+		return k.ref < other.ref
+	} else {
+		return k.alt < other.alt
+	}
+}
+
+// hgvsMatrix accumulates the columns of the single hgvs-based matrix
+// (one pair of columns per distinct variant, one column per phase)
+// in a temporary file, instead of keeping them all in memory until
+// the matrix is written.
+//
+// Column values are -1 (no data), 0 (ref), or 1 (variant present),
+// stored as int8. If the same variant is added more than once (e.g.,
+// it is in the overlapping part of tiles that were processed in
+// different chunks), the stored columns are combined by taking the
+// maximum value in each row.
+type hgvsMatrix struct {
+	rows   int
+	tmp    *os.File
+	bufw   *bufio.Writer
+	size   int64
+	cols   map[hgvsKey]*hgvsMatrixCol
+	idKeys map[string]hgvsKey
+}
+
+type hgvsMatrixCol struct {
+	id      string
+	offsets []int64 // positions of stored column pairs in tmp
+}
+
+// newHGVSMatrix returns a new hgvsMatrix with the given number of
+// rows, using a temporary file with the given name. The caller must
+// call Close to delete the temporary file.
+func newHGVSMatrix(tmpfnm string, rows int) (*hgvsMatrix, error) {
+	f, err := os.OpenFile(tmpfnm, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &hgvsMatrix{
+		rows:   rows,
+		tmp:    f,
+		bufw:   bufio.NewWriterSize(f, 1<<24),
+		cols:   map[hgvsKey]*hgvsMatrixCol{},
+		idKeys: map[string]hgvsKey{},
+	}, nil
+}
+
+// Add stores a column pair for the given variant. It returns an
+// error if id was previously added with a different key, or key was
+// previously added with a different id.
+func (m *hgvsMatrix) Add(key hgvsKey, id string, colpair [2][]int16) error {
+	if other, ok := m.idKeys[id]; ok && other != key {
+		return fmt.Errorf("hgvs ID %q refers to two different variants: %+v and %+v", id, other, key)
+	}
+	col := m.cols[key]
+	if col == nil {
+		col = &hgvsMatrixCol{id: id}
+		m.cols[key] = col
+		m.idKeys[id] = key
+	} else if col.id != id {
+		return fmt.Errorf("variant %+v has two different hgvs IDs: %q and %q", key, col.id, id)
+	}
+	col.offsets = append(col.offsets, m.size)
+	for _, phcol := range colpair {
+		if len(phcol) != m.rows {
+			return fmt.Errorf("bug: hgvs column has %d rows, expected %d", len(phcol), m.rows)
+		}
+		for _, v := range phcol {
+			err := m.bufw.WriteByte(byte(int8(v)))
+			if err != nil {
+				return err
+			}
+		}
+		m.size += int64(m.rows)
+	}
+	return nil
+}
+
+// Len returns the number of distinct variants added so far.
+func (m *hgvsMatrix) Len() int {
+	return len(m.cols)
+}
+
+// sortedCols returns the stored columns sorted by variant key, and
+// flushes buffered data to the temporary file.
+func (m *hgvsMatrix) sortedCols() ([]*hgvsMatrixCol, error) {
+	err := m.bufw.Flush()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]hgvsKey, 0, len(m.cols))
+	for key := range m.cols {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+	cols := make([]*hgvsMatrixCol, len(keys))
+	for i, key := range keys {
+		cols[i] = m.cols[key]
+	}
+	return cols, nil
+}
+
+// keyCols returns the stored columns for the given keys, in the
+// given order, and flushes buffered data to the temporary file. Keys
+// that were never added get an empty column (see fill).
+func (m *hgvsMatrix) keyCols(keys []hgvsKey) ([]*hgvsMatrixCol, error) {
+	err := m.bufw.Flush()
+	if err != nil {
+		return nil, err
+	}
+	cols := make([]*hgvsMatrixCol, len(keys))
+	for i, key := range keys {
+		cols[i] = m.cols[key]
+		if cols[i] == nil {
+			cols[i] = &hgvsMatrixCol{}
+		}
+	}
+	return cols, nil
+}
+
+// fill copies rows [r0, r1) of the matrix into out, which has
+// (r1-r0)*len(cols)*2 elements. Columns with no stored data are
+// filled with -1.
+func (m *hgvsMatrix) fill(out []int16, cols []*hgvsMatrixCol, r0, r1 int) error {
+	ncols := len(cols) * 2
+	buf := make([]byte, r1-r0)
+	for idx, col := range cols {
+		for ph := 0; ph < 2; ph++ {
+			if len(col.offsets) == 0 {
+				for row := 0; row < r1-r0; row++ {
+					out[row*ncols+idx*2+ph] = -1
+				}
+			}
+			for i, offset := range col.offsets {
+				_, err := m.tmp.ReadAt(buf, offset+int64(ph*m.rows+r0))
+				if err != nil {
+					return err
+				}
+				for row, b := range buf {
+					v := int16(int8(b))
+					p := &out[row*ncols+idx*2+ph]
+					if i == 0 || v > *p {
+						*p = v
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Matrix returns the whole matrix (rows x 2*Len(), row-major) and
+// the hgvs ID of each column pair.
+func (m *hgvsMatrix) Matrix() ([]int16, []string, error) {
+	cols, err := m.sortedCols()
+	if err != nil {
+		return nil, nil, err
+	}
+	out := make([]int16, m.rows*len(cols)*2)
+	err = m.fill(out, cols, 0, m.rows)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, hgvsMatrixIDs(cols), nil
+}
+
+// WriteNumpy writes the matrix to a .npy file, building at most
+// approximately maxBytes of it in memory at a time, and returns the
+// hgvs ID of each column pair.
+func (m *hgvsMatrix) WriteNumpy(fnm string, maxBytes int) ([]string, error) {
+	cols, err := m.sortedCols()
+	if err != nil {
+		return nil, err
+	}
+	err = m.writeNumpy(fnm, cols, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	return hgvsMatrixIDs(cols), nil
+}
+
+// WriteNumpyKeys is like WriteNumpy, but the output has one column
+// pair for each of the given keys, in the given order, whether or
+// not it was added.
+func (m *hgvsMatrix) WriteNumpyKeys(fnm string, keys []hgvsKey, maxBytes int) error {
+	cols, err := m.keyCols(keys)
+	if err != nil {
+		return err
+	}
+	return m.writeNumpy(fnm, cols, maxBytes)
+}
+
+func (m *hgvsMatrix) writeNumpy(fnm string, cols []*hgvsMatrixCol, maxBytes int) error {
+	ncols := len(cols) * 2
+	blockRows := m.rows
+	if ncols > 0 && maxBytes/(ncols*2) < blockRows {
+		blockRows = maxBytes / (ncols * 2)
+		if blockRows < 1 {
+			blockRows = 1
+		}
+	}
+	log.WithFields(log.Fields{
+		"filename":  fnm,
+		"rows":      m.rows,
+		"cols":      ncols,
+		"blockRows": blockRows,
+	}).Infof("writing numpy: %s", fnm)
+	output, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	bufw := bufio.NewWriterSize(output, 1<<26)
+	err = writeNumpyHeader(bufw, "<i2", m.rows, ncols)
+	if err != nil {
+		return err
+	}
+	out := make([]int16, blockRows*ncols)
+	buf := make([]byte, len(out)*2)
+	for r0 := 0; r0 < m.rows; r0 += blockRows {
+		r1 := r0 + blockRows
+		if r1 > m.rows {
+			r1 = m.rows
+		}
+		block := out[:(r1-r0)*ncols]
+		err = m.fill(block, cols, r0, r1)
+		if err != nil {
+			return err
+		}
+		for i, v := range block {
+			binary.LittleEndian.PutUint16(buf[i*2:], uint16(v))
+		}
+		_, err = bufw.Write(buf[:len(block)*2])
+		if err != nil {
+			return err
+		}
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	err = output.Close()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Close deletes the temporary file. It is safe to call Close more
+// than once.
+func (m *hgvsMatrix) Close() error {
+	if m.tmp == nil {
+		return nil
+	}
+	m.tmp.Close()
+	err := os.Remove(m.tmp.Name())
+	m.tmp = nil
+	return err
+}
+
+func hgvsMatrixIDs(cols []*hgvsMatrixCol) []string {
+	ids := make([]string, len(cols))
+	for i, col := range cols {
+		ids[i] = col.id
+	}
+	return ids
+}
+
+// writeNumpyHeader writes a version 1.0 .npy header for a 2-D
+// C-order array with the given dtype (e.g., "<i2") and shape.
+func writeNumpyHeader(w io.Writer, dtype string, rows, cols int) error {
+	dict := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': (%d, %d), }", dtype, rows, cols)
+	// Magic (6) + version (2) + header length (2) + dict +
+	// padding + newline must be a multiple of 64 bytes.
+	padlen := 63 - (10+len(dict))%64
+	hdr := make([]byte, 0, 10+len(dict)+padlen+1)
+	hdr = append(hdr, "\x93NUMPY\x01\x00"...)
+	hdr = append(hdr, 0, 0)
+	binary.LittleEndian.PutUint16(hdr[8:], uint16(len(dict)+padlen+1))
+	hdr = append(hdr, dict...)
+	for i := 0; i < padlen; i++ {
+		hdr = append(hdr, ' ')
+	}
+	hdr = append(hdr, '\n')
+	_, err := w.Write(hdr)
+	return err
+}
@@ -0,0 +1,66 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"os"
+
+	"github.com/kshedden/gonpy"
+	"gopkg.in/check.v1"
+)
+
+type hgvsMatrixSuite struct{}
+
+var _ = check.Suite(&hgvsMatrixSuite{})
+
+func (s *hgvsMatrixSuite) TestMatrix(c *check.C) {
+	tmpdir := c.MkDir()
+	m, err := newHGVSMatrix(tmpdir+"/tmp", 3)
+	c.Assert(err, check.IsNil)
+	defer m.Close()
+
+	chr2 := hgvsKey{seqname: "chr2", pos: 5, ref: "A", alt: "G"}
+	chr1b := hgvsKey{seqname: "chr1", pos: 100, ref: "C", alt: "T"}
+	chr1a := hgvsKey{seqname: "chr1", pos: 20, ref: "A", alt: "T"}
+	c.Assert(m.Add(chr2, "chr2:g.5A>G", [2][]int16{{1, 0, -1}, {0, 0, 1}}), check.IsNil)
+	c.Assert(m.Add(chr1b, "chr1:g.100C>T", [2][]int16{{0, -1, -1}, {0, 1, 0}}), check.IsNil)
+	c.Assert(m.Add(chr1a, "chr1:g.20A>T", [2][]int16{{1, 1, 1}, {0, 0, 0}}), check.IsNil)
+	// same variant seen again in a later chunk
+	c.Assert(m.Add(chr1b, "chr1:g.100C>T", [2][]int16{{-1, 0, 1}, {-1, -1, -1}}), check.IsNil)
+	c.Check(m.Len(), check.Equals, 3)
+
+	err = m.Add(chr1b, "1:g.100C>T", [2][]int16{{0, 0, 0}, {0, 0, 0}})
+	c.Check(err, check.ErrorMatches, `variant .* has two different hgvs IDs: "chr1:g.100C>T" and "1:g.100C>T"`)
+	err = m.Add(hgvsKey{seqname: "chr3", pos: 20, ref: "A", alt: "T"}, "chr1:g.20A>T", [2][]int16{{0, 0, 0}, {0, 0, 0}})
+	c.Check(err, check.ErrorMatches, `hgvs ID "chr1:g.20A>T" refers to two different variants: .*`)
+
+	expect := []int16{
+		1, 0, 0, 0, 1, 0,
+		1, 0, 0, 1, 0, 0,
+		1, 0, 1, 0, -1, 1,
+	}
+	out, ids, err := m.Matrix()
+	c.Assert(err, check.IsNil)
+	c.Check(ids, check.DeepEquals, []string{"chr1:g.20A>T", "chr1:g.100C>T", "chr2:g.5A>G"})
+	c.Check(out, check.DeepEquals, expect)
+
+	// maxBytes=12 forces one row per block
+	ids, err = m.WriteNumpy(tmpdir+"/hgvs.npy", 12)
+	c.Assert(err, check.IsNil)
+	c.Check(ids, check.DeepEquals, []string{"chr1:g.20A>T", "chr1:g.100C>T", "chr2:g.5A>G"})
+	f, err := os.Open(tmpdir + "/hgvs.npy")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	npy, err := gonpy.NewReader(f)
+	c.Assert(err, check.IsNil)
+	c.Check(npy.Shape, check.DeepEquals, []int{3, 6})
+	data, err := npy.GetInt16()
+	c.Check(err, check.IsNil)
+	c.Check(data, check.DeepEquals, expect)
+
+	c.Check(m.Close(), check.IsNil)
+	_, err = os.Stat(tmpdir + "/tmp")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
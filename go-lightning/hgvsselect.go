@@ -0,0 +1,98 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/arvados/lightning/go-lightning/hgvs"
+)
+
+// hgvsSelection is a set of HGVS columns to output, loaded from an
+// export-numpy -select-hgvs file.
+type hgvsSelection struct {
+	ids    map[string]bool     // "chr1:g.123A>G"
+	ranges map[string][][2]int // seqname => [start, end] (1-based, inclusive)
+}
+
+// loadHGVSSelection reads a -select-hgvs file. Each line is either
+// an HGVS ID ("chr1:g.123A>G", as in the *.columns.csv files written
+// by export-numpy) or a position range ("chr1:1000-2000", or
+// "chr1:1000" for a single position). If a line has comma-separated
+// fields, only the first field is used. Blank lines and lines
+// starting with "#" are ignored.
+func loadHGVSSelection(fnm string) (*hgvsSelection, error) {
+	f, err := open(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sel := &hgvsSelection{ids: map[string]bool{}, ranges: map[string][][2]int{}}
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(line, ','); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if strings.Contains(line, ":g.") {
+			sel.ids[line] = true
+			continue
+		}
+		colon := strings.LastIndexByte(line, ':')
+		if colon < 1 {
+			return nil, fmt.Errorf("%s line %d: cannot parse %q: expected an HGVS ID (chr1:g.123A>G) or position range (chr1:1000-2000)", fnm, lineno, line)
+		}
+		seqname, span := line[:colon], line[colon+1:]
+		startstr, endstr := span, span
+		if i := strings.IndexByte(span, '-'); i >= 0 {
+			startstr, endstr = span[:i], span[i+1:]
+		}
+		start, err := strconv.Atoi(startstr)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid start position in %q", fnm, lineno, line)
+		}
+		end, err := strconv.Atoi(endstr)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid end position in %q", fnm, lineno, line)
+		}
+		if end < start {
+			return nil, fmt.Errorf("%s line %d: end position is before start position in %q", fnm, lineno, line)
+		}
+		sel.ranges[seqname] = append(sel.ranges[seqname], [2]int{start, end})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sel, nil
+}
+
+// Match returns true if the given variant is selected, either by ID
+// or because its position is in a selected range.
+func (sel *hgvsSelection) Match(seqname string, pdi hgvs.Variant) bool {
+	if sel.ids[seqname+":g."+pdi.String()] {
+		return true
+	}
+	for _, r := range sel.ranges[seqname] {
+		if pdi.Position >= r[0] && pdi.Position <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of HGVS IDs and ranges in the selection.
+func (sel *hgvsSelection) Len() int {
+	n := len(sel.ids)
+	for _, rs := range sel.ranges {
+		n += len(rs)
+	}
+	return n
+}
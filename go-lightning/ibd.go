@@ -0,0 +1,426 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	log "github.com/sirupsen/logrus"
+)
+
+// ibdcmd finds long runs of identical tile variants shared by pairs
+// of haplotypes from different genomes, i.e., candidate
+// identical-by-descent segments.
+type ibdcmd struct {
+	params        ibdParams
+	contigAliases contigAliasOptions
+}
+
+type ibdParams struct {
+	minLength    int // minimum segment length in reference bases
+	minTags      int // minimum number of matching tags in a segment
+	maxNocallRun int // maximum number of consecutive no-call tags within a segment
+}
+
+// ibdPath is the sequence of reference tiles on one reference
+// sequence, in order.
+type ibdPath struct {
+	seqname string
+	tags    []tagID
+	start   []int // reference position (0-based) of each tile
+	end     []int // reference position (0-based, exclusive) of the end of each tile
+}
+
+// ibdSegment is a run of tags on a reference sequence where two
+// haplotypes have identical tile variants (or no-calls).
+type ibdSegment struct {
+	phase            [2]int // phase of first and second genome
+	seqname          string
+	start, end       int // 0-based, end exclusive
+	startTag, endTag tagID
+	tags             int // tags with matching variants
+	nocalls          int // tags in the segment where either haplotype is a no-call
+}
+
+type ibdPairResult struct {
+	sample   [2]string
+	segments []ibdSegment
+}
+
+func (cmd *ibdcmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
+	inputDir := flags.String("input-dir", "./in", "input `directory`")
+	outputDir := flags.String("output-dir", "./out", "output `directory`")
+	ref := flags.String("ref", "", "name of reference to use for coordinates (required if the library has more than one)")
+	samples := flags.String("samples", "", "comma-separated list of `genomes` to compare (default: all)")
+	flags.IntVar(&cmd.params.minLength, "min-length", 1000000, "report segments at least `N` reference bases long")
+	flags.IntVar(&cmd.params.minTags, "min-tags", 100, "report segments with at least `N` matching tags")
+	flags.IntVar(&cmd.params.maxNocallRun, "max-nocall-run", 5, "allow up to `N` consecutive tags where either haplotype is a no-call within a segment")
+	threads := flags.Int("threads", runtime.GOMAXPROCS(0), "compare up to `N` pairs of genomes concurrently")
+	cmd.contigAliases.Flags(flags)
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		runner := arvadosContainerRunner{
+			Name:        "lightning ibd",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         240000000000,
+			VCPUs:       32,
+			Priority:    *priority,
+			KeepCache:   2,
+			APIAccess:   true,
+		}
+		containerOpts.Apply(&runner, stdout)
+		err = runner.TranslatePaths(inputDir)
+		if err == nil {
+			err = cmd.contigAliases.TranslatePaths(&runner)
+		}
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"ibd", "-local=true",
+			"-pprof", ":6060",
+			"-input-dir", *inputDir,
+			"-output-dir", "/mnt/output",
+			"-ref", *ref,
+			"-samples", *samples,
+			"-min-length", fmt.Sprintf("%d", cmd.params.minLength),
+			"-min-tags", fmt.Sprintf("%d", cmd.params.minTags),
+			"-max-nocall-run", fmt.Sprintf("%d", cmd.params.maxNocallRun),
+			"-threads", fmt.Sprintf("%d", runner.VCPUs),
+		}
+		runner.Args = append(runner.Args, cmd.contigAliases.Args()...)
+		var output string
+		output, err = runner.Run()
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output)
+		return 0
+	}
+
+	err = cmd.contigAliases.Load()
+	if err != nil {
+		return 1
+	}
+	tilelib := &tileLibrary{
+		retainNoCalls:       true,
+		retainTileSequences: true,
+		compactGenomes:      map[string][]tileVariantID{},
+	}
+	err = tilelib.LoadDir(context.Background(), *inputDir)
+	if err != nil {
+		return 1
+	}
+	paths, err := ibdPaths(tilelib, *ref)
+	if err != nil {
+		return 1
+	}
+
+	var names []string
+	lookup := genomeLookup(tilelib.compactGenomes)
+	cgs := map[string][]tileVariantID{}
+	if *samples == "" {
+		for name, cg := range tilelib.compactGenomes {
+			label := trimFilenameForLabel(name)
+			names = append(names, label)
+			cgs[label] = cg
+		}
+	} else {
+		for _, name := range strings.Split(*samples, ",") {
+			cgs[name], err = lookup(name)
+			if err != nil {
+				return 1
+			}
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) < 2 {
+		err = errors.New("need at least 2 genomes to compare")
+		return 1
+	}
+
+	var pairs [][2]string
+	for i := range names {
+		for j := i + 1; j < len(names); j++ {
+			pairs = append(pairs, [2]string{names[i], names[j]})
+		}
+	}
+	log.Infof("comparing %d pairs of genomes", len(pairs))
+	results := make([]ibdPairResult, len(pairs))
+	progress := newProgress("ibd: pairs", len(pairs))
+	todo := make(chan int, len(pairs))
+	for i := range pairs {
+		todo <- i
+	}
+	close(todo)
+	var wg sync.WaitGroup
+	for t := 0; t < *threads; t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				pair := pairs[i]
+				results[i] = ibdPairResult{
+					sample:   pair,
+					segments: findIBD(cgs[pair[0]], cgs[pair[1]], paths, cmd.params),
+				}
+				progress.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	progress.Done()
+
+	err = writeIBDSegments(*outputDir+"/ibd-segments.csv", results)
+	if err != nil {
+		return 1
+	}
+	err = writeIBDSummary(*outputDir+"/ibd-summary.csv", results)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// ibdPaths returns the reference tile paths of the given reference
+// (or the only reference in the library, if refname is empty),
+// sorted by sequence name. Tags that appear more than once in the
+// reference are omitted.
+func ibdPaths(tilelib *tileLibrary, refname string) ([]ibdPath, error) {
+	if refname == "" {
+		if len(tilelib.refseqs) != 1 {
+			var refs []string
+			for name := range tilelib.refseqs {
+				refs = append(refs, name)
+			}
+			sort.Strings(refs)
+			return nil, fmt.Errorf("library has %d references %q: use -ref to choose one", len(refs), refs)
+		}
+		for name := range tilelib.refseqs {
+			refname = name
+		}
+	}
+	seqs, ok := tilelib.refseqs[refname]
+	if !ok {
+		return nil, fmt.Errorf("reference %q not found in library", refname)
+	}
+	taglen := tilelib.taglib.taglen
+	var seqnames []string
+	duptag := map[tagID]bool{}
+	for seqname, reftiles := range seqs {
+		seqnames = append(seqnames, seqname)
+		for _, libref := range reftiles {
+			_, duptag[libref.Tag] = duptag[libref.Tag]
+		}
+	}
+	sort.Slice(seqnames, func(i, j int) bool { return chromLess(seqnames[i], seqnames[j]) })
+	var paths []ibdPath
+	for _, seqname := range seqnames {
+		reftiles := seqs[seqname]
+		path := ibdPath{seqname: seqname}
+		pos := 0
+		for i, libref := range reftiles {
+			size := len(tilelib.TileVariantSequence(libref))
+			if size < taglen[libref.Tag] {
+				return nil, fmt.Errorf("reference %q seq %q uses tile %d variant %d with sequence len %d < taglen %d", refname, seqname, libref.Tag, libref.Variant, size, taglen[libref.Tag])
+			}
+			if !duptag[libref.Tag] {
+				path.tags = append(path.tags, libref.Tag)
+				path.start = append(path.start, pos)
+				path.end = append(path.end, pos+size)
+			}
+			pos += size - pathOverlap(taglen, reftiles, i)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// findIBD returns the segments where a haplotype of genome a and a
+// haplotype of genome b have identical tile variants.
+func findIBD(a, b []tileVariantID, paths []ibdPath, params ibdParams) []ibdSegment {
+	var segments []ibdSegment
+	for _, path := range paths {
+		for pa := 0; pa < 2; pa++ {
+			for pb := 0; pb < 2; pb++ {
+				segments = append(segments, findIBDPath(a, b, pa, pb, path, params)...)
+			}
+		}
+	}
+	return segments
+}
+
+// findIBDPath returns the segments on the given reference path
+// where phase pa of genome a and phase pb of genome b have identical
+// tile variants.
+func findIBDPath(a, b []tileVariantID, pa, pb int, path ibdPath, params ibdParams) []ibdSegment {
+	var segments []ibdSegment
+	runStart, lastMatch := -1, -1
+	matches, nocalls, nocallRun := 0, 0, 0
+	endRun := func() {
+		if runStart >= 0 && matches >= params.minTags && path.end[lastMatch]-path.start[runStart] >= params.minLength {
+			segments = append(segments, ibdSegment{
+				phase:    [2]int{pa, pb},
+				seqname:  path.seqname,
+				start:    path.start[runStart],
+				end:      path.end[lastMatch],
+				startTag: path.tags[runStart],
+				endTag:   path.tags[lastMatch],
+				tags:     matches,
+				nocalls:  nocalls,
+			})
+		}
+		runStart, lastMatch = -1, -1
+		matches, nocalls, nocallRun = 0, 0, 0
+	}
+	for i, tag := range path.tags {
+		var va, vb tileVariantID
+		if int(tag)*2+pa < len(a) {
+			va = a[int(tag)*2+pa]
+		}
+		if int(tag)*2+pb < len(b) {
+			vb = b[int(tag)*2+pb]
+		}
+		switch {
+		case va == 0 || vb == 0:
+			if runStart < 0 {
+				continue
+			}
+			nocallRun++
+			if nocallRun > params.maxNocallRun {
+				endRun()
+			}
+		case va == vb:
+			if runStart < 0 {
+				runStart = i
+			} else {
+				// Only count no-calls that are
+				// followed by a match, i.e., inside
+				// the segment.
+				nocalls += nocallRun
+			}
+			lastMatch = i
+			matches++
+			nocallRun = 0
+		default:
+			endRun()
+		}
+	}
+	endRun()
+	return segments
+}
+
+func writeIBDSegments(fnm string, results []ibdPairResult) error {
+	log.Infof("writing %s", fnm)
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriterSize(f, 1<<20)
+	w := csv.NewWriter(bufw)
+	w.Write([]string{"Sample1", "Phase1", "Sample2", "Phase2", "Chromosome", "Start", "End", "StartTag", "EndTag", "Tags", "NoCalls"})
+	for _, r := range results {
+		for _, seg := range r.segments {
+			w.Write([]string{
+				r.sample[0], fmt.Sprintf("%d", seg.phase[0]+1),
+				r.sample[1], fmt.Sprintf("%d", seg.phase[1]+1),
+				seg.seqname,
+				fmt.Sprintf("%d", seg.start),
+				fmt.Sprintf("%d", seg.end),
+				fmt.Sprintf("%d", seg.startTag),
+				fmt.Sprintf("%d", seg.endTag),
+				fmt.Sprintf("%d", seg.tags),
+				fmt.Sprintf("%d", seg.nocalls),
+			})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	if err := bufw.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func writeIBDSummary(fnm string, results []ibdPairResult) error {
+	log.Infof("writing %s", fnm)
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"Sample1", "Sample2", "Segments", "TotalLength", "LongestSegment"})
+	for _, r := range results {
+		total, longest := 0, 0
+		for _, seg := range r.segments {
+			total += seg.end - seg.start
+			if longest < seg.end-seg.start {
+				longest = seg.end - seg.start
+			}
+		}
+		w.Write([]string{r.sample[0], r.sample[1],
+			fmt.Sprintf("%d", len(r.segments)),
+			fmt.Sprintf("%d", total),
+			fmt.Sprintf("%d", longest),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
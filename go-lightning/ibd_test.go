@@ -0,0 +1,59 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"gopkg.in/check.v1"
+)
+
+type ibdSuite struct{}
+
+var _ = check.Suite(&ibdSuite{})
+
+// interleave returns a compact genome with the given variants on
+// phase 0 and phase 1.
+func interleave(p0, p1 []tileVariantID) []tileVariantID {
+	cg := make([]tileVariantID, len(p0)*2)
+	for i := range p0 {
+		cg[i*2] = p0[i]
+		cg[i*2+1] = p1[i]
+	}
+	return cg
+}
+
+func (s *ibdSuite) TestFindIBD(c *check.C) {
+	path := ibdPath{seqname: "chr1"}
+	for tag := 0; tag < 10; tag++ {
+		path.tags = append(path.tags, tagID(tag))
+		path.start = append(path.start, tag*100)
+		path.end = append(path.end, tag*100+124)
+	}
+	params := ibdParams{minLength: 300, minTags: 3, maxNocallRun: 1}
+	a := interleave(
+		[]tileVariantID{1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+		[]tileVariantID{2, 2, 2, 2, 2, 2, 2, 2, 2, 2})
+	b := interleave(
+		[]tileVariantID{1, 1, 0, 1, 1, 3, 1, 1, 1, 1},
+		[]tileVariantID{2, 2, 2, 2, 2, 2, 2, 2, 2, 2})
+	c.Check(findIBD(a, b, []ibdPath{path}, params), check.DeepEquals, []ibdSegment{
+		{phase: [2]int{0, 0}, seqname: "chr1", start: 0, end: 524, startTag: 0, endTag: 4, tags: 4, nocalls: 1},
+		{phase: [2]int{0, 0}, seqname: "chr1", start: 600, end: 1024, startTag: 6, endTag: 9, tags: 4, nocalls: 0},
+		{phase: [2]int{1, 1}, seqname: "chr1", start: 0, end: 1024, startTag: 0, endTag: 9, tags: 10, nocalls: 0},
+	})
+
+	// Too many consecutive no-calls end a segment; trailing
+	// no-calls are not included.
+	b = interleave(
+		[]tileVariantID{1, 1, 1, 0, 0, 1, 1, 1, 0, 0},
+		[]tileVariantID{3, 3, 3, 3, 3, 3, 3, 3, 3, 3})
+	c.Check(findIBD(a, b, []ibdPath{path}, params), check.DeepEquals, []ibdSegment{
+		{phase: [2]int{0, 0}, seqname: "chr1", start: 0, end: 324, startTag: 0, endTag: 2, tags: 3, nocalls: 0},
+		{phase: [2]int{0, 0}, seqname: "chr1", start: 500, end: 824, startTag: 5, endTag: 7, tags: 3, nocalls: 0},
+	})
+
+	// Segments shorter than -min-length are not reported.
+	params.minLength = 400
+	c.Check(findIBD(a, b, []ibdPath{path}, params), check.HasLen, 0)
+}
@@ -6,6 +6,7 @@ package lightning
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
 	"context"
 	"encoding/gob"
@@ -25,9 +26,9 @@ import (
 	"sort"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
+	"github.com/arvados/lightning/go-lightning/libio"
 	"github.com/klauspost/pgzip"
 	log "github.com/sirupsen/logrus"
 )
@@ -35,18 +36,38 @@ import (
 type importer struct {
 	tagLibraryFile      string
 	refFile             string
+	refLibraryFile      string
 	outputFile          string
+	maxOutputSize       int64 // if > 0, outputFile is a directory of library.NNNN.gob.gz files of about this size
+	outputIndex         bool
 	projectUUID         string
 	loglevel            string
 	priority            int
+	container           containerOptions
 	runLocal            bool
 	skipOOO             bool
+	tagPrefilter        bool
+	provenance          bool
+	assembly            bool
 	outputTiles         bool
 	saveIncompleteTiles bool
 	outputStats         string
+	excludeTagsFile     string
 	matchChromosome     *regexp.Regexp
-	encoder             *gob.Encoder
+	haploidChromosome   *regexp.Regexp // nil if -haploid-chromosome is empty
+	heteroplasmyMinAF   float64
+	encoder             libraryEncoder
 	retainAfterEncoding bool // keep imported genomes/refseqs in memory after writing to disk
+	gcInterval          time.Duration
+	watchdogTimeout     time.Duration
+	consensusJobs       int // max concurrent bcftools consensus processes per vcf haplotype
+	refSplitOnce        sync.Once
+	refSplitDir         string
+	refChroms           []refChrom
+	refSplitErr         error
+	refSeqsOnce         sync.Once
+	refSeqs             []refSeq
+	refSeqsErr          error
 	batchArgs
 }
 
@@ -61,19 +82,32 @@ func (cmd *importer) RunCommand(prog string, args []string, stdin io.Reader, std
 	flags.SetOutput(stderr)
 	flags.StringVar(&cmd.tagLibraryFile, "tag-library", "", "tag library fasta `file`")
 	flags.StringVar(&cmd.refFile, "ref", "", "reference fasta `file`")
+	flags.StringVar(&cmd.refLibraryFile, "ref-library", "", "load reference tile variants and sequences from `file` (output of a previous import of only a reference fasta file, with -output-tiles) instead of tiling the reference again")
 	flags.StringVar(&cmd.outputFile, "o", "-", "output `file`")
+	flags.Int64Var(&cmd.maxOutputSize, "max-output-size", 0, "write output to library.NNNN.gob.gz files in the -o directory, starting a new file when the current one reaches about this many `bytes` (compressed), instead of a single file (0 = single file)")
 	flags.StringVar(&cmd.projectUUID, "project", "", "project `UUID` for output data")
 	flags.BoolVar(&cmd.runLocal, "local", false, "run on local host (default: run in an arvados container)")
 	flags.BoolVar(&cmd.skipOOO, "skip-ooo", false, "skip out-of-order tags")
+	flags.BoolVar(&cmd.tagPrefilter, "tag-prefilter", false, "(experimental) use a Bloom filter to speed up tag matching")
+	flags.BoolVar(&cmd.assembly, "assembly", false, "(experimental) treat paired sample.1.fasta/sample.2.fasta inputs as assembled contigs, which can be partial chromosomes in either orientation, rather than full chromosome sequences")
 	flags.BoolVar(&cmd.outputTiles, "output-tiles", false, "include tile variant sequences in output file")
+	flags.BoolVar(&cmd.outputIndex, "output-index", true, "alongside the output file(s), write index.json (tag range and number of entries in each output file) and samples.csv (genomes, their output files, and numbers of calls); with a single -o file, the sidecar filenames are prefixed with the output filename and a dot")
+	flags.BoolVar(&cmd.provenance, "provenance", false, "with -output-tiles, record the input file in which each tile variant was first seen, and when")
 	flags.BoolVar(&cmd.saveIncompleteTiles, "save-incomplete-tiles", false, "treat tiles with no-calls as regular tiles")
 	flags.StringVar(&cmd.outputStats, "output-stats", "", "output stats to `file` (json)")
+	flags.StringVar(&cmd.excludeTagsFile, "exclude-tags", "", excludeTagsUsage)
+	flags.DurationVar(&cmd.gcInterval, "gc-interval", 0, "drop unreferenced tile variants from memory at the given `interval` (0 = never)")
+	flags.IntVar(&cmd.consensusJobs, "consensus-jobs", 1, "when importing vcf files, run up to `N` bcftools consensus processes per haplotype, one chromosome each (1 = one process for the whole genome)")
 	cmd.batchArgs.Flags(flags)
 	matchChromosome := flags.String("match-chromosome", "^(chr)?([0-9]+|X|Y|MT?)$", "import chromosomes that match the given `regexp`")
+	haploidChromosome := flags.String("haploid-chromosome", "", "treat chromosomes that match the given `regexp` (e.g., '^(chr)?MT?$') as haploid: copy the first haplotype's tile variants to the second phase, instead of tiling a second haplotype")
+	flags.Float64Var(&cmd.heteroplasmyMinAF, "heteroplasmy-min-af", 0, "with -haploid-chromosome and vcf inputs, use the first sample's allele fractions (FORMAT/AF) to build a major haplotype (variants with AF >= 0.5) and a secondary haplotype (also including variants with AF >= this `fraction`), store them as the first and second phase, and record the secondary variants' allele fractions (0 = don't)")
 	flags.IntVar(&cmd.priority, "priority", 500, "container request priority")
+	cmd.container.Flags(flags)
 	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	flags.DurationVar(&cmd.watchdogTimeout, "watchdog-timeout", 0, "abort with a goroutine dump if no worker thread starts or finishes for this long, and log long-running workers every 1/4 of this `interval` (0 = disable)")
 	flags.StringVar(&cmd.loglevel, "loglevel", "info", "logging threshold (trace, debug, info, warn, error, fatal, or panic)")
-	err = flags.Parse(args)
+	err = parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		err = nil
 		return 0
@@ -85,6 +119,18 @@ func (cmd *importer) RunCommand(prog string, args []string, stdin io.Reader, std
 	} else if flags.NArg() == 0 {
 		flags.Usage()
 		return 2
+	} else if cmd.heteroplasmyMinAF < 0 || cmd.heteroplasmyMinAF >= majorAF {
+		err = fmt.Errorf("invalid -heteroplasmy-min-af %v: must be at least 0 and less than %v", cmd.heteroplasmyMinAF, majorAF)
+		return 2
+	} else if cmd.heteroplasmyMinAF > 0 && *haploidChromosome == "" {
+		err = errors.New("cannot use -heteroplasmy-min-af without -haploid-chromosome")
+		return 2
+	} else if cmd.maxOutputSize < 0 {
+		err = fmt.Errorf("invalid -max-output-size %d: must not be negative", cmd.maxOutputSize)
+		return 2
+	} else if cmd.maxOutputSize > 0 && cmd.runLocal && cmd.outputFile == "-" {
+		err = errors.New("cannot use -max-output-size without -o directory")
+		return 2
 	}
 
 	if *pprof != "" {
@@ -92,6 +138,9 @@ func (cmd *importer) RunCommand(prog string, args []string, stdin io.Reader, std
 			log.Println(http.ListenAndServe(*pprof, nil))
 		}()
 	}
+	if cmd.runLocal {
+		startWatchdog(cmd.watchdogTimeout, stderr)
+	}
 
 	lvl, err := log.ParseLevel(cmd.loglevel)
 	if err != nil {
@@ -103,10 +152,19 @@ func (cmd *importer) RunCommand(prog string, args []string, stdin io.Reader, std
 	if err != nil {
 		return 1
 	}
+	if *haploidChromosome != "" {
+		cmd.haploidChromosome, err = regexp.Compile(*haploidChromosome)
+		if err != nil {
+			return 1
+		}
+	}
 
 	if !cmd.runLocal {
 		err = cmd.runBatches(stdout, flags.Args())
-		if err != nil {
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
 			return 1
 		}
 		return 0
@@ -124,38 +182,105 @@ func (cmd *importer) RunCommand(prog string, args []string, stdin io.Reader, std
 	}
 
 	var outw, outf io.WriteCloser
-	if cmd.outputFile == "-" {
-		outw = nopCloser{stdout}
-	} else {
-		outf, err = os.OpenFile(cmd.outputFile, os.O_CREATE|os.O_WRONLY, 0777)
+	var bufw *bufio.Writer
+	var split *splitEncoder
+	var index *importIndex
+	if cmd.outputIndex && cmd.outputFile != "-" {
+		index = &importIndex{}
+	}
+	if cmd.maxOutputSize > 0 {
+		var header []interface{}
+		if cmd.outputTiles {
+			for _, ent := range libio.TagSetEntries(taglib.Tags()) {
+				header = append(header, ent)
+			}
+		}
+		split, err = newSplitEncoder(cmd.outputFile, cmd.maxOutputSize, header...)
 		if err != nil {
 			return 1
 		}
-		defer outf.Close()
-		if strings.HasSuffix(cmd.outputFile, ".gz") {
-			outw = pgzip.NewWriter(outf)
+		defer split.Close()
+		cmd.encoder = split
+		if index != nil {
+			split.onEncode = index.add
+		}
+	} else {
+		if cmd.outputFile == "-" {
+			outw = nopCloser{stdout}
 		} else {
-			outw = outf
+			outf, err = os.OpenFile(cmd.outputFile, os.O_CREATE|os.O_WRONLY, 0777)
+			if err != nil {
+				return 1
+			}
+			defer outf.Close()
+			if strings.HasSuffix(cmd.outputFile, ".gz") {
+				outw = pgzip.NewWriter(outf)
+			} else {
+				outw = outf
+			}
+		}
+		bufw = bufio.NewWriterSize(outw, 64*1024*1024)
+		cmd.encoder = gob.NewEncoder(bufw)
+		if index != nil {
+			cmd.encoder = index.encoder(cmd.encoder, cmd.outputFile)
+		}
+		if cmd.outputTiles {
+			encodeTagSet(cmd.encoder, taglib.Tags())
 		}
 	}
-	bufw := bufio.NewWriterSize(outw, 64*1024*1024)
-	cmd.encoder = gob.NewEncoder(bufw)
 
-	tilelib := &tileLibrary{taglib: taglib, retainNoCalls: cmd.saveIncompleteTiles, skipOOO: cmd.skipOOO}
+	tilelib := &tileLibrary{taglib: taglib, retainNoCalls: cmd.saveIncompleteTiles, skipOOO: cmd.skipOOO, trackProvenance: cmd.provenance}
+	tilelib.excludeTags, err = loadExcludeTags(cmd.excludeTagsFile)
+	if err != nil {
+		return 1
+	}
 	if cmd.outputTiles {
-		cmd.encoder.Encode(LibraryEntry{TagSet: taglib.Tags()})
 		tilelib.encoder = cmd.encoder
 	}
+	if cmd.gcInterval > 0 {
+		if cmd.retainAfterEncoding {
+			err = errors.New("cannot use -gc-interval when retaining imported genomes in memory")
+			return 1
+		}
+		tilelib.trackReferences = true
+		go func() {
+			for range time.Tick(cmd.gcInterval) {
+				dropped := tilelib.CollectGarbage()
+				log.Printf("gc: dropped %d unreferenced tile variants, tilelib.Len() == %d", dropped, tilelib.Len())
+			}
+		}()
+	}
 	go func() {
 		for range time.Tick(10 * time.Minute) {
 			log.Printf("tilelib.Len() == %d", tilelib.Len())
 		}
 	}()
 
+	if cmd.refLibraryFile != "" {
+		err = cmd.loadRefLibrary(tilelib)
+		if err != nil {
+			return 1
+		}
+	}
+	defer cmd.cleanupRefSplit()
 	err = cmd.tileInputs(tilelib, infiles)
 	if err != nil {
 		return 1
 	}
+	if split != nil {
+		err = split.Close()
+		if err != nil {
+			return 1
+		}
+		log.Infof("wrote %d output files to %s", split.Files(), cmd.outputFile)
+		if index != nil {
+			err = index.writeSidecars(cmd.outputFile + "/")
+			if err != nil {
+				return 1
+			}
+		}
+		return 0
+	}
 	err = bufw.Flush()
 	if err != nil {
 		return 1
@@ -170,6 +295,12 @@ func (cmd *importer) RunCommand(prog string, args []string, stdin io.Reader, std
 			return 1
 		}
 	}
+	if index != nil {
+		err = index.writeSidecars(cmd.outputFile + ".")
+		if err != nil {
+			return 1
+		}
+	}
 	return 0
 }
 
@@ -190,7 +321,8 @@ func (cmd *importer) runBatches(stdout io.Writer, inputs []string) error {
 		Priority:    cmd.priority,
 		KeepCache:   1,
 	}
-	err := runner.TranslatePaths(&cmd.tagLibraryFile, &cmd.refFile, &cmd.outputFile)
+	cmd.container.Apply(&runner, stdout)
+	err := runner.TranslatePaths(&cmd.tagLibraryFile, &cmd.refFile, &cmd.refLibraryFile, &cmd.outputFile, &cmd.excludeTagsFile)
 	if err != nil {
 		return err
 	}
@@ -211,13 +343,25 @@ func (cmd *importer) runBatches(stdout io.Writer, inputs []string) error {
 			"-loglevel=" + cmd.loglevel,
 			"-pprof=:6061",
 			fmt.Sprintf("-skip-ooo=%v", cmd.skipOOO),
+			fmt.Sprintf("-tag-prefilter=%v", cmd.tagPrefilter),
+			fmt.Sprintf("-assembly=%v", cmd.assembly),
 			fmt.Sprintf("-output-tiles=%v", cmd.outputTiles),
+			fmt.Sprintf("-provenance=%v", cmd.provenance),
 			fmt.Sprintf("-save-incomplete-tiles=%v", cmd.saveIncompleteTiles),
+			fmt.Sprintf("-gc-interval=%v", cmd.gcInterval),
+			fmt.Sprintf("-watchdog-timeout=%v", cmd.watchdogTimeout),
+			fmt.Sprintf("-consensus-jobs=%d", cmd.consensusJobs),
 			"-match-chromosome", cmd.matchChromosome.String(),
+			"-haploid-chromosome", cmd.haploidChromosomeString(),
+			fmt.Sprintf("-heteroplasmy-min-af=%v", cmd.heteroplasmyMinAF),
+			fmt.Sprintf("-max-output-size=%d", cmd.maxOutputSize),
+			fmt.Sprintf("-output-index=%v", cmd.outputIndex),
 			"-output-stats", "/mnt/output/stats.json",
 			"-tag-library", cmd.tagLibraryFile,
 			"-ref", cmd.refFile,
-			"-o", "/mnt/output/library.gob.gz",
+			"-ref-library", cmd.refLibraryFile,
+			"-exclude-tags", cmd.excludeTagsFile,
+			"-o", cmd.containerOutput(),
 		}
 		runner.Args = append(runner.Args, cmd.batchArgs.Args(batch)...)
 		runner.Args = append(runner.Args, inputs...)
@@ -228,12 +372,26 @@ func (cmd *importer) runBatches(stdout io.Writer, inputs []string) error {
 	}
 	var outfiles []string
 	for _, o := range outputs {
-		outfiles = append(outfiles, o+"/library.gob.gz")
+		if cmd.maxOutputSize > 0 {
+			outfiles = append(outfiles, o)
+		} else {
+			outfiles = append(outfiles, o+"/library.gob.gz")
+		}
 	}
 	fmt.Fprintln(stdout, strings.Join(outfiles, " "))
 	return nil
 }
 
+// containerOutput returns the -o argument for an import container:
+// the output directory itself if the output is split into
+// library.NNNN.gob.gz files, otherwise a single file in it.
+func (cmd *importer) containerOutput() string {
+	if cmd.maxOutputSize > 0 {
+		return "/mnt/output"
+	}
+	return "/mnt/output/library.gob.gz"
+}
+
 func (cmd *importer) tileFasta(tilelib *tileLibrary, infile string, isRef bool) (tileSeq, []importStats, error) {
 	var input io.ReadCloser
 	input, err := open(infile)
@@ -249,6 +407,9 @@ func (cmd *importer) tileFasta(tilelib *tileLibrary, infile string, isRef bool)
 		}
 		defer input.Close()
 	}
+	if cmd.assembly && !isRef {
+		return tilelib.TileAssembly(infile, input)
+	}
 	return tilelib.TileFasta(infile, input, cmd.matchChromosome, isRef)
 }
 
@@ -275,12 +436,16 @@ func (cmd *importer) loadTagLibrary() (*tagLibrary, error) {
 	if taglib.Len() < 1 {
 		return nil, fmt.Errorf("cannot tile: tag library is empty")
 	}
+	if cmd.tagPrefilter {
+		taglib.EnablePrefilter(tagPrefilterBitsPerTag)
+	}
 	log.Printf("tag library %s load done", cmd.tagLibraryFile)
 	return &taglib, nil
 }
 
 var (
 	vcfFilenameRe    = regexp.MustCompile(`\.vcf(\.gz)?$`)
+	pgenFilenameRe   = regexp.MustCompile(`\.pgen$`)
 	fasta1FilenameRe = regexp.MustCompile(`\.1\.fa(sta)?(\.fa(sta)?)?(\.gz)?$`)
 	fasta2FilenameRe = regexp.MustCompile(`\.2\.fa(sta)?(\.fa(sta)?)?(\.gz)?$`)
 	fastaFilenameRe  = regexp.MustCompile(`\.fa(sta)?(\.gz)?$`)
@@ -307,7 +472,7 @@ func listInputFiles(paths []string) (files []string, err error) {
 		}
 		sort.Strings(names)
 		for _, name := range names {
-			if vcfFilenameRe.MatchString(name) {
+			if vcfFilenameRe.MatchString(name) || pgenFilenameRe.MatchString(name) {
 				files = append(files, filepath.Join(path, name))
 			} else if fastaFilenameRe.MatchString(name) && !fasta2FilenameRe.MatchString(name) {
 				files = append(files, filepath.Join(path, name))
@@ -326,6 +491,12 @@ func listInputFiles(paths []string) (files []string, err error) {
 			} else {
 				return nil, fmt.Errorf("%s: cannot read without .tbi or .csi index file", file)
 			}
+		} else if pgenFilenameRe.MatchString(file) {
+			for _, ext := range []string{".pvar", ".psam"} {
+				if _, err := os.Stat(pgenCompanion(file, ext)); err != nil {
+					return nil, fmt.Errorf("%s: cannot read without %s file", file, ext)
+				}
+			}
 		} else {
 			return nil, fmt.Errorf("don't know how to handle filename %s", file)
 		}
@@ -334,18 +505,19 @@ func listInputFiles(paths []string) (files []string, err error) {
 }
 
 func (cmd *importer) tileInputs(tilelib *tileLibrary, infiles []string) error {
-	starttime := time.Now()
 	errs := make(chan error, 1)
-	todo := make(chan func() error, len(infiles)*2)
+	var todo []func() error
 	allstats := make([][]importStats, len(infiles)*2)
+	var extrastats [][][]importStats // per-sample stats for multi-sample inputs
 	var encodeJobs sync.WaitGroup
 	for idx, infile := range infiles {
 		idx, infile := idx, infile
 		var phases sync.WaitGroup
 		phases.Add(2)
 		variants := make([][]tileVariantID, 2)
+		hap := &haploidCalls{}
 		if fasta1FilenameRe.MatchString(infile) {
-			todo <- func() error {
+			todo = append(todo, func() error {
 				defer phases.Done()
 				log.Printf("%s (sample.1) starting tiling", infile)
 				defer log.Printf("%s done", infile)
@@ -353,11 +525,12 @@ func (cmd *importer) tileInputs(tilelib *tileLibrary, infiles []string) error {
 				allstats[idx*2] = stats
 				var kept, dropped int
 				variants[0], kept, dropped = tseqs.Variants()
+				hap.tags = cmd.haploidTags(tseqs)
 				log.Printf("%s (sample.1) found %d unique tags plus %d repeats", infile, kept, dropped)
-				return err
-			}
+				return diagnose(err, "tiling input", infile)
+			})
 			infile2 := fasta1FilenameRe.ReplaceAllString(infile, `.2.fa$1$2$4`)
-			todo <- func() error {
+			todo = append(todo, func() error {
 				defer phases.Done()
 				log.Printf("%s (sample.2) starting tiling", infile2)
 				defer log.Printf("%s done", infile2)
@@ -366,10 +539,10 @@ func (cmd *importer) tileInputs(tilelib *tileLibrary, infiles []string) error {
 				var kept, dropped int
 				variants[1], kept, dropped = tseqs.Variants()
 				log.Printf("%s (sample.2) found %d unique tags plus %d repeats", infile2, kept, dropped)
-				return err
-			}
+				return diagnose(err, "tiling input", infile2)
+			})
 		} else if fastaFilenameRe.MatchString(infile) {
-			todo <- func() error {
+			todo = append(todo, func() error {
 				defer phases.Done()
 				defer phases.Done()
 				log.Printf("%s (reference) starting tiling", infile)
@@ -377,7 +550,7 @@ func (cmd *importer) tileInputs(tilelib *tileLibrary, infiles []string) error {
 				tseqs, stats, err := cmd.tileFasta(tilelib, infile, true)
 				allstats[idx*2] = stats
 				if err != nil {
-					return err
+					return diagnose(err, "tiling input", infile)
 				}
 				totlen := 0
 				for _, tseq := range tseqs {
@@ -393,17 +566,22 @@ func (cmd *importer) tileInputs(tilelib *tileLibrary, infiles []string) error {
 					tilelib.refseqs[infile] = tseqs
 					tilelib.mtx.Unlock()
 				}
+				for _, tseq := range tseqs {
+					for _, libref := range tseq {
+						tilelib.MarkReferenced(libref)
+					}
+				}
 
 				return cmd.encoder.Encode(LibraryEntry{
 					CompactSequences: []CompactSequence{{Name: infile, TileSequences: tseqs}},
 				})
-			}
+			})
 			// Don't write out a CompactGenomes entry
 			continue
 		} else if vcfFilenameRe.MatchString(infile) {
 			for phase := 0; phase < 2; phase++ {
 				phase := phase
-				todo <- func() error {
+				todo = append(todo, func() error {
 					defer phases.Done()
 					log.Printf("%s phase %d starting", infile, phase+1)
 					defer log.Printf("%s phase %d done", infile, phase+1)
@@ -411,10 +589,66 @@ func (cmd *importer) tileInputs(tilelib *tileLibrary, infiles []string) error {
 					allstats[idx*2] = stats
 					var kept, dropped int
 					variants[phase], kept, dropped = tseqs.Variants()
+					if phase == 0 {
+						hap.tags = cmd.haploidTags(tseqs)
+					}
 					log.Printf("%s phase %d found %d unique tags plus %d repeats", infile, phase+1, kept, dropped)
-					return err
+					return diagnose(err, "tiling input", infile)
+				})
+			}
+			if cmd.heteroplasmyMinAF > 0 {
+				phases.Add(1)
+				todo = append(todo, func() error {
+					defer phases.Done()
+					log.Printf("%s heteroplasmy starting", infile)
+					defer log.Printf("%s heteroplasmy done", infile)
+					err := cmd.tileHeteroplasmy(tilelib, infile, hap)
+					return diagnose(err, "tiling input", infile)
+				})
+			}
+		} else if pgenFilenameRe.MatchString(infile) {
+			pg, err := loadPgen(infile)
+			if err != nil {
+				return diagnose(err, "reading input", infile)
+			}
+			pgstats := make([][]importStats, len(pg.samples)*2)
+			extrastats = append(extrastats, pgstats)
+			for sample, iid := range pg.samples {
+				sample := sample
+				// Use the IID as the genome's label (see
+				// trimFilenameForLabel).
+				name := infile + "/" + strings.Replace(iid, "/", "-", -1)
+				var phases sync.WaitGroup
+				phases.Add(2)
+				variants := make([][]tileVariantID, 2)
+				hap := &haploidCalls{}
+				for phase := 0; phase < 2; phase++ {
+					phase := phase
+					todo = append(todo, func() error {
+						defer phases.Done()
+						label := fmt.Sprintf("%s phase %d", name, phase+1)
+						log.Printf("%s starting", label)
+						defer log.Printf("%s done", label)
+						tseqs, stats, err := cmd.tilePgenHaplotype(tilelib, pg, sample, phase, label)
+						pgstats[sample*2+phase] = stats
+						var kept, dropped int
+						variants[phase], kept, dropped = tseqs.Variants()
+						if phase == 0 {
+							hap.tags = cmd.haploidTags(tseqs)
+						}
+						log.Printf("%s found %d unique tags plus %d repeats", label, kept, dropped)
+						return diagnose(err, "tiling input", infile)
+					})
 				}
+				encodeJobs.Add(1)
+				go func() {
+					defer encodeJobs.Done()
+					phases.Wait()
+					cmd.encodeGenome(tilelib, name, variants, hap, errs)
+				}()
 			}
+			// CompactGenomes entries are written above
+			continue
 		} else {
 			panic(fmt.Sprintf("bug: unhandled filename %q", infile))
 		}
@@ -422,39 +656,21 @@ func (cmd *importer) tileInputs(tilelib *tileLibrary, infiles []string) error {
 		go func() {
 			defer encodeJobs.Done()
 			phases.Wait()
-			if len(errs) > 0 {
-				return
-			}
-			variants := flatten(variants)
-			err := cmd.encoder.Encode(LibraryEntry{
-				CompactGenomes: []CompactGenome{{Name: infile, Variants: variants}},
-			})
-			if err != nil {
-				select {
-				case errs <- err:
-				default:
-				}
-			}
-			if cmd.retainAfterEncoding {
-				tilelib.mtx.Lock()
-				if tilelib.compactGenomes == nil {
-					tilelib.compactGenomes = make(map[string][]tileVariantID)
-				}
-				tilelib.compactGenomes[infile] = variants
-				tilelib.mtx.Unlock()
-			}
+			cmd.encodeGenome(tilelib, infile, variants, hap, errs)
 		}()
 	}
-	go close(todo)
+	progress := newProgress("import: tiling jobs", len(todo))
+	todoCh := make(chan func() error, len(todo))
+	for _, fn := range todo {
+		todoCh <- fn
+	}
+	close(todoCh)
 	var tileJobs sync.WaitGroup
-	var running int64
 	for i := 0; i < runtime.GOMAXPROCS(-1); i++ {
 		tileJobs.Add(1)
-		atomic.AddInt64(&running, 1)
 		go func() {
 			defer tileJobs.Done()
-			defer atomic.AddInt64(&running, -1)
-			for fn := range todo {
+			for fn := range todoCh {
 				if len(errs) > 0 {
 					return
 				}
@@ -465,16 +681,12 @@ func (cmd *importer) tileInputs(tilelib *tileLibrary, infiles []string) error {
 					default:
 					}
 				}
-				remain := len(todo) + int(atomic.LoadInt64(&running)) - 1
-				if remain < cap(todo) {
-					ttl := time.Now().Sub(starttime) * time.Duration(remain) / time.Duration(cap(todo)-remain)
-					eta := time.Now().Add(ttl)
-					log.Printf("progress %d/%d, eta %v (%v)", cap(todo)-remain, cap(todo), eta, ttl)
-				}
+				progress.Add(1)
 			}
 		}()
 	}
 	tileJobs.Wait()
+	progress.Done()
 	if len(errs) > 0 {
 		// Must not wait on encodeJobs in this case. If the
 		// tileJobs goroutines exited early, some funcs in
@@ -499,6 +711,11 @@ func (cmd *importer) tileInputs(tilelib *tileLibrary, infiles []string) error {
 		for _, stats := range allstats {
 			flatstats = append(flatstats, stats...)
 		}
+		for _, pgstats := range extrastats {
+			for _, stats := range pgstats {
+				flatstats = append(flatstats, stats...)
+			}
+		}
 		err = json.NewEncoder(f).Encode(flatstats)
 		if err != nil {
 			return err
@@ -508,12 +725,258 @@ func (cmd *importer) tileInputs(tilelib *tileLibrary, infiles []string) error {
 	return nil
 }
 
+// encodeGenome writes a CompactGenome entry with the given
+// per-haplotype variants (after applying hap, if
+// -haploid-chromosome is in use), unless an error has already been
+// reported in errs.
+func (cmd *importer) encodeGenome(tilelib *tileLibrary, name string, variants [][]tileVariantID, hap *haploidCalls, errs chan error) {
+	if len(errs) > 0 {
+		return
+	}
+	var het []Heteroplasmy
+	if cmd.haploidChromosome != nil {
+		het = hap.apply(variants)
+	}
+	flat := flatten(variants)
+	for i, v := range flat {
+		tilelib.MarkReferenced(tileLibRef{Tag: tagID(i / 2), Variant: v})
+	}
+	err := cmd.encoder.Encode(LibraryEntry{
+		CompactGenomes: []CompactGenome{{Name: name, Variants: flat, Heteroplasmy: het}},
+	})
+	if err != nil {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	if cmd.retainAfterEncoding {
+		tilelib.mtx.Lock()
+		if tilelib.compactGenomes == nil {
+			tilelib.compactGenomes = make(map[string][]tileVariantID)
+		}
+		tilelib.compactGenomes[name] = flat
+		tilelib.mtx.Unlock()
+	}
+}
+
+// tilePgenHaplotype reconstructs one haplotype of a sample in a
+// .pgen input by applying its variants to the reference, and tiles
+// the result.
+func (cmd *importer) tilePgenHaplotype(tilelib *tileLibrary, pg *pgenData, sample, phase int, label string) (tileSeq, []importStats, error) {
+	refseqs, err := cmd.loadRefSeqs()
+	if err != nil {
+		return nil, nil, err
+	}
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		bufw := bufio.NewWriterSize(pw, 8*1024*1024)
+		skipped, err := pg.writeHaplotypeFasta(bufw, refseqs, sample, phase)
+		if err == nil {
+			err = bufw.Flush()
+		}
+		if skipped > 0 {
+			log.Warnf("%s: skipped %d variants that overlap other variants or do not match the reference", label, skipped)
+		}
+		pw.CloseWithError(err)
+	}()
+	return tilelib.TileFasta(label, pr, cmd.matchChromosome, false)
+}
+
+// haploidChromosomeString returns the -haploid-chromosome regexp,
+// or "" if none.
+func (cmd *importer) haploidChromosomeString() string {
+	if cmd.haploidChromosome == nil {
+		return ""
+	}
+	return cmd.haploidChromosome.String()
+}
+
+// haploidTags returns the tags in tseq that are on chromosomes
+// matching -haploid-chromosome.
+func (cmd *importer) haploidTags(tseq tileSeq) []tagID {
+	if cmd.haploidChromosome == nil {
+		return nil
+	}
+	var tags []tagID
+	for seqname, path := range tseq {
+		if !cmd.haploidChromosome.MatchString(seqname) {
+			continue
+		}
+		for _, libref := range path {
+			tags = append(tags, libref.Tag)
+		}
+	}
+	return tags
+}
+
+// tileHeteroplasmy builds the major and secondary haplotypes of the
+// haploid chromosomes in the given vcf file (see
+// -heteroplasmy-min-af), tiles them, and stores the results in hap.
+func (cmd *importer) tileHeteroplasmy(tilelib *tileLibrary, infile string, hap *haploidCalls) error {
+	refseqs, err := cmd.loadRefSeqs()
+	if err != nil {
+		return err
+	}
+	f, err := open(infile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var rdr io.Reader = f
+	if strings.HasSuffix(infile, ".gz") {
+		zr, err := pgzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		rdr = zr
+	}
+	variants, err := readHaploidVariants(rdr, cmd.haploidChromosome)
+	if err != nil {
+		return err
+	}
+	var major, secondary bytes.Buffer
+	hap.fractions = map[tagID]float32{}
+	for _, rs := range refseqs {
+		if !cmd.haploidChromosome.MatchString(rs.name) {
+			continue
+		}
+		vs := haploidVariantsFor(variants, rs.name)
+		for _, h := range []struct {
+			buf   *bytes.Buffer
+			minAF float64
+		}{{&major, majorAF}, {&secondary, cmd.heteroplasmyMinAF}} {
+			seq, skipped := applyHaploidVariants(rs.seq, vs, h.minAF)
+			if skipped > 0 {
+				log.Warnf("%s: %s: skipped %d variants that overlap other variants or do not match the reference", infile, rs.name, skipped)
+			}
+			fmt.Fprintf(h.buf, ">%s\n%s\n", rs.name, seq)
+		}
+		fractions, err := heteroplasmyFractions(tilelib.taglib, rs.seq, vs, cmd.heteroplasmyMinAF)
+		if err != nil {
+			return err
+		}
+		for tag, af := range fractions {
+			hap.fractions[tag] = af
+		}
+	}
+	tseqs, _, err := tilelib.TileFasta(infile+" major", &major, cmd.matchChromosome, false)
+	if err != nil {
+		return err
+	}
+	hap.major, _, _ = tseqs.Variants()
+	tseqs, _, err = tilelib.TileFasta(infile+" secondary", &secondary, cmd.matchChromosome, false)
+	if err != nil {
+		return err
+	}
+	hap.secondary, _, _ = tseqs.Variants()
+	return nil
+}
+
+type refSeq struct {
+	name string
+	seq  []byte // lowercase
+}
+
+// loadRefSeqs returns the sequences in cmd.refFile that match
+// cmd.matchChromosome. The file is only read once; later calls
+// return the same data.
+func (cmd *importer) loadRefSeqs() ([]refSeq, error) {
+	cmd.refSeqsOnce.Do(func() {
+		cmd.refSeqs, cmd.refSeqsErr = cmd.doLoadRefSeqs()
+	})
+	return cmd.refSeqs, cmd.refSeqsErr
+}
+
+func (cmd *importer) doLoadRefSeqs() ([]refSeq, error) {
+	if cmd.refFile == "" {
+		return nil, errors.New("cannot import pgen: reference data (-ref) not specified")
+	}
+	log.Infof("loading reference sequences from %s", cmd.refFile)
+	f, err := open(cmd.refFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rdr io.Reader = f
+	if strings.HasSuffix(cmd.refFile, ".gz") {
+		zr, err := pgzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cmd.refFile, err)
+		}
+		defer zr.Close()
+		rdr = zr
+	}
+	in := bufio.NewReaderSize(rdr, 8*1024*1024)
+	var refseqs []refSeq
+	for {
+		label, seq, err := readFastaSequence(in)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", cmd.refFile, err)
+		}
+		name := strings.TrimSpace(label)
+		if i := strings.IndexAny(name, " \t"); i >= 0 {
+			name = name[:i]
+		}
+		if cmd.matchChromosome.MatchString(name) {
+			refseqs = append(refseqs, refSeq{name: name, seq: seq})
+		}
+	}
+	if len(refseqs) == 0 {
+		return nil, fmt.Errorf("%s: no sequences match -match-chromosome regexp %q", cmd.refFile, cmd.matchChromosome)
+	}
+	return refseqs, nil
+}
+
 func (cmd *importer) tileGVCF(tilelib *tileLibrary, infile string, phase int) (tileseq tileSeq, stats []importStats, err error) {
 	if cmd.refFile == "" {
 		err = errors.New("cannot import vcf: reference data (-ref) not specified")
 		return
 	}
-	args := []string{"bcftools", "consensus", "--fasta-ref", cmd.refFile, "-H", fmt.Sprint(phase + 1), infile}
+	label := fmt.Sprintf("%s phase %d", infile, phase+1)
+	if cmd.consensusJobs <= 1 {
+		return cmd.tileConsensus(tilelib, infile, phase, cmd.refFile, label)
+	}
+	chroms, err := cmd.splitRef()
+	if err != nil {
+		return
+	}
+	tileseq = tileSeq{}
+	var mtx sync.Mutex
+	throttle := throttle{Max: cmd.consensusJobs}
+	for _, chrom := range chroms {
+		chrom := chrom
+		throttle.Go(func() error {
+			tseq, chromstats, err := cmd.tileConsensus(tilelib, infile, phase, chrom.file, label+" "+chrom.name)
+			if err != nil {
+				return err
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			for seqname, path := range tseq {
+				tileseq[seqname] = path
+			}
+			stats = append(stats, chromstats...)
+			return nil
+		})
+	}
+	err = throttle.Wait()
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].InputLabel < stats[j].InputLabel })
+	return
+}
+
+// tileConsensus runs bcftools consensus to get one haplotype of
+// infile (using the given reference fasta file), and tiles the
+// result.
+func (cmd *importer) tileConsensus(tilelib *tileLibrary, infile string, phase int, refFile string, label string) (tileseq tileSeq, stats []importStats, err error) {
+	args := []string{"bcftools", "consensus", "--fasta-ref", refFile, "-H", fmt.Sprint(phase + 1), infile}
 	indexsuffix := ".tbi"
 	if _, err := os.Stat(infile + ".csi"); err == nil {
 		indexsuffix = ".csi"
@@ -524,7 +987,7 @@ func (cmd *importer) tileGVCF(tilelib *tileLibrary, infile string, phase int) (t
 			"--log-driver=none",
 			"--volume=" + infile + ":" + infile + ":ro",
 			"--volume=" + infile + indexsuffix + ":" + infile + indexsuffix + ":ro",
-			"--volume=" + cmd.refFile + ":" + cmd.refFile + ":ro",
+			"--volume=" + refFile + ":" + refFile + ":ro",
 			"lightning-runtime",
 		}, args...)
 	}
@@ -540,22 +1003,143 @@ func (cmd *importer) tileGVCF(tilelib *tileLibrary, infile string, phase int) (t
 		return
 	}
 	defer consensus.Wait()
-	tileseq, stats, err = tilelib.TileFasta(fmt.Sprintf("%s phase %d", infile, phase+1), stdout, cmd.matchChromosome, false)
+	meter := &meteredReader{r: stdout}
+	t0 := time.Now()
+	tileseq, stats, err = tilelib.TileFasta(label, bufio.NewReaderSize(meter, 8*1024*1024), cmd.matchChromosome, false)
 	if err != nil {
 		return
 	}
+	elapsed := time.Since(t0)
+	log.Infof("%s: read %d bytes from bcftools in %v (%.1f MB/s), %v (%.0f%%) waiting for bcftools output", label, meter.bytes, elapsed, float64(meter.bytes)/elapsed.Seconds()/1e6, meter.stall, 100*meter.stall.Seconds()/elapsed.Seconds())
 	err = stdout.Close()
 	if err != nil {
 		return
 	}
 	err = consensus.Wait()
 	if err != nil {
-		err = fmt.Errorf("%s phase %d: bcftools: %s", infile, phase, err)
+		err = fmt.Errorf("%s: bcftools: %s", label, err)
 		return
 	}
 	return
 }
 
+// meteredReader counts the bytes read from r, and the time spent
+// waiting for r to return data. It is not safe for concurrent use.
+type meteredReader struct {
+	r     io.Reader
+	bytes int64
+	stall time.Duration
+}
+
+func (m *meteredReader) Read(p []byte) (int, error) {
+	t0 := time.Now()
+	n, err := m.r.Read(p)
+	m.stall += time.Since(t0)
+	m.bytes += int64(n)
+	return n, err
+}
+
+type refChrom struct {
+	name string // sequence name, e.g., "chr1"
+	file string // fasta file containing only this sequence
+}
+
+// splitRef writes each sequence in cmd.refFile that matches
+// cmd.matchChromosome to a separate fasta file in a temp dir, so
+// bcftools consensus can be run on each chromosome separately. The
+// work is only done once; later calls return the same files.
+func (cmd *importer) splitRef() ([]refChrom, error) {
+	cmd.refSplitOnce.Do(func() {
+		cmd.refChroms, cmd.refSplitErr = cmd.doSplitRef()
+	})
+	return cmd.refChroms, cmd.refSplitErr
+}
+
+func (cmd *importer) doSplitRef() ([]refChrom, error) {
+	dir, err := ioutil.TempDir("", "lightning-ref-")
+	if err != nil {
+		return nil, err
+	}
+	cmd.refSplitDir = dir
+	log.Infof("splitting %s into per-chromosome files in %s", cmd.refFile, dir)
+	f, err := open(cmd.refFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rdr io.Reader = f
+	if strings.HasSuffix(cmd.refFile, ".gz") {
+		zr, err := pgzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cmd.refFile, err)
+		}
+		defer zr.Close()
+		rdr = zr
+	}
+	in := bufio.NewReaderSize(rdr, 8*1024*1024)
+	var chroms []refChrom
+	var out *os.File
+	var bufw *bufio.Writer
+	closeOut := func() error {
+		if out == nil {
+			return nil
+		}
+		err := bufw.Flush()
+		if err != nil {
+			return err
+		}
+		err = out.Close()
+		out = nil
+		return err
+	}
+	defer closeOut()
+	for {
+		line, rerr := in.ReadBytes('\n')
+		if len(line) > 0 && line[0] == '>' {
+			if err := closeOut(); err != nil {
+				return nil, err
+			}
+			name := strings.TrimSpace(string(line[1:]))
+			if i := strings.IndexAny(name, " \t"); i >= 0 {
+				name = name[:i]
+			}
+			if cmd.matchChromosome.MatchString(name) {
+				chrom := refChrom{name: name, file: fmt.Sprintf("%s/%04d.fa", dir, len(chroms))}
+				out, err = os.Create(chrom.file)
+				if err != nil {
+					return nil, err
+				}
+				bufw = bufio.NewWriterSize(out, 8*1024*1024)
+				chroms = append(chroms, chrom)
+			}
+		}
+		if out != nil && len(line) > 0 {
+			if _, err := bufw.Write(line); err != nil {
+				return nil, err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			return nil, fmt.Errorf("%s: %w", cmd.refFile, rerr)
+		}
+	}
+	if err := closeOut(); err != nil {
+		return nil, err
+	}
+	if len(chroms) == 0 {
+		return nil, fmt.Errorf("%s: no sequences match -match-chromosome regexp %q", cmd.refFile, cmd.matchChromosome)
+	}
+	log.Infof("split %s into %d chromosomes", cmd.refFile, len(chroms))
+	return chroms, nil
+}
+
+func (cmd *importer) cleanupRefSplit() {
+	if cmd.refSplitDir != "" {
+		os.RemoveAll(cmd.refSplitDir)
+	}
+}
+
 func flatten(variants [][]tileVariantID) []tileVariantID {
 	ntags := 0
 	for _, v := range variants {
@@ -0,0 +1,270 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type importSuite struct{}
+
+var _ = check.Suite(&importSuite{})
+
+func (s *importSuite) TestSplitRef(c *check.C) {
+	cmd := &importer{refFile: "testdata/ref.fasta", matchChromosome: regexp.MustCompile(`^chr2$`)}
+	defer cmd.cleanupRefSplit()
+	chroms, err := cmd.splitRef()
+	c.Assert(err, check.IsNil)
+	c.Assert(chroms, check.HasLen, 1)
+	c.Check(chroms[0].name, check.Equals, "chr2")
+
+	all, err := ioutil.ReadFile("testdata/ref.fasta")
+	c.Assert(err, check.IsNil)
+	chr2, err := ioutil.ReadFile(chroms[0].file)
+	c.Assert(err, check.IsNil)
+	c.Check(strings.HasPrefix(string(chr2), ">chr2\n"), check.Equals, true)
+	c.Check(bytes.HasSuffix(all, chr2), check.Equals, true)
+
+	// second call returns the same files
+	again, err := cmd.splitRef()
+	c.Check(err, check.IsNil)
+	c.Check(again, check.DeepEquals, chroms)
+}
+
+func (s *importSuite) TestMeteredReader(c *check.C) {
+	m := &meteredReader{r: strings.NewReader("acgtacgt")}
+	buf, err := ioutil.ReadAll(m)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "acgtacgt")
+	c.Check(m.bytes, check.Equals, int64(8))
+}
+
+func (s *importSuite) TestRefLibrary(c *check.C) {
+	tmpdir := c.MkDir()
+	exited := (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-output-tiles",
+		"-save-incomplete-tiles",
+		"-o", tmpdir + "/ref.gob",
+		"testdata/ref.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	var refseqs []map[string][]tileLibRef
+	for i, input := range []string{"testdata/pipeline1/input1.1.fasta", "testdata/pipeline1/input2.1.fasta"} {
+		outfile := fmt.Sprintf("%s/lib%d.gob", tmpdir, i)
+		exited := (&importer{}).RunCommand("import", []string{
+			"-local=true",
+			"-tag-library", "testdata/tags",
+			"-output-tiles",
+			"-ref-library", tmpdir + "/ref.gob",
+			"-o", outfile,
+			input,
+		}, nil, os.Stderr, os.Stderr)
+		c.Assert(exited, check.Equals, 0)
+
+		f, err := os.Open(outfile)
+		c.Assert(err, check.IsNil)
+		var refTileVariants int
+		var genomes []string
+		err = DecodeLibrary(f, false, func(ent *LibraryEntry) error {
+			for _, cs := range ent.CompactSequences {
+				c.Check(cs.Name, check.Equals, "testdata/ref.fasta")
+				refseqs = append(refseqs, cs.TileSequences)
+			}
+			for _, tv := range ent.TileVariants {
+				if tv.Ref {
+					refTileVariants++
+				}
+			}
+			for _, cg := range ent.CompactGenomes {
+				genomes = append(genomes, cg.Name)
+			}
+			return nil
+		})
+		f.Close()
+		c.Assert(err, check.IsNil)
+		c.Check(refTileVariants > 0, check.Equals, true)
+		c.Check(genomes, check.DeepEquals, []string{input})
+	}
+	// Both imports use the same ref variant numbering.
+	c.Assert(refseqs, check.HasLen, 2)
+	c.Check(refseqs[1], check.DeepEquals, refseqs[0])
+
+	// Ref library must match tag library.
+	tags, err := ioutil.ReadFile("testdata/tags")
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(tmpdir+"/tags", bytes.Replace(tags, []byte("ggagaactgtgctccgccttcaga"), []byte("ggagaactgtgctccgccttcagc"), 1), 0644)
+	c.Assert(err, check.IsNil)
+	stderr := &bytes.Buffer{}
+	exited = (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", tmpdir + "/tags",
+		"-ref-library", tmpdir + "/ref.gob",
+		"-o", tmpdir + "/bad.gob",
+		"testdata/pipeline1/input1.1.fasta",
+	}, nil, stderr, stderr)
+	c.Check(exited, check.Not(check.Equals), 0)
+	c.Check(stderr.String(), check.Matches, `(?ms).*tag set hash .* does not match.*`)
+
+	// A library with genomes is not a ref library.
+	stderr.Reset()
+	exited = (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-ref-library", tmpdir + "/lib0.gob",
+		"-o", tmpdir + "/bad.gob",
+		"testdata/pipeline1/input1.1.fasta",
+	}, nil, stderr, stderr)
+	c.Check(exited, check.Not(check.Equals), 0)
+	c.Check(stderr.String(), check.Matches, `(?ms).*is not a ref library.*`)
+}
+
+func (s *importSuite) TestMaxOutputSize(c *check.C) {
+	outdir := c.MkDir() + "/lib"
+	exited := (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-output-tiles",
+		"-save-incomplete-tiles",
+		"-max-output-size=1",
+		"-o", outdir,
+		"testdata/pipeline1/input1.1.fasta",
+		"testdata/pipeline1/input2.1.fasta",
+		"testdata/ref.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	files, err := filepath.Glob(outdir + "/library.*.gob.gz")
+	c.Assert(err, check.IsNil)
+	c.Check(len(files) > 1, check.Equals, true)
+	var genomes []string
+	for _, fnm := range files {
+		var entries, tagsets, tileVariants int
+		err = decodeLibraryFile(fnm, func(ent *LibraryEntry) error {
+			if entries == 0 && len(ent.TagSet) > 0 {
+				tagsets++
+			}
+			entries++
+			tileVariants += len(ent.TileVariants)
+			for _, cg := range ent.CompactGenomes {
+				genomes = append(genomes, cg.Name)
+			}
+			return nil
+		})
+		c.Assert(err, check.IsNil)
+		c.Check(tagsets, check.Equals, 1, check.Commentf("%s", fnm))
+		// Each file has the tag set and at least one more
+		// entry.
+		c.Check(entries > 1, check.Equals, true, check.Commentf("%s", fnm))
+	}
+	sort.Strings(genomes)
+	c.Check(genomes, check.DeepEquals, []string{"testdata/pipeline1/input1.1.fasta", "testdata/pipeline1/input2.1.fasta"})
+
+	tilelib := &tileLibrary{retainNoCalls: true, retainTileSequences: true, compactGenomes: map[string][]tileVariantID{}}
+	err = tilelib.LoadDir(context.Background(), outdir)
+	c.Assert(err, check.IsNil)
+	c.Check(tilelib.compactGenomes, check.HasLen, 2)
+	c.Check(tilelib.refseqs, check.HasLen, 1)
+
+	var index struct {
+		Files          []importIndexFile
+		TileVariants   int
+		CompactGenomes int
+	}
+	buf, err := ioutil.ReadFile(outdir + "/index.json")
+	c.Assert(err, check.IsNil)
+	c.Assert(json.Unmarshal(buf, &index), check.IsNil)
+	c.Check(index.Files, check.HasLen, len(files))
+	c.Check(index.CompactGenomes, check.Equals, 2)
+	c.Check(index.TileVariants > 0, check.Equals, true)
+	buf, err = ioutil.ReadFile(outdir + "/samples.csv")
+	c.Assert(err, check.IsNil)
+	c.Check(strings.Split(string(buf), "\n")[0], check.Equals, "Index,Name,File,Tags,Calls,NoCalls,Heteroplasmy")
+	c.Check(strings.Count(string(buf), "\n"), check.Equals, 3)
+
+	// -max-output-size requires an output directory.
+	stderr := &bytes.Buffer{}
+	exited = (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-max-output-size=1000",
+		"testdata/pipeline1/input1.1.fasta",
+	}, nil, stderr, stderr)
+	c.Check(exited, check.Equals, 2)
+	c.Check(stderr.String(), check.Matches, `(?ms).*without -o directory.*`)
+}
+
+func (s *importSuite) TestOutputIndex(c *check.C) {
+	tmpdir := c.MkDir()
+	exited := (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-output-tiles",
+		"-o", tmpdir + "/library.gob",
+		"testdata/pipeline1/input1.1.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	var tileVariants int
+	minTag, maxTag := -1, -1
+	err := decodeLibraryFile(tmpdir+"/library.gob", func(ent *LibraryEntry) error {
+		for _, tv := range ent.TileVariants {
+			tileVariants++
+			if minTag < 0 || int(tv.Tag) < minTag {
+				minTag = int(tv.Tag)
+			}
+			if int(tv.Tag) > maxTag {
+				maxTag = int(tv.Tag)
+			}
+		}
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+
+	buf, err := ioutil.ReadFile(tmpdir + "/library.gob.index.json")
+	c.Assert(err, check.IsNil)
+	var index struct{ Files []importIndexFile }
+	c.Assert(json.Unmarshal(buf, &index), check.IsNil)
+	c.Check(index.Files, check.DeepEquals, []importIndexFile{{
+		Name:           "library.gob",
+		MinTag:         minTag,
+		MaxTag:         maxTag,
+		TileVariants:   tileVariants,
+		CompactGenomes: 1,
+	}})
+
+	buf, err = ioutil.ReadFile(tmpdir + "/library.gob.samples.csv")
+	c.Assert(err, check.IsNil)
+	rows, err := csv.NewReader(bytes.NewReader(buf)).ReadAll()
+	c.Assert(err, check.IsNil)
+	c.Assert(rows, check.HasLen, 2)
+	c.Check(rows[1][:3], check.DeepEquals, []string{"0", "testdata/pipeline1/input1.1.fasta", "library.gob"})
+
+	// No sidecars with -output-index=false.
+	exited = (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-output-index=false",
+		"-o", tmpdir + "/noindex.gob",
+		"testdata/pipeline1/input1.1.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	_, err = os.Stat(tmpdir + "/noindex.gob.index.json")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
@@ -0,0 +1,172 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// importIndex summarizes the library entries written by an import,
+// so the output can be inspected without decoding it (see
+// writeSidecars).
+type importIndex struct {
+	mtx     sync.Mutex
+	files   []*importIndexFile
+	byName  map[string]*importIndexFile
+	genomes []importIndexGenome
+}
+
+// importIndexFile describes one output file.
+type importIndexFile struct {
+	Name             string
+	MinTag           int // -1 if no tile variants
+	MaxTag           int // -1 if no tile variants
+	TileVariants     int
+	CompactGenomes   int
+	CompactSequences []string
+}
+
+// importIndexGenome describes one genome.
+type importIndexGenome struct {
+	Name         string
+	File         string
+	Tags         int
+	Calls        int // non-zero tile variants, both phases
+	NoCalls      int // zero tile variants, both phases
+	Heteroplasmy int
+}
+
+// add records the given library entry (LibraryEntry or
+// *LibraryEntry), which was written to the given file.
+func (idx *importIndex) add(file string, v interface{}) {
+	var ent *LibraryEntry
+	switch v := v.(type) {
+	case LibraryEntry:
+		ent = &v
+	case *LibraryEntry:
+		ent = v
+	default:
+		return
+	}
+	file = filepath.Base(file)
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	f := idx.byName[file]
+	if f == nil {
+		if idx.byName == nil {
+			idx.byName = map[string]*importIndexFile{}
+		}
+		f = &importIndexFile{Name: file, MinTag: -1, MaxTag: -1}
+		idx.byName[file] = f
+		idx.files = append(idx.files, f)
+	}
+	for _, tv := range ent.TileVariants {
+		if f.MinTag < 0 || int(tv.Tag) < f.MinTag {
+			f.MinTag = int(tv.Tag)
+		}
+		if int(tv.Tag) > f.MaxTag {
+			f.MaxTag = int(tv.Tag)
+		}
+	}
+	f.TileVariants += len(ent.TileVariants)
+	f.CompactGenomes += len(ent.CompactGenomes)
+	for _, cs := range ent.CompactSequences {
+		f.CompactSequences = append(f.CompactSequences, cs.Name)
+	}
+	for _, cg := range ent.CompactGenomes {
+		g := importIndexGenome{
+			Name:         cg.Name,
+			File:         file,
+			Tags:         len(cg.Variants) / 2,
+			Heteroplasmy: len(cg.Heteroplasmy),
+		}
+		for _, v := range cg.Variants {
+			if v == 0 {
+				g.NoCalls++
+			} else {
+				g.Calls++
+			}
+		}
+		idx.genomes = append(idx.genomes, g)
+	}
+}
+
+// encoder returns a libraryEncoder that passes entries through to
+// enc, and records them as written to the given file.
+func (idx *importIndex) encoder(enc libraryEncoder, file string) libraryEncoder {
+	return &importIndexEncoder{enc: enc, idx: idx, file: file}
+}
+
+type importIndexEncoder struct {
+	enc  libraryEncoder
+	idx  *importIndex
+	file string
+}
+
+func (e *importIndexEncoder) Encode(v interface{}) error {
+	err := e.enc.Encode(v)
+	if err == nil {
+		e.idx.add(e.file, v)
+	}
+	return err
+}
+
+// writeSidecars writes {prefix}index.json, listing the output files
+// with their tag ranges and numbers of entries, and
+// {prefix}samples.csv, listing the genomes in the order they were
+// written, with their output files and numbers of calls.
+func (idx *importIndex) writeSidecars(prefix string) error {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	var total struct {
+		Files          []*importIndexFile
+		TileVariants   int
+		CompactGenomes int
+	}
+	total.Files = idx.files
+	for _, f := range idx.files {
+		total.TileVariants += f.TileVariants
+		total.CompactGenomes += f.CompactGenomes
+	}
+	buf, err := json.MarshalIndent(total, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(prefix+"index.json", append(buf, '\n'), 0666)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(prefix+"samples.csv", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"Index", "Name", "File", "Tags", "Calls", "NoCalls", "Heteroplasmy"})
+	for i, g := range idx.genomes {
+		w.Write([]string{
+			fmt.Sprintf("%d", i),
+			g.Name,
+			g.File,
+			fmt.Sprintf("%d", g.Tags),
+			fmt.Sprintf("%d", g.Calls),
+			fmt.Sprintf("%d", g.NoCalls),
+			fmt.Sprintf("%d", g.Heteroplasmy),
+		})
+	}
+	w.Flush()
+	err = w.Error()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,164 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"fmt"
+)
+
+// Quality flags for imputed genotype matrix entries (see
+// imputeTileVariants).
+const (
+	imputeObserved int8 = 0  // called in input, not imputed
+	imputeNeighbor int8 = 1  // copied from haplotypes with matching flanking tiles
+	imputeMode     int8 = 2  // most common variant at this tag
+	imputeFailed   int8 = -1 // no-call, could not be imputed
+)
+
+func checkImputeMethod(method string) error {
+	switch method {
+	case "", "mode", "neighbor":
+		return nil
+	default:
+		return fmt.Errorf("invalid -impute method %q: must be mode or neighbor", method)
+	}
+}
+
+type imputeStats struct {
+	Neighbor int
+	Mode     int
+	Failed   int
+}
+
+// imputeTileVariants replaces no-calls (tile variants with no
+// sequence data) in a chunk of compact genomes with called variants,
+// and returns a quality flag for each entry of each genome's
+// Variants slice, indexed by [row][2*(tag-tagstart)+phase] where row
+// is the index in cgnames.
+//
+// Entries with variant 0 (tag not found, e.g., covered by a spanning
+// tile) are not no-calls and are left alone.
+//
+// With method "mode", each no-call is replaced with the most common
+// called variant at that tag. With method "neighbor", each no-call
+// is replaced with the most common variant among haplotypes that
+// have the same variants at the nearest window called tags on each
+// side (in the same chunk); if there are no such haplotypes, the
+// mode is used instead.
+func imputeTileVariants(method string, window int, cgs map[string]CompactGenome, cgnames []string, seq map[tagID][]TileVariant, tagstart, tagend tagID) ([][]int8, imputeStats) {
+	var stats imputeStats
+	ntags := int(tagend - tagstart)
+	haps := make([][]tileVariantID, 0, len(cgnames)*2)
+	flags := make([][]int8, len(cgnames))
+	for row, name := range cgnames {
+		flags[row] = make([]int8, ntags*2)
+		haps = append(haps, cgs[name].Variants, cgs[name].Variants)
+	}
+	called := func(tag tagID, v tileVariantID) bool {
+		variants := seq[tag]
+		return v > 0 && int(v) < len(variants) && len(variants[v].Sequence) > 0
+	}
+	// Find no-calls before changing anything, so imputed values
+	// aren't used as evidence when imputing other entries.
+	nocall := make([][]bool, len(haps))
+	for h, variants := range haps {
+		phase := h % 2
+		nocall[h] = make([]bool, ntags)
+		for t := 0; t < ntags && 2*t+phase < len(variants); t++ {
+			v := variants[2*t+phase]
+			nocall[h][t] = v > 0 && !called(tagstart+tagID(t), v)
+		}
+	}
+	variantAt := func(h, t int) tileVariantID {
+		return haps[h][2*t+h%2]
+	}
+	// flanking returns the indices of the nearest window called
+	// tags before and after t in haplotype h.
+	flanking := func(h, t int) []int {
+		var ret []int
+		for i, n := t-1, 0; i >= 0 && n < window; i-- {
+			if v := variantAt(h, i); v > 0 && !nocall[h][i] {
+				ret = append(ret, i)
+				n++
+			}
+		}
+		for i, n := t+1, 0; i < ntags && n < window; i++ {
+			if v := variantAt(h, i); v > 0 && !nocall[h][i] {
+				ret = append(ret, i)
+				n++
+			}
+		}
+		return ret
+	}
+	for t := 0; t < ntags; t++ {
+		var missing []int
+		count := map[tileVariantID]int{}
+		for h := range haps {
+			if nocall[h][t] {
+				missing = append(missing, h)
+			} else if v := variantAt(h, t); v > 0 {
+				count[v]++
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		mode := mostCommonVariant(count)
+		for _, h := range missing {
+			v, flag := tileVariantID(0), imputeFailed
+			if method == "neighbor" {
+				flank := flanking(h, t)
+				ncount := map[tileVariantID]int{}
+				for other := range haps {
+					if other == h || nocall[other][t] || variantAt(other, t) == 0 || len(flank) == 0 {
+						continue
+					}
+					match := true
+					for _, i := range flank {
+						if variantAt(other, i) != variantAt(h, i) {
+							match = false
+							break
+						}
+					}
+					if match {
+						ncount[variantAt(other, t)]++
+					}
+				}
+				if nv := mostCommonVariant(ncount); nv > 0 {
+					v, flag = nv, imputeNeighbor
+				}
+			}
+			if v == 0 && mode > 0 {
+				v, flag = mode, imputeMode
+			}
+			switch flag {
+			case imputeNeighbor:
+				stats.Neighbor++
+			case imputeMode:
+				stats.Mode++
+			default:
+				stats.Failed++
+			}
+			flags[h/2][2*t+h%2] = flag
+			if v > 0 {
+				haps[h][2*t+h%2] = v
+			}
+		}
+	}
+	return flags, stats
+}
+
+// mostCommonVariant returns the variant with the highest count, or
+// the lowest-numbered variant in case of a tie, or 0 if count is
+// empty.
+func mostCommonVariant(count map[tileVariantID]int) tileVariantID {
+	best, bestCount := tileVariantID(0), 0
+	for v, n := range count {
+		if n > bestCount || (n == bestCount && v < best) {
+			best, bestCount = v, n
+		}
+	}
+	return best
+}
@@ -0,0 +1,54 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"gopkg.in/check.v1"
+)
+
+func (s *sliceSuite) TestImputeTileVariants(c *check.C) {
+	// Tags 10-13. Variant 3 at each tag is a no-call (no sequence
+	// data).
+	seq := map[tagID][]TileVariant{}
+	for tag := tagID(10); tag < 14; tag++ {
+		seq[tag] = []TileVariant{{}, {Sequence: []byte("acgt")}, {Sequence: []byte("aggt")}, {}}
+	}
+	cgnames := []string{"a", "b", "c", "d"}
+	setup := func() map[string]CompactGenome {
+		return map[string]CompactGenome{
+			// phase 0 / phase 1 interleaved
+			"a": {StartTag: 10, EndTag: 14, Variants: []tileVariantID{1, 2, 2, 1, 1, 2, 1, 1}},
+			"b": {StartTag: 10, EndTag: 14, Variants: []tileVariantID{1, 2, 2, 1, 1, 2, 1, 1}},
+			"c": {StartTag: 10, EndTag: 14, Variants: []tileVariantID{1, 1, 1, 1, 2, 2, 1, 1}},
+			"d": {StartTag: 10, EndTag: 14, Variants: []tileVariantID{1, 2, 3, 3, 1, 3, 0, 1}},
+		}
+	}
+
+	cgs := setup()
+	flags, stats := imputeTileVariants("mode", 1, cgs, cgnames, seq, 10, 14)
+	c.Check(stats, check.Equals, imputeStats{Mode: 3})
+	c.Check(cgs["d"].Variants, check.DeepEquals, []tileVariantID{1, 2, 1, 1, 1, 2, 0, 1})
+	c.Check(flags[3], check.DeepEquals, []int8{0, 0, imputeMode, imputeMode, 0, imputeMode, 0, 0})
+	c.Check(flags[0], check.DeepEquals, make([]int8, 8))
+
+	// Haplotype d/1 matches a/1 and b/1 at the flanking tags 10
+	// and 13 (tags 11 and 12 are no-calls), so it gets their
+	// variant 1 at tag 11. Haplotype d/0 matches a/0 and b/0 at
+	// tags 10 and 12 (but not c/0), so it gets variant 2.
+	cgs = setup()
+	flags, stats = imputeTileVariants("neighbor", 1, cgs, cgnames, seq, 10, 14)
+	c.Check(stats, check.Equals, imputeStats{Neighbor: 3})
+	c.Check(cgs["d"].Variants, check.DeepEquals, []tileVariantID{1, 2, 2, 1, 1, 2, 0, 1})
+	c.Check(flags[3], check.DeepEquals, []int8{0, 0, imputeNeighbor, imputeNeighbor, 0, imputeNeighbor, 0, 0})
+
+	// Nothing to impute from.
+	cgs = map[string]CompactGenome{
+		"a": {StartTag: 10, EndTag: 11, Variants: []tileVariantID{3, 0}},
+	}
+	flags, stats = imputeTileVariants("neighbor", 1, cgs, []string{"a"}, seq, 10, 11)
+	c.Check(stats, check.Equals, imputeStats{Failed: 1})
+	c.Check(cgs["a"].Variants, check.DeepEquals, []tileVariantID{3, 0})
+	c.Check(flags[0], check.DeepEquals, []int8{imputeFailed, 0})
+}
@@ -0,0 +1,175 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/arvados/lightning/go-lightning/libio"
+	"golang.org/x/crypto/blake2b"
+)
+
+// infocmd prints a JSON summary of a library.
+type infocmd struct{}
+
+// libraryInfo is the output of "lightning info".
+type libraryInfo struct {
+	SampleCount   int               `json:"sample_count"`
+	Samples       []string          `json:"samples"` // sorted
+	Tags          int               `json:"tags"`
+	TileVariants  int64             `json:"tile_variants"`
+	References    []string          `json:"references"` // sorted
+	SequenceBytes int64             `json:"sequence_bytes"`
+	TagSetHash    string            `json:"tag_set_hash"` // hex, or "" if no file has a tag set
+	Files         []libraryFileInfo `json:"files"`
+}
+
+// libraryFileInfo has the record counts for one library file.
+type libraryFileInfo struct {
+	Path          string `json:"path"`
+	TagSets       int    `json:"tag_sets"`
+	TileVariants  int64  `json:"tile_variants"`
+	Genomes       int    `json:"genomes"`
+	References    int    `json:"references"`
+	SequenceBytes int64  `json:"sequence_bytes"`
+	TagSetHash    string `json:"tag_set_hash,omitempty"`
+}
+
+func (cmd *infocmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	inputDir := flags.String("input-dir", "./in", "input `directory` or library file")
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	}
+
+	infiles, err := allFiles(*inputDir, matchGobFile)
+	if err != nil {
+		return 1
+	} else if len(infiles) == 0 {
+		err = fmt.Errorf("no input files found in %s", *inputDir)
+		return 1
+	}
+	sort.Strings(infiles)
+	info, err := summarizeLibrary(infiles)
+	if err != nil {
+		return 1
+	}
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(info)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// summarizeLibrary reads the given library files and returns counts
+// of their contents. Genomes and references that appear in several
+// files (e.g., slices) are counted once in the totals.
+func summarizeLibrary(infiles []string) (*libraryInfo, error) {
+	files := make([]libraryFileInfo, len(infiles))
+	samples := map[string]bool{}
+	refs := map[string]bool{}
+	tags := 0
+	var mtx sync.Mutex
+	throttle := throttle{Max: runtime.GOMAXPROCS(0)}
+	for i, infile := range infiles {
+		i, infile := i, infile
+		throttle.Go(func() error {
+			fi := libraryFileInfo{Path: infile}
+			f, err := open(infile)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			err = DecodeLibraryOptions(f, strings.HasSuffix(infile, ".gz"), DecodeOptions{SkipGenomeVariants: true}, func(ent *LibraryEntry) error {
+				if len(ent.TagSet) > 0 {
+					fi.TagSets++
+					hash := ent.TagSetHash
+					if hash == ([blake2b.Size256]byte{}) {
+						// written by an older version
+						hash = libio.TagSetHash(ent.TagSet)
+					}
+					fi.TagSetHash = fmt.Sprintf("%x", hash)
+				}
+				fi.TileVariants += int64(len(ent.TileVariants))
+				for _, tv := range ent.TileVariants {
+					fi.SequenceBytes += int64(len(tv.Sequence))
+				}
+				fi.Genomes += len(ent.CompactGenomes)
+				fi.References += len(ent.CompactSequences)
+				mtx.Lock()
+				defer mtx.Unlock()
+				if len(ent.TagSet) > tags {
+					tags = len(ent.TagSet)
+				}
+				for _, cg := range ent.CompactGenomes {
+					samples[cg.Name] = true
+				}
+				for _, cs := range ent.CompactSequences {
+					refs[cs.Name] = true
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %w", infile, err)
+			}
+			files[i] = fi
+			return nil
+		})
+	}
+	if err := throttle.Wait(); err != nil {
+		return nil, err
+	}
+	info := &libraryInfo{
+		SampleCount: len(samples),
+		Samples:     []string{},
+		Tags:        tags,
+		References:  []string{},
+		Files:       files,
+	}
+	for name := range samples {
+		info.Samples = append(info.Samples, name)
+	}
+	sort.Strings(info.Samples)
+	for name := range refs {
+		info.References = append(info.References, name)
+	}
+	sort.Strings(info.References)
+	var hashPath string
+	for _, fi := range files {
+		info.TileVariants += fi.TileVariants
+		info.SequenceBytes += fi.SequenceBytes
+		if fi.TagSetHash == "" {
+			continue
+		} else if info.TagSetHash == "" {
+			info.TagSetHash, hashPath = fi.TagSetHash, fi.Path
+		} else if info.TagSetHash != fi.TagSetHash {
+			return nil, fmt.Errorf("tag library mismatch: %s has tag set hash %s but %s has tag set hash %s", fi.Path, fi.TagSetHash, hashPath, info.TagSetHash)
+		}
+	}
+	return info, nil
+}
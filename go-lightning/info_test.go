@@ -0,0 +1,62 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type infoSuite struct{}
+
+var _ = check.Suite(&infoSuite{})
+
+func (s *infoSuite) TestInfoCommand(c *check.C) {
+	tmpdir := c.MkDir()
+	exited := (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-output-tiles",
+		"-save-incomplete-tiles",
+		"-o", tmpdir + "/library1.gob",
+		"testdata/ref.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	exited = (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-output-tiles",
+		"-o", tmpdir + "/library2.gob",
+		"testdata/pipeline1",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	var stdout bytes.Buffer
+	exited = (&infocmd{}).RunCommand("info", []string{
+		"-input-dir", tmpdir,
+	}, nil, &stdout, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	c.Log(stdout.String())
+	var info libraryInfo
+	c.Assert(json.Unmarshal(stdout.Bytes(), &info), check.IsNil)
+	c.Check(info.SampleCount, check.Equals, len(info.Samples))
+	c.Check(info.SampleCount, check.Equals, 2)
+	c.Check(info.Tags > 0, check.Equals, true)
+	c.Check(info.TileVariants > 0, check.Equals, true)
+	c.Check(info.SequenceBytes > 0, check.Equals, true)
+	c.Check(info.References, check.DeepEquals, []string{"testdata/ref.fasta"})
+	c.Check(info.TagSetHash, check.Matches, `[0-9a-f]{64}`)
+	c.Assert(info.Files, check.HasLen, 2)
+	c.Check(info.Files[0].References, check.Equals, 1)
+	c.Check(info.Files[1].Genomes, check.Equals, 2)
+	c.Check(info.Files[0].TileVariants+info.Files[1].TileVariants, check.Equals, info.TileVariants)
+	for _, fi := range info.Files {
+		c.Check(fi.TagSets, check.Equals, 1)
+		c.Check(fi.TagSetHash, check.Equals, info.TagSetHash)
+	}
+}
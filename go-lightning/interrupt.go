@@ -0,0 +1,61 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// interruptContext returns a context that is cancelled when the
+// process receives SIGINT or SIGTERM, so long-running commands can
+// stop their workers and remove temporary files before exiting.
+// context.Cause(ctx) indicates which signal was received.
+//
+// After the first signal, the default signal handling is restored,
+// so a second SIGINT/SIGTERM exits immediately.
+//
+// The caller must call the returned cancel func when finished.
+func interruptContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(sigs)
+		select {
+		case sig := <-sigs:
+			log.Warnf("received %s signal, cancelling (repeat to exit immediately)", sig)
+			cancel(fmt.Errorf("interrupted by %s signal", sig))
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() { cancel(context.Canceled) }
+}
+
+// removeTempFiles removes files in dir that match the given glob
+// patterns. It is used to clean up temporary files after an aborted
+// run, when deferred per-file cleanup might not have happened.
+func removeTempFiles(dir string, patterns ...string) {
+	for _, pattern := range patterns {
+		fnms, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			log.Warnf("error listing temporary files in %s: %s", dir, err)
+			continue
+		}
+		for _, fnm := range fnms {
+			if err := os.Remove(fnm); err != nil && !os.IsNotExist(err) {
+				log.Warnf("error removing temporary file: %s", err)
+			} else if err == nil {
+				log.Infof("removed temporary file %s", fnm)
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"sort"
+	"syscall"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type interruptSuite struct{}
+
+var _ = check.Suite(&interruptSuite{})
+
+func (s *interruptSuite) TestInterruptContext(c *check.C) {
+	if runtime.GOOS == "windows" {
+		c.Skip("cannot send SIGTERM on windows")
+	}
+	ctx, cancel := interruptContext(context.Background())
+	defer cancel()
+	c.Check(ctx.Err(), check.IsNil)
+	proc, err := os.FindProcess(os.Getpid())
+	c.Assert(err, check.IsNil)
+	c.Assert(proc.Signal(syscall.SIGTERM), check.IsNil)
+	select {
+	case <-ctx.Done():
+	case <-time.After(10 * time.Second):
+		c.Fatal("timed out waiting for cancel")
+	}
+	c.Check(context.Cause(ctx), check.ErrorMatches, `interrupted by terminated signal`)
+
+	ctx, cancel = interruptContext(context.Background())
+	cancel()
+	c.Check(context.Cause(ctx), check.Equals, context.Canceled)
+}
+
+func (s *interruptSuite) TestRemoveTempFiles(c *check.C) {
+	tmpdir := c.MkDir()
+	for _, fnm := range []string{"tmp.chr1.gob", "tmp.chr2.gob", "tmp.sort.0", "tmp.hgvs-matrix", "matrix.npy", "tmp.other"} {
+		c.Assert(os.WriteFile(tmpdir+"/"+fnm, nil, 0666), check.IsNil)
+	}
+	removeTempFiles(tmpdir, "tmp.*.gob", "tmp.hgvs-matrix", "tmp.panel-matrix", "tmp.sort.*")
+	ents, err := os.ReadDir(tmpdir)
+	c.Assert(err, check.IsNil)
+	var remaining []string
+	for _, ent := range ents {
+		remaining = append(remaining, ent.Name())
+	}
+	sort.Strings(remaining)
+	c.Check(remaining, check.DeepEquals, []string{"matrix.npy", "tmp.other"})
+}
@@ -0,0 +1,122 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Settings that tune reading input files from Keep (see open). They
+// are set by the -keep-block-cache and -keep-retries flags, which
+// parseFlags adds to every command.
+var (
+	keepBlocksPerFile  = 2
+	keepReadRetries    = 5
+	keepRetryBaseDelay = time.Second
+	keepRetryMaxDelay  = time.Minute
+)
+
+// keepFlags adds the Keep tuning flags to flags, unless they are
+// already there.
+func keepFlags(flags *flag.FlagSet) {
+	if flags.Lookup("keep-block-cache") != nil {
+		return
+	}
+	flags.IntVar(&keepBlocksPerFile, "keep-block-cache", 2, "when reading input files from Keep, add `N` 64 MiB blocks to the block cache for each open file")
+	flags.IntVar(&keepReadRetries, "keep-retries", 5, "when reading input files from Keep, retry a failed read up to `N` times, with exponential backoff starting at 1 second and capped at 1 minute")
+}
+
+// checkKeepFlags returns an error if the Keep tuning flags are out of
+// range.
+func checkKeepFlags() error {
+	if keepBlocksPerFile < 1 {
+		return fmt.Errorf("invalid -keep-block-cache %d: must be at least 1", keepBlocksPerFile)
+	} else if keepReadRetries < 0 {
+		return fmt.Errorf("invalid -keep-retries %d: must not be negative", keepReadRetries)
+	}
+	return nil
+}
+
+// keepArgs returns command line arguments that pass the Keep tuning
+// flags to a container.
+func keepArgs() []string {
+	return []string{
+		fmt.Sprintf("-keep-block-cache=%d", keepBlocksPerFile),
+		fmt.Sprintf("-keep-retries=%d", keepReadRetries),
+	}
+}
+
+// retryFile wraps a file opened by siteFS. If a read fails, it
+// reopens the file, seeks to the current position, and tries again,
+// with exponential backoff between attempts. When closed, it logs
+// the amount of data read, the read throughput, and the number of
+// retries.
+type retryFile struct {
+	file
+	reopen func() (file, error)
+	name   string
+
+	offset   int64
+	bytes    int64
+	readTime time.Duration
+	retries  int
+}
+
+func (rf *retryFile) Read(p []byte) (int, error) {
+	t0 := time.Now()
+	defer func() { rf.readTime += time.Since(t0) }()
+	delay := keepRetryBaseDelay
+	for attempt := 0; ; attempt++ {
+		n, err := rf.file.Read(p)
+		rf.offset += int64(n)
+		rf.bytes += int64(n)
+		if err == nil || err == io.EOF || n > 0 || attempt >= keepReadRetries {
+			return n, err
+		}
+		rf.retries++
+		log.Warnf("error reading %s at offset %d (attempt %d of %d), retrying in %v: %s", rf.name, rf.offset, attempt+1, keepReadRetries+1, delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > keepRetryMaxDelay {
+			delay = keepRetryMaxDelay
+		}
+		f, err := rf.reopen()
+		if err != nil {
+			log.Warnf("error reopening %s: %s", rf.name, err)
+			continue
+		}
+		_, err = f.Seek(rf.offset, io.SeekStart)
+		if err != nil {
+			f.Close()
+			log.Warnf("error seeking %s to offset %d: %s", rf.name, rf.offset, err)
+			continue
+		}
+		rf.file.Close()
+		rf.file = f
+	}
+}
+
+func (rf *retryFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := rf.file.Seek(offset, whence)
+	if err == nil {
+		rf.offset = pos
+	}
+	return pos, err
+}
+
+func (rf *retryFile) Close() error {
+	if rf.bytes > 0 {
+		mbps := 0.0
+		if rf.readTime > 0 {
+			mbps = float64(rf.bytes) / rf.readTime.Seconds() / 1e6
+		}
+		log.Infof("read %d bytes from %s in %v (%.1f MB/s), %d retries", rf.bytes, rf.name, rf.readTime.Round(time.Millisecond), mbps, rf.retries)
+	}
+	return rf.file.Close()
+}
@@ -0,0 +1,103 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type keepIOSuite struct{}
+
+var _ = check.Suite(&keepIOSuite{})
+
+// flakyFile returns an error from Read once it has returned failAt
+// bytes.
+type flakyFile struct {
+	*bytes.Reader
+	failAt int64
+}
+
+func (f *flakyFile) Read(p []byte) (int, error) {
+	pos, _ := f.Seek(0, io.SeekCurrent)
+	if pos >= f.failAt {
+		return 0, errors.New("transient error")
+	}
+	if int64(len(p)) > f.failAt-pos {
+		p = p[:f.failAt-pos]
+	}
+	return f.Reader.Read(p)
+}
+
+func (f *flakyFile) Close() error                       { return nil }
+func (f *flakyFile) Readdir(int) ([]os.FileInfo, error) { return nil, nil }
+
+func (s *keepIOSuite) TestRetry(c *check.C) {
+	defer func(d time.Duration) { keepRetryBaseDelay = d }(keepRetryBaseDelay)
+	keepRetryBaseDelay = time.Millisecond
+
+	data := []byte("0123456789abcdefghij")
+	opened := 0
+	reopen := func() (file, error) {
+		opened++
+		// Each reopened file fails a bit further along.
+		return &flakyFile{Reader: bytes.NewReader(data), failAt: int64(5 * (opened + 1))}, nil
+	}
+	first, _ := reopen()
+	rf := &retryFile{file: first, name: "test", reopen: reopen}
+	buf, err := ioutil.ReadAll(rf)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, string(data))
+	c.Check(rf.retries, check.Equals, 3)
+	c.Check(rf.bytes, check.Equals, int64(len(data)))
+	c.Check(rf.Close(), check.IsNil)
+}
+
+func (s *keepIOSuite) TestRetryLimit(c *check.C) {
+	defer func(d time.Duration, n int) { keepRetryBaseDelay, keepReadRetries = d, n }(keepRetryBaseDelay, keepReadRetries)
+	keepRetryBaseDelay = time.Millisecond
+	keepReadRetries = 2
+
+	reopen := func() (file, error) {
+		return &flakyFile{Reader: bytes.NewReader([]byte("0123456789")), failAt: 3}, nil
+	}
+	first, _ := reopen()
+	rf := &retryFile{file: first, name: "test", reopen: reopen}
+	buf, err := ioutil.ReadAll(rf)
+	c.Check(err, check.ErrorMatches, "transient error")
+	c.Check(string(buf), check.Equals, "012")
+	c.Check(rf.retries, check.Equals, 2)
+}
+
+func (s *keepIOSuite) TestKeepFlags(c *check.C) {
+	defer func(n, r int) { keepBlocksPerFile, keepReadRetries = n, r }(keepBlocksPerFile, keepReadRetries)
+	defer os.Unsetenv("LIGHTNING_KEEP_RETRIES")
+	os.Setenv("LIGHTNING_KEEP_RETRIES", "7")
+
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	err := parseFlags(flags, "lightning test", []string{"-keep-block-cache=3"})
+	c.Assert(err, check.IsNil)
+	c.Check(keepBlocksPerFile, check.Equals, 3)
+	c.Check(keepReadRetries, check.Equals, 7)
+	c.Check(keepArgs(), check.DeepEquals, []string{"-keep-block-cache=3", "-keep-retries=7"})
+
+	for _, args := range [][]string{
+		{"-keep-block-cache=0"},
+		{"-keep-retries=-1"},
+	} {
+		flags := flag.NewFlagSet("", flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		err = parseFlags(flags, "lightning test", args)
+		c.Check(err, check.ErrorMatches, `invalid -keep-.*`)
+	}
+}
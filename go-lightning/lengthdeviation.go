@@ -0,0 +1,70 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+)
+
+// lengthDeviationMissing is the length deviation of a tile variant
+// that has no corresponding reference sequence.
+const lengthDeviationMissing = math.MinInt32
+
+// lengthDeviationInt16 returns the given length deviation as an
+// entry of the length-deviation matrix output, where math.MinInt16
+// means missing, and larger deviations are clamped to ±math.MaxInt16.
+func lengthDeviationInt16(dev int32) int16 {
+	if dev == lengthDeviationMissing {
+		return math.MinInt16
+	} else if dev > math.MaxInt16 {
+		return math.MaxInt16
+	} else if dev < -math.MaxInt16 {
+		return -math.MaxInt16
+	}
+	return int16(dev)
+}
+
+// lengthMatrixMissing is the missing-value predicate for the
+// length-deviation matrix output.
+func lengthMatrixMissing(v int16) bool { return v == math.MinInt16 }
+
+// writeLengthDeviation writes a CSV file with the length deviation
+// of each one-hot column's tile variant from the reference. The
+// Deviation field is empty if the variant has no corresponding
+// reference sequence.
+func writeLengthDeviation(fnm string, xrefs []onehotXref) error {
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriterSize(f, 1<<20)
+	_, err = fmt.Fprint(bufw, "ColumnID,Column,Tag,Variant,Hom,Deviation\n")
+	if err != nil {
+		return err
+	}
+	for i, xref := range xrefs {
+		hom := 0
+		if xref.hom {
+			hom = 1
+		}
+		dev := ""
+		if xref.lengthDeviation != lengthDeviationMissing {
+			dev = fmt.Sprintf("%d", xref.lengthDeviation)
+		}
+		_, err = fmt.Fprintf(bufw, "%s,%d,%d,%d,%d,%s\n", xref.columnID(), i, xref.tag, xref.variant, hom, dev)
+		if err != nil {
+			return err
+		}
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
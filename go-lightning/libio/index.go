@@ -0,0 +1,373 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package libio
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"sort"
+
+	"github.com/klauspost/pgzip"
+)
+
+// An indexed library file is an ordinary gzip-compressed library file
+// (so it can be read sequentially by NewReader) with additional
+// structure that allows ReadTagRange to read a range of tags without
+// decompressing and decoding the whole file:
+//
+//   - The first gzip member contains the tag set (see
+//     TagSetEntries), reference sequences, and genomes.
+//
+//   - Each following gzip member contains the tile variants for a
+//     block of consecutive tags, in tag order.
+//
+//   - The last gzip member is empty. The "extra" field of its gzip
+//     header holds the index: the first tag and file offset of each
+//     block, and the offset of the last member itself.
+const (
+	indexSubfieldID = "LI"
+	maxIndexBlocks  = 4096 // keeps the index well under the 64 KiB gzip extra field limit
+	indexBlockSize  = 12   // 4 bytes tag, 8 bytes offset
+)
+
+type indexBlock struct {
+	StartTag TagID
+	Offset   int64
+}
+
+type tagIndex struct {
+	blocks []indexBlock
+	end    int64 // offset of index member = end of last block
+}
+
+// WriteIndexed writes an indexed library file with the given
+// content to w. Tile variants are grouped into blocks of blockTags
+// consecutive tags (or more, if needed to keep the index size
+// reasonable).
+func WriteIndexed(w io.Writer, tagset [][]byte, css []CompactSequence, cgs []CompactGenome, tvs []TileVariant, blockTags int) error {
+	sorted := make([]TileVariant, len(tvs))
+	copy(sorted, tvs)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Tag < sorted[j].Tag })
+	if blockTags < 1 {
+		blockTags = 1
+	}
+	if n := len(sorted); n > 0 {
+		span := int(sorted[n-1].Tag-sorted[0].Tag) + 1
+		if min := (span + maxIndexBlocks - 1) / maxIndexBlocks; blockTags < min {
+			blockTags = min
+		}
+	}
+
+	bufw := bufio.NewWriterSize(w, 1<<20)
+	cw := &countingWriter{w: bufw}
+	zw := pgzip.NewWriter(cw)
+	enc := gob.NewEncoder(zw)
+	// The first entry must be in the first member (even if
+	// tagset is empty) because it includes the gob type
+	// definitions needed to decode the rest of the file.
+	for _, ent := range TagSetEntries(tagset) {
+		if err := enc.Encode(ent); err != nil {
+			return err
+		}
+	}
+	if len(css) > 0 {
+		if err := enc.Encode(&LibraryEntry{CompactSequences: css}); err != nil {
+			return err
+		}
+	}
+	if len(cgs) > 0 {
+		if err := enc.Encode(&LibraryEntry{CompactGenomes: cgs}); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	var idx tagIndex
+	for i := 0; i < len(sorted); {
+		start := sorted[i].Tag / TagID(blockTags) * TagID(blockTags)
+		j := i
+		for j < len(sorted) && sorted[j].Tag < start+TagID(blockTags) {
+			j++
+		}
+		idx.blocks = append(idx.blocks, indexBlock{StartTag: start, Offset: cw.n})
+		zw.Reset(cw)
+		if err := enc.Encode(&LibraryEntry{TileVariants: sorted[i:j]}); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		i = j
+	}
+	idx.end = cw.n
+	iw := gzip.NewWriter(cw)
+	iw.Header.Extra = idx.encode()
+	if err := iw.Close(); err != nil {
+		return err
+	}
+	return bufw.Flush()
+}
+
+func (idx *tagIndex) encode() []byte {
+	data := make([]byte, 0, 8+len(idx.blocks)*indexBlockSize)
+	for _, b := range idx.blocks {
+		data = binary.LittleEndian.AppendUint32(data, uint32(b.StartTag))
+		data = binary.LittleEndian.AppendUint64(data, uint64(b.Offset))
+	}
+	data = binary.LittleEndian.AppendUint64(data, uint64(idx.end))
+	extra := append([]byte(indexSubfieldID), 0, 0)
+	binary.LittleEndian.PutUint16(extra[2:], uint16(len(data)))
+	return append(extra, data...)
+}
+
+func decodeTagIndex(extra []byte) (*tagIndex, bool) {
+	for len(extra) >= 4 {
+		id, size := string(extra[:2]), int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return nil, false
+		}
+		data := extra[4 : 4+size]
+		extra = extra[4+size:]
+		if id != indexSubfieldID || size < 8 || (size-8)%indexBlockSize != 0 {
+			continue
+		}
+		idx := &tagIndex{end: int64(binary.LittleEndian.Uint64(data[size-8:]))}
+		for i := 0; i+indexBlockSize <= size-8; i += indexBlockSize {
+			idx.blocks = append(idx.blocks, indexBlock{
+				StartTag: TagID(binary.LittleEndian.Uint32(data[i:])),
+				Offset:   int64(binary.LittleEndian.Uint64(data[i+4:])),
+			})
+		}
+		return idx, true
+	}
+	return nil, false
+}
+
+// readTagIndex returns the index of an indexed library file, or nil
+// if the file is not indexed.
+func readTagIndex(rs io.ReadSeeker) (*tagIndex, error) {
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	// The index member is at most 10 bytes of header, 2+65535
+	// bytes of extra field, and a few bytes of (empty) data and
+	// trailer.
+	tailsize := int64(1 << 17)
+	if tailsize > size {
+		tailsize = size
+	}
+	if _, err = rs.Seek(size-tailsize, io.SeekStart); err != nil {
+		return nil, err
+	}
+	tail := make([]byte, tailsize)
+	if _, err = io.ReadFull(rs, tail); err != nil {
+		return nil, err
+	}
+	// Look for the last gzip header (with FEXTRA flag set) that
+	// parses as a member containing an index, and ends at EOF.
+	for i := len(tail); i > 0; {
+		i = bytes.LastIndex(tail[:i], []byte{0x1f, 0x8b, 8})
+		if i < 0 {
+			break
+		}
+		if i+3 >= len(tail) || tail[i+3]&4 == 0 {
+			continue
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(tail[i:]))
+		if err != nil {
+			continue
+		}
+		idx, ok := decodeTagIndex(zr.Header.Extra)
+		if !ok || idx.end != size-tailsize+int64(i) {
+			continue
+		}
+		if n, err := io.Copy(io.Discard, zr); err != nil || n != 0 {
+			continue
+		}
+		return idx, nil
+	}
+	return nil, nil
+}
+
+// ReadTagRange reads the parts of a library file that pertain to
+// tags in the range [start, end), and calls the given handlers (see
+// (*Reader)Read). Genomes are trimmed to the requested range, so
+// their StartTag and EndTag fields are within [start, end).
+//
+// If the file is indexed (see WriteIndexed), only the relevant tile
+// variant blocks are decompressed. Otherwise, the whole file is read
+// and filtered.
+func ReadTagRange(rs io.ReadSeeker, start, end TagID, h Handlers) error {
+	idx, err := readTagIndex(rs)
+	if err != nil {
+		return err
+	}
+	var rdr io.Reader
+	if idx == nil {
+		if _, err = rs.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		rdr = rs
+	} else {
+		headerEnd := idx.end
+		if len(idx.blocks) > 0 {
+			headerEnd = idx.blocks[0].Offset
+		}
+		sections := []io.Reader{&seekSection{rs: rs, off: 0, n: headerEnd}}
+		first, last := -1, -1
+		for i, b := range idx.blocks {
+			if b.StartTag >= end {
+				break
+			}
+			if i+1 < len(idx.blocks) && idx.blocks[i+1].StartTag <= start {
+				continue
+			}
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+		if first >= 0 {
+			blocksEnd := idx.end
+			if last+1 < len(idx.blocks) {
+				blocksEnd = idx.blocks[last+1].Offset
+			}
+			off := idx.blocks[first].Offset
+			sections = append(sections, &seekSection{rs: rs, off: off, n: blocksEnd - off})
+		}
+		rdr = io.MultiReader(sections...)
+	}
+	r, err := NewReader(rdr)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	filtered := h
+	if h.TileVariant != nil {
+		filtered.TileVariant = func(tv *TileVariant) error {
+			if tv.Tag < start || tv.Tag >= end {
+				return nil
+			}
+			return h.TileVariant(tv)
+		}
+	}
+	if h.CompactGenome != nil {
+		filtered.CompactGenome = func(cg *CompactGenome) error {
+			trimmed := TrimCompactGenome(*cg, start, end)
+			return h.CompactGenome(&trimmed)
+		}
+	}
+	return r.Read(filtered)
+}
+
+// ReadHeader reads the tag set, reference sequences, and genomes
+// from an indexed library file (see WriteIndexed) and calls the
+// given handlers, without decompressing any tile variant blocks.
+//
+// If the file is not indexed, ReadHeader returns false without
+// calling any handlers.
+func ReadHeader(rs io.ReadSeeker, h Handlers) (bool, error) {
+	idx, err := readTagIndex(rs)
+	if err != nil || idx == nil {
+		return false, err
+	}
+	headerEnd := idx.end
+	if len(idx.blocks) > 0 {
+		headerEnd = idx.blocks[0].Offset
+	}
+	r, err := NewReader(&seekSection{rs: rs, off: 0, n: headerEnd})
+	if err != nil {
+		return true, err
+	}
+	defer r.Close()
+	h.TileVariant = nil
+	return true, r.Read(h)
+}
+
+// TrimCompactGenome returns the part of cg that pertains to tags in
+// the range [start, end).
+func TrimCompactGenome(cg CompactGenome, start, end TagID) CompactGenome {
+	if start < cg.StartTag {
+		start = cg.StartTag
+	}
+	if end > cg.EndTag {
+		end = cg.EndTag
+	}
+	if end < start {
+		end = start
+	}
+	from, to := 2*int(start-cg.StartTag), 2*int(end-cg.StartTag)
+	if to > len(cg.Variants) {
+		to = len(cg.Variants)
+	}
+	if from > to {
+		from = to
+	}
+	return CompactGenome{
+		Name:         cg.Name,
+		Variants:     cg.Variants[from:to],
+		StartTag:     start,
+		EndTag:       end,
+		Heteroplasmy: TrimHeteroplasmy(cg.Heteroplasmy, start, end),
+	}
+}
+
+// seekSection reads n bytes starting at offset off. It seeks on the
+// first call to Read, so several seekSections can share an
+// io.ReadSeeker as long as they are read one at a time (e.g., via
+// io.MultiReader).
+type seekSection struct {
+	rs     io.ReadSeeker
+	off    int64
+	n      int64
+	seeked bool
+}
+
+func (s *seekSection) Read(p []byte) (int, error) {
+	if !s.seeked {
+		if _, err := s.rs.Seek(s.off, io.SeekStart); err != nil {
+			return 0, err
+		}
+		s.seeked = true
+	}
+	if s.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > s.n {
+		p = p[:s.n]
+	}
+	n, err := s.rs.Read(p)
+	s.n -= int64(n)
+	if err == io.EOF && s.n > 0 {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// IsIndexed returns true if the given library file is indexed (see
+// WriteIndexed).
+func IsIndexed(rs io.ReadSeeker) (bool, error) {
+	idx, err := readTagIndex(rs)
+	return idx != nil, err
+}
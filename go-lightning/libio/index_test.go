@@ -0,0 +1,151 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package libio
+
+import (
+	"bytes"
+	"fmt"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *libioSuite) writeIndexed(c *check.C, blockTags int) []byte {
+	var tvs []TileVariant
+	for tag := TagID(99); tag >= 10; tag-- {
+		tvs = append(tvs, TileVariant{Tag: tag, Variant: 1, Sequence: []byte(fmt.Sprintf("seq%d", tag))})
+	}
+	variants := make([]TileVariantID, 180)
+	for i := range variants {
+		variants[i] = TileVariantID(i/2 + 10)
+	}
+	var buf bytes.Buffer
+	err := WriteIndexed(&buf,
+		[][]byte{[]byte("acgtacgtacgtacgtacgtacgt")},
+		[]CompactSequence{{Name: "ref", TileSequences: map[string][]TileLibRef{"chr1": {{Tag: 10, Variant: 1}}}}},
+		[]CompactGenome{{Name: "sample1", Variants: variants, StartTag: 10, EndTag: 100}},
+		tvs, blockTags)
+	c.Assert(err, check.IsNil)
+	return buf.Bytes()
+}
+
+func (s *libioSuite) TestIndexedSequentialRead(c *check.C) {
+	r, err := NewReader(bytes.NewReader(s.writeIndexed(c, 20)))
+	c.Assert(err, check.IsNil)
+	var tags []TagID
+	var cgs []CompactGenome
+	err = r.Read(Handlers{
+		TileVariant:   func(tv *TileVariant) error { tags = append(tags, tv.Tag); return nil },
+		CompactGenome: func(cg *CompactGenome) error { cgs = append(cgs, *cg); return nil },
+	})
+	c.Check(err, check.IsNil)
+	c.Assert(tags, check.HasLen, 90)
+	for i, tag := range tags {
+		c.Check(tag, check.Equals, TagID(i+10))
+	}
+	c.Assert(cgs, check.HasLen, 1)
+	c.Check(cgs[0].Variants, check.HasLen, 180)
+}
+
+func (s *libioSuite) TestReadTagRange(c *check.C) {
+	indexed := s.writeIndexed(c, 20)
+	idx, err := readTagIndex(bytes.NewReader(indexed))
+	c.Assert(err, check.IsNil)
+	c.Assert(idx, check.NotNil)
+	c.Check(idx.blocks, check.HasLen, 5)
+
+	for _, trial := range []struct {
+		buf        []byte
+		start, end TagID
+	}{
+		{indexed, 45, 62},
+		{indexed, 0, 5},
+		{indexed, 0, 1000},
+		{indexed, 99, 100},
+		{s.writeLibrary(c, true), 1, 2},
+		{s.writeLibrary(c, false), 0, 1},
+	} {
+		c.Logf("trial %d-%d", trial.start, trial.end)
+		var tags []TagID
+		var cgs []CompactGenome
+		var tagsets, css int
+		err := ReadTagRange(bytes.NewReader(trial.buf), trial.start, trial.end, Handlers{
+			TagSet:          func([][]byte) error { tagsets++; return nil },
+			TileVariant:     func(tv *TileVariant) error { tags = append(tags, tv.Tag); return nil },
+			CompactGenome:   func(cg *CompactGenome) error { cgs = append(cgs, *cg); return nil },
+			CompactSequence: func(*CompactSequence) error { css++; return nil },
+		})
+		c.Assert(err, check.IsNil)
+		c.Check(tagsets, check.Equals, 1)
+		c.Check(css, check.Equals, 1)
+		for _, tag := range tags {
+			c.Check(tag >= trial.start && tag < trial.end, check.Equals, true)
+		}
+		c.Assert(cgs, check.HasLen, 1)
+		cg := cgs[0]
+		c.Check(cg.Variants, check.HasLen, 2*int(cg.EndTag-cg.StartTag))
+		if len(trial.buf) == len(indexed) {
+			expect := int(trial.end - trial.start)
+			if trial.start < 10 {
+				expect -= int(10 - trial.start)
+			}
+			if trial.end > 100 {
+				expect -= int(trial.end - 100)
+			}
+			if expect < 0 {
+				expect = 0
+			}
+			c.Check(tags, check.HasLen, expect)
+			for i := 0; i < len(cg.Variants); i++ {
+				c.Check(cg.Variants[i], check.Equals, TileVariantID(int(cg.StartTag)+i/2))
+			}
+		}
+	}
+}
+
+func (s *libioSuite) TestTrimCompactGenome(c *check.C) {
+	cg := CompactGenome{Name: "x", Variants: []TileVariantID{1, 1, 2, 2, 3, 3}, StartTag: 5, EndTag: 8}
+	c.Check(TrimCompactGenome(cg, 6, 7), check.DeepEquals, CompactGenome{Name: "x", Variants: []TileVariantID{2, 2}, StartTag: 6, EndTag: 7})
+	c.Check(TrimCompactGenome(cg, 0, 100), check.DeepEquals, cg)
+	c.Check(TrimCompactGenome(cg, 10, 20).Variants, check.HasLen, 0)
+
+	cg.Heteroplasmy = []Heteroplasmy{{Tag: 5, Fraction: 0.1}, {Tag: 7, Fraction: 0.2}}
+	c.Check(TrimCompactGenome(cg, 6, 8).Heteroplasmy, check.DeepEquals, []Heteroplasmy{{Tag: 7, Fraction: 0.2}})
+	c.Check(TrimCompactGenome(cg, 6, 7).Heteroplasmy, check.HasLen, 0)
+}
+
+func (s *libioSuite) TestReadHeader(c *check.C) {
+	indexed := s.writeIndexed(c, 20)
+	idx, err := readTagIndex(bytes.NewReader(indexed))
+	c.Assert(err, check.IsNil)
+	// Corrupt the tile variant blocks, to confirm ReadHeader
+	// doesn't decompress them.
+	for i := idx.blocks[0].Offset + 10; i < idx.end-10; i++ {
+		indexed[i] = 0
+	}
+	var ntagsets, ntvs int
+	var css []CompactSequence
+	var cgs []CompactGenome
+	h := Handlers{
+		TagSet:          func([][]byte) error { ntagsets++; return nil },
+		TileVariant:     func(*TileVariant) error { ntvs++; return nil },
+		CompactGenome:   func(cg *CompactGenome) error { cgs = append(cgs, *cg); return nil },
+		CompactSequence: func(cs *CompactSequence) error { css = append(css, *cs); return nil },
+	}
+	ok, err := ReadHeader(bytes.NewReader(indexed), h)
+	c.Check(err, check.IsNil)
+	c.Check(ok, check.Equals, true)
+	c.Check(ntagsets, check.Equals, 1)
+	c.Check(ntvs, check.Equals, 0)
+	c.Assert(css, check.HasLen, 1)
+	c.Check(css[0].Name, check.Equals, "ref")
+	c.Assert(cgs, check.HasLen, 1)
+	c.Check(cgs[0].Variants, check.HasLen, 180)
+
+	ntagsets = 0
+	ok, err = ReadHeader(bytes.NewReader(s.writeLibrary(c, true)), h)
+	c.Check(err, check.IsNil)
+	c.Check(ok, check.Equals, false)
+	c.Check(ntagsets, check.Equals, 0)
+}
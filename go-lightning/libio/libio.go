@@ -0,0 +1,146 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+// Package libio reads and writes lightning library files (the
+// library.gob and library.gob.gz files written by "lightning
+// import", "lightning merge", "lightning slice", etc.).
+//
+// Compatibility: a library file is a sequence of gob-encoded
+// LibraryEntry values, optionally gzip-compressed. Fields may be
+// added to the types in this package in future versions, but
+// existing fields will not be removed, renamed, or changed to an
+// incompatible type. Readers built with this package will continue
+// to read files written by later versions (ignoring new fields), and
+// later versions will continue to read files written by this one.
+package libio
+
+import (
+	"bytes"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// TagID identifies a tag: it is the tag's 0-based position in the
+// tag set.
+type TagID int32
+
+// TileVariantID identifies a variant of a tile. Variant IDs are
+// 1-based; 0 means no call / unknown.
+type TileVariantID uint16
+
+// TileLibRef identifies a tile variant.
+type TileLibRef struct {
+	Tag     TagID
+	Variant TileVariantID
+}
+
+// CompactGenome is a genome, represented as a list of tile variants
+// (two per tag, one for each phase) starting at StartTag.
+type CompactGenome struct {
+	Name     string
+	Variants []TileVariantID
+	StartTag TagID
+	EndTag   TagID
+
+	// Heteroplasmy lists the tags on haploid chromosomes (e.g.,
+	// chrM) where the second phase holds a secondary tile
+	// variant instead of a copy of the first. It is populated
+	// only by "lightning import -heteroplasmy-min-af".
+	Heteroplasmy []Heteroplasmy
+}
+
+// Heteroplasmy is the fraction of a genome's reads that support the
+// secondary tile variant at a tag on a haploid chromosome.
+type Heteroplasmy struct {
+	Tag      TagID
+	Fraction float32
+}
+
+// TrimHeteroplasmy returns the entries of het that pertain to tags
+// in the range [start, end).
+func TrimHeteroplasmy(het []Heteroplasmy, start, end TagID) []Heteroplasmy {
+	var trimmed []Heteroplasmy
+	for _, h := range het {
+		if h.Tag >= start && h.Tag < end {
+			trimmed = append(trimmed, h)
+		}
+	}
+	return trimmed
+}
+
+// CompactSequence is a reference genome (one path of tile variants
+// per chromosome).
+type CompactSequence struct {
+	Name          string
+	TileSequences map[string][]TileLibRef
+}
+
+// TileVariant is a single tile variant, including its sequence if
+// the library was written with tile sequences.
+type TileVariant struct {
+	Tag      TagID
+	Ref      bool
+	Variant  TileVariantID
+	Blake2b  [blake2b.Size256]byte
+	Sequence []byte
+
+	// Source and SourceTime (unix timestamp) identify the input
+	// file in which this tile variant was first seen, and when.
+	// They are populated only if provenance tracking was enabled
+	// during import.
+	Source     string
+	SourceTime int64
+}
+
+// LibraryEntry is a single record in a library file. Any combination
+// of fields can be populated.
+type LibraryEntry struct {
+	TagSet           [][]byte
+	CompactGenomes   []CompactGenome
+	CompactSequences []CompactSequence
+	TileVariants     []TileVariant
+
+	// TagSetHash is TagSetHash(TagSet). It is populated when
+	// TagSet is (except in files written by older versions), and
+	// in the tag set header entry (see TagSetEntries).
+	TagSetHash [blake2b.Size256]byte
+
+	// TagSetSize is the number of tags in the tag set. It is
+	// populated only in the tag set header entry.
+	TagSetSize int
+}
+
+// TagSetEntry returns a library entry containing the given tag set
+// and its hash.
+func TagSetEntry(tagset [][]byte) *LibraryEntry {
+	return &LibraryEntry{TagSet: tagset, TagSetHash: TagSetHash(tagset)}
+}
+
+// TagSetEntries returns the entries that introduce the given tag set
+// at the start of a library file: a small header entry with the hash
+// and size of the tag set (but not the tag set itself), which lets
+// readers identify the tag set without decoding it, followed by
+// TagSetEntry(tagset). If the tag set is empty, only the second
+// entry is returned.
+func TagSetEntries(tagset [][]byte) []*LibraryEntry {
+	ent := TagSetEntry(tagset)
+	if len(tagset) == 0 {
+		return []*LibraryEntry{ent}
+	}
+	return []*LibraryEntry{{TagSetHash: ent.TagSetHash, TagSetSize: len(tagset)}, ent}
+}
+
+// TagSetHash returns a hash of the content of the given tag set
+// (ignoring case). Libraries can be merged only if their tag sets
+// have the same hash.
+func TagSetHash(tagset [][]byte) [blake2b.Size256]byte {
+	h, _ := blake2b.New256(nil)
+	for _, tag := range tagset {
+		h.Write(bytes.ToLower(tag))
+		h.Write([]byte{'\n'})
+	}
+	var sum [blake2b.Size256]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
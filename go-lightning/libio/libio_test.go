@@ -0,0 +1,116 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package libio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type libioSuite struct{}
+
+var _ = check.Suite(&libioSuite{})
+
+func (s *libioSuite) writeLibrary(c *check.C, gz bool) []byte {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, gz)
+	c.Assert(w.WriteTagSet([][]byte{[]byte("acgtacgtacgtacgtacgtacgt"), []byte("ggggccccaaaattttggggcccc")}), check.IsNil)
+	c.Assert(w.WriteTileVariants([]TileVariant{
+		{Tag: 0, Variant: 1, Ref: true, Sequence: []byte("acgt")},
+		{Tag: 1, Variant: 1, Sequence: []byte("ggcc")},
+	}), check.IsNil)
+	c.Assert(w.WriteCompactGenomes([]CompactGenome{{Name: "sample1", Variants: []TileVariantID{1, 1, 1, 0}, StartTag: 0, EndTag: 2}}), check.IsNil)
+	c.Assert(w.WriteCompactSequences([]CompactSequence{{Name: "ref", TileSequences: map[string][]TileLibRef{"chr1": {{Tag: 0, Variant: 1}}}}}), check.IsNil)
+	c.Assert(w.Close(), check.IsNil)
+	return buf.Bytes()
+}
+
+func (s *libioSuite) TestRoundTrip(c *check.C) {
+	for _, gz := range []bool{false, true} {
+		c.Logf("gz=%v", gz)
+		r, err := NewReader(bytes.NewReader(s.writeLibrary(c, gz)))
+		c.Assert(err, check.IsNil)
+		var tagsets int
+		var tvs []TileVariant
+		var cgs []CompactGenome
+		var css []CompactSequence
+		err = r.Read(Handlers{
+			TagSet:          func(tagset [][]byte) error { tagsets++; c.Check(tagset, check.HasLen, 2); return nil },
+			TileVariant:     func(tv *TileVariant) error { tvs = append(tvs, *tv); return nil },
+			CompactGenome:   func(cg *CompactGenome) error { cgs = append(cgs, *cg); return nil },
+			CompactSequence: func(cs *CompactSequence) error { css = append(css, *cs); return nil },
+		})
+		c.Check(err, check.IsNil)
+		c.Check(r.Close(), check.IsNil)
+		c.Check(tagsets, check.Equals, 1)
+		c.Assert(tvs, check.HasLen, 2)
+		c.Check(tvs[0].Ref, check.Equals, true)
+		c.Check(string(tvs[1].Sequence), check.Equals, "ggcc")
+		c.Assert(cgs, check.HasLen, 1)
+		c.Check(cgs[0].Name, check.Equals, "sample1")
+		c.Check(cgs[0].Variants, check.DeepEquals, []TileVariantID{1, 1, 1, 0})
+		c.Check(cgs[0].EndTag, check.Equals, TagID(2))
+		c.Assert(css, check.HasLen, 1)
+		c.Check(css[0].TileSequences["chr1"], check.DeepEquals, []TileLibRef{{Tag: 0, Variant: 1}})
+	}
+}
+
+func (s *libioSuite) TestNext(c *check.C) {
+	r, err := NewReader(bytes.NewReader(s.writeLibrary(c, true)))
+	c.Assert(err, check.IsNil)
+	var n int
+	for {
+		ent, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, check.IsNil)
+		c.Check(ent, check.NotNil)
+		n++
+	}
+	c.Check(n, check.Equals, 5) // tag set header, tag set, tile variants, genomes, sequences
+}
+
+func (s *libioSuite) TestHandlerError(c *check.C) {
+	r, err := NewReader(bytes.NewReader(s.writeLibrary(c, false)))
+	c.Assert(err, check.IsNil)
+	stop := errors.New("stop")
+	var calls int
+	err = r.Read(Handlers{TileVariant: func(*TileVariant) error { calls++; return stop }})
+	c.Check(err, check.Equals, stop)
+	c.Check(calls, check.Equals, 1)
+}
+
+func (s *libioSuite) TestEmpty(c *check.C) {
+	r, err := NewReader(bytes.NewReader(nil))
+	c.Assert(err, check.IsNil)
+	_, err = r.Next()
+	c.Check(err, check.Equals, io.EOF)
+}
+
+func (s *libioSuite) TestTagSetHash(c *check.C) {
+	a := TagSetHash([][]byte{[]byte("acgt"), []byte("ttt")})
+	c.Check(TagSetHash([][]byte{[]byte("ACGT"), []byte("TTT")}), check.Equals, a)
+	c.Check(TagSetHash([][]byte{[]byte("acgtt"), []byte("tt")}), check.Not(check.Equals), a)
+	c.Check(TagSetHash([][]byte{[]byte("ttt"), []byte("acgt")}), check.Not(check.Equals), a)
+
+	r, err := NewReader(bytes.NewReader(s.writeLibrary(c, false)))
+	c.Assert(err, check.IsNil)
+	hdr, err := r.Next()
+	c.Assert(err, check.IsNil)
+	c.Check(hdr.TagSet, check.HasLen, 0)
+	c.Check(hdr.TagSetSize, check.Equals, 2)
+	ent, err := r.Next()
+	c.Assert(err, check.IsNil)
+	c.Check(ent.TagSet, check.HasLen, 2)
+	c.Check(ent.TagSetHash, check.Equals, TagSetHash(ent.TagSet))
+	c.Check(hdr.TagSetHash, check.Equals, ent.TagSetHash)
+}
@@ -0,0 +1,109 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package libio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"io"
+
+	"github.com/klauspost/pgzip"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Reader reads entries from a library file.
+type Reader struct {
+	dec    *gob.Decoder
+	closer io.Closer
+}
+
+// NewReader returns a Reader that reads library entries from r. If
+// the data is gzip-compressed, it is decompressed automatically.
+func NewReader(r io.Reader) (*Reader, error) {
+	bufr := bufio.NewReaderSize(r, 1<<20)
+	magic, err := bufr.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(magic, gzipMagic) {
+		return &Reader{dec: gob.NewDecoder(bufr)}, nil
+	}
+	zr, err := pgzip.NewReader(bufr)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{dec: gob.NewDecoder(zr), closer: zr}, nil
+}
+
+// Next returns the next entry. At the end of the library, it
+// returns nil, io.EOF.
+func (r *Reader) Next() (*LibraryEntry, error) {
+	var ent LibraryEntry
+	err := r.dec.Decode(&ent)
+	if err != nil {
+		return nil, err
+	}
+	return &ent, nil
+}
+
+// Close releases resources used by the reader. It does not close the
+// underlying io.Reader.
+func (r *Reader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// Handlers are the callbacks used by (*Reader)Read. Nil callbacks
+// are skipped. If a callback returns an error, Read stops and
+// returns that error.
+type Handlers struct {
+	TagSet          func(tagset [][]byte) error
+	TileVariant     func(tv *TileVariant) error
+	CompactGenome   func(cg *CompactGenome) error
+	CompactSequence func(cs *CompactSequence) error
+}
+
+// Read calls the given handlers for each item in the library, in the
+// order they appear in the file, until the end of the library.
+func (r *Reader) Read(h Handlers) error {
+	for {
+		ent, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if h.TagSet != nil && len(ent.TagSet) > 0 {
+			if err = h.TagSet(ent.TagSet); err != nil {
+				return err
+			}
+		}
+		if h.TileVariant != nil {
+			for i := range ent.TileVariants {
+				if err = h.TileVariant(&ent.TileVariants[i]); err != nil {
+					return err
+				}
+			}
+		}
+		if h.CompactGenome != nil {
+			for i := range ent.CompactGenomes {
+				if err = h.CompactGenome(&ent.CompactGenomes[i]); err != nil {
+					return err
+				}
+			}
+		}
+		if h.CompactSequence != nil {
+			for i := range ent.CompactSequences {
+				if err = h.CompactSequence(&ent.CompactSequences[i]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package libio
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+
+	"github.com/klauspost/pgzip"
+)
+
+// Writer writes entries to a library file.
+type Writer struct {
+	bufw *bufio.Writer
+	zw   *pgzip.Writer
+	enc  *gob.Encoder
+}
+
+// NewWriter returns a Writer that writes library entries to w,
+// gzip-compressed if gz is true. The caller must call Close to flush
+// buffered data.
+func NewWriter(w io.Writer, gz bool) *Writer {
+	lw := &Writer{bufw: bufio.NewWriterSize(w, 1<<20)}
+	if gz {
+		lw.zw = pgzip.NewWriter(lw.bufw)
+		lw.enc = gob.NewEncoder(lw.zw)
+	} else {
+		lw.enc = gob.NewEncoder(lw.bufw)
+	}
+	return lw
+}
+
+// Write writes a single entry.
+func (w *Writer) Write(ent *LibraryEntry) error {
+	return w.enc.Encode(ent)
+}
+
+// WriteTagSet writes the entries that introduce the given tag set
+// (see TagSetEntries).
+func (w *Writer) WriteTagSet(tagset [][]byte) error {
+	for _, ent := range TagSetEntries(tagset) {
+		if err := w.Write(ent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteTileVariants writes an entry containing the given tile
+// variants.
+func (w *Writer) WriteTileVariants(tvs []TileVariant) error {
+	return w.Write(&LibraryEntry{TileVariants: tvs})
+}
+
+// WriteCompactGenomes writes an entry containing the given genomes.
+func (w *Writer) WriteCompactGenomes(cgs []CompactGenome) error {
+	return w.Write(&LibraryEntry{CompactGenomes: cgs})
+}
+
+// WriteCompactSequences writes an entry containing the given
+// reference sequences.
+func (w *Writer) WriteCompactSequences(css []CompactSequence) error {
+	return w.Write(&LibraryEntry{CompactSequences: css})
+}
+
+// Close flushes buffered data. It does not close the underlying
+// io.Writer.
+func (w *Writer) Close() error {
+	if w.zw != nil {
+		if err := w.zw.Close(); err != nil {
+			return err
+		}
+	}
+	return w.bufw.Flush()
+}
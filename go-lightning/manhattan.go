@@ -35,8 +35,10 @@ func (cmd *manhattanPlot) RunCommand(prog string, args []string, stdin io.Reader
 	csvOutputFilename := flags.String("csv-output", "", "csv output `filename` (e.g., './tile-locations-pvalues.csv')")
 	csvOutputThreshold := flags.Float64("csv-output-threshold", 0, "logpvalue threshold for csv output (0 for none)")
 	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
 	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
-	err = flags.Parse(args)
+	err = parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		err = nil
 		return 0
@@ -61,6 +63,7 @@ func (cmd *manhattanPlot) RunCommand(prog string, args []string, stdin io.Reader
 			},
 		},
 	}
+	containerOpts.Apply(&runner, stdout)
 	if !*runlocal {
 		err = runner.TranslatePaths(inputDirectory)
 		if err != nil {
@@ -94,7 +97,10 @@ func (cmd *manhattanPlot) RunCommand(prog string, args []string, stdin io.Reader
 	runner.Args = append([]string{"/manhattan.py"}, args...)
 	var output string
 	output, err = runner.Run()
-	if err != nil {
+	if err == errDryRun {
+		err = nil
+		return 0
+	} else if err != nil {
 		return 1
 	}
 	fmt.Fprintln(stdout, output+"/plot.png")
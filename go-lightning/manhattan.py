@@ -33,13 +33,22 @@ for i in range(columns.shape[1]):
 print(f'building tilepos dict', file=sys.stderr)
 # tilepos maps tag# => (chromosome, position)
 tilepos = {}
-for dirent in os.scandir(input_path):
-    if dirent.name.endswith('.annotations.csv'):
-        with open(dirent, 'rt', newline='') as annotations:
-            for annotation in csv.reader(annotations):
-                # 500000,0,2,=,chr1,160793649,,,
-                if annotation[3] == "=":
-                    tilepos[int(annotation[0])] = (annotation[4], int(annotation[5]))
+chromosomes_path = os.path.join(input_path, 'chromosomes.csv')
+if columns.shape[0] >= 8 and os.path.exists(chromosomes_path):
+    # onehot-columns.npy has chromosome and position rows
+    with open(chromosomes_path, 'rt', newline='') as f:
+        chromnames = [row[1] for row in csv.reader(f)][1:]
+    for i in range(columns.shape[1]):
+        if columns[6,i] >= 0:
+            tilepos[columns[0,i]] = (chromnames[columns[6,i]], int(columns[7,i]))
+else:
+    for dirent in os.scandir(input_path):
+        if dirent.name.endswith('.annotations.csv'):
+            with open(dirent, 'rt', newline='') as annotations:
+                for annotation in csv.reader(annotations):
+                    # 500000,0,2,=,chr1,160793649,,,
+                    if annotation[3] == "=":
+                        tilepos[int(annotation[0])] = (annotation[4], int(annotation[5]))
 
 if csv_threshold > 0 and csv_output_path != "":
     print(f'writing csv {csv_output_path}', file=sys.stderr)
@@ -0,0 +1,513 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	log "github.com/sirupsen/logrus"
+)
+
+// manhattanData joins the p-values in onehot-columns.npy with
+// chromosome positions and (optionally) rsids, and writes a CSV file
+// sorted for plotting, plus optional Manhattan and QQ plot images.
+type manhattanData struct {
+	maxPValue     float64
+	significance  float64
+	contigAliases contigAliasOptions
+}
+
+// manhattanPoint is one row of manhattan.csv: a single one-hot
+// column (het or hom tile variant).
+type manhattanPoint struct {
+	chrom   string
+	pos     int
+	rsids   []string
+	pvalue  float64
+	tag     tagID
+	variant tileVariantID
+	hom     bool
+}
+
+func (cmd *manhattanData) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
+	inputDir := flags.String("input-dir", "./in", "input `directory` (output of slice-numpy -single-onehot, including onehot-columns.npy, chromosomes.csv, and annotations)")
+	outputDir := flags.String("output-dir", "./out", "output `directory`")
+	rsidsFilename := flags.String("rsids", "", "fill in the rsid column using the ID field of the given VCF `file` (e.g., dbSNP), for tile variants whose hgvs annotations match a VCF record")
+	flags.Float64Var(&cmd.maxPValue, "max-pvalue", 1, "omit columns with p-value above this threshold")
+	flags.Float64Var(&cmd.significance, "significance", 5e-8, "p-value threshold line on Manhattan plot")
+	writePNG := flags.Bool("png", false, "also write manhattan.png and qq.png")
+	cmd.contigAliases.Flags(flags)
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		runner := arvadosContainerRunner{
+			Name:        "lightning manhattan-data",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         16000000000,
+			VCPUs:       2,
+			Priority:    *priority,
+			KeepCache:   2,
+			APIAccess:   true,
+		}
+		containerOpts.Apply(&runner, stdout)
+		err = runner.TranslatePaths(inputDir, rsidsFilename)
+		if err == nil {
+			err = cmd.contigAliases.TranslatePaths(&runner)
+		}
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"manhattan-data", "-local=true",
+			"-pprof", ":6060",
+			"-input-dir", *inputDir,
+			"-output-dir", "/mnt/output",
+			"-rsids", *rsidsFilename,
+			"-max-pvalue", fmt.Sprintf("%v", cmd.maxPValue),
+			"-significance", fmt.Sprintf("%v", cmd.significance),
+			"-png=" + fmt.Sprintf("%v", *writePNG),
+		}
+		runner.Args = append(runner.Args, cmd.contigAliases.Args()...)
+		var output string
+		output, err = runner.Run()
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output+"/manhattan.csv")
+		return 0
+	}
+
+	err = cmd.contigAliases.Load()
+	if err != nil {
+		return 1
+	}
+	points, err := cmd.load(*inputDir)
+	if err != nil {
+		return 1
+	}
+	if *rsidsFilename != "" {
+		err = cmd.annotateRSIDs(points, *inputDir, *rsidsFilename)
+		if err != nil {
+			return 1
+		}
+	}
+	err = writeManhattanCSV(*outputDir+"/manhattan.csv", points)
+	if err != nil {
+		return 1
+	}
+	err = writeQQCSV(*outputDir+"/qq.csv", points)
+	if err != nil {
+		return 1
+	}
+	if *writePNG {
+		err = writePNGFile(*outputDir+"/manhattan.png", manhattanImage(points, cmd.significance))
+		if err != nil {
+			return 1
+		}
+		err = writePNGFile(*outputDir+"/qq.png", qqImage(points))
+		if err != nil {
+			return 1
+		}
+	}
+	return 0
+}
+
+// load returns the one-hot columns with a reference position and a
+// p-value no greater than cmd.maxPValue, sorted by chromosome,
+// position, tag, variant, and het/hom.
+func (cmd *manhattanData) load(inputDir string) ([]manhattanPoint, error) {
+	xrefs, xshape, err := readNumpyInt32(inputDir + "/onehot-columns.npy")
+	if err != nil {
+		return nil, err
+	}
+	if xshape[0] < onehotXrefRows {
+		return nil, fmt.Errorf("%s/onehot-columns.npy has %d rows, expected %d (output of an older version of slice-numpy?)", inputDir, xshape[0], onehotXrefRows)
+	}
+	chroms, err := loadChromosomes(inputDir + "/chromosomes.csv")
+	if err != nil {
+		return nil, err
+	}
+	ncols := xshape[1]
+	var points []manhattanPoint
+	for col := 0; col < ncols; col++ {
+		chrom, pos := int(xrefs[ncols*6+col]), int(xrefs[ncols*7+col])
+		if chrom < 0 {
+			continue
+		} else if chrom >= len(chroms) {
+			return nil, fmt.Errorf("onehot-columns.npy column %d: chromosome %d out of range (chromosomes.csv has %d)", col, chrom, len(chroms))
+		}
+		if xrefs[ncols*3+col] < 0 {
+			// p-value suppressed by slice-numpy
+			// -min-group-size
+			continue
+		}
+		pvalue := math.Pow(10, -float64(xrefs[ncols*4+col])/1000000)
+		if pvalue > cmd.maxPValue {
+			continue
+		}
+		points = append(points, manhattanPoint{
+			chrom:   chroms[chrom],
+			pos:     pos,
+			pvalue:  pvalue,
+			tag:     tagID(xrefs[col]),
+			variant: tileVariantID(xrefs[ncols+col]),
+			hom:     xrefs[ncols*2+col] != 0,
+		})
+	}
+	sort.Slice(points, func(i, j int) bool {
+		a, b := &points[i], &points[j]
+		switch {
+		case a.chrom != b.chrom:
+			return chromLess(a.chrom, b.chrom)
+		case a.pos != b.pos:
+			return a.pos < b.pos
+		case a.tag != b.tag:
+			return a.tag < b.tag
+		case a.variant != b.variant:
+			return a.variant < b.variant
+		default:
+			return !a.hom && b.hom
+		}
+	})
+	log.Printf("loaded %d columns", len(points))
+	return points, nil
+}
+
+// annotateRSIDs fills in the rsids of each point, using the hgvs
+// annotations (*.annotations.csv) in inputDir to find the variants
+// in each tile variant, and the ID field of the given VCF file to
+// find their rsids.
+func (cmd *manhattanData) annotateRSIDs(points []manhattanPoint, inputDir, vcfFilename string) error {
+	want := map[tileLibRef]bool{}
+	for _, p := range points {
+		want[tileLibRef{Tag: p.tag, Variant: p.variant}] = true
+	}
+	fnms, err := filepath.Glob(inputDir + "/matrix*.annotations.csv")
+	if err != nil {
+		return err
+	} else if len(fnms) == 0 {
+		return fmt.Errorf("-rsids requires hgvs annotations, but no matrix*.annotations.csv files found in %s", inputDir)
+	}
+	keys := map[tileLibRef][]hgvsKey{}
+	seen := map[tileLibRef]map[hgvsKey]bool{}
+	wantKeys := map[hgvsKey][]string{}
+	for _, fnm := range fnms {
+		buf, err := os.ReadFile(fnm)
+		if err != nil {
+			return err
+		}
+		for _, line := range bytes.Split(buf, []byte{'\n'}) {
+			if isAnnotationHeader(line) {
+				continue
+			}
+			fields := bytes.SplitN(line, []byte{','}, 9)
+			if len(fields) < 8 || len(fields[3]) == 0 || string(fields[3]) == "=" {
+				continue
+			}
+			tag, _ := strconv.Atoi(string(fields[0]))
+			variant, _ := strconv.Atoi(string(fields[2]))
+			libref := tileLibRef{Tag: tagID(tag), Variant: tileVariantID(variant)}
+			if !want[libref] {
+				continue
+			}
+			pos, _ := strconv.Atoi(string(fields[5]))
+			key := normalizePanelVariant(string(fields[4]), pos, string(fields[6]), string(fields[7]))
+			if seen[libref] == nil {
+				seen[libref] = map[hgvsKey]bool{}
+			}
+			if !seen[libref][key] {
+				seen[libref][key] = true
+				keys[libref] = append(keys[libref], key)
+				wantKeys[key] = nil
+			}
+		}
+	}
+	log.Printf("looking up rsids for %d variants in %s", len(wantKeys), vcfFilename)
+	err = readVCFIDs(vcfFilename, wantKeys)
+	if err != nil {
+		return err
+	}
+	found := 0
+	for i := range points {
+		p := &points[i]
+		for _, key := range keys[tileLibRef{Tag: p.tag, Variant: p.variant}] {
+			p.rsids = append(p.rsids, wantKeys[key]...)
+		}
+		if len(p.rsids) > 0 {
+			found++
+		}
+	}
+	log.Printf("found rsids for %d of %d columns", found, len(points))
+	return nil
+}
+
+// readVCFIDs reads the given VCF file, and for each record that
+// matches one of the keys in ids, appends the record's ID field to
+// ids[key]. Records with ID "." are ignored.
+func readVCFIDs(fnm string, ids map[hgvsKey][]string) error {
+	f, err := zopen(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(bufio.NewReaderSize(f, 1<<20))
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := bytes.SplitN(line, []byte{'\t'}, 6)
+		if len(fields) < 5 || string(fields[2]) == "." {
+			continue
+		}
+		pos, err := strconv.Atoi(string(fields[1]))
+		if err != nil {
+			continue
+		}
+		for _, alt := range bytes.Split(fields[4], []byte{','}) {
+			key := normalizePanelVariant(string(fields[0]), pos, string(fields[3]), string(alt))
+			if prev, ok := ids[key]; ok {
+				ids[key] = append(prev, string(fields[2]))
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func writeManhattanCSV(fnm string, points []manhattanPoint) error {
+	log.Printf("writing %s", fnm)
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriter(f)
+	fmt.Fprint(bufw, "chrom,pos,rsid,pvalue,tag,variant,hom\n")
+	for _, p := range points {
+		hom := 0
+		if p.hom {
+			hom = 1
+		}
+		fmt.Fprintf(bufw, "%s,%d,%s,%g,%d,%d,%d\n", p.chrom, p.pos, strings.Join(p.rsids, ";"), p.pvalue, p.tag, p.variant, hom)
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// qqValues returns the observed and expected -log10(p-value) of the
+// given points, sorted from most to least significant.
+func qqValues(points []manhattanPoint) (observed, expected []float64) {
+	n := len(points)
+	observed = make([]float64, n)
+	expected = make([]float64, n)
+	for i, p := range points {
+		observed[i] = -math.Log10(p.pvalue)
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(observed)))
+	for i := range expected {
+		expected[i] = -math.Log10((float64(i) + 0.5) / float64(n))
+	}
+	return
+}
+
+func writeQQCSV(fnm string, points []manhattanPoint) error {
+	log.Printf("writing %s", fnm)
+	observed, expected := qqValues(points)
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriter(f)
+	fmt.Fprint(bufw, "expected_log10p,observed_log10p\n")
+	for i := range observed {
+		fmt.Fprintf(bufw, "%g,%g\n", expected[i], observed[i])
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func writePNGFile(fnm string, img image.Image) error {
+	log.Printf("writing %s", fnm)
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = png.Encode(f, img)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// plotCanvas is a minimal scatter plot renderer (axes, points, and
+// reference lines, without text labels).
+type plotCanvas struct {
+	img          *image.RGBA
+	margin       int
+	xmax, ymax   float64
+	plotW, plotH int
+}
+
+var (
+	plotAxisColor  = color.RGBA{0x40, 0x40, 0x40, 0xff}
+	plotLineColor  = color.RGBA{0xd6, 0x27, 0x28, 0xff}
+	plotPointColor = [2]color.RGBA{{0x1d, 0x2a, 0x44, 0xff}, {0x44, 0x1d, 0x2a, 0xff}}
+)
+
+func newPlotCanvas(w, h int, xmax, ymax float64) *plotCanvas {
+	pc := &plotCanvas{
+		img:    image.NewRGBA(image.Rect(0, 0, w, h)),
+		margin: 20,
+		xmax:   math.Max(xmax, 1e-9),
+		ymax:   math.Max(ymax, 1e-9),
+	}
+	pc.plotW, pc.plotH = w-2*pc.margin, h-2*pc.margin
+	for i := range pc.img.Pix {
+		pc.img.Pix[i] = 0xff
+	}
+	for x := pc.margin; x <= pc.margin+pc.plotW; x++ {
+		pc.img.Set(x, pc.margin+pc.plotH, plotAxisColor)
+	}
+	for y := pc.margin; y <= pc.margin+pc.plotH; y++ {
+		pc.img.Set(pc.margin, y, plotAxisColor)
+	}
+	return pc
+}
+
+func (pc *plotCanvas) xy(x, y float64) (int, int) {
+	return pc.margin + int(x/pc.xmax*float64(pc.plotW)), pc.margin + pc.plotH - int(math.Min(y, pc.ymax)/pc.ymax*float64(pc.plotH))
+}
+
+func (pc *plotCanvas) point(x, y float64, c color.Color) {
+	px, py := pc.xy(x, y)
+	for dx := -1; dx <= 1; dx++ {
+		for dy := -1; dy <= 1; dy++ {
+			pc.img.Set(px+dx, py+dy, c)
+		}
+	}
+}
+
+// line draws a dashed line from (x0,y0) to (x1,y1).
+func (pc *plotCanvas) line(x0, y0, x1, y1 float64, c color.Color) {
+	px0, py0 := pc.xy(x0, y0)
+	px1, py1 := pc.xy(x1, y1)
+	steps := px1 - px0
+	if d := py0 - py1; d > steps {
+		steps = d
+	}
+	if steps < 1 {
+		steps = 1
+	}
+	for i := 0; i <= steps; i++ {
+		if i%8 >= 5 {
+			continue
+		}
+		t := float64(i) / float64(steps)
+		pc.img.Set(px0+int(t*float64(px1-px0)), py0+int(t*float64(py1-py0)), c)
+	}
+}
+
+// manhattanImage plots -log10(p-value) against genome position, with
+// chromosomes in alternating colors, and a line at the given
+// significance threshold.
+func manhattanImage(points []manhattanPoint, significance float64) image.Image {
+	// offset of each chromosome, using the largest position
+	// seen on each chromosome as its length
+	offset := map[string]float64{}
+	total := 0.0
+	for i, p := range points {
+		if i+1 == len(points) || points[i+1].chrom != p.chrom {
+			offset[p.chrom] = total
+			total += float64(p.pos) + 1
+		}
+	}
+	ymax := -math.Log10(significance)
+	for _, p := range points {
+		ymax = math.Max(ymax, -math.Log10(p.pvalue))
+	}
+	pc := newPlotCanvas(1600, 600, total, ymax*1.05)
+	chromIdx := -1
+	for i, p := range points {
+		if i == 0 || points[i-1].chrom != p.chrom {
+			chromIdx++
+		}
+		pc.point(offset[p.chrom]+float64(p.pos), -math.Log10(p.pvalue), plotPointColor[chromIdx%2])
+	}
+	pc.line(0, -math.Log10(significance), total, -math.Log10(significance), plotLineColor)
+	return pc.img
+}
+
+// qqImage plots observed against expected -log10(p-value), with the
+// line of equality.
+func qqImage(points []manhattanPoint) image.Image {
+	observed, expected := qqValues(points)
+	max := 1.0
+	if len(observed) > 0 {
+		max = math.Max(observed[0], expected[0]) * 1.05
+	}
+	pc := newPlotCanvas(600, 600, max, max)
+	pc.line(0, 0, max, max, plotLineColor)
+	for i := range observed {
+		pc.point(expected[i], observed[i], plotPointColor[0])
+	}
+	return pc.img
+}
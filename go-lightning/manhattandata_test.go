@@ -0,0 +1,95 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"image/png"
+	"os"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type manhattanDataSuite struct{}
+
+var _ = check.Suite(&manhattanDataSuite{})
+
+func (s *manhattanDataSuite) TestChromLess(c *check.C) {
+	order := map[string]int{"chr1": 0, "chr2": 1, "chr10": 2, "chrX": 3, "chrY": 4, "chrM": 5, "chrUn_1": 6}
+	for a := range order {
+		for b := range order {
+			c.Check(chromLess(a, b), check.Equals, order[a] < order[b], check.Commentf("%s < %s", a, b))
+		}
+	}
+}
+
+func (s *manhattanDataSuite) TestManhattanData(c *check.C) {
+	indir := c.MkDir()
+	outdir := c.MkDir()
+	// columns: tag, variant, hom, pvalue, -log10(p), maf,
+	// chromosome, position
+	cols := [][]int32{
+		{10, 2, 0, 0, 3000000, 0, 1, 500},
+		{10, 2, 1, 0, 1000000, 0, 1, 500},
+		{3, 2, 0, 0, 8000000, 0, 0, 100},
+		{7, 3, 0, 0, 0, 0, 0, 900},
+		{99, 2, 0, 0, 9000000, 0, -1, -1},
+	}
+	data := make([]int32, onehotXrefRows*len(cols))
+	for col, xref := range cols {
+		for row, v := range xref {
+			data[row*len(cols)+col] = v
+		}
+	}
+	c.Assert(writeNumpyInt32(indir+"/onehot-columns.npy", data, onehotXrefRows, len(cols)), check.IsNil)
+	c.Assert(writeChromosomes(indir+"/chromosomes.csv", []string{"chr1", "chr2"}), check.IsNil)
+	err := os.WriteFile(indir+"/matrix.0000.annotations.csv", []byte(`3,0,2,=,chr1,100,,,
+3,0,2,chr1:g.120A>G,chr1,120,A,G,
+10,1,2,chr2:g.510C>T,chr2,510,C,T,
+10,1,2,chr2:g.530_531insA,chr2,531,,A,G
+`), 0666)
+	c.Assert(err, check.IsNil)
+	err = os.WriteFile(indir+"/rsids.vcf", []byte(`##fileformat=VCFv4.2
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO
+1	120	rs120	A	C,G	.	.	.
+2	510	rs510	C	T	.	.	.
+2	530	rs530	G	GA	.	.	.
+2	600	rs600	G	A	.	.	.
+`), 0666)
+	c.Assert(err, check.IsNil)
+
+	exited := (&manhattanData{}).RunCommand("manhattan-data", []string{
+		"-local=true",
+		"-input-dir", indir,
+		"-output-dir", outdir,
+		"-rsids", indir + "/rsids.vcf",
+		"-max-pvalue", "0.5",
+		"-png",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	buf, err := os.ReadFile(outdir + "/manhattan.csv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, `chrom,pos,rsid,pvalue,tag,variant,hom
+chr1,100,rs120,1e-08,3,2,0
+chr2,500,rs510;rs530,0.001,10,2,0
+chr2,500,rs510;rs530,0.1,10,2,1
+`)
+
+	buf, err = os.ReadFile(outdir + "/qq.csv")
+	c.Assert(err, check.IsNil)
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	c.Check(lines, check.HasLen, 4)
+	c.Check(lines[0], check.Equals, "expected_log10p,observed_log10p")
+	c.Check(lines[1], check.Matches, `0\.778\d*,(8|7\.9999\d*)`)
+
+	for _, fnm := range []string{"manhattan.png", "qq.png"} {
+		f, err := os.Open(outdir + "/" + fnm)
+		c.Assert(err, check.IsNil)
+		defer f.Close()
+		_, err = png.Decode(f)
+		c.Check(err, check.IsNil)
+	}
+}
@@ -0,0 +1,362 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+
+	"git.arvados.org/arvados.git/lib/cmd"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	manifestFilename          = "manifest.json"
+	manifestSignatureFilename = "manifest.json.sig"
+
+	// manifestKeyMount is the path of the signing key in the
+	// container (see manifestOptions.TranslatePaths).
+	manifestKeyMount = "/mnt/secret/manifest-signing-key.pem"
+)
+
+// manifestOptions are the -write-manifest and -manifest-signing-key
+// options of commands that write an output directory.
+type manifestOptions struct {
+	write   bool
+	keyFile string
+}
+
+func (mo *manifestOptions) Flags(flags *flag.FlagSet) {
+	flags.BoolVar(&mo.write, "write-manifest", false, "write manifest.json listing the input and output files with their sizes and hashes")
+	flags.StringVar(&mo.keyFile, "manifest-signing-key", "", "sign manifest.json using Ed25519 private key in PEM `file` (implies -write-manifest; in container mode, the key is passed to the container as a secret, not stored in Keep)")
+}
+
+// Enabled returns true if a manifest should be written.
+func (mo *manifestOptions) Enabled() bool {
+	return mo.write || mo.keyFile != ""
+}
+
+// TranslatePaths checks the signing key (if any) and arranges for
+// runner to pass it to the container as a secret mount, so it is not
+// stored in Keep or recorded in the container request.
+func (mo *manifestOptions) TranslatePaths(runner *arvadosContainerRunner) error {
+	if mo.keyFile == "" {
+		return nil
+	}
+	if _, err := loadEd25519PrivateKey(mo.keyFile); err != nil {
+		return err
+	}
+	if err := runner.AddSecretFile(manifestKeyMount, mo.keyFile); err != nil {
+		return err
+	}
+	mo.keyFile = manifestKeyMount
+	return nil
+}
+
+// Args returns command line arguments that reproduce the manifest
+// options (see Flags).
+func (mo *manifestOptions) Args() []string {
+	return []string{
+		fmt.Sprintf("-write-manifest=%v", mo.write),
+		"-manifest-signing-key=" + mo.keyFile,
+	}
+}
+
+// Write writes the manifest (and signature) in outputDir, if
+// enabled.
+func (mo *manifestOptions) Write(outputDir string, args, inputs []string) error {
+	if !mo.Enabled() {
+		return nil
+	}
+	return writeOutputManifest(outputDir, args, inputs, mo.keyFile)
+}
+
+// outputManifest describes the files written to an output directory,
+// along with the lightning version and arguments that produced them,
+// and the input files they were produced from.
+type outputManifest struct {
+	Program string
+	Version string
+	Args    []string
+	Inputs  []manifestFile // Name is the path given on the command line
+	Files   []manifestFile // Name is relative to the output directory
+}
+
+type manifestFile struct {
+	Name   string
+	Size   int64
+	SHA256 string
+}
+
+// writeOutputManifest writes manifest.json in outputDir, listing all
+// files already present in outputDir, and the given input files (or
+// all files in the given input directories). If keyFile is not
+// empty, it also writes manifest.json.sig, an Ed25519 signature of
+// manifest.json using the PEM-encoded PKCS #8 private key in keyFile
+// (e.g., generated by "openssl genpkey -algorithm ed25519").
+func writeOutputManifest(outputDir string, args, inputs []string, keyFile string) error {
+	var key ed25519.PrivateKey
+	if keyFile != "" {
+		var err error
+		key, err = loadEd25519PrivateKey(keyFile)
+		if err != nil {
+			return err
+		}
+	}
+	infiles, err := manifestInputs(inputs)
+	if err != nil {
+		return err
+	}
+	files, err := manifestFiles(outputDir)
+	if err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(outputManifest{
+		Program: "lightning",
+		Version: cmd.Version.String(),
+		Args:    args,
+		Inputs:  infiles,
+		Files:   files,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	log.Infof("writing %s", filepath.Join(outputDir, manifestFilename))
+	err = ioutil.WriteFile(filepath.Join(outputDir, manifestFilename), buf, 0666)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return nil
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, buf)) + "\n"
+	return ioutil.WriteFile(filepath.Join(outputDir, manifestSignatureFilename), []byte(sig), 0666)
+}
+
+// manifestInputs returns the path, size, and SHA-256 hash of each of
+// the given input files, and of each file in the given input
+// directories (recursively).
+func manifestInputs(inputs []string) ([]manifestFile, error) {
+	var files []manifestFile
+	for _, input := range inputs {
+		fi, err := os.Stat(input)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, manifestFile{Name: input})
+			continue
+		}
+		dirfiles, err := manifestFiles(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range dirfiles {
+			f.Name = filepath.ToSlash(filepath.Join(input, f.Name))
+			files = append(files, f)
+		}
+	}
+	err := hashManifestFiles(files, "")
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// manifestFiles returns the name, size, and SHA-256 hash of each file
+// in dir (recursively), excluding the manifest itself.
+func manifestFiles(dir string) ([]manifestFile, error) {
+	var files []manifestFile
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if name == manifestFilename || name == manifestSignatureFilename {
+			return nil
+		}
+		files = append(files, manifestFile{Name: name})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = hashManifestFiles(files, dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// hashManifestFiles fills in the size and SHA-256 hash of each of the
+// given files (named relative to dir, or "" for the current
+// directory), reading several files concurrently.
+func hashManifestFiles(files []manifestFile, dir string) error {
+	throttle := throttle{Max: runtime.GOMAXPROCS(0)}
+	for i := range files {
+		f := &files[i]
+		throttle.Go(func() error {
+			path := filepath.Join(dir, filepath.FromSlash(f.Name))
+			fh, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer fh.Close()
+			h := sha256.New()
+			f.Size, err = io.Copy(h, fh)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			f.SHA256 = hex.EncodeToString(h.Sum(nil))
+			return nil
+		})
+	}
+	return throttle.Wait()
+}
+
+func loadEd25519PrivateKey(keyFile string) (ed25519.PrivateKey, error) {
+	buf, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", keyFile)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyFile, err)
+	}
+	edkey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 private key", keyFile)
+	}
+	return edkey, nil
+}
+
+func loadEd25519PublicKey(keyFile string) (ed25519.PublicKey, error) {
+	buf, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", keyFile)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyFile, err)
+	}
+	edkey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 public key", keyFile)
+	}
+	return edkey, nil
+}
+
+// verifyOutputManifest checks the manifest signature in dir using
+// pubkey, then checks that every file listed in the manifest has the
+// listed size and hash.
+func verifyOutputManifest(dir string, pubkey ed25519.PublicKey) (*outputManifest, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, manifestFilename))
+	if err != nil {
+		return nil, err
+	}
+	sigtext, err := ioutil.ReadFile(filepath.Join(dir, manifestSignatureFilename))
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sigtext)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", manifestSignatureFilename, err)
+	}
+	if !ed25519.Verify(pubkey, buf, sig) {
+		return nil, errors.New("manifest signature verification failed")
+	}
+	var manifest outputManifest
+	err = json.Unmarshal(buf, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	files, err := manifestFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]manifestFile{}
+	for _, f := range files {
+		found[f.Name] = f
+	}
+	for _, want := range manifest.Files {
+		got, ok := found[want.Name]
+		if !ok {
+			return nil, fmt.Errorf("%s: file listed in manifest is missing", want.Name)
+		} else if got != want {
+			return nil, fmt.Errorf("%s: file does not match manifest (size %d sha256 %s, expected size %d sha256 %s)", want.Name, got.Size, got.SHA256, want.Size, want.SHA256)
+		}
+	}
+	return &manifest, nil
+}
+
+type verifyManifest struct{}
+
+func (cmd *verifyManifest) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pubkeyFile := flags.String("public-key", "", "PEM-encoded Ed25519 public key `file`")
+	dir := flags.String("dir", ".", "output `directory` containing manifest.json and manifest.json.sig")
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	} else if *pubkeyFile == "" {
+		err = errors.New("cannot verify without -public-key argument")
+		return 2
+	}
+	pubkey, err := loadEd25519PublicKey(*pubkeyFile)
+	if err != nil {
+		return 1
+	}
+	manifest, err := verifyOutputManifest(*dir, pubkey)
+	if err != nil {
+		return 1
+	}
+	fmt.Fprintf(stdout, "OK: %d files produced by %s %s\n", len(manifest.Files), manifest.Program, manifest.Version)
+	return 0
+}
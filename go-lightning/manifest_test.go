@@ -0,0 +1,114 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type manifestSuite struct{}
+
+var _ = check.Suite(&manifestSuite{})
+
+func (s *manifestSuite) TestSignAndVerify(c *check.C) {
+	pubkey, privkey, err := ed25519.GenerateKey(nil)
+	c.Assert(err, check.IsNil)
+	keydir := c.MkDir()
+	der, err := x509.MarshalPKCS8PrivateKey(privkey)
+	c.Assert(err, check.IsNil)
+	err = os.WriteFile(keydir+"/key.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	c.Assert(err, check.IsNil)
+	der, err = x509.MarshalPKIXPublicKey(pubkey)
+	c.Assert(err, check.IsNil)
+	err = os.WriteFile(keydir+"/pub.pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+	c.Assert(err, check.IsNil)
+
+	outdir := c.MkDir()
+	err = os.WriteFile(outdir+"/matrix.npy", []byte("foo"), 0666)
+	c.Assert(err, check.IsNil)
+	err = os.Mkdir(outdir+"/sub", 0777)
+	c.Assert(err, check.IsNil)
+	err = os.WriteFile(outdir+"/sub/samples.csv", []byte("bar"), 0666)
+	c.Assert(err, check.IsNil)
+
+	indir := c.MkDir()
+	err = os.WriteFile(indir+"/library.gob", []byte("foo"), 0666)
+	c.Assert(err, check.IsNil)
+	err = os.WriteFile(keydir+"/samples.csv", []byte("baz"), 0666)
+	c.Assert(err, check.IsNil)
+
+	err = writeOutputManifest(outdir, []string{"-local=true"}, []string{indir, keydir + "/samples.csv"}, keydir+"/key.pem")
+	c.Assert(err, check.IsNil)
+
+	code := (&verifyManifest{}).RunCommand("lightning verify-manifest", []string{"-public-key", keydir + "/pub.pem", "-dir", outdir}, nil, os.Stderr, os.Stderr)
+	c.Check(code, check.Equals, 0)
+
+	manifest, err := verifyOutputManifest(outdir, pubkey)
+	c.Assert(err, check.IsNil)
+	c.Check(manifest.Files, check.HasLen, 2)
+	c.Check(manifest.Files[0].Name, check.Equals, "matrix.npy")
+	c.Check(manifest.Files[1].Name, check.Equals, "sub/samples.csv")
+	c.Check(manifest.Inputs, check.DeepEquals, []manifestFile{
+		{Name: indir + "/library.gob", Size: 3, SHA256: fmt.Sprintf("%x", sha256.Sum256([]byte("foo")))},
+		{Name: keydir + "/samples.csv", Size: 3, SHA256: fmt.Sprintf("%x", sha256.Sum256([]byte("baz")))},
+	})
+
+	// modified output file
+	err = os.WriteFile(outdir+"/matrix.npy", []byte("baz"), 0666)
+	c.Assert(err, check.IsNil)
+	_, err = verifyOutputManifest(outdir, pubkey)
+	c.Check(err, check.ErrorMatches, `matrix.npy: file does not match manifest.*`)
+
+	// wrong key
+	otherkey, _, err := ed25519.GenerateKey(nil)
+	c.Assert(err, check.IsNil)
+	_, err = verifyOutputManifest(outdir, otherkey)
+	c.Check(err, check.ErrorMatches, `manifest signature verification failed`)
+}
+
+func (s *manifestSuite) TestSigningKeyInContainer(c *check.C) {
+	_, privkey, err := ed25519.GenerateKey(nil)
+	c.Assert(err, check.IsNil)
+	der, err := x509.MarshalPKCS8PrivateKey(privkey)
+	c.Assert(err, check.IsNil)
+	keypem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	keyfile := c.MkDir() + "/key.pem"
+	err = os.WriteFile(keyfile, keypem, 0600)
+	c.Assert(err, check.IsNil)
+
+	// The key is passed to the container as a secret mount, not
+	// a collection mount.
+	runner := arvadosContainerRunner{}
+	mo := manifestOptions{keyFile: keyfile}
+	c.Assert(mo.TranslatePaths(&runner), check.IsNil)
+	c.Check(runner.Mounts, check.HasLen, 0)
+	c.Check(runner.SecretMounts[manifestKeyMount], check.DeepEquals, map[string]interface{}{"kind": "text", "content": string(keypem)})
+	c.Check(mo.Args(), check.DeepEquals, []string{"-write-manifest=false", "-manifest-signing-key=" + manifestKeyMount})
+
+	// The key content does not appear in dry-run output.
+	var dryrun bytes.Buffer
+	runner.ProjectUUID = "zzzzz-j7d0g-000000000000000"
+	runner.Prog = "/bin/true"
+	runner.DryRun = &dryrun
+	_, err = runner.Run()
+	c.Check(err, check.Equals, errDryRun)
+	c.Check(dryrun.String(), check.Matches, `(?ms).*"secret_mounts".*`+manifestKeyMount+`.*\(redacted\).*`)
+	c.Check(strings.Contains(dryrun.String(), "PRIVATE KEY"), check.Equals, false)
+
+	// An invalid key is rejected before submitting anything.
+	err = os.WriteFile(keyfile, []byte("foo"), 0600)
+	c.Assert(err, check.IsNil)
+	mo = manifestOptions{keyFile: keyfile}
+	c.Check(mo.TranslatePaths(&arvadosContainerRunner{}), check.ErrorMatches, `.*no PEM data found`)
+}
@@ -20,10 +20,16 @@ type intervalTreeNode struct {
 
 type intervalTree []intervalTreeNode
 
+// mask is a set of intervals on named contigs. Contig names are
+// converted to canonical form (see canonicalContig) so "chr1" and
+// "1" refer to the same contig.
 type mask struct {
 	intervals map[string][]interval
 	itrees    map[string]intervalTree
 	frozen    bool
+	// if inverted, Check reports whether the given range is
+	// outside all intervals
+	inverted bool
 }
 
 func (m *mask) Add(seqname string, start, end int) {
@@ -33,6 +39,7 @@ func (m *mask) Add(seqname string, start, end int) {
 	if m.intervals == nil {
 		m.intervals = map[string][]interval{}
 	}
+	seqname = canonicalContig(seqname)
 	m.intervals[seqname] = append(m.intervals[seqname], interval{start, end})
 }
 
@@ -48,7 +55,7 @@ func (m *mask) Check(seqname string, start, end int) bool {
 	if !m.frozen {
 		panic("bug: (*mask)Check() called before Freeze()")
 	}
-	return m.itrees[seqname].check(0, interval{start, end})
+	return m.itrees[canonicalContig(seqname)].check(0, interval{start, end}) != m.inverted
 }
 
 func (m *mask) Len() int {
@@ -62,6 +69,78 @@ func (m *mask) Len() int {
 	return n
 }
 
+// unionMasks returns a new (unfrozen) mask with all of the
+// intervals in the given masks.
+func unionMasks(masks []*mask) *mask {
+	union := &mask{}
+	for _, m := range masks {
+		for seqname, intervals := range m.intervals {
+			for _, iv := range intervals {
+				union.Add(seqname, iv.start, iv.end)
+			}
+		}
+	}
+	return union
+}
+
+// intersectMasks returns a new (unfrozen) mask with the intervals
+// that are covered by every one of the given masks.
+func intersectMasks(masks []*mask) *mask {
+	isect := &mask{}
+	for seqname, intervals := range masks[0].intervals {
+		common := mergeIntervals(intervals)
+		for _, m := range masks[1:] {
+			common = intersectIntervals(common, mergeIntervals(m.intervals[seqname]))
+		}
+		for _, iv := range common {
+			isect.Add(seqname, iv.start, iv.end)
+		}
+	}
+	return isect
+}
+
+// mergeIntervals returns a sorted copy of the given intervals, with
+// overlapping intervals merged.
+func mergeIntervals(in []interval) []interval {
+	sorted := append([]interval(nil), in...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].start < sorted[j].start })
+	var merged []interval
+	for _, iv := range sorted {
+		if n := len(merged); n > 0 && iv.start <= merged[n-1].end {
+			if iv.end > merged[n-1].end {
+				merged[n-1].end = iv.end
+			}
+			continue
+		}
+		merged = append(merged, iv)
+	}
+	return merged
+}
+
+// intersectIntervals returns the intersection of two sorted lists
+// of non-overlapping intervals.
+func intersectIntervals(a, b []interval) []interval {
+	var out []interval
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		start, end := a[i].start, a[i].end
+		if b[j].start > start {
+			start = b[j].start
+		}
+		if b[j].end < end {
+			end = b[j].end
+		}
+		if start <= end {
+			out = append(out, interval{start, end})
+		}
+		if a[i].end < b[j].end {
+			i++
+		} else {
+			j++
+		}
+	}
+	return out
+}
+
 func (m *mask) freeze(in []interval) intervalTree {
 	if len(in) == 0 {
 		return nil
@@ -5,6 +5,9 @@
 package lightning
 
 import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
 	"math/rand"
 	"testing"
 
@@ -73,3 +76,111 @@ func benchmarkMask(b *testing.B, size int) {
 		m.Check("chrB", start, end)
 	}
 }
+
+func (s *maskSuite) TestMakeMaskRegionsFilter(c *check.C) {
+	tmpdir := c.MkDir()
+	gtf := tmpdir + "/genes.gtf"
+	err := ioutil.WriteFile(gtf, []byte(`# test
+chr1	src	gene	100	500	.	+	.	gene_id "G1"; gene_name "BRCA1";
+chr1	src	exon	100	150	.	+	.	gene_id "G1"; gene_name "BRCA1";
+chr1	src	exon	1000	1050	.	+	.	gene_id "G2"; gene_name "TP53";
+chr2	src	exon	2000	2050	.	+	.	gene_id "G3"; gene_name "OTHER";
+`), 0666)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(tmpdir+"/panel.txt", []byte("BRCA1\nTP53\n"), 0666)
+	c.Assert(err, check.IsNil)
+
+	m, err := makeMask(gtf, 0, regionsFilter{})
+	c.Assert(err, check.IsNil)
+	c.Check(m.Len(), check.Equals, 4)
+
+	m, err = makeMask(gtf, 0, regionsFilter{featureTypes: "exon"})
+	c.Assert(err, check.IsNil)
+	c.Check(m.Len(), check.Equals, 3)
+	c.Check(m.Check("1", 200, 300), check.Equals, false)
+
+	for _, attr := range []string{"gene_name=BRCA1,TP53", "gene_name=@" + tmpdir + "/panel.txt"} {
+		m, err = makeMask(gtf, 0, regionsFilter{featureTypes: "exon", attribute: attr})
+		c.Assert(err, check.IsNil)
+		c.Check(m.Len(), check.Equals, 2)
+		c.Check(m.Check("1", 120, 130), check.Equals, true)
+		c.Check(m.Check("1", 1020, 1030), check.Equals, true)
+		c.Check(m.Check("1", 200, 300), check.Equals, false)
+		c.Check(m.Check("2", 2000, 2010), check.Equals, false)
+	}
+
+	err = ioutil.WriteFile(tmpdir+"/regions.bed", []byte("chr1\t100\t200\n"), 0666)
+	c.Assert(err, check.IsNil)
+	_, err = makeMask(tmpdir+"/regions.bed", 0, regionsFilter{featureTypes: "exon"})
+	c.Check(err, check.ErrorMatches, `.*require a GFF/GTF regions file`)
+	_, err = makeMask(gtf, 0, regionsFilter{attribute: "gene_name"})
+	c.Check(err, check.ErrorMatches, `invalid -regions-attribute.*`)
+}
+
+func (s *maskSuite) TestGFFAttribute(c *check.C) {
+	c.Check(gffAttribute([]byte(`gene_id "G1"; gene_name "BRCA1";`), "gene_name"), check.DeepEquals, []string{"BRCA1"})
+	c.Check(gffAttribute([]byte(`ID=gene1;Name=BRCA1;Alias=A%2CB,C`), "Alias"), check.DeepEquals, []string{"A,B", "C"})
+	c.Check(gffAttribute([]byte(`ID=gene1;Name=BRCA1`), "gene_name"), check.IsNil)
+}
+
+func (s *maskSuite) TestMakeMaskMultipleFiles(c *check.C) {
+	tmpdir := c.MkDir()
+	err := ioutil.WriteFile(tmpdir+"/a.bed", []byte("chr1\t100\t200\nchr1\t300\t400\nchr2\t100\t200\n"), 0666)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(tmpdir+"/b.bed", []byte("chr1\t150\t350\n"), 0666)
+	c.Assert(err, check.IsNil)
+
+	m, err := makeMask(tmpdir+"/a.bed,"+tmpdir+"/b.bed", 0, regionsFilter{})
+	c.Assert(err, check.IsNil)
+	c.Check(m.Len(), check.Equals, 4)
+	c.Check(m.Check("1", 250, 260), check.Equals, true)
+	c.Check(m.Check("2", 150, 160), check.Equals, true)
+
+	// same files, using a glob
+	m, err = makeMask(tmpdir+"/*.bed", 0, regionsFilter{combine: "union"})
+	c.Assert(err, check.IsNil)
+	c.Check(m.Len(), check.Equals, 4)
+
+	m, err = makeMask(tmpdir+"/*.bed", 0, regionsFilter{combine: "intersection"})
+	c.Assert(err, check.IsNil)
+	c.Check(m.intervals["1"], check.DeepEquals, []interval{{150, 200}, {300, 350}})
+	c.Check(m.Check("1", 250, 260), check.Equals, false)
+	c.Check(m.Check("1", 160, 170), check.Equals, true)
+	c.Check(m.Check("2", 150, 160), check.Equals, false)
+
+	m, err = makeMask(tmpdir+"/a.bed", 0, regionsFilter{invert: true})
+	c.Assert(err, check.IsNil)
+	c.Check(m.Check("1", 150, 160), check.Equals, false)
+	c.Check(m.Check("1", 250, 260), check.Equals, true)
+	c.Check(m.Check("3", 150, 160), check.Equals, true)
+
+	_, err = makeMask(tmpdir+"/a.bed,"+tmpdir+"/nonexistent.bed", 0, regionsFilter{})
+	c.Check(err, check.ErrorMatches, `.*nonexistent.bed: no such file or directory`)
+	_, err = makeMask(tmpdir+"/a.bed", 0, regionsFilter{combine: "xor"})
+	c.Check(err, check.ErrorMatches, `invalid -regions-combine "xor".*`)
+}
+
+func (s *maskSuite) TestMakeMaskGzip(c *check.C) {
+	tmpdir := c.MkDir()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("chr1\t100\t200\nchr2\t100\t200\n"))
+	c.Assert(zw.Close(), check.IsNil)
+	err := ioutil.WriteFile(tmpdir+"/a.bed.gz", buf.Bytes(), 0666)
+	c.Assert(err, check.IsNil)
+
+	// no tabix index, so contigs doesn't matter
+	m, err := makeMask(tmpdir+"/a.bed.gz", 0, regionsFilter{contigs: []string{"chr1"}})
+	c.Assert(err, check.IsNil)
+	c.Check(m.Len(), check.Equals, 2)
+	c.Check(m.Check("1", 150, 160), check.Equals, true)
+	c.Check(m.Check("2", 150, 160), check.Equals, true)
+}
+
+func (s *maskSuite) TestIntersectIntervals(c *check.C) {
+	a := mergeIntervals([]interval{{50, 60}, {0, 10}, {5, 20}})
+	c.Check(a, check.DeepEquals, []interval{{0, 20}, {50, 60}})
+	b := []interval{{15, 55}, {58, 70}}
+	c.Check(intersectIntervals(a, b), check.DeepEquals, []interval{{15, 20}, {50, 55}, {58, 60}})
+	c.Check(intersectIntervals(a, nil), check.IsNil)
+}
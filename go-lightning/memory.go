@@ -0,0 +1,54 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// availableMemory returns the amount of memory (in bytes) available
+// to this process: the smaller of MemAvailable in /proc/meminfo and
+// the cgroup memory limit, if any. It returns 0 if neither can be
+// determined.
+func availableMemory() int64 {
+	var avail int64
+	if f, err := os.Open("/proc/meminfo"); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+				kib, err := strconv.ParseInt(fields[1], 10, 64)
+				if err == nil {
+					avail = kib << 10
+				}
+				break
+			}
+		}
+	}
+	for _, fnm := range []string{
+		"/sys/fs/cgroup/memory.max",                   // cgroup v2
+		"/sys/fs/cgroup/memory/memory.limit_in_bytes", // cgroup v1
+	} {
+		buf, err := os.ReadFile(fnm)
+		if err != nil {
+			continue
+		}
+		limit, err := strconv.ParseInt(string(bytes.TrimSpace(buf)), 10, 64)
+		if err != nil {
+			// "max" means no limit
+			continue
+		}
+		if avail == 0 || limit < avail {
+			avail = limit
+		}
+		break
+	}
+	return avail
+}
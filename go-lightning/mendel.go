@@ -0,0 +1,350 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"sort"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	log "github.com/sirupsen/logrus"
+)
+
+// mendelcmd checks each child/mother/father trio for tags where the
+// child's tile variants cannot be explained by inheriting one from
+// each parent.
+type mendelcmd struct {
+	maxRate float64
+}
+
+type trio struct {
+	Child, Mother, Father string
+}
+
+type trioResult struct {
+	trio
+	checked      int
+	inconsistent []mendelError
+}
+
+type mendelError struct {
+	tag                   tagID
+	child, mother, father [2]tileVariantID
+}
+
+func (cmd *mendelcmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
+	inputDir := flags.String("input-dir", "./in", "input `directory`")
+	outputDir := flags.String("output-dir", "./out", "output `directory`")
+	pedigreeFile := flags.String("pedigree", "", "pedigree `file` (PED format: family, child, father, mother, ...)")
+	flags.Float64Var(&cmd.maxRate, "max-inconsistent-rate", 1, "fail if any trio's rate of Mendelian-inconsistent tags exceeds `fraction`")
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	} else if *pedigreeFile == "" {
+		err = errors.New("cannot check without -pedigree argument")
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		runner := arvadosContainerRunner{
+			Name:        "lightning mendel",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         120000000000,
+			VCPUs:       16,
+			Priority:    *priority,
+			KeepCache:   2,
+			APIAccess:   true,
+		}
+		containerOpts.Apply(&runner, stdout)
+		err = runner.TranslatePaths(inputDir, pedigreeFile)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"mendel", "-local=true",
+			"-pprof", ":6060",
+			"-input-dir", *inputDir,
+			"-output-dir", "/mnt/output",
+			"-pedigree", *pedigreeFile,
+			"-max-inconsistent-rate", fmt.Sprintf("%f", cmd.maxRate),
+		}
+		var output string
+		output, err = runner.Run()
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output)
+		return 0
+	}
+
+	trios, err := readPedigree(*pedigreeFile)
+	if err != nil {
+		return 1
+	}
+	tilelib := &tileLibrary{
+		retainNoCalls:       true,
+		retainTileSequences: true,
+		compactGenomes:      map[string][]tileVariantID{},
+	}
+	err = tilelib.LoadDir(context.Background(), *inputDir)
+	if err != nil {
+		return 1
+	}
+	results, err := checkTrios(tilelib.compactGenomes, trios, tileNoCalls(tilelib))
+	if err != nil {
+		return 1
+	}
+	err = writeMendelSummary(*outputDir+"/mendel-summary.csv", results)
+	if err != nil {
+		return 1
+	}
+	err = writeMendelErrors(*outputDir+"/mendel-inconsistent.csv", results)
+	if err != nil {
+		return 1
+	}
+	for _, r := range results {
+		if rate := r.rate(); rate > cmd.maxRate {
+			err = fmt.Errorf("trio %s/%s/%s: Mendelian inconsistency rate %f exceeds -max-inconsistent-rate %f", r.Child, r.Mother, r.Father, rate, cmd.maxRate)
+			return 1
+		}
+	}
+	return 0
+}
+
+// readPedigree returns the trios in a PED file, i.e., whitespace
+// separated family ID, individual ID, father ID, mother ID, and
+// optionally other columns. Individuals without both parents listed
+// are skipped.
+func readPedigree(fnm string) ([]trio, error) {
+	f, err := open(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var trios []trio
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("%s: line %d: expected at least 4 fields, found %d", fnm, lineno, len(fields))
+		}
+		child, father, mother := fields[1], fields[2], fields[3]
+		if father == "0" || mother == "0" {
+			continue
+		}
+		trios = append(trios, trio{Child: child, Mother: mother, Father: father})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	if len(trios) == 0 {
+		return nil, fmt.Errorf("%s: no trios found", fnm)
+	}
+	return trios, nil
+}
+
+// checkTrios checks each trio for Mendelian consistency. Pedigree
+// names are looked up with genomeLookup.
+//
+// Tags where any member of the trio has a missing tile (variant 0)
+// or a tile variant with no-calls (according to noCall, if non-nil)
+// are not checked.
+func checkTrios(cgs map[string][]tileVariantID, trios []trio, noCall func(tagID, tileVariantID) bool) ([]trioResult, error) {
+	lookup := genomeLookup(cgs)
+	var results []trioResult
+	for _, t := range trios {
+		child, err := lookup(t.Child)
+		if err != nil {
+			return nil, err
+		}
+		mother, err := lookup(t.Mother)
+		if err != nil {
+			return nil, err
+		}
+		father, err := lookup(t.Father)
+		if err != nil {
+			return nil, err
+		}
+		result := trioResult{trio: t}
+		for tag := 0; tag*2+1 < len(child) && tag*2+1 < len(mother) && tag*2+1 < len(father); tag++ {
+			c := [2]tileVariantID{child[tag*2], child[tag*2+1]}
+			m := [2]tileVariantID{mother[tag*2], mother[tag*2+1]}
+			f := [2]tileVariantID{father[tag*2], father[tag*2+1]}
+			if missingGenotype(tagID(tag), c, noCall) || missingGenotype(tagID(tag), m, noCall) || missingGenotype(tagID(tag), f, noCall) {
+				// missing/low-quality tile
+				continue
+			}
+			result.checked++
+			if (hasVariant(m, c[0]) && hasVariant(f, c[1])) || (hasVariant(m, c[1]) && hasVariant(f, c[0])) {
+				continue
+			}
+			result.inconsistent = append(result.inconsistent, mendelError{tag: tagID(tag), child: c, mother: m, father: f})
+		}
+		log.Infof("trio %s/%s/%s: %d tags checked, %d inconsistent", t.Child, t.Mother, t.Father, result.checked, len(result.inconsistent))
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// genomeLookup returns a function that finds a genome in cgs by name.
+// Names can be given either as full genome names or as labels
+// produced by trimFilenameForLabel (e.g., "input1" for
+// "testdata/pipeline1/input1.1.fasta").
+func genomeLookup(cgs map[string][]tileVariantID) func(string) ([]tileVariantID, error) {
+	byLabel := map[string][]string{}
+	for name := range cgs {
+		label := trimFilenameForLabel(name)
+		byLabel[label] = append(byLabel[label], name)
+	}
+	return func(name string) ([]tileVariantID, error) {
+		if cg, ok := cgs[name]; ok {
+			return cg, nil
+		}
+		switch names := byLabel[name]; len(names) {
+		case 0:
+			return nil, fmt.Errorf("sample %q not found in library", name)
+		case 1:
+			return cgs[names[0]], nil
+		default:
+			sort.Strings(names)
+			return nil, fmt.Errorf("sample %q is ambiguous (matches %q)", name, names)
+		}
+	}
+}
+
+// missingGenotype returns true if either phase of gt is missing
+// (variant 0) or has no-calls.
+func missingGenotype(tag tagID, gt [2]tileVariantID, noCall func(tagID, tileVariantID) bool) bool {
+	if gt[0] == 0 || gt[1] == 0 {
+		return true
+	}
+	return noCall != nil && (noCall(tag, gt[0]) || noCall(tag, gt[1]))
+}
+
+// tileNoCalls returns a function that reports whether a tile
+// variant's sequence has no-calls, i.e., bases other than a, c, g,
+// and t (as in libraries imported with -save-incomplete-tiles). A
+// tile variant whose sequence is not available is assumed to be
+// called.
+func tileNoCalls(tilelib *tileLibrary) func(tagID, tileVariantID) bool {
+	cache := map[tileLibRef]bool{}
+	return func(tag tagID, v tileVariantID) bool {
+		libref := tileLibRef{Tag: tag, Variant: v}
+		nocall, ok := cache[libref]
+		if !ok {
+			for _, b := range tilelib.TileVariantSequence(libref) {
+				if b != 'a' && b != 'c' && b != 'g' && b != 't' {
+					nocall = true
+					break
+				}
+			}
+			cache[libref] = nocall
+		}
+		return nocall
+	}
+}
+
+func hasVariant(gt [2]tileVariantID, v tileVariantID) bool {
+	return gt[0] == v || gt[1] == v
+}
+
+func (r trioResult) rate() float64 {
+	if r.checked == 0 {
+		return 0
+	}
+	return float64(len(r.inconsistent)) / float64(r.checked)
+}
+
+func writeMendelSummary(fnm string, results []trioResult) error {
+	log.Infof("writing %s", fnm)
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"Child", "Mother", "Father", "TagsChecked", "Inconsistent", "Rate"})
+	for _, r := range results {
+		w.Write([]string{r.Child, r.Mother, r.Father,
+			fmt.Sprintf("%d", r.checked),
+			fmt.Sprintf("%d", len(r.inconsistent)),
+			fmt.Sprintf("%g", r.rate()),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func writeMendelErrors(fnm string, results []trioResult) error {
+	log.Infof("writing %s", fnm)
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriter(f)
+	w := csv.NewWriter(bufw)
+	w.Write([]string{"Child", "Mother", "Father", "Tag", "ChildVariants", "MotherVariants", "FatherVariants"})
+	gt := func(v [2]tileVariantID) string { return fmt.Sprintf("%d/%d", v[0], v[1]) }
+	for _, r := range results {
+		for _, e := range r.inconsistent {
+			w.Write([]string{r.Child, r.Mother, r.Father, fmt.Sprintf("%d", e.tag), gt(e.child), gt(e.mother), gt(e.father)})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	if err := bufw.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,80 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type mendelSuite struct{}
+
+var _ = check.Suite(&mendelSuite{})
+
+func (s *mendelSuite) TestCheckTrios(c *check.C) {
+	tmpdir := c.MkDir()
+	err := os.WriteFile(tmpdir+"/family.ped", []byte(`# family child father mother sex phenotype
+fam1 kid dad mom 1 0
+fam1 dad 0 0 1 0
+fam1 mom 0 0 2 0
+`), 0600)
+	c.Assert(err, check.IsNil)
+	trios, err := readPedigree(tmpdir + "/family.ped")
+	c.Assert(err, check.IsNil)
+	c.Check(trios, check.DeepEquals, []trio{{Child: "kid", Mother: "mom", Father: "dad"}})
+
+	cgs := map[string][]tileVariantID{
+		"dir/mom.1.fasta": {1, 2, 1, 2, 1, 1, 1, 1},
+		"dir/dad.1.fasta": {3, 3, 1, 2, 1, 1, 0, 1},
+		"dir/kid.1.fasta": {3, 1, 2, 2, 3, 1, 2, 2},
+	}
+	results, err := checkTrios(cgs, trios, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(results, check.HasLen, 1)
+	// tag 3 is not checked because dad has a missing tile
+	c.Check(results[0].checked, check.Equals, 3)
+	c.Check(results[0].inconsistent, check.DeepEquals, []mendelError{
+		{tag: 2, child: [2]tileVariantID{3, 1}, mother: [2]tileVariantID{1, 1}, father: [2]tileVariantID{1, 1}},
+	})
+
+	code := (&mendelcmd{}).RunCommand("mendel", []string{"-local=true", "-input-dir", tmpdir}, nil, os.Stderr, os.Stderr)
+	c.Check(code, check.Equals, 2)
+
+	_, err = checkTrios(cgs, []trio{{Child: "kid", Mother: "mom", Father: "stranger"}}, nil)
+	c.Check(err, check.ErrorMatches, `sample "stranger" not found in library`)
+}
+
+func (s *mendelSuite) TestNoCalls(c *check.C) {
+	tilelib := &tileLibrary{retainNoCalls: true, retainTileSequences: true}
+	c.Check(tilelib.getRef(0, []byte("acgtacgt"), false), check.Equals, tileLibRef{Tag: 0, Variant: 1})
+	c.Check(tilelib.getRef(0, []byte("acgnncgt"), false), check.Equals, tileLibRef{Tag: 0, Variant: 2})
+	c.Check(tilelib.getRef(0, []byte("acgtaggt"), false), check.Equals, tileLibRef{Tag: 0, Variant: 3})
+	noCall := tileNoCalls(tilelib)
+	c.Check(noCall(0, 1), check.Equals, false)
+	c.Check(noCall(0, 2), check.Equals, true)
+	c.Check(noCall(0, 3), check.Equals, false)
+
+	// The child's no-call tile (variant 2) doesn't match either
+	// parent, but the tag is skipped instead of being reported
+	// as inconsistent.
+	cgs := map[string][]tileVariantID{
+		"mom": {1, 1},
+		"dad": {1, 3},
+		"kid": {2, 3},
+	}
+	trios := []trio{{Child: "kid", Mother: "mom", Father: "dad"}}
+	results, err := checkTrios(cgs, trios, noCall)
+	c.Assert(err, check.IsNil)
+	c.Assert(results, check.HasLen, 1)
+	c.Check(results[0].checked, check.Equals, 0)
+	c.Check(results[0].inconsistent, check.HasLen, 0)
+
+	// Without the no-call check, it would be inconsistent.
+	results, err = checkTrios(cgs, trios, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(results[0].checked, check.Equals, 1)
+	c.Check(results[0].inconsistent, check.HasLen, 1)
+}
@@ -48,8 +48,10 @@ func (cmd *merger) RunCommand(prog string, args []string, stdin io.Reader, stdou
 	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
 	projectUUID := flags.String("project", "", "project `UUID` for output data")
 	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
 	outputFilename := flags.String("o", "-", "output `file`")
-	err = flags.Parse(args)
+	err = parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		err = nil
 		return 0
@@ -80,6 +82,7 @@ func (cmd *merger) RunCommand(prog string, args []string, stdin io.Reader, stdou
 			APIAccess:   true,
 			KeepCache:   1,
 		}
+		containerOpts.Apply(&runner, stdout)
 		for i := range cmd.inputs {
 			err = runner.TranslatePaths(&cmd.inputs[i])
 			if err != nil {
@@ -91,7 +94,10 @@ func (cmd *merger) RunCommand(prog string, args []string, stdin io.Reader, stdou
 		}, cmd.inputs...)
 		var output string
 		output, err = runner.Run()
-		if err != nil {
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
 			return 1
 		}
 		fmt.Fprintln(stdout, output+"/library.gob.gz")
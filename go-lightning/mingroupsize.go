@@ -0,0 +1,46 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"math"
+)
+
+// minorGenotypeCount returns the number of training set samples that
+// have the genotype represented by a one-hot column, or the number
+// that don't, whichever is smaller.
+func minorGenotypeCount(onehot []bool) int {
+	n := genotypeCount(onehot)
+	if other := len(onehot) - n; other < n {
+		return other
+	}
+	return n
+}
+
+// suppressAggregates replaces the p-value and allele frequencies of
+// a one-hot column with NaN, so aggregate outputs (case/control
+// stats, ancestry allele frequencies) don't reveal information about
+// a small group of samples. See -min-group-size.
+func (xref *onehotXref) suppressAggregates() {
+	nan := math.NaN()
+	xref.pvalue = nan
+	xref.maf = nan
+	if len(xref.ancestryAF) > 0 {
+		// ancestryAF is shared by the hom and het columns, so
+		// replace it instead of modifying it in place.
+		afs := make([]float64, len(xref.ancestryAF))
+		for i := range afs {
+			afs[i] = nan
+		}
+		xref.ancestryAF = afs
+	}
+	xref.caseControl = caseControlStats{
+		caseAF:    nan,
+		controlAF: nan,
+		oddsRatio: nan,
+		ciLow:     nan,
+		ciHigh:    nan,
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"io/ioutil"
+	"math"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type minGroupSizeSuite struct{}
+
+var _ = check.Suite(&minGroupSizeSuite{})
+
+func (s *minGroupSizeSuite) TestMinorGenotypeCount(c *check.C) {
+	c.Check(minorGenotypeCount(nil), check.Equals, 0)
+	c.Check(minorGenotypeCount([]bool{false, false, false}), check.Equals, 0)
+	c.Check(minorGenotypeCount([]bool{true, false, false}), check.Equals, 1)
+	c.Check(minorGenotypeCount([]bool{true, true, false}), check.Equals, 1)
+	c.Check(minorGenotypeCount([]bool{true, true, false, false}), check.Equals, 2)
+}
+
+func (s *minGroupSizeSuite) TestSuppressAggregates(c *check.C) {
+	afs := []float64{0.5, 0.125}
+	xrefs := []onehotXref{
+		{tag: 5, variant: 2, hom: true, pvalue: 0.01, maf: 0.25, ancestryAF: afs, suppressed: true},
+		{tag: 5, variant: 2, pvalue: 0.02, maf: 0.25, ancestryAF: afs},
+	}
+	xrefs[0].suppressAggregates()
+	c.Check(math.IsNaN(xrefs[0].pvalue), check.Equals, true)
+	c.Check(math.IsNaN(xrefs[0].maf), check.Equals, true)
+	c.Check(math.IsNaN(xrefs[0].ancestryAF[1]), check.Equals, true)
+	c.Check(math.IsNaN(xrefs[0].caseControl.oddsRatio), check.Equals, true)
+	// het column shares the ancestryAF slice, and is not affected
+	c.Check(xrefs[1].ancestryAF, check.DeepEquals, []float64{0.5, 0.125})
+
+	xdata := onehotXref2int32(xrefs)
+	for row := 3; row <= 5; row++ {
+		c.Check(xdata[row*2], check.Equals, int32(-1))
+	}
+	c.Check(xdata[3*2+1], check.Equals, int32(20000))
+	c.Check(xdata[5*2+1], check.Equals, int32(250000))
+
+	fnm := c.MkDir() + "/onehot-case-control.csv"
+	err := writeCaseControlStats(fnm, xrefs[:1])
+	c.Assert(err, check.IsNil)
+	buf, err := ioutil.ReadFile(fnm)
+	c.Assert(err, check.IsNil)
+	lines := strings.Split(string(buf), "\n")
+	c.Check(lines[1], check.Matches, `.*,5,2,1,NaN,NaN,NaN,NaN,NaN,NaN`)
+}
@@ -0,0 +1,224 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kshedden/gonpy"
+)
+
+// missingEncoding determines how missing entries (no-calls and
+// low-quality tile variants) are represented in matrix outputs. The
+// zero value leaves each matrix's native encoding alone:
+//
+//	tile variant matrices: 0 = no-call, -1 = low quality,
+//	                       -2 = covered by a spanning tile (slice-numpy -mark-spanning)
+//	hgvs matrices:         -1 = no-call
+type missingEncoding struct {
+	value string // "default", "-1", "0", or "nan"
+	mask  bool   // also write {name}.missing.npy (1 = missing, 0 = called)
+}
+
+func (me *missingEncoding) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&me.value, "missing-encoding", "default", "represent no-calls in matrix outputs as `value` -1, 0, or nan (nan writes float32 matrices), instead of each matrix's default encoding")
+	flags.BoolVar(&me.mask, "missing-mask", false, "also write a {name}.missing.npy int8 mask (1=missing, 0=called) for each matrix output")
+}
+
+// Args returns command line arguments that reproduce the encoding
+// parameters (see Flags).
+func (me *missingEncoding) Args() []string {
+	return []string{
+		"-missing-encoding=" + me.value,
+		fmt.Sprintf("-missing-mask=%v", me.mask),
+	}
+}
+
+// Check returns an error if the -missing-encoding value is not
+// valid.
+func (me *missingEncoding) Check() error {
+	switch me.value {
+	case "", "default", "-1", "0", "nan":
+		return nil
+	default:
+		return fmt.Errorf("invalid -missing-encoding value %q: must be default, -1, 0, or nan", me.value)
+	}
+}
+
+// tileMatrixSpanning is the tile variant matrix value for a tag
+// covered by a spanning tile, with slice-numpy -mark-spanning. It is
+// not a missing value.
+const tileMatrixSpanning int16 = -2
+
+// Missing-value predicates for the native encodings of the various
+// matrix outputs.
+func tileMatrixMissing(v int16) bool { return v <= 0 && v != tileMatrixSpanning }
+func hgvsMatrixMissing(v int16) bool { return v < 0 }
+
+// Apply rewrites the given int8 or int16 .npy file (in which entries
+// are identified as missing by the given function) using the
+// selected encoding, and writes the mask file if requested. It
+// returns the dtype of the rewritten file ("int8", "int16", or
+// "float32") and the mask filename, or "" if no mask was written.
+func (me *missingEncoding) Apply(fnm string, missing func(int16) bool) (dtype, maskFnm string, err error) {
+	in, err := os.Open(fnm)
+	if err != nil {
+		return "", "", err
+	}
+	defer in.Close()
+	rdr := bufio.NewReaderSize(in, 1<<20)
+	npyDtype, size, rows, cols, err := readNumpyHeader(rdr)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", fnm, err)
+	} else if npyDtype != "i1" && npyDtype != "i2" {
+		return "", "", fmt.Errorf("%s: unsupported dtype %q (expected int8 or int16)", fnm, npyDtype)
+	}
+	dtype = fmt.Sprintf("int%d", size*8)
+	if (me.value == "" || me.value == "default") && !me.mask {
+		return dtype, "", nil
+	}
+
+	var out *bufio.Writer
+	var outf *os.File
+	var replace int16
+	nan := me.value == "nan"
+	if me.value != "" && me.value != "default" {
+		outDescr := fmt.Sprintf("<i%d", size)
+		if nan {
+			dtype, outDescr = "float32", "<f4"
+		} else {
+			n, _ := strconv.Atoi(me.value)
+			replace = int16(n)
+		}
+		outf, err = os.Create(fnm + ".tmp")
+		if err != nil {
+			return "", "", err
+		}
+		defer outf.Close()
+		defer os.Remove(fnm + ".tmp")
+		out = bufio.NewWriterSize(outf, 1<<20)
+		err = writeNumpyHeader(out, outDescr, rows, cols)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	var maskw *bufio.Writer
+	var maskf *os.File
+	if me.mask {
+		maskFnm = strings.TrimSuffix(fnm, ".npy") + ".missing.npy"
+		maskf, err = os.Create(maskFnm)
+		if err != nil {
+			return "", "", err
+		}
+		defer maskf.Close()
+		maskw = bufio.NewWriterSize(maskf, 1<<20)
+		err = writeNumpyHeader(maskw, "|i1", rows, cols)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	buf := make([]byte, size)
+	var obuf [4]byte
+	for i := 0; i < rows*cols; i++ {
+		_, err = io.ReadFull(rdr, buf)
+		if err != nil {
+			return "", "", fmt.Errorf("%s: %w", fnm, err)
+		}
+		var v int16
+		if size == 1 {
+			v = int16(int8(buf[0]))
+		} else {
+			v = int16(binary.LittleEndian.Uint16(buf))
+		}
+		isMissing := missing(v)
+		if maskw != nil {
+			if isMissing {
+				maskw.WriteByte(1)
+			} else {
+				maskw.WriteByte(0)
+			}
+		}
+		if out == nil {
+			continue
+		}
+		switch {
+		case nan && isMissing:
+			binary.LittleEndian.PutUint32(obuf[:], math.Float32bits(float32(math.NaN())))
+			_, err = out.Write(obuf[:4])
+		case nan:
+			binary.LittleEndian.PutUint32(obuf[:], math.Float32bits(float32(v)))
+			_, err = out.Write(obuf[:4])
+		default:
+			if isMissing {
+				v = replace
+			}
+			binary.LittleEndian.PutUint16(obuf[:], uint16(v))
+			_, err = out.Write(obuf[:size])
+		}
+		if err != nil {
+			return "", "", err
+		}
+	}
+	if maskw != nil {
+		err = maskw.Flush()
+		if err != nil {
+			return "", "", err
+		}
+		err = maskf.Close()
+		if err != nil {
+			return "", "", err
+		}
+	}
+	if out != nil {
+		err = out.Flush()
+		if err != nil {
+			return "", "", err
+		}
+		err = outf.Close()
+		if err != nil {
+			return "", "", err
+		}
+		err = os.Rename(fnm+".tmp", fnm)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return dtype, maskFnm, nil
+}
+
+// readNumpyHeader reads the header of a 2-D .npy file, leaving r
+// positioned at the start of the data. It returns the numpy type
+// without byte order (e.g., "i2" or "f4"), the element size in bytes,
+// and the shape.
+func readNumpyHeader(r io.Reader) (dtype string, size, rows, cols int, err error) {
+	npy, err := gonpy.NewReader(r)
+	if err != nil {
+		return
+	}
+	dtype = strings.TrimLeft(npy.Dtype, "<>|=")
+	if len(npy.Shape) != 2 {
+		err = fmt.Errorf("expected 2-dimensional array, got shape %v", npy.Shape)
+	} else if npy.ColumnMajor {
+		err = errors.New("column-major (fortran_order) arrays are not supported")
+	} else if npy.Endian == binary.BigEndian {
+		err = errors.New("big-endian arrays are not supported")
+	} else if size, err = strconv.Atoi(strings.TrimLeft(dtype, "biuf")); err != nil || size < 1 {
+		err = fmt.Errorf("unsupported dtype %q", npy.Dtype)
+	} else {
+		rows, cols = npy.Shape[0], npy.Shape[1]
+	}
+	return
+}
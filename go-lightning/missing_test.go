@@ -0,0 +1,112 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type missingSuite struct{}
+
+var _ = check.Suite(&missingSuite{})
+
+// readNumpyBody returns the header and data of a .npy file.
+func readNumpyBody(c *check.C, fnm string) (string, []byte) {
+	buf, err := os.ReadFile(fnm)
+	c.Assert(err, check.IsNil)
+	hdrlen := 10 + int(binary.LittleEndian.Uint16(buf[8:]))
+	return string(buf[:hdrlen]), buf[hdrlen:]
+}
+
+func writeTestNumpyInt16(c *check.C, fnm string, data []int16, rows, cols int) {
+	var buf bytes.Buffer
+	c.Assert(writeNumpyHeader(&buf, "<i2", rows, cols), check.IsNil)
+	c.Assert(binary.Write(&buf, binary.LittleEndian, data), check.IsNil)
+	c.Assert(os.WriteFile(fnm, buf.Bytes(), 0666), check.IsNil)
+}
+
+func (s *missingSuite) TestApply(c *check.C) {
+	tmpdir := c.MkDir()
+	data := []int16{1, 0, -1, 2, 3, 0}
+	for _, trial := range []struct {
+		value  string
+		expect []int16
+	}{
+		{"-1", []int16{1, -1, -1, 2, 3, -1}},
+		{"0", []int16{1, 0, 0, 2, 3, 0}},
+	} {
+		fnm := tmpdir + "/matrix.npy"
+		writeTestNumpyInt16(c, fnm, data, 2, 3)
+		me := missingEncoding{value: trial.value}
+		dtype, maskFnm, err := me.Apply(fnm, tileMatrixMissing)
+		c.Assert(err, check.IsNil)
+		c.Check(dtype, check.Equals, "int16")
+		c.Check(maskFnm, check.Equals, "")
+		hdr, body := readNumpyBody(c, fnm)
+		c.Check(hdr, check.Matches, `(?s).*'descr': '<i2'.*'shape': \(2, 3\).*`)
+		got := make([]int16, len(body)/2)
+		c.Check(binary.Read(bytes.NewReader(body), binary.LittleEndian, got), check.IsNil)
+		c.Check(got, check.DeepEquals, trial.expect, check.Commentf("value %q", trial.value))
+	}
+
+	fnm := tmpdir + "/hgvs.npy"
+	writeTestNumpyInt16(c, fnm, data, 2, 3)
+	me := missingEncoding{value: "nan", mask: true}
+	dtype, maskFnm, err := me.Apply(fnm, hgvsMatrixMissing)
+	c.Assert(err, check.IsNil)
+	c.Check(dtype, check.Equals, "float32")
+	c.Check(maskFnm, check.Equals, tmpdir+"/hgvs.missing.npy")
+	hdr, body := readNumpyBody(c, fnm)
+	c.Check(hdr, check.Matches, `(?s).*'descr': '<f4'.*'shape': \(2, 3\).*`)
+	got := make([]float32, len(body)/4)
+	c.Check(binary.Read(bytes.NewReader(body), binary.LittleEndian, got), check.IsNil)
+	c.Check(got[:2], check.DeepEquals, []float32{1, 0})
+	c.Check(math.IsNaN(float64(got[2])), check.Equals, true)
+	c.Check(got[3:], check.DeepEquals, []float32{2, 3, 0})
+	hdr, body = readNumpyBody(c, maskFnm)
+	c.Check(hdr, check.Matches, `(?s).*'descr': '\|i1'.*'shape': \(2, 3\).*`)
+	c.Check(body, check.DeepEquals, []byte{0, 0, 1, 0, 0, 0})
+
+	// default encoding: file is left alone
+	writeTestNumpyInt16(c, fnm, data, 2, 3)
+	orig, err := os.ReadFile(fnm)
+	c.Assert(err, check.IsNil)
+	dtype, _, err = (&missingEncoding{value: "default"}).Apply(fnm, tileMatrixMissing)
+	c.Assert(err, check.IsNil)
+	c.Check(dtype, check.Equals, "int16")
+	after, err := os.ReadFile(fnm)
+	c.Assert(err, check.IsNil)
+	c.Check(after, check.DeepEquals, orig)
+
+	// spanning tiles (-mark-spanning) are not missing
+	c.Check(tileMatrixMissing(tileMatrixSpanning), check.Equals, false)
+	c.Check(tileMatrixMissing(-1), check.Equals, true)
+	c.Check(tileMatrixMissing(0), check.Equals, true)
+}
+
+func (s *missingSuite) TestApplyInt8(c *check.C) {
+	fnm := c.MkDir() + "/hgvs.1.npy"
+	var buf bytes.Buffer
+	c.Assert(writeNumpyHeader(&buf, "|i1", 1, 4), check.IsNil)
+	buf.Write([]byte{1, 0, 0xff, 1})
+	c.Assert(os.WriteFile(fnm, buf.Bytes(), 0666), check.IsNil)
+	dtype, _, err := (&missingEncoding{value: "0"}).Apply(fnm, hgvsMatrixMissing)
+	c.Assert(err, check.IsNil)
+	c.Check(dtype, check.Equals, "int8")
+	_, body := readNumpyBody(c, fnm)
+	c.Check(body, check.DeepEquals, []byte{1, 0, 0, 1})
+}
+
+func (s *missingSuite) TestCheck(c *check.C) {
+	for _, v := range []string{"", "default", "-1", "0", "nan"} {
+		c.Check((&missingEncoding{value: v}).Check(), check.IsNil)
+	}
+	c.Check((&missingEncoding{value: "NA"}).Check(), check.ErrorMatches, `invalid -missing-encoding value "NA".*`)
+}
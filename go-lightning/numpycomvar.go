@@ -27,11 +27,13 @@ func (cmd *numpyComVar) RunCommand(prog string, args []string, stdin io.Reader,
 	projectUUID := flags.String("project", "", "project `UUID` for output data")
 	inputFilename := flags.String("i", "-", "numpy matrix `file`")
 	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
 	annotationsFilename := flags.String("annotations", "", "annotations tsv `file`")
 	maxResults := flags.Int("max-results", 256, "maximum number of tile variants to output")
 	minFrequency := flags.Float64("min-frequency", 0.4, "minimum allele frequency")
 	maxFrequency := flags.Float64("max-frequency", 0.6, "maximum allele frequency")
-	err = flags.Parse(args)
+	err = parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		err = nil
 		return 0
@@ -50,6 +52,7 @@ func (cmd *numpyComVar) RunCommand(prog string, args []string, stdin io.Reader,
 		VCPUs:       2,
 		Priority:    *priority,
 	}
+	containerOpts.Apply(&runner, stdout)
 	err = runner.TranslatePaths(inputFilename, annotationsFilename)
 	if err != nil {
 		return 1
@@ -107,7 +110,10 @@ out.close()
 `, *inputFilename, *annotationsFilename, "/mnt/output/commonvariants.csv", fmt.Sprintf("%d", *maxResults), fmt.Sprintf("%f", *minFrequency), fmt.Sprintf("%f", *maxFrequency)}
 	var output string
 	output, err = runner.Run()
-	if err != nil {
+	if err == errDryRun {
+		err = nil
+		return 0
+	} else if err != nil {
 		return 1
 	}
 	fmt.Fprintln(stdout, output+"/commonvariants.csv")
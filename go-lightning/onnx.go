@@ -0,0 +1,132 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// protoMessage builds a protobuf-encoded message. It supports just
+// enough of the wire format to write ONNX models (see
+// https://github.com/onnx/onnx/blob/main/onnx/onnx.proto).
+type protoMessage []byte
+
+func (m *protoMessage) tag(field, wiretype int) {
+	m.uvarint(uint64(field)<<3 | uint64(wiretype))
+}
+
+func (m *protoMessage) uvarint(v uint64) {
+	*m = binary.AppendUvarint(*m, v)
+}
+
+func (m *protoMessage) Int(field int, v int64) {
+	m.tag(field, 0)
+	m.uvarint(uint64(v))
+}
+
+func (m *protoMessage) Bytes(field int, b []byte) {
+	m.tag(field, 2)
+	m.uvarint(uint64(len(b)))
+	*m = append(*m, b...)
+}
+
+func (m *protoMessage) String(field int, s string) {
+	m.Bytes(field, []byte(s))
+}
+
+func (m *protoMessage) Message(field int, sub protoMessage) {
+	m.Bytes(field, sub)
+}
+
+// ONNX enum values and IR/opset versions used by onnxLogisticModel.
+const (
+	onnxIRVersion    = 7
+	onnxOpsetVersion = 13
+	onnxFloat        = 1 // TensorProto.DataType FLOAT
+)
+
+// onnxTensor returns a float TensorProto with the given name and
+// dimensions.
+func onnxTensor(name string, dims []int64, data []float32) protoMessage {
+	var t protoMessage
+	for _, d := range dims {
+		t.Int(1, d)
+	}
+	t.Int(2, onnxFloat)
+	t.String(8, name)
+	raw := make([]byte, 4*len(data))
+	for i, f := range data {
+		binary.LittleEndian.PutUint32(raw[i*4:], math.Float32bits(f))
+	}
+	t.Bytes(9, raw)
+	return t
+}
+
+// onnxValueInfo returns a ValueInfoProto for a float tensor. A dim <
+// 0 is encoded as a symbolic dimension named "N".
+func onnxValueInfo(name string, dims []int64) protoMessage {
+	var shape protoMessage
+	for _, d := range dims {
+		var dim protoMessage
+		if d < 0 {
+			dim.String(2, "N")
+		} else {
+			dim.Int(1, d)
+		}
+		shape.Message(1, dim)
+	}
+	var tensorType protoMessage
+	tensorType.Int(1, onnxFloat)
+	tensorType.Message(2, shape)
+	var typ protoMessage
+	typ.Message(1, tensorType)
+	var vi protoMessage
+	vi.String(1, name)
+	vi.Message(2, typ)
+	return vi
+}
+
+func onnxNode(opType string, inputs []string, output string) protoMessage {
+	var n protoMessage
+	for _, in := range inputs {
+		n.String(1, in)
+	}
+	n.String(2, output)
+	n.String(3, opType+"_"+output)
+	n.String(4, opType)
+	return n
+}
+
+// onnxLogisticModel returns an ONNX model that computes
+// sigmoid(X·coef + intercept). The model has one input, "X" (float,
+// shape [N, len(coef)]), and one output, "probability" (float, shape
+// [N, 1]).
+func onnxLogisticModel(coef []float64, intercept float64) []byte {
+	w := make([]float32, len(coef))
+	for i, c := range coef {
+		w[i] = float32(c)
+	}
+	var graph protoMessage
+	graph.Message(1, onnxNode("MatMul", []string{"X", "coef"}, "logit0"))
+	graph.Message(1, onnxNode("Add", []string{"logit0", "intercept"}, "logit"))
+	graph.Message(1, onnxNode("Sigmoid", []string{"logit"}, "probability"))
+	graph.String(2, "lightning-logistic-regression")
+	graph.Message(5, onnxTensor("coef", []int64{int64(len(coef)), 1}, w))
+	graph.Message(5, onnxTensor("intercept", []int64{1}, []float32{float32(intercept)}))
+	graph.Message(11, onnxValueInfo("X", []int64{-1, int64(len(coef))}))
+	graph.Message(12, onnxValueInfo("probability", []int64{-1, 1}))
+
+	var opset protoMessage
+	opset.String(1, "")
+	opset.Int(2, onnxOpsetVersion)
+
+	var model protoMessage
+	model.Int(1, onnxIRVersion)
+	model.String(2, "lightning")
+	model.Message(7, graph)
+	model.Message(8, opset)
+	return model
+}
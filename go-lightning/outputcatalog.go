@@ -0,0 +1,91 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// outputCatalog describes the files produced by a slice-numpy run,
+// and is written to outputs.json in the output directory so
+// downstream tools can find matrices and their row/column labels
+// without hard-coding filename patterns.
+type outputCatalog struct {
+	Command string            `json:"command"`
+	Flags   map[string]string `json:"flags"`
+	Outputs []outputArtifact  `json:"outputs"`
+
+	mtx sync.Mutex
+}
+
+// outputArtifact describes a single output file. File names are
+// relative to the output directory.
+type outputArtifact struct {
+	File         string `json:"file"`
+	Kind         string `json:"kind"`                    // matrix, onehot, annotations, samples, ...
+	Dtype        string `json:"dtype,omitempty"`         // numpy dtype, e.g., "int16" (npy files only)
+	Shape        []int  `json:"shape,omitempty"`         // numpy shape (npy files only)
+	RowLabels    string `json:"row_labels,omitempty"`    // file describing the rows
+	ColumnLabels string `json:"column_labels,omitempty"` // file describing the columns
+}
+
+func newOutputCatalog(command string, flags *flag.FlagSet) *outputCatalog {
+	m := &outputCatalog{Command: command, Flags: map[string]string{}}
+	flags.VisitAll(func(f *flag.Flag) {
+		m.Flags[f.Name] = f.Value.String()
+	})
+	return m
+}
+
+// add records an output file. It is safe to call concurrently, and
+// on a nil catalog (in which case it does nothing).
+func (m *outputCatalog) add(a outputArtifact) {
+	if m == nil {
+		return
+	}
+	a.File = filepath.Base(a.File)
+	if a.RowLabels != "" {
+		a.RowLabels = filepath.Base(a.RowLabels)
+	}
+	if a.ColumnLabels != "" {
+		a.ColumnLabels = filepath.Base(a.ColumnLabels)
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.Outputs = append(m.Outputs, a)
+}
+
+// addNumpy records a numpy output file with the given dtype, shape,
+// and row/column label files.
+func (m *outputCatalog) addNumpy(fnm, kind, dtype string, rows, cols int, rowLabels, columnLabels string) {
+	m.add(outputArtifact{
+		File:         fnm,
+		Kind:         kind,
+		Dtype:        dtype,
+		Shape:        []int{rows, cols},
+		RowLabels:    rowLabels,
+		ColumnLabels: columnLabels,
+	})
+}
+
+// Write writes the catalog to the given file, with outputs sorted
+// by file name.
+func (m *outputCatalog) Write(fnm string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	sort.Slice(m.Outputs, func(i, j int) bool {
+		return m.Outputs[i].File < m.Outputs[j].File
+	})
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fnm, append(buf, '\n'), 0666)
+}
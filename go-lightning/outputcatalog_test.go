@@ -0,0 +1,43 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type outputCatalogSuite struct{}
+
+var _ = check.Suite(&outputCatalogSuite{})
+
+func (s *outputCatalogSuite) TestWrite(c *check.C) {
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.Bool("single-onehot", false, "")
+	flags.String("output-dir", "./out", "")
+	c.Assert(flags.Parse([]string{"-single-onehot", "-output-dir=/tmp/x"}), check.IsNil)
+
+	cat := newOutputCatalog("slice-numpy", flags)
+	cat.add(outputArtifact{File: "/tmp/x/samples.csv", Kind: "samples"})
+	cat.addNumpy("/tmp/x/matrix.0000.npy", "matrix", "int16", 4, 6, "samples.csv", "/tmp/x/matrix.0000.annotations.csv")
+	var nilcat *outputCatalog
+	nilcat.add(outputArtifact{File: "ignored"})
+
+	fnm := c.MkDir() + "/outputs.json"
+	c.Assert(cat.Write(fnm), check.IsNil)
+	buf, err := os.ReadFile(fnm)
+	c.Assert(err, check.IsNil)
+	var got outputCatalog
+	c.Assert(json.Unmarshal(buf, &got), check.IsNil)
+	c.Check(got.Command, check.Equals, "slice-numpy")
+	c.Check(got.Flags, check.DeepEquals, map[string]string{"single-onehot": "true", "output-dir": "/tmp/x"})
+	c.Check(got.Outputs, check.DeepEquals, []outputArtifact{
+		{File: "matrix.0000.npy", Kind: "matrix", Dtype: "int16", Shape: []int{4, 6}, RowLabels: "samples.csv", ColumnLabels: "matrix.0000.annotations.csv"},
+		{File: "samples.csv", Kind: "samples"},
+	})
+}
@@ -0,0 +1,360 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	log "github.com/sirupsen/logrus"
+)
+
+// outputCollection is a new Arvados collection that receives the
+// files a local command would otherwise write to an output
+// directory. Data is written to Keep as it is produced, so large
+// outputs don't need to be staged on local disk and uploaded
+// afterward.
+//
+// While an outputCollection is active, create and writeFile redirect
+// files below its directory into the collection.
+type outputCollection struct {
+	dir string
+	fs  arvados.CollectionFileSystem
+}
+
+var (
+	outputCollections    = map[string]*outputCollection{}
+	outputCollectionsMtx sync.Mutex
+)
+
+// newOutputCollection returns a new (not yet saved) collection, and
+// starts redirecting files below dir into it.
+func newOutputCollection(dir string) (*outputCollection, error) {
+	if os.Getenv("ARVADOS_API_HOST") == "" {
+		return nil, errors.New("cannot write output to a collection: ARVADOS_API_HOST is not set")
+	}
+	siteFSMtx.Lock()
+	err := setupKeepClient()
+	siteFSMtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	fs, err := (&arvados.Collection{}).FileSystem(arvadosClientFromEnv, keepClient)
+	if err != nil {
+		return nil, err
+	}
+	oc := &outputCollection{dir: filepath.Clean(dir), fs: fs}
+	outputCollectionsMtx.Lock()
+	defer outputCollectionsMtx.Unlock()
+	if outputCollections[oc.dir] != nil {
+		return nil, fmt.Errorf("already writing %s to an output collection", oc.dir)
+	}
+	outputCollections[oc.dir] = oc
+	return oc, nil
+}
+
+// Save stops redirecting files into the collection, and saves it in
+// the given project. Files that are still open are not included.
+func (oc *outputCollection) Save(name, projectUUID string) (arvados.Collection, error) {
+	oc.Release()
+	var coll arvados.Collection
+	mtxt, err := oc.fs.MarshalManifest(".")
+	if err != nil {
+		return coll, err
+	}
+	err = arvadosClientFromEnv.RequestAndDecode(&coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"collection": map[string]interface{}{
+			"owner_uuid":    projectUUID,
+			"manifest_text": mtxt,
+			"name":          name,
+		},
+	})
+	if err != nil {
+		return coll, err
+	}
+	log.Infof("saved output collection %s (%q)", coll.UUID, name)
+	return coll, nil
+}
+
+// Release stops redirecting files into the collection without saving
+// it. It is safe to call Release more than once, and after Save.
+func (oc *outputCollection) Release() {
+	outputCollectionsMtx.Lock()
+	defer outputCollectionsMtx.Unlock()
+	if outputCollections[oc.dir] == oc {
+		delete(outputCollections, oc.dir)
+	}
+}
+
+// openFile creates or truncates fnm, which is a path relative to
+// the top of the collection, creating parent directories as needed.
+func (oc *outputCollection) openFile(fnm string) (io.WriteCloser, error) {
+	dir := ""
+	for _, elt := range strings.Split(filepath.Dir(fnm), "/") {
+		if elt == "." {
+			continue
+		}
+		dir += elt + "/"
+		err := oc.fs.Mkdir(dir, 0777)
+		if err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+	}
+	return oc.fs.OpenFile(fnm, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+}
+
+// lookupOutputCollection returns the active output collection whose
+// directory contains fnm, and the path of fnm relative to that
+// directory. It returns nil if fnm is not in any output collection.
+func lookupOutputCollection(fnm string) (*outputCollection, string) {
+	outputCollectionsMtx.Lock()
+	defer outputCollectionsMtx.Unlock()
+	if len(outputCollections) == 0 {
+		return nil, ""
+	}
+	fnm = filepath.Clean(fnm)
+	for dir := filepath.Dir(fnm); ; dir = filepath.Dir(dir) {
+		if oc := outputCollections[dir]; oc != nil {
+			rel, err := filepath.Rel(dir, fnm)
+			if err != nil {
+				return nil, ""
+			}
+			return oc, rel
+		}
+		if dir == "." || dir == "/" {
+			return nil, ""
+		}
+	}
+}
+
+// create creates or truncates the named file, writing into an output
+// collection instead of the local filesystem if fnm is below an
+// active output collection's directory.
+func create(fnm string) (io.WriteCloser, error) {
+	if oc, rel := lookupOutputCollection(fnm); oc != nil {
+		log.Infof("writing %q to output collection", rel)
+		return oc.openFile(rel)
+	}
+	return os.Create(fnm)
+}
+
+// mkdirAll is like os.MkdirAll, except that it does nothing if dir is
+// in an active output collection (see create).
+func mkdirAll(dir string) error {
+	if oc, _ := lookupOutputCollection(filepath.Join(dir, "_")); oc != nil {
+		return nil
+	}
+	return os.MkdirAll(dir, 0777)
+}
+
+// writeFile is like os.WriteFile, but uses create.
+func writeFile(fnm string, data []byte, perm os.FileMode) error {
+	if oc, _ := lookupOutputCollection(fnm); oc == nil {
+		return os.WriteFile(fnm, data, perm)
+	}
+	f, err := create(fnm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// partialOutput periodically copies completed output files into a
+// separate collection while a long-running command is still
+// working, so partial results can be inspected before the command
+// finishes, and survive if it crashes.
+type partialOutput struct {
+	dir      string
+	interval time.Duration
+	client   apiClient
+	fs       arvados.CollectionFileSystem
+	coll     arvados.Collection
+
+	mtx     sync.Mutex
+	pending []string
+	stop    chan struct{}
+	done    chan struct{}
+	err     error
+}
+
+// apiClient is the subset of *arvados.Client used by partialOutput.
+type apiClient interface {
+	RequestAndDecode(dst interface{}, method, path string, body io.Reader, params interface{}) error
+}
+
+// keepBackend is the subset of *keepclient.KeepClient used by
+// collection filesystems.
+type keepBackend interface {
+	ReadAt(locator string, p []byte, off int) (int, error)
+	BlockWrite(context.Context, arvados.BlockWriteOptions) (arvados.BlockWriteResponse, error)
+	LocalLocator(locator string) (string, error)
+}
+
+// startPartialOutput creates a new collection with the given name in
+// the given project, and starts a goroutine that copies files passed
+// to Add from dir into the collection, saving the collection at the
+// given interval.
+func startPartialOutput(dir, name, projectUUID string, interval time.Duration) (*partialOutput, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid -partial-output-interval %v", interval)
+	}
+	siteFSMtx.Lock()
+	err := setupKeepClient()
+	siteFSMtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return newPartialOutput(arvadosClientFromEnv, keepClient, dir, name, projectUUID, interval)
+}
+
+// newPartialOutput is startPartialOutput with the given API and Keep
+// clients.
+func newPartialOutput(client apiClient, kc keepBackend, dir, name, projectUUID string, interval time.Duration) (*partialOutput, error) {
+	po := &partialOutput{
+		dir:      filepath.Clean(dir),
+		interval: interval,
+		client:   client,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	err := client.RequestAndDecode(&po.coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"collection": map[string]interface{}{
+			"owner_uuid": projectUUID,
+			"name":       name,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	po.fs, err = po.coll.FileSystem(client, kc)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("saving partial output in collection %s every %v", po.coll.UUID, interval)
+	go po.run()
+	return po, nil
+}
+
+// Add queues the given completed files (which must be below the
+// output directory) to be copied at the next save. It is a no-op if
+// po is nil.
+func (po *partialOutput) Add(fnms ...string) {
+	if po == nil {
+		return
+	}
+	po.mtx.Lock()
+	defer po.mtx.Unlock()
+	po.pending = append(po.pending, fnms...)
+}
+
+// Close copies any remaining queued files, saves the collection, and
+// stops the background goroutine. It returns the first error
+// encountered while saving. It is a no-op if po is nil.
+func (po *partialOutput) Close() error {
+	if po == nil {
+		return nil
+	}
+	close(po.stop)
+	<-po.done
+	return po.err
+}
+
+func (po *partialOutput) run() {
+	defer close(po.done)
+	ticker := time.NewTicker(po.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-po.stop:
+			po.save()
+			return
+		case <-ticker.C:
+			po.save()
+		}
+	}
+}
+
+// save copies queued files into the collection and updates the
+// collection record. Errors are logged (and remembered for Close)
+// rather than interrupting the command, which will still save its
+// full output when it finishes.
+func (po *partialOutput) save() {
+	po.mtx.Lock()
+	todo := po.pending
+	po.pending = nil
+	po.mtx.Unlock()
+	if len(todo) == 0 {
+		return
+	}
+	err := po.copyFiles(todo)
+	if err == nil {
+		var mtxt string
+		mtxt, err = po.fs.MarshalManifest(".")
+		if err == nil {
+			err = po.client.RequestAndDecode(&po.coll, "PATCH", "arvados/v1/collections/"+po.coll.UUID, nil, map[string]interface{}{
+				"collection": map[string]interface{}{
+					"manifest_text": mtxt,
+				},
+			})
+		}
+	}
+	if err != nil {
+		log.Warnf("error saving partial output collection %s: %s", po.coll.UUID, err)
+		if po.err == nil {
+			po.err = err
+		}
+		return
+	}
+	log.Infof("saved %d files in partial output collection %s", len(todo), po.coll.UUID)
+}
+
+func (po *partialOutput) copyFiles(fnms []string) error {
+	oc := outputCollection{dir: po.dir, fs: po.fs}
+	for _, fnm := range fnms {
+		rel, err := filepath.Rel(po.dir, filepath.Clean(fnm))
+		if err != nil || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("cannot add %q to partial output: not in %s", fnm, po.dir)
+		}
+		err = func() error {
+			src, err := os.Open(fnm)
+			if os.IsNotExist(err) {
+				// Intermediate file that has already been
+				// merged into a bigger one and deleted.
+				log.Infof("not adding %q to partial output: file no longer exists", fnm)
+				return nil
+			} else if err != nil {
+				return err
+			}
+			defer src.Close()
+			dst, err := oc.openFile(rel)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(dst, src)
+			if err != nil {
+				dst.Close()
+				return err
+			}
+			return dst.Close()
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"gopkg.in/check.v1"
+)
+
+type outputCollectionSuite struct{}
+
+var _ = check.Suite(&outputCollectionSuite{})
+
+func (s *outputCollectionSuite) TestRedirect(c *check.C) {
+	tmpdir := c.MkDir()
+	fs, err := (&arvados.Collection{}).FileSystem(nil, nil)
+	c.Assert(err, check.IsNil)
+	oc := &outputCollection{dir: tmpdir + "/out", fs: fs}
+	outputCollectionsMtx.Lock()
+	outputCollections[oc.dir] = oc
+	outputCollectionsMtx.Unlock()
+	defer oc.Release()
+
+	coll, rel := lookupOutputCollection(tmpdir + "/out/sub/../matrix.npy")
+	c.Check(coll, check.Equals, oc)
+	c.Check(rel, check.Equals, "matrix.npy")
+	coll, _ = lookupOutputCollection(tmpdir + "/outside.csv")
+	c.Check(coll, check.IsNil)
+
+	err = writeFile(tmpdir+"/out/sub/dir/labels.csv", []byte("0,a\n"), 0666)
+	c.Assert(err, check.IsNil)
+	f, err := fs.Open("sub/dir/labels.csv")
+	c.Assert(err, check.IsNil)
+	buf, err := ioutil.ReadAll(f)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "0,a\n")
+
+	err = writeFile(tmpdir+"/local.csv", []byte("x"), 0666)
+	c.Assert(err, check.IsNil)
+	buf, err = ioutil.ReadFile(tmpdir + "/local.csv")
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "x")
+
+	oc.Release()
+	coll, _ = lookupOutputCollection(tmpdir + "/out/matrix.npy")
+	c.Check(coll, check.IsNil)
+}
+
+// stubAPIClient handles the collection create/update requests made
+// by partialOutput, and records the manifest of each update.
+type stubAPIClient struct {
+	mtx     sync.Mutex
+	updates []string
+}
+
+func (ac *stubAPIClient) RequestAndDecode(dst interface{}, method, path string, body io.Reader, params interface{}) error {
+	ac.mtx.Lock()
+	defer ac.mtx.Unlock()
+	coll := dst.(*arvados.Collection)
+	attrs := params.(map[string]interface{})["collection"].(map[string]interface{})
+	switch method {
+	case "POST":
+		coll.UUID = "zzzzz-4zz18-partialoutput00"
+		coll.Name, _ = attrs["name"].(string)
+		coll.OwnerUUID, _ = attrs["owner_uuid"].(string)
+	case "PATCH":
+		coll.ManifestText, _ = attrs["manifest_text"].(string)
+		ac.updates = append(ac.updates, coll.ManifestText)
+	default:
+		return fmt.Errorf("unexpected request %s %s", method, path)
+	}
+	return nil
+}
+
+func (ac *stubAPIClient) Updates() []string {
+	ac.mtx.Lock()
+	defer ac.mtx.Unlock()
+	return append([]string(nil), ac.updates...)
+}
+
+// memKeepClient stores blocks in memory.
+type memKeepClient struct {
+	mtx    sync.Mutex
+	blocks map[string][]byte
+}
+
+func (kc *memKeepClient) BlockWrite(_ context.Context, opts arvados.BlockWriteOptions) (arvados.BlockWriteResponse, error) {
+	locator := fmt.Sprintf("%x+%d", md5.Sum(opts.Data), len(opts.Data))
+	kc.mtx.Lock()
+	defer kc.mtx.Unlock()
+	if kc.blocks == nil {
+		kc.blocks = map[string][]byte{}
+	}
+	kc.blocks[locator] = append([]byte(nil), opts.Data...)
+	return arvados.BlockWriteResponse{Locator: locator, Replicas: 1}, nil
+}
+
+func (kc *memKeepClient) ReadAt(locator string, p []byte, off int) (int, error) {
+	kc.mtx.Lock()
+	defer kc.mtx.Unlock()
+	buf, ok := kc.blocks[locator]
+	if !ok {
+		return 0, os.ErrNotExist
+	} else if off >= len(buf) {
+		return 0, io.EOF
+	}
+	n := copy(p, buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (kc *memKeepClient) LocalLocator(locator string) (string, error) {
+	return locator, nil
+}
+
+func (s *outputCollectionSuite) TestPartialOutputInterval(c *check.C) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		po, err := startPartialOutput(c.MkDir(), "test partial output", "", interval)
+		c.Check(po, check.IsNil)
+		c.Check(err, check.ErrorMatches, `invalid -partial-output-interval .*`)
+	}
+}
+
+func (s *outputCollectionSuite) TestPartialOutput(c *check.C) {
+	tmpdir := c.MkDir()
+	c.Assert(os.Mkdir(tmpdir+"/sub", 0777), check.IsNil)
+	c.Assert(ioutil.WriteFile(tmpdir+"/matrix.0.npy", []byte("chunk0"), 0666), check.IsNil)
+	c.Assert(ioutil.WriteFile(tmpdir+"/sub/annotations.0.csv", []byte("ann0"), 0666), check.IsNil)
+
+	interval := 20 * time.Millisecond
+	client := &stubAPIClient{}
+	po, err := newPartialOutput(client, &memKeepClient{}, tmpdir+"/", "test partial output", "zzzzz-j7d0g-0123456789abcde", interval)
+	c.Assert(err, check.IsNil)
+	c.Check(po.coll.Name, check.Equals, "test partial output")
+	c.Check(po.coll.OwnerUUID, check.Equals, "zzzzz-j7d0g-0123456789abcde")
+
+	// Completed chunks are copied and saved at the next tick,
+	// without waiting for Close. Files that have already been
+	// deleted are skipped.
+	po.Add(tmpdir+"/matrix.0.npy", tmpdir+"/sub/annotations.0.csv", tmpdir+"/tmp.deleted.gob")
+	for deadline := time.Now().Add(10 * time.Second); len(client.Updates()) == 0; time.Sleep(interval / 4) {
+		if time.Now().After(deadline) {
+			c.Fatal("timed out waiting for partial output to be saved")
+		}
+	}
+	updates := client.Updates()
+	c.Check(updates[0], check.Matches, `(?ms)\. .* \d+:6:matrix\.0\.npy\n\./sub .*:annotations\.0\.csv\n`)
+	c.Check(updates[0], check.Not(check.Matches), `(?ms).*deleted.*`)
+
+	// Nothing new to save => no update
+	time.Sleep(5 * interval)
+	c.Check(client.Updates(), check.HasLen, 1)
+
+	// Files added after the last tick are saved by Close.
+	c.Assert(ioutil.WriteFile(tmpdir+"/matrix.1.npy", []byte("chunk1"), 0666), check.IsNil)
+	po.Add(tmpdir + "/matrix.1.npy")
+	c.Check(po.Close(), check.IsNil)
+	updates = client.Updates()
+	c.Assert(updates, check.HasLen, 2)
+	c.Check(updates[1], check.Matches, `(?ms).*:matrix\.0\.npy.*:matrix\.1\.npy.*`)
+	f, err := po.fs.Open("matrix.1.npy")
+	c.Assert(err, check.IsNil)
+	buf, err := ioutil.ReadAll(f)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "chunk1")
+}
+
+func (s *outputCollectionSuite) TestPartialOutputOutsideDir(c *check.C) {
+	tmpdir := c.MkDir()
+	client := &stubAPIClient{}
+	po, err := newPartialOutput(client, &memKeepClient{}, tmpdir+"/out", "test partial output", "", time.Hour)
+	c.Assert(err, check.IsNil)
+	po.Add(tmpdir + "/elsewhere.npy")
+	c.Check(po.Close(), check.ErrorMatches, `cannot add ".*/elsewhere.npy" to partial output: not in .*/out`)
+	c.Check(client.Updates(), check.HasLen, 0)
+
+	// nil partialOutput (partial output disabled) is a no-op
+	po = nil
+	po.Add(tmpdir + "/elsewhere.npy")
+	c.Check(po.Close(), check.IsNil)
+}
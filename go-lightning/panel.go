@@ -0,0 +1,246 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// variantPanel is a user-supplied list of variants (e.g., GWAS hits
+// or pharmacogenomic sites) to output as genotype columns,
+// regardless of which variants happen to be present in the input.
+type variantPanel struct {
+	variants []panelVariant   // in input order
+	index    map[hgvsKey]int  // normalized key -> index in variants
+	byChrom  map[string][]int // canonical contig -> indices, sorted by position
+}
+
+type panelVariant struct {
+	// as given in the input file
+	chrom string
+	pos   int
+	ref   string
+	alt   string
+
+	// normalized: canonical contig name, and minimal ref/alt
+	// alleles with position adjusted accordingly (e.g., VCF
+	// "100 A AT" becomes 101 "" "T", the same as the HGVS
+	// variants reported by slice-numpy)
+	key hgvsKey
+}
+
+// loadVariantPanel reads a variant list from a VCF file (if the
+// filename ends in .vcf or .vcf.gz, or the file starts with a VCF
+// header) or a CSV file with chrom,pos,ref,alt columns and an
+// optional header row. In a CSV file, an empty allele can be written
+// as "" or "-". VCF records with multiple alt alleles yield one
+// variant per alt allele.
+func loadVariantPanel(fnm string) (*variantPanel, error) {
+	f, err := zopen(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	isVCF := strings.HasSuffix(fnm, ".vcf") || strings.HasSuffix(fnm, ".vcf.gz")
+	return parseVariantPanel(f, isVCF, fnm)
+}
+
+func parseVariantPanel(r io.Reader, isVCF bool, fnm string) (*variantPanel, error) {
+	panel := &variantPanel{
+		index:   map[hgvsKey]int{},
+		byChrom: map[string][]int{},
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024)
+	first := true
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		isFirst := first
+		first = false
+		if lineno == 1 && strings.HasPrefix(line, "##fileformat=VCF") {
+			isVCF = true
+		}
+		var chrom, posstr, ref string
+		var alts []string
+		if isVCF {
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			fields := strings.Split(line, "\t")
+			if len(fields) < 5 {
+				return nil, fmt.Errorf("%s:%d: expected at least 5 tab-separated fields", fnm, lineno)
+			}
+			chrom, posstr, ref = fields[0], fields[1], fields[3]
+			alts = strings.Split(fields[4], ",")
+		} else {
+			fields := strings.Split(line, ",")
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("%s:%d: expected 4 comma-separated fields (chrom,pos,ref,alt)", fnm, lineno)
+			}
+			if _, err := strconv.Atoi(fields[1]); err != nil && isFirst {
+				// header row
+				continue
+			}
+			chrom, posstr, ref = fields[0], fields[1], fields[2]
+			alts = fields[3:]
+		}
+		pos, err := strconv.Atoi(posstr)
+		if err != nil || pos < 1 {
+			return nil, fmt.Errorf("%s:%d: invalid position %q", fnm, lineno, posstr)
+		}
+		for _, alt := range alts {
+			v := panelVariant{chrom: chrom, pos: pos, ref: ref, alt: alt}
+			v.key = normalizePanelVariant(chrom, pos, ref, alt)
+			if v.key.ref == v.key.alt {
+				return nil, fmt.Errorf("%s:%d: ref and alt alleles are equivalent", fnm, lineno)
+			}
+			if i, ok := panel.index[v.key]; ok {
+				other := panel.variants[i]
+				return nil, fmt.Errorf("%s:%d: variant %s:%d %s>%s is equivalent to %s:%d %s>%s", fnm, lineno, chrom, pos, ref, alt, other.chrom, other.pos, other.ref, other.alt)
+			}
+			panel.index[v.key] = len(panel.variants)
+			panel.byChrom[v.key.seqname] = append(panel.byChrom[v.key.seqname], len(panel.variants))
+			panel.variants = append(panel.variants, v)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	if len(panel.variants) == 0 {
+		return nil, fmt.Errorf("%s: no variants found", fnm)
+	}
+	for _, idxs := range panel.byChrom {
+		sort.SliceStable(idxs, func(i, j int) bool {
+			return panel.variants[idxs[i]].key.pos < panel.variants[idxs[j]].key.pos
+		})
+	}
+	return panel, nil
+}
+
+// normalizePanelVariant returns the key for the given variant:
+// canonical contig name, upper case alleles with any common suffix
+// and then any common prefix removed, and position adjusted to
+// account for the removed prefix.
+//
+// Note this does not left-align indels in repetitive sequence, so a
+// panel indel only matches if it is given in the same (leftmost)
+// position that slice-numpy reports.
+func normalizePanelVariant(chrom string, pos int, ref, alt string) hgvsKey {
+	ref, alt = strings.ToUpper(ref), strings.ToUpper(alt)
+	if ref == "-" {
+		ref = ""
+	}
+	if alt == "-" {
+		alt = ""
+	}
+	for len(ref) > 0 && len(alt) > 0 && ref[len(ref)-1] == alt[len(alt)-1] {
+		ref, alt = ref[:len(ref)-1], alt[:len(alt)-1]
+	}
+	for len(ref) > 0 && len(alt) > 0 && ref[0] == alt[0] {
+		ref, alt = ref[1:], alt[1:]
+		pos++
+	}
+	return hgvsKey{seqname: canonicalContig(chrom), pos: pos, ref: ref, alt: alt}
+}
+
+// lookup returns the index of the panel variant equivalent to the
+// given variant reported by slice-numpy, or -1 if there is none.
+func (panel *variantPanel) lookup(key hgvsKey) int {
+	key.seqname = canonicalContig(key.seqname)
+	if i, ok := panel.index[key]; ok {
+		return i
+	}
+	return -1
+}
+
+// covered returns the indices of panel variants on the given contig
+// whose positions are between start and end (inclusive).
+func (panel *variantPanel) covered(seqname string, start, end int) []int {
+	idxs := panel.byChrom[canonicalContig(seqname)]
+	i := sort.Search(len(idxs), func(i int) bool { return panel.variants[idxs[i]].key.pos >= start })
+	j := i
+	for j < len(idxs) && panel.variants[idxs[j]].key.pos <= end {
+		j++
+	}
+	return idxs[i:j]
+}
+
+// Keys returns the normalized keys of the panel variants, in input
+// order.
+func (panel *variantPanel) Keys() []hgvsKey {
+	keys := make([]hgvsKey, len(panel.variants))
+	for i, v := range panel.variants {
+		keys[i] = v.key
+	}
+	return keys
+}
+
+// WriteAnnotations writes a CSV file with one row per panel variant
+// (index,chrom,pos,ref,alt, as given in the input file).
+func (panel *variantPanel) WriteAnnotations(fnm string) error {
+	var buf strings.Builder
+	for i, v := range panel.variants {
+		fmt.Fprintf(&buf, "%d,%s,%d,%s,%s\n", i, v.chrom, v.pos, v.ref, v.alt)
+	}
+	return writeFile(fnm, []byte(buf.String()), 0666)
+}
+
+// addColumns adds a column pair to m for each panel variant that is
+// reported in a chunk of slice-numpy output (hgvsKeys/hgvsCols) or
+// falls within one of the chunk's reference tiles (refTiles, pairs of
+// tag and input column). A panel variant in a reference tile that is
+// not reported in the chunk is 0 in genomes that have the reference
+// tile variant and -1 in others, the same as the hgvs matrix columns
+// of a reported variant in genomes that don't have it.
+//
+// reftile returns the reference tile variant, contig, position, and
+// length of the given tag.
+func (panel *variantPanel) addColumns(m *hgvsMatrix, regions *mask, chunk []int16, refTiles [][2]int, hgvsKeys []hgvsKey, hgvsCols map[hgvsKey][2][]int16, reftile func(tag int) (tileVariantID, string, int, int)) error {
+	rows := m.rows
+	chunkcols := len(chunk) / rows
+	seen := map[int]bool{}
+	for _, key := range hgvsKeys {
+		i := panel.lookup(key)
+		if i < 0 {
+			continue
+		}
+		seen[i] = true
+		err := m.Add(panel.variants[i].key, strconv.Itoa(i), hgvsCols[key])
+		if err != nil {
+			return err
+		}
+	}
+	for _, tc := range refTiles {
+		tag, incol := tc[0], tc[1]
+		variant, seqname, pos, length := reftile(tag)
+		for _, i := range panel.covered(seqname, pos+1, pos+length) {
+			key := panel.variants[i].key
+			if seen[i] || (regions != nil && !regions.Check(seqname, key.pos, key.pos+len(key.ref))) {
+				continue
+			}
+			colpair := [2][]int16{make([]int16, rows), make([]int16, rows)}
+			for ph := 0; ph < 2; ph++ {
+				for row := 0; row < rows; row++ {
+					if tileVariantID(chunk[row*chunkcols+incol*2+ph]) != variant {
+						colpair[ph][row] = -1
+					}
+				}
+			}
+			err := m.Add(key, strconv.Itoa(i), colpair)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
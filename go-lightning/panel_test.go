@@ -0,0 +1,57 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type panelSuite struct{}
+
+var _ = check.Suite(&panelSuite{})
+
+func (s *panelSuite) TestParseVCF(c *check.C) {
+	panel, err := parseVariantPanel(strings.NewReader(`##fileformat=VCFv4.2
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO
+chr1	100	rs1	A	AT	.	.	.
+1	200	rs2	C	G,T	.	.	.
+chr2	50	.	GCA	G	.	.	.
+`), false, "test.vcf")
+	c.Assert(err, check.IsNil)
+	c.Check(panel.Keys(), check.DeepEquals, []hgvsKey{
+		{seqname: "1", pos: 101, ref: "", alt: "T"},
+		{seqname: "1", pos: 200, ref: "C", alt: "G"},
+		{seqname: "1", pos: 200, ref: "C", alt: "T"},
+		{seqname: "2", pos: 51, ref: "CA", alt: ""},
+	})
+	c.Check(panel.variants[1].chrom, check.Equals, "1")
+	c.Check(panel.lookup(hgvsKey{seqname: "1", pos: 200, ref: "C", alt: "T"}), check.Equals, 2)
+	c.Check(panel.lookup(hgvsKey{seqname: "1", pos: 101, ref: "", alt: "T"}), check.Equals, 0)
+	c.Check(panel.lookup(hgvsKey{seqname: "1", pos: 200, ref: "C", alt: "A"}), check.Equals, -1)
+	c.Check(panel.covered("chr1", 101, 200), check.DeepEquals, []int{0, 1, 2})
+	c.Check(panel.covered("1", 102, 300), check.DeepEquals, []int{1, 2})
+	c.Check(panel.covered("chr2", 1, 50), check.HasLen, 0)
+}
+
+func (s *panelSuite) TestParseCSV(c *check.C) {
+	panel, err := parseVariantPanel(strings.NewReader("chrom,pos,ref,alt\nchr3,10,-,AC\nchr3,5,g,a\n"), false, "test.csv")
+	c.Assert(err, check.IsNil)
+	c.Check(panel.Keys(), check.DeepEquals, []hgvsKey{
+		{seqname: "3", pos: 10, ref: "", alt: "AC"},
+		{seqname: "3", pos: 5, ref: "G", alt: "A"},
+	})
+	c.Check(panel.covered("chr3", 1, 20), check.DeepEquals, []int{1, 0})
+
+	_, err = parseVariantPanel(strings.NewReader("chr3,5,G,A\nchr3,4,AG,AA\n"), false, "test.csv")
+	c.Check(err, check.ErrorMatches, `test.csv:2: variant chr3:4 AG>AA is equivalent to chr3:5 G>A`)
+	_, err = parseVariantPanel(strings.NewReader("chr3,5,G,G\n"), false, "test.csv")
+	c.Check(err, check.ErrorMatches, `test.csv:1: ref and alt alleles are equivalent`)
+	_, err = parseVariantPanel(strings.NewReader("chr3,5,G\n"), false, "test.csv")
+	c.Check(err, check.ErrorMatches, `test.csv:1: expected 4 .*`)
+	_, err = parseVariantPanel(strings.NewReader("chrom,pos,ref,alt\n"), false, "test.csv")
+	c.Check(err, check.ErrorMatches, `test.csv: no variants found`)
+}
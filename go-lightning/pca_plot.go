@@ -39,8 +39,10 @@ func (cmd *pythonPlot) RunCommand(prog string, args []string, stdin io.Reader, s
 	xComponent := flags.Int("x", 1, "1-based PCA component to plot on x axis")
 	yComponent := flags.Int("y", 2, "1-based PCA component to plot on y axis")
 	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
 	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
-	err = flags.Parse(args)
+	err = parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		err = nil
 		return 0
@@ -65,6 +67,7 @@ func (cmd *pythonPlot) RunCommand(prog string, args []string, stdin io.Reader, s
 			},
 		},
 	}
+	containerOpts.Apply(&runner, stdout)
 	if !*runlocal {
 		err = runner.TranslatePaths(inputFilename, sampleListFilename, phenotypeFilename)
 		if err != nil {
@@ -101,7 +104,10 @@ func (cmd *pythonPlot) RunCommand(prog string, args []string, stdin io.Reader, s
 	runner.Args = append([]string{"/pca_plot.py"}, args...)
 	var output string
 	output, err = runner.Run()
-	if err != nil {
+	if err == errDryRun {
+		err = nil
+		return 0
+	} else if err != nil {
 		return 1
 	}
 	fmt.Fprintln(stdout, output+"/plot.png")
@@ -0,0 +1,208 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Names of the pca.samples.csv columns written by clusterPCA.
+const (
+	pcaClusterColumn = "PCACluster"
+	pcaOutlierColumn = "PCAOutlier"
+)
+
+// clusterPCA assigns each sample to one of k clusters using k-means
+// on its PCA components, fitting the centroids on the training set
+// only. Clusters are numbered in descending order of training set
+// size.
+//
+// If outlierSD > 0, a sample is flagged as an outlier if any of its
+// components is more than outlierSD standard deviations (computed
+// from the training set members of its cluster) away from its
+// cluster's centroid.
+func clusterPCA(components [][]float64, training []bool, k int, outlierSD float64) (clusters []int, outliers []bool, err error) {
+	var train [][]float64
+	for i, p := range components {
+		if training[i] {
+			train = append(train, p)
+		}
+	}
+	if k < 1 {
+		return nil, nil, fmt.Errorf("invalid number of clusters %d", k)
+	} else if len(train) < k {
+		return nil, nil, fmt.Errorf("cannot find %d clusters in %d training samples", k, len(train))
+	}
+	centroids := kmeans(train, k, 10, 1)
+
+	// renumber clusters by size
+	size := make([]int, k)
+	for _, p := range train {
+		size[nearestCentroid(p, centroids)]++
+	}
+	order := make([]int, k)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return size[order[a]] > size[order[b]] })
+	sorted := make([][]float64, k)
+	for i, c := range order {
+		sorted[i] = centroids[c]
+	}
+	centroids = sorted
+
+	clusters = make([]int, len(components))
+	for i, p := range components {
+		clusters[i] = nearestCentroid(p, centroids)
+	}
+	if outlierSD <= 0 {
+		return clusters, nil, nil
+	}
+
+	// sd[c][d] is the standard deviation of component d among
+	// training set members of cluster c
+	sd := make([][]float64, k)
+	n := make([]int, k)
+	for c := range sd {
+		sd[c] = make([]float64, len(centroids[c]))
+	}
+	for i, p := range components {
+		if !training[i] {
+			continue
+		}
+		c := clusters[i]
+		n[c]++
+		for d, x := range p {
+			sd[c][d] += (x - centroids[c][d]) * (x - centroids[c][d])
+		}
+	}
+	for c := range sd {
+		for d := range sd[c] {
+			if n[c] > 1 {
+				sd[c][d] = math.Sqrt(sd[c][d] / float64(n[c]-1))
+			} else {
+				sd[c][d] = 0
+			}
+		}
+	}
+	outliers = make([]bool, len(components))
+	for i, p := range components {
+		c := clusters[i]
+		for d, x := range p {
+			if sd[c][d] > 0 && math.Abs(x-centroids[c][d]) > outlierSD*sd[c][d] {
+				outliers[i] = true
+				break
+			}
+		}
+	}
+	return clusters, outliers, nil
+}
+
+// kmeans returns k centroids for the given points, using Lloyd's
+// algorithm with k-means++ initialization. The best (lowest total
+// squared distance) of the given number of restarts is returned. The
+// result is deterministic for a given seed.
+func kmeans(points [][]float64, k, restarts int, seed int64) [][]float64 {
+	rnd := rand.New(rand.NewSource(seed))
+	var best [][]float64
+	bestCost := math.Inf(1)
+	for r := 0; r < restarts; r++ {
+		centroids := kmeansInit(points, k, rnd)
+		assign := make([]int, len(points))
+		for iter := 0; iter < 100; iter++ {
+			changed := iter == 0
+			for i, p := range points {
+				if c := nearestCentroid(p, centroids); c != assign[i] {
+					assign[i] = c
+					changed = true
+				}
+			}
+			if !changed {
+				break
+			}
+			count := make([]int, k)
+			sum := make([][]float64, k)
+			for c := range sum {
+				sum[c] = make([]float64, len(points[0]))
+			}
+			for i, p := range points {
+				count[assign[i]]++
+				for d, x := range p {
+					sum[assign[i]][d] += x
+				}
+			}
+			for c := range centroids {
+				if count[c] == 0 {
+					// leave empty cluster's
+					// centroid where it is
+					continue
+				}
+				for d := range sum[c] {
+					sum[c][d] /= float64(count[c])
+				}
+				centroids[c] = sum[c]
+			}
+		}
+		cost := 0.0
+		for _, p := range points {
+			cost += sqdist(p, centroids[nearestCentroid(p, centroids)])
+		}
+		if cost < bestCost {
+			best, bestCost = centroids, cost
+		}
+	}
+	return best
+}
+
+// kmeansInit chooses k initial centroids from the given points
+// using the k-means++ method.
+func kmeansInit(points [][]float64, k int, rnd *rand.Rand) [][]float64 {
+	centroids := [][]float64{append([]float64(nil), points[rnd.Intn(len(points))]...)}
+	dist := make([]float64, len(points))
+	for len(centroids) < k {
+		total := 0.0
+		for i, p := range points {
+			dist[i] = sqdist(p, centroids[nearestCentroid(p, centroids)])
+			total += dist[i]
+		}
+		next := 0
+		if total > 0 {
+			x := rnd.Float64() * total
+			for next = range dist {
+				x -= dist[next]
+				if x < 0 {
+					break
+				}
+			}
+		} else {
+			// all points coincide with existing
+			// centroids
+			next = rnd.Intn(len(points))
+		}
+		centroids = append(centroids, append([]float64(nil), points[next]...))
+	}
+	return centroids
+}
+
+func nearestCentroid(p []float64, centroids [][]float64) int {
+	best, bestDist := 0, math.Inf(1)
+	for c, centroid := range centroids {
+		if d := sqdist(p, centroid); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+func sqdist(a, b []float64) float64 {
+	d := 0.0
+	for i := range a {
+		d += (a[i] - b[i]) * (a[i] - b[i])
+	}
+	return d
+}
@@ -0,0 +1,46 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"gopkg.in/check.v1"
+)
+
+type pcaClusterSuite struct{}
+
+var _ = check.Suite(&pcaClusterSuite{})
+
+func (s *pcaClusterSuite) TestClusterPCA(c *check.C) {
+	components := [][]float64{
+		{10, 0}, {10.1, 0.1}, {9.9, -0.1}, {10, 0.1}, {10.1, -0.1},
+		{0, 0.1}, {0.1, -0.1}, {-0.1, 0},
+		{10, 0}, // validation sample near the big cluster
+		{0, 5},  // outlier, validation
+	}
+	training := []bool{true, true, true, true, true, true, true, true, false, false}
+	clusters, outliers, err := clusterPCA(components, training, 2, 0)
+	c.Assert(err, check.IsNil)
+	c.Check(outliers, check.IsNil)
+	c.Check(clusters, check.DeepEquals, []int{0, 0, 0, 0, 0, 1, 1, 1, 0, 1})
+
+	clusters, outliers, err = clusterPCA(components, training, 2, 6)
+	c.Assert(err, check.IsNil)
+	c.Check(clusters, check.DeepEquals, []int{0, 0, 0, 0, 0, 1, 1, 1, 0, 1})
+	c.Check(outliers, check.DeepEquals, []bool{false, false, false, false, false, false, false, false, false, true})
+
+	_, _, err = clusterPCA(components, training, 9, 0)
+	c.Check(err, check.ErrorMatches, `cannot find 9 clusters in 8 training samples`)
+}
+
+func (s *pcaClusterSuite) TestKmeansDeterministic(c *check.C) {
+	points := [][]float64{{0}, {1}, {2}, {10}, {11}, {12}, {20}, {21}}
+	c.Check(kmeans(points, 3, 5, 1), check.DeepEquals, kmeans(points, 3, 5, 1))
+	centroids := kmeans(points, 3, 5, 1)
+	c.Check(centroids, check.HasLen, 3)
+	for _, p := range points {
+		centroid := centroids[nearestCentroid(p, centroids)]
+		c.Check(sqdist(p, centroid) <= 1, check.Equals, true, check.Commentf("%v -> %v", p, centroid))
+	}
+}
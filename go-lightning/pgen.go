@@ -0,0 +1,667 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PLINK2 .pgen/.pvar/.psam input support.
+//
+// The .pgen reader handles the standard variable-width storage mode
+// (0x10) with biallelic hardcalls and (optional) phase information,
+// which is what "plink2 --make-pgen" writes for phased VCF input.
+// Dosage tracks are ignored. Multiallelic hardcalls are not
+// supported; split them first with "plink2 --make-pgen
+// multiallelics=-" or similar.
+
+var errPgenTruncated = errors.New("truncated pgen record")
+
+const pgenBlockSize = 1 << 16
+
+// pgenVariant is a variant from a .pvar file.
+type pgenVariant struct {
+	chrom int // index into pgenData.chroms
+	pos   int // 1-based position
+	ref   []byte
+	alt   []byte // first alt allele, or nil if the variant can't be applied to a sequence
+}
+
+// pgenData is the content of a .pgen/.pvar/.psam trio, arranged for
+// reconstructing per-haplotype sequences.
+type pgenData struct {
+	samples    []string // IIDs from .psam
+	variants   []pgenVariant
+	chroms     []string
+	chromRange [][2]int   // [start, end) indices into variants, for each chrom
+	alt        [][]uint32 // alt[sample*2+phase] = indices of variants where the haplotype has the alt allele
+	nocall     [][]uint32 // nocall[sample] = indices of variants where the sample is missing or unphased
+}
+
+// pgenCompanion returns the name of the .pvar or .psam file that
+// accompanies the given .pgen file.
+func pgenCompanion(pgenFile, ext string) string {
+	return strings.TrimSuffix(pgenFile, ".pgen") + ext
+}
+
+// loadPgen reads the given .pgen file and its .pvar and .psam
+// companions.
+func loadPgen(fnm string) (*pgenData, error) {
+	pg := &pgenData{}
+	var err error
+	pg.samples, err = readPsam(pgenCompanion(fnm, ".psam"))
+	if err != nil {
+		return nil, err
+	}
+	pvarFile := pgenCompanion(fnm, ".pvar")
+	pg.variants, pg.chroms, err = readPvar(pvarFile)
+	if err != nil {
+		return nil, err
+	}
+	pg.chromRange = make([][2]int, len(pg.chroms))
+	for i, v := range pg.variants {
+		if i == 0 || v.chrom != pg.variants[i-1].chrom {
+			if pg.chromRange[v.chrom][1] > 0 {
+				return nil, fmt.Errorf("%s: variants for chromosome %s are not contiguous", pvarFile, pg.chroms[v.chrom])
+			}
+			pg.chromRange[v.chrom][0] = i
+		} else if v.pos < pg.variants[i-1].pos {
+			return nil, fmt.Errorf("%s: variants are not sorted by position (%s:%d follows %s:%d)", pvarFile, pg.chroms[v.chrom], v.pos, pg.chroms[v.chrom], pg.variants[i-1].pos)
+		}
+		pg.chromRange[v.chrom][1] = i + 1
+	}
+
+	f, err := open(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	pr, err := newPgenReader(bufio.NewReaderSize(f, 8*1024*1024), len(pg.variants), len(pg.samples))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	pg.alt = make([][]uint32, len(pg.samples)*2)
+	pg.nocall = make([][]uint32, len(pg.samples))
+	for vi, v := range pg.variants {
+		geno, phase, err := pr.Next()
+		if err != nil {
+			return nil, fmt.Errorf("%s: variant %d (%s:%d): %w", fnm, vi, pg.chroms[v.chrom], v.pos, err)
+		}
+		if v.alt == nil {
+			continue
+		}
+		for s, g := range geno {
+			switch {
+			case g == 0:
+			case g == 2:
+				pg.alt[s*2] = append(pg.alt[s*2], uint32(vi))
+				pg.alt[s*2+1] = append(pg.alt[s*2+1], uint32(vi))
+			case g == 1 && phase[s] >= 0:
+				pg.alt[s*2+1-int(phase[s])] = append(pg.alt[s*2+1-int(phase[s])], uint32(vi))
+			default:
+				pg.nocall[s] = append(pg.nocall[s], uint32(vi))
+			}
+		}
+	}
+	log.Infof("%s: loaded %d variants for %d samples", fnm, len(pg.variants), len(pg.samples))
+	return pg, nil
+}
+
+// readPsam returns the sample IDs (IID column) from a .psam (or
+// .fam) file.
+func readPsam(fnm string) ([]string, error) {
+	f, err := open(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	iidCol := 1 // .fam: FID IID PAT MAT SEX PHENO
+	var samples []string
+	for lineno := 1; scanner.Scan(); lineno++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if strings.HasPrefix(fields[0], "#") {
+			if lineno > 1 {
+				continue
+			}
+			iidCol = -1
+			for i, name := range fields {
+				if strings.TrimPrefix(name, "#") == "IID" {
+					iidCol = i
+				}
+			}
+			if iidCol < 0 {
+				return nil, fmt.Errorf("%s: no IID column in header", fnm)
+			}
+			continue
+		}
+		if iidCol >= len(fields) {
+			return nil, fmt.Errorf("%s: line %d: missing IID column", fnm, lineno)
+		}
+		samples = append(samples, fields[iidCol])
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("%s: no samples", fnm)
+	}
+	return samples, nil
+}
+
+// readPvar returns the variants listed in a .pvar (or .bim) file,
+// and the chromosome names, in order of first appearance.
+func readPvar(fnm string) ([]pgenVariant, []string, error) {
+	f, err := open(fnm)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	// .bim: CHROM ID CM POS ALT REF
+	chromCol, posCol, refCol, altCol := 0, 3, 5, 4
+	chromIndex := map[string]int{}
+	var chroms []string
+	var variants []pgenVariant
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "##") || line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if strings.HasPrefix(line, "#") {
+			chromCol, posCol, refCol, altCol = -1, -1, -1, -1
+			for i, name := range fields {
+				switch strings.TrimPrefix(name, "#") {
+				case "CHROM":
+					chromCol = i
+				case "POS":
+					posCol = i
+				case "REF":
+					refCol = i
+				case "ALT":
+					altCol = i
+				}
+			}
+			if chromCol < 0 || posCol < 0 || refCol < 0 || altCol < 0 {
+				return nil, nil, fmt.Errorf("%s: header must have CHROM, POS, REF, and ALT columns", fnm)
+			}
+			continue
+		}
+		if len(fields) <= chromCol || len(fields) <= posCol || len(fields) <= refCol || len(fields) <= altCol {
+			return nil, nil, fmt.Errorf("%s: line %d: too few fields", fnm, lineno)
+		}
+		pos, err := strconv.Atoi(fields[posCol])
+		if err != nil || pos < 1 {
+			return nil, nil, fmt.Errorf("%s: line %d: invalid position %q", fnm, lineno, fields[posCol])
+		}
+		chrom, ok := chromIndex[fields[chromCol]]
+		if !ok {
+			chrom = len(chroms)
+			chromIndex[fields[chromCol]] = chrom
+			chroms = append(chroms, fields[chromCol])
+		}
+		v := pgenVariant{
+			chrom: chrom,
+			pos:   pos,
+			ref:   bytes.ToLower([]byte(fields[refCol])),
+		}
+		alt := fields[altCol]
+		if i := strings.IndexByte(alt, ','); i >= 0 {
+			alt = alt[:i]
+		}
+		if isPlainAllele(fields[refCol]) && isPlainAllele(alt) {
+			v.alt = bytes.ToLower([]byte(alt))
+		}
+		variants = append(variants, v)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	return variants, chroms, nil
+}
+
+// isPlainAllele returns true if s is a non-empty sequence of
+// nucleotides (not ".", "*", or a symbolic allele like "<DEL>").
+func isPlainAllele(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch c {
+		case 'A', 'C', 'G', 'T', 'N', 'a', 'c', 'g', 't', 'n':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// chromIndex returns the index in pg.chroms of the given reference
+// sequence name, allowing for the presence/absence of a "chr"
+// prefix.
+func (pg *pgenData) chromIndex(name string) (int, bool) {
+	for _, try := range []string{name, "chr" + name, strings.TrimPrefix(name, "chr")} {
+		for i, chrom := range pg.chroms {
+			if chrom == try {
+				return i, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// writeHaplotypeFasta writes the given haplotype of the given sample
+// to w in fasta format, by applying its variants to the reference
+// sequences. Missing and unphased genotypes are written as "n". It
+// returns the number of variants that were skipped because their REF
+// allele did not match the reference or they overlapped a variant
+// that was already applied.
+func (pg *pgenData) writeHaplotypeFasta(w io.Writer, refseqs []refSeq, sample, phase int) (skipped int, err error) {
+	alt, nocall := pg.alt[sample*2+phase], pg.nocall[sample]
+	for _, rs := range refseqs {
+		if _, err = fmt.Fprintf(w, ">%s\n", rs.name); err != nil {
+			return
+		}
+		cursor := 0
+		if c, ok := pg.chromIndex(rs.name); ok {
+			start, end := uint32(pg.chromRange[c][0]), uint32(pg.chromRange[c][1])
+			ai := sort.Search(len(alt), func(i int) bool { return alt[i] >= start })
+			ni := sort.Search(len(nocall), func(i int) bool { return nocall[i] >= start })
+			for {
+				var vi uint32
+				var isAlt bool
+				if ai < len(alt) && alt[ai] < end && (ni >= len(nocall) || alt[ai] < nocall[ni]) {
+					vi, isAlt = alt[ai], true
+					ai++
+				} else if ni < len(nocall) && nocall[ni] < end {
+					vi = nocall[ni]
+					ni++
+				} else {
+					break
+				}
+				v := pg.variants[vi]
+				p := v.pos - 1
+				if p < cursor || p+len(v.ref) > len(rs.seq) || !bytes.Equal(rs.seq[p:p+len(v.ref)], v.ref) {
+					skipped++
+					continue
+				}
+				if _, err = w.Write(rs.seq[cursor:p]); err != nil {
+					return
+				}
+				if isAlt {
+					_, err = w.Write(v.alt)
+				} else {
+					_, err = w.Write(bytes.Repeat([]byte{'n'}, len(v.ref)))
+				}
+				if err != nil {
+					return
+				}
+				cursor = p + len(v.ref)
+			}
+		}
+		if _, err = w.Write(rs.seq[cursor:]); err != nil {
+			return
+		}
+		if _, err = w.Write([]byte{'\n'}); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// pgenReader reads genotypes from a .pgen file, one variant at a
+// time.
+type pgenReader struct {
+	r         *bufio.Reader
+	nsamples  int
+	nvariants int
+	idBytes   int // size of a sample ID in a difflist
+	vrtypes   []byte
+	reclens   []uint32
+	blockOffs []uint64
+	offset    uint64 // current position in r
+	next      int    // index of next variant to read
+	rec       []byte
+	geno      []byte
+	ldbase    []byte
+	phase     []int8
+}
+
+func newPgenReader(r *bufio.Reader, nvariants, nsamples int) (*pgenReader, error) {
+	var hdr [12]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	if hdr[0] != 0x6c || hdr[1] != 0x1b {
+		return nil, errors.New("not a pgen file")
+	}
+	if hdr[2] != 0x10 {
+		return nil, fmt.Errorf("unsupported pgen storage mode 0x%02x", hdr[2])
+	}
+	if n := int(binary.LittleEndian.Uint32(hdr[3:])); n != nvariants {
+		return nil, fmt.Errorf("pgen has %d variants but pvar has %d", n, nvariants)
+	}
+	if n := int(binary.LittleEndian.Uint32(hdr[7:])); n != nsamples {
+		return nil, fmt.Errorf("pgen has %d samples but psam has %d", n, nsamples)
+	}
+	storage := hdr[11] & 0xf
+	if storage > 7 {
+		return nil, fmt.Errorf("unsupported pgen header control byte 0x%02x", hdr[11])
+	}
+	vrtype8 := storage >= 4
+	reclenBytes := int(storage&3) + 1
+	alleleCtBytes := int(hdr[11]>>4) & 3
+	nonrefFlags := hdr[11]>>6 == 3
+
+	pr := &pgenReader{
+		r:         r,
+		nsamples:  nsamples,
+		nvariants: nvariants,
+		idBytes:   pgenIDBytes(nsamples),
+		vrtypes:   make([]byte, nvariants),
+		reclens:   make([]uint32, nvariants),
+		blockOffs: make([]uint64, (nvariants+pgenBlockSize-1)/pgenBlockSize),
+		offset:    uint64(len(hdr)),
+		geno:      make([]byte, nsamples),
+		phase:     make([]int8, nsamples),
+	}
+	read := func(n int) ([]byte, error) {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(r, buf)
+		pr.offset += uint64(n)
+		return buf, err
+	}
+	buf, err := read(8 * len(pr.blockOffs))
+	if err != nil {
+		return nil, err
+	}
+	for b := range pr.blockOffs {
+		pr.blockOffs[b] = binary.LittleEndian.Uint64(buf[b*8:])
+	}
+	for b := range pr.blockOffs {
+		first := b * pgenBlockSize
+		n := nvariants - first
+		if n > pgenBlockSize {
+			n = pgenBlockSize
+		}
+		if vrtype8 {
+			buf, err = read(n)
+			copy(pr.vrtypes[first:], buf)
+		} else {
+			buf, err = read((n + 1) / 2)
+			for i := 0; i < n; i++ {
+				pr.vrtypes[first+i] = (buf[i/2] >> (4 * uint(i&1))) & 0xf
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf, err = read(n * reclenBytes)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < n; i++ {
+			var reclen uint32
+			for j := reclenBytes - 1; j >= 0; j-- {
+				reclen = reclen<<8 | uint32(buf[i*reclenBytes+j])
+			}
+			pr.reclens[first+i] = reclen
+		}
+		skip := n * alleleCtBytes
+		if nonrefFlags {
+			skip += (n + 7) / 8
+		}
+		if _, err = read(skip); err != nil {
+			return nil, err
+		}
+	}
+	return pr, nil
+}
+
+// pgenIDBytes returns the number of bytes used to store a sample ID
+// in a difflist.
+func pgenIDBytes(nsamples int) int {
+	switch {
+	case nsamples < 1<<8:
+		return 1
+	case nsamples < 1<<16:
+		return 2
+	case nsamples < 1<<24:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// Next returns the genotypes of the next variant: geno[i] is 0 (hom
+// ref), 1 (het), 2 (hom alt), or 3 (missing) for sample i. For a
+// het, phase[i] is 0 ("0|1"), 1 ("1|0"), or -1 (unphased). The
+// returned slices are only valid until the next call to Next.
+func (pr *pgenReader) Next() (geno []byte, phase []int8, err error) {
+	vi := pr.next
+	if vi >= pr.nvariants {
+		return nil, nil, io.EOF
+	}
+	pr.next++
+	if vi%pgenBlockSize == 0 {
+		off := pr.blockOffs[vi/pgenBlockSize]
+		if off < pr.offset {
+			return nil, nil, fmt.Errorf("invalid block offset %d", off)
+		}
+		_, err = io.CopyN(ioutil.Discard, pr.r, int64(off-pr.offset))
+		if err != nil {
+			return nil, nil, err
+		}
+		pr.offset = off
+	}
+	reclen := int(pr.reclens[vi])
+	if cap(pr.rec) < reclen {
+		pr.rec = make([]byte, reclen)
+	}
+	rec := pr.rec[:reclen]
+	_, err = io.ReadFull(pr.r, rec)
+	if err != nil {
+		return nil, nil, err
+	}
+	pr.offset += uint64(reclen)
+
+	vrtype := pr.vrtypes[vi]
+	rec, err = pr.decodeGenotypes(vrtype, rec)
+	if err != nil {
+		return nil, nil, err
+	}
+	if vrtype&8 != 0 {
+		return nil, nil, errors.New("multiallelic hardcalls are not supported")
+	}
+	for i := range pr.phase {
+		pr.phase[i] = -1
+	}
+	if vrtype&0x10 != 0 {
+		err = pr.decodePhase(rec)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return pr.geno, pr.phase, nil
+}
+
+// decodeGenotypes decodes the hardcall track of a variant record
+// into pr.geno, and returns the rest of the record.
+func (pr *pgenReader) decodeGenotypes(vrtype byte, rec []byte) ([]byte, error) {
+	geno := pr.geno
+	var err error
+	switch low := vrtype & 7; low {
+	case 0:
+		// 2-bit genotype array
+		n := (pr.nsamples + 3) / 4
+		if len(rec) < n {
+			return nil, errPgenTruncated
+		}
+		for i := range geno {
+			geno[i] = (rec[i/4] >> (2 * uint(i&3))) & 3
+		}
+		rec = rec[n:]
+	case 1:
+		// 1-bit array selecting between two common genotypes,
+		// plus a difflist of exceptions
+		n := (pr.nsamples + 7) / 8
+		if len(rec) < 1+n {
+			return nil, errPgenTruncated
+		}
+		base, delta := rec[0]>>2, rec[0]&3
+		for i := range geno {
+			geno[i] = base + delta*((rec[1+i/8]>>uint(i&7))&1)
+		}
+		rec, err = pr.applyDifflist(rec[1+n:])
+	case 2, 3:
+		// difflist relative to the most recent non-LD-compressed
+		// variant (3 = with ref/alt swapped)
+		if pr.ldbase == nil {
+			return nil, errors.New("LD-compressed record without a preceding base record")
+		}
+		copy(geno, pr.ldbase)
+		rec, err = pr.applyDifflist(rec)
+		if low == 3 {
+			for i, g := range geno {
+				if g == 0 || g == 2 {
+					geno[i] = 2 - g
+				}
+			}
+		}
+	case 5:
+		// all hom ref
+		for i := range geno {
+			geno[i] = 0
+		}
+	default:
+		// difflist against a background of hom ref (4), hom
+		// alt (6), or missing (7)
+		for i := range geno {
+			geno[i] = low & 3
+		}
+		rec, err = pr.applyDifflist(rec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if low := vrtype & 7; low != 2 && low != 3 {
+		if pr.ldbase == nil {
+			pr.ldbase = make([]byte, pr.nsamples)
+		}
+		copy(pr.ldbase, geno)
+	}
+	return rec, nil
+}
+
+// applyDifflist parses a difflist (a sparse list of sample IDs and
+// genotypes) at the start of rec, writes its genotypes into pr.geno,
+// and returns the rest of rec.
+func (pr *pgenReader) applyDifflist(rec []byte) ([]byte, error) {
+	l, n := binary.Uvarint(rec)
+	if n <= 0 {
+		return nil, errPgenTruncated
+	}
+	rec = rec[n:]
+	if l == 0 {
+		return rec, nil
+	} else if l > uint64(pr.nsamples) {
+		return nil, fmt.Errorf("difflist length %d exceeds sample count %d", l, pr.nsamples)
+	}
+	length := int(l)
+	groups := (length + 63) / 64
+	firstIDs := groups * pr.idBytes
+	if len(rec) < firstIDs+(groups-1)+(length+3)/4 {
+		return nil, errPgenTruncated
+	}
+	ids := rec[:firstIDs]
+	raregeno := rec[firstIDs+groups-1:]
+	rec = raregeno[(length+3)/4:]
+	for g := 0; g < groups; g++ {
+		var id uint64
+		for j := pr.idBytes - 1; j >= 0; j-- {
+			id = id<<8 | uint64(ids[g*pr.idBytes+j])
+		}
+		for j := 0; j < 64 && g*64+j < length; j++ {
+			if j > 0 {
+				delta, n := binary.Uvarint(rec)
+				if n <= 0 {
+					return nil, errPgenTruncated
+				}
+				rec = rec[n:]
+				id += delta
+			}
+			if id >= uint64(pr.nsamples) {
+				return nil, fmt.Errorf("difflist sample ID %d out of range", id)
+			}
+			k := g*64 + j
+			pr.geno[id] = (raregeno[k/4] >> (2 * uint(k&3))) & 3
+		}
+	}
+	return rec, nil
+}
+
+// decodePhase decodes the phase track of a variant record into
+// pr.phase.
+func (pr *pgenReader) decodePhase(rec []byte) error {
+	hetct := 0
+	for _, g := range pr.geno {
+		if g == 1 {
+			hetct++
+		}
+	}
+	bit := func(buf []byte, k int) byte { return (buf[k/8] >> uint(k&7)) & 1 }
+	n := (hetct + 8) / 8
+	if len(rec) < n {
+		return errPgenTruncated
+	}
+	// The first bit indicates whether the next hetct bits are
+	// phaseinfo for all hets (0), or a phasepresent bitarray
+	// (1) followed by a byte-aligned phaseinfo bitarray for the
+	// hets whose phase is present.
+	explicit := bit(rec, 0) == 1
+	info := rec
+	infobit := 1
+	if explicit {
+		present := 0
+		for k := 1; k <= hetct; k++ {
+			present += int(bit(rec, k))
+		}
+		info = rec[n:]
+		infobit = 0
+		if len(info) < (present+7)/8 {
+			return errPgenTruncated
+		}
+	}
+	het := 0
+	for i, g := range pr.geno {
+		if g != 1 {
+			continue
+		}
+		het++
+		if explicit && bit(rec, het) == 0 {
+			continue
+		}
+		pr.phase[i] = int8(bit(info, infobit))
+		infobit++
+	}
+	return nil
+}
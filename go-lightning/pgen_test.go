@@ -0,0 +1,136 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type pgenSuite struct{}
+
+var _ = check.Suite(&pgenSuite{})
+
+// writeTestPgen writes a .pgen file with the given 8-bit vrtypes and
+// records.
+func writeTestPgen(c *check.C, fnm string, nsamples int, vrtypes []byte, records [][]byte) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0x6c, 0x1b, 0x10})
+	binary.Write(&buf, binary.LittleEndian, uint32(len(records)))
+	binary.Write(&buf, binary.LittleEndian, uint32(nsamples))
+	buf.WriteByte(0x04) // 8-bit vrtypes, 1-byte record lengths
+	binary.Write(&buf, binary.LittleEndian, uint64(12+8+2*len(records)))
+	buf.Write(vrtypes)
+	for _, rec := range records {
+		buf.WriteByte(byte(len(rec)))
+	}
+	for _, rec := range records {
+		buf.Write(rec)
+	}
+	c.Assert(os.WriteFile(fnm, buf.Bytes(), 0666), check.IsNil)
+}
+
+func (s *pgenSuite) TestLoadAndReconstruct(c *check.C) {
+	tmpdir := c.MkDir()
+	c.Assert(os.WriteFile(tmpdir+"/test.psam", []byte("#FID\tIID\tSEX\nf1\tS1\t1\nf2\tS2\t2\nf3\tS3\tNA\n"), 0666), check.IsNil)
+	c.Assert(os.WriteFile(tmpdir+"/test.pvar", []byte(`##fileformat=VCFv4.2
+#CHROM	POS	ID	REF	ALT
+1	2	v0	C	T
+1	6	v1	C	G
+1	10	v2	C	A
+1	14	v3	CG	C
+1	18	v4	C	T
+1	19	v5	G	<DEL>
+1	20	v6	A	T
+`), 0666), check.IsNil)
+	writeTestPgen(c, tmpdir+"/test.pgen", 3,
+		[]byte{0x10, 4, 2, 1, 5, 6, 6},
+		[][]byte{
+			// raw genotypes: het, hom alt, het; phase
+			// track: S1 1|0, S3 unphased
+			{0x19, 0x03, 0x01},
+			// difflist on hom ref background: S3 hom alt
+			{0x01, 0x02, 0x02},
+			// LD-compressed from v1: S1 missing
+			{0x01, 0x00, 0x03},
+			// 1-bit hom ref/hom alt: S2 hom alt
+			{0x02, 0x02, 0x00},
+			// all hom ref
+			{},
+			// hom alt background, no exceptions
+			{0x00},
+			{0x00},
+		})
+
+	pg, err := loadPgen(tmpdir + "/test.pgen")
+	c.Assert(err, check.IsNil)
+	c.Check(pg.samples, check.DeepEquals, []string{"S1", "S2", "S3"})
+	c.Check(pg.chroms, check.DeepEquals, []string{"1"})
+	c.Check(pg.variants[5].alt, check.IsNil)
+
+	refseqs := []refSeq{
+		{name: "chr1", seq: []byte("acgtacgtacgtacgtacgt")},
+		{name: "chr2", seq: []byte("ggggcccc")},
+	}
+	for _, trial := range []struct {
+		sample, phase int
+		expect        string
+	}{
+		{0, 0, "atgtacgtangtacgtacgt"},
+		{0, 1, "acgtacgtangtacgtacgt"},
+		{1, 0, "atgtacgtacgtactacgt"},
+		{1, 1, "atgtacgtacgtactacgt"},
+		{2, 0, "angtaggtaagtacgtacgt"},
+		{2, 1, "angtaggtaagtacgtacgt"},
+	} {
+		var buf bytes.Buffer
+		skipped, err := pg.writeHaplotypeFasta(&buf, refseqs, trial.sample, trial.phase)
+		c.Assert(err, check.IsNil)
+		c.Check(skipped, check.Equals, 1, check.Commentf("%+v", trial)) // v6 REF does not match
+		c.Check(buf.String(), check.Equals, ">chr1\n"+trial.expect+"\n>chr2\nggggcccc\n", check.Commentf("%+v", trial))
+	}
+}
+
+func (s *pgenSuite) TestErrors(c *check.C) {
+	tmpdir := c.MkDir()
+	c.Assert(os.WriteFile(tmpdir+"/test.psam", []byte("#IID\nS1\n"), 0666), check.IsNil)
+	c.Assert(os.WriteFile(tmpdir+"/test.pvar", []byte("#CHROM\tPOS\tID\tREF\tALT\n1\t2\tv0\tC\tT\n1\t1\tv1\tA\tG\n"), 0666), check.IsNil)
+	_, err := loadPgen(tmpdir + "/test.pgen")
+	c.Check(err, check.ErrorMatches, `.*not sorted by position.*`)
+
+	c.Assert(os.WriteFile(tmpdir+"/test.pvar", []byte("#CHROM\tPOS\tID\tREF\tALT\n1\t2\tv0\tC\tT,G\n"), 0666), check.IsNil)
+	writeTestPgen(c, tmpdir+"/test.pgen", 1, []byte{0x08}, [][]byte{{0x02, 0x00}})
+	_, err = loadPgen(tmpdir + "/test.pgen")
+	c.Check(err, check.ErrorMatches, `.*multiallelic hardcalls are not supported`)
+
+	writeTestPgen(c, tmpdir+"/test.pgen", 2, []byte{0}, [][]byte{{0}})
+	_, err = loadPgen(tmpdir + "/test.pgen")
+	c.Check(err, check.ErrorMatches, `.*pgen has 2 samples but psam has 1`)
+}
+
+func (s *pgenSuite) TestReadBimFam(c *check.C) {
+	tmpdir := c.MkDir()
+	c.Assert(os.WriteFile(tmpdir+"/test.psam", []byte("fam1 S1 0 0 1 -9\nfam1 S2 0 0 2 -9\n"), 0666), check.IsNil)
+	samples, err := readPsam(tmpdir + "/test.psam")
+	c.Assert(err, check.IsNil)
+	c.Check(samples, check.DeepEquals, []string{"S1", "S2"})
+
+	c.Assert(os.WriteFile(tmpdir+"/test.pvar", []byte(strings.Join([]string{
+		"chr1\tv0\t0\t5\tT\tC",
+		"chr2\tv1\t0\t3\tA\tGG",
+		"",
+	}, "\n")), 0666), check.IsNil)
+	variants, chroms, err := readPvar(tmpdir + "/test.pvar")
+	c.Assert(err, check.IsNil)
+	c.Check(chroms, check.DeepEquals, []string{"chr1", "chr2"})
+	c.Check(variants, check.DeepEquals, []pgenVariant{
+		{chrom: 0, pos: 5, ref: []byte("c"), alt: []byte("t")},
+		{chrom: 1, pos: 3, ref: []byte("gg"), alt: []byte("a")},
+	})
+}
@@ -0,0 +1,309 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"sort"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	log "github.com/sirupsen/logrus"
+)
+
+// phasingcmd compares the phasing of each sample against a truth
+// genome (e.g., a trio-phased or long-read-phased copy of the same
+// individual) and reports switch errors between adjacent
+// heterozygous tags.
+type phasingcmd struct {
+	refname string
+}
+
+// phasingStats summarizes the comparison of one sample against its
+// truth genome on one chromosome (or all chromosomes, if Chromosome
+// is "*").
+type phasingStats struct {
+	Sample     string
+	Truth      string
+	Chromosome string
+	// heterozygous tags where sample and truth have the same
+	// pair of tile variants
+	Compared int
+	// heterozygous tags (in truth) where sample has a different
+	// pair of tile variants
+	Mismatched int
+	// number of times the sample's haplotype assignment
+	// (relative to truth) changes between adjacent compared
+	// tags
+	Switches int
+}
+
+func (ps phasingStats) switchRate() float64 {
+	if ps.Compared < 2 {
+		return 0
+	}
+	return float64(ps.Switches) / float64(ps.Compared-1)
+}
+
+func (cmd *phasingcmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
+	inputDir := flags.String("input-dir", "./in", "input `directory`")
+	outputDir := flags.String("output-dir", "./out", "output `directory`")
+	pairsFile := flags.String("pairs", "", "`file` listing sample and truth genome names, separated by whitespace, one pair per line")
+	flags.StringVar(&cmd.refname, "ref", "", "name of reference `sequence` that determines tag order on each chromosome (default: the only reference in the input library, if any)")
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	} else if *pairsFile == "" {
+		err = errors.New("cannot compare without -pairs argument")
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		runner := arvadosContainerRunner{
+			Name:        "lightning phasing-stats",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         120000000000,
+			VCPUs:       16,
+			Priority:    *priority,
+			KeepCache:   2,
+			APIAccess:   true,
+		}
+		containerOpts.Apply(&runner, stdout)
+		err = runner.TranslatePaths(inputDir, pairsFile)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"phasing-stats", "-local=true",
+			"-pprof", ":6060",
+			"-input-dir", *inputDir,
+			"-output-dir", "/mnt/output",
+			"-pairs", *pairsFile,
+			"-ref", cmd.refname,
+		}
+		var output string
+		output, err = runner.Run()
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output+"/phasing-stats.csv")
+		return 0
+	}
+
+	pairs, err := readSamplePairs(*pairsFile)
+	if err != nil {
+		return 1
+	}
+	tilelib := &tileLibrary{
+		retainNoCalls:  true,
+		compactGenomes: map[string][]tileVariantID{},
+	}
+	err = tilelib.LoadDir(context.Background(), *inputDir)
+	if err != nil {
+		return 1
+	}
+	chroms, err := cmd.tagOrder(tilelib)
+	if err != nil {
+		return 1
+	}
+	lookup := genomeLookup(tilelib.compactGenomes)
+	var allstats []phasingStats
+	for _, pair := range pairs {
+		var sample, truth []tileVariantID
+		sample, err = lookup(pair[0])
+		if err != nil {
+			return 1
+		}
+		truth, err = lookup(pair[1])
+		if err != nil {
+			return 1
+		}
+		total := phasingStats{Sample: pair[0], Truth: pair[1], Chromosome: "*"}
+		for _, chrom := range chroms {
+			ps := comparePhasing(sample, truth, chrom.tags)
+			ps.Sample, ps.Truth, ps.Chromosome = pair[0], pair[1], chrom.name
+			allstats = append(allstats, ps)
+			total.Compared += ps.Compared
+			total.Mismatched += ps.Mismatched
+			total.Switches += ps.Switches
+		}
+		log.Infof("%s vs. %s: %d heterozygous tags compared, %d mismatched, %d switches (rate %g)", pair[0], pair[1], total.Compared, total.Mismatched, total.Switches, total.switchRate())
+		allstats = append(allstats, total)
+	}
+	err = writePhasingStats(*outputDir+"/phasing-stats.csv", allstats)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+type tagPath struct {
+	name string
+	tags []tagID
+}
+
+// tagOrder returns the order of tags on each chromosome of the
+// reference. If the library has no reference, it returns all tags in
+// numeric order, as a single path named "*".
+func (cmd *phasingcmd) tagOrder(tilelib *tileLibrary) ([]tagPath, error) {
+	if len(tilelib.refseqs) == 0 {
+		log.Warn("library has no reference sequences, comparing all tags in numeric order")
+		path := tagPath{name: "*", tags: make([]tagID, len(tilelib.variant))}
+		for i := range path.tags {
+			path.tags[i] = tagID(i)
+		}
+		return []tagPath{path}, nil
+	}
+	refseq := tilelib.refseqs[cmd.refname]
+	if cmd.refname == "" && len(tilelib.refseqs) == 1 {
+		for _, rs := range tilelib.refseqs {
+			refseq = rs
+		}
+	}
+	if refseq == nil {
+		var refnames []string
+		for name := range tilelib.refseqs {
+			refnames = append(refnames, name)
+		}
+		sort.Strings(refnames)
+		return nil, fmt.Errorf("reference %q not found in library (choices are %q)", cmd.refname, refnames)
+	}
+	var seqnames []string
+	for seqname := range refseq {
+		seqnames = append(seqnames, seqname)
+	}
+	sort.Strings(seqnames)
+	var paths []tagPath
+	for _, seqname := range seqnames {
+		path := tagPath{name: seqname}
+		for _, libref := range refseq[seqname] {
+			path.tags = append(path.tags, libref.Tag)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// comparePhasing compares sample against truth at the given tags, in
+// the given order. Tags where either genome has a missing tile, or
+// truth is homozygous, are skipped.
+func comparePhasing(sample, truth []tileVariantID, tags []tagID) phasingStats {
+	var ps phasingStats
+	var prevSameOrder bool
+	for _, tag := range tags {
+		i := int(tag) * 2
+		if i+1 >= len(sample) || i+1 >= len(truth) {
+			continue
+		}
+		s0, s1, t0, t1 := sample[i], sample[i+1], truth[i], truth[i+1]
+		if s0 == 0 || s1 == 0 || t0 == 0 || t1 == 0 || t0 == t1 {
+			continue
+		}
+		sameOrder := s0 == t0 && s1 == t1
+		if !sameOrder && !(s0 == t1 && s1 == t0) {
+			ps.Mismatched++
+			continue
+		}
+		if ps.Compared > 0 && sameOrder != prevSameOrder {
+			ps.Switches++
+		}
+		prevSameOrder = sameOrder
+		ps.Compared++
+	}
+	return ps
+}
+
+// readSamplePairs reads whitespace-separated pairs of sample names,
+// one pair per line. Blank lines and lines starting with "#" are
+// ignored.
+func readSamplePairs(fnm string) ([][2]string, error) {
+	f, err := open(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var pairs [][2]string
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: line %d: expected 2 fields, found %d", fnm, lineno, len(fields))
+		}
+		pairs = append(pairs, [2]string{fields[0], fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("%s: no sample pairs found", fnm)
+	}
+	return pairs, nil
+}
+
+func writePhasingStats(fnm string, allstats []phasingStats) error {
+	log.Infof("writing %s", fnm)
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"Sample", "Truth", "Chromosome", "Compared", "Mismatched", "Switches", "SwitchRate"})
+	for _, ps := range allstats {
+		w.Write([]string{ps.Sample, ps.Truth, ps.Chromosome,
+			fmt.Sprintf("%d", ps.Compared),
+			fmt.Sprintf("%d", ps.Mismatched),
+			fmt.Sprintf("%d", ps.Switches),
+			fmt.Sprintf("%g", ps.switchRate()),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
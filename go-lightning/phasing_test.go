@@ -0,0 +1,45 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"gopkg.in/check.v1"
+)
+
+type phasingSuite struct{}
+
+var _ = check.Suite(&phasingSuite{})
+
+func (s *phasingSuite) TestComparePhasing(c *check.C) {
+	truth := []tileVariantID{
+		1, 2, // tag 0: het
+		1, 1, // tag 1: hom (skipped)
+		3, 1, // tag 2: het
+		2, 1, // tag 3: het
+		1, 2, // tag 4: het
+		1, 2, // tag 5: het
+		1, 2, // tag 6: het
+	}
+	sample := []tileVariantID{
+		1, 2, // same order
+		1, 1,
+		3, 1, // same order
+		1, 2, // switch
+		2, 3, // mismatch
+		0, 2, // missing (skipped)
+		1, 2, // switch
+	}
+	ps := comparePhasing(sample, truth, []tagID{0, 1, 2, 3, 4, 5, 6})
+	c.Check(ps, check.DeepEquals, phasingStats{Compared: 4, Mismatched: 1, Switches: 2})
+	c.Check(ps.switchRate(), check.Equals, 2.0/3.0)
+
+	// tag order comes from the reference path
+	ps = comparePhasing(sample, truth, []tagID{3, 0, 2})
+	c.Check(ps, check.DeepEquals, phasingStats{Compared: 3, Switches: 1})
+
+	ps = comparePhasing(truth, truth, []tagID{0, 1, 2, 3, 4, 5, 6})
+	c.Check(ps, check.DeepEquals, phasingStats{Compared: 6})
+	c.Check(ps.switchRate(), check.Equals, 0.0)
+}
@@ -171,6 +171,18 @@ chr2 472 572 7 1000 . 496 572
 6,6,e36dce85efbef,chr2:g.472G>A
 6,6,f81388b184f4a,chr2:g.469_471del
 `))
+
+	annotateout.Reset()
+	code = (&annotatecmd{}).RunCommand("lightning annotate", []string{"-local", "-format=v2", "-i", tmpdir + "/merged/library.gob"}, bytes.NewReader(nil), annotateout, os.Stderr)
+	c.Check(code, check.Equals, 0)
+	lines := strings.Split(strings.TrimSuffix(annotateout.String(), "\n"), "\n")
+	c.Assert(len(lines) > 2, check.Equals, true)
+	c.Check(lines[0], check.Equals, annotationVersionLine)
+	c.Check(lines[1], check.Equals, "tag,outcol,variant,hgvs,chrom,pos,ref,alt,left")
+	c.Check(sortLines(strings.Join(lines[2:], "\n")), check.Matches, `(?ms).*\n4,4,\d+,chr2:g.291C>A,chr2,291,C,A,\n.*`)
+	for _, line := range lines[2:] {
+		c.Check(strings.Split(line, ","), check.HasLen, len(annotationColumns), check.Commentf("%q", line))
+	}
 }
 
 func sortLines(txt string) string {
@@ -0,0 +1,356 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.arvados.org/arvados.git/lib/cmd"
+)
+
+// plancmd checks the flags of each step in a multi-step plan (one
+// lightning command per line) without running any of the steps, and
+// reports all of the problems it finds.
+type plancmd struct {
+	checkFiles    bool
+	contigAliases contigAliasOptions
+}
+
+type planStep struct {
+	lineno  int
+	command string
+	flags   *flag.FlagSet // nil if the command could not be inspected
+}
+
+// plannedStep is passed as a command's stderr by inspectFlags. When
+// parseFlags sees it as the flag set's output, it stores the parsed
+// flags in it and returns errPlanned, so the command exits without
+// doing anything.
+type plannedStep struct {
+	flags *flag.FlagSet
+	err   error
+}
+
+// Write discards the command's error messages.
+func (*plannedStep) Write(p []byte) (int, error) { return len(p), nil }
+
+// inspectFlags runs the given command handler with a plannedStep as
+// stderr, and returns the plannedStep. If the handler doesn't parse
+// its flags with parseFlags, the returned flags are nil.
+func inspectFlags(h cmd.Handler, prog string, args []string) *plannedStep {
+	planned := &plannedStep{}
+	h.RunCommand(prog, args, nil, ioutil.Discard, planned)
+	return planned
+}
+
+var errPlanned = errors.New("flags parsed for plan, not running command")
+
+// Commands that don't parse their flags with parseFlags, and
+// therefore can't be inspected safely.
+var planUnsupported = map[string]bool{
+	"version":            true,
+	"-version":           true,
+	"--version":          true,
+	"build-docker-image": true,
+	"plan":               true,
+}
+
+// planRules are command-specific checks for combinations of flags
+// that are accepted by the flag parser but would fail (possibly
+// hours) after the command starts.
+var planRules = map[string]func(flags *flag.FlagSet) []string{
+	"slice-numpy": func(flags *flag.FlagSet) []string {
+		if flagValue(flags, "samples") != "" {
+			return nil
+		}
+		var problems []string
+		if p, err := strconv.ParseFloat(flagValue(flags, "chi2-p-value"), 64); err == nil && p != 1 {
+			problems = append(problems, "-chi2-p-value requires -samples")
+		}
+		if flagValue(flags, "case-control-only") == "true" {
+			problems = append(problems, "-case-control-only requires -samples")
+		}
+		if flagValue(flags, "phenotype") != "" {
+			problems = append(problems, "-phenotype requires -samples")
+		}
+		return problems
+	},
+	"export": func(flags *flag.FlagSet) []string {
+		if n, err := strconv.Atoi(flagValue(flags, "samples-per-shard")); err != nil || n <= 0 {
+			return nil
+		}
+		var problems []string
+		if flagValue(flags, "output-format") != "pvcf" {
+			problems = append(problems, "-samples-per-shard requires -output-format=pvcf")
+		}
+		if flagValue(flags, "output-per-chromosome") != "true" {
+			problems = append(problems, "-samples-per-shard requires -output-per-chromosome")
+		}
+		return problems
+	},
+}
+
+// Commands whose -ref flag is a reference fasta file (rather than
+// the name of a reference in a library).
+var planRefFastaCommands = map[string]bool{
+	"import":     true,
+	"vcf2fasta":  true,
+	"ref2genome": true,
+}
+
+func (cmd *plancmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s [options] plan-file\n\nplan-file has one lightning command per line, e.g.:\n\n\timport -ref=hg38.fa.gz -tag-library=tags.fa.gz vcfdir\n\tslice-numpy -regions=genes.bed -samples=samples.csv -chi2-p-value=1e-5\n\nArguments are separated by whitespace (quoting is not supported). Blank lines and lines starting with # are ignored.\n\noptions:\n", prog)
+		flags.PrintDefaults()
+	}
+	flags.BoolVar(&cmd.checkFiles, "check-files", true, "check that input files named by flags exist, and that regions files only refer to chromosomes in the reference")
+	cmd.contigAliases.Flags(flags)
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	err = cmd.contigAliases.Load()
+	if err != nil {
+		return 1
+	}
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return 1
+	}
+	defer f.Close()
+	steps, problems, err := cmd.parse(f)
+	if err != nil {
+		return 1
+	}
+	problems = append(problems, cmd.check(steps)...)
+	for _, problem := range problems {
+		fmt.Fprintln(stdout, problem)
+	}
+	if len(problems) > 0 {
+		err = fmt.Errorf("found %d problems in %d steps", len(problems), len(steps))
+		return 1
+	}
+	fmt.Fprintf(stdout, "OK: %d steps\n", len(steps))
+	return 0
+}
+
+// parse reads the plan and inspects the flags of each step.
+func (cmd *plancmd) parse(rdr io.Reader) ([]planStep, []string, error) {
+	var steps []planStep
+	var problems []string
+	scanner := bufio.NewScanner(rdr)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		words := strings.Fields(scanner.Text())
+		if len(words) > 0 && words[0] == "lightning" {
+			words = words[1:]
+		}
+		if len(words) == 0 || strings.HasPrefix(words[0], "#") {
+			continue
+		}
+		step := planStep{lineno: lineno, command: words[0]}
+		steps = append(steps, step)
+		h, ok := handler[step.command]
+		if !ok {
+			problems = append(problems, step.problem("unknown command"))
+			continue
+		} else if planUnsupported[step.command] {
+			problems = append(problems, step.problem("command cannot be used in a plan"))
+			continue
+		}
+		planned := inspectFlags(h, "lightning "+step.command, words[1:])
+		if planned.flags == nil {
+			problems = append(problems, step.problem("command cannot be used in a plan"))
+			continue
+		} else if planned.err == flag.ErrHelp {
+			problems = append(problems, step.problem("-help flag in plan"))
+			continue
+		} else if planned.err != nil {
+			problems = append(problems, step.problem(planned.err.Error()))
+			continue
+		}
+		steps[len(steps)-1].flags = planned.flags
+	}
+	return steps, problems, scanner.Err()
+}
+
+func (cmd *plancmd) check(steps []planStep) []string {
+	var problems []string
+	refseqs := map[string]bool{}
+	var refs []string
+	for _, step := range steps {
+		if step.flags == nil {
+			continue
+		}
+		if rule := planRules[step.command]; rule != nil {
+			for _, problem := range rule(step.flags) {
+				problems = append(problems, step.problem(problem))
+			}
+		}
+		if !cmd.checkFiles {
+			continue
+		}
+		for _, fnm := range planInputFiles(step.flags) {
+			if _, err := os.Stat(fnm); err != nil {
+				problems = append(problems, step.problem(err.Error()))
+			}
+		}
+		if ref := flagValue(step.flags, "ref"); planRefFastaCommands[step.command] && ref != "" && isLocalFile(ref) {
+			match, err := regexp.Compile(flagValue(step.flags, "match-chromosome"))
+			if err != nil {
+				match = matchAnyChromosome
+			}
+			seqnames, err := fastaSeqNames(ref)
+			if err != nil {
+				problems = append(problems, step.problem(err.Error()))
+				continue
+			}
+			refs = append(refs, ref)
+			for _, seqname := range seqnames {
+				if match.MatchString(seqname) {
+					refseqs[canonicalContig(seqname)] = true
+				}
+			}
+		}
+	}
+	if len(refs) == 0 {
+		return problems
+	}
+	for _, step := range steps {
+		if step.flags == nil {
+			continue
+		}
+		regions := flagValue(step.flags, "regions")
+		if regions == "" || !isLocalFile(regions) || flagValue(step.flags, "invert-regions") == "true" {
+			continue
+		}
+		mask, err := makeMask(regions, 0, regionsFilter{
+			featureTypes: flagValue(step.flags, "regions-feature-type"),
+			attribute:    flagValue(step.flags, "regions-attribute"),
+			combine:      flagValue(step.flags, "regions-combine"),
+		})
+		if err != nil {
+			problems = append(problems, step.problem(fmt.Sprintf("%s: %s", regions, err)))
+			continue
+		}
+		var missing []string
+		for seqname := range mask.intervals {
+			if !refseqs[seqname] {
+				missing = append(missing, seqname)
+			}
+		}
+		sort.Strings(missing)
+		for _, seqname := range missing {
+			problems = append(problems, step.problem(fmt.Sprintf("regions file %s refers to chromosome %q, which is not imported from reference %s", regions, seqname, strings.Join(refs, ", "))))
+		}
+	}
+	return problems
+}
+
+func (step planStep) problem(msg string) string {
+	return fmt.Sprintf("line %d: %s: %s", step.lineno, step.command, msg)
+}
+
+func flagValue(flags *flag.FlagSet, name string) string {
+	f := flags.Lookup(name)
+	if f == nil {
+		return ""
+	}
+	return f.Value.String()
+}
+
+// planInputFiles returns the local input files named by the given
+// flags, i.e., non-empty values of non-output flags whose usage
+// placeholder is "file" or a filename like "samples.csv", or the
+// non-glob entries in flags whose placeholder is "files".
+func planInputFiles(flags *flag.FlagSet) []string {
+	var fnms []string
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "o" || strings.HasPrefix(f.Name, "output") {
+			return
+		}
+		placeholder, _ := flag.UnquoteUsage(f)
+		if placeholder == "files" {
+			// comma-separated list of files and glob
+			// patterns
+			for _, fnm := range strings.Split(f.Value.String(), ",") {
+				if fnm != "" && isLocalFile(fnm) && !strings.ContainsAny(fnm, "*?[") {
+					fnms = append(fnms, fnm)
+				}
+			}
+			return
+		}
+		if placeholder != "file" && !strings.Contains(placeholder, ".") {
+			return
+		}
+		if fnm := f.Value.String(); fnm != "" && isLocalFile(fnm) {
+			fnms = append(fnms, fnm)
+		}
+	})
+	return fnms
+}
+
+// isLocalFile returns false if fnm is "-" (stdin) or refers to an
+// Arvados collection.
+func isLocalFile(fnm string) bool {
+	return fnm != "-" && (os.Getenv("ARVADOS_API_HOST") == "" || !collectionInPathRe.MatchString(fnm))
+}
+
+// fastaSeqNames returns the names of the sequences in the given
+// fasta file, using the samtools index (fnm.fai) if there is one.
+func fastaSeqNames(fnm string) ([]string, error) {
+	var seqnames []string
+	if fai, err := ioutil.ReadFile(fnm + ".fai"); err == nil {
+		for _, line := range bytes.Split(fai, []byte{'\n'}) {
+			if fields := bytes.SplitN(line, []byte{'\t'}, 2); len(fields[0]) > 0 {
+				seqnames = append(seqnames, string(fields[0]))
+			}
+		}
+		return seqnames, nil
+	}
+	f, err := zopen(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1<<20), 1<<26)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) > 0 && line[0] == '>' {
+			if fields := strings.Fields(string(line[1:])); len(fields) > 0 {
+				seqnames = append(seqnames, fields[0])
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	return seqnames, nil
+}
@@ -0,0 +1,96 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"gopkg.in/check.v1"
+)
+
+type planSuite struct{}
+
+var _ = check.Suite(&planSuite{})
+
+func (s *planSuite) TestPlan(c *check.C) {
+	tmpdir := c.MkDir()
+	err := ioutil.WriteFile(tmpdir+"/regions.bed", []byte("chr1\t100\t200\nchr3\t100\t200\n"), 0666)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(tmpdir+"/plan.txt", []byte(`# comment
+lightning import -local=true -ref=testdata/ref.fasta -tag-library=testdata/tags testdata/pipeline1
+
+slice-numpy -regions=`+tmpdir+`/regions.bed -chi2-p-value=0.01 -case-control-only
+export -samples-per-shard=10
+export -no-such-flag
+frobnicate -foo
+dump -regions=`+tmpdir+`/nonexistent.bed
+`), 0666)
+	c.Assert(err, check.IsNil)
+
+	var stdout bytes.Buffer
+	exited := (&plancmd{}).RunCommand("lightning plan", []string{tmpdir + "/plan.txt"}, nil, &stdout, os.Stderr)
+	c.Check(exited, check.Equals, 1)
+	c.Check(stdout.String(), check.Equals, `line 6: export: flag provided but not defined: -no-such-flag
+line 7: frobnicate: unknown command
+line 4: slice-numpy: -chi2-p-value requires -samples
+line 4: slice-numpy: -case-control-only requires -samples
+line 5: export: -samples-per-shard requires -output-format=pvcf
+line 8: dump: stat `+tmpdir+`/nonexistent.bed: no such file or directory
+line 4: slice-numpy: regions file `+tmpdir+`/regions.bed refers to chromosome "3", which is not imported from reference testdata/ref.fasta
+`)
+
+	err = ioutil.WriteFile(tmpdir+"/plan.txt", []byte(`import -ref=testdata/ref.fasta -tag-library=testdata/tags testdata/pipeline1
+slice-numpy -regions=`+tmpdir+`/regions.bed -chi2-p-value=0.01 -case-control-only
+`), 0666)
+	c.Assert(err, check.IsNil)
+	stdout.Reset()
+	exited = (&plancmd{}).RunCommand("lightning plan", []string{"-check-files=false", tmpdir + "/plan.txt"}, nil, &stdout, os.Stderr)
+	c.Check(exited, check.Equals, 1)
+	c.Check(stdout.String(), check.Equals, `line 2: slice-numpy: -chi2-p-value requires -samples
+line 2: slice-numpy: -case-control-only requires -samples
+`)
+
+	err = ioutil.WriteFile(tmpdir+"/regions.bed", []byte("chr1\t100\t200\n"), 0666)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(tmpdir+"/plan.txt", []byte(`import -ref=testdata/ref.fasta -tag-library=testdata/tags testdata/pipeline1
+slice-numpy -regions=`+tmpdir+`/regions.bed
+`), 0666)
+	c.Assert(err, check.IsNil)
+	stdout.Reset()
+	exited = (&plancmd{}).RunCommand("lightning plan", []string{tmpdir + "/plan.txt"}, nil, &stdout, os.Stderr)
+	c.Check(exited, check.Equals, 0)
+	c.Check(stdout.String(), check.Equals, "OK: 2 steps\n")
+}
+
+func (s *planSuite) TestInspectFlagsConcurrently(c *check.C) {
+	var wg sync.WaitGroup
+	planned := make([]*plannedStep, 20)
+	for i := range planned {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i%2 == 0 {
+				planned[i] = inspectFlags(&sliceNumpy{}, "lightning slice-numpy", []string{"-threads=3"})
+			} else {
+				planned[i] = inspectFlags(&exporter{}, "lightning export", []string{"-output-format=pvcf"})
+			}
+		}()
+	}
+	wg.Wait()
+	for i, p := range planned {
+		c.Assert(p.flags, check.NotNil)
+		c.Check(p.err, check.IsNil)
+		if i%2 == 0 {
+			c.Check(flagValue(p.flags, "threads"), check.Equals, "3")
+			c.Check(p.flags.Lookup("output-format"), check.IsNil)
+		} else {
+			c.Check(flagValue(p.flags, "output-format"), check.Equals, "pvcf")
+		}
+	}
+}
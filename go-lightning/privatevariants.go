@@ -0,0 +1,275 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/arvados/lightning/go-lightning/hgvs"
+	log "github.com/sirupsen/logrus"
+)
+
+// privateVariants finds tile variants that occur in a given group of
+// samples, and not in any other sample.
+type privateVariants struct {
+	matchGroup     *regexp.Regexp
+	includeNoCalls bool
+	maxTileSize    int
+}
+
+type privateVariant struct {
+	tileLibRef
+	samples     []string // samples in the group that have this variant
+	annotations []string // e.g., "chr1:g.123A>T"
+}
+
+func (cmd *privateVariants) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
+	inputDir := flags.String("input-dir", "./in", "input `directory`")
+	outputDir := flags.String("output-dir", "./out", "output `directory`")
+	matchGroup := flags.String("match-group", "", "report variants private to the samples whose names match `regexp`")
+	flags.BoolVar(&cmd.includeNoCalls, "include-no-calls", false, "report tile variants that contain no-calls")
+	flags.IntVar(&cmd.maxTileSize, "max-tile-size", 50000, "don't try to make annotations for tiles bigger than given `size`")
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	} else if *matchGroup == "" {
+		err = errors.New("-match-group argument is required")
+		return 2
+	}
+	cmd.matchGroup, err = regexp.Compile(*matchGroup)
+	if err != nil {
+		err = fmt.Errorf("-match-group: %w", err)
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		runner := arvadosContainerRunner{
+			Name:        "lightning private-variants",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         240000000000,
+			VCPUs:       32,
+			Priority:    *priority,
+			KeepCache:   2,
+			APIAccess:   true,
+		}
+		containerOpts.Apply(&runner, stdout)
+		err = runner.TranslatePaths(inputDir)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"private-variants", "-local=true",
+			"-pprof", ":6060",
+			"-input-dir", *inputDir,
+			"-output-dir", "/mnt/output",
+			"-match-group", *matchGroup,
+			"-include-no-calls=" + fmt.Sprintf("%v", cmd.includeNoCalls),
+			"-max-tile-size", fmt.Sprintf("%d", cmd.maxTileSize),
+		}
+		var output string
+		output, err = runner.Run()
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output+"/private-variants.csv")
+		return 0
+	}
+
+	tilelib := &tileLibrary{
+		retainNoCalls:       true,
+		retainTileSequences: true,
+		compactGenomes:      map[string][]tileVariantID{},
+	}
+	err = tilelib.LoadDir(context.Background(), *inputDir)
+	if err != nil {
+		return 1
+	}
+	pvs, err := cmd.find(tilelib)
+	if err != nil {
+		return 1
+	}
+	err = cmd.annotate(tilelib, pvs)
+	if err != nil {
+		return 1
+	}
+	err = writePrivateVariants(*outputDir+"/private-variants.csv", pvs)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// find returns the tile variants that are present in at least one
+// sample in the group and absent from all other samples, sorted by
+// tag and variant.
+func (cmd *privateVariants) find(tilelib *tileLibrary) ([]*privateVariant, error) {
+	var group, others []string
+	for name := range tilelib.compactGenomes {
+		if cmd.matchGroup.MatchString(name) {
+			group = append(group, name)
+		} else {
+			others = append(others, name)
+		}
+	}
+	if len(group) == 0 {
+		return nil, fmt.Errorf("no samples match %q", cmd.matchGroup)
+	}
+	sort.Strings(group)
+	log.Infof("finding variants private to %d samples (%d other samples)", len(group), len(others))
+
+	found := map[tileLibRef]*privateVariant{}
+	for _, name := range group {
+		for i, v := range tilelib.compactGenomes[name] {
+			if v == 0 {
+				continue
+			}
+			libref := tileLibRef{Tag: tagID(i / 2), Variant: v}
+			pv := found[libref]
+			if pv == nil {
+				pv = &privateVariant{tileLibRef: libref}
+				found[libref] = pv
+			}
+			if len(pv.samples) == 0 || pv.samples[len(pv.samples)-1] != name {
+				pv.samples = append(pv.samples, name)
+			}
+		}
+	}
+	for _, name := range others {
+		for i, v := range tilelib.compactGenomes[name] {
+			if v != 0 {
+				delete(found, tileLibRef{Tag: tagID(i / 2), Variant: v})
+			}
+		}
+	}
+	var pvs []*privateVariant
+	for libref, pv := range found {
+		if !cmd.includeNoCalls {
+			seq := tilelib.TileVariantSequence(libref)
+			if len(seq) == 0 || countBases(seq) != len(seq) {
+				continue
+			}
+		}
+		pvs = append(pvs, pv)
+	}
+	sort.Slice(pvs, func(i, j int) bool {
+		if pvs[i].Tag != pvs[j].Tag {
+			return pvs[i].Tag < pvs[j].Tag
+		}
+		return pvs[i].Variant < pvs[j].Variant
+	})
+	log.Infof("found %d private tile variants", len(pvs))
+	return pvs, nil
+}
+
+// annotate fills in the hgvs annotations of the given variants, using
+// the reference sequences in tilelib.
+func (cmd *privateVariants) annotate(tilelib *tileLibrary, pvs []*privateVariant) error {
+	if len(tilelib.refseqs) == 0 {
+		log.Warn("library has no reference sequences, not annotating")
+		return nil
+	}
+	lookup := make(map[tileLibRef]*privateVariant, len(pvs))
+	dropTiles := make([]bool, len(tilelib.variant))
+	for i := range dropTiles {
+		dropTiles[i] = true
+	}
+	for _, pv := range pvs {
+		lookup[pv.tileLibRef] = pv
+		dropTiles[pv.Tag] = false
+	}
+	var mtx sync.Mutex
+	err := (&annotatecmd{
+		maxTileSize: cmd.maxTileSize,
+		dropTiles:   dropTiles,
+		reportAnnotation: func(tag tagID, _ int, variant tileVariantID, refname string, seqname string, pdi hgvs.Variant) {
+			pv := lookup[tileLibRef{Tag: tag, Variant: variant}]
+			if pv == nil {
+				return
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			pv.annotations = append(pv.annotations, seqname+":g."+pdi.String())
+		},
+	}).exportTileDiffs(ioutil.Discard, tilelib)
+	if err != nil {
+		return err
+	}
+	for _, pv := range pvs {
+		sort.Strings(pv.annotations)
+	}
+	return nil
+}
+
+func writePrivateVariants(fnm string, pvs []*privateVariant) error {
+	log.Infof("writing %s", fnm)
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriter(f)
+	w := csv.NewWriter(bufw)
+	w.Write([]string{"Tag", "Variant", "Samples", "Annotations"})
+	for _, pv := range pvs {
+		w.Write([]string{
+			fmt.Sprintf("%d", pv.Tag),
+			fmt.Sprintf("%d", pv.Variant),
+			strings.Join(pv.samples, " "),
+			strings.Join(pv.annotations, " "),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	if err := bufw.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,58 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type privateVariantsSuite struct{}
+
+var _ = check.Suite(&privateVariantsSuite{})
+
+func (s *privateVariantsSuite) TestPrivateVariants(c *check.C) {
+	tmpdir := c.MkDir()
+	exited := (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-output-tiles",
+		"-save-incomplete-tiles",
+		"-o", tmpdir + "/library.gob",
+		"testdata/ref.fasta",
+		"testdata/pipeline1",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	exited = (&privateVariants{}).RunCommand("private-variants", []string{
+		"-local=true",
+		"-input-dir=" + tmpdir + "/library.gob",
+		"-output-dir=" + tmpdir,
+		"-match-group=input1",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	buf, err := ioutil.ReadFile(tmpdir + "/private-variants.csv")
+	c.Assert(err, check.IsNil)
+	c.Logf("%s", buf)
+	lines := strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+	c.Check(lines[0], check.Equals, "Tag,Variant,Samples,Annotations")
+	c.Check(len(lines) > 1, check.Equals, true)
+	for _, line := range lines[1:] {
+		c.Check(line, check.Matches, `\d+,\d+,testdata/pipeline1/input1\.1\.fasta,.*`)
+	}
+	c.Check(string(buf), check.Matches, `(?ms).*chr1:g\.41T>A.*`)
+	c.Check(string(buf), check.Not(check.Matches), `(?ms).*input2.*`)
+
+	exited = (&privateVariants{}).RunCommand("private-variants", []string{
+		"-local=true",
+		"-input-dir=" + tmpdir + "/library.gob",
+		"-output-dir=" + tmpdir,
+		"-match-group=nonexistent",
+	}, nil, os.Stderr, os.Stderr)
+	c.Check(exited, check.Equals, 1)
+}
@@ -0,0 +1,122 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-isatty"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// If progressTTY is non-nil, progress reports are drawn
+	// there as a single line that is updated in place, instead
+	// of being logged.
+	progressTTY io.Writer = ttyOrNil(os.Stderr)
+
+	progressLogInterval = time.Minute
+	progressTTYInterval = time.Second / 4
+)
+
+func ttyOrNil(f *os.File) io.Writer {
+	if os.Getenv("LIGHTNING_PROGRESS") != "log" && isatty.IsTerminal(f.Fd()) {
+		return f
+	}
+	return nil
+}
+
+// progress reports the progress of a long-running loop (items done,
+// rate, and estimated time remaining). It is safe to call Add from
+// multiple goroutines.
+type progress struct {
+	label    string
+	total    int64
+	done     int64
+	start    time.Time
+	now      func() time.Time
+	tty      io.Writer
+	interval time.Duration
+
+	mtx        sync.Mutex
+	lastReport time.Time
+}
+
+// newProgress returns a progress reporter for a loop that will
+// process total items.
+func newProgress(label string, total int) *progress {
+	p := &progress{
+		label:    label,
+		total:    int64(total),
+		now:      time.Now,
+		tty:      progressTTY,
+		interval: progressLogInterval,
+	}
+	if p.tty != nil {
+		p.interval = progressTTYInterval
+	}
+	p.start = p.now()
+	p.lastReport = p.start
+	return p
+}
+
+// Add records that n more items are done, and reports progress if
+// enough time has passed since the last report.
+func (p *progress) Add(n int) {
+	done := atomic.AddInt64(&p.done, int64(n))
+	now := p.now()
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if now.Sub(p.lastReport) < p.interval {
+		return
+	}
+	p.lastReport = now
+	p.report(p.status(done, now))
+}
+
+// Done reports the final count and elapsed time.
+func (p *progress) Done() {
+	now := p.now()
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	done := atomic.LoadInt64(&p.done)
+	elapsed := now.Sub(p.start)
+	msg := fmt.Sprintf("%s: %d/%d done in %v", p.label, done, p.total, elapsed.Round(time.Second))
+	if p.tty != nil {
+		fmt.Fprintf(p.tty, "\r%s\x1b[K\n", msg)
+	} else {
+		log.Print(msg)
+	}
+}
+
+func (p *progress) report(msg string) {
+	if p.tty != nil {
+		fmt.Fprintf(p.tty, "\r%s\x1b[K", msg)
+	} else {
+		log.Print(msg)
+	}
+}
+
+func (p *progress) status(done int64, now time.Time) string {
+	elapsed := now.Sub(p.start)
+	msg := fmt.Sprintf("%s: %d/%d", p.label, done, p.total)
+	if p.total > 0 {
+		msg += fmt.Sprintf(" (%.0f%%)", float64(done)*100/float64(p.total))
+	}
+	if done == 0 || elapsed <= 0 {
+		return msg + ", ETA N/A"
+	}
+	msg += fmt.Sprintf(", %.3g/s", float64(done)/elapsed.Seconds())
+	if done >= p.total {
+		return msg
+	}
+	ttl := time.Duration(float64(elapsed) * float64(p.total-done) / float64(done))
+	return msg + fmt.Sprintf(", ETA %v (%v)", now.Add(ttl).Format(time.RFC3339), ttl.Round(time.Second))
+}
@@ -0,0 +1,50 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type progressSuite struct{}
+
+var _ = check.Suite(&progressSuite{})
+
+func (s *progressSuite) TestStatus(c *check.C) {
+	t0 := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := &progress{label: "test", total: 100, start: t0}
+	c.Check(p.status(0, t0.Add(time.Second)), check.Equals, "test: 0/100 (0%), ETA N/A")
+	c.Check(p.status(25, t0.Add(10*time.Second)), check.Equals, "test: 25/100 (25%), 2.5/s, ETA 2022-01-01T00:00:40Z (30s)")
+	c.Check(p.status(100, t0.Add(20*time.Second)), check.Equals, "test: 100/100 (100%), 5/s")
+}
+
+func (s *progressSuite) TestTTY(c *check.C) {
+	t0 := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := t0
+	var buf bytes.Buffer
+	p := &progress{
+		label:      "test",
+		total:      4,
+		start:      t0,
+		lastReport: t0,
+		now:        func() time.Time { return now },
+		tty:        &buf,
+		interval:   time.Second,
+	}
+	now = now.Add(time.Second / 2)
+	p.Add(1) // too soon to report
+	c.Check(buf.String(), check.Equals, "")
+	now = now.Add(time.Second / 2)
+	p.Add(1)
+	c.Check(buf.String(), check.Equals, "\rtest: 2/4 (50%), 2/s, ETA 2022-01-01T00:00:02Z (1s)\x1b[K")
+	buf.Reset()
+	now = now.Add(time.Second)
+	p.Add(2)
+	p.Done()
+	c.Check(buf.String(), check.Equals, "\rtest: 4/4 (100%), 2/s\x1b[K\rtest: 4/4 done in 2s\x1b[K\n")
+}
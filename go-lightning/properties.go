@@ -0,0 +1,141 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	log "github.com/sirupsen/logrus"
+)
+
+type arvadosPropertiesItem struct {
+	UUID       string                 `json:"uuid"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// loadArvadosProperties returns the properties of the Arvados
+// objects identified by the given comma-separated UUIDs, converted to
+// strings (see flattenProperties).
+//
+// A collection or container request UUID yields the properties of
+// that object. A project UUID yields the properties of every
+// collection and container request in that project.
+func loadArvadosProperties(client *arvados.Client, uuids string) ([]map[string]string, error) {
+	var records []map[string]string
+	for _, uuid := range strings.Split(uuids, ",") {
+		uuid = strings.TrimSpace(uuid)
+		if uuid == "" {
+			continue
+		}
+		var items []arvadosPropertiesItem
+		switch {
+		case strings.Contains(uuid, "-j7d0g-"):
+			for _, path := range []string{"arvados/v1/collections", "arvados/v1/container_requests"} {
+				more, err := listArvadosProperties(client, path, uuid)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, more...)
+			}
+		case strings.Contains(uuid, "-4zz18-"), strings.Contains(uuid, "-xvhdp-"):
+			path := "arvados/v1/collections/" + uuid
+			if strings.Contains(uuid, "-xvhdp-") {
+				path = "arvados/v1/container_requests/" + uuid
+			}
+			var item arvadosPropertiesItem
+			err := client.RequestAndDecode(&item, "GET", path, nil, arvados.GetOptions{Select: []string{"uuid", "properties"}})
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		default:
+			return nil, fmt.Errorf("cannot load properties from %q: not a project, collection, or container request UUID", uuid)
+		}
+		for _, item := range items {
+			records = append(records, flattenProperties(item.Properties))
+		}
+		log.Infof("loaded properties of %d objects from %s", len(items), uuid)
+	}
+	return records, nil
+}
+
+// listArvadosProperties returns the UUIDs and properties of all
+// items of the given type that are owned by the given project.
+func listArvadosProperties(client *arvados.Client, path, projectUUID string) ([]arvadosPropertiesItem, error) {
+	var items []arvadosPropertiesItem
+	for {
+		var page struct {
+			Items []arvadosPropertiesItem `json:"items"`
+		}
+		err := client.RequestAndDecode(&page, "GET", path, nil, arvados.ListOptions{
+			Select:  []string{"uuid", "properties"},
+			Filters: []arvados.Filter{{Attr: "owner_uuid", Operator: "=", Operand: projectUUID}},
+			Order:   []string{"uuid"},
+			Offset:  int64(len(items)),
+			Limit:   1000,
+			Count:   "none",
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Items) == 0 {
+			return items, nil
+		}
+		items = append(items, page.Items...)
+	}
+}
+
+// flattenProperties converts property values to strings. Numbers are
+// formatted without trailing zeroes, true and false become "1" and
+// "0" (so they can be used as case/control values), and other
+// non-string values are JSON-encoded. Null values are omitted.
+func flattenProperties(props map[string]interface{}) map[string]string {
+	flat := make(map[string]string, len(props))
+	for k, v := range props {
+		switch v := v.(type) {
+		case nil:
+		case string:
+			flat[k] = v
+		case float64:
+			flat[k] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			if v {
+				flat[k] = "1"
+			} else {
+				flat[k] = "0"
+			}
+		default:
+			buf, err := json.Marshal(v)
+			if err == nil {
+				flat[k] = string(buf)
+			}
+		}
+	}
+	return flat
+}
+
+// propertyTable returns the given property records as rows of a
+// table with a header row: the first column is idProp and the
+// remaining columns are cols. Records without a non-empty idProp are
+// skipped.
+func propertyTable(records []map[string]string, idProp string, cols []string) [][]string {
+	rows := [][]string{append([]string{idProp}, cols...)}
+	for _, rec := range records {
+		id := rec[idProp]
+		if id == "" {
+			continue
+		}
+		row := []string{id}
+		for _, col := range cols {
+			row = append(row, rec[col])
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
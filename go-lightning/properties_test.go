@@ -0,0 +1,66 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"gopkg.in/check.v1"
+)
+
+type propertiesSuite struct{}
+
+var _ = check.Suite(&propertiesSuite{})
+
+func (s *propertiesSuite) TestFlattenProperties(c *check.C) {
+	c.Check(flattenProperties(map[string]interface{}{
+		"s":    "foo",
+		"i":    float64(3),
+		"f":    0.25,
+		"t":    true,
+		"n":    nil,
+		"list": []interface{}{"a", float64(1)},
+	}), check.DeepEquals, map[string]string{
+		"s":    "foo",
+		"i":    "3",
+		"f":    "0.25",
+		"t":    "1",
+		"list": `["a",1]`,
+	})
+}
+
+func (s *propertiesSuite) TestPropertyTable(c *check.C) {
+	rows := propertyTable([]map[string]string{
+		{"sample_id": "s1", "cc": "1", "other": "x"},
+		{"cc": "0"},
+		{"sample_id": "s2"},
+	}, "sample_id", []string{"cc"})
+	c.Check(rows, check.DeepEquals, [][]string{
+		{"sample_id", "cc"},
+		{"s1", "1"},
+		{"s2", ""},
+	})
+}
+
+func (s *propertiesSuite) TestSampleInfoFromProperties(c *check.C) {
+	cgnames := []string{"pipeline1/input1.1.fasta", "pipeline1/input2.1.fasta", "pipeline1/input3.1.fasta", "pipeline1/input4.1.fasta"}
+	records := []map[string]string{
+		{"sample_id": "input1", "case_control": "1", "training_validation": "1", "bmi": "30"},
+		{"sample_id": "input2", "case_control": "0", "training_validation": "0"},
+		{"sample_id": "input3", "case_control": "1"},
+	}
+	si, err := sampleInfoFromProperties(cgnames, records, "sample_id", "case_control", "training_validation", []string{"bmi"})
+	c.Assert(err, check.IsNil)
+	c.Check(si, check.DeepEquals, []sampleInfo{
+		{id: "input1", isCase: true, isTraining: true, phenotypes: map[string]string{"bmi": "30"}},
+		{id: "input2", isControl: true, isValidation: true},
+		{id: "input3", isCase: true, isTraining: true},
+		{id: "input4"},
+	})
+
+	_, err = sampleInfoFromProperties(cgnames, append(records, records[0]), "sample_id", "case_control", "training_validation", nil)
+	c.Check(err, check.ErrorMatches, `multiple objects have sample_id="input1"`)
+
+	_, err = sampleInfoFromProperties(cgnames, records, "sample", "case_control", "training_validation", nil)
+	c.Check(err, check.ErrorMatches, `no objects have a sample property .*`)
+}
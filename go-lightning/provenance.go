@@ -0,0 +1,64 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"time"
+)
+
+// tileVariantSource identifies the input (genome or reference file)
+// in which a tile variant was first seen, and when.
+type tileVariantSource struct {
+	Source string
+	Time   int64 // unix timestamp (seconds)
+}
+
+// earlierThan returns true if src should replace other as the
+// provenance of a tile variant.
+func (src tileVariantSource) earlierThan(other tileVariantSource) bool {
+	if src.Source == "" {
+		return false
+	}
+	return other.Source == "" || (src.Time != 0 && (other.Time == 0 || src.Time < other.Time))
+}
+
+// csvFields returns the source and time, suitable for appending to a
+// CSV row. Unknown values are empty.
+func (src tileVariantSource) csvFields() string {
+	if src.Source == "" {
+		return ","
+	}
+	ts := ""
+	if src.Time != 0 {
+		ts = time.Unix(src.Time, 0).UTC().Format(time.RFC3339)
+	}
+	return src.Source + "," + ts
+}
+
+// noteSource records src as the provenance of the given tile
+// variant, unless an earlier one has already been recorded.
+func (tilelib *tileLibrary) noteSource(libref tileLibRef, src tileVariantSource) {
+	if !tilelib.trackProvenance || src.Source == "" {
+		return
+	}
+	tilelib.provenanceMtx.Lock()
+	defer tilelib.provenanceMtx.Unlock()
+	if tilelib.provenance == nil {
+		tilelib.provenance = map[tileLibRef]tileVariantSource{}
+	}
+	if src.earlierThan(tilelib.provenance[libref]) {
+		tilelib.provenance[libref] = src
+	}
+}
+
+// Provenance returns the recorded provenance of the given tile
+// variant. It returns false if trackProvenance is not enabled or
+// the provenance is unknown.
+func (tilelib *tileLibrary) Provenance(libref tileLibRef) (tileVariantSource, bool) {
+	tilelib.provenanceMtx.Lock()
+	defer tilelib.provenanceMtx.Unlock()
+	src, ok := tilelib.provenance[libref]
+	return src, ok
+}
@@ -0,0 +1,75 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"sync"
+)
+
+// pvaluePool is a fixed-size pool of worker goroutines that compute
+// p-values. It is shared by all of the chunk-processing goroutines in
+// slice-numpy, so the number of CPUs used for (potentially very
+// expensive) p-value calculations can be limited independently of
+// the number of chunks being decoded at once.
+type pvaluePool struct {
+	batchSize int
+	jobs      chan pvalueBatch
+	wg        sync.WaitGroup
+}
+
+type pvalueBatch struct {
+	obs  [][]bool
+	out  []float64
+	done *sync.WaitGroup
+}
+
+// newPvaluePool starts the given number of workers, each of which
+// calls pvalue on batches of up to batchSize columns at a time.
+func newPvaluePool(workers, batchSize int, pvalue func([]bool) float64) *pvaluePool {
+	if workers < 1 {
+		workers = 1
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	p := &pvaluePool{batchSize: batchSize, jobs: make(chan pvalueBatch, workers*2)}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer p.wg.Done()
+			for batch := range p.jobs {
+				for i, obs := range batch.obs {
+					batch.out[i] = pvalue(obs)
+				}
+				batch.done.Done()
+			}
+		}()
+	}
+	return p
+}
+
+// Evaluate returns the p-value of each column in obs. It is safe to
+// call from multiple goroutines at once.
+func (p *pvaluePool) Evaluate(obs [][]bool) []float64 {
+	out := make([]float64, len(obs))
+	var done sync.WaitGroup
+	for i := 0; i < len(obs); i += p.batchSize {
+		end := i + p.batchSize
+		if end > len(obs) {
+			end = len(obs)
+		}
+		done.Add(1)
+		p.jobs <- pvalueBatch{obs: obs[i:end], out: out[i:end], done: &done}
+	}
+	done.Wait()
+	return out
+}
+
+// Close stops the workers after all pending batches are done. The
+// pool must not be used after calling Close.
+func (p *pvaluePool) Close() {
+	close(p.jobs)
+	p.wg.Wait()
+}
@@ -0,0 +1,63 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"gopkg.in/check.v1"
+)
+
+type pvaluePoolSuite struct{}
+
+var _ = check.Suite(&pvaluePoolSuite{})
+
+func (s *pvaluePoolSuite) TestEvaluate(c *check.C) {
+	var running, maxRunning int64
+	pool := newPvaluePool(3, 4, func(obs []bool) float64 {
+		n := atomic.AddInt64(&running, 1)
+		defer atomic.AddInt64(&running, -1)
+		for {
+			max := atomic.LoadInt64(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt64(&maxRunning, max, n) {
+				break
+			}
+		}
+		return float64(len(obs))
+	})
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	for caller := 0; caller < 5; caller++ {
+		caller := caller
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			obs := make([][]bool, 10+caller)
+			for i := range obs {
+				obs[i] = make([]bool, i)
+			}
+			pvalues := pool.Evaluate(obs)
+			c.Check(pvalues, check.HasLen, len(obs))
+			for i, p := range pvalues {
+				c.Check(p, check.Equals, float64(i))
+			}
+		}()
+	}
+	wg.Wait()
+	c.Check(maxRunning <= 3, check.Equals, true)
+	c.Check(pool.Evaluate(nil), check.HasLen, 0)
+}
+
+func (s *pvaluePoolSuite) TestFilterPvalues(c *check.C) {
+	cmd := &sliceNumpy{chi2PValue: 0.05}
+	onehot := [][]int8{{1}, {2}, {3}}
+	xref := []onehotXref{{tag: 1}, {tag: 2}, {tag: 3}}
+	onehot, xref = cmd.filterPvalues(onehot, xref, []float64{0.01, 0.5, 0.001})
+	c.Check(onehot, check.DeepEquals, [][]int8{{1}, {3}})
+	c.Check(xref, check.DeepEquals, []onehotXref{{tag: 1, pvalue: 0.01}, {tag: 3, pvalue: 0.001}})
+	c.Check(cmd.pvalueCallCount, check.Equals, int64(3))
+}
@@ -42,8 +42,10 @@ func (cmd *ref2genome) RunCommand(prog string, args []string, stdin io.Reader, s
 	flags.StringVar(&cmd.outputFilename, "o", "", "output filename")
 	flags.BoolVar(&cmd.runLocal, "local", false, "run on local host (default: run in an arvados container)")
 	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
 	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
-	err = flags.Parse(args)
+	err = parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		err = nil
 		return 0
@@ -76,6 +78,7 @@ func (cmd *ref2genome) RunCommand(prog string, args []string, stdin io.Reader, s
 			Priority:    *priority,
 			VCPUs:       1,
 		}
+		containerOpts.Apply(&runner, stdout)
 		err = runner.TranslatePaths(&cmd.refFile)
 		if err != nil {
 			return 1
@@ -83,7 +86,10 @@ func (cmd *ref2genome) RunCommand(prog string, args []string, stdin io.Reader, s
 		runner.Args = []string{"ref2genome", "-local=true", "-ref", cmd.refFile, "-o", "/mnt/output/ref.genome"}
 		var output string
 		output, err = runner.Run()
-		if err != nil {
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
 			return 1
 		}
 		fmt.Fprintln(stdout, output+"/ref.genome")
@@ -0,0 +1,91 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+
+	"github.com/arvados/lightning/go-lightning/libio"
+	log "github.com/sirupsen/logrus"
+)
+
+// loadRefLibrary loads the reference tile variants and reference
+// sequences from cmd.refLibraryFile -- the output of a previous
+// "import -output-tiles" run whose only input was a reference fasta
+// file -- into tilelib, and writes the reference sequences to the
+// output.
+//
+// This must be called before tiling any other inputs, so the
+// reference tile variants get the same variant numbers in every
+// import that uses the same ref library.
+func (cmd *importer) loadRefLibrary(tilelib *tileLibrary) error {
+	f, err := open(cmd.refLibraryFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var tagset [][]byte
+	var cseqs []CompactSequence
+	variantmap := map[tileLibRef]tileVariantID{}
+	log.Infof("loading ref library %s", cmd.refLibraryFile)
+	err = DecodeLibrary(bufio.NewReaderSize(f, 64*1024*1024), strings.HasSuffix(cmd.refLibraryFile, ".gz"), func(ent *LibraryEntry) error {
+		if len(ent.TagSet) > 0 {
+			tagset = ent.TagSet
+			if want, got := libio.TagSetHash(tilelib.taglib.Tags()), libio.TagSetHash(tagset); want != got {
+				return fmt.Errorf("%s: tag set hash %x does not match tag library %s (%x)", cmd.refLibraryFile, got, cmd.tagLibraryFile, want)
+			}
+		}
+		if len(ent.CompactGenomes) > 0 {
+			return fmt.Errorf("%s is not a ref library: contains genome %q", cmd.refLibraryFile, ent.CompactGenomes[0].Name)
+		}
+		if len(ent.TileVariants) > 0 && tagset == nil {
+			return fmt.Errorf("%s is not a ref library: no tag set (was it imported with -output-tiles?)", cmd.refLibraryFile)
+		}
+		cseqs = append(cseqs, ent.CompactSequences...)
+		return tilelib.loadTileVariants(ent.TileVariants, variantmap)
+	})
+	if err != nil {
+		return err
+	}
+	if tagset == nil {
+		return fmt.Errorf("%s is not a ref library: no tag set (was it imported with -output-tiles?)", cmd.refLibraryFile)
+	}
+	if len(cseqs) == 0 {
+		return fmt.Errorf("%s is not a ref library: no reference sequences", cmd.refLibraryFile)
+	}
+	for _, cseq := range cseqs {
+		for _, tseq := range cseq.TileSequences {
+			for i, libref := range tseq {
+				if libref.Variant == 0 {
+					continue
+				}
+				v, ok := variantmap[libref]
+				if !ok {
+					return fmt.Errorf("%s: CompactSequence %q has variant %d for tag %d, but that variant was not in the library", cmd.refLibraryFile, cseq.Name, libref.Variant, libref.Tag)
+				}
+				tseq[i].Variant = v
+				tilelib.MarkReferenced(tseq[i])
+			}
+		}
+		if cmd.retainAfterEncoding {
+			tilelib.mtx.Lock()
+			if tilelib.refseqs == nil {
+				tilelib.refseqs = map[string]map[string][]tileLibRef{}
+			}
+			tilelib.refseqs[cseq.Name] = cseq.TileSequences
+			tilelib.mtx.Unlock()
+		}
+		err = cmd.encoder.Encode(LibraryEntry{
+			CompactSequences: []CompactSequence{cseq},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("loaded ref library %s: %d reference sequences, %d tile variants", cmd.refLibraryFile, len(cseqs), len(variantmap))
+	return nil
+}
@@ -0,0 +1,185 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// refsCmd lists the reference sequences in a library.
+type refsCmd struct{}
+
+func (cmd *refsCmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	inputDir := flags.String("input-dir", "./in", "input `directory` or library file")
+	perChrom := flags.Bool("chromosomes", false, "also list the chromosomes of each reference")
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	}
+
+	infiles, err := allFiles(*inputDir, matchGobFile)
+	if err != nil {
+		return 1
+	} else if len(infiles) == 0 {
+		err = fmt.Errorf("no input files found in %s", *inputDir)
+		return 1
+	}
+	var cseqs []CompactSequence
+	taglen := 0
+	reflen := map[tileLibRef]int{}
+	for _, infile := range infiles {
+		err = decodeLibraryFile(infile, func(ent *LibraryEntry) error {
+			if len(ent.TagSet) > 0 {
+				taglen = len(ent.TagSet[0])
+			}
+			cseqs = append(cseqs, ent.CompactSequences...)
+			for _, tv := range ent.TileVariants {
+				if tv.Ref {
+					reflen[tileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = len(tv.Sequence)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 1
+		}
+	}
+	if len(cseqs) == 0 {
+		err = fmt.Errorf("no reference sequences found in %s", *inputDir)
+		return 1
+	}
+	refs := summarizeRefs(cseqs, taglen, func(libref tileLibRef) (int, bool) {
+		n, ok := reflen[libref]
+		return n, ok
+	})
+	err = writeRefSummaries(stdout, refs, *perChrom)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// refSummary describes a reference sequence in a library.
+type refSummary struct {
+	name   string
+	chroms []chromSummary // sorted by name
+}
+
+type chromSummary struct {
+	name   string
+	tiles  int
+	length int // bases, or -1 if any reference tile sequence is unavailable
+}
+
+// length returns the total length of the reference, or -1 if the
+// length of any chromosome is unknown.
+func (rs refSummary) length() int {
+	total := 0
+	for _, c := range rs.chroms {
+		if c.length < 0 {
+			return -1
+		}
+		total += c.length
+	}
+	return total
+}
+
+// summarizeRefs returns a summary of each of the given reference
+// sequences, sorted by name. If there are multiple
+// CompactSequences with the same name, the last one is used (as in
+// slice-numpy). tilelen returns the length of the given reference
+// tile, or false if it is not known.
+func summarizeRefs(cseqs []CompactSequence, taglen int, tilelen func(tileLibRef) (int, bool)) []refSummary {
+	byName := map[string]map[string][]tileLibRef{}
+	for _, cseq := range cseqs {
+		byName[cseq.Name] = cseq.TileSequences
+	}
+	var refs []refSummary
+	for name, tseqs := range byName {
+		rs := refSummary{name: name}
+		for chrom, tseq := range tseqs {
+			cs := chromSummary{name: chrom, tiles: len(tseq)}
+			for i, libref := range tseq {
+				n, ok := tilelen(libref)
+				if !ok {
+					cs.length = -1
+					break
+				}
+				cs.length += n
+				if i > 0 {
+					// adjacent tiles overlap by one tag
+					cs.length -= taglen
+				}
+			}
+			rs.chroms = append(rs.chroms, cs)
+		}
+		sort.Slice(rs.chroms, func(i, j int) bool { return rs.chroms[i].name < rs.chroms[j].name })
+		refs = append(refs, rs)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].name < refs[j].name })
+	return refs
+}
+
+// writeRefSummaries writes a table of the given references, with
+// the number of chromosomes, tiles, and bases in each. If perChrom
+// is true, each reference is followed by a row for each of its
+// chromosomes.
+func writeRefSummaries(w io.Writer, refs []refSummary, perChrom bool) error {
+	bufw := bufio.NewWriter(w)
+	tw := tabwriter.NewWriter(bufw, 0, 8, 2, ' ', 0)
+	fmt.Fprint(tw, "REFERENCE\tCHROMOSOMES\tTILES\tLENGTH\n")
+	for _, rs := range refs {
+		tiles := 0
+		for _, c := range rs.chroms {
+			tiles += c.tiles
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", rs.name, len(rs.chroms), tiles, refLengthString(rs.length()))
+		if perChrom {
+			for _, c := range rs.chroms {
+				fmt.Fprintf(tw, "  %s\t\t%d\t%s\n", c.name, c.tiles, refLengthString(c.length))
+			}
+		}
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+	return bufw.Flush()
+}
+
+func refLengthString(n int) string {
+	if n < 0 {
+		return "?"
+	}
+	return fmt.Sprintf("%d", n)
+}
+
+// refListing returns the output of writeRefSummaries as a string,
+// for use in error messages.
+func refListing(refs []refSummary) string {
+	var buf bytes.Buffer
+	writeRefSummaries(&buf, refs, false)
+	return buf.String()
+}
@@ -0,0 +1,69 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type refsSuite struct{}
+
+var _ = check.Suite(&refsSuite{})
+
+func (s *refsSuite) TestSummarizeRefs(c *check.C) {
+	tilelen := map[tileLibRef]int{
+		{Tag: 0, Variant: 1}: 30,
+		{Tag: 1, Variant: 1}: 40,
+		{Tag: 2, Variant: 1}: 50,
+	}
+	refs := summarizeRefs([]CompactSequence{
+		{Name: "ref2", TileSequences: map[string][]tileLibRef{
+			"chr1": {{Tag: 0, Variant: 1}, {Tag: 1, Variant: 1}},
+			"chr2": {{Tag: 2, Variant: 1}, {Tag: 3, Variant: 1}},
+		}},
+		{Name: "ref1", TileSequences: map[string][]tileLibRef{
+			"chr1": {{Tag: 0, Variant: 1}, {Tag: 1, Variant: 1}, {Tag: 2, Variant: 1}},
+		}},
+	}, 10, func(libref tileLibRef) (int, bool) {
+		n, ok := tilelen[libref]
+		return n, ok
+	})
+	c.Assert(refs, check.HasLen, 2)
+	c.Check(refs[0].name, check.Equals, "ref1")
+	c.Check(refs[0].chroms, check.DeepEquals, []chromSummary{{name: "chr1", tiles: 3, length: 30 + 40 + 50 - 10*2}})
+	c.Check(refs[0].length(), check.Equals, 100)
+	c.Check(refs[1].name, check.Equals, "ref2")
+	c.Check(refs[1].chroms, check.DeepEquals, []chromSummary{
+		{name: "chr1", tiles: 2, length: 30 + 40 - 10},
+		{name: "chr2", tiles: 2, length: -1},
+	})
+	c.Check(refs[1].length(), check.Equals, -1)
+	c.Check(refListing(refs), check.Matches, `(?ms)REFERENCE +CHROMOSOMES +TILES +LENGTH\nref1 +1 +3 +100\nref2 +2 +4 +\?\n`)
+}
+
+func (s *refsSuite) TestRefsCommand(c *check.C) {
+	tmpdir := c.MkDir()
+	exited := (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-output-tiles",
+		"-save-incomplete-tiles",
+		"-o", tmpdir + "/library.gob",
+		"testdata/ref.fasta",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	var stdout bytes.Buffer
+	exited = (&refsCmd{}).RunCommand("refs", []string{
+		"-input-dir", tmpdir + "/library.gob",
+		"-chromosomes",
+	}, nil, &stdout, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	c.Log(stdout.String())
+	c.Check(stdout.String(), check.Matches, `(?ms)REFERENCE.*\ntestdata/ref.fasta +2 +\d+ +\d+\n  chr1 .*\n  chr2 .*`)
+}
@@ -0,0 +1,210 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// regionsFilter selects lines from a GFF3/GTF regions file by
+// feature type (column 3) and attribute value (column 9), and
+// determines how multiple regions files are combined. The zero
+// value selects all lines and takes the union of all files.
+type regionsFilter struct {
+	featureTypes string // comma-separated, e.g., "exon,CDS"
+	attribute    string // name=value1,value2,... or name=@file
+	combine      string // "union" or "intersection"
+	invert       bool   // exclude the given regions instead of including them
+
+	// If non-empty, only regions on these contigs are needed,
+	// so a bgzip-compressed regions file with a tabix index
+	// ({file}.tbi) is read only for these contigs. (Not a
+	// command line flag: set by commands that know which contigs
+	// are in their input.)
+	contigs []string
+}
+
+func (rf *regionsFilter) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&rf.featureTypes, "regions-feature-type", "", "only use GFF/GTF regions with the given feature `types` (comma-separated, e.g., exon,CDS)")
+	flags.StringVar(&rf.combine, "regions-combine", "union", "when -regions lists multiple files, use the `union` or intersection of their regions")
+	flags.BoolVar(&rf.invert, "invert-regions", false, "exclude the specified regions instead of including them")
+	flags.StringVar(&rf.attribute, "regions-attribute", "", "only use GFF/GTF regions whose attribute has one of the given values (`name=value,value,...`, or name=@file to read values from a file, one per line)")
+}
+
+// Args returns command line arguments that reproduce the filter
+// parameters (see Flags).
+func (rf *regionsFilter) Args() []string {
+	return []string{
+		"-regions-feature-type=" + rf.featureTypes,
+		"-regions-attribute=" + rf.attribute,
+		"-regions-combine=" + rf.combine,
+		fmt.Sprintf("-invert-regions=%v", rf.invert),
+	}
+}
+
+// TranslatePaths updates the given -regions value (a
+// comma-separated list of files) and the values file in
+// -regions-attribute (if any) to refer to the corresponding paths
+// in the container.
+func (rf *regionsFilter) TranslatePaths(runner *arvadosContainerRunner, regionsFilename *string) error {
+	if *regionsFilename != "" {
+		fnms := strings.Split(*regionsFilename, ",")
+		for i := range fnms {
+			err := runner.TranslatePaths(&fnms[i])
+			if err != nil {
+				return err
+			}
+		}
+		*regionsFilename = strings.Join(fnms, ",")
+	}
+	name, fnm, ok := rf.attributeFile()
+	if !ok {
+		return nil
+	}
+	err := runner.TranslatePaths(&fnm)
+	if err != nil {
+		return err
+	}
+	rf.attribute = name + "=@" + fnm
+	return nil
+}
+
+// regionsFiles returns the files named by a -regions value, i.e., a
+// comma-separated list of filenames and glob patterns.
+func regionsFiles(regionsFilename string) ([]string, error) {
+	var fnms []string
+	for _, pattern := range strings.Split(regionsFilename, ",") {
+		if pattern == "" {
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pattern, err)
+		} else if len(matches) == 0 {
+			// Not a glob, or a glob that doesn't match
+			// anything. Either way, we want a "no such
+			// file" error if it doesn't exist.
+			matches = []string{pattern}
+		}
+		fnms = append(fnms, matches...)
+	}
+	if len(fnms) == 0 {
+		return nil, errors.New("no regions files specified")
+	}
+	return fnms, nil
+}
+
+func (rf *regionsFilter) attributeFile() (name, fnm string, ok bool) {
+	name, values, ok := strings.Cut(rf.attribute, "=")
+	if !ok || !strings.HasPrefix(values, "@") {
+		return "", "", false
+	}
+	return name, values[1:], true
+}
+
+// compiled returns a function that reports whether a GFF/GTF line
+// (already split into fields) should be used. It returns nil if the
+// filter selects all lines.
+func (rf *regionsFilter) compiled() (func(fields [][]byte) (bool, error), error) {
+	if rf.combine != "" && rf.combine != "union" && rf.combine != "intersection" {
+		return nil, fmt.Errorf("invalid -regions-combine %q: must be union or intersection", rf.combine)
+	}
+	if rf.featureTypes == "" && rf.attribute == "" {
+		return nil, nil
+	}
+	var types map[string]bool
+	if rf.featureTypes != "" {
+		types = map[string]bool{}
+		for _, t := range strings.Split(rf.featureTypes, ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+	}
+	var attrName string
+	var attrValues map[string]bool
+	if rf.attribute != "" {
+		name, values, ok := strings.Cut(rf.attribute, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid -regions-attribute %q: must be name=value,value,... or name=@file", rf.attribute)
+		}
+		attrName = name
+		var list []string
+		if _, fnm, ok := rf.attributeFile(); ok {
+			f, err := zopen(fnm)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			buf, err := io.ReadAll(f)
+			if err != nil {
+				return nil, err
+			}
+			list = strings.Split(string(buf), "\n")
+		} else {
+			list = strings.Split(values, ",")
+		}
+		attrValues = map[string]bool{}
+		for _, v := range list {
+			if v = strings.TrimSpace(v); v != "" {
+				attrValues[v] = true
+			}
+		}
+		if len(attrValues) == 0 {
+			return nil, fmt.Errorf("-regions-attribute %q: empty list of values", rf.attribute)
+		}
+	}
+	return func(fields [][]byte) (bool, error) {
+		if len(fields) < 9 {
+			return false, errors.New("-regions-feature-type and -regions-attribute require a GFF/GTF regions file")
+		}
+		if types != nil && !types[string(fields[2])] {
+			return false, nil
+		}
+		if attrValues != nil {
+			for _, v := range gffAttribute(fields[8], attrName) {
+				if attrValues[v] {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		return true, nil
+	}, nil
+}
+
+// gffAttribute returns the values of the named attribute in a
+// GFF3 (name=value,value;...) or GTF (name "value"; ...) attribute
+// column.
+func gffAttribute(attrs []byte, name string) []string {
+	var values []string
+	for _, attr := range bytes.Split(attrs, []byte{';'}) {
+		attr = bytes.TrimSpace(attr)
+		if i := bytes.IndexByte(attr, '='); i >= 0 {
+			// GFF3
+			if string(attr[:i]) != name {
+				continue
+			}
+			for _, v := range strings.Split(string(attr[i+1:]), ",") {
+				if unescaped, err := url.PathUnescape(v); err == nil {
+					v = unescaped
+				}
+				values = append(values, v)
+			}
+		} else if i := bytes.IndexByte(attr, ' '); i >= 0 {
+			// GTF
+			if string(attr[:i]) != name {
+				continue
+			}
+			values = append(values, strings.Trim(strings.TrimSpace(string(attr[i+1:])), `"`))
+		}
+	}
+	return values
+}
@@ -0,0 +1,313 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	_ "net/http/pprof"
+	"regexp"
+	"runtime"
+	"sort"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	log "github.com/sirupsen/logrus"
+)
+
+// retilecmd converts an existing library (which must include tile
+// sequences) to a new tag library, by reassembling each reference
+// and genome sequence from its tiles and tiling the result with the
+// new tags.
+type retilecmd struct {
+	oldlib  *tileLibrary
+	newlib  *tileLibrary
+	refname string // reference whose paths determine tile order
+}
+
+var matchAnyChromosome = regexp.MustCompile(`.*`)
+
+func (cmd *retilecmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
+	inputDir := flags.String("input-dir", "./in", "input `directory` (library with tile sequences, e.g., from import -output-tiles)")
+	outputDir := flags.String("output-dir", "./out", "output `directory`")
+	tagLibraryFile := flags.String("tag-library", "", "new tag library fasta `file`")
+	flags.StringVar(&cmd.refname, "ref", "", "name of reference `sequence` that determines tile order (default: the only reference in the input library)")
+	skipOOO := flags.Bool("skip-ooo", false, "skip out-of-order tags")
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	} else if *tagLibraryFile == "" {
+		err = errors.New("cannot retile without -tag-library argument")
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		runner := arvadosContainerRunner{
+			Name:        "lightning retile",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         700000000000,
+			VCPUs:       96,
+			Priority:    *priority,
+			KeepCache:   2,
+			APIAccess:   true,
+		}
+		containerOpts.Apply(&runner, stdout)
+		err = runner.TranslatePaths(inputDir, tagLibraryFile)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"retile", "-local=true",
+			"-pprof", ":6060",
+			"-input-dir", *inputDir,
+			"-output-dir", "/mnt/output",
+			"-tag-library", *tagLibraryFile,
+			"-ref", cmd.refname,
+			"-skip-ooo=" + fmt.Sprintf("%v", *skipOOO),
+		}
+		var output string
+		output, err = runner.Run()
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output)
+		return 0
+	}
+
+	taglib, err := (&importer{tagLibraryFile: *tagLibraryFile}).loadTagLibrary()
+	if err != nil {
+		return 1
+	}
+	cmd.oldlib = &tileLibrary{
+		retainNoCalls:       true,
+		retainTileSequences: true,
+		compactGenomes:      map[string][]tileVariantID{},
+	}
+	err = cmd.oldlib.LoadDir(context.Background(), *inputDir)
+	if err != nil {
+		return 1
+	}
+	cmd.newlib = &tileLibrary{
+		taglib:              taglib,
+		retainNoCalls:       true,
+		retainTileSequences: true,
+		skipOOO:             *skipOOO,
+		compactGenomes:      map[string][]tileVariantID{},
+		refseqs:             map[string]map[string][]tileLibRef{},
+	}
+	err = cmd.retile()
+	if err != nil {
+		return 1
+	}
+	log.Info("tidying")
+	cmd.newlib.Tidy()
+	err = cmd.newlib.WriteDir(*outputDir)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func (cmd *retilecmd) retile() error {
+	var refnames []string
+	for name := range cmd.oldlib.refseqs {
+		refnames = append(refnames, name)
+	}
+	sort.Strings(refnames)
+	if len(refnames) == 0 {
+		return errors.New("input library has no reference sequences")
+	}
+	if cmd.refname == "" {
+		if len(refnames) > 1 {
+			return fmt.Errorf("input library has multiple reference sequences %q, need -ref argument", refnames)
+		}
+		cmd.refname = refnames[0]
+	} else if cmd.oldlib.refseqs[cmd.refname] == nil {
+		return fmt.Errorf("reference %q not found in input library (choices are %q)", cmd.refname, refnames)
+	}
+
+	var cgnames []string
+	for name := range cmd.oldlib.compactGenomes {
+		cgnames = append(cgnames, name)
+	}
+	sort.Strings(cgnames)
+
+	var mtx sync.Mutex
+	throttle := throttle{Max: runtime.NumCPU()}
+	for _, refname := range refnames {
+		refname := refname
+		throttle.Go(func() error {
+			log.Infof("retiling reference %s", refname)
+			rdr := cmd.refFasta(refname)
+			defer rdr.Close()
+			tseqs, _, err := cmd.newlib.TileFasta(refname, rdr, matchAnyChromosome, true)
+			if err != nil {
+				return fmt.Errorf("%s: %w", refname, err)
+			}
+			mtx.Lock()
+			cmd.newlib.refseqs[refname] = tseqs
+			mtx.Unlock()
+			return nil
+		})
+	}
+	allvariants := make([][][]tileVariantID, len(cgnames))
+	for i, name := range cgnames {
+		name, variants := name, make([][]tileVariantID, 2)
+		allvariants[i] = variants
+		for phase := 0; phase < 2; phase++ {
+			phase := phase
+			throttle.Go(func() error {
+				log.Infof("retiling %s phase %d", name, phase+1)
+				rdr := cmd.genomeFasta(name, phase)
+				defer rdr.Close()
+				tseqs, _, err := cmd.newlib.TileFasta(fmt.Sprintf("%s phase %d", name, phase+1), rdr, matchAnyChromosome, false)
+				if err != nil {
+					return fmt.Errorf("%s phase %d: %w", name, phase+1, err)
+				}
+				variants[phase], _, _ = tseqs.Variants()
+				return nil
+			})
+		}
+	}
+	err := throttle.Wait()
+	if err != nil {
+		return err
+	}
+	for i, name := range cgnames {
+		cmd.newlib.compactGenomes[name] = flatten(allvariants[i])
+	}
+	return nil
+}
+
+// refFasta returns a reader that produces the sequences of the given
+// reference, reassembled from its tiles, in fasta format.
+func (cmd *retilecmd) refFasta(refname string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		refseq := cmd.oldlib.refseqs[refname]
+		var seqnames []string
+		for seqname := range refseq {
+			seqnames = append(seqnames, seqname)
+		}
+		sort.Strings(seqnames)
+		bufw := bufio.NewWriterSize(pw, 1<<20)
+		for _, seqname := range seqnames {
+			fmt.Fprintf(bufw, ">%s\n", seqname)
+			for i, libref := range refseq[seqname] {
+				seq := cmd.oldlib.TileVariantSequence(libref)
+				if len(seq) == 0 {
+					pw.CloseWithError(fmt.Errorf("reference %q seq %q: tile variant %d,%d has no sequence (input library must include tile sequences)", refname, seqname, libref.Tag, libref.Variant))
+					return
+				}
+				if i > 0 {
+					seq = seq[cmd.oldlib.taglib.TagLen(libref.Tag):]
+				}
+				bufw.Write(seq)
+			}
+			bufw.WriteString("\n")
+		}
+		pw.CloseWithError(bufw.Flush())
+	}()
+	return pr
+}
+
+// genomeFasta returns a reader that produces the sequence of one
+// phase of the given genome, reassembled from its tiles in the order
+// they appear in the reference, in fasta format.
+//
+// Where a tile is missing (or a tile variant's sequence is not
+// known) the sequence is split into separate fasta records.
+func (cmd *retilecmd) genomeFasta(name string, phase int) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		cg := cmd.oldlib.compactGenomes[name]
+		refseq := cmd.oldlib.refseqs[cmd.refname]
+		var seqnames []string
+		for seqname := range refseq {
+			seqnames = append(seqnames, seqname)
+		}
+		sort.Strings(seqnames)
+		bufw := bufio.NewWriterSize(pw, 1<<20)
+		for _, seqname := range seqnames {
+			part := 0
+			var prev []byte
+			for _, reflibref := range refseq[seqname] {
+				tag := reflibref.Tag
+				var variant tileVariantID
+				if i := int(tag)*2 + phase; i < len(cg) {
+					variant = cg[i]
+				}
+				if variant == 0 {
+					// Either spanned by the
+					// previous tile, or missing.
+					continue
+				}
+				seq := cmd.oldlib.TileVariantSequence(tileLibRef{Tag: tag, Variant: variant})
+				taglen := cmd.oldlib.taglib.TagLen(tag)
+				if len(seq) < taglen {
+					// Sequence not known.
+					if prev != nil {
+						bufw.WriteString("\n")
+					}
+					prev = nil
+					continue
+				}
+				if prev != nil && len(prev) >= taglen && bytes.EqualFold(prev[len(prev)-taglen:], seq[:taglen]) {
+					// Continues the current
+					// record.
+					bufw.Write(seq[taglen:])
+				} else {
+					if prev != nil {
+						bufw.WriteString("\n")
+					}
+					fmt.Fprintf(bufw, ">%s.%d\n", seqname, part)
+					part++
+					bufw.Write(seq)
+				}
+				prev = seq
+			}
+			if prev != nil {
+				bufw.WriteString("\n")
+			}
+		}
+		pw.CloseWithError(bufw.Flush())
+	}()
+	return pr
+}
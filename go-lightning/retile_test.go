@@ -0,0 +1,71 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type retileSuite struct{}
+
+var _ = check.Suite(&retileSuite{})
+
+func (s *retileSuite) TestRetileSameTags(c *check.C) {
+	tmpdir := c.MkDir()
+	err := os.Mkdir(tmpdir+"/retiled", 0777)
+	c.Assert(err, check.IsNil)
+
+	exited := (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-output-tiles",
+		"-save-incomplete-tiles",
+		"-o", tmpdir + "/library.gob",
+		"testdata/ref.fasta",
+		"testdata/pipeline1",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	exited = (&retilecmd{}).RunCommand("retile", []string{
+		"-local=true",
+		"-input-dir=" + tmpdir + "/library.gob",
+		"-output-dir=" + tmpdir + "/retiled",
+		"-tag-library=testdata/tags",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	// Retiling with the same tag library should not change the
+	// variants found in each genome.
+	for _, input := range []string{tmpdir + "/library.gob", tmpdir + "/retiled"} {
+		outdir := input + ".out"
+		err = os.Mkdir(outdir, 0777)
+		c.Assert(err, check.IsNil)
+		exited = (&exporter{}).RunCommand("export", []string{
+			"-local=true",
+			"-input-dir=" + input,
+			"-output-dir=" + outdir,
+			"-output-format=pvcf",
+			"-ref=testdata/ref.fasta",
+		}, nil, os.Stderr, os.Stderr)
+		c.Assert(exited, check.Equals, 0)
+	}
+	for _, fnm := range []string{"out.chr1.vcf", "out.chr2.vcf"} {
+		expect, err := ioutil.ReadFile(tmpdir + "/library.gob.out/" + fnm)
+		c.Assert(err, check.IsNil)
+		got, err := ioutil.ReadFile(tmpdir + "/retiled.out/" + fnm)
+		c.Assert(err, check.IsNil)
+		c.Check(sortLines(string(got)), check.Equals, sortLines(string(expect)))
+	}
+
+	exited = (&retilecmd{}).RunCommand("retile", []string{
+		"-local=true",
+		"-input-dir=" + tmpdir + "/library.gob",
+		"-output-dir=" + tmpdir + "/retiled",
+	}, nil, os.Stderr, os.Stderr)
+	c.Check(exited, check.Equals, 2)
+}
@@ -0,0 +1,136 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// sampleCoverage is the number of called (non-zero) tile variants in
+// a genome, out of 2 per tag in the library.
+type sampleCoverage struct {
+	Name    string
+	Called  int
+	Total   int
+	Dropped bool // coverage is below the -min-sample-coverage threshold
+}
+
+// Coverage returns the fraction of the genome's tile variants that
+// are called.
+func (sc sampleCoverage) Coverage() float64 {
+	if sc.Total == 0 {
+		return 0
+	}
+	return float64(sc.Called) / float64(sc.Total)
+}
+
+// countCalled returns the number of non-zero tile variants in
+// variants.
+func countCalled(variants []tileVariantID) int {
+	n := 0
+	for _, v := range variants {
+		if v > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// sampleCoverages returns the coverage of each genome, sorted by
+// name, given the number of called tile variants in each genome and
+// the number of tags in the library. Genomes with coverage less than
+// min are marked as dropped.
+func sampleCoverages(called map[string]int, ntags int, min float64) []sampleCoverage {
+	covs := make([]sampleCoverage, 0, len(called))
+	for name, n := range called {
+		sc := sampleCoverage{Name: name, Called: n, Total: ntags * 2}
+		sc.Dropped = sc.Coverage() < min
+		covs = append(covs, sc)
+	}
+	sort.Slice(covs, func(i, j int) bool { return covs[i].Name < covs[j].Name })
+	return covs
+}
+
+// countCalledInFiles reads the given library files and returns the
+// number of called tile variants in each of the named genomes, for
+// tags below ntags.
+func countCalledInFiles(infiles []string, names []string, ntags int) (map[string]int, error) {
+	called := make(map[string]int, len(names))
+	for _, name := range names {
+		called[name] = 0
+	}
+	var mtx sync.Mutex
+	throttle := throttle{Max: runtime.GOMAXPROCS(0)}
+	for _, infile := range infiles {
+		infile := infile
+		throttle.Go(func() error {
+			f, err := open(infile)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			count := map[string]int{}
+			err = DecodeLibraryOptions(f, strings.HasSuffix(infile, ".gz"), DecodeOptions{SkipTileVariants: true}, func(ent *LibraryEntry) error {
+				for _, cg := range ent.CompactGenomes {
+					variants := cg.Variants
+					if max := (ntags - int(cg.StartTag)) * 2; max <= 0 {
+						variants = nil
+					} else if max < len(variants) {
+						variants = variants[:max]
+					}
+					count[cg.Name] += countCalled(variants)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %w", infile, err)
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			for name, n := range count {
+				if _, ok := called[name]; ok {
+					called[name] += n
+				}
+			}
+			return nil
+		})
+	}
+	if err := throttle.Wait(); err != nil {
+		return nil, err
+	}
+	return called, nil
+}
+
+// writeSampleCoverage writes a CSV file with one row per genome,
+// reporting its coverage and whether it was dropped.
+func writeSampleCoverage(fnm string, covs []sampleCoverage) error {
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriter(f)
+	_, err = fmt.Fprint(bufw, "Index,SampleID,Called,Total,Coverage,Dropped\n")
+	if err != nil {
+		return err
+	}
+	for i, sc := range covs {
+		_, err = fmt.Fprintf(bufw, "%d,%s,%d,%d,%f,%v\n", i, trimFilenameForLabel(sc.Name), sc.Called, sc.Total, sc.Coverage(), sc.Dropped)
+		if err != nil {
+			return err
+		}
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
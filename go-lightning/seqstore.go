@@ -0,0 +1,126 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// seqSpillStore is a disk-backed alternative to tileLibrary.seq2. Tile
+// sequences are appended to an unlinked temp file; only the offset
+// and length of each sequence are kept in memory.
+type seqSpillStore struct {
+	file    *os.File
+	wbuf    *bufio.Writer
+	size    int64 // bytes written to wbuf
+	flushed int64 // bytes flushed to file
+	index   map[tileHash]seqSpillRef
+	err     error
+	mtx     sync.Mutex
+}
+
+type seqSpillRef struct {
+	offset int64
+	length int32
+}
+
+// newSeqSpillStore creates a spill file in dir (or the default temp
+// dir if dir is ""). The file is unlinked immediately, so its disk
+// space is released when the process exits.
+func newSeqSpillStore(dir string) (*seqSpillStore, error) {
+	f, err := os.CreateTemp(dir, "lightning-seq-")
+	if err != nil {
+		return nil, fmt.Errorf("seqSpillStore: %w", err)
+	}
+	err = os.Remove(f.Name())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("seqSpillStore: %w", err)
+	}
+	return &seqSpillStore{
+		file:  f,
+		wbuf:  bufio.NewWriterSize(f, 4*1024*1024),
+		index: map[tileHash]seqSpillRef{},
+	}, nil
+}
+
+// Put saves seq under the given hash. If a sequence is already stored
+// under that hash, Put does nothing.
+func (s *seqSpillStore) Put(hash tileHash, seq []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.err != nil {
+		return
+	}
+	if _, ok := s.index[hash]; ok {
+		return
+	}
+	_, err := s.wbuf.Write(seq)
+	if err != nil {
+		s.err = fmt.Errorf("seqSpillStore: write: %w", err)
+		return
+	}
+	s.index[hash] = seqSpillRef{offset: s.size, length: int32(len(seq))}
+	s.size += int64(len(seq))
+}
+
+// Get returns the sequence stored under the given hash, or nil if
+// there is none.
+func (s *seqSpillStore) Get(hash tileHash) []byte {
+	s.mtx.Lock()
+	ref, ok := s.index[hash]
+	if !ok || s.err != nil {
+		s.mtx.Unlock()
+		return nil
+	}
+	if ref.offset+int64(ref.length) > s.flushed {
+		err := s.wbuf.Flush()
+		if err != nil {
+			s.err = fmt.Errorf("seqSpillStore: flush: %w", err)
+			s.mtx.Unlock()
+			return nil
+		}
+		s.flushed = s.size
+	}
+	s.mtx.Unlock()
+	buf := make([]byte, ref.length)
+	_, err := s.file.ReadAt(buf, ref.offset)
+	if err != nil && err != io.EOF {
+		s.mtx.Lock()
+		if s.err == nil {
+			s.err = fmt.Errorf("seqSpillStore: read: %w", err)
+		}
+		s.mtx.Unlock()
+		return nil
+	}
+	return buf
+}
+
+// Err returns the first error encountered by Put or Get, if any.
+func (s *seqSpillStore) Err() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.err
+}
+
+// Len returns the number of sequences stored.
+func (s *seqSpillStore) Len() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.index)
+}
+
+// Close closes the spill file, releasing its disk space.
+func (s *seqSpillStore) Close() error {
+	err := s.file.Close()
+	if err != nil {
+		return fmt.Errorf("seqSpillStore: close: %w", err)
+	}
+	return nil
+}
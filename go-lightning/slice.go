@@ -16,17 +16,22 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/arvados/lightning/go-lightning/libio"
 	"github.com/klauspost/pgzip"
 	log "github.com/sirupsen/logrus"
 )
 
 type slicecmd struct{}
 
+// Number of tags per block in indexed slice files.
+const sliceIndexBlockTags = 1000
+
 func (cmd *slicecmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
 	var err error
 	defer func() {
@@ -41,10 +46,20 @@ func (cmd *slicecmd) RunCommand(prog string, args []string, stdin io.Reader, std
 	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
 	projectUUID := flags.String("project", "", "project `UUID` for output data")
 	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
 	preemptible := flags.Bool("preemptible", true, "request preemptible instance")
 	outputDir := flags.String("output-dir", "./out", "output `directory`")
-	tagsPerFile := flags.Int("tags-per-file", 50000, "tags per file (nfiles will be ~10M÷x)")
-	err = flags.Parse(args)
+	watchdogTimeout := flags.Duration("watchdog-timeout", 0, "abort with a goroutine dump if no worker thread starts or finishes for this long, and log long-running workers every 1/4 of this `interval` (0 = disable)")
+	var opts SliceOptions
+	flags.IntVar(&opts.TagsPerFile, "tags-per-file", 50000, "tags per file (nfiles will be ~10M÷x)")
+	flags.BoolVar(&opts.ByChromosome, "chromosome-chunks", false, "align file boundaries with chromosome boundaries in the reference sequence, so each file has tags from only one chromosome (and at most -tags-per-file tags), and write a chunk→chromosome map to chunks.csv")
+	flags.StringVar(&opts.RefName, "ref", "", "reference sequence `name` to use for -chromosome-chunks (may be omitted if input has only one reference sequence)")
+	flags.IntVar(&opts.SamplesPerSlice, "samples-per-slice", 0, "also split genomes into blocks of `N` samples (sorted by name), writing a separate file for each tag range and sample block, and write a manifest to chunks.csv and genomes.csv (0 = don't split by sample)")
+	var filter Filter
+	filter.GenomeFlags(flags)
+	flags.BoolVar(&opts.Index, "index", false, "write indexed output files, so readers like dump can skip to the tags they need (requires rewriting each output file after slicing)")
+	err = parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		err = nil
 		return 0
@@ -55,6 +70,12 @@ func (cmd *slicecmd) RunCommand(prog string, args []string, stdin io.Reader, std
 	if len(inputDirs) == 0 {
 		err = errors.New("no input dirs specified")
 		return 2
+	} else if opts.RefName != "" && !opts.ByChromosome {
+		err = errors.New("-ref does not make sense without -chromosome-chunks")
+		return 2
+	} else if opts.SamplesPerSlice < 0 {
+		err = fmt.Errorf("invalid -samples-per-slice %d", opts.SamplesPerSlice)
+		return 2
 	}
 
 	if *pprof != "" {
@@ -78,35 +99,297 @@ func (cmd *slicecmd) RunCommand(prog string, args []string, stdin io.Reader, std
 			APIAccess:   true,
 			Preemptible: *preemptible,
 		}
+		containerOpts.Apply(&runner, stdout)
 		for i := range inputDirs {
 			err = runner.TranslatePaths(&inputDirs[i])
 			if err != nil {
 				return 1
 			}
 		}
+		err = filter.TranslatePaths(&runner)
+		if err != nil {
+			return 1
+		}
 		runner.Args = append([]string{"slice", "-local=true",
 			"-pprof", ":6060",
 			"-output-dir", "/mnt/output",
-		}, inputDirs...)
+			"-tags-per-file", fmt.Sprintf("%d", opts.TagsPerFile),
+			"-chromosome-chunks=" + fmt.Sprintf("%v", opts.ByChromosome),
+			"-ref", opts.RefName,
+			"-samples-per-slice", fmt.Sprintf("%d", opts.SamplesPerSlice),
+			"-index=" + fmt.Sprintf("%v", opts.Index),
+			"-watchdog-timeout=" + watchdogTimeout.String(),
+		}, filter.GenomeArgs()...)
+		runner.Args = append(runner.Args, inputDirs...)
 		var output string
 		output, err = runner.Run()
-		if err != nil {
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
 			return 1
 		}
 		fmt.Fprintln(stdout, output)
 		return 0
 	}
 
-	err = Slice(*tagsPerFile, *outputDir, inputDirs)
+	if filter.MatchGenome != "" || filter.ExcludeGenome != "" || filter.GenomeList != "" {
+		opts.Genomes, err = filter.GenomeSelector()
+		if err != nil {
+			return 1
+		}
+	}
+	startWatchdog(*watchdogTimeout, stderr)
+	err = Slice(*outputDir, inputDirs, opts)
 	if err != nil {
 		return 1
 	}
 	return 0
 }
 
+// sliceChunk is the range of tags written to one output file by
+// Slice.
+type sliceChunk struct {
+	start   tagID
+	end     tagID
+	seqname string // reference chromosome, if chunks are aligned to chromosomes
+}
+
+// fixedSliceChunks returns chunks with the same number of tags in
+// each chunk.
+func fixedSliceChunks(tags, tagsPerFile int) []sliceChunk {
+	var chunks []sliceChunk
+	for start := 0; start < tags; start += tagsPerFile {
+		chunks = append(chunks, sliceChunk{start: tagID(start), end: tagID(start + tagsPerFile)})
+	}
+	return chunks
+}
+
+// chromosomeSliceChunks returns chunks that start at the first tag of
+// each chromosome in the given reference sequence, and are split as
+// needed so no chunk has more than tagsPerFile tags.
+//
+// Tags that come before the first tag of the first chromosome are
+// included in the first chromosome's first chunk. Tags that don't
+// appear in the reference are included in the chunk of the preceding
+// chromosome.
+func chromosomeSliceChunks(tags, tagsPerFile int, refseq map[string][]tileLibRef) []sliceChunk {
+	type chrStart struct {
+		seqname string
+		start   tagID
+	}
+	var starts []chrStart
+	for seqname, path := range refseq {
+		if len(path) == 0 {
+			continue
+		}
+		start := path[0].Tag
+		for _, libref := range path {
+			if start > libref.Tag {
+				start = libref.Tag
+			}
+		}
+		starts = append(starts, chrStart{seqname, start})
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		if starts[i].start != starts[j].start {
+			return starts[i].start < starts[j].start
+		}
+		return starts[i].seqname < starts[j].seqname
+	})
+	var chunks []sliceChunk
+	for i, cs := range starts {
+		start, end := int(cs.start), tags
+		if i == 0 {
+			start = 0
+		}
+		if i+1 < len(starts) {
+			end = int(starts[i+1].start)
+		}
+		for ; start < end; start += tagsPerFile {
+			chunkend := start + tagsPerFile
+			if chunkend > end {
+				chunkend = end
+			}
+			chunks = append(chunks, sliceChunk{start: tagID(start), end: tagID(chunkend), seqname: cs.seqname})
+		}
+	}
+	return chunks
+}
+
+// sliceScan reads the given library files and returns the sorted
+// names of all genomes, and (if needRef is true) the tile paths of
+// the named reference sequence, or the only reference sequence if
+// refname is empty.
+func sliceScan(infiles []string, needRef bool, refname string) (map[string][]tileLibRef, []string, error) {
+	var mtx sync.Mutex
+	found := map[string]map[string][]tileLibRef{}
+	genomes := map[string]bool{}
+	throttle := throttle{Max: runtime.GOMAXPROCS(0)}
+	for _, infile := range infiles {
+		infile := infile
+		throttle.Go(func() error {
+			f, err := open(infile)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return DecodeLibrary(f, strings.HasSuffix(infile, ".gz"), func(ent *LibraryEntry) error {
+				mtx.Lock()
+				defer mtx.Unlock()
+				for _, cg := range ent.CompactGenomes {
+					genomes[cg.Name] = true
+				}
+				for _, cs := range ent.CompactSequences {
+					if needRef && (refname == "" || cs.Name == refname) {
+						found[cs.Name] = cs.TileSequences
+					}
+				}
+				return nil
+			})
+		})
+	}
+	if err := throttle.Wait(); err != nil {
+		return nil, nil, err
+	}
+	names := make([]string, 0, len(genomes))
+	for name := range genomes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if !needRef {
+		return nil, names, nil
+	}
+	if len(found) == 0 && refname != "" {
+		return nil, nil, fmt.Errorf("reference sequence %q not found", refname)
+	} else if len(found) == 0 {
+		return nil, nil, errors.New("no reference sequence found")
+	} else if len(found) > 1 {
+		var refnames []string
+		for name := range found {
+			refnames = append(refnames, name)
+		}
+		sort.Strings(refnames)
+		return nil, nil, fmt.Errorf("multiple reference sequences found (%s), need to specify one with -ref", strings.Join(refnames, ", "))
+	}
+	for _, refseq := range found {
+		return refseq, names, nil
+	}
+	panic("unreachable")
+}
+
+// writeSliceManifest writes chunks.csv, with the filename,
+// chromosome, tag range, and sample range of each output file, and
+// genomes.csv, with the index (used in chunks.csv sample ranges) and
+// name of each genome.
+func writeSliceManifest(dstdir string, chunks []sliceChunk, genomes []string, samplesPerSlice int) error {
+	f, err := os.Create(dstdir + "/chunks.csv")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriter(f)
+	nblocks := sampleBlocks(len(genomes), samplesPerSlice)
+	fmt.Fprintf(bufw, "Filename,Chromosome,StartTag,EndTag,StartSample,EndSample\n")
+	for i, chunk := range chunks {
+		for block := 0; block < nblocks; block++ {
+			start, end := sampleBlockRange(block, len(genomes), samplesPerSlice)
+			fmt.Fprintf(bufw, "%s,%s,%d,%d,%d,%d\n", sliceFilename(i, block, nblocks), chunk.seqname, chunk.start, chunk.end, start, end)
+		}
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	f, err = os.Create(dstdir + "/genomes.csv")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw = bufio.NewWriter(f)
+	fmt.Fprintf(bufw, "Index,Name\n")
+	for i, name := range genomes {
+		fmt.Fprintf(bufw, "%d,%s\n", i, name)
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// sampleBlocks returns the number of sample blocks needed for the
+// given number of genomes (1 if samplesPerSlice is 0).
+func sampleBlocks(genomes, samplesPerSlice int) int {
+	if samplesPerSlice <= 0 || genomes == 0 {
+		return 1
+	}
+	return (genomes + samplesPerSlice - 1) / samplesPerSlice
+}
+
+// sampleBlockRange returns the range of genome indices [start, end)
+// in the given sample block.
+func sampleBlockRange(block, genomes, samplesPerSlice int) (int, int) {
+	if samplesPerSlice <= 0 {
+		return 0, genomes
+	}
+	start, end := block*samplesPerSlice, (block+1)*samplesPerSlice
+	if end > genomes {
+		end = genomes
+	}
+	return start, end
+}
+
+func sliceFilename(chunkIdx, block, nblocks int) string {
+	if nblocks > 1 {
+		return fmt.Sprintf("library%04d.%04d.gob.gz", chunkIdx, block)
+	}
+	return fmt.Sprintf("library%04d.gob.gz", chunkIdx)
+}
+
+// SliceOptions control how Slice splits its output into files.
+type SliceOptions struct {
+	// Maximum number of tags per file.
+	TagsPerFile int
+
+	// If > 0, genomes are also split into blocks of
+	// SamplesPerSlice genomes, and each tag range is written to a
+	// separate file for each sample block. Each of these files
+	// has all of the tile variants for its tag range, so it can
+	// be processed independently. The reference sequences are
+	// written to the first file.
+	SamplesPerSlice int
+
+	// If true, file boundaries are also aligned with chromosome
+	// boundaries in the reference sequence named RefName (see
+	// chromosomeSliceChunks).
+	ByChromosome bool
+	RefName      string
+
+	// If true, each output file is rewritten in indexed form (see
+	// libio.WriteIndexed) after slicing.
+	Index bool
+
+	// If non-nil, only the selected genomes are written to the
+	// output files. This requires an extra pass over the input
+	// files to check the genome list, if any.
+	Genomes *GenomeSelector
+}
+
 // Read tags+tiles+genomes from srcdir, write to dstdir with (up to)
 // the specified number of tags per file.
-func Slice(tagsPerFile int, dstdir string, srcdirs []string) error {
+//
+// The ByChromosome, SamplesPerSlice, and Genomes options require an
+// extra pass over the input files, and write a manifest to chunks.csv and
+// genomes.csv (see writeSliceManifest).
+func Slice(dstdir string, srcdirs []string, opts SliceOptions) error {
+	tagsPerFile, samplesPerSlice := opts.TagsPerFile, opts.SamplesPerSlice
+	byChromosome, refname := opts.ByChromosome, opts.RefName
 	var infiles []string
 	for _, srcdir := range srcdirs {
 		files, err := allFiles(srcdir, matchGobFile)
@@ -115,6 +398,9 @@ func Slice(tagsPerFile int, dstdir string, srcdirs []string) error {
 		}
 		infiles = append(infiles, files...)
 	}
+	if err := checkTagSets(infiles); err != nil {
+		return err
+	}
 	// dirNamespace[dir] is an int in [0,len(dirNamespace)), used below to
 	// namespace variant numbers from different dirs.
 	dirNamespace := map[string]tileVariantID{}
@@ -126,9 +412,47 @@ func Slice(tagsPerFile int, dstdir string, srcdirs []string) error {
 	}
 	namespaces := tileVariantID(len(dirNamespace))
 
+	var refseq map[string][]tileLibRef
+	var genomes []string
+	nblocks := 1
+	genomeBlock := map[string]int{}
+	// keepGenome[name] is true for the selected genomes, if
+	// opts.Genomes is non-nil.
+	var keepGenome map[string]bool
+	if byChromosome || samplesPerSlice > 0 || opts.Genomes != nil {
+		log.Printf("scanning input for genome names and reference sequences")
+		var err error
+		refseq, genomes, err = sliceScan(infiles, byChromosome, refname)
+		if err != nil {
+			return err
+		}
+		if opts.Genomes != nil {
+			genomes, err = opts.Genomes.Select(genomes)
+			if err != nil {
+				return err
+			}
+			if len(genomes) == 0 {
+				return fmt.Errorf("no genomes found matching %s", opts.Genomes)
+			}
+			keepGenome = make(map[string]bool, len(genomes))
+			for _, name := range genomes {
+				keepGenome[name] = true
+			}
+		}
+		nblocks = sampleBlocks(len(genomes), samplesPerSlice)
+		for block := 0; block < nblocks; block++ {
+			start, end := sampleBlockRange(block, len(genomes), samplesPerSlice)
+			for _, name := range genomes[start:end] {
+				genomeBlock[name] = block
+			}
+		}
+		log.Printf("found %d genomes, %d sample blocks", len(genomes), nblocks)
+	}
+
 	var (
 		tagset     [][]byte
 		tagsetOnce sync.Once
+		chunks     []sliceChunk
 		fs         []*os.File
 		bufws      []*bufio.Writer
 		gzws       []*pgzip.Writer
@@ -137,6 +461,12 @@ func Slice(tagsPerFile int, dstdir string, srcdirs []string) error {
 		countTileVariants int64
 		countGenomes      int64
 		countReferences   int64
+
+		// names of reference sequences already written
+		// (imports that use the same ref library all include
+		// the same reference sequences)
+		refsWritten    = map[string]bool{}
+		refsWrittenMtx sync.Mutex
 	)
 
 	throttle := throttle{Max: runtime.GOMAXPROCS(0)}
@@ -158,14 +488,26 @@ func Slice(tagsPerFile int, dstdir string, srcdirs []string) error {
 				if len(ent.TagSet) > 0 {
 					tagsetOnce.Do(func() {
 						tagset = ent.TagSet
+						if byChromosome {
+							chunks = chromosomeSliceChunks(len(tagset), tagsPerFile, refseq)
+						} else {
+							chunks = fixedSliceChunks(len(tagset), tagsPerFile)
+						}
+						if byChromosome || samplesPerSlice > 0 {
+							err := writeSliceManifest(dstdir, chunks, genomes, samplesPerSlice)
+							if err != nil {
+								throttle.Report(err)
+								return
+							}
+						}
 						var err error
-						fs, bufws, gzws, encs, err = openOutFiles(dstdir, len(ent.TagSet), tagsPerFile)
+						fs, bufws, gzws, encs, err = openOutFiles(dstdir, len(chunks), nblocks)
 						if err != nil {
 							throttle.Report(err)
 							return
 						}
 						for _, enc := range encs {
-							err = enc.Encode(LibraryEntry{TagSet: tagset})
+							err = encodeTagSet(enc, tagset)
 							if err != nil {
 								throttle.Report(err)
 								return
@@ -179,32 +521,46 @@ func Slice(tagsPerFile int, dstdir string, srcdirs []string) error {
 				atomic.AddInt64(&countTileVariants, int64(len(ent.TileVariants)))
 				for _, tv := range ent.TileVariants {
 					tv.Variant = tv.Variant*namespaces + namespace
-					fileno := 0
-					if !tv.Ref {
-						fileno = int(tv.Tag) / tagsPerFile
+					if tv.Ref {
+						err := encs[0].Encode(LibraryEntry{
+							TileVariants: []TileVariant{tv},
+						})
+						if err != nil {
+							return err
+						}
+						continue
 					}
-					err := encs[fileno].Encode(LibraryEntry{
-						TileVariants: []TileVariant{tv},
-					})
-					if err != nil {
-						return err
+					chunk := sort.Search(len(chunks), func(i int) bool { return chunks[i].end > tv.Tag })
+					for block := 0; block < nblocks; block++ {
+						err := encs[chunk*nblocks+block].Encode(LibraryEntry{
+							TileVariants: []TileVariant{tv},
+						})
+						if err != nil {
+							return err
+						}
 					}
 				}
 				// Here, each output file gets a
 				// CompactGenome entry for each
-				// genome, even if there are no
-				// variants in the relevant range.
-				// Easier for downstream code.
-				atomic.AddInt64(&countGenomes, int64(len(ent.CompactGenomes)))
+				// genome in its sample block, even if
+				// there are no variants in the
+				// relevant range. Easier for
+				// downstream code.
 				for _, cg := range ent.CompactGenomes {
+					if keepGenome != nil && !keepGenome[cg.Name] {
+						continue
+					}
+					atomic.AddInt64(&countGenomes, 1)
 					for i, v := range cg.Variants {
 						if v > 0 {
 							cg.Variants[i] = v*namespaces + namespace
 						}
 					}
-					for i, enc := range encs {
-						start := i * tagsPerFile
-						end := start + tagsPerFile
+					block := genomeBlock[cg.Name]
+					for i := range chunks {
+						enc := encs[i*nblocks+block]
+						start := int(chunks[i].start)
+						end := int(chunks[i].end)
 						if max := len(cg.Variants)/2 + int(cg.StartTag); end > max {
 							end = max
 						}
@@ -216,10 +572,11 @@ func Slice(tagsPerFile int, dstdir string, srcdirs []string) error {
 							variants = cg.Variants[(start-int(cg.StartTag))*2 : (end-int(cg.StartTag))*2]
 						}
 						err := enc.Encode(LibraryEntry{CompactGenomes: []CompactGenome{{
-							Name:     cg.Name,
-							Variants: variants,
-							StartTag: tagID(start),
-							EndTag:   tagID(start + tagsPerFile),
+							Name:         cg.Name,
+							Variants:     variants,
+							StartTag:     tagID(start),
+							EndTag:       chunks[i].end,
+							Heteroplasmy: libio.TrimHeteroplasmy(cg.Heteroplasmy, tagID(start), tagID(end)),
 						}}})
 						if err != nil {
 							return err
@@ -228,16 +585,25 @@ func Slice(tagsPerFile int, dstdir string, srcdirs []string) error {
 				}
 				// Write all ref seqs to the first
 				// slice. Easier for downstream code.
-				atomic.AddInt64(&countReferences, int64(len(ent.CompactSequences)))
-				if len(ent.CompactSequences) > 0 {
-					for _, cs := range ent.CompactSequences {
+				var css []CompactSequence
+				refsWrittenMtx.Lock()
+				for _, cs := range ent.CompactSequences {
+					if !refsWritten[cs.Name] {
+						refsWritten[cs.Name] = true
+						css = append(css, cs)
+					}
+				}
+				refsWrittenMtx.Unlock()
+				atomic.AddInt64(&countReferences, int64(len(css)))
+				if len(css) > 0 {
+					for _, cs := range css {
 						for _, tseq := range cs.TileSequences {
 							for i, libref := range tseq {
 								tseq[i].Variant = libref.Variant*namespaces + namespace
 							}
 						}
 					}
-					err := encs[0].Encode(LibraryEntry{CompactSequences: ent.CompactSequences})
+					err := encs[0].Encode(LibraryEntry{CompactSequences: css})
 					if err != nil {
 						return err
 					}
@@ -252,17 +618,81 @@ func Slice(tagsPerFile int, dstdir string, srcdirs []string) error {
 		return throttle.Err()
 	}
 	defer log.Printf("Total %d tile variants, %d genomes, %d reference sequences", countTileVariants, countGenomes, countReferences)
-	return closeOutFiles(fs, bufws, gzws, encs)
+	err := closeOutFiles(fs, bufws, gzws, encs)
+	if err != nil || !opts.Index {
+		return err
+	}
+	var fnms []string
+	for _, f := range fs {
+		fnms = append(fnms, f.Name())
+	}
+	return indexSliceFiles(fnms)
+}
+
+func indexSliceFiles(fnms []string) error {
+	// Each file is decoded into memory, so use less concurrency
+	// than the slicing stage.
+	throttle := throttle{Max: runtime.GOMAXPROCS(0)/8 + 1}
+	for _, fnm := range fnms {
+		fnm := fnm
+		throttle.Go(func() error {
+			log.Printf("indexing %s", fnm)
+			return indexSliceFile(fnm)
+		})
+	}
+	return throttle.Wait()
+}
+
+// indexSliceFile rewrites a library file in indexed form (see
+// libio.WriteIndexed).
+func indexSliceFile(fnm string) error {
+	var tagset [][]byte
+	var css []CompactSequence
+	var cgs []CompactGenome
+	var tvs []TileVariant
+	f, err := os.Open(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = DecodeLibrary(f, strings.HasSuffix(fnm, ".gz"), func(ent *LibraryEntry) error {
+		if len(ent.TagSet) > 0 {
+			tagset = ent.TagSet
+		}
+		css = append(css, ent.CompactSequences...)
+		cgs = append(cgs, ent.CompactGenomes...)
+		tvs = append(tvs, ent.TileVariants...)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", fnm, err)
+	}
+	f.Close()
+	tmp, err := os.Create(fnm + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	err = libio.WriteIndexed(tmp, tagset, css, cgs, tvs, sliceIndexBlockTags)
+	if err != nil {
+		return fmt.Errorf("%s: %w", tmp.Name(), err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fnm)
 }
 
-func openOutFiles(dstdir string, tags, tagsPerFile int) (fs []*os.File, bufws []*bufio.Writer, gzws []*pgzip.Writer, encs []*gob.Encoder, err error) {
-	nfiles := (tags + tagsPerFile - 1) / tagsPerFile
+func openOutFiles(dstdir string, nchunks, nblocks int) (fs []*os.File, bufws []*bufio.Writer, gzws []*pgzip.Writer, encs []*gob.Encoder, err error) {
+	nfiles := nchunks * nblocks
 	fs = make([]*os.File, nfiles)
 	bufws = make([]*bufio.Writer, nfiles)
 	gzws = make([]*pgzip.Writer, nfiles)
 	encs = make([]*gob.Encoder, nfiles)
-	for i := 0; i*tagsPerFile < tags; i++ {
-		fs[i], err = os.Create(dstdir + fmt.Sprintf("/library%04d.gob.gz", i))
+	for i := 0; i < nfiles; i++ {
+		fs[i], err = os.Create(dstdir + "/" + sliceFilename(i/nblocks, i%nblocks, nblocks))
 		if err != nil {
 			return
 		}
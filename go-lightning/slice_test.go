@@ -5,10 +5,15 @@
 package lightning
 
 import (
+	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 
+	"github.com/arvados/lightning/go-lightning/libio"
 	"github.com/kshedden/gonpy"
 	"gopkg.in/check.v1"
 )
@@ -81,6 +86,63 @@ func (s *sliceSuite) TestImportAndSlice(c *check.C) {
 	out, _ := exec.Command("find", slicedir, "-ls").CombinedOutput()
 	c.Logf("%s", out)
 
+	c.Log("=== slice -samples-per-slice ===")
+	{
+		shardeddir := c.MkDir()
+		exited := (&slicecmd{}).RunCommand("slice", []string{
+			"-local=true",
+			"-output-dir=" + shardeddir,
+			"-tags-per-file=2",
+			"-samples-per-slice=1",
+			"-index",
+			tmpdir + "/lib1",
+			tmpdir + "/lib2",
+			tmpdir + "/lib3",
+		}, nil, os.Stderr, os.Stderr)
+		c.Check(exited, check.Equals, 0)
+		manifest, err := ioutil.ReadFile(shardeddir + "/chunks.csv")
+		c.Assert(err, check.IsNil)
+		c.Logf("%s", manifest)
+		lines := strings.Split(strings.TrimSpace(string(manifest)), "\n")
+		c.Check(lines[0], check.Equals, "Filename,Chromosome,StartTag,EndTag,StartSample,EndSample")
+		for _, line := range lines[1:] {
+			f, err := os.Open(shardeddir + "/" + strings.Split(line, ",")[0])
+			if !c.Check(err, check.IsNil) {
+				continue
+			}
+			indexed, err := libio.IsIndexed(f)
+			c.Check(err, check.IsNil)
+			c.Check(indexed, check.Equals, true)
+			f.Close()
+		}
+		files, err := filepath.Glob(shardeddir + "/*.gob.gz")
+		c.Check(err, check.IsNil)
+		c.Check(files, check.HasLen, len(lines)-1)
+		genomes, err := ioutil.ReadFile(shardeddir + "/genomes.csv")
+		c.Check(err, check.IsNil)
+		c.Check(string(genomes), check.Matches, `(?ms)Index,Name\n0,.*`)
+	}
+
+	c.Log("=== slice -exclude-genome ===")
+	{
+		selecteddir := c.MkDir()
+		exited := (&slicecmd{}).RunCommand("slice", []string{
+			"-local=true",
+			"-output-dir=" + selecteddir,
+			"-tags-per-file=2",
+			"-samples-per-slice=1",
+			"-exclude-genome=pipeline1dup",
+			tmpdir + "/lib1",
+			tmpdir + "/lib2",
+			tmpdir + "/lib3",
+		}, nil, os.Stderr, os.Stderr)
+		c.Check(exited, check.Equals, 0)
+		genomes, err := ioutil.ReadFile(selecteddir + "/genomes.csv")
+		c.Assert(err, check.IsNil)
+		c.Check(strings.Count(string(genomes), "\n"), check.Equals, 3)
+		c.Check(string(genomes), check.Not(check.Matches), `(?ms).*pipeline1dup.*`)
+	}
+
 	c.Log("=== dump ===")
 	{
 		dumpdir := c.MkDir()
@@ -144,6 +206,73 @@ func (s *sliceSuite) TestImportAndSlice(c *check.C) {
 		}
 	}
 
+	c.Log("=== slice-numpy -min-sample-coverage ===")
+	{
+		npydir := c.MkDir()
+		exited := (&sliceNumpy{}).RunCommand("slice-numpy", []string{
+			"-local=true",
+			"-input-dir=" + slicedir,
+			"-output-dir=" + npydir,
+			"-min-sample-coverage=0.01",
+		}, nil, os.Stderr, os.Stderr)
+		c.Check(exited, check.Equals, 0)
+		report, err := ioutil.ReadFile(npydir + "/sample-coverage.csv")
+		c.Assert(err, check.IsNil)
+		c.Logf("%s", report)
+		lines := strings.Split(strings.TrimSpace(string(report)), "\n")
+		c.Check(lines[0], check.Equals, "Index,SampleID,Called,Total,Coverage,Dropped")
+		c.Check(lines[1:], check.HasLen, 4)
+		for _, line := range lines[1:] {
+			c.Check(line, check.Matches, `.*,false`)
+		}
+	}
+
+	c.Log("=== slice-numpy -length-deviation ===")
+	{
+		npydir := c.MkDir()
+		exited := (&sliceNumpy{}).RunCommand("slice-numpy", []string{
+			"-local=true",
+			"-input-dir=" + slicedir,
+			"-output-dir=" + npydir,
+			"-length-deviation",
+		}, nil, os.Stderr, os.Stderr)
+		c.Check(exited, check.Equals, 0)
+		f, err := os.Open(npydir + "/length-deviation.0000.npy")
+		c.Assert(err, check.IsNil)
+		defer f.Close()
+		npy, err := gonpy.NewReader(f)
+		c.Assert(err, check.IsNil)
+		c.Check(npy.Shape, check.DeepEquals, []int{4, 4})
+		devs, err := npy.GetInt16()
+		c.Assert(err, check.IsNil)
+		c.Logf("%v", devs)
+		matrix := []int16{2, 1, 1, 2, -1, -1, 1, 1, 2, 1, 1, 2, -1, -1, 1, 1}
+		called := 0
+		for i, dev := range devs {
+			if matrix[i] < 0 {
+				c.Check(dev, check.Equals, int16(math.MinInt16))
+			} else if dev != math.MinInt16 {
+				c.Check(dev > -1000 && dev < 1000, check.Equals, true)
+				called++
+			}
+		}
+		c.Check(called > 0, check.Equals, true)
+
+		exited = (&sliceNumpy{}).RunCommand("slice-numpy", []string{
+			"-local=true",
+			"-input-dir=" + slicedir,
+			"-output-dir=" + npydir,
+			"-chunked-onehot",
+			"-include-variant-1",
+			"-length-deviation",
+		}, nil, os.Stderr, os.Stderr)
+		c.Check(exited, check.Equals, 0)
+		csv, err := ioutil.ReadFile(npydir + "/onehot-length-deviation.0000.csv")
+		c.Assert(err, check.IsNil)
+		c.Logf("%s", csv)
+		c.Check(string(csv), check.Matches, `ColumnID,Column,Tag,Variant,Hom,Deviation\n(.*,.*,.*,.*,.*,-?[0-9]*\n)+`)
+	}
+
 	c.Log("=== slice-numpy + regions ===")
 	{
 		npydir := c.MkDir()
@@ -201,6 +330,7 @@ func (s *sliceSuite) TestImportAndSlice(c *check.C) {
 			"-input-dir=" + slicedir,
 			"-output-dir=" + npydir,
 			"-merge-output=true",
+			"-sort-annotations=true",
 			"-single-hgvs-matrix=true",
 		}, nil, os.Stderr, os.Stderr)
 		c.Check(exited, check.Equals, 0)
@@ -233,6 +363,21 @@ func (s *sliceSuite) TestImportAndSlice(c *check.C) {
 		} {
 			c.Check(string(annotations), check.Matches, "(?ms).*"+s+".*")
 		}
+
+		sorted, err := ioutil.ReadFile(npydir + "/matrix.sorted.annotations.csv")
+		c.Assert(err, check.IsNil)
+		c.Check(sorted, check.HasLen, len(annotations))
+		c.Check(string(sorted), check.Matches, `(?ms)(0,0,[^\n]*,chr1,[^\n]*\n)+(4,1,[^\n]*,chr2,[^\n]*\n)+`)
+
+		f, err = os.Open(npydir + "/matrix.sorted-columns.npy")
+		c.Assert(err, check.IsNil)
+		defer f.Close()
+		npy, err = gonpy.NewReader(f)
+		c.Assert(err, check.IsNil)
+		c.Check(npy.Shape, check.DeepEquals, []int{1, 4})
+		perm, err := npy.GetInt32()
+		c.Check(err, check.IsNil)
+		c.Check(perm, check.DeepEquals, []int32{0, 1, 2, 3})
 	}
 
 	c.Log("=== slice-numpy + chunked hgvs matrix ===")
@@ -362,6 +507,7 @@ pipeline1dup/input2	0
 			"-input-dir=" + slicedir,
 			"-output-dir=" + npydir,
 			"-debug-tag=1",
+			"-split-output=true",
 		}, nil, os.Stderr, os.Stderr)
 		c.Check(exited, check.Equals, 0)
 		out, _ := exec.Command("find", npydir, "-ls").CombinedOutput()
@@ -389,13 +535,14 @@ pipeline1dup/input2	0
 		defer f.Close()
 		npy, err = gonpy.NewReader(f)
 		c.Assert(err, check.IsNil)
-		c.Check(npy.Shape, check.DeepEquals, []int{5, 6})
+		c.Check(npy.Shape, check.DeepEquals, []int{8, 6})
 		onehotcols, err := npy.GetInt32()
 		if c.Check(err, check.IsNil) {
 			for r := 0; r < npy.Shape[0]; r++ {
 				c.Logf("%v", onehotcols[r*npy.Shape[1]:(r+1)*npy.Shape[1]])
 			}
-			c.Check(onehotcols, check.DeepEquals, []int32{
+			checkOnehotColumnCoordinates(c, npydir, onehotcols, 6)
+			c.Check(onehotcols[:5*6], check.DeepEquals, []int32{
 				1, 4, 4, 4, 6, 6,
 				2, 2, 3, 4, 2, 3,
 				0, 0, 0, 0, 0, 0,
@@ -403,6 +550,131 @@ pipeline1dup/input2	0
 				803273, 803273, 803273, 803273, 803273, 803273,
 			})
 		}
+
+		colids, err := loadColumnIDs(npydir + "/onehot-column-ids.csv")
+		c.Assert(err, check.IsNil)
+		c.Check(colids, check.HasLen, 6)
+		for id, col := range colids {
+			c.Check(id, check.Matches, `[0-9]+:[0-9a-f]{64}:(hom|het)`)
+			c.Check(col >= 0 && col < 6, check.Equals, true)
+		}
+
+		outputs, err := ioutil.ReadFile(npydir + "/outputs.json")
+		c.Assert(err, check.IsNil)
+		c.Check(string(outputs), check.Matches, `(?ms).*"file": "onehot-columns.npy",\s*"kind": "onehot-columns",\s*"dtype": "int32",\s*"shape": \[\s*8,\s*6\s*\].*`)
+
+		samples, err := loadSampleInfo(npydir + "/samples.csv")
+		c.Assert(err, check.IsNil)
+		splitNZ := 0
+		for _, split := range []string{"train", "val"} {
+			var want []int8
+			for _, si := range samples {
+				if si.isTraining == (split == "train") && (si.isTraining || si.isValidation) {
+					if si.isCase {
+						want = append(want, 1)
+					} else {
+						want = append(want, 0)
+					}
+				}
+			}
+			f, err := os.Open(npydir + "/y." + split + ".npy")
+			c.Assert(err, check.IsNil)
+			defer f.Close()
+			npy, err := gonpy.NewReader(f)
+			c.Assert(err, check.IsNil)
+			y, err := npy.GetInt8()
+			c.Check(err, check.IsNil)
+			c.Check(y, check.DeepEquals, want)
+
+			f, err = os.Open(npydir + "/onehot." + split + ".npy")
+			c.Assert(err, check.IsNil)
+			defer f.Close()
+			npy, err = gonpy.NewReader(f)
+			c.Assert(err, check.IsNil)
+			c.Check(npy.Shape[0], check.Equals, 2)
+			onehot, err := npy.GetUint32()
+			c.Check(err, check.IsNil)
+			for _, row := range onehot[:npy.Shape[1]] {
+				c.Check(int(row) < len(want), check.Equals, true)
+			}
+			splitNZ += npy.Shape[1]
+		}
+		c.Check(splitNZ, check.Equals, 12)
+	}
+
+	c.Log("=== slice-numpy + onehotSingle + aggregateOnly ===")
+	{
+		npydir := c.MkDir()
+		exited := (&sliceNumpy{}).RunCommand("slice-numpy", []string{
+			"-local=true",
+			"-single-onehot=true",
+			"-aggregate-only=true",
+			"-samples=" + tmpdir + "/samples.csv",
+			"-chi2-p-value=0.5",
+			"-min-coverage=0.75",
+			"-input-dir=" + slicedir,
+			"-output-dir=" + npydir,
+		}, nil, os.Stderr, os.Stderr)
+		c.Check(exited, check.Equals, 0)
+		out, _ := exec.Command("find", npydir, "-ls").CombinedOutput()
+		c.Logf("%s", out)
+
+		for _, fnm := range []string{"onehot.npy", "samples.csv"} {
+			_, err := os.Stat(npydir + "/" + fnm)
+			c.Check(os.IsNotExist(err), check.Equals, true, check.Commentf("%s", fnm))
+		}
+		_, err := os.Stat(npydir + "/onehot-columns.npy")
+		c.Check(err, check.IsNil)
+		buf, err := ioutil.ReadFile(npydir + "/onehot-aggregates.csv")
+		c.Assert(err, check.IsNil)
+		c.Logf("%s", buf)
+		lines := strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+		c.Check(lines[0], check.Equals, "ColumnID,Column,Tag,Variant,Hom,Count,Total,MAF,PValue")
+		c.Check(lines, check.HasLen, 7)
+		for _, line := range lines[1:] {
+			c.Check(line, check.Matches, `[0-9]+:[0-9a-f]{64}:(hom|het),[0-9]+,[0-9]+,[0-9]+,[01],[0-9]+,[0-9]+,[0-9.e-]+,0\.157299.*`)
+		}
+
+		exited = (&sliceNumpy{}).RunCommand("slice-numpy", []string{
+			"-local=true",
+			"-single-onehot=true",
+			"-aggregate-only=true",
+			"-merge-output=true",
+			"-input-dir=" + slicedir,
+			"-output-dir=" + npydir,
+		}, nil, os.Stderr, os.Stderr)
+		c.Check(exited, check.Equals, 1)
+	}
+
+	c.Log("=== slice-numpy + pca ===")
+	{
+		samplesIn, err := ioutil.ReadFile(tmpdir + "/samples.csv")
+		c.Assert(err, check.IsNil)
+
+		npydir := c.MkDir()
+		exited := (&sliceNumpy{}).RunCommand("slice-numpy", []string{
+			"-local=true",
+			"-pca=true",
+			"-pca-components=2",
+			"-samples=" + tmpdir + "/samples.csv",
+			"-min-coverage=0.75",
+			"-input-dir=" + slicedir,
+			"-output-dir=" + npydir,
+		}, nil, os.Stderr, os.Stderr)
+		c.Check(exited, check.Equals, 0)
+
+		// samples.csv is a faithful copy of the input
+		samplesOut, err := ioutil.ReadFile(npydir + "/samples.csv")
+		c.Assert(err, check.IsNil)
+		c.Check(string(samplesOut), check.Equals, string(samplesIn))
+
+		// PCA components go in pca.samples.csv
+		samples, err := loadSampleInfo(npydir + "/pca.samples.csv")
+		c.Assert(err, check.IsNil)
+		c.Check(samples, check.HasLen, 4)
+		for _, si := range samples {
+			c.Check(si.pcaComponents, check.HasLen, 2)
+		}
 	}
 }
 
@@ -527,6 +799,70 @@ func (s *sliceSuite) TestSpanningTile(c *check.C) {
 		}
 	}
 
+	c.Log("=== slice-numpy -mark-spanning ===")
+	{
+		// with 4 tags per file, the spanning tile at tag 5
+		// and the tag it covers (6) are in the same chunk
+		slicedir4 := c.MkDir()
+		exited := (&slicecmd{}).RunCommand("slice", []string{
+			"-local=true",
+			"-output-dir=" + slicedir4,
+			"-tags-per-file=4",
+			tmpdir + "/lib1",
+			tmpdir + "/lib2",
+		}, nil, os.Stderr, os.Stderr)
+		c.Assert(exited, check.Equals, 0)
+		plaindir, markdir := c.MkDir(), c.MkDir()
+		for _, trial := range []struct {
+			dir  string
+			mark bool
+		}{{plaindir, false}, {markdir, true}} {
+			exited := (&sliceNumpy{}).RunCommand("slice-numpy", []string{
+				"-local=true",
+				"-input-dir=" + slicedir4,
+				"-output-dir=" + trial.dir,
+				"-mark-spanning=" + fmt.Sprintf("%v", trial.mark),
+			}, nil, os.Stderr, os.Stderr)
+			c.Assert(exited, check.Equals, 0)
+		}
+		fnms, err := filepath.Glob(plaindir + "/matrix.*.npy")
+		c.Assert(err, check.IsNil)
+		c.Assert(fnms, check.Not(check.HasLen), 0)
+		spanned := 0
+		for _, fnm := range fnms {
+			var variants [2][]int16
+			for i, dir := range []string{plaindir, markdir} {
+				f, err := os.Open(dir + "/" + filepath.Base(fnm))
+				c.Assert(err, check.IsNil)
+				defer f.Close()
+				npy, err := gonpy.NewReader(f)
+				c.Assert(err, check.IsNil)
+				variants[i], err = npy.GetInt16()
+				c.Assert(err, check.IsNil)
+			}
+			c.Assert(variants[1], check.HasLen, len(variants[0]))
+			// only "tag not found" entries change, and
+			// only to "spanning tile"
+			for i, v := range variants[0] {
+				if variants[1][i] != v {
+					c.Check(v, check.Equals, int16(0), check.Commentf("%s entry %d", fnm, i))
+					c.Check(variants[1][i], check.Equals, tileMatrixSpanning, check.Commentf("%s entry %d", fnm, i))
+					spanned++
+				}
+			}
+		}
+		c.Check(spanned > 0, check.Equals, true)
+
+		exited = (&sliceNumpy{}).RunCommand("slice-numpy", []string{
+			"-local=true",
+			"-input-dir=" + slicedir4,
+			"-output-dir=" + c.MkDir(),
+			"-mark-spanning",
+			"-single-onehot",
+		}, nil, os.Stderr, os.Stderr)
+		c.Check(exited, check.Equals, 1)
+	}
+
 	c.Log("=== slice-numpy + regions ===")
 	{
 		npydir := c.MkDir()
@@ -734,13 +1070,14 @@ spanningtile/input1	1
 		defer f.Close()
 		npy, err = gonpy.NewReader(f)
 		c.Assert(err, check.IsNil)
-		c.Check(npy.Shape, check.DeepEquals, []int{5, 4})
+		c.Check(npy.Shape, check.DeepEquals, []int{8, 4})
 		onehotcols, err := npy.GetInt32()
 		if c.Check(err, check.IsNil) {
 			for r := 0; r < npy.Shape[0]; r++ {
 				c.Logf("%v", onehotcols[r*npy.Shape[1]:(r+1)*npy.Shape[1]])
 			}
-			c.Check(onehotcols, check.DeepEquals, []int32{
+			checkOnehotColumnCoordinates(c, npydir, onehotcols, 4)
+			c.Check(onehotcols[:5*4], check.DeepEquals, []int32{
 				1, 1, 5, 5,
 				2, 2, 2, 2,
 				1, 0, 1, 0,
@@ -751,6 +1088,26 @@ spanningtile/input1	1
 	}
 }
 
+// checkOnehotColumnCoordinates checks that the chromosome and
+// position rows of onehot-columns.npy are consistent with
+// chromosomes.csv.
+func checkOnehotColumnCoordinates(c *check.C, npydir string, onehotcols []int32, cols int) {
+	chroms, err := ioutil.ReadFile(npydir + "/chromosomes.csv")
+	c.Assert(err, check.IsNil)
+	lines := strings.Split(strings.TrimSpace(string(chroms)), "\n")
+	c.Check(lines[0], check.Equals, "Index,Chromosome")
+	nchroms := len(lines) - 1
+	for i := 0; i < cols; i++ {
+		chrom, pos := onehotcols[cols*6+i], onehotcols[cols*7+i]
+		if chrom < 0 {
+			c.Check(pos, check.Equals, int32(-1))
+			continue
+		}
+		c.Check(int(chrom) < nchroms, check.Equals, true)
+		c.Check(pos >= 0, check.Equals, true)
+	}
+}
+
 func (s *sliceSuite) Test_tv2homhet(c *check.C) {
 	cmd := &sliceNumpy{
 		cgnames:         []string{"sample1", "sample2", "sample3", "sample4"},
@@ -802,3 +1159,154 @@ func (s *sliceSuite) Test_tv2homhet(c *check.C) {
 		}
 	}
 }
+
+func (s *sliceSuite) TestHomhetHaploid(c *check.C) {
+	cmd := &sliceNumpy{
+		cgnames:         []string{"sample1", "sample2", "sample3"},
+		trainingSet:     []int{0, 1, 2},
+		trainingSetSize: 3,
+		includeVariant1: true,
+		minCoverageAll:  true,
+		maxFrequency:    1,
+		debugTag:        -1,
+		haploidTags:     map[tagID]bool{0: true},
+	}
+	cgs := map[string]CompactGenome{
+		"sample1": {Variants: []tileVariantID{1, 1}}, // tv=1
+		"sample2": {Variants: []tileVariantID{2, 2}}, // tv=2
+		"sample3": {Variants: []tileVariantID{1, 2}}, // tv=1, secondary tv=2
+	}
+	fakevariant := TileVariant{Sequence: []byte("ACGT")}
+	seq := map[tagID][]TileVariant{0: {{}, fakevariant, fakevariant}}
+	onehot, xref, _ := cmd.homhetCandidates(cgs, 2, []tileVariantID{0, 1, 2}, 0, 0, seq)
+	c.Check(onehot, check.DeepEquals, [][]int8{{1, 0, 1}, {0, 0, 0}, {0, 1, 0}, {0, 0, 1}})
+	c.Assert(xref, check.HasLen, 4)
+	c.Check(xref[0].maf, check.Equals, 2.0/3)
+	c.Check(xref[2].maf, check.Equals, 1.0/3)
+}
+
+func (s *sliceSuite) TestSampleInfoPhenotypes(c *check.C) {
+	tmpdir := c.MkDir()
+	err := ioutil.WriteFile(tmpdir+"/samples.csv", []byte(`Index,SampleID,CaseControl,TrainingValidation,PCA0,Height,Diabetes,Covariate:Age
+0,input1,1,1,0.500000,0,1,34
+1,input2,0,1,-0.250000,1,,51.5
+2,input3,,0,0.125000,1,0,8
+`), 0600)
+	c.Assert(err, check.IsNil)
+	samples, err := loadSampleInfo(tmpdir + "/samples.csv")
+	c.Assert(err, check.IsNil)
+	c.Assert(samples, check.HasLen, 3)
+	c.Check(samples[1].pcaComponents, check.DeepEquals, []float64{-0.25})
+	c.Check(samples[1].phenotypes, check.DeepEquals, map[string]string{"Height": "1", "Diabetes": ""})
+	c.Check(samples[1].covariates, check.DeepEquals, map[string]float64{"Age": 51.5})
+
+	outdir := c.MkDir()
+	err = writeSampleInfo(samples, outdir)
+	c.Assert(err, check.IsNil)
+	buf, err := ioutil.ReadFile(outdir + "/samples.csv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, `Index,SampleID,CaseControl,TrainingValidation,PCA0,Diabetes,Height,Covariate:Age
+0,input1,1,1,0.500000,1,0,34
+1,input2,0,1,-0.250000,,1,51.5
+2,input3,,,0.125000,0,1,8
+`)
+
+	err = selectPhenotype(samples, "Diabetes")
+	c.Assert(err, check.IsNil)
+	c.Check(samples[0].isCase, check.Equals, true)
+	c.Check(samples[1].isCase || samples[1].isControl, check.Equals, false)
+	c.Check(samples[2].isControl, check.Equals, true)
+	// input2 has no Diabetes value, so it is no longer in the
+	// training set
+	c.Check(samples[0].isTraining, check.Equals, true)
+	c.Check(samples[1].isTraining, check.Equals, false)
+
+	na := []sampleInfo{
+		{id: "input1", isCase: true, isTraining: true, phenotypes: map[string]string{"P": "NA"}},
+		{id: "input2", isControl: true, isValidation: true, phenotypes: map[string]string{"P": "NA"}},
+		{id: "input3", isTraining: true, phenotypes: map[string]string{"P": "0"}},
+	}
+	err = selectPhenotype(na, "P")
+	c.Assert(err, check.IsNil)
+	for _, si := range na[:2] {
+		c.Check(si.isCase || si.isControl || si.isTraining || si.isValidation, check.Equals, false, check.Commentf("%s", si.id))
+	}
+	c.Check(na[2].isControl, check.Equals, true)
+	c.Check(na[2].isTraining, check.Equals, true)
+
+	err = selectPhenotype(samples, "Weight")
+	c.Check(err, check.ErrorMatches, `phenotype "Weight" not found.*`)
+}
+
+func (s *sliceSuite) TestSampleInfoRoundTrip(c *check.C) {
+	samples := []sampleInfo{
+		{id: "input1", isCase: true, isTraining: true, pcaComponents: []float64{0.5, -1.25}, phenotypes: map[string]string{"P": "1"}, covariates: map[string]float64{"Age": 34}},
+		{id: "input2", isControl: true, isValidation: true, pcaComponents: []float64{0.125, 3}, phenotypes: map[string]string{"P": ""}, covariates: map[string]float64{"Age": 51.5}},
+		{id: "input3", pcaComponents: []float64{0, 0}, phenotypes: map[string]string{"P": "0"}, covariates: map[string]float64{"Age": 0}},
+	}
+	tmpdir := c.MkDir()
+	err := writeSampleInfoFile(samples, tmpdir+"/a.csv")
+	c.Assert(err, check.IsNil)
+	loaded, err := loadSampleInfo(tmpdir + "/a.csv")
+	c.Assert(err, check.IsNil)
+	c.Check(loaded, check.DeepEquals, samples)
+	err = writeSampleInfoFile(loaded, tmpdir+"/b.csv")
+	c.Assert(err, check.IsNil)
+	a, err := ioutil.ReadFile(tmpdir + "/a.csv")
+	c.Assert(err, check.IsNil)
+	b, err := ioutil.ReadFile(tmpdir + "/b.csv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(b), check.Equals, string(a))
+}
+
+func (s *sliceSuite) TestLengthDeviationInt16(c *check.C) {
+	c.Check(lengthDeviationInt16(-3), check.Equals, int16(-3))
+	c.Check(lengthDeviationInt16(40000), check.Equals, int16(math.MaxInt16))
+	c.Check(lengthDeviationInt16(-40000), check.Equals, int16(-math.MaxInt16))
+	c.Check(lengthDeviationInt16(lengthDeviationMissing), check.Equals, int16(math.MinInt16))
+	c.Check(lengthMatrixMissing(lengthDeviationInt16(-40000)), check.Equals, false)
+}
+
+func (s *sliceSuite) TestChromosomeSliceChunks(c *check.C) {
+	refseq := map[string][]tileLibRef{
+		"chr1": {{Tag: 1}, {Tag: 2}, {Tag: 3}, {Tag: 4}, {Tag: 5}},
+		"chr2": {{Tag: 8}, {Tag: 7}, {Tag: 9}},
+		"chrM": {},
+	}
+	c.Check(chromosomeSliceChunks(12, 4, refseq), check.DeepEquals, []sliceChunk{
+		{start: 0, end: 4, seqname: "chr1"},
+		{start: 4, end: 7, seqname: "chr1"},
+		{start: 7, end: 11, seqname: "chr2"},
+		{start: 11, end: 12, seqname: "chr2"},
+	})
+	c.Check(chromosomeSliceChunks(12, 100, refseq), check.DeepEquals, []sliceChunk{
+		{start: 0, end: 7, seqname: "chr1"},
+		{start: 7, end: 12, seqname: "chr2"},
+	})
+	c.Check(fixedSliceChunks(5, 2), check.DeepEquals, []sliceChunk{
+		{start: 0, end: 2},
+		{start: 2, end: 4},
+		{start: 4, end: 6},
+	})
+}
+
+func (s *sliceSuite) TestSampleBlocks(c *check.C) {
+	c.Check(sampleBlocks(10, 0), check.Equals, 1)
+	c.Check(sampleBlocks(10, 3), check.Equals, 4)
+	c.Check(sampleBlocks(9, 3), check.Equals, 3)
+	c.Check(sampleBlocks(0, 3), check.Equals, 1)
+	for _, trial := range []struct {
+		block, genomes, samplesPerSlice int
+		start, end                      int
+	}{
+		{0, 10, 0, 0, 10},
+		{0, 10, 3, 0, 3},
+		{2, 10, 3, 6, 9},
+		{3, 10, 3, 9, 10},
+	} {
+		start, end := sampleBlockRange(trial.block, trial.genomes, trial.samplesPerSlice)
+		c.Check([]int{start, end}, check.DeepEquals, []int{trial.start, trial.end}, check.Commentf("%+v", trial))
+	}
+	c.Check(sliceFilename(3, 0, 1), check.Equals, "library0003.gob.gz")
+	c.Check(sliceFilename(3, 1, 2), check.Equals, "library0003.0001.gob.gz")
+}
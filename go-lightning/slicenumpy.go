@@ -7,6 +7,7 @@ package lightning
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/json"
 	"errors"
@@ -18,6 +19,7 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"runtime/debug"
@@ -25,6 +27,7 @@ import (
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
@@ -40,17 +43,43 @@ import (
 const annotationMaxTileSpan = 100
 
 type sliceNumpy struct {
-	filter             filter
+	filter             Filter
 	threads            int
+	memBudget          int64
+	gcPercent          int
+	gcMemoryLimit      int64
+	pvalueThreads      int
+	pvalueBatchSize    int
 	chi2Cases          []bool
+	strata             []int // training set index => stratum index (see sampleStrata)
+	strataNames        []string
+	ancestry           []int // training set index => ancestry group index (see sampleStrata)
+	ancestryNames      []string
+	excludeTags        excludeTags
+	ancestryFilter     int // index into ancestryNames of -ancestry group, or -1
+	ancestryMinFreq    float64
 	chi2PValue         float64
 	pvalueMinFrequency float64
 	maxFrequency       float64
 	pcaComponents      int
+	pcaClusters        int
+	pcaOutlierSD       float64
 	minCoverage        int
 	minCoverageAll     bool
 	includeVariant1    bool
+	caseControlStats   bool
+	lengthDeviation    bool
+	markSpanning       bool
+	minGroupSize       int
+	aggregateOnly      bool
+	missing            missingEncoding
+	manifest           manifestOptions
+	contigAliases      contigAliasOptions
+	impute             string
+	imputeWindow       int
 	debugTag           tagID
+	haploidChromosome  *regexp.Regexp // nil if -haploid-chromosome is empty
+	haploidTags        map[tagID]bool // reference tags on haploid chromosomes
 
 	cgnames         []string
 	samples         []sampleInfo
@@ -58,6 +87,8 @@ type sliceNumpy struct {
 	trainingSetSize int
 	pvalue          func(onehot []bool) float64
 	pvalueCallCount int64
+	outputs         *outputCatalog
+	partial         *partialOutput
 }
 
 func (cmd *sliceNumpy) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
@@ -78,31 +109,72 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 	arvadosVCPUs := flags.Int("arvados-vcpus", 96, "number of VCPUs to request for arvados container")
 	projectUUID := flags.String("project", "", "project `UUID` for output data")
 	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
 	preemptible := flags.Bool("preemptible", true, "request preemptible instance")
 	inputDir := flags.String("input-dir", "./in", "input `directory`")
 	outputDir := flags.String("output-dir", "./out", "output `directory`")
-	ref := flags.String("ref", "", "reference name (if blank, choose last one that appears in input)")
-	regionsFilename := flags.String("regions", "", "only output columns/annotations that intersect regions in specified bed `file`")
+	tmpDir := flags.String("tmp-dir", "", "write temporary files to `directory` instead of -output-dir (in container mode, any non-empty value means use a scratch volume instead of the output collection)")
+	tmpCompress := flags.Bool("tmp-compress", false, "compress temporary files written by -chunked-hgvs-matrix")
+	watchdogTimeout := flags.Duration("watchdog-timeout", 0, "abort with a goroutine dump if no worker thread starts or finishes for this long, and log long-running workers every 1/4 of this `interval` (0 = disable)")
+	ref := flags.String("ref", "", "reference name (may be blank if input has only one reference; see 'lightning refs')")
+	excludeTagsFilename := flags.String("exclude-tags", "", excludeTagsUsage)
+	regionsFilename := flags.String("regions", "", "only output columns/annotations that intersect regions in specified bed/gff/gtf `files` (comma-separated list of filenames or glob patterns)")
 	expandRegions := flags.Int("expand-regions", 0, "expand specified regions by `N` base pairs on each side`")
+	var rfilter regionsFilter
+	rfilter.Flags(flags)
 	mergeOutput := flags.Bool("merge-output", false, "merge output into one matrix.npy and one matrix.annotations.csv")
+	sortAnnotations := flags.Bool("sort-annotations", false, "with -merge-output, also write matrix.sorted.annotations.csv (sorted by chromosome and position) and matrix.sorted-columns.npy (matrix.npy column indices in the same order)")
+	annotationFormat := flags.String("annotation-format", annotationFormatV1, "matrix*.annotations.csv `format`: v1 (no header) or v2 (version line and header row, same schema as \"annotate -format=v2\")")
 	hgvsSingle := flags.Bool("single-hgvs-matrix", false, "also generate hgvs-based matrix")
+	variantsFilename := flags.String("variants", "", "also write panel.npy with a pair of hgvs-based genotype columns (1=present, 0=ref, -1=no-call or other variant) for each variant listed in the given VCF or CSV (chrom,pos,ref,alt) `file`, in the given order, whether or not the variant appears in the input")
 	hgvsChunked := flags.Bool("chunked-hgvs-matrix", false, "also generate hgvs-based matrix per chromosome")
 	onehotSingle := flags.Bool("single-onehot", false, "generate one-hot tile-based matrix")
 	onehotChunked := flags.Bool("chunked-onehot", false, "generate one-hot tile-based matrix per input chunk")
+	flags.BoolVar(&cmd.aggregateOnly, "aggregate-only", false, "with -single-onehot or -chunked-onehot, only write site-level outputs (annotations, one-hot column info, counts, allele frequencies, p-values) and never per-sample matrices or sample lists; write genotype counts to onehot-aggregates.csv (or onehot-aggregates.{chunk}.csv)")
+	splitOutput := flags.Bool("split-output", false, "also write the training and validation rows of each single (non-chunked) matrix to {name}.train.npy and {name}.val.npy, and case/control labels (1=case, 0=control, -1=neither) to y.train.npy and y.val.npy")
 	samplesFilename := flags.String("samples", "", "`samples.csv` file with training/validation and case/control groups (see 'lightning choose-samples')")
 	caseControlOnly := flags.Bool("case-control-only", false, "drop samples that are not in case/control groups")
-	onlyPCA := flags.Bool("pca", false, "run principal component analysis, write components to pca.npy and samples.csv")
+	phenotype := flags.String("phenotype", "", "use the named phenotype column from -samples file instead of CaseControl")
+	ancestryColumn := flags.String("ancestry-column", "", "with -single-onehot or -chunked-onehot, compute the allele frequency of each one-hot column within each ancestry group given by the named column from -samples file (training set only), and write them to onehot-ancestry-af.csv (or onehot-ancestry-af.{chunk}.csv)")
+	ancestryName := flags.String("ancestry", "", "with -ancestry-column, only output one-hot columns whose tile variants are polymorphic in the named ancestry group")
+	flags.Float64Var(&cmd.ancestryMinFreq, "ancestry-min-frequency", 0, "with -ancestry, only output one-hot columns whose minor allele frequency in the named ancestry group is at least this value")
+	strataColumn := flags.String("strata-column", "", "compute p-values within each stratum (e.g., cohort or batch) given by the named column from -samples file, and combine them using the Cochran-Mantel-Haenszel test (chi-squared) or fixed-effect meta-analysis (logistic regression with PCA/covariates); write per-stratum case/control counts to strata.csv")
+	samplesProperties := flags.String("samples-properties", "", "instead of -samples, read sample metadata from the properties of the given Arvados `UUIDs` (comma-separated project, collection, and container request UUIDs; a project means all collections and container requests in it)")
+	sampleIDProperty := flags.String("sample-id-property", "sample_id", "name of sample ID `property` when using -samples-properties")
+	caseControlProperty := flags.String("case-control-property", "case_control", "name of case/control `property` (1=case, 0=control) when using -samples-properties")
+	trainingValidationProperty := flags.String("training-validation-property", "training_validation", "name of training/validation `property` (1=training, 0=validation; if missing, cases and controls are in the training set) when using -samples-properties")
+	onlyPCA := flags.Bool("pca", false, "run principal component analysis, write components to pca.npy and pca.samples.csv")
 	flags.IntVar(&cmd.pcaComponents, "pca-components", 4, "number of PCA components to compute / use in logistic regression")
+	flags.IntVar(&cmd.pcaClusters, "pca-clusters", 0, "with -pca, assign samples to `k` clusters using k-means on PCA components (fit on training set), and add a PCACluster column to pca.samples.csv (0 = don't)")
+	flags.Float64Var(&cmd.pcaOutlierSD, "pca-outlier-sd", 0, "with -pca, add a PCAOutlier column to pca.samples.csv flagging samples with any PCA component more than `N` standard deviations from the mean of their cluster (0 = don't)")
 	maxPCATiles := flags.Int("max-pca-tiles", 0, "maximum tiles to use as PCA input (filter, then drop every 2nd colum pair until below max)")
 	debugTag := flags.Int("debug-tag", -1, "log debugging details about specified tag")
 	flags.BoolVar(&cmd.minCoverageAll, "min-coverage-all", false, "apply -min-coverage filter based on all samples, not just training set")
-	flags.IntVar(&cmd.threads, "threads", 16, "number of memory-hungry assembly threads, and number of VCPUs to request for arvados container")
+	flags.IntVar(&cmd.threads, "threads", 16, "maximum number of memory-hungry assembly threads, and number of VCPUs to request for arvados container")
+	flags.IntVar(&cmd.gcPercent, "gc-percent", 0, "set Go garbage collector target `percentage` (like GOGC; higher values use more memory but spend less time in GC; -1 = collect only when needed to stay under -gc-memory-limit; 0 = use GOGC environment variable or default 100)")
+	flags.Int64Var(&cmd.gcMemoryLimit, "gc-memory-limit", 0, "set Go garbage collector soft memory limit in `bytes` (like GOMEMLIMIT; 0 = use GOMEMLIMIT environment variable or no limit)")
+	flags.Int64Var(&cmd.memBudget, "mem-budget", 0, "limit concurrency so the estimated memory use of assembly threads stays below `bytes` (0 = use 80% of available memory, -1 = no limit other than -threads)")
+	flags.IntVar(&cmd.pvalueThreads, "pvalue-threads", 0, "number of threads to use for p-value calculations, shared by all assembly threads (0 = number of CPUs)")
+	flags.IntVar(&cmd.pvalueBatchSize, "pvalue-batch-size", 64, "number of columns per p-value calculation task")
 	flags.Float64Var(&cmd.chi2PValue, "chi2-p-value", 1, "do Χ² test (or logistic regression if -samples file has PCA components) and omit columns with p-value above this threshold")
 	flags.Float64Var(&cmd.pvalueMinFrequency, "pvalue-min-frequency", 0.01, "skip p-value calculation on tile variants below this frequency in the training set")
 	flags.Float64Var(&cmd.maxFrequency, "max-frequency", 1, "do not output variants above this frequency in the training set")
 	flags.BoolVar(&cmd.includeVariant1, "include-variant-1", false, "include most common variant when building one-hot matrix")
+	flags.IntVar(&cmd.minGroupSize, "min-group-size", 0, "suppress p-values and allele frequencies (output NaN, or -1 in onehot-columns.npy) of one-hot columns where fewer than `k` training set samples have -- or fewer than k lack -- the column's genotype (0 = don't)")
+	cmd.missing.Flags(flags)
+	flags.BoolVar(&cmd.caseControlStats, "case-control-stats", false, "with -single-onehot or -chunked-onehot, also write onehot-case-control.csv (or onehot-case-control.{chunk}.csv) with case/control allele frequencies, odds ratio, and 95% confidence interval for each one-hot column")
+	flags.BoolVar(&cmd.lengthDeviation, "length-deviation", false, "also write each tile variant's length minus the length of the corresponding reference sequence (insertion/deletion size): per column in onehot-length-deviation.csv (or onehot-length-deviation.{chunk}.csv) with -single-onehot or -chunked-onehot, otherwise per sample in length-deviation.{chunk}.npy, with the same shape as matrix.{chunk}.npy (no-calls are -32768; see -missing-encoding)")
+	flags.BoolVar(&cmd.markSpanning, "mark-spanning", false, "in tile variant matrix outputs, encode entries covered by a spanning tile (a tile variant at a preceding tag that extends past this tag) as -2 instead of 0, so they are not treated as missing (spanning tiles that start in a previous input chunk are not detected)")
+	haploidChromosome := flags.String("haploid-chromosome", "", "in one-hot output, treat tags on reference chromosomes that match the given `regexp` (e.g., '^(chr)?MT?$') as haploid: a tile variant's hom column indicates the genome's (major) variant, its het column indicates a secondary (heteroplasmic) variant, and allele frequencies count each genome once (see 'lightning import -haploid-chromosome')")
+	flags.StringVar(&cmd.impute, "impute", "", "impute no-call tile variants before applying coverage filters, using `method` mode (most common variant) or neighbor (most common variant among haplotypes with matching flanking tiles), and write per-entry quality flags (0=observed, 1=neighbor, 2=mode, -1=not imputed) to impute.{chunk}.npy, with the same shape as matrix.{chunk}.npy")
+	flags.IntVar(&cmd.imputeWindow, "impute-window", 2, "number of flanking tiles on each side to compare when using -impute=neighbor")
+	partialOutputName := flags.String("partial-output-name", "", "with -local, while running, copy each chunk's output files to a new collection with the given `name` (in the -project project) so partial results can be inspected before the command finishes")
+	partialOutputInterval := flags.Duration("partial-output-interval", 10*time.Minute, "how often to save the partial output collection (in container mode, 0 disables partial output)")
+	cmd.manifest.Flags(flags)
 	cmd.filter.Flags(flags)
-	err := flags.Parse(args)
+	cmd.contigAliases.Flags(flags)
+	err := parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		return nil
 	} else if err != nil {
@@ -117,9 +189,77 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 		}()
 	}
 
-	if cmd.chi2PValue != 1 && *samplesFilename == "" {
+	if *samplesFilename != "" && *samplesProperties != "" {
+		return fmt.Errorf("cannot use both -samples and -samples-properties")
+	}
+	haveSamples := *samplesFilename != "" || *samplesProperties != ""
+	if cmd.chi2PValue != 1 && !haveSamples {
 		return fmt.Errorf("cannot use provided -chi2-p-value=%f because -samples= value is empty", cmd.chi2PValue)
 	}
+	if err := checkImputeMethod(cmd.impute); err != nil {
+		return err
+	}
+	if err := cmd.missing.Check(); err != nil {
+		return err
+	}
+	if *splitOutput && !haveSamples {
+		return fmt.Errorf("cannot use -split-output because -samples= value is empty")
+	}
+	if *splitOutput && !*mergeOutput && !*hgvsSingle && !*onehotSingle {
+		return fmt.Errorf("-split-output requires -merge-output, -single-hgvs-matrix, or -single-onehot")
+	}
+	if *sortAnnotations && !*mergeOutput {
+		return fmt.Errorf("-sort-annotations requires -merge-output")
+	}
+	if err := checkAnnotationFormat(*annotationFormat); err != nil {
+		return err
+	}
+	if cmd.caseControlStats && !haveSamples {
+		return fmt.Errorf("cannot use -case-control-stats because -samples= value is empty")
+	}
+	if cmd.caseControlStats && !*onehotSingle && !*onehotChunked {
+		return fmt.Errorf("-case-control-stats requires -single-onehot or -chunked-onehot")
+	}
+	if cmd.lengthDeviation && (*mergeOutput || *onlyPCA) && !*onehotSingle && !*onehotChunked {
+		return fmt.Errorf("-length-deviation requires -single-onehot, -chunked-onehot, or chunked matrix output (not -merge-output or -pca)")
+	}
+	if cmd.markSpanning && !*mergeOutput && (*onehotSingle || *onehotChunked || *onlyPCA) {
+		return fmt.Errorf("-mark-spanning requires tile variant matrix output (not -single-onehot, -chunked-onehot, or -pca without -merge-output)")
+	}
+	if *haploidChromosome != "" {
+		cmd.haploidChromosome, err = regexp.Compile(*haploidChromosome)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *ancestryColumn != "" && !haveSamples {
+		return fmt.Errorf("-ancestry-column does not make sense without -samples")
+	}
+	if *ancestryColumn != "" && !*onehotSingle && !*onehotChunked {
+		return fmt.Errorf("-ancestry-column requires -single-onehot or -chunked-onehot")
+	}
+	if cmd.aggregateOnly {
+		if !*onehotSingle && !*onehotChunked {
+			return fmt.Errorf("-aggregate-only requires -single-onehot or -chunked-onehot")
+		}
+		if *mergeOutput || *hgvsSingle || *hgvsChunked || *variantsFilename != "" || *onlyPCA || *splitOutput || cmd.impute != "" {
+			return fmt.Errorf("-aggregate-only is not compatible with -merge-output, -single-hgvs-matrix, -chunked-hgvs-matrix, -variants, -pca, -split-output, or -impute")
+		}
+	}
+	if *ancestryName != "" && *ancestryColumn == "" {
+		return fmt.Errorf("-ancestry requires -ancestry-column")
+	}
+
+	if (cmd.pcaClusters != 0 || cmd.pcaOutlierSD != 0) && !*onlyPCA {
+		return fmt.Errorf("-pca-clusters and -pca-outlier-sd require -pca")
+	}
+	if cmd.pcaClusters < 0 || cmd.pcaOutlierSD < 0 {
+		return fmt.Errorf("-pca-clusters and -pca-outlier-sd must not be negative")
+	}
+	if cmd.minGroupSize < 0 {
+		return fmt.Errorf("-min-group-size must not be negative")
+	}
 
 	cmd.debugTag = tagID(*debugTag)
 
@@ -135,44 +275,150 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 			APIAccess:   true,
 			Preemptible: *preemptible,
 		}
-		err = runner.TranslatePaths(inputDir, regionsFilename, samplesFilename)
+		containerOpts.Apply(&runner, stdout)
+		err = runner.TranslatePaths(inputDir, samplesFilename, variantsFilename, excludeTagsFilename)
+		if err == nil {
+			err = rfilter.TranslatePaths(&runner, regionsFilename)
+		}
+		if err == nil {
+			err = cmd.filter.TranslatePaths(&runner)
+		}
+		if err == nil {
+			err = cmd.manifest.TranslatePaths(&runner)
+		}
+		if err == nil {
+			err = cmd.contigAliases.TranslatePaths(&runner)
+		}
 		if err != nil {
 			return err
 		}
+		if *partialOutputInterval > 0 {
+			*partialOutputName = runner.Name + " partial output"
+		}
+		if *tmpDir != "" {
+			runner.Mounts["/tmp/lightning-tmp"] = map[string]interface{}{"kind": "tmp", "capacity": 500000000000}
+			*tmpDir = "/tmp/lightning-tmp"
+		}
 		runner.Args = []string{"slice-numpy", "-local=true",
 			"-pprof=:6060",
 			"-input-dir=" + *inputDir,
 			"-output-dir=/mnt/output",
+			"-project=" + *projectUUID,
+			"-partial-output-name=" + *partialOutputName,
+			"-partial-output-interval=" + partialOutputInterval.String(),
 			"-threads=" + fmt.Sprintf("%d", cmd.threads),
+			"-mem-budget=" + fmt.Sprintf("%d", cmd.memBudget),
+			"-gc-percent=" + fmt.Sprintf("%d", cmd.gcPercent),
+			"-gc-memory-limit=" + fmt.Sprintf("%d", cmd.gcMemoryLimit),
 			"-regions=" + *regionsFilename,
+			"-exclude-tags=" + *excludeTagsFilename,
 			"-expand-regions=" + fmt.Sprintf("%d", *expandRegions),
 			"-merge-output=" + fmt.Sprintf("%v", *mergeOutput),
+			"-sort-annotations=" + fmt.Sprintf("%v", *sortAnnotations),
+			"-annotation-format=" + *annotationFormat,
 			"-single-hgvs-matrix=" + fmt.Sprintf("%v", *hgvsSingle),
 			"-chunked-hgvs-matrix=" + fmt.Sprintf("%v", *hgvsChunked),
+			"-variants=" + *variantsFilename,
 			"-single-onehot=" + fmt.Sprintf("%v", *onehotSingle),
 			"-chunked-onehot=" + fmt.Sprintf("%v", *onehotChunked),
+			"-split-output=" + fmt.Sprintf("%v", *splitOutput),
+			"-aggregate-only=" + fmt.Sprintf("%v", cmd.aggregateOnly),
 			"-samples=" + *samplesFilename,
+			"-samples-properties=" + *samplesProperties,
+			"-sample-id-property=" + *sampleIDProperty,
+			"-case-control-property=" + *caseControlProperty,
+			"-training-validation-property=" + *trainingValidationProperty,
 			"-case-control-only=" + fmt.Sprintf("%v", *caseControlOnly),
+			"-phenotype=" + *phenotype,
+			"-strata-column=" + *strataColumn,
+			"-ancestry-column=" + *ancestryColumn,
+			"-ancestry=" + *ancestryName,
+			"-ancestry-min-frequency=" + fmt.Sprintf("%f", cmd.ancestryMinFreq),
 			"-min-coverage-all=" + fmt.Sprintf("%v", cmd.minCoverageAll),
 			"-pca=" + fmt.Sprintf("%v", *onlyPCA),
 			"-pca-components=" + fmt.Sprintf("%d", cmd.pcaComponents),
+			"-pca-clusters=" + fmt.Sprintf("%d", cmd.pcaClusters),
+			"-pca-outlier-sd=" + fmt.Sprintf("%f", cmd.pcaOutlierSD),
 			"-max-pca-tiles=" + fmt.Sprintf("%d", *maxPCATiles),
+			"-pvalue-threads=" + fmt.Sprintf("%d", cmd.pvalueThreads),
+			"-pvalue-batch-size=" + fmt.Sprintf("%d", cmd.pvalueBatchSize),
 			"-chi2-p-value=" + fmt.Sprintf("%f", cmd.chi2PValue),
 			"-pvalue-min-frequency=" + fmt.Sprintf("%f", cmd.pvalueMinFrequency),
 			"-max-frequency=" + fmt.Sprintf("%f", cmd.maxFrequency),
 			"-include-variant-1=" + fmt.Sprintf("%v", cmd.includeVariant1),
+			"-min-group-size=" + fmt.Sprintf("%d", cmd.minGroupSize),
+			"-case-control-stats=" + fmt.Sprintf("%v", cmd.caseControlStats),
+			"-length-deviation=" + fmt.Sprintf("%v", cmd.lengthDeviation),
+			"-mark-spanning=" + fmt.Sprintf("%v", cmd.markSpanning),
+			"-haploid-chromosome=" + *haploidChromosome,
+			"-impute=" + cmd.impute,
+			"-impute-window=" + fmt.Sprintf("%d", cmd.imputeWindow),
 			"-debug-tag=" + fmt.Sprintf("%d", cmd.debugTag),
+			"-watchdog-timeout=" + watchdogTimeout.String(),
+			"-tmp-dir=" + *tmpDir,
+			"-tmp-compress=" + fmt.Sprintf("%v", *tmpCompress),
 		}
 		runner.Args = append(runner.Args, cmd.filter.Args()...)
+		runner.Args = append(runner.Args, rfilter.Args()...)
+		runner.Args = append(runner.Args, cmd.missing.Args()...)
+		runner.Args = append(runner.Args, cmd.manifest.Args()...)
+		runner.Args = append(runner.Args, cmd.contigAliases.Args()...)
 		var output string
 		output, err = runner.Run()
-		if err != nil {
+		if err == errDryRun {
+			err = nil
+			return nil
+		} else if err != nil {
 			return err
 		}
 		fmt.Fprintln(stdout, output)
 		return nil
 	}
 
+	err = cmd.contigAliases.Load()
+	if err != nil {
+		return err
+	}
+
+	startWatchdog(*watchdogTimeout, stderr)
+
+	if *tmpDir == "" {
+		*tmpDir = *outputDir
+	}
+
+	ctx, cancel := interruptContext(context.Background())
+	defer cancel()
+	defer func() {
+		if context.Cause(ctx) != nil {
+			removeTempFiles(*tmpDir, "tmp.*.gob", "tmp.hgvs-matrix", "tmp.panel-matrix", "tmp.sort.*")
+		}
+	}()
+
+	if *partialOutputName != "" {
+		cmd.partial, err = startPartialOutput(*outputDir, *partialOutputName, *projectUUID, *partialOutputInterval)
+		if err != nil {
+			return err
+		}
+		defer cmd.partial.Close()
+	}
+
+	if cmd.gcPercent != 0 {
+		log.Infof("setting GC percent to %d (was %d)", cmd.gcPercent, debug.SetGCPercent(cmd.gcPercent))
+	}
+	if cmd.gcMemoryLimit > 0 {
+		log.Infof("setting GC memory limit to %d bytes (was %d)", cmd.gcMemoryLimit, debug.SetMemoryLimit(cmd.gcMemoryLimit))
+	}
+	cmd.outputs = newOutputCatalog("slice-numpy", flags)
+
+	var panel *variantPanel
+	if *variantsFilename != "" {
+		panel, err = loadVariantPanel(*variantsFilename)
+		if err != nil {
+			return err
+		}
+		log.Infof("loaded %d variants from %s", len(panel.variants), *variantsFilename)
+	}
+
 	infiles, err := allFiles(*inputDir, matchGobFile)
 	if err != nil {
 		return err
@@ -182,6 +428,9 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 		return err
 	}
 	sort.Strings(infiles)
+	if err = checkTagSets(infiles); err != nil {
+		return err
+	}
 
 	var refseq map[string][]tileLibRef
 	var reftiledata = make(map[tileLibRef][]byte, 11000000)
@@ -190,9 +439,8 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 		return err
 	}
 
-	matchGenome, err := regexp.Compile(cmd.filter.MatchGenome)
+	genomes, err := cmd.filter.GenomeSelector()
 	if err != nil {
-		err = fmt.Errorf("-match-genome: invalid regexp: %q", cmd.filter.MatchGenome)
 		return err
 	}
 
@@ -201,25 +449,37 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 		if err != nil {
 			return err
 		}
-	} else if *caseControlOnly {
+		if *phenotype != "" {
+			err = selectPhenotype(cmd.samples, *phenotype)
+			if err != nil {
+				return err
+			}
+		}
+	} else if *caseControlOnly && !haveSamples {
 		return fmt.Errorf("-case-control-only does not make sense without -samples")
+	} else if *phenotype != "" && !haveSamples {
+		return fmt.Errorf("-phenotype does not make sense without -samples")
+	} else if *strataColumn != "" && !haveSamples {
+		return fmt.Errorf("-strata-column does not make sense without -samples")
 	}
 
 	cmd.cgnames = nil
 	var tagset [][]byte
-	err = DecodeLibrary(in0, strings.HasSuffix(infiles[0], ".gz"), func(ent *LibraryEntry) error {
+	var cseqs []CompactSequence
+	// Only genome names are needed here, and ref tile
+	// sequences, which are all in the first slice file.
+	err = DecodeLibraryOptions(in0, strings.HasSuffix(infiles[0], ".gz"), DecodeOptions{SkipGenomeVariants: true}, func(ent *LibraryEntry) error {
 		if len(ent.TagSet) > 0 {
 			tagset = ent.TagSet
 		}
 		for _, cseq := range ent.CompactSequences {
-			if cseq.Name == *ref || *ref == "" {
+			cseqs = append(cseqs, cseq)
+			if cseq.Name == *ref {
 				refseq = cseq.TileSequences
 			}
 		}
 		for _, cg := range ent.CompactGenomes {
-			if matchGenome.MatchString(cg.Name) {
-				cmd.cgnames = append(cmd.cgnames, cg.Name)
-			}
+			cmd.cgnames = append(cmd.cgnames, cg.Name)
 		}
 		for _, tv := range ent.TileVariants {
 			if tv.Ref {
@@ -232,28 +492,114 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 		return err
 	}
 	in0.Close()
-	if refseq == nil {
-		err = fmt.Errorf("%s: reference sequence not found", infiles[0])
-		return err
-	}
 	if len(tagset) == 0 {
 		err = fmt.Errorf("tagset not found")
 		return err
 	}
+	if refseq == nil {
+		refs := summarizeRefs(cseqs, len(tagset[0]), func(libref tileLibRef) (int, bool) {
+			seq, ok := reftiledata[libref]
+			return len(seq), ok
+		})
+		switch {
+		case len(refs) == 0:
+			return fmt.Errorf("%s: reference sequence not found", infiles[0])
+		case *ref != "":
+			return fmt.Errorf("%s: reference %q not found; available references are:\n%s", infiles[0], *ref, refListing(refs))
+		case len(refs) > 1:
+			return fmt.Errorf("%s: input has multiple references, use -ref to choose one:\n%s", infiles[0], refListing(refs))
+		}
+		log.Infof("using reference %q (the only reference in input)", refs[0].name)
+		for _, cseq := range cseqs {
+			refseq = cseq.TileSequences
+		}
+	}
 
 	taglib := &tagLibrary{}
 	err = taglib.setTags(tagset)
 	if err != nil {
 		return err
 	}
-	taglen := taglib.TagLen()
 	sort.Strings(cmd.cgnames)
+	cmd.cgnames, err = genomes.Select(cmd.cgnames)
+	if err != nil {
+		return err
+	}
 
 	if len(cmd.cgnames) == 0 {
 		return fmt.Errorf("fatal: 0 matching samples in library, nothing to do")
 	}
+
+	// lowCoverage[name]==true for samples that are dropped by
+	// -min-sample-coverage
+	var lowCoverage map[string]bool
+	if cmd.filter.MinSampleCoverage > 0 {
+		ntags := len(tagset)
+		if cmd.filter.MaxTag >= 0 && ntags > cmd.filter.MaxTag+1 {
+			ntags = cmd.filter.MaxTag + 1
+		}
+		log.Info("counting called tile variants in each sample")
+		called, err := countCalledInFiles(infiles, cmd.cgnames, ntags)
+		if err != nil {
+			return err
+		}
+		covs := sampleCoverages(called, ntags, cmd.filter.MinSampleCoverage)
+		lowCoverage = map[string]bool{}
+		for _, sc := range covs {
+			if sc.Dropped {
+				lowCoverage[sc.Name] = true
+			}
+		}
+		log.Infof("dropping %d of %d samples with coverage < %f", len(lowCoverage), len(covs), cmd.filter.MinSampleCoverage)
+		if len(lowCoverage) == len(covs) {
+			return fmt.Errorf("fatal: all %d samples have coverage < %f, nothing to do", len(covs), cmd.filter.MinSampleCoverage)
+		}
+		if !cmd.aggregateOnly {
+			err = writeSampleCoverage(*outputDir+"/sample-coverage.csv", covs)
+			if err != nil {
+				return err
+			}
+			cmd.outputs.add(outputArtifact{File: "sample-coverage.csv", Kind: "sample-coverage"})
+		}
+	}
+	if *samplesProperties != "" {
+		var records []map[string]string
+		records, err = loadArvadosProperties(arvadosClientFromEnv, *samplesProperties)
+		if err != nil {
+			return err
+		}
+		var phenotypes []string
+		if *phenotype != "" {
+			phenotypes = []string{*phenotype}
+		}
+		if *strataColumn != "" {
+			phenotypes = append(phenotypes, *strataColumn)
+		}
+		if *ancestryColumn != "" {
+			phenotypes = append(phenotypes, *ancestryColumn)
+		}
+		cmd.samples, err = sampleInfoFromProperties(cmd.cgnames, records, *sampleIDProperty, *caseControlProperty, *trainingValidationProperty, phenotypes)
+		if err != nil {
+			return err
+		}
+		if *phenotype != "" {
+			err = selectPhenotype(cmd.samples, *phenotype)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if lowCoverage != nil && !haveSamples {
+		kept := cmd.cgnames[:0]
+		for _, name := range cmd.cgnames {
+			if !lowCoverage[name] {
+				kept = append(kept, name)
+			}
+		}
+		cmd.cgnames = kept
+	}
 	cmd.trainingSet = make([]int, len(cmd.cgnames))
-	if *samplesFilename == "" {
+	if !haveSamples {
 		cmd.trainingSetSize = len(cmd.cgnames)
 		for i, name := range cmd.cgnames {
 			cmd.samples = append(cmd.samples, sampleInfo{
@@ -270,9 +616,9 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 				return fmt.Errorf("mismatched sample list: sample %d is %q in library, %q in %s", i, s, cmd.samples[i].id, *samplesFilename)
 			}
 		}
-		if *caseControlOnly {
+		if *caseControlOnly || lowCoverage != nil {
 			for i := 0; i < len(cmd.samples); i++ {
-				if !cmd.samples[i].isTraining && !cmd.samples[i].isValidation {
+				if (*caseControlOnly && !cmd.samples[i].isTraining && !cmd.samples[i].isValidation) || lowCoverage[cmd.cgnames[i]] {
 					if i+1 < len(cmd.samples) {
 						copy(cmd.samples[i:], cmd.samples[i+1:])
 						copy(cmd.cgnames[i:], cmd.cgnames[i+1:])
@@ -294,7 +640,34 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 				cmd.trainingSet[i] = -1
 			}
 		}
-		if cmd.pvalue == nil {
+		if *strataColumn != "" {
+			cmd.strata, cmd.strataNames, err = sampleStrata(cmd.samples, *strataColumn)
+			if err != nil {
+				return err
+			}
+			log.Infof("using %d strata from %q column: %q", len(cmd.strataNames), *strataColumn, cmd.strataNames)
+		}
+		cmd.ancestryFilter = -1
+		if *ancestryColumn != "" {
+			cmd.ancestry, cmd.ancestryNames, err = sampleStrata(cmd.samples, *ancestryColumn)
+			if err != nil {
+				return err
+			}
+			log.Infof("using %d ancestry groups from %q column: %q", len(cmd.ancestryNames), *ancestryColumn, cmd.ancestryNames)
+			for i, name := range cmd.ancestryNames {
+				if name == *ancestryName {
+					cmd.ancestryFilter = i
+				}
+			}
+			if *ancestryName != "" && cmd.ancestryFilter < 0 {
+				return fmt.Errorf("-ancestry=%q not found in %q column (groups are %q)", *ancestryName, *ancestryColumn, cmd.ancestryNames)
+			}
+		}
+		if cmd.pvalue == nil && cmd.strata != nil {
+			cmd.pvalue = func(onehot []bool) float64 {
+				return cmhPvalue(onehot, cmd.chi2Cases, cmd.strata, len(cmd.strataNames))
+			}
+		} else if cmd.pvalue == nil {
 			cmd.pvalue = func(onehot []bool) float64 {
 				return pvalue(onehot, cmd.chi2Cases)
 			}
@@ -310,8 +683,12 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 		cmd.minCoverage = int(math.Ceil(cmd.filter.MinCoverage * float64(cmd.minCoverage)))
 	}
 
-	if len(cmd.samples[0].pcaComponents) > 0 {
-		cmd.pvalue = glmPvalueFunc(cmd.samples, cmd.pcaComponents)
+	if len(cmd.samples[0].pcaComponents) > 0 || len(cmd.samples[0].covariates) > 0 {
+		if cmd.strata != nil {
+			cmd.pvalue = glmMetaPvalueFunc(cmd.samples, cmd.pcaComponents, cmd.strata, len(cmd.strataNames))
+		} else {
+			cmd.pvalue = glmPvalueFunc(cmd.samples, cmd.pcaComponents)
+		}
 		// Unfortunately, statsmodel/glm lib logs stuff to
 		// os.Stdout when it panics on an unsolvable
 		// problem. We recover() from the panic in glm.go, but
@@ -332,9 +709,44 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 		cgnamemap[name] = true
 	}
 
-	err = writeSampleInfo(cmd.samples, *outputDir)
-	if err != nil {
-		return err
+	if !cmd.aggregateOnly {
+		err = writeSampleInfo(cmd.samples, *outputDir)
+		if err != nil {
+			return err
+		}
+		cmd.outputs.add(outputArtifact{File: "samples.csv", Kind: "samples"})
+	}
+	if cmd.strata != nil {
+		err = writeStrataCounts(*outputDir+"/strata.csv", cmd.strataNames, cmd.strata, cmd.chi2Cases)
+		if err != nil {
+			return err
+		}
+		cmd.outputs.add(outputArtifact{File: "strata.csv", Kind: "strata"})
+	}
+	if *splitOutput {
+		err = cmd.writeSplitLabels(*outputDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	// chromIndex[seqname] is the value used to identify seqname
+	// in the chromosome row of onehot-columns output.
+	chromNames := make([]string, 0, len(refseq))
+	for seqname := range refseq {
+		chromNames = append(chromNames, seqname)
+	}
+	sort.Strings(chromNames)
+	chromIndex := make(map[string]int, len(chromNames))
+	for i, seqname := range chromNames {
+		chromIndex[seqname] = i
+	}
+	if *onehotChunked || *onehotSingle {
+		err = writeChromosomes(*outputDir+"/chromosomes.csv", chromNames)
+		if err != nil {
+			return err
+		}
+		cmd.outputs.add(outputArtifact{File: "chromosomes.csv", Kind: "chromosomes"})
 	}
 
 	log.Info("indexing reference tiles")
@@ -350,15 +762,16 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 	reftile := map[tagID]*reftileinfo{}
 	for seqname, cseq := range refseq {
 		pos := 0
+		overlap := 0
 		lastreftag := tagID(-1)
-		for _, libref := range cseq {
+		for i, libref := range cseq {
 			if cmd.filter.MaxTag >= 0 && libref.Tag > tagID(cmd.filter.MaxTag) {
 				continue
 			}
 			tiledata := reftiledata[libref]
 			if len(tiledata) == 0 {
 				err = fmt.Errorf("missing tiledata for tag %d variant %d in %s in ref", libref.Tag, libref.Variant, seqname)
-				return err
+				return diagnoseTag(err, "reading reference", infiles[0], libref.Tag)
 			}
 			foundthistag := false
 			taglib.FindAll(bufio.NewReader(bytes.NewReader(tiledata[:len(tiledata)-1])), nil, func(tagid tagID, offset, _ int) {
@@ -394,22 +807,80 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 				}
 				lastreftag = libref.Tag
 			}
-			pos += len(tiledata) - taglen
+			overlap = pathOverlap(taglib.taglen, cseq, i)
+			pos += len(tiledata) - overlap
+		}
+		log.Printf("... %s done, len %d", seqname, pos+overlap)
+	}
+	if cmd.haploidChromosome != nil {
+		cmd.haploidTags = map[tagID]bool{}
+		for tag, rt := range reftile {
+			if cmd.haploidChromosome.MatchString(rt.seqname) {
+				cmd.haploidTags[tag] = true
+			}
+		}
+		log.Printf("treating %d tags as haploid", len(cmd.haploidTags))
+	}
+
+	// tileLengthDeviation returns the length of the given tile
+	// variant sequence minus the length of the corresponding
+	// reference sequence, i.e., the reference tile with the same
+	// tag, extended with the following reference tiles until it
+	// ends with the same tag as the variant (up to
+	// annotationMaxTileSpan tiles). It returns false if there is
+	// no corresponding reference sequence.
+	tileLengthDeviation := func(tag tagID, tvseq []byte) (int, bool) {
+		rt := reftile[tag]
+		if rt == nil || len(tvseq) < taglib.TagLen(tag) {
+			return 0, false
+		}
+		reflen := len(rt.tiledata)
+		endtag, ok := taglib.EndTag(tvseq)
+		if !ok {
+			// variant has no end tag, so it should
+			// correspond to the last tile of a
+			// reference sequence
+			if rt.nexttag >= 0 {
+				return 0, false
+			}
+			return len(tvseq) - reflen, true
+		}
+		for i := 0; i < annotationMaxTileSpan && rt.nexttag != endtag; i++ {
+			next := reftile[rt.nexttag]
+			if rt.nexttag < 0 || next == nil {
+				return 0, false
+			}
+			reflen += len(next.tiledata) - taglib.TagLen(rt.nexttag)
+			rt = next
 		}
-		log.Printf("... %s done, len %d", seqname, pos+taglen)
+		if rt.nexttag != endtag {
+			return 0, false
+		}
+		return len(tvseq) - reflen, true
+	}
+
+	cmd.excludeTags, err = loadExcludeTags(*excludeTagsFilename)
+	if err != nil {
+		return err
+	}
+	if len(cmd.excludeTags) > 0 {
+		log.Printf("excluding %d tags listed in %s", len(cmd.excludeTags), *excludeTagsFilename)
 	}
 
 	var mask *mask
 	if *regionsFilename != "" {
 		log.Printf("loading regions from %s", *regionsFilename)
-		mask, err = makeMask(*regionsFilename, *expandRegions)
+		for seqname := range refseq {
+			rfilter.contigs = append(rfilter.contigs, seqname)
+		}
+		mask, err = makeMask(*regionsFilename, *expandRegions, rfilter)
 		if err != nil {
 			return err
 		}
 		log.Printf("before applying mask, len(reftile) == %d", len(reftile))
 		log.Printf("deleting reftile entries for regions outside %d intervals", mask.Len())
 		for _, rt := range reftile {
-			if !mask.Check(strings.TrimPrefix(rt.seqname, "chr"), rt.pos, rt.pos+len(rt.tiledata)) {
+			if !mask.Check(rt.seqname, rt.pos, rt.pos+len(rt.tiledata)) {
 				rt.excluded = true
 			}
 		}
@@ -419,23 +890,21 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 	type hgvsColSet map[hgvs.Variant][2][]int8
 	encodeHGVS := throttle{Max: len(refseq)}
 	encodeHGVSTodo := map[string]chan hgvsColSet{}
-	tmpHGVSCols := map[string]*os.File{}
+	tmpHGVSCols := map[string]*tempGobFile{}
 	if *hgvsChunked {
 		for seqname := range refseq {
-			var f *os.File
-			f, err = os.Create(*outputDir + "/tmp." + seqname + ".gob")
+			var tmp *tempGobFile
+			tmp, err = createTempGobFile(*tmpDir, "tmp."+seqname+".gob", *tmpCompress)
 			if err != nil {
 				return err
 			}
-			defer os.Remove(f.Name())
-			bufw := bufio.NewWriterSize(f, 1<<24)
-			enc := gob.NewEncoder(bufw)
-			tmpHGVSCols[seqname] = f
+			defer tmp.Remove()
+			tmpHGVSCols[seqname] = tmp
 			todo := make(chan hgvsColSet, 128)
 			encodeHGVSTodo[seqname] = todo
 			encodeHGVS.Go(func() error {
 				for colset := range todo {
-					err := enc.Encode(colset)
+					err := tmp.Encode(colset)
 					if err != nil {
 						encodeHGVS.Report(err)
 						for range todo {
@@ -443,13 +912,13 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 						return err
 					}
 				}
-				return bufw.Flush()
+				return tmp.Flush()
 			})
 		}
 	}
 
 	var toMerge [][]int16
-	if *mergeOutput || *hgvsSingle {
+	if *mergeOutput || *hgvsSingle || panel != nil {
 		toMerge = make([][]int16, len(infiles))
 	}
 	var onehotIndirect [][2][]uint32 // [chunkIndex][axis][index]
@@ -462,25 +931,69 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 	}
 	chunkStartTag := make([]tagID, len(infiles))
 
-	throttleMem := throttle{Max: cmd.threads} // TODO: estimate using mem and data size
+	throttleMem := throttle{Max: cmd.threads}
 	throttleNumpyMem := throttle{Max: cmd.threads/2 + 1}
+	var memBudget *memThrottle
+	if cmd.memBudget == 0 {
+		if avail := availableMemory(); avail > 0 {
+			memBudget = &memThrottle{Budget: avail / 5 * 4}
+		} else {
+			log.Warn("cannot determine available memory, using -threads as the only concurrency limit")
+		}
+	} else if cmd.memBudget > 0 {
+		memBudget = &memThrottle{Budget: cmd.memBudget}
+	}
+	if memBudget != nil {
+		log.Infof("memory budget %d bytes", memBudget.Budget)
+	}
+	chunkTags := (len(tagset) + len(infiles) - 1) / len(infiles)
+	if cmd.pvalueThreads < 1 {
+		cmd.pvalueThreads = runtime.GOMAXPROCS(0)
+	}
+	pvalueWorkers := newPvaluePool(cmd.pvalueThreads, cmd.pvalueBatchSize, cmd.pvalue)
+	defer pvalueWorkers.Close()
 	log.Info("generating annotations and numpy matrix for each slice")
 	var errSkip = errors.New("skip infile")
-	var done int64
+	progress := newProgress("slice-numpy: input files", len(infiles))
 	for infileIdx, infile := range infiles {
 		infileIdx, infile := infileIdx, infile
 		throttleMem.Go(func() error {
-			seq := make(map[tagID][]TileVariant, 50000)
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			arena := getTileVariantArena()
+			defer putTileVariantArena(arena)
 			cgs := make(map[string]CompactGenome, len(cmd.cgnames))
 			f, err := open(infile)
 			if err != nil {
-				return err
+				return diagnose(err, "reading input", infile)
 			}
 			defer f.Close()
+			if memBudget != nil {
+				size, err := f.Seek(0, io.SeekEnd)
+				if err != nil {
+					return err
+				}
+				if _, err = f.Seek(0, io.SeekStart); err != nil {
+					return err
+				}
+				est := cmd.estimateChunkMemory(chunkTags, size)
+				log.Infof("%04d: waiting for %d bytes of memory budget", infileIdx, est)
+				est = memBudget.Acquire(est)
+				defer memBudget.Release(est)
+			}
 			log.Infof("%04d: reading %s", infileIdx, infile)
-			err = DecodeLibrary(f, strings.HasSuffix(infile, ".gz"), func(ent *LibraryEntry) error {
+			decode := func(cb func(*LibraryEntry) error) error {
+				return DecodeLibrary(f, strings.HasSuffix(infile, ".gz"), cb)
+			}
+			if cmd.filter.MaxTag >= 0 {
+				decode = func(cb func(*LibraryEntry) error) error {
+					return DecodeLibraryTagRange(f, 0, tagID(cmd.filter.MaxTag)+1, cb)
+				}
+			}
+			err = decode(func(ent *LibraryEntry) error {
 				for _, tv := range ent.TileVariants {
-					if tv.Ref {
+					if tv.Ref || cmd.excludeTags[tv.Tag] {
 						continue
 					}
 					// Skip tile with no
@@ -504,15 +1017,7 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 					if tv.Tag == cmd.debugTag {
 						log.Printf("infile %d %s tag %d variant %d hash %x", infileIdx, infile, tv.Tag, tv.Variant, tv.Blake2b[:3])
 					}
-					variants := seq[tv.Tag]
-					if len(variants) == 0 {
-						variants = make([]TileVariant, 100)
-					}
-					for len(variants) <= int(tv.Variant) {
-						variants = append(variants, TileVariant{})
-					}
-					variants[int(tv.Variant)] = tv
-					seq[tv.Tag] = variants
+					arena.add(&tv)
 				}
 				for _, cg := range ent.CompactGenomes {
 					if cmd.filter.MaxTag >= 0 && cg.StartTag > tagID(cmd.filter.MaxTag) {
@@ -527,6 +1032,17 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 					if sliceSize := 2 * int(cg.EndTag-cg.StartTag); len(cg.Variants) < sliceSize {
 						cg.Variants = append(cg.Variants, make([]tileVariantID, sliceSize-len(cg.Variants))...)
 					}
+					// treat excluded tags like
+					// tags with insufficient
+					// coverage (see minCoverage
+					// below)
+					for tag := range cmd.excludeTags {
+						if tag >= cg.StartTag && tag < cg.EndTag {
+							idx := int(tag-cg.StartTag) * 2
+							cg.Variants[idx] = 0
+							cg.Variants[idx+1] = 0
+						}
+					}
 					cgs[cg.Name] = cg
 				}
 				return nil
@@ -534,19 +1050,43 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 			if err == errSkip {
 				return nil
 			} else if err != nil {
-				return fmt.Errorf("%04d: DecodeLibrary(%s): %w", infileIdx, infile, err)
+				return diagnose(fmt.Errorf("%04d: DecodeLibrary(%s): %w", infileIdx, infile, err), "reading input", infile)
 			}
+			seq := arena.build()
 			tagstart := cgs[cmd.cgnames[0]].StartTag
 			tagend := cgs[cmd.cgnames[0]].EndTag
 			chunkStartTag[infileIdx] = tagstart
 
+			if cmd.impute != "" {
+				log.Infof("%04d: imputing no-calls for tags %d-%d (method=%s)", infileIdx, tagstart, tagend, cmd.impute)
+				imputeFlags, stats := imputeTileVariants(cmd.impute, cmd.imputeWindow, cgs, cmd.cgnames, seq, tagstart, tagend)
+				log.Infof("%04d: imputed %d no-calls using neighbors, %d using mode, %d not imputed", infileIdx, stats.Neighbor, stats.Mode, stats.Failed)
+				err = cmd.writeImputeFlags(fmt.Sprintf("%s/impute.%04d.npy", *outputDir, infileIdx), imputeFlags, tagstart, func(tag tagID) bool {
+					rt := reftile[tag]
+					return mask != nil && (rt == nil || rt.excluded)
+				})
+				if err != nil {
+					return err
+				}
+			}
+
 			// TODO: filters
 
 			log.Infof("%04d: renumber/dedup variants for tags %d-%d", infileIdx, tagstart, tagend)
 			variantRemap := make([][]tileVariantID, tagend-tagstart)
+			// variantLengthDeviation[tag-tagstart][v] is
+			// the length deviation of original variant v
+			// (only if -length-deviation)
+			var variantLengthDeviation [][]int32
+			if cmd.lengthDeviation {
+				variantLengthDeviation = make([][]int32, tagend-tagstart)
+			}
 			throttleCPU := throttle{Max: runtime.GOMAXPROCS(0)}
 			for tag, variants := range seq {
 				tag, variants := tag, variants
+				if ctx.Err() != nil {
+					break
+				}
 				throttleCPU.Go(func() error {
 					alleleCoverage := 0
 					count := make(map[[blake2b.Size256]byte]int, len(variants))
@@ -564,7 +1104,7 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 						idx := int(tag-tagstart) * 2
 						for allele := 0; allele < 2; allele++ {
 							v := cg.Variants[idx+allele]
-							if v > 0 && len(variants[v].Sequence) > 0 {
+							if v > 0 && int(v) < len(variants) && len(variants[v].Sequence) > 0 {
 								count[variants[v].Blake2b]++
 								alleleCoverage++
 							}
@@ -627,6 +1167,16 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 						}
 					}
 					variantRemap[tag-tagstart] = remap
+					if variantLengthDeviation != nil {
+						dev := make([]int32, len(variants))
+						for i, tv := range variants {
+							dev[i] = lengthDeviationMissing
+							if d, ok := tileLengthDeviation(tag, tv.Sequence); ok && remap[i] > 0 {
+								dev[i] = int32(d)
+							}
+						}
+						variantLengthDeviation[tag-tagstart] = dev
+					}
 					if rt != nil {
 						refrank := rank[blake2b.Sum256(rt.tiledata)]
 						if tag == cmd.debugTag {
@@ -638,16 +1188,21 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 				})
 			}
 			throttleCPU.Wait()
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
 
 			var onehotChunk [][]int8
 			var onehotXref []onehotXref
+			var onehotObs [][]bool
 
 			var annotationsFilename string
 			if *onlyPCA {
-				annotationsFilename = "/dev/null"
+				annotationsFilename = os.DevNull
 			} else {
 				annotationsFilename = fmt.Sprintf("%s/matrix.%04d.annotations.csv", *outputDir, infileIdx)
 				log.Infof("%04d: writing %s", infileIdx, annotationsFilename)
+				cmd.outputs.add(outputArtifact{File: annotationsFilename, Kind: "annotations"})
 			}
 			annof, err := os.Create(annotationsFilename)
 			if err != nil {
@@ -656,6 +1211,10 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 			annow := bufio.NewWriterSize(annof, 1<<20)
 			outcol := 0
 			for tag := tagstart; tag < tagend; tag++ {
+				if ctx.Err() != nil {
+					annof.Close()
+					return context.Cause(ctx)
+				}
 				rt := reftile[tag]
 				if rt == nil && mask != nil {
 					// With no ref tile, we don't
@@ -691,15 +1250,34 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 					}
 				}
 				if *onehotChunked || *onehotSingle || *onlyPCA {
-					onehot, xrefs := cmd.tv2homhet(cgs, maxv, remap, tag, tagstart, seq)
+					onehot, xrefs, obs := cmd.homhetCandidates(cgs, maxv, remap, tag, tagstart, seq)
+					for i := range xrefs {
+						if rt != nil {
+							xrefs[i].chrom = chromIndex[rt.seqname]
+							xrefs[i].pos = rt.pos
+						} else {
+							xrefs[i].chrom = -1
+							xrefs[i].pos = -1
+						}
+						if variantLengthDeviation != nil {
+							xrefs[i].lengthDeviation = lengthDeviationMissing
+							for v, newv := range remap {
+								if newv == xrefs[i].variant && variantLengthDeviation[tag-tagstart][v] != lengthDeviationMissing {
+									xrefs[i].lengthDeviation = variantLengthDeviation[tag-tagstart][v]
+									break
+								}
+							}
+						}
+					}
 					if tag == cmd.debugTag {
 						log.WithFields(logrus.Fields{
 							"onehot": onehot,
 							"xrefs":  xrefs,
-						}).Info("tv2homhet()")
+						}).Info("homhetCandidates()")
 					}
 					onehotChunk = append(onehotChunk, onehot...)
 					onehotXref = append(onehotXref, xrefs...)
+					onehotObs = append(onehotObs, obs...)
 				}
 				if *onlyPCA {
 					outcol++
@@ -728,7 +1306,7 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 					} else {
 						done[v] = true
 					}
-					if len(tv.Sequence) < taglen {
+					if len(tv.Sequence) < taglib.TagLen(tag) {
 						continue
 					}
 					// if reftilestr doesn't end
@@ -738,15 +1316,20 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 					// it does (up to an arbitrary
 					// sanity-check limit)
 					reftilestr := reftilestr
-					endtagstr := strings.ToUpper(string(tv.Sequence[len(tv.Sequence)-taglen:]))
+					endtaglen := taglib.TagLen(tag)
+					if endtag, ok := taglib.EndTag(tv.Sequence); ok {
+						endtaglen = taglib.TagLen(endtag)
+					}
+					endtagstr := strings.ToUpper(string(tv.Sequence[len(tv.Sequence)-endtaglen:]))
 					for i, rt := 0, rt; i < annotationMaxTileSpan && !strings.HasSuffix(reftilestr, endtagstr) && rt.nexttag >= 0; i++ {
-						rt = reftile[rt.nexttag]
+						nexttag := rt.nexttag
+						rt = reftile[nexttag]
 						if rt == nil {
 							break
 						}
-						reftilestr += strings.ToUpper(string(rt.tiledata[taglen:]))
+						reftilestr += strings.ToUpper(string(rt.tiledata[taglib.TagLen(nexttag):]))
 					}
-					if mask != nil && !mask.Check(strings.TrimPrefix(rt.seqname, "chr"), rt.pos, rt.pos+len(reftilestr)) {
+					if mask != nil && !mask.Check(rt.seqname, rt.pos, rt.pos+len(reftilestr)) {
 						continue
 					}
 					if !strings.HasSuffix(reftilestr, endtagstr) {
@@ -832,6 +1415,14 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 				return err
 			}
 
+			if len(onehotObs) > 0 {
+				log.Infof("%04d: computing p-values for %d columns", infileIdx, len(onehotObs))
+				pvalues := pvalueWorkers.Evaluate(onehotObs)
+				onehotObs = nil
+				onehotChunk, onehotXref = cmd.filterPvalues(onehotChunk, onehotXref, pvalues)
+				log.Infof("%04d: %d columns pass p-value filter", infileIdx, len(onehotChunk))
+			}
+
 			if *onehotChunked {
 				// transpose onehotChunk[col][row] to numpy[row*ncols+col]
 				rows := len(cmd.cgnames)
@@ -840,15 +1431,56 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 				throttleNumpyMem.Acquire()
 				out := onehotcols2int8(onehotChunk)
 				fnm := fmt.Sprintf("%s/onehot.%04d.npy", *outputDir, infileIdx)
-				err = writeNumpyInt8(fnm, out, rows, cols)
+				colsFnm := fmt.Sprintf("%s/onehot-columns.%04d.npy", *outputDir, infileIdx)
+				idsFnm := fmt.Sprintf("%s/onehot-column-ids.%04d.csv", *outputDir, infileIdx)
+				if !cmd.aggregateOnly {
+					err = writeNumpyInt8(fnm, out, rows, cols)
+					if err != nil {
+						return err
+					}
+					cmd.outputs.addNumpy(fnm, "onehot", "int8", rows, cols, "samples.csv", colsFnm)
+				} else {
+					aggFnm := fmt.Sprintf("%s/onehot-aggregates.%04d.csv", *outputDir, infileIdx)
+					err = writeOnehotAggregates(aggFnm, cmd.trainingSetSize, onehotXref)
+					if err != nil {
+						return err
+					}
+					cmd.outputs.add(outputArtifact{File: aggFnm, Kind: "aggregates"})
+				}
+				err = writeNumpyInt32(colsFnm, onehotXref2int32(onehotXref), onehotXrefRows, len(onehotXref))
 				if err != nil {
 					return err
 				}
-				fnm = fmt.Sprintf("%s/onehot-columns.%04d.npy", *outputDir, infileIdx)
-				err = writeNumpyInt32(fnm, onehotXref2int32(onehotXref), 4, len(onehotXref))
+				cmd.outputs.addNumpy(colsFnm, "onehot-columns", "int32", onehotXrefRows, len(onehotXref), "", idsFnm)
+				err = writeColumnIDs(idsFnm, onehotXref)
 				if err != nil {
 					return err
 				}
+				cmd.outputs.add(outputArtifact{File: idsFnm, Kind: "column-ids"})
+				if cmd.caseControlStats {
+					ccFnm := fmt.Sprintf("%s/onehot-case-control.%04d.csv", *outputDir, infileIdx)
+					err = writeCaseControlStats(ccFnm, onehotXref)
+					if err != nil {
+						return err
+					}
+					cmd.outputs.add(outputArtifact{File: ccFnm, Kind: "case-control-stats"})
+				}
+				if cmd.lengthDeviation {
+					ldFnm := fmt.Sprintf("%s/onehot-length-deviation.%04d.csv", *outputDir, infileIdx)
+					err = writeLengthDeviation(ldFnm, onehotXref)
+					if err != nil {
+						return err
+					}
+					cmd.outputs.add(outputArtifact{File: ldFnm, Kind: "length-deviation"})
+				}
+				if cmd.ancestry != nil {
+					afFnm := fmt.Sprintf("%s/onehot-ancestry-af.%04d.csv", *outputDir, infileIdx)
+					err = writeAncestryAF(afFnm, cmd.ancestryNames, onehotXref)
+					if err != nil {
+						return err
+					}
+					cmd.outputs.add(outputArtifact{File: afFnm, Kind: "ancestry-af"})
+				}
 				debug.FreeOSMemory()
 				throttleNumpyMem.Release()
 			}
@@ -859,29 +1491,56 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 				n := len(onehotIndirect[infileIdx][0])
 				log.Infof("%04d: keeping onehot coordinates in memory (n=%d, mem=%d)", infileIdx, n, n*8*2)
 			}
-			if !(*onehotSingle || *onehotChunked || *onlyPCA) || *mergeOutput || *hgvsSingle {
+			if !(*onehotSingle || *onehotChunked || *onlyPCA) || *mergeOutput || *hgvsSingle || panel != nil {
 				log.Infof("%04d: preparing numpy (rows=%d, cols=%d)", infileIdx, len(cmd.cgnames), 2*outcol)
 				throttleNumpyMem.Acquire()
 				rows := len(cmd.cgnames)
 				cols := 2 * outcol
 				out := make([]int16, rows*cols)
+				// lengthDev is the -length-deviation
+				// matrix, with the same layout as out
+				var lengthDev []int16
+				if variantLengthDeviation != nil && !*mergeOutput && !*onehotChunked && !*onehotSingle {
+					lengthDev = make([]int16, rows*cols)
+				}
 				for row, name := range cmd.cgnames {
 					outidx := row * cols
+					// spanEnd[phase] is the end tag
+					// of the most recent tile
+					// variant in each phase (for
+					// -mark-spanning)
+					var spanEnd [2]tagID
 					for col, v := range cgs[name].Variants {
 						tag := tagstart + tagID(col/2)
 						if cmd.filter.MaxTag >= 0 && tag > tagID(cmd.filter.MaxTag) {
 							break
 						}
+						if cmd.markSpanning && v > 0 {
+							spanEnd[col%2] = tag + 1
+							if variants, ok := seq[tag]; ok && int(v) < len(variants) {
+								if endtag, ok := taglib.EndTag(variants[v].Sequence); ok && endtag > tag {
+									spanEnd[col%2] = endtag
+								}
+							}
+						}
 						if rt := reftile[tag]; mask != nil && (rt == nil || rt.excluded) {
 							continue
 						}
-						if v == 0 {
+						if v == 0 && cmd.markSpanning && tag < spanEnd[col%2] {
+							out[outidx] = tileMatrixSpanning
+						} else if v == 0 {
 							out[outidx] = 0 // tag not found / spanning tile
 						} else if variants, ok := seq[tag]; ok && int(v) < len(variants) && len(variants[v].Sequence) > 0 {
 							out[outidx] = int16(variantRemap[tag-tagstart][v])
 						} else {
 							out[outidx] = -1 // low quality tile variant
 						}
+						if lengthDev != nil {
+							lengthDev[outidx] = math.MinInt16
+							if dev := variantLengthDeviation[tag-tagstart]; out[outidx] > 0 && int(v) < len(dev) {
+								lengthDev[outidx] = lengthDeviationInt16(dev[v])
+							}
+						}
 						if tag == cmd.debugTag {
 							log.Printf("tag %d row %d col %d outidx %d v %d out %d", tag, row, col, outidx, v, out[outidx])
 						}
@@ -892,7 +1551,7 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 				cgs = nil
 				debug.FreeOSMemory()
 				throttleNumpyMem.Release()
-				if *mergeOutput || *hgvsSingle {
+				if *mergeOutput || *hgvsSingle || panel != nil {
 					log.Infof("%04d: matrix fragment %d rows x %d cols", infileIdx, rows, cols)
 					toMerge[infileIdx] = out
 				}
@@ -902,16 +1561,40 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 					if err != nil {
 						return err
 					}
+					err = cmd.addMatrixOutput(fnm, "matrix", rows, cols, annotationsFilename, tileMatrixMissing)
+					if err != nil {
+						return err
+					}
+					if lengthDev != nil {
+						fnm := fmt.Sprintf("%s/length-deviation.%04d.npy", *outputDir, infileIdx)
+						err = writeNumpyInt16(fnm, lengthDev, rows, cols)
+						if err != nil {
+							return err
+						}
+						err = cmd.addMatrixOutput(fnm, "length-deviation", rows, cols, annotationsFilename, lengthMatrixMissing)
+						if err != nil {
+							return err
+						}
+					}
+				}
+			}
+			if cmd.partial != nil {
+				fnms, err := filepath.Glob(fmt.Sprintf("%s/*.%04d.*", *outputDir, infileIdx))
+				if err != nil {
+					return err
 				}
+				cmd.partial.Add(fnms...)
 			}
 			debug.FreeOSMemory()
-			log.Infof("%s: done (%d/%d)", infile, int(atomic.AddInt64(&done, 1)), len(infiles))
+			log.Infof("%s: done", infile)
+			progress.Add(1)
 			return nil
 		})
 	}
 	if err = throttleMem.Wait(); err != nil {
 		return err
 	}
+	progress.Done()
 
 	if *hgvsChunked {
 		log.Info("flushing hgvsCols temp files")
@@ -922,15 +1605,25 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 		if err != nil {
 			return err
 		}
+		var totalDisk, totalRaw int64
+		for seqname, tmp := range tmpHGVSCols {
+			disk, raw, err := tmp.Size()
+			if err != nil {
+				return err
+			}
+			log.Infof("%s: hgvsCols temp file is %d bytes (%d bytes before compression)", seqname, disk, raw)
+			totalDisk += disk
+			totalRaw += raw
+		}
+		log.Infof("hgvsCols temp files in %s total %d bytes (%d bytes before compression)", *tmpDir, totalDisk, totalRaw)
 		for seqname := range refseq {
 			log.Infof("%s: reading hgvsCols from temp file", seqname)
-			f := tmpHGVSCols[seqname]
-			_, err = f.Seek(0, io.SeekStart)
+			var dec *gob.Decoder
+			dec, err = tmpHGVSCols[seqname].Decoder()
 			if err != nil {
 				return err
 			}
 			var hgvsCols hgvsColSet
-			dec := gob.NewDecoder(bufio.NewReaderSize(f, 1<<24))
 			for err == nil {
 				err = dec.Decode(&hgvsCols)
 			}
@@ -964,13 +1657,18 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 					}
 				}
 			}
-			err = writeNumpyInt8(fmt.Sprintf("%s/hgvs.%s.npy", *outputDir, seqname), out, rows, cols)
+			fnm := fmt.Sprintf("%s/hgvs.%s.annotations.csv", *outputDir, seqname)
+			npyFnm := fmt.Sprintf("%s/hgvs.%s.npy", *outputDir, seqname)
+			err = writeNumpyInt8(npyFnm, out, rows, cols)
+			if err != nil {
+				return err
+			}
+			err = cmd.addMatrixOutput(npyFnm, "hgvs", rows, cols, fnm, hgvsMatrixMissing)
 			if err != nil {
 				return err
 			}
 			out = nil
 
-			fnm := fmt.Sprintf("%s/hgvs.%s.annotations.csv", *outputDir, seqname)
 			log.Infof("%s: writing hgvs column labels to %s", seqname, fnm)
 			var hgvsLabels bytes.Buffer
 			for varIdx, variant := range variants {
@@ -980,10 +1678,11 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 			if err != nil {
 				return err
 			}
+			cmd.outputs.add(outputArtifact{File: fnm, Kind: "annotations"})
 		}
 	}
 
-	if *mergeOutput || *hgvsSingle {
+	if *mergeOutput || *hgvsSingle || panel != nil {
 		var annow *bufio.Writer
 		var annof *os.File
 		if *mergeOutput {
@@ -1005,14 +1704,43 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 		if *mergeOutput {
 			out = make([]int16, rows*cols)
 		}
-		hgvsCols := map[string][2][]int16{} // hgvs -> [[g0,g1,g2,...], [g0,g1,g2,...]] (slice of genomes for each phase)
-		startcol := 0
-		for outIdx, chunk := range toMerge {
-			chunkcols := len(chunk) / rows
-			if *mergeOutput {
-				for row := 0; row < rows; row++ {
-					copy(out[row*cols+startcol:], chunk[row*chunkcols:(row+1)*chunkcols])
-				}
+		var hgvsMat *hgvsMatrix
+		if *hgvsSingle {
+			hgvsMat, err = newHGVSMatrix(*tmpDir+"/tmp.hgvs-matrix", rows)
+			if err != nil {
+				return err
+			}
+			defer hgvsMat.Close()
+		}
+		var panelMat *hgvsMatrix
+		if panel != nil {
+			panelMat, err = newHGVSMatrix(*tmpDir+"/tmp.panel-matrix", rows)
+			if err != nil {
+				return err
+			}
+			defer panelMat.Close()
+		}
+		// merged tile column -> ref position, for
+		// -sort-annotations
+		var tilePos []tilePosition
+		if *sortAnnotations {
+			tilePos = make([]tilePosition, cols/2)
+		}
+		annotated := map[hgvsKey]bool{}
+		startcol := 0
+		for outIdx, chunk := range toMerge {
+			// variant -> [[g0,g1,g2,...], [g0,g1,g2,...]] (slice
+			// of genomes for each phase)
+			hgvsCols := map[hgvsKey][2][]int16{}
+			var hgvsKeys []hgvsKey
+			hgvsIDs := map[hgvsKey]string{}
+			// ref tiles in this chunk: tag -> input column
+			var refTiles [][2]int
+			chunkcols := len(chunk) / rows
+			if *mergeOutput {
+				for row := 0; row < rows; row++ {
+					copy(out[row*cols+startcol:], chunk[row*chunkcols:(row+1)*chunkcols])
+				}
 			}
 			toMerge[outIdx] = nil
 
@@ -1040,6 +1768,7 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 				seqname := string(fields[4])
 				pos, _ := strconv.Atoi(string(fields[5]))
 				refseq := fields[6]
+				key := hgvsKey{seqname: seqname, pos: pos, ref: string(refseq), alt: string(fields[7])}
 				if hgvsID == "" {
 					// Null entry for un-diffable
 					// tile variant
@@ -1047,16 +1776,20 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 				}
 				if hgvsID == "=" {
 					// Null entry for ref tile
+					refTiles = append(refTiles, [2]int{tag, incol})
+					if tilePos != nil {
+						tilePos[incol+startcol/2] = tilePosition{seqname: seqname, pos: pos, ok: true}
+					}
 					continue
 				}
-				if mask != nil && !mask.Check(strings.TrimPrefix(seqname, "chr"), pos, pos+len(refseq)) {
+				if mask != nil && !mask.Check(seqname, pos, pos+len(refseq)) {
 					// The tile intersects one of
 					// the selected regions, but
 					// this particular HGVS
 					// variant does not.
 					continue
 				}
-				hgvsColPair := hgvsCols[hgvsID]
+				hgvsColPair := hgvsCols[key]
 				if hgvsColPair[0] == nil {
 					// values in new columns start
 					// out as -1 ("no data yet")
@@ -1080,8 +1813,14 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 							}
 						}
 					}
-					hgvsCols[hgvsID] = hgvsColPair
-					if annow != nil {
+					hgvsCols[key] = hgvsColPair
+					hgvsKeys = append(hgvsKeys, key)
+					hgvsIDs[key] = hgvsID
+					if annow != nil && !annotated[key] {
+						// (only once, even if the
+						// variant appears again in
+						// a later chunk)
+						annotated[key] = true
 						hgvsref := hgvs.Variant{
 							Position: pos,
 							Ref:      string(refseq),
@@ -1089,6 +1828,8 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 						}
 						fmt.Fprintf(annow, "%d,%d,%d,%s:g.%s,%s,%d,%s,%s,%s\n", tag, incol+startcol/2, rt.variant, seqname, hgvsref.String(), seqname, pos, refseq, refseq, fields[8])
 					}
+				} else if hgvsIDs[key] != hgvsID {
+					return fmt.Errorf("%s: variant %+v has two different hgvs IDs: %q and %q", annotationsFilename, key, hgvsIDs[key], hgvsID)
 				}
 				if annow != nil {
 					fmt.Fprintf(annow, "%d,%d,%d,%s,%s,%d,%s,%s,%s\n", tag, incol+startcol/2, tileVariant, hgvsID, seqname, pos, refseq, fields[7], fields[8])
@@ -1103,6 +1844,23 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 				}
 			}
 
+			if hgvsMat != nil {
+				for _, key := range hgvsKeys {
+					err = hgvsMat.Add(key, hgvsIDs[key], hgvsCols[key])
+					if err != nil {
+						return err
+					}
+				}
+			}
+			if panelMat != nil {
+				err = panel.addColumns(panelMat, mask, chunk, refTiles, hgvsKeys, hgvsCols, func(tag int) (tileVariantID, string, int, int) {
+					rt := reftile[tagID(tag)]
+					return rt.variant, rt.seqname, rt.pos, len(rt.tiledata)
+				})
+				if err != nil {
+					return err
+				}
+			}
 			startcol += chunkcols
 		}
 		if *mergeOutput {
@@ -1118,32 +1876,59 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 			if err != nil {
 				return err
 			}
+			cmd.outputs.add(outputArtifact{File: "matrix.annotations.csv", Kind: "annotations"})
+			err = cmd.addMatrixOutput(*outputDir+"/matrix.npy", "matrix", rows, cols, "matrix.annotations.csv", tileMatrixMissing)
+			if err != nil {
+				return err
+			}
+			if *sortAnnotations {
+				err = writeSortedAnnotations(*outputDir, *tmpDir, tilePos)
+				if err != nil {
+					return err
+				}
+				cmd.outputs.add(outputArtifact{File: "matrix.sorted.annotations.csv", Kind: "annotations"})
+				cmd.outputs.addNumpy("matrix.sorted-columns.npy", "sorted-columns", "int32", 1, cols, "", "matrix.sorted.annotations.csv")
+			}
+			if *splitOutput {
+				err = cmd.writeSplitNumpyInt16(fmt.Sprintf("%s/matrix", *outputDir), out, cols, tileMatrixMissing)
+				if err != nil {
+					return err
+				}
+			}
 		}
 		out = nil
 
 		if *hgvsSingle {
-			cols = len(hgvsCols) * 2
+			cols = hgvsMat.Len() * 2
 			log.Printf("building hgvs-based matrix: %d rows x %d cols", rows, cols)
-			out = make([]int16, rows*cols)
-			hgvsIDs := make([]string, 0, cols/2)
-			for hgvsID := range hgvsCols {
-				hgvsIDs = append(hgvsIDs, hgvsID)
-			}
-			sort.Strings(hgvsIDs)
-			var hgvsLabels bytes.Buffer
-			for idx, hgvsID := range hgvsIDs {
-				fmt.Fprintf(&hgvsLabels, "%d,%s\n", idx, hgvsID)
-				for ph := 0; ph < 2; ph++ {
-					hgvscol := hgvsCols[hgvsID][ph]
-					for row, val := range hgvscol {
-						out[row*cols+idx*2+ph] = val
-					}
+			var hgvsIDs []string
+			if *splitOutput {
+				out, hgvsIDs, err = hgvsMat.Matrix()
+				if err == nil {
+					err = writeNumpyInt16(fmt.Sprintf("%s/hgvs.npy", *outputDir), out, rows, cols)
+				}
+				if err == nil {
+					err = cmd.writeSplitNumpyInt16(fmt.Sprintf("%s/hgvs", *outputDir), out, cols, hgvsMatrixMissing)
 				}
+				out = nil
+			} else {
+				hgvsIDs, err = hgvsMat.WriteNumpy(fmt.Sprintf("%s/hgvs.npy", *outputDir), 1<<30)
 			}
-			err = writeNumpyInt16(fmt.Sprintf("%s/hgvs.npy", *outputDir), out, rows, cols)
 			if err != nil {
 				return err
 			}
+			err = hgvsMat.Close()
+			if err != nil {
+				return err
+			}
+			err = cmd.addMatrixOutput(*outputDir+"/hgvs.npy", "hgvs", rows, cols, "hgvs.annotations.csv", hgvsMatrixMissing)
+			if err != nil {
+				return err
+			}
+			var hgvsLabels bytes.Buffer
+			for idx, hgvsID := range hgvsIDs {
+				fmt.Fprintf(&hgvsLabels, "%d,%s\n", idx, hgvsID)
+			}
 
 			fnm := fmt.Sprintf("%s/hgvs.annotations.csv", *outputDir)
 			log.Printf("writing hgvs labels: %s", fnm)
@@ -1151,6 +1936,29 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 			if err != nil {
 				return err
 			}
+			cmd.outputs.add(outputArtifact{File: fnm, Kind: "annotations"})
+		}
+
+		if panelMat != nil {
+			cols = len(panel.variants) * 2
+			log.Printf("writing panel matrix: %d rows x %d cols (%d of %d panel variants seen in input)", rows, cols, panelMat.Len(), len(panel.variants))
+			err = panelMat.WriteNumpyKeys(fmt.Sprintf("%s/panel.npy", *outputDir), panel.Keys(), 1<<30)
+			if err != nil {
+				return err
+			}
+			err = panelMat.Close()
+			if err != nil {
+				return err
+			}
+			err = cmd.addMatrixOutput(*outputDir+"/panel.npy", "panel", rows, cols, "panel.annotations.csv", hgvsMatrixMissing)
+			if err != nil {
+				return err
+			}
+			err = panel.WriteAnnotations(fmt.Sprintf("%s/panel.annotations.csv", *outputDir))
+			if err != nil {
+				return err
+			}
+			cmd.outputs.add(outputArtifact{File: "panel.annotations.csv", Kind: "annotations"})
 		}
 	}
 	if *onehotSingle || *onlyPCA {
@@ -1180,15 +1988,62 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 		}
 		if *onehotSingle {
 			fnm := fmt.Sprintf("%s/onehot.npy", *outputDir)
-			err = writeNumpyUint32(fnm, onehot, 2, nzCount)
+			if !cmd.aggregateOnly {
+				err = writeNumpyUint32(fnm, onehot, 2, nzCount)
+				if err != nil {
+					return err
+				}
+				// Sparse format: the rows of this
+				// array are (sample row, onehot
+				// column) pairs, so the label files
+				// describe the values in those rows,
+				// not the rows/columns of this array.
+				cmd.outputs.addNumpy(fnm, "onehot-sparse", "uint32", 2, nzCount, "samples.csv", "onehot-columns.npy")
+			} else {
+				err = writeOnehotAggregates(*outputDir+"/onehot-aggregates.csv", cmd.trainingSetSize, xrefs)
+				if err != nil {
+					return err
+				}
+				cmd.outputs.add(outputArtifact{File: "onehot-aggregates.csv", Kind: "aggregates"})
+			}
+			if *splitOutput {
+				err = cmd.writeSplitOnehot(fmt.Sprintf("%s/onehot", *outputDir), onehot)
+				if err != nil {
+					return err
+				}
+			}
+			fnm = fmt.Sprintf("%s/onehot-columns.npy", *outputDir)
+			err = writeNumpyInt32(fnm, onehotXref2int32(xrefs), onehotXrefRows, len(xrefs))
 			if err != nil {
 				return err
 			}
-			fnm = fmt.Sprintf("%s/onehot-columns.npy", *outputDir)
-			err = writeNumpyInt32(fnm, onehotXref2int32(xrefs), 5, len(xrefs))
+			cmd.outputs.addNumpy(fnm, "onehot-columns", "int32", onehotXrefRows, len(xrefs), "", "onehot-column-ids.csv")
+			err = writeColumnIDs(*outputDir+"/onehot-column-ids.csv", xrefs)
 			if err != nil {
 				return err
 			}
+			cmd.outputs.add(outputArtifact{File: "onehot-column-ids.csv", Kind: "column-ids"})
+			if cmd.caseControlStats {
+				err = writeCaseControlStats(*outputDir+"/onehot-case-control.csv", xrefs)
+				if err != nil {
+					return err
+				}
+				cmd.outputs.add(outputArtifact{File: "onehot-case-control.csv", Kind: "case-control-stats"})
+			}
+			if cmd.lengthDeviation {
+				err = writeLengthDeviation(*outputDir+"/onehot-length-deviation.csv", xrefs)
+				if err != nil {
+					return err
+				}
+				cmd.outputs.add(outputArtifact{File: "onehot-length-deviation.csv", Kind: "length-deviation"})
+			}
+			if cmd.ancestry != nil {
+				err = writeAncestryAF(*outputDir+"/onehot-ancestry-af.csv", cmd.ancestryNames, xrefs)
+				if err != nil {
+					return err
+				}
+				cmd.outputs.add(outputArtifact{File: "onehot-ancestry-af.csv", Kind: "ancestry-af"})
+			}
 			fnm = fmt.Sprintf("%s/stats.json", *outputDir)
 			j, err := json.Marshal(map[string]interface{}{
 				"pvalueCallCount": cmd.pvalueCallCount,
@@ -1200,6 +2055,7 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 			if err != nil {
 				return err
 			}
+			cmd.outputs.add(outputArtifact{File: fnm, Kind: "stats"})
 		}
 		if *onlyPCA {
 			cols := 0
@@ -1269,21 +2125,39 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 			if err != nil {
 				return err
 			}
+			cmd.outputs.addNumpy(fnm, "pca", "float64", outrows, outcols, "pca.samples.csv", "")
 			log.Print("done")
 
+			// Write a copy of the sample metadata with
+			// the new PCA components to pca.samples.csv.
+			// samples.csv (written above) continues to
+			// reflect the -samples input as provided.
+			if outrows != len(cmd.samples) {
+				return fmt.Errorf("bug: PCA output has %d rows, but there are %d samples", outrows, len(cmd.samples))
+			}
 			log.Print("copying pca components to sampleInfo")
-			for i := range cmd.samples {
-				cmd.samples[i].pcaComponents = make([]float64, outcols)
+			pcaSamples := make([]sampleInfo, len(cmd.samples))
+			copy(pcaSamples, cmd.samples)
+			for i := range pcaSamples {
+				pcaSamples[i].pcaComponents = make([]float64, outcols)
 				for c := 0; c < outcols; c++ {
-					cmd.samples[i].pcaComponents[c] = pca.At(i, c)
+					pcaSamples[i].pcaComponents[c] = pca.At(i, c)
 				}
 			}
 			log.Print("done")
 
-			err = writeSampleInfo(cmd.samples, *outputDir)
+			if cmd.pcaClusters > 0 || cmd.pcaOutlierSD > 0 {
+				err = cmd.clusterPCASamples(pcaSamples)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = writeSampleInfoFile(pcaSamples, *outputDir+"/pca.samples.csv")
 			if err != nil {
 				return err
 			}
+			cmd.outputs.add(outputArtifact{File: "pca.samples.csv", Kind: "samples"})
 		}
 	}
 	if !*mergeOutput && !*onehotChunked && !*onehotSingle && !*onlyPCA {
@@ -1307,9 +2181,36 @@ func (cmd *sliceNumpy) run(prog string, args []string, stdin io.Reader, stdout,
 			err = fmt.Errorf("close %s: %w", tagoffsetFilename, err)
 			return err
 		}
+		cmd.outputs.add(outputArtifact{File: tagoffsetFilename, Kind: "chunk-tag-offsets"})
 	}
 
-	return nil
+	if *annotationFormat == annotationFormatV2 {
+		fnms, err := filepath.Glob(*outputDir + "/matrix*.annotations.csv")
+		if err != nil {
+			return err
+		}
+		for _, fnm := range fnms {
+			log.Infof("adding v2 header to %s", fnm)
+			err = prependAnnotationHeader(fnm)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Infof("writing output catalog to %s/outputs.json", *outputDir)
+	err = cmd.outputs.Write(*outputDir + "/outputs.json")
+	if err != nil {
+		return err
+	}
+
+	inputs := infiles
+	for _, fnm := range []string{*samplesFilename, *variantsFilename, *excludeTagsFilename} {
+		if fnm != "" {
+			inputs = append(inputs, fnm)
+		}
+	}
+	return cmd.manifest.Write(*outputDir, args, inputs)
 }
 
 type sampleInfo struct {
@@ -1319,10 +2220,23 @@ type sampleInfo struct {
 	isTraining    bool
 	isValidation  bool
 	pcaComponents []float64
+	phenotypes    map[string]string  // phenotype name => "1" (case), "0" (control), or other (neither)
+	covariates    map[string]float64 // covariate name => value
 }
 
+const covariateColumnPrefix = "Covariate:"
+
+var pcaColumnRe = regexp.MustCompile(`^PCA[0-9]+$`)
+
 // Read samples.csv file with case/control and training/validation
 // flags.
+//
+// Columns after TrainingValidation are interpreted according to
+// their names in the header row: "PCA0", "PCA1", etc. are PCA
+// components; "Covariate:NAME" columns are numeric covariates; any
+// other column is an additional phenotype with the same 0/1
+// encoding as CaseControl (see selectPhenotype). If there is no
+// header row, all additional columns are PCA components.
 func loadSampleInfo(samplesFilename string) ([]sampleInfo, error) {
 	var si []sampleInfo
 	f, err := open(samplesFilename)
@@ -1334,6 +2248,7 @@ func loadSampleInfo(samplesFilename string) ([]sampleInfo, error) {
 	if err != nil {
 		return nil, err
 	}
+	var header []string
 	lineNum := 0
 	for _, csv := range bytes.Split(buf, []byte{'\n'}) {
 		lineNum++
@@ -1345,6 +2260,7 @@ func loadSampleInfo(samplesFilename string) ([]sampleInfo, error) {
 			return nil, fmt.Errorf("%d fields < 4 in %s line %d: %q", len(split), samplesFilename, lineNum, csv)
 		}
 		if split[0] == "Index" && split[1] == "SampleID" && split[2] == "CaseControl" && split[3] == "TrainingValidation" {
+			header = split
 			continue
 		}
 		idx, err := strconv.Atoi(split[0])
@@ -1357,14 +2273,39 @@ func loadSampleInfo(samplesFilename string) ([]sampleInfo, error) {
 		if idx != len(si) {
 			return nil, fmt.Errorf("%s line %d: index %d out of order", samplesFilename, lineNum, idx)
 		}
+		if header != nil && len(split) != len(header) {
+			return nil, fmt.Errorf("%s line %d: %d fields, but header has %d", samplesFilename, lineNum, len(split), len(header))
+		}
 		var pcaComponents []float64
-		if len(split) > 4 {
-			for _, s := range split[4:] {
+		var phenotypes map[string]string
+		var covariates map[string]float64
+		for col := 4; col < len(split); col++ {
+			s := split[col]
+			name := ""
+			if header != nil {
+				name = header[col]
+			}
+			switch {
+			case header == nil || pcaColumnRe.MatchString(name):
 				f, err := strconv.ParseFloat(s, 64)
 				if err != nil {
 					return nil, fmt.Errorf("%s line %d: cannot parse float %q: %s", samplesFilename, lineNum, s, err)
 				}
 				pcaComponents = append(pcaComponents, f)
+			case strings.HasPrefix(name, covariateColumnPrefix):
+				f, err := strconv.ParseFloat(s, 64)
+				if err != nil {
+					return nil, fmt.Errorf("%s line %d: %s: cannot parse float %q: %s", samplesFilename, lineNum, name, s, err)
+				}
+				if covariates == nil {
+					covariates = map[string]float64{}
+				}
+				covariates[strings.TrimPrefix(name, covariateColumnPrefix)] = f
+			default:
+				if phenotypes == nil {
+					phenotypes = map[string]string{}
+				}
+				phenotypes[name] = s
 			}
 		}
 		si = append(si, sampleInfo{
@@ -1374,13 +2315,118 @@ func loadSampleInfo(samplesFilename string) ([]sampleInfo, error) {
 			isTraining:    split[3] == "1",
 			isValidation:  split[3] == "0" && len(split[2]) > 0, // fix errant 0s in input
 			pcaComponents: pcaComponents,
+			phenotypes:    phenotypes,
+			covariates:    covariates,
 		})
 	}
 	return si, nil
 }
 
+// sampleInfoFromProperties returns one sampleInfo for each of the
+// given genome names, using the Arvados property records (see
+// loadArvadosProperties) whose idProp matches the genome name. The
+// properties named in phenotypes are copied to the sampleInfo
+// phenotypes (see selectPhenotype).
+//
+// Genomes with no matching record are neither cases nor controls.
+func sampleInfoFromProperties(cgnames []string, records []map[string]string, idProp, ccProp, tvProp string, phenotypes []string) ([]sampleInfo, error) {
+	byID := map[string]map[string]string{}
+	for _, rec := range records {
+		id := rec[idProp]
+		if id == "" {
+			continue
+		}
+		if _, dup := byID[id]; dup {
+			return nil, fmt.Errorf("multiple objects have %s=%q", idProp, id)
+		}
+		byID[id] = rec
+	}
+	si := make([]sampleInfo, len(cgnames))
+	matched := 0
+	for i, name := range cgnames {
+		id := trimFilenameForLabel(name)
+		si[i].id = id
+		rec, ok := byID[id]
+		if !ok {
+			rec, ok = byID[name]
+		}
+		if !ok {
+			continue
+		}
+		matched++
+		si[i].isCase = rec[ccProp] == "1"
+		si[i].isControl = rec[ccProp] == "0"
+		if tv, ok := rec[tvProp]; ok {
+			si[i].isTraining = tv == "1"
+			si[i].isValidation = tv == "0" && (si[i].isCase || si[i].isControl)
+		} else {
+			si[i].isTraining = si[i].isCase || si[i].isControl
+		}
+		for _, k := range phenotypes {
+			if v, ok := rec[k]; ok {
+				if si[i].phenotypes == nil {
+					si[i].phenotypes = map[string]string{}
+				}
+				si[i].phenotypes[k] = v
+			}
+		}
+	}
+	log.Infof("found sample metadata properties for %d of %d genomes", matched, len(cgnames))
+	if matched == 0 {
+		return nil, fmt.Errorf("no objects have a %s property matching any of the %d genome names", idProp, len(cgnames))
+	}
+	return si, nil
+}
+
+// selectPhenotype replaces the isCase/isControl flags of each sample
+// with the values from the named phenotype column. Samples whose
+// value is neither "1" nor "0" (e.g., "NA" or empty) are also
+// removed from the training and validation sets, so they are not
+// counted as controls.
+func selectPhenotype(samples []sampleInfo, name string) error {
+	for i := range samples {
+		val, ok := samples[i].phenotypes[name]
+		if !ok {
+			return fmt.Errorf("phenotype %q not found for sample %d (%s)", name, i, samples[i].id)
+		}
+		samples[i].isCase = val == "1"
+		samples[i].isControl = val == "0"
+		if !samples[i].isCase && !samples[i].isControl {
+			samples[i].isTraining = false
+			samples[i].isValidation = false
+		}
+	}
+	return nil
+}
+
+// sampleInfoColumnNames returns the sorted phenotype and covariate
+// names present in samples.
+func sampleInfoColumnNames(samples []sampleInfo) (phenotypes, covariates []string) {
+	pheno, cov := map[string]bool{}, map[string]bool{}
+	for _, si := range samples {
+		for name := range si.phenotypes {
+			pheno[name] = true
+		}
+		for name := range si.covariates {
+			cov[name] = true
+		}
+	}
+	for name := range pheno {
+		phenotypes = append(phenotypes, name)
+	}
+	for name := range cov {
+		covariates = append(covariates, name)
+	}
+	sort.Strings(phenotypes)
+	sort.Strings(covariates)
+	return
+}
+
 func writeSampleInfo(samples []sampleInfo, outputDir string) error {
-	fnm := outputDir + "/samples.csv"
+	return writeSampleInfoFile(samples, outputDir+"/samples.csv")
+}
+
+func writeSampleInfoFile(samples []sampleInfo, fnm string) error {
 	log.Infof("writing sample metadata to %s", fnm)
 	f, err := os.Create(fnm)
 	if err != nil {
@@ -1393,6 +2439,13 @@ func writeSampleInfo(samples []sampleInfo, outputDir string) error {
 			pcaLabels += fmt.Sprintf(",PCA%d", i)
 		}
 	}
+	phenotypeNames, covariateNames := sampleInfoColumnNames(samples)
+	for _, name := range phenotypeNames {
+		pcaLabels += "," + name
+	}
+	for _, name := range covariateNames {
+		pcaLabels += "," + covariateColumnPrefix + name
+	}
 	_, err = fmt.Fprintf(f, "Index,SampleID,CaseControl,TrainingValidation%s\n", pcaLabels)
 	if err != nil {
 		return err
@@ -1413,6 +2466,12 @@ func writeSampleInfo(samples []sampleInfo, outputDir string) error {
 		for _, pcaval := range si.pcaComponents {
 			pcavals += fmt.Sprintf(",%f", pcaval)
 		}
+		for _, name := range phenotypeNames {
+			pcavals += "," + si.phenotypes[name]
+		}
+		for _, name := range covariateNames {
+			pcavals += "," + strconv.FormatFloat(si.covariates[name], 'g', -1, 64)
+		}
 		_, err = fmt.Fprintf(f, "%d,%s,%s,%s%s\n", i, si.id, cc, tv, pcavals)
 		if err != nil {
 			return fmt.Errorf("write %s: %w", fnm, err)
@@ -1426,6 +2485,285 @@ func writeSampleInfo(samples []sampleInfo, outputDir string) error {
 	return nil
 }
 
+// clusterPCASamples adds PCACluster and/or PCAOutlier phenotype
+// columns (see clusterPCA) to the given samples, which must already
+// have PCA components.
+func (cmd *sliceNumpy) clusterPCASamples(samples []sampleInfo) error {
+	k := cmd.pcaClusters
+	if k == 0 {
+		// outliers only: treat all samples as one cluster
+		k = 1
+	}
+	components := make([][]float64, len(samples))
+	training := make([]bool, len(samples))
+	for i, si := range samples {
+		components[i] = si.pcaComponents
+		training[i] = si.isTraining
+	}
+	clusters, outliers, err := clusterPCA(components, training, k, cmd.pcaOutlierSD)
+	if err != nil {
+		return err
+	}
+	size := make([]int, k)
+	noutliers := 0
+	for i := range samples {
+		phenotypes := map[string]string{}
+		for name, val := range samples[i].phenotypes {
+			phenotypes[name] = val
+		}
+		if cmd.pcaClusters > 0 {
+			phenotypes[pcaClusterColumn] = fmt.Sprintf("%d", clusters[i])
+			size[clusters[i]]++
+		}
+		if outliers != nil {
+			if outliers[i] {
+				phenotypes[pcaOutlierColumn] = "1"
+				noutliers++
+			} else {
+				phenotypes[pcaOutlierColumn] = "0"
+			}
+		}
+		samples[i].phenotypes = phenotypes
+	}
+	if cmd.pcaClusters > 0 {
+		log.Infof("PCA cluster sizes: %v", size)
+	}
+	if outliers != nil {
+		log.Infof("flagged %d PCA outliers (> %g SD)", noutliers, cmd.pcaOutlierSD)
+	}
+	return nil
+}
+
+// splitRows returns the output row numbers of the training and
+// validation samples.
+func (cmd *sliceNumpy) splitRows() (train, val []int) {
+	for row, si := range cmd.samples {
+		if si.isTraining {
+			train = append(train, row)
+		} else if si.isValidation {
+			val = append(val, row)
+		}
+	}
+	return
+}
+
+// writeSplitLabels writes the case/control labels of the training
+// and validation samples to y.train.npy and y.val.npy.
+func (cmd *sliceNumpy) writeSplitLabels(outputDir string) error {
+	train, val := cmd.splitRows()
+	for _, split := range []struct {
+		name string
+		rows []int
+	}{{"train", train}, {"val", val}} {
+		y := make([]int8, len(split.rows))
+		for i, row := range split.rows {
+			if cmd.samples[row].isCase {
+				y[i] = 1
+			} else if !cmd.samples[row].isControl {
+				y[i] = -1
+			}
+		}
+		fnm := fmt.Sprintf("%s/y.%s.npy", outputDir, split.name)
+		err := writeNumpyInt8(fnm, y, len(y), 1)
+		if err != nil {
+			return err
+		}
+		cmd.outputs.addNumpy(fnm, "labels-"+split.name, "int8", len(y), 1, "samples.csv", "")
+	}
+	return nil
+}
+
+// tilePosition is the reference position of a merged tile column.
+type tilePosition struct {
+	seqname string
+	pos     int
+	ok      bool // false if the tile has no reference position
+}
+
+// annotationSortRunBytes is the amount of annotation data to sort in
+// memory before spilling a sorted run to disk.
+const annotationSortRunBytes = 1 << 28
+
+// writeSortedAnnotations writes matrix.sorted.annotations.csv, the
+// lines of matrix.annotations.csv sorted by chromosome, position, and
+// tile column, and matrix.sorted-columns.npy, the columns of
+// matrix.npy in the same order (tiles without a reference position
+// go last). Temporary files are written in tmpDir.
+func writeSortedAnnotations(outputDir, tmpDir string, tilePos []tilePosition) error {
+	order := map[string]contigOrderKey{}
+	type sortKey struct {
+		contig contigOrderKey
+		pos    int
+		outcol int
+	}
+	parse := func(line []byte) sortKey {
+		fields := bytes.SplitN(line, []byte{','}, 7)
+		if len(fields) < 7 {
+			return sortKey{}
+		}
+		outcol, _ := strconv.Atoi(string(fields[1]))
+		pos, _ := strconv.Atoi(string(fields[5]))
+		contig, ok := order[string(fields[4])]
+		if !ok {
+			contig = contigOrder(string(fields[4]))
+			order[string(fields[4])] = contig
+		}
+		return sortKey{contig, pos, outcol}
+	}
+	err := sortLinesExternal(outputDir+"/matrix.annotations.csv", outputDir+"/matrix.sorted.annotations.csv", tmpDir+"/tmp.sort.", annotationSortRunBytes, func(a, b []byte) bool {
+		ka, kb := parse(a), parse(b)
+		if ka.contig != kb.contig {
+			return ka.contig.less(kb.contig)
+		} else if ka.pos != kb.pos {
+			return ka.pos < kb.pos
+		}
+		return ka.outcol < kb.outcol
+	})
+	if err != nil {
+		return err
+	}
+
+	tiles := make([]int, len(tilePos))
+	for i := range tiles {
+		tiles[i] = i
+	}
+	sort.SliceStable(tiles, func(i, j int) bool {
+		a, b := tilePos[tiles[i]], tilePos[tiles[j]]
+		if a.ok != b.ok {
+			return a.ok
+		} else if !a.ok {
+			return false
+		} else if a.seqname != b.seqname {
+			return chromLess(a.seqname, b.seqname)
+		}
+		return a.pos < b.pos
+	})
+	perm := make([]int32, 0, len(tiles)*2)
+	for _, tile := range tiles {
+		perm = append(perm, int32(tile*2), int32(tile*2+1))
+	}
+	return writeNumpyInt32(outputDir+"/matrix.sorted-columns.npy", perm, 1, len(perm))
+}
+
+// writeSplitNumpyInt16 writes the training and validation rows of
+// the given matrix (one row per sample) to {prefix}.train.npy and
+// {prefix}.val.npy. Columns are the same as in the full matrix.
+func (cmd *sliceNumpy) writeSplitNumpyInt16(prefix string, out []int16, cols int, missing func(int16) bool) error {
+	train, val := cmd.splitRows()
+	for _, split := range []struct {
+		name string
+		rows []int
+	}{{"train", train}, {"val", val}} {
+		sub := make([]int16, len(split.rows)*cols)
+		for i, row := range split.rows {
+			copy(sub[i*cols:(i+1)*cols], out[row*cols:(row+1)*cols])
+		}
+		err := writeNumpyInt16(prefix+"."+split.name+".npy", sub, len(split.rows), cols)
+		if err != nil {
+			return err
+		}
+		err = cmd.addMatrixOutput(prefix+"."+split.name+".npy", filepath.Base(prefix)+"-"+split.name, len(split.rows), cols, prefix+".annotations.csv", missing)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addMatrixOutput applies the -missing-encoding option to the given
+// matrix output file, and records the file (and its missing-value
+// mask, if any) in the output catalog.
+func (cmd *sliceNumpy) addMatrixOutput(fnm, kind string, rows, cols int, columnLabels string, missing func(int16) bool) error {
+	dtype, maskFnm, err := cmd.missing.Apply(fnm, missing)
+	if err != nil {
+		return err
+	}
+	cmd.outputs.addNumpy(fnm, kind, dtype, rows, cols, "samples.csv", columnLabels)
+	if maskFnm != "" {
+		cmd.outputs.addNumpy(maskFnm, kind+"-missing", "int8", rows, cols, "samples.csv", columnLabels)
+	}
+	return nil
+}
+
+// writeSplitOnehot writes the training and validation rows of the
+// given sparse one-hot matrix ([row,row,...,col,col,...]) to
+// {prefix}.train.npy and {prefix}.val.npy, using the same sparse
+// format. Row numbers are renumbered to match y.{train,val}.npy;
+// column numbers are the same as in the full matrix.
+func (cmd *sliceNumpy) writeSplitOnehot(prefix string, onehot []uint32) error {
+	nz := len(onehot) / 2
+	train, val := cmd.splitRows()
+	for _, split := range []struct {
+		name string
+		rows []int
+	}{{"train", train}, {"val", val}} {
+		newrow := make([]int, len(cmd.samples))
+		for i := range newrow {
+			newrow[i] = -1
+		}
+		for i, row := range split.rows {
+			newrow[row] = i
+		}
+		var rows, cols []uint32
+		for i := 0; i < nz; i++ {
+			if r := newrow[onehot[i]]; r >= 0 {
+				rows = append(rows, uint32(r))
+				cols = append(cols, onehot[nz+i])
+			}
+		}
+		err := writeNumpyUint32(prefix+"."+split.name+".npy", append(rows, cols...), 2, len(rows))
+		if err != nil {
+			return err
+		}
+		cmd.outputs.addNumpy(prefix+"."+split.name+".npy", "onehot-sparse-"+split.name, "uint32", 2, len(rows), "samples.csv", prefix+"-columns.npy")
+	}
+	return nil
+}
+
+// estimateChunkMemory returns a rough estimate of the memory needed
+// to process one input file with the given number of tags and
+// (compressed) size.
+func (cmd *sliceNumpy) estimateChunkMemory(tags int, fileSize int64) int64 {
+	rows := int64(len(cmd.cgnames))
+	// Per sample per tag: compact genome variants (2 phases × 2
+	// bytes), numpy matrix (2 phases × 2 bytes), and one-hot
+	// columns (typically a few bytes).
+	const bytesPerCell = 2*2 + 2*2 + 4
+	// Tile variant sequences expand several times when
+	// decompressed and decoded.
+	const expansion = 5
+	return rows*int64(tags)*bytesPerCell + fileSize*expansion
+}
+
+// writeImputeFlags writes the quality flags returned by
+// imputeTileVariants to a numpy file, using the same column layout
+// as matrix.{chunk}.npy: tags for which skip returns true are
+// omitted, as are tags above the -max-tag filter.
+func (cmd *sliceNumpy) writeImputeFlags(fnm string, flags [][]int8, tagstart tagID, skip func(tagID) bool) error {
+	var cols []int
+	for col := range flags[0] {
+		tag := tagstart + tagID(col/2)
+		if cmd.filter.MaxTag >= 0 && tag > tagID(cmd.filter.MaxTag) {
+			break
+		}
+		if !skip(tag) {
+			cols = append(cols, col)
+		}
+	}
+	out := make([]int8, 0, len(flags)*len(cols))
+	for _, rowflags := range flags {
+		for _, col := range cols {
+			out = append(out, rowflags[col])
+		}
+	}
+	err := writeNumpyInt8(fnm, out, len(flags), len(cols))
+	if err != nil {
+		return err
+	}
+	cmd.outputs.addNumpy(fnm, "impute-flags", "int8", len(flags), len(cols), "samples.csv", "")
+	return nil
+}
+
 func (cmd *sliceNumpy) filterHGVScolpair(colpair [2][]int8) bool {
 	if cmd.chi2PValue >= 1 {
 		return true
@@ -1575,6 +2913,16 @@ type onehotXref struct {
 	hom     bool
 	pvalue  float64
 	maf     float64
+	hash    [blake2b.Size256]byte // sequence hash of variant (see columnID)
+	chrom   int                   // index into chromosomes.csv, or -1 if tag is not in the reference
+	pos     int                   // position of reference tile, or -1 if tag is not in the reference
+
+	caseControl caseControlStats // only if -case-control-stats
+	ancestryAF  []float64        // allele frequency in each ancestry group, only if -ancestry-column
+	count       int              // number of training set samples with this genotype
+	suppressed  bool             // minor genotype count is below -min-group-size
+
+	lengthDeviation int32 // only if -length-deviation (see tileLengthDeviation)
 }
 
 const onehotXrefSize = unsafe.Sizeof(onehotXref{})
@@ -1584,6 +2932,19 @@ const onehotXrefSize = unsafe.Sizeof(onehotXref{})
 //
 // Return nil if no tile variant passes Χ² filter.
 func (cmd *sliceNumpy) tv2homhet(cgs map[string]CompactGenome, maxv tileVariantID, remap []tileVariantID, tag, chunkstarttag tagID, seq map[tagID][]TileVariant) ([][]int8, []onehotXref) {
+	onehot, xref, obs := cmd.homhetCandidates(cgs, maxv, remap, tag, chunkstarttag, seq)
+	pvalues := make([]float64, len(obs))
+	for i := range obs {
+		pvalues[i] = cmd.pvalue(obs[i])
+	}
+	return cmd.filterPvalues(onehot, xref, pvalues)
+}
+
+// homhetCandidates returns the one-hot columns for the given tag that
+// pass the coverage and frequency filters, and the corresponding
+// training set observations to use for p-value calculation. The
+// returned xrefs' pvalue fields are not filled in.
+func (cmd *sliceNumpy) homhetCandidates(cgs map[string]CompactGenome, maxv tileVariantID, remap []tileVariantID, tag, chunkstarttag tagID, seq map[tagID][]TileVariant) ([][]int8, []onehotXref, [][]bool) {
 	if tag == cmd.debugTag {
 		tv := make([]tileVariantID, len(cmd.cgnames)*2)
 		for i, name := range cmd.cgnames {
@@ -1599,9 +2960,10 @@ func (cmd *sliceNumpy) tv2homhet(cgs map[string]CompactGenome, maxv tileVariantI
 	}
 	if maxv < 1 || (maxv < 2 && !cmd.includeVariant1) {
 		// everyone has the most common variant (of the variants we don't drop)
-		return nil, nil
+		return nil, nil, nil
 	}
 	tagoffset := tag - chunkstarttag
+	haploid := cmd.haploidTags[tag]
 	coverage := 0
 	for cgidx, cgname := range cmd.cgnames {
 		if !cmd.minCoverageAll && !cmd.samples[cgidx].isTraining {
@@ -1609,17 +2971,19 @@ func (cmd *sliceNumpy) tv2homhet(cgs map[string]CompactGenome, maxv tileVariantI
 		}
 		cg := cgs[cgname]
 		alleles := 0
-		for _, v := range cg.Variants[tagoffset*2 : tagoffset*2+2] {
+		firstCalled := false
+		for phase, v := range cg.Variants[tagoffset*2 : tagoffset*2+2] {
 			if v > 0 && int(v) < len(seq[tag]) && len(seq[tag][v].Sequence) > 0 {
 				alleles++
+				firstCalled = firstCalled || phase == 0
 			}
 		}
-		if alleles == 2 {
+		if alleles == 2 || (haploid && firstCalled) {
 			coverage++
 		}
 	}
 	if coverage < cmd.minCoverage {
-		return nil, nil
+		return nil, nil, nil
 	}
 	// "observed" array for p-value calculation (training set
 	// only)
@@ -1635,7 +2999,21 @@ func (cmd *sliceNumpy) tv2homhet(cgs map[string]CompactGenome, maxv tileVariantI
 		cgvars := cgs[name].Variants[tagoffset*2:]
 		tv0, tv1 := remap[cgvars[0]], remap[cgvars[1]]
 		for v := tileVariantID(1); v <= maxv; v++ {
-			if tv0 == v && tv1 == v {
+			if haploid {
+				// hom = major variant, het =
+				// secondary variant only
+				if tv0 == v {
+					if tsid >= 0 {
+						obs[v*2][tsid] = true
+					}
+					outcols[v*2][cgid] = 1
+				} else if tv1 == v {
+					if tsid >= 0 {
+						obs[v*2+1][tsid] = true
+					}
+					outcols[v*2+1][cgid] = 1
+				}
+			} else if tv0 == v && tv1 == v {
 				if tsid >= 0 {
 					obs[v*2][tsid] = true
 				}
@@ -1648,9 +3026,18 @@ func (cmd *sliceNumpy) tv2homhet(cgs map[string]CompactGenome, maxv tileVariantI
 			}
 		}
 	}
+	// vhash[v] is the sequence hash of (remapped) variant v
+	vhash := make([][blake2b.Size256]byte, maxv+1)
+	for i, v := range remap {
+		if v > 0 && v <= maxv && i < len(seq[tag]) {
+			vhash[v] = seq[tag][i].Blake2b
+		}
+	}
 	var onehot [][]int8
 	var xref []onehotXref
-	var maf float64
+	var candobs [][]bool
+	var maf, caseAF, controlAF float64
+	var afs []float64
 	for col := 2; col < len(obs); col++ {
 		// col 0,1 correspond to tile variant 0, i.e.,
 		// no-call; col 2,3 correspond to the most common
@@ -1659,7 +3046,11 @@ func (cmd *sliceNumpy) tv2homhet(cgs map[string]CompactGenome, maxv tileVariantI
 			continue
 		}
 		if col&1 == 0 {
-			maf = homhet2maf(obs[col : col+2])
+			if haploid {
+				maf = homhet2haploidAF(obs[col : col+2])
+			} else {
+				maf = homhet2maf(obs[col : col+2])
+			}
 			if maf < cmd.pvalueMinFrequency {
 				// Skip both columns (hom and het) if
 				// allele frequency is below threshold
@@ -1672,22 +3063,60 @@ func (cmd *sliceNumpy) tv2homhet(cgs map[string]CompactGenome, maxv tileVariantI
 				col++
 				continue
 			}
-		}
-		atomic.AddInt64(&cmd.pvalueCallCount, 1)
-		p := cmd.pvalue(obs[col])
-		if cmd.chi2PValue < 1 && !(p < cmd.chi2PValue) {
-			continue
+			if cmd.ancestry != nil {
+				afs = ancestryAF(obs[col:col+2], cmd.ancestry, len(cmd.ancestryNames))
+				if cmd.ancestryFilter >= 0 && !ancestryPolymorphic(afs[cmd.ancestryFilter], cmd.ancestryMinFreq) {
+					// Skip both columns if the
+					// variant is monomorphic in
+					// the chosen ancestry group
+					col++
+					continue
+				}
+			}
+			if cmd.caseControlStats {
+				caseAF, controlAF = caseControlAF(obs[col:col+2], cmd.chi2Cases)
+			}
 		}
 		onehot = append(onehot, outcols[col])
 		xref = append(xref, onehotXref{
-			tag:     tag,
-			variant: tileVariantID(col >> 1),
-			hom:     col&1 == 0,
-			pvalue:  p,
-			maf:     maf,
+			tag:        tag,
+			variant:    tileVariantID(col >> 1),
+			hom:        col&1 == 0,
+			maf:        maf,
+			hash:       vhash[col>>1],
+			ancestryAF: afs,
+			count:      genotypeCount(obs[col]),
+			suppressed: cmd.minGroupSize > 0 && minorGenotypeCount(obs[col]) < cmd.minGroupSize,
 		})
+		if cmd.caseControlStats {
+			cc := &xref[len(xref)-1].caseControl
+			cc.caseAF, cc.controlAF = caseAF, controlAF
+			cc.oddsRatio, cc.ciLow, cc.ciHigh = oddsRatio(obs[col], cmd.chi2Cases)
+		}
+		candobs = append(candobs, obs[col])
+	}
+	return onehot, xref, candobs
+}
+
+// filterPvalues fills in the given p-values and drops the columns
+// whose p-values are above the -chi2-p-value threshold. The onehot
+// and xref slices are modified in place.
+func (cmd *sliceNumpy) filterPvalues(onehot [][]int8, xref []onehotXref, pvalues []float64) ([][]int8, []onehotXref) {
+	atomic.AddInt64(&cmd.pvalueCallCount, int64(len(pvalues)))
+	keep := 0
+	for i, p := range pvalues {
+		if cmd.chi2PValue < 1 && !(p < cmd.chi2PValue) {
+			continue
+		}
+		onehot[keep] = onehot[i]
+		xref[keep] = xref[i]
+		xref[keep].pvalue = p
+		if xref[keep].suppressed {
+			xref[keep].suppressAggregates()
+		}
+		keep++
 	}
-	return onehot, xref
+	return onehot[:keep], xref[:keep]
 }
 
 func homhet2maf(onehot [][]bool) float64 {
@@ -1707,24 +3136,56 @@ func homhet2maf(onehot [][]bool) float64 {
 	return float64(n) / float64(len(onehot[0])*2)
 }
 
+// homhet2haploidAF returns the fraction of genomes that have the
+// variant as their major variant on a haploid chromosome (see
+// -haploid-chromosome).
+func homhet2haploidAF(onehot [][]bool) float64 {
+	if len(onehot[0]) == 0 {
+		return 0
+	}
+	n := 0
+	for _, hom := range onehot[0] {
+		if hom {
+			n++
+		}
+	}
+	return float64(n) / float64(len(onehot[0]))
+}
+
+// Number of rows returned by onehotXref2int32.
+const onehotXrefRows = 8
+
 // convert a []onehotXref with length N to a numpy-style []int32
-// matrix with N columns, one row per field of onehotXref struct.
-//
-// Hom/het row contains hom=0, het=1.
+// matrix with N columns and the following rows:
 //
-// P-value row contains 1000000x actual p-value.
+//	0: tag
+//	1: variant
+//	2: hom/het (hom=1, het=0)
+//	3: 1000000x actual p-value (-1 if suppressed by -min-group-size)
+//	4: 1000000x -log10(p-value) (-1 if suppressed)
+//	5: 1000000x minor allele frequency (-1 if suppressed)
+//	6: chromosome (row number in chromosomes.csv, or -1 if no ref tile)
+//	7: position of reference tile (or -1 if no ref tile)
 func onehotXref2int32(xrefs []onehotXref) []int32 {
 	xcols := len(xrefs)
-	xdata := make([]int32, 6*xcols)
+	xdata := make([]int32, onehotXrefRows*xcols)
 	for i, xref := range xrefs {
 		xdata[i] = int32(xref.tag)
 		xdata[xcols+i] = int32(xref.variant)
 		if xref.hom {
 			xdata[xcols*2+i] = 1
 		}
-		xdata[xcols*3+i] = int32(xref.pvalue * 1000000)
-		xdata[xcols*4+i] = int32(-math.Log10(xref.pvalue) * 1000000)
-		xdata[xcols*5+i] = int32(xref.maf * 1000000)
+		if xref.suppressed {
+			xdata[xcols*3+i] = -1
+			xdata[xcols*4+i] = -1
+			xdata[xcols*5+i] = -1
+		} else {
+			xdata[xcols*3+i] = int32(xref.pvalue * 1000000)
+			xdata[xcols*4+i] = int32(-math.Log10(xref.pvalue) * 1000000)
+			xdata[xcols*5+i] = int32(xref.maf * 1000000)
+		}
+		xdata[xcols*6+i] = int32(xref.chrom)
+		xdata[xcols*7+i] = int32(xref.pos)
 	}
 	return xdata
 }
@@ -0,0 +1,150 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/klauspost/pgzip"
+)
+
+// libraryEncoder writes library entries to an output stream, e.g., a
+// *gob.Encoder or *splitEncoder.
+type libraryEncoder interface {
+	Encode(interface{}) error
+}
+
+// splitEncoder writes library entries to a sequence of
+// gzip-compressed files in a directory (library.0000.gob.gz,
+// library.0001.gob.gz, ...), like WriteDir, starting a new file when
+// the current file reaches maxSize bytes. Each file is a complete
+// library stream that starts with the given header entries (e.g.,
+// the tag set), so the directory can be read by anything that reads
+// WriteDir output.
+//
+// Encode is safe to call concurrently. Files are only rotated
+// between entries, so a file can exceed maxSize by the size of one
+// (compressed) entry.
+type splitEncoder struct {
+	dir     string
+	maxSize int64
+	header  []interface{}
+
+	// if non-nil, called with the current filename after each
+	// entry is written
+	onEncode func(file string, v interface{})
+
+	mtx    sync.Mutex
+	nfiles int
+	f      *os.File
+	bufw   *bufio.Writer
+	zw     *pgzip.Writer
+	enc    *gob.Encoder
+	size   int64 // compressed bytes written to current file
+	empty  bool  // no entries written to current file yet, other than header
+	err    error
+}
+
+func newSplitEncoder(dir string, maxSize int64, header ...interface{}) (*splitEncoder, error) {
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, err
+	}
+	se := &splitEncoder{dir: dir, maxSize: maxSize, header: header}
+	err = se.open()
+	if err != nil {
+		return nil, err
+	}
+	return se, nil
+}
+
+// Encode writes v to the current file, first starting a new file if
+// the current one has reached maxSize.
+func (se *splitEncoder) Encode(v interface{}) error {
+	se.mtx.Lock()
+	defer se.mtx.Unlock()
+	if se.err != nil {
+		return se.err
+	} else if se.f == nil {
+		return errors.New("splitEncoder: Encode called after Close")
+	}
+	if !se.empty && se.maxSize > 0 && se.size >= se.maxSize {
+		se.err = se.close()
+		if se.err == nil {
+			se.err = se.open()
+		}
+		if se.err != nil {
+			return se.err
+		}
+	}
+	se.empty = false
+	se.err = se.enc.Encode(v)
+	if se.err == nil && se.onEncode != nil {
+		se.onEncode(se.f.Name(), v)
+	}
+	return se.err
+}
+
+// Files returns the number of files written so far.
+func (se *splitEncoder) Files() int {
+	se.mtx.Lock()
+	defer se.mtx.Unlock()
+	return se.nfiles
+}
+
+// Close finishes writing the current file. It returns the first
+// error encountered by Encode, if any.
+func (se *splitEncoder) Close() error {
+	se.mtx.Lock()
+	defer se.mtx.Unlock()
+	if se.f == nil {
+		return se.err
+	}
+	err := se.close()
+	if se.err == nil {
+		se.err = err
+	}
+	return se.err
+}
+
+func (se *splitEncoder) open() error {
+	f, err := os.OpenFile(fmt.Sprintf("%s/library.%04d.gob.gz", se.dir, se.nfiles), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	se.nfiles++
+	se.f = f
+	se.size = 0
+	se.empty = true
+	se.bufw = bufio.NewWriterSize(f, 1<<24)
+	se.zw = pgzip.NewWriter(&tempGobCounter{w: se.bufw, n: &se.size})
+	se.enc = gob.NewEncoder(se.zw)
+	for _, v := range se.header {
+		err = se.enc.Encode(v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (se *splitEncoder) close() error {
+	f := se.f
+	se.f = nil
+	err := se.zw.Close()
+	if err == nil {
+		err = se.bufw.Flush()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -38,10 +39,13 @@ func (cmd *statscmd) RunCommand(prog string, args []string, stdin io.Reader, std
 	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
 	projectUUID := flags.String("project", "", "project `UUID` for output data")
 	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
 	inputFilename := flags.String("i", "-", "input `file`")
 	outputFilename := flags.String("o", "-", "output `file`")
 	flags.BoolVar(&cmd.debugUnplaced, "debug-unplaced", false, "output full list of unplaced tags")
-	err = flags.Parse(args)
+	tagStatsFilename := flags.String("tag-stats", "", "also write per-tag variant counts and tile length statistics to csv `file`")
+	err = parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		err = nil
 		return 0
@@ -71,17 +75,27 @@ func (cmd *statscmd) RunCommand(prog string, args []string, stdin io.Reader, std
 			VCPUs:       1,
 			Priority:    *priority,
 		}
+		containerOpts.Apply(&runner, stdout)
 		err = runner.TranslatePaths(inputFilename)
 		if err != nil {
 			return 1
 		}
 		runner.Args = []string{"stats", "-local=true", fmt.Sprintf("-debug-unplaced=%v", cmd.debugUnplaced), "-i", *inputFilename, "-o", "/mnt/output/stats.json"}
+		if *tagStatsFilename != "" {
+			runner.Args = append(runner.Args, "-tag-stats", "/mnt/output/tag-stats.csv")
+		}
 		var output string
 		output, err = runner.Run()
-		if err != nil {
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
 			return 1
 		}
 		fmt.Fprintln(stdout, output+"/stats.json")
+		if *tagStatsFilename != "" {
+			fmt.Fprintln(stdout, output+"/tag-stats.csv")
+		}
 		return 0
 	}
 
@@ -107,11 +121,34 @@ func (cmd *statscmd) RunCommand(prog string, args []string, stdin io.Reader, std
 		defer output.Close()
 	}
 
+	var tagStats *os.File
+	var tagStatsBuf *bufio.Writer
+	var tagStatsW io.Writer // nil if not writing tag stats
+	if *tagStatsFilename != "" {
+		tagStats, err = os.Create(*tagStatsFilename)
+		if err != nil {
+			return 1
+		}
+		defer tagStats.Close()
+		tagStatsBuf = bufio.NewWriter(tagStats)
+		tagStatsW = tagStatsBuf
+	}
+
 	bufw := bufio.NewWriter(output)
-	err = cmd.doStats(input, strings.HasSuffix(*inputFilename, ".gz"), bufw)
+	err = cmd.doStats(input, strings.HasSuffix(*inputFilename, ".gz"), bufw, tagStatsW)
 	if err != nil {
 		return 1
 	}
+	if tagStats != nil {
+		err = tagStatsBuf.Flush()
+		if err != nil {
+			return 1
+		}
+		err = tagStats.Close()
+		if err != nil {
+			return 1
+		}
+	}
 	err = bufw.Flush()
 	if err != nil {
 		return 1
@@ -123,20 +160,27 @@ func (cmd *statscmd) RunCommand(prog string, args []string, stdin io.Reader, std
 	return 0
 }
 
-func (cmd *statscmd) doStats(input io.Reader, gz bool, output io.Writer) error {
+// doStats writes summary statistics about the library read from
+// input to output (as JSON). If tagStats is not nil, it also writes
+// a csv table with the number of variants and tile length statistics
+// for each tag, which helps identify hypervariable or repetitive
+// tags that should be masked.
+func (cmd *statscmd) doStats(input io.Reader, gz bool, output, tagStats io.Writer) error {
 	var ret struct {
-		Genomes          int
-		CalledBases      []int64
-		Tags             int
-		TagsPlacedNTimes []int // a[x]==y means there were y tags that placed x times
-		TileVariants     int
-		VariantsBySize   []int
-		NCVariantsBySize []int
-		UnplacedTags     []string `json:",omitempty"`
+		Genomes           int
+		CalledBases       []int64
+		Tags              int
+		TagsPlacedNTimes  []int // a[x]==y means there were y tags that placed x times
+		TagsWithNVariants []int // a[x]==y means there were y tags that had x variants
+		TileVariants      int
+		VariantsBySize    []int
+		NCVariantsBySize  []int
+		UnplacedTags      []string `json:",omitempty"`
 	}
 
 	var tagSet [][]byte
 	var tagPlacements []int
+	var tagVariants []tagVariantStats
 	tileVariantCalls := map[tileLibRef]int{}
 	err := DecodeLibrary(input, gz, func(ent *LibraryEntry) error {
 		ret.Genomes += len(ent.CompactGenomes)
@@ -171,6 +215,11 @@ func (cmd *statscmd) doStats(input io.Reader, gz bool, output io.Writer) error {
 			}
 
 			tileVariantCalls[tileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = calls
+
+			if need := int(tv.Tag) + 1 - len(tagVariants); need > 0 {
+				tagVariants = append(tagVariants, make([]tagVariantStats, need)...)
+			}
+			tagVariants[tv.Tag].add(len(tv.Sequence))
 		}
 		for _, g := range ent.CompactGenomes {
 			if need := (len(g.Variants)+1)/2 - len(tagPlacements); need > 0 {
@@ -199,6 +248,75 @@ func (cmd *statscmd) doStats(input io.Reader, gz bool, output io.Writer) error {
 			ret.UnplacedTags = append(ret.UnplacedTags, fmt.Sprintf("%d %s", id, tagSet[id]))
 		}
 	}
+	ntags := ret.Tags
+	if ntags < len(tagVariants) {
+		ntags = len(tagVariants)
+	}
+	for tag := 0; tag < ntags; tag++ {
+		n := 0
+		if tag < len(tagVariants) {
+			n = tagVariants[tag].variants
+		}
+		for len(ret.TagsWithNVariants) <= n {
+			ret.TagsWithNVariants = append(ret.TagsWithNVariants, 0)
+		}
+		ret.TagsWithNVariants[n]++
+	}
+
+	if tagStats != nil {
+		fmt.Fprint(tagStats, "Tag,Variants,Placed,MinLength,MaxLength,MeanLength,LengthSD\n")
+		for tag := 0; tag < ntags; tag++ {
+			var tvs tagVariantStats
+			if tag < len(tagVariants) {
+				tvs = tagVariants[tag]
+			}
+			placed := 0
+			if tag < len(tagPlacements) {
+				placed = tagPlacements[tag]
+			}
+			mean, sd := tvs.meanSD()
+			_, err = fmt.Fprintf(tagStats, "%d,%d,%d,%d,%d,%.1f,%.1f\n", tag, tvs.variants, placed, tvs.minLen, tvs.maxLen, mean, sd)
+			if err != nil {
+				return err
+			}
+		}
+	}
 
 	return json.NewEncoder(output).Encode(ret)
 }
+
+// tagVariantStats accumulates the number and sequence lengths of the
+// tile variants of a tag.
+type tagVariantStats struct {
+	variants       int
+	minLen, maxLen int
+	sumLen, sumSq  float64
+}
+
+func (tvs *tagVariantStats) add(seqlen int) {
+	if tvs.variants == 0 || seqlen < tvs.minLen {
+		tvs.minLen = seqlen
+	}
+	if seqlen > tvs.maxLen {
+		tvs.maxLen = seqlen
+	}
+	tvs.variants++
+	tvs.sumLen += float64(seqlen)
+	tvs.sumSq += float64(seqlen) * float64(seqlen)
+}
+
+// meanSD returns the mean and (population) standard deviation of
+// the sequence lengths.
+func (tvs *tagVariantStats) meanSD() (float64, float64) {
+	if tvs.variants == 0 {
+		return 0, 0
+	}
+	n := float64(tvs.variants)
+	mean := tvs.sumLen / n
+	variance := tvs.sumSq/n - mean*mean
+	if variance < 0 {
+		// rounding error
+		variance = 0
+	}
+	return mean, math.Sqrt(variance)
+}
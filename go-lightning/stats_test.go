@@ -0,0 +1,49 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+
+	"gopkg.in/check.v1"
+)
+
+type statsSuite struct{}
+
+var _ = check.Suite(&statsSuite{})
+
+func (s *statsSuite) TestTagStats(c *check.C) {
+	var lib bytes.Buffer
+	enc := gob.NewEncoder(&lib)
+	c.Assert(enc.Encode(LibraryEntry{TagSet: [][]byte{[]byte("aaaa"), []byte("cccc"), []byte("gggg")}}), check.IsNil)
+	c.Assert(enc.Encode(LibraryEntry{TileVariants: []TileVariant{
+		{Tag: 0, Variant: 1, Sequence: []byte("aaaatttt")},
+		{Tag: 1, Variant: 1, Sequence: []byte("cccctttt")},
+		{Tag: 1, Variant: 2, Sequence: []byte("ccccttttttttgggg")},
+		{Tag: 1, Variant: 3, Sequence: []byte("ccccnnnnnnnnnnnngggg")},
+	}}), check.IsNil)
+	c.Assert(enc.Encode(LibraryEntry{CompactGenomes: []CompactGenome{
+		{Name: "sample1", Variants: []tileVariantID{1, 1, 1, 2, 0, 0}},
+		{Name: "sample2", Variants: []tileVariantID{1, 1, 3, 3, 0, 0}},
+	}}), check.IsNil)
+
+	var out, tagStats bytes.Buffer
+	err := (&statscmd{}).doStats(&lib, false, &out, &tagStats)
+	c.Assert(err, check.IsNil)
+	c.Check(tagStats.String(), check.Equals, `Tag,Variants,Placed,MinLength,MaxLength,MeanLength,LengthSD
+0,1,4,8,8,8.0,0.0
+1,3,4,8,20,14.7,5.0
+2,0,0,0,0,0.0,0.0
+`)
+	var stats struct {
+		Tags              int
+		TagsWithNVariants []int
+	}
+	c.Assert(json.Unmarshal(out.Bytes(), &stats), check.IsNil)
+	c.Check(stats.Tags, check.Equals, 3)
+	c.Check(stats.TagsWithNVariants, check.DeepEquals, []int{1, 1, 0, 1})
+}
@@ -0,0 +1,104 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// sampleStrata returns the stratum index of each training set sample
+// (in the same order as onehot columns passed to p-value functions),
+// according to the given column of the samples file (or property,
+// see sampleInfoFromProperties), and the name of each stratum.
+func sampleStrata(samples []sampleInfo, column string) (strata []int, names []string, err error) {
+	index := map[string]int{}
+	for i, si := range samples {
+		if !si.isTraining {
+			continue
+		}
+		val, ok := si.phenotypes[column]
+		if !ok {
+			return nil, nil, fmt.Errorf("strata column %q not found for sample %d (%s)", column, i, si.id)
+		}
+		index[val] = 0
+	}
+	for val := range index {
+		names = append(names, val)
+	}
+	sort.Strings(names)
+	for k, val := range names {
+		index[val] = k
+	}
+	for _, si := range samples {
+		if si.isTraining {
+			strata = append(strata, index[si.phenotypes[column]])
+		}
+	}
+	return strata, names, nil
+}
+
+// Cochran-Mantel-Haenszel test for association between x and y,
+// controlling for strata (see sampleStrata). Strata with fewer than
+// 2 samples, or where x or y is constant, contribute nothing.
+func cmhPvalue(x, y []bool, strata []int, nstrata int) float64 {
+	// counts[k] = {x&y, x&!y, !x&y, !x&!y} in stratum k
+	counts := make([][4]float64, nstrata)
+	for i, yi := range y {
+		cell := 0
+		if !x[i] {
+			cell += 2
+		}
+		if !yi {
+			cell++
+		}
+		counts[strata[i]][cell]++
+	}
+	var sumdiff, sumvar float64
+	for _, c := range counts {
+		n := c[0] + c[1] + c[2] + c[3]
+		if n < 2 {
+			continue
+		}
+		xsum, notx := c[0]+c[1], c[2]+c[3]
+		ysum, noty := c[0]+c[2], c[1]+c[3]
+		sumdiff += c[0] - xsum*ysum/n
+		sumvar += xsum * notx * ysum * noty / (n * n * (n - 1))
+	}
+	if sumvar == 0 {
+		return 1
+	}
+	return chisquared.Survival(sumdiff * sumdiff / sumvar)
+}
+
+// writeStrataCounts writes a CSV file with the number of training
+// set cases and controls in each stratum.
+func writeStrataCounts(fnm string, names []string, strata []int, cases []bool) error {
+	counts := make([][2]int, len(names))
+	for i, k := range strata {
+		if cases[i] {
+			counts[k][0]++
+		} else {
+			counts[k][1]++
+		}
+	}
+	f, err := os.Create(fnm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriter(f)
+	fmt.Fprint(bufw, "stratum,cases,controls\n")
+	for k, name := range names {
+		fmt.Fprintf(bufw, "%s,%d,%d\n", name, counts[k][0], counts[k][1])
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
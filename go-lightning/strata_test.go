@@ -0,0 +1,63 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type strataSuite struct{}
+
+var _ = check.Suite(&strataSuite{})
+
+func (s *strataSuite) TestSampleStrata(c *check.C) {
+	samples := []sampleInfo{
+		{id: "a", isTraining: true, phenotypes: map[string]string{"batch": "b2"}},
+		{id: "b", isTraining: false},
+		{id: "c", isTraining: true, phenotypes: map[string]string{"batch": "b1"}},
+		{id: "d", isTraining: true, phenotypes: map[string]string{"batch": "b2"}},
+	}
+	strata, names, err := sampleStrata(samples, "batch")
+	c.Assert(err, check.IsNil)
+	c.Check(names, check.DeepEquals, []string{"b1", "b2"})
+	c.Check(strata, check.DeepEquals, []int{1, 0, 1})
+
+	samples[3].phenotypes = nil
+	_, _, err = sampleStrata(samples, "batch")
+	c.Check(err, check.ErrorMatches, `strata column "batch" not found for sample 3 \(d\)`)
+}
+
+func (s *strataSuite) TestCMH(c *check.C) {
+	// x&y=2, x&!y=2, !x&y=1, !x&!y=3
+	x := []bool{true, true, true, false, false, true, false, false}
+	y := []bool{true, true, false, false, true, false, false, false}
+	// a-E[a] = 2-4*3/8, var = 4*4*3*5/(8*8*7)
+	variance := 240.0 / 448
+	c.Check(cmhPvalue(x, y, make([]int, len(x)), 1), check.Equals, chisquared.Survival(0.5*0.5/variance))
+
+	// Same table repeated in two strata
+	x2 := append(append([]bool(nil), x...), x...)
+	y2 := append(append([]bool(nil), y...), y...)
+	strata := make([]int, len(x2))
+	for i := len(x); i < len(x2); i++ {
+		strata[i] = 1
+	}
+	c.Check(cmhPvalue(x2, y2, strata, 2), check.Equals, chisquared.Survival(1/(variance*2)))
+
+	// Strata where x or y is constant contribute nothing.
+	c.Check(cmhPvalue([]bool{true, true}, []bool{true, false}, []int{0, 0}, 1), check.Equals, 1.0)
+	c.Check(cmhPvalue(append([]bool{true, false}, x...), append([]bool{true, true}, y...), append([]int{1, 1}, make([]int, len(x))...), 2), check.Equals, chisquared.Survival(0.5*0.5/variance))
+}
+
+func (s *strataSuite) TestWriteStrataCounts(c *check.C) {
+	fnm := c.MkDir() + "/strata.csv"
+	err := writeStrataCounts(fnm, []string{"b1", "b2"}, []int{1, 0, 1, 1}, []bool{true, false, false, true})
+	c.Assert(err, check.IsNil)
+	buf, err := os.ReadFile(fnm)
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "stratum,cases,controls\nb1,0,1\nb2,2,1\n")
+}
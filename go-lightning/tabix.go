@@ -0,0 +1,186 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// tabixIndex is the part of a tabix (.tbi) index needed to find the
+// start of each contig's data in a bgzip-compressed file.
+type tabixIndex struct {
+	colSeq int               // 1-based column containing the contig name
+	meta   byte              // lines starting with this character are comments
+	start  map[string]uint64 // contig name -> virtual offset of its first line
+}
+
+// tabixPseudoBin is the bin number that holds metadata (not data
+// offsets) in a tabix index.
+const tabixPseudoBin = 37450
+
+// readTabixIndex reads a tabix index (see
+// https://samtools.github.io/hts-specs/tabix.pdf).
+func readTabixIndex(r io.Reader) (*tabixIndex, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	rdr := bufio.NewReader(gz)
+	var hdr struct {
+		Magic  [4]byte
+		NRef   int32
+		Format int32
+		ColSeq int32
+		ColBeg int32
+		ColEnd int32
+		Meta   int32
+		Skip   int32
+		LNm    int32
+	}
+	err = binary.Read(rdr, binary.LittleEndian, &hdr)
+	if err != nil {
+		return nil, err
+	}
+	if string(hdr.Magic[:]) != "TBI\x01" {
+		return nil, errors.New("not a tabix index")
+	}
+	names := make([]byte, hdr.LNm)
+	_, err = io.ReadFull(rdr, names)
+	if err != nil {
+		return nil, err
+	}
+	idx := &tabixIndex{
+		colSeq: int(hdr.ColSeq),
+		meta:   byte(hdr.Meta),
+		start:  map[string]uint64{},
+	}
+	refnames := bytes.Split(bytes.TrimRight(names, "\x00"), []byte{0})
+	if len(refnames) != int(hdr.NRef) {
+		return nil, fmt.Errorf("tabix index has %d names, expected %d", len(refnames), hdr.NRef)
+	}
+	for _, refname := range refnames {
+		var nbin int32
+		err = binary.Read(rdr, binary.LittleEndian, &nbin)
+		if err != nil {
+			return nil, err
+		}
+		start := uint64(math.MaxUint64)
+		for i := int32(0); i < nbin; i++ {
+			var bin struct {
+				Bin    uint32
+				NChunk int32
+			}
+			err = binary.Read(rdr, binary.LittleEndian, &bin)
+			if err != nil {
+				return nil, err
+			}
+			chunks := make([]uint64, bin.NChunk*2)
+			err = binary.Read(rdr, binary.LittleEndian, chunks)
+			if err != nil {
+				return nil, err
+			}
+			if bin.Bin == tabixPseudoBin {
+				continue
+			}
+			for c := 0; c < len(chunks); c += 2 {
+				if chunks[c] < start {
+					start = chunks[c]
+				}
+			}
+		}
+		var nintv int32
+		err = binary.Read(rdr, binary.LittleEndian, &nintv)
+		if err != nil {
+			return nil, err
+		}
+		_, err = rdr.Discard(int(nintv) * 8)
+		if err != nil {
+			return nil, err
+		}
+		if start != math.MaxUint64 {
+			idx.start[string(refname)] = start
+		}
+	}
+	return idx, nil
+}
+
+// readTabixContigs returns the lines of the given bgzip-compressed
+// file that are on the given contigs (compared in canonical form),
+// using the tabix index in fnm+".tbi" to skip the rest of the file.
+//
+// If the index cannot be opened, ok is false, and the caller should
+// read the whole file instead.
+func readTabixContigs(fnm string, contigs []string) (data []byte, ok bool, err error) {
+	idxfile, err := open(fnm + ".tbi")
+	if err != nil {
+		return nil, false, nil
+	}
+	defer idxfile.Close()
+	idx, err := readTabixIndex(idxfile)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s.tbi: %w", fnm, err)
+	}
+	want := map[string]bool{}
+	for _, contig := range contigs {
+		want[canonicalContig(contig)] = true
+	}
+	f, err := open(fnm)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	for name, voffset := range idx.start {
+		if !want[canonicalContig(name)] {
+			continue
+		}
+		err = readTabixContig(&buf, f, idx, name, voffset)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %s: %w", fnm, name, err)
+		}
+	}
+	return buf.Bytes(), true, nil
+}
+
+// readTabixContig appends the lines for the named contig to buf,
+// starting at the given virtual offset (compressed block offset <<
+// 16 | offset within uncompressed block) and stopping at the first
+// line for a different contig.
+func readTabixContig(buf *bytes.Buffer, f io.ReadSeeker, idx *tabixIndex, name string, voffset uint64) error {
+	_, err := f.Seek(int64(voffset>>16), io.SeekStart)
+	if err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(bufio.NewReaderSize(f, 1<<20))
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(io.Discard, gz, int64(voffset&0xffff))
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 || line[0] == idx.meta {
+			continue
+		}
+		fields := bytes.SplitN(line, []byte{'\t'}, idx.colSeq+1)
+		if len(fields) < idx.colSeq || string(fields[idx.colSeq-1]) != name {
+			break
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,99 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type tabixSuite struct{}
+
+var _ = check.Suite(&tabixSuite{})
+
+// writeTestTabix writes a gzip file with one member per contig (like
+// bgzip, although real bgzip blocks are smaller and carry an extra
+// header field) and a minimal tabix index with one bin per contig.
+func writeTestTabix(c *check.C, fnm string, contigs []string, data map[string]string) {
+	var file, idx bytes.Buffer
+	binary.Write(&idx, binary.LittleEndian, []byte("TBI\x01"))
+	var names []byte
+	for _, contig := range contigs {
+		names = append(names, contig...)
+		names = append(names, 0)
+	}
+	binary.Write(&idx, binary.LittleEndian, []int32{int32(len(contigs)), 0, 1, 2, 3, '#', 0, int32(len(names))})
+	idx.Write(names)
+	for _, contig := range contigs {
+		start := uint64(file.Len()) << 16
+		zw := gzip.NewWriter(&file)
+		zw.Write([]byte(data[contig]))
+		c.Assert(zw.Close(), check.IsNil)
+		end := uint64(file.Len()) << 16
+		// one real bin, one pseudo-bin with metadata that
+		// must not be mistaken for a data offset
+		binary.Write(&idx, binary.LittleEndian, int32(2))
+		binary.Write(&idx, binary.LittleEndian, uint32(tabixPseudoBin))
+		binary.Write(&idx, binary.LittleEndian, int32(2))
+		binary.Write(&idx, binary.LittleEndian, []uint64{0, 0, 0, 0})
+		binary.Write(&idx, binary.LittleEndian, uint32(4681))
+		binary.Write(&idx, binary.LittleEndian, int32(1))
+		binary.Write(&idx, binary.LittleEndian, []uint64{start, end})
+		binary.Write(&idx, binary.LittleEndian, int32(1))
+		binary.Write(&idx, binary.LittleEndian, []uint64{start})
+	}
+	c.Assert(os.WriteFile(fnm, file.Bytes(), 0666), check.IsNil)
+	var zidx bytes.Buffer
+	zw := gzip.NewWriter(&zidx)
+	zw.Write(idx.Bytes())
+	c.Assert(zw.Close(), check.IsNil)
+	c.Assert(os.WriteFile(fnm+".tbi", zidx.Bytes(), 0666), check.IsNil)
+}
+
+func (s *tabixSuite) TestReadTabixContigs(c *check.C) {
+	tmpdir := c.MkDir()
+	fnm := tmpdir + "/regions.bed.gz"
+	writeTestTabix(c, fnm, []string{"chr1", "chr2", "chr3"}, map[string]string{
+		"chr1": "#comment\nchr1\t100\t200\nchr1\t300\t400\n",
+		"chr2": "chr2\t100\t200\n",
+		"chr3": "chr3\t500\t600\n",
+	})
+
+	data, ok, err := readTabixContigs(fnm, []string{"2"})
+	c.Assert(err, check.IsNil)
+	c.Check(ok, check.Equals, true)
+	c.Check(string(data), check.Equals, "chr2\t100\t200\n")
+
+	data, ok, err = readTabixContigs(fnm, []string{"chr1"})
+	c.Assert(err, check.IsNil)
+	c.Check(ok, check.Equals, true)
+	c.Check(string(data), check.Equals, "chr1\t100\t200\nchr1\t300\t400\n")
+
+	data, ok, err = readTabixContigs(fnm, []string{"chrX"})
+	c.Assert(err, check.IsNil)
+	c.Check(ok, check.Equals, true)
+	c.Check(data, check.HasLen, 0)
+
+	// no index
+	_, ok, err = readTabixContigs(tmpdir+"/nonexistent.bed.gz", []string{"chr1"})
+	c.Check(err, check.IsNil)
+	c.Check(ok, check.Equals, false)
+
+	m, err := makeMask(fnm, 0, regionsFilter{contigs: []string{"chr1", "chr3"}})
+	c.Assert(err, check.IsNil)
+	c.Check(m.Len(), check.Equals, 3)
+	c.Check(m.Check("chr1", 150, 160), check.Equals, true)
+	c.Check(m.Check("chr2", 150, 160), check.Equals, false)
+	c.Check(m.Check("chr3", 550, 560), check.Equals, true)
+
+	// without contigs, the whole file is read
+	m, err = makeMask(fnm, 0, regionsFilter{})
+	c.Assert(err, check.IsNil)
+	c.Check(m.Len(), check.Equals, 4)
+}
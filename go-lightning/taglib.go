@@ -6,25 +6,82 @@ package lightning
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"sort"
+
+	"github.com/arvados/lightning/go-lightning/libio"
 )
 
 const tagmapKeySize = 32
 
+// Bloom filter size used by "import -tag-prefilter".
+const tagPrefilterBitsPerTag = 16
+
 type tagmapKey uint64
 
-type tagID int32
+type tagID = libio.TagID
 
 type tagInfo struct {
 	id     tagID // 0-based position in input tagset
 	tagseq []byte
 }
 
+// tagLibrary finds tags in sequence data. Tags can have different
+// lengths. Each tag is indexed by its last keylen bases, where keylen
+// is the length of the shortest tag (or tagmapKeySize, whichever is
+// smaller).
 type tagLibrary struct {
-	tagmap  map[tagmapKey]tagInfo
+	tagmap  map[tagmapKey][]tagInfo // longest first
+	taglen  []int                   // taglen[tagID] is the tag's length
 	keylen  int
+	maxlen  int
 	keymask tagmapKey
+
+	// Optional Bloom filter over tagmap keys (see
+	// EnablePrefilter).
+	prefilter      []uint64
+	prefilterShift uint
+}
+
+// EnablePrefilter builds a Bloom filter over the tag keys, using
+// about bitsPerTag bits per tag, which FindAll then uses to skip
+// most positions without a (comparatively slow) tagmap lookup.
+//
+// This is opt-in because it only helps when the filter is small
+// enough to stay in CPU cache -- see BenchmarkFindAll.
+func (taglib *tagLibrary) EnablePrefilter(bitsPerTag int) {
+	nbits := uint64(64)
+	taglib.prefilterShift = 64 - 6
+	for nbits < uint64(len(taglib.tagmap)*bitsPerTag) {
+		nbits <<= 1
+		taglib.prefilterShift--
+	}
+	taglib.prefilter = make([]uint64, nbits/64)
+	for key := range taglib.tagmap {
+		h1, h2 := taglib.prefilterHash(key)
+		taglib.prefilter[h1>>6] |= 1 << (h1 & 63)
+		taglib.prefilter[h2>>6] |= 1 << (h2 & 63)
+	}
+}
+
+// prefilterHash returns two bit positions in the prefilter for the
+// given key.
+func (taglib *tagLibrary) prefilterHash(key tagmapKey) (uint64, uint64) {
+	return (uint64(key) * 0x9e3779b97f4a7c15) >> taglib.prefilterShift,
+		(uint64(key) * 0xc2b2ae3d27d4eb4f) >> taglib.prefilterShift
+}
+
+// mayHaveKey returns false if the prefilter is enabled and no tag
+// has the given key.
+func (taglib *tagLibrary) mayHaveKey(key tagmapKey) bool {
+	if taglib.prefilter == nil {
+		return true
+	}
+	h1, h2 := taglib.prefilterHash(key)
+	return taglib.prefilter[h1>>6]&(1<<(h1&63)) != 0 &&
+		taglib.prefilter[h2>>6]&(1<<(h2&63)) != 0
 }
 
 func (taglib *tagLibrary) Load(rdr io.Reader) error {
@@ -44,7 +101,7 @@ func (taglib *tagLibrary) Load(rdr io.Reader) error {
 }
 
 func (taglib *tagLibrary) FindAll(in *bufio.Reader, passthrough io.Writer, fn func(id tagID, pos, taglen int)) error {
-	var window = make([]byte, 0, taglib.keylen*1000)
+	var window = make([]byte, 0, taglib.maxlen*1000)
 	var key tagmapKey
 	for offset := 0; ; {
 		base, err := in.ReadByte()
@@ -82,31 +139,86 @@ func (taglib *tagLibrary) FindAll(in *bufio.Reader, passthrough io.Writer, fn fu
 		}
 		window = append(window, base)
 		if len(window) == cap(window) {
-			copy(window, window[len(window)-taglib.keylen:])
-			window = window[:taglib.keylen]
+			copy(window, window[len(window)-taglib.maxlen:])
+			window = window[:taglib.maxlen]
 		}
 		key = ((key << 2) | twobit[int(base)]) & taglib.keymask
 
-		if len(window) < taglib.keylen {
+		if len(window) < taglib.keylen || !taglib.mayHaveKey(key) {
 			continue
-		} else if taginfo, ok := taglib.tagmap[key]; !ok {
-			continue
-		} else if len(taginfo.tagseq) != taglib.keylen {
-			return fmt.Errorf("assertion failed: len(%q) != keylen %d", taginfo.tagseq, taglib.keylen)
-		} else {
-			fn(taginfo.id, offset-taglib.keylen, len(taginfo.tagseq))
+		}
+		for _, taginfo := range taglib.tagmap[key] {
+			taglen := len(taginfo.tagseq)
+			if len(window) < taglen || !bytes.EqualFold(window[len(window)-taglen:], taginfo.tagseq) {
+				continue
+			}
+			fn(taginfo.id, offset-taglen, taglen)
 			window = window[:0] // don't try to match overlapping tags
+			break
 		}
 	}
 	return nil
 }
 
 func (taglib *tagLibrary) Len() int {
-	return len(taglib.tagmap)
+	return len(taglib.taglen)
 }
 
-func (taglib *tagLibrary) TagLen() int {
-	return taglib.keylen
+// TagLen returns the length of the given tag.
+func (taglib *tagLibrary) TagLen(id tagID) int {
+	return taglib.taglen[id]
+}
+
+// EndTag returns the ID of the tag at the end of seq, if any.
+func (taglib *tagLibrary) EndTag(seq []byte) (tagID, bool) {
+	if len(seq) < taglib.keylen {
+		return 0, false
+	}
+	var key tagmapKey
+	for _, b := range seq[len(seq)-taglib.keylen:] {
+		key = (key << 2) | twobit[int(b)]
+	}
+	for _, info := range taglib.tagmap[key] {
+		if l := len(info.tagseq); len(seq) >= l && bytes.EqualFold(seq[len(seq)-l:], info.tagseq) {
+			return info.id, true
+		}
+	}
+	return 0, false
+}
+
+// tagLengths returns the length of each tag in tagset.
+func tagLengths(tagset [][]byte) []int {
+	taglen := make([]int, len(tagset))
+	for i, tag := range tagset {
+		taglen[i] = len(tag)
+	}
+	return taglen
+}
+
+// pathOverlap returns the number of bases shared by path[i] and
+// path[i+1], i.e., the length of the tag that starts path[i+1]. If
+// path[i] is the last tile in the path, pathOverlap returns the
+// length of its own tag.
+func pathOverlap(taglen []int, path []tileLibRef, i int) int {
+	if i+1 < len(path) {
+		return taglen[path[i+1].Tag]
+	}
+	return taglen[path[i].Tag]
+}
+
+// TagLengths returns the distinct tag lengths in the library, longest
+// first.
+func (taglib *tagLibrary) TagLengths() []int {
+	seen := map[int]bool{}
+	var lens []int
+	for _, l := range taglib.taglen {
+		if !seen[l] {
+			seen[l] = true
+			lens = append(lens, l)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(lens)))
+	return lens
 }
 
 var (
@@ -138,36 +250,52 @@ var (
 
 func (taglib *tagLibrary) setTags(tags [][]byte) error {
 	taglib.keylen = tagmapKeySize
-	for _, t := range tags {
-		if l := len(t); taglib.keylen > l {
+	taglib.maxlen = 0
+	for i, t := range tags {
+		l := len(t)
+		if l == 0 {
+			return fmt.Errorf("tag %d is empty", i)
+		}
+		if taglib.keylen > l {
 			taglib.keylen = l
 		}
+		if taglib.maxlen < l {
+			taglib.maxlen = l
+		}
 	}
 	taglib.keymask = tagmapKey((1 << (taglib.keylen * 2)) - 1)
-	taglib.tagmap = map[tagmapKey]tagInfo{}
+	taglib.tagmap = map[tagmapKey][]tagInfo{}
+	taglib.prefilter = nil
+	taglib.taglen = make([]int, len(tags))
 	for i, tag := range tags {
+		tag = bytes.ToLower(tag)
 		var key tagmapKey
-		for _, b := range tag[:taglib.keylen] {
+		for _, b := range tag[len(tag)-taglib.keylen:] {
 			key = (key << 2) | twobit[int(b)]
 		}
-		if _, ok := taglib.tagmap[key]; ok {
-			return fmt.Errorf("first %d bytes of tag %d (%x) are not unique", taglib.keylen, i, key)
+		for _, other := range taglib.tagmap[key] {
+			if bytes.Equal(other.tagseq, tag) {
+				return fmt.Errorf("tag %d (%s) is not unique", i, tag)
+			}
 		}
-		taglib.tagmap[key] = tagInfo{tagID(i), tag}
+		infos := append(taglib.tagmap[key], tagInfo{tagID(i), tag})
+		// Try longer tags first, so a tag that happens to
+		// end with a shorter tag isn't reported as the
+		// shorter one.
+		sort.SliceStable(infos, func(a, b int) bool { return len(infos[a].tagseq) > len(infos[b].tagseq) })
+		taglib.tagmap[key] = infos
+		taglib.taglen[i] = len(tag)
 	}
 	return nil
 }
 
+// Tags returns the tag sequences (lowercase), indexed by tagID.
 func (taglib *tagLibrary) Tags() [][]byte {
-	out := make([][]byte, len(taglib.tagmap))
-	untwobit := []byte{'a', 'c', 'g', 't'}
-	for key, info := range taglib.tagmap {
-		seq := make([]byte, taglib.keylen)
-		for i := len(seq) - 1; i >= 0; i-- {
-			seq[i] = untwobit[int(key)&3]
-			key = key >> 2
+	out := make([][]byte, len(taglib.taglen))
+	for _, infos := range taglib.tagmap {
+		for _, info := range infos {
+			out[int(info.id)] = append([]byte(nil), info.tagseq...)
 		}
-		out[int(info.id)] = seq
 	}
 	return out
 }
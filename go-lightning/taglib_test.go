@@ -98,3 +98,112 @@ func (s *taglibSuite) TestFindAllRealisticSize(c *check.C) {
 	c.Check(matches[0], check.Equals, tagMatch{0, 0, tagsize})
 	c.Check(matches[1].id, check.Equals, tagID(1))
 }
+
+func (s *taglibSuite) TestFindAllVariableLength(c *check.C) {
+	var taglib tagLibrary
+	err := taglib.Load(bytes.NewBufferString(`>0000.00
+ggagaactgtgctccgccttcaga
+acacatgctagcgcgtcggggtggtttaacc
+agcagagtggccagccac
+tctagcagagtggccagccac
+`))
+	c.Assert(err, check.IsNil)
+	c.Check(taglib.TagLen(1), check.Equals, 31)
+	c.Check(taglib.TagLengths(), check.DeepEquals, []int{31, 24, 21, 18})
+	haystack := []byte(`ggagaactgtgctccgccttcagaccccccccccccccccccccacacatgctagcgcgtcggggtggtttaaccgggggggggggggggggggggggggggactctagcagagtggccagccac`)
+	var matches []tagMatch
+	taglib.FindAll(bufio.NewReader(bytes.NewBuffer(haystack)), nil, func(id tagID, pos, taglen int) {
+		matches = append(matches, tagMatch{id, pos, taglen})
+	})
+	// tag 3 ends with tag 2, but tag 3 is longer, so it takes
+	// precedence
+	c.Check(matches, check.DeepEquals, []tagMatch{{0, 0, 24}, {1, 44, 31}, {3, 104, 21}})
+
+	id, ok := taglib.EndTag([]byte(`ccccacacatgctagcgcgtcggggtggtttaacc`))
+	c.Check(ok, check.Equals, true)
+	c.Check(id, check.Equals, tagID(1))
+	_, ok = taglib.EndTag([]byte(`ccccacacatgctagcgcgtcggggtggtttaac`))
+	c.Check(ok, check.Equals, false)
+
+	c.Check(string(taglib.Tags()[2]), check.Equals, "agcagagtggccagccac")
+}
+
+func (s *taglibSuite) TestDuplicateTag(c *check.C) {
+	var taglib tagLibrary
+	err := taglib.setTags([][]byte{[]byte("acgtacgtacgt"), []byte("ttttacgtacgtacgt"), []byte("ACGTACGTACGT")})
+	c.Check(err, check.ErrorMatches, `tag 2 .* is not unique`)
+}
+
+// randomTagLibrary returns a random haystack of the given size, and
+// a tag library with tagcount tags taken from evenly spaced
+// positions in the haystack.
+func randomTagLibrary(size, tagcount, tagsize int) ([]byte, *tagLibrary, error) {
+	acgt := []byte{'a', 'c', 'g', 't'}
+	haystack := make([]byte, size)
+	rand.Read(haystack)
+	for i := range haystack {
+		haystack[i] = acgt[int(haystack[i]&3)]
+	}
+	used := map[string]bool{}
+	var tags [][]byte
+	for i := 0; len(tags) < tagcount; i += (len(haystack) - tagsize) / tagcount {
+		tag := haystack[i : i+tagsize]
+		for used[string(tag)] {
+			i++
+			tag = haystack[i : i+tagsize]
+		}
+		used[string(tag)] = true
+		tags = append(tags, tag)
+	}
+	taglib := &tagLibrary{}
+	return haystack, taglib, taglib.setTags(tags)
+}
+
+func (s *taglibSuite) TestFindAllPrefilter(c *check.C) {
+	haystack, taglib, err := randomTagLibrary(1000000, 500, 24)
+	c.Assert(err, check.IsNil)
+	findAll := func() []tagMatch {
+		var matches []tagMatch
+		err := taglib.FindAll(bufio.NewReader(bytes.NewBuffer(haystack)), nil, func(id tagID, pos, taglen int) {
+			matches = append(matches, tagMatch{id, pos, taglen})
+		})
+		c.Assert(err, check.IsNil)
+		return matches
+	}
+	expect := findAll()
+	c.Check(len(expect) >= 500, check.Equals, true)
+	for _, bitsPerTag := range []int{1, 4, tagPrefilterBitsPerTag} {
+		taglib.EnablePrefilter(bitsPerTag)
+		c.Check(findAll(), check.DeepEquals, expect)
+	}
+	// Reloading tags discards the old filter.
+	err = taglib.setTags([][]byte{[]byte("acgtacgtacgt")})
+	c.Assert(err, check.IsNil)
+	c.Check(taglib.prefilter, check.IsNil)
+}
+
+func BenchmarkFindAll(b *testing.B) {
+	benchmarkFindAll(b, 0)
+}
+
+func BenchmarkFindAllPrefilter(b *testing.B) {
+	benchmarkFindAll(b, tagPrefilterBitsPerTag)
+}
+
+func benchmarkFindAll(b *testing.B, bitsPerTag int) {
+	haystack, taglib, err := randomTagLibrary(10000000, 5000, 24)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if bitsPerTag > 0 {
+		taglib.EnablePrefilter(bitsPerTag)
+	}
+	b.SetBytes(int64(len(haystack)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := taglib.FindAll(bufio.NewReader(bytes.NewBuffer(haystack)), nil, func(tagID, int, int) {})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/arvados/lightning/go-lightning/libio"
+	"golang.org/x/crypto/blake2b"
+)
+
+type tagSetInfo struct {
+	hash [blake2b.Size256]byte
+	tags int
+}
+
+var errStopReading = errors.New("stop reading")
+
+// encodeTagSet writes the entries that introduce the given tag set
+// (see libio.TagSetEntries).
+func encodeTagSet(enc libraryEncoder, tagset [][]byte) error {
+	for _, ent := range libio.TagSetEntries(tagset) {
+		if err := enc.Encode(ent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readTagSetInfo returns the hash and size of the tag set in the
+// given library file, or nil if the file has no tag set.
+//
+// Only the first entry is read: the tag set, if any, is always
+// written before anything else. Normally the first entry is a small
+// header with the hash and size of the tag set, so the tag set
+// itself is not decoded; files written by older versions start with
+// the tag set instead.
+func readTagSetInfo(fnm string) (*tagSetInfo, error) {
+	f, err := open(fnm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var info *tagSetInfo
+	err = DecodeLibraryOptions(f, strings.HasSuffix(fnm, ".gz"), DecodeOptions{SkipTileVariants: true, SkipGenomes: true}, func(ent *LibraryEntry) error {
+		if len(ent.TagSet) > 0 {
+			info = &tagSetInfo{hash: ent.TagSetHash, tags: len(ent.TagSet)}
+			if info.hash == ([blake2b.Size256]byte{}) {
+				// written by an older version
+				info.hash = libio.TagSetHash(ent.TagSet)
+			}
+		} else if ent.TagSetSize > 0 {
+			info = &tagSetInfo{hash: ent.TagSetHash, tags: ent.TagSetSize}
+		}
+		return errStopReading
+	})
+	if err != nil && err != errStopReading {
+		return nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	return info, nil
+}
+
+// checkTagSets returns an error identifying the offending file if
+// the given library files were not all built with the same tag
+// library. Files without tag sets (e.g., output of "import" without
+// -output-tiles) are not checked.
+func checkTagSets(infiles []string) error {
+	infos := make([]*tagSetInfo, len(infiles))
+	throttle := throttle{Max: runtime.GOMAXPROCS(0)}
+	var mtx sync.Mutex
+	for i, infile := range infiles {
+		i, infile := i, infile
+		throttle.Go(func() error {
+			info, err := readTagSetInfo(infile)
+			mtx.Lock()
+			infos[i] = info
+			mtx.Unlock()
+			return err
+		})
+	}
+	if err := throttle.Wait(); err != nil {
+		return err
+	}
+	first := -1
+	for i, info := range infos {
+		if info == nil {
+			continue
+		} else if first < 0 {
+			first = i
+		} else if info.hash != infos[first].hash {
+			return fmt.Errorf("tag library mismatch: %s has tag set hash %x (%d tags) but %s has tag set hash %x (%d tags)", infiles[i], info.hash, info.tags, infiles[first], infos[first].hash, infos[first].tags)
+		}
+	}
+	return nil
+}
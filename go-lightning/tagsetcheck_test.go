@@ -0,0 +1,66 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"os"
+
+	"github.com/arvados/lightning/go-lightning/libio"
+	"gopkg.in/check.v1"
+)
+
+type tagSetCheckSuite struct{}
+
+var _ = check.Suite(&tagSetCheckSuite{})
+
+func (s *tagSetCheckSuite) writeLibrary(c *check.C, fnm string, tagset [][]byte) {
+	f, err := os.Create(fnm)
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	w := libio.NewWriter(f, true)
+	if tagset != nil {
+		c.Assert(w.WriteTagSet(tagset), check.IsNil)
+	}
+	c.Assert(w.WriteCompactGenomes([]CompactGenome{{Name: fnm}}), check.IsNil)
+	c.Assert(w.Close(), check.IsNil)
+}
+
+func (s *tagSetCheckSuite) TestCheckTagSets(c *check.C) {
+	tmpdir := c.MkDir()
+	tagset := [][]byte{[]byte("acgtacgtacgt"), []byte("ttttacgtacgt")}
+	s.writeLibrary(c, tmpdir+"/a.gob.gz", tagset)
+	s.writeLibrary(c, tmpdir+"/b.gob.gz", [][]byte{[]byte("ACGTACGTACGT"), []byte("TTTTACGTACGT")})
+	s.writeLibrary(c, tmpdir+"/c.gob.gz", nil)
+	s.writeLibrary(c, tmpdir+"/d.gob.gz", [][]byte{[]byte("acgtacgtacgt"), []byte("ttttacgtacga")})
+
+	c.Check(checkTagSets([]string{tmpdir + "/a.gob.gz", tmpdir + "/b.gob.gz", tmpdir + "/c.gob.gz"}), check.IsNil)
+	err := checkTagSets([]string{tmpdir + "/c.gob.gz", tmpdir + "/a.gob.gz", tmpdir + "/d.gob.gz"})
+	c.Check(err, check.ErrorMatches, `tag library mismatch: .*/d\.gob\.gz has tag set hash [0-9a-f]+ \(2 tags\) but .*/a\.gob\.gz has .*`)
+
+	// The tag set header is enough: the tag set itself is not
+	// decoded.
+	hdr := libio.TagSetEntries(tagset)[0]
+	f, err := os.Create(tmpdir + "/hdr.gob.gz")
+	c.Assert(err, check.IsNil)
+	w := libio.NewWriter(f, true)
+	c.Assert(w.Write(hdr), check.IsNil)
+	c.Assert(w.Close(), check.IsNil)
+	c.Assert(f.Close(), check.IsNil)
+	info, err := readTagSetInfo(tmpdir + "/hdr.gob.gz")
+	c.Assert(err, check.IsNil)
+	c.Check(info, check.DeepEquals, &tagSetInfo{hash: libio.TagSetHash(tagset), tags: 2})
+
+	// Files written by older versions start with the tag set
+	// entry, with or without its hash.
+	for _, ent := range []*LibraryEntry{libio.TagSetEntry(tagset), {TagSet: tagset}} {
+		f, err := os.Create(tmpdir + "/old.gob.gz")
+		c.Assert(err, check.IsNil)
+		w := libio.NewWriter(f, true)
+		c.Assert(w.Write(ent), check.IsNil)
+		c.Assert(w.Close(), check.IsNil)
+		c.Assert(f.Close(), check.IsNil)
+		c.Check(checkTagSets([]string{tmpdir + "/old.gob.gz", tmpdir + "/a.gob.gz", tmpdir + "/hdr.gob.gz"}), check.IsNil)
+	}
+}
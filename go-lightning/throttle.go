@@ -5,8 +5,16 @@
 package lightning
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type throttle struct {
@@ -34,9 +42,25 @@ func (t *throttle) Release() {
 	<-t.ch
 }
 
+// Report records err (if non-nil) so it will be returned by Err and
+// Wait. Only the first error is returned; subsequent errors are
+// logged, with the location of the Report call, so they are not
+// lost.
 func (t *throttle) Report(err error) {
-	if err != nil {
-		t.errorOnce.Do(func() { t.err.Store(err) })
+	t.report(err, callerLocation(2))
+}
+
+func (t *throttle) report(err error, where string) {
+	if err == nil {
+		return
+	}
+	first := false
+	t.errorOnce.Do(func() {
+		t.err.Store(err)
+		first = true
+	})
+	if !first {
+		log.Errorf("%s: error reported after an earlier error (not returned): %s", where, err)
 	}
 }
 
@@ -56,9 +80,182 @@ func (t *throttle) Go(f func() error) error {
 		t.Release()
 		return t.Err()
 	}
+	where := callerLocation(2)
+	id := throttleWorkers.start(where)
 	go func() {
-		t.Report(f())
+		t.report(f(), where)
+		throttleWorkers.finish(id)
 		t.Release()
 	}()
 	return nil
 }
+
+// callerLocation returns the file:line of the caller skip levels up
+// the stack (see runtime.Caller).
+func callerLocation(skip int) string {
+	_, file, line, ok := runtime.Caller(skip)
+	if !ok {
+		return "unknown location"
+	}
+	for i := len(file) - 1; i > 0; i-- {
+		if file[i] == '/' {
+			file = file[i+1:]
+			break
+		}
+	}
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
+// throttleWorkers tracks the goroutines started by throttle.Go, for
+// heartbeat logging and deadlock detection (see startWatchdog).
+var throttleWorkers workerRegistry
+
+type workerRegistry struct {
+	mtx          sync.Mutex
+	nextID       int64
+	running      map[int64]workerInfo
+	lastActivity time.Time // last time a worker started or finished
+}
+
+type workerInfo struct {
+	where   string // location of the throttle.Go call
+	started time.Time
+}
+
+func (wr *workerRegistry) start(where string) int64 {
+	wr.mtx.Lock()
+	defer wr.mtx.Unlock()
+	if wr.running == nil {
+		wr.running = map[int64]workerInfo{}
+	}
+	wr.nextID++
+	wr.lastActivity = time.Now()
+	wr.running[wr.nextID] = workerInfo{where: where, started: wr.lastActivity}
+	return wr.nextID
+}
+
+func (wr *workerRegistry) finish(id int64) {
+	wr.mtx.Lock()
+	defer wr.mtx.Unlock()
+	delete(wr.running, id)
+	wr.lastActivity = time.Now()
+}
+
+// heartbeat logs each worker that has been running for at least
+// minAge, and returns the time since the last worker started or
+// finished.
+func (wr *workerRegistry) heartbeat(minAge time.Duration) time.Duration {
+	wr.mtx.Lock()
+	defer wr.mtx.Unlock()
+	now := time.Now()
+	ids := make([]int64, 0, len(wr.running))
+	for id := range wr.running {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		w := wr.running[id]
+		if age := now.Sub(w.started); age >= minAge {
+			log.Infof("heartbeat: worker %d (started at %s) running for %v", id, w.where, age.Round(time.Second))
+		}
+	}
+	if wr.lastActivity.IsZero() {
+		return 0
+	}
+	return now.Sub(wr.lastActivity)
+}
+
+// startWatchdog starts a goroutine that logs long-running throttle
+// workers every timeout/4 and, if no worker starts or finishes for
+// the given timeout while any worker is running, writes all
+// goroutine stacks to stderr and exits the process.
+//
+// If timeout is zero, startWatchdog does nothing.
+func startWatchdog(timeout time.Duration, stderr io.Writer) {
+	if timeout <= 0 {
+		return
+	}
+	go func() {
+		for range time.NewTicker(timeout / 4).C {
+			idle := throttleWorkers.heartbeat(timeout / 4)
+			throttleWorkers.mtx.Lock()
+			nrunning := len(throttleWorkers.running)
+			throttleWorkers.mtx.Unlock()
+			if nrunning == 0 || idle < timeout {
+				continue
+			}
+			watchdogAbort(stderr, fmt.Sprintf("watchdog: no worker started or finished in %v (%d workers running), aborting", idle.Round(time.Second), nrunning))
+		}
+	}()
+}
+
+// watchdogAbort writes msg and all goroutine stacks to stderr,
+// writes error.json if requested by the environment (see Main), and
+// exits.
+func watchdogAbort(stderr io.Writer, msg string) {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+	fmt.Fprintf(stderr, "%s\n%s\n%s\n", msg, buf, msg)
+	if fnm := os.Getenv(errorJSONEnv); fnm != "" {
+		command := ""
+		if len(os.Args) > 1 {
+			command = os.Args[1]
+		}
+		d := failureDiagnostic(command, 1, msg)
+		d.Phase = "watchdog"
+		if err := writeErrorJSON(fnm, d); err != nil {
+			fmt.Fprintf(stderr, "error writing %s: %s\n", fnm, err)
+		}
+	}
+	os.Exit(1)
+}
+
+// memThrottle limits concurrency according to the total estimated
+// memory use of running tasks, rather than the number of tasks.
+type memThrottle struct {
+	Budget int64
+
+	mtx   sync.Mutex
+	cond  *sync.Cond
+	inuse int64
+}
+
+// Acquire blocks until n bytes of the budget are available, reserves
+// them, and returns the amount reserved, which should be passed to
+// Release when the task is done.
+//
+// If n exceeds the entire budget, Acquire waits until nothing else is
+// reserved and reserves the entire budget, so the task runs alone
+// instead of never running at all.
+func (t *memThrottle) Acquire(n int64) int64 {
+	if n > t.Budget {
+		n = t.Budget
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.cond == nil {
+		t.cond = sync.NewCond(&t.mtx)
+	}
+	for t.inuse+n > t.Budget {
+		t.cond.Wait()
+	}
+	t.inuse += n
+	return n
+}
+
+// Release returns n bytes (as returned by Acquire) to the budget.
+func (t *memThrottle) Release(n int64) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.inuse -= n
+	if t.cond != nil {
+		t.cond.Broadcast()
+	}
+}
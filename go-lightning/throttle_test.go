@@ -0,0 +1,78 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type throttleSuite struct{}
+
+var _ = check.Suite(&throttleSuite{})
+
+func (s *throttleSuite) TestMemThrottle(c *check.C) {
+	t := memThrottle{Budget: 100}
+	var inuse, maxInuse int64
+	var wg sync.WaitGroup
+	for _, n := range []int64{40, 40, 40, 10, 150, 30} {
+		n := n
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reserved := t.Acquire(n)
+			defer t.Release(reserved)
+			if n > 100 {
+				c.Check(reserved, check.Equals, int64(100))
+			} else {
+				c.Check(reserved, check.Equals, n)
+			}
+			now := atomic.AddInt64(&inuse, reserved)
+			for {
+				max := atomic.LoadInt64(&maxInuse)
+				if now <= max || atomic.CompareAndSwapInt64(&maxInuse, max, now) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt64(&inuse, -reserved)
+		}()
+	}
+	wg.Wait()
+	c.Check(maxInuse <= 100, check.Equals, true)
+	c.Check(t.inuse, check.Equals, int64(0))
+}
+
+func (s *throttleSuite) TestReportFirstError(c *check.C) {
+	t := throttle{Max: 2}
+	for i := 0; i < 4; i++ {
+		i := i
+		t.Go(func() error {
+			if i == 0 {
+				return errors.New("first")
+			}
+			return nil
+		})
+	}
+	c.Check(t.Wait(), check.ErrorMatches, `first`)
+	t.Report(errors.New("second"))
+	c.Check(t.Err(), check.ErrorMatches, `first`)
+}
+
+func (s *throttleSuite) TestWorkerRegistry(c *check.C) {
+	var wr workerRegistry
+	c.Check(wr.heartbeat(0), check.Equals, time.Duration(0))
+	id := wr.start(callerLocation(1))
+	c.Check(wr.running[id].where, check.Matches, `throttle_test\.go:\d+`)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(wr.heartbeat(0) >= 10*time.Millisecond, check.Equals, true)
+	wr.finish(id)
+	c.Check(wr.running, check.HasLen, 0)
+	c.Check(wr.heartbeat(0) < 10*time.Millisecond, check.Equals, true)
+}
@@ -0,0 +1,440 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"sort"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/arvados/lightning/go-lightning/hgvs"
+	log "github.com/sirupsen/logrus"
+)
+
+// tileAlign writes an alignment of all variants of a single tile
+// against the reference tile, along with the variants assigned to
+// each sample, for reviewing calling artifacts at a locus.
+type tileAlign struct{}
+
+func (cmd *tileAlign) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
+	inputDir := flags.String("input-dir", "./in", "input `directory` or library file")
+	outputFilename := flags.String("o", "-", "output `file`")
+	tag := flags.Int("tag", -1, "`tag` ID of tile to align")
+	ref := flags.String("ref", "", "reference name (may be blank if input has only one reference; see 'lightning refs')")
+	format := flags.String("format", "text", "output `format`: text or html")
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	} else if *tag < 0 {
+		err = errors.New("-tag argument is required")
+		return 2
+	} else if *format != "text" && *format != "html" {
+		err = fmt.Errorf("invalid -format %q: must be text or html", *format)
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		if *outputFilename != "-" {
+			err = errors.New("cannot specify output file in container mode: not implemented")
+			return 1
+		}
+		runner := arvadosContainerRunner{
+			Name:        "lightning tile-alignment",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         16000000000,
+			VCPUs:       2,
+			Priority:    *priority,
+			KeepCache:   2,
+			APIAccess:   true,
+		}
+		containerOpts.Apply(&runner, stdout)
+		err = runner.TranslatePaths(inputDir)
+		if err != nil {
+			return 1
+		}
+		outfile := fmt.Sprintf("tile-%d.%s", *tag, map[string]string{"text": "txt", "html": "html"}[*format])
+		runner.Args = []string{"tile-alignment", "-local=true",
+			"-pprof", ":6060",
+			"-input-dir", *inputDir,
+			"-o", "/mnt/output/" + outfile,
+			"-tag", fmt.Sprintf("%d", *tag),
+			"-ref", *ref,
+			"-format", *format,
+		}
+		var output string
+		output, err = runner.Run()
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output+"/"+outfile)
+		return 0
+	}
+
+	infiles, err := allFiles(*inputDir, matchGobFile)
+	if err != nil {
+		return 1
+	} else if len(infiles) == 0 {
+		err = fmt.Errorf("no input files found in %s", *inputDir)
+		return 1
+	}
+	err = checkTagSets(infiles)
+	if err != nil {
+		return 1
+	}
+	ta, err := loadTileAlignment(infiles, tagID(*tag), *ref)
+	if err != nil {
+		return 1
+	}
+
+	var output io.WriteCloser
+	if *outputFilename == "-" {
+		output = nopCloser{stdout}
+	} else {
+		output, err = os.OpenFile(*outputFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+		if err != nil {
+			return 1
+		}
+		defer output.Close()
+	}
+	bufw := bufio.NewWriter(output)
+	if *format == "html" {
+		ta.writeHTML(bufw)
+	} else {
+		ta.writeText(bufw)
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return 1
+	}
+	err = output.Close()
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// tileAlignment is an alignment of the variants of a single tile.
+type tileAlignment struct {
+	tag        tagID
+	refname    string
+	seqname    string
+	pos        int // 0-based position of tile in seqname, or -1 if unknown
+	refvariant tileVariantID
+	variants   []alignedTileVariant // sorted by variant ID
+	samples    []alignedSample      // sorted by name
+	nocalls    int                  // haplotypes with no tile variant
+}
+
+type alignedTileVariant struct {
+	variant tileVariantID
+	aligned string // with '-' for gaps, same length for all variants
+	count   int    // haplotypes with this variant
+}
+
+type alignedSample struct {
+	name     string
+	variants [2]tileVariantID
+}
+
+// loadTileAlignment reads the tile variants of the given tag, the
+// corresponding reference tile, and each genome's variants at that
+// tag from the given library files, and aligns the tile variants
+// against the reference tile.
+func loadTileAlignment(infiles []string, tag tagID, refname string) (*tileAlignment, error) {
+	var taglen int
+	var cseqs []CompactSequence
+	seqs := map[tileVariantID][]byte{}
+	reflen := map[tileLibRef]int{}
+	genomes := map[string]*[2]tileVariantID{}
+	for _, infile := range infiles {
+		err := decodeLibraryFile(infile, func(ent *LibraryEntry) error {
+			if len(ent.TagSet) > 0 {
+				taglen = len(ent.TagSet[0])
+			}
+			cseqs = append(cseqs, ent.CompactSequences...)
+			for _, tv := range ent.TileVariants {
+				if tv.Ref {
+					reflen[tileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = len(tv.Sequence)
+				}
+				if tv.Tag == tag && len(tv.Sequence) > 0 {
+					seqs[tv.Variant] = tv.Sequence
+				}
+			}
+			for _, cg := range ent.CompactGenomes {
+				g := genomes[cg.Name]
+				if g == nil {
+					g = &[2]tileVariantID{}
+					genomes[cg.Name] = g
+				}
+				if i := int(tag-cg.StartTag) * 2; tag >= cg.StartTag && i+1 < len(cg.Variants) {
+					g[0], g[1] = cg.Variants[i], cg.Variants[i+1]
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	refs := summarizeRefs(cseqs, taglen, func(libref tileLibRef) (int, bool) {
+		n, ok := reflen[libref]
+		return n, ok
+	})
+	var refseq map[string][]tileLibRef
+	for _, cseq := range cseqs {
+		if cseq.Name == refname || (refname == "" && len(refs) == 1) {
+			refseq = cseq.TileSequences
+		}
+	}
+	switch {
+	case len(refs) == 0:
+		return nil, errors.New("reference sequence not found")
+	case refseq == nil && refname != "":
+		return nil, fmt.Errorf("reference %q not found; available references are:\n%s", refname, refListing(refs))
+	case refseq == nil:
+		return nil, fmt.Errorf("input has multiple references, use -ref to choose one:\n%s", refListing(refs))
+	}
+	if refname == "" {
+		refname = refs[0].name
+	}
+
+	ta := &tileAlignment{tag: tag, refname: refname, pos: -1}
+	for seqname, tseq := range refseq {
+		pos := 0
+		for _, libref := range tseq {
+			if libref.Tag == tag {
+				ta.seqname = seqname
+				ta.refvariant = libref.Variant
+				ta.pos = pos
+				break
+			}
+			n, ok := reflen[libref]
+			if !ok {
+				pos = -1
+			} else if pos >= 0 {
+				pos += n - taglen
+			}
+		}
+		if ta.seqname != "" {
+			break
+		}
+	}
+	if ta.seqname == "" {
+		return nil, fmt.Errorf("reference %q does not use tag %d", refname, tag)
+	}
+	refseqdata, ok := seqs[ta.refvariant]
+	if !ok {
+		return nil, fmt.Errorf("sequence of reference tile variant %d of tag %d not found in input", ta.refvariant, tag)
+	}
+
+	counts := map[tileVariantID]int{}
+	for name, g := range genomes {
+		ta.samples = append(ta.samples, alignedSample{name: name, variants: *g})
+		for _, v := range g {
+			if v == 0 {
+				ta.nocalls++
+			} else {
+				counts[v]++
+			}
+		}
+	}
+	sort.Slice(ta.samples, func(i, j int) bool { return ta.samples[i].name < ta.samples[j].name })
+
+	var vids []tileVariantID
+	for v := range seqs {
+		vids = append(vids, v)
+	}
+	for v := range counts {
+		if _, ok := seqs[v]; !ok {
+			log.Warnf("tile variant %d of tag %d is used by %d haplotypes but its sequence was not found", v, tag, counts[v])
+		}
+	}
+	sort.Slice(vids, func(i, j int) bool { return vids[i] < vids[j] })
+	strs := make([]string, len(vids))
+	for i, v := range vids {
+		strs[i] = strings.ToUpper(string(seqs[v]))
+	}
+	aligned := alignToReference(strings.ToUpper(string(refseqdata)), strs)
+	for i, v := range vids {
+		ta.variants = append(ta.variants, alignedTileVariant{variant: v, aligned: aligned[i], count: counts[v]})
+	}
+	return ta, nil
+}
+
+// alignToReference aligns each of the given sequences against ref,
+// using the same diffs that are used to generate hgvs annotations,
+// and returns the aligned sequences with '-' inserted for gaps. All
+// returned strings have the same length: where any sequence has an
+// insertion relative to ref, the others have gaps.
+func alignToReference(ref string, seqs []string) []string {
+	type alignedSeq struct {
+		bases []byte   // one per ref position, '-' if deleted
+		ins   []string // ins[i] is inserted before ref position i
+	}
+	maxins := make([]int, len(ref)+1)
+	aseqs := make([]alignedSeq, len(seqs))
+	for i, seq := range seqs {
+		aseq := alignedSeq{bases: []byte(ref), ins: make([]string, len(ref)+1)}
+		diffs, _ := hgvs.Diff(ref, seq, 0)
+		for _, d := range diffs {
+			p := d.Position - 1
+			n := len(d.Ref)
+			if len(d.New) < n {
+				n = len(d.New)
+			}
+			copy(aseq.bases[p:], d.New[:n])
+			for j := p + n; j < p+len(d.Ref); j++ {
+				aseq.bases[j] = '-'
+			}
+			aseq.ins[p+len(d.Ref)] += d.New[n:]
+		}
+		for p, s := range aseq.ins {
+			if len(s) > maxins[p] {
+				maxins[p] = len(s)
+			}
+		}
+		aseqs[i] = aseq
+	}
+	out := make([]string, len(aseqs))
+	for i, aseq := range aseqs {
+		var buf strings.Builder
+		for p, s := range aseq.ins {
+			buf.WriteString(s)
+			buf.WriteString(strings.Repeat("-", maxins[p]-len(s)))
+			if p < len(aseq.bases) {
+				buf.WriteByte(aseq.bases[p])
+			}
+		}
+		out[i] = buf.String()
+	}
+	return out
+}
+
+// refAligned returns the aligned reference sequence.
+func (ta *tileAlignment) refAligned() string {
+	for _, tv := range ta.variants {
+		if tv.variant == ta.refvariant {
+			return tv.aligned
+		}
+	}
+	return ""
+}
+
+func (ta *tileAlignment) location() string {
+	if ta.pos < 0 {
+		return ta.seqname
+	}
+	return fmt.Sprintf("%s:%d", ta.seqname, ta.pos+1)
+}
+
+// writeText writes the alignment as plain text. Bases that match
+// the reference tile are shown as '.'.
+func (ta *tileAlignment) writeText(w io.Writer) {
+	fmt.Fprintf(w, "# tag %d, reference %s, %s, reference tile variant %d\n", ta.tag, ta.refname, ta.location(), ta.refvariant)
+	fmt.Fprintf(w, "# variant\thaplotypes\talignment\n")
+	refaligned := ta.refAligned()
+	for _, tv := range ta.variants {
+		aligned := []byte(tv.aligned)
+		label := fmt.Sprintf("%d", tv.variant)
+		if tv.variant == ta.refvariant {
+			label += "*"
+		} else {
+			for i := range aligned {
+				if aligned[i] == refaligned[i] && aligned[i] != '-' {
+					aligned[i] = '.'
+				}
+			}
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", label, tv.count, aligned)
+	}
+	fmt.Fprintf(w, "# no-call haplotypes: %d\n", ta.nocalls)
+	fmt.Fprintf(w, "# sample\tvariant\tvariant\n")
+	for _, s := range ta.samples {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", s.name, s.variants[0], s.variants[1])
+	}
+}
+
+// writeHTML writes the alignment as an HTML page, with bases that
+// differ from the reference tile highlighted.
+func (ta *tileAlignment) writeHTML(w io.Writer) {
+	title := html.EscapeString(fmt.Sprintf("tag %d, reference %s, %s", ta.tag, ta.refname, ta.location()))
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>%s</title>\n", title)
+	fmt.Fprint(w, `<style>
+body { font-family: sans-serif; }
+td, th { padding: 0 0.5em; text-align: left; }
+.seq { font-family: monospace; white-space: pre; }
+.diff { background: #fc8; }
+.gap { color: #999; }
+.ref { font-weight: bold; }
+</style></head><body>
+`)
+	fmt.Fprintf(w, "<h1>%s</h1>\n<p>Reference tile variant: %d. No-call haplotypes: %d.</p>\n", title, ta.refvariant, ta.nocalls)
+	fmt.Fprint(w, "<table>\n<tr><th>variant</th><th>haplotypes</th><th>alignment</th></tr>\n")
+	refaligned := ta.refAligned()
+	for _, tv := range ta.variants {
+		class := ""
+		if tv.variant == ta.refvariant {
+			class = ` class="ref"`
+		}
+		fmt.Fprintf(w, "<tr%s><td>%d</td><td>%d</td><td class=\"seq\">", class, tv.variant, tv.count)
+		for i := 0; i < len(tv.aligned); i++ {
+			b := tv.aligned[i]
+			switch {
+			case b != refaligned[i]:
+				fmt.Fprintf(w, `<span class="diff">%c</span>`, b)
+			case b == '-':
+				fmt.Fprint(w, `<span class="gap">-</span>`)
+			default:
+				fmt.Fprintf(w, "%c", b)
+			}
+		}
+		fmt.Fprint(w, "</td></tr>\n")
+	}
+	fmt.Fprint(w, "</table>\n<h2>Samples</h2>\n<table>\n<tr><th>sample</th><th>variant</th><th>variant</th></tr>\n")
+	for _, s := range ta.samples {
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%d</td><td>%d</td></tr>\n", html.EscapeString(s.name), s.variants[0], s.variants[1])
+	}
+	fmt.Fprint(w, "</table>\n</body></html>\n")
+}
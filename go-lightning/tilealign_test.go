@@ -0,0 +1,74 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type tileAlignSuite struct{}
+
+var _ = check.Suite(&tileAlignSuite{})
+
+func (s *tileAlignSuite) TestAlignToReference(c *check.C) {
+	aligned := alignToReference("ACGTACGT", []string{
+		"ACGTACGT",
+		"ACCTACGT",
+		"ACGTGGACGT",
+		"ACACGT",
+	})
+	c.Check(aligned, check.DeepEquals, []string{
+		"ACGT--ACGT",
+		"ACCT--ACGT",
+		"ACGTGGACGT",
+		"AC----ACGT",
+	})
+}
+
+func (s *tileAlignSuite) TestTileAlignment(c *check.C) {
+	tmpdir := c.MkDir()
+	exited := (&importer{}).RunCommand("import", []string{
+		"-local=true",
+		"-tag-library", "testdata/tags",
+		"-output-tiles",
+		"-save-incomplete-tiles",
+		"-o", tmpdir + "/library.gob",
+		"testdata/ref.fasta",
+		"testdata/pipeline1",
+	}, nil, os.Stderr, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	var stdout bytes.Buffer
+	exited = (&tileAlign{}).RunCommand("tile-alignment", []string{
+		"-local=true",
+		"-input-dir", tmpdir + "/library.gob",
+		"-tag", "1",
+	}, nil, &stdout, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	c.Log(stdout.String())
+	c.Check(stdout.String(), check.Matches, `(?ms)# tag 1, reference testdata/ref.fasta, chr\d:\d+, reference tile variant \d+\n.*\n\d+\*\t\d+\t[ACGT-]+\n.*`)
+	c.Check(stdout.String(), check.Matches, `(?ms).*\n# sample\tvariant\tvariant\n.*input1\t\d+\t\d+\n.*`)
+
+	stdout.Reset()
+	exited = (&tileAlign{}).RunCommand("tile-alignment", []string{
+		"-local=true",
+		"-input-dir", tmpdir + "/library.gob",
+		"-tag", "1",
+		"-format", "html",
+	}, nil, &stdout, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	c.Check(stdout.String(), check.Matches, `(?ms)<!DOCTYPE html>.*<tr class="ref"><td>\d+</td>.*input1.*</html>\n`)
+
+	exited = (&tileAlign{}).RunCommand("tile-alignment", []string{
+		"-local=true",
+		"-input-dir", tmpdir + "/library.gob",
+		"-tag", "1",
+		"-ref", "nonexistent",
+	}, nil, &stdout, os.Stderr)
+	c.Check(exited, check.Equals, 1)
+}
@@ -0,0 +1,102 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"sync"
+)
+
+// tileVariantArena collects the tile variants of one input chunk.
+//
+// Rather than keeping a separately allocated []byte for each
+// sequence and growing a []TileVariant for each tag as variants
+// arrive, it copies sequences into one large buffer, and (in build)
+// carves the per-tag variant slices out of one large []TileVariant
+// sized by counting the variants in a first pass. This keeps the
+// number of live heap objects per chunk small, which greatly reduces
+// GC work on big chunks.
+//
+// Arenas are recycled via getTileVariantArena/putTileVariantArena so
+// the buffers allocated for one chunk are reused for the next.
+type tileVariantArena struct {
+	tvs    []TileVariant // Sequence fields are nil until build()
+	seqEnd []int         // tvs[i].Sequence is buf[seqEnd[i-1]:seqEnd[i]]
+	buf    []byte
+	index  []TileVariant // backing array for slices returned by build()
+}
+
+var tileVariantArenaPool = sync.Pool{New: func() interface{} { return &tileVariantArena{} }}
+
+func getTileVariantArena() *tileVariantArena {
+	return tileVariantArenaPool.Get().(*tileVariantArena)
+}
+
+// putTileVariantArena returns a to the pool. The caller must not use
+// a, or any slices returned by a.build(), afterward.
+func putTileVariantArena(a *tileVariantArena) {
+	a.reset()
+	tileVariantArenaPool.Put(a)
+}
+
+// add copies tv (including its sequence data) into the arena.
+func (a *tileVariantArena) add(tv *TileVariant) {
+	a.buf = append(a.buf, tv.Sequence...)
+	a.seqEnd = append(a.seqEnd, len(a.buf))
+	a.tvs = append(a.tvs, *tv)
+	a.tvs[len(a.tvs)-1].Sequence = nil
+}
+
+// build returns the collected tile variants, indexed by tag and
+// variant number. If the same tag and variant were added more than
+// once, the last one wins.
+func (a *tileVariantArena) build() map[tagID][]TileVariant {
+	// First pass: find the number of variant slots needed for
+	// each tag.
+	nvariants := make(map[tagID]int, 50000)
+	for i := range a.tvs {
+		tv := &a.tvs[i]
+		if n := int(tv.Variant) + 1; n > nvariants[tv.Tag] {
+			nvariants[tv.Tag] = n
+		}
+	}
+	total := 0
+	for _, n := range nvariants {
+		total += n
+	}
+	if cap(a.index) < total {
+		a.index = make([]TileVariant, total)
+	} else {
+		a.index = a.index[:total]
+		for i := range a.index {
+			a.index[i] = TileVariant{}
+		}
+	}
+	seq := make(map[tagID][]TileVariant, len(nvariants))
+	offset := 0
+	for tag, n := range nvariants {
+		seq[tag] = a.index[offset : offset+n : offset+n]
+		offset += n
+	}
+	// Second pass: fill in the variants, pointing their
+	// sequences into the arena buffer.
+	start := 0
+	for i := range a.tvs {
+		tv := a.tvs[i]
+		end := a.seqEnd[i]
+		tv.Sequence = a.buf[start:end:end]
+		start = end
+		seq[tv.Tag][tv.Variant] = tv
+	}
+	return seq
+}
+
+// reset discards the arena's content, retaining its allocated
+// buffers for reuse.
+func (a *tileVariantArena) reset() {
+	a.tvs = a.tvs[:0]
+	a.seqEnd = a.seqEnd[:0]
+	a.buf = a.buf[:0]
+	a.index = a.index[:0]
+}
@@ -0,0 +1,43 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"gopkg.in/check.v1"
+)
+
+func (s *sliceSuite) TestTileVariantArena(c *check.C) {
+	for trial := 0; trial < 2; trial++ {
+		a := getTileVariantArena()
+		for _, tv := range []TileVariant{
+			{Tag: 5, Variant: 2, Sequence: []byte("acgt")},
+			{Tag: 7, Variant: 1, Sequence: []byte("gg")},
+			{Tag: 5, Variant: 1, Sequence: []byte("tt")},
+			{Tag: 5, Variant: 3},
+		} {
+			tv := tv
+			a.add(&tv)
+			// The arena must not retain the caller's buffer.
+			if len(tv.Sequence) > 0 {
+				tv.Sequence[0] = 'x'
+			}
+		}
+		seq := a.build()
+		c.Check(seq, check.HasLen, 2)
+		c.Assert(seq[5], check.HasLen, 4)
+		c.Check(seq[5][0].Sequence, check.HasLen, 0)
+		c.Check(string(seq[5][1].Sequence), check.Equals, "tt")
+		c.Check(string(seq[5][2].Sequence), check.Equals, "acgt")
+		c.Check(seq[5][3].Sequence, check.HasLen, 0)
+		c.Check(seq[5][3].Variant, check.Equals, tileVariantID(3))
+		c.Assert(seq[7], check.HasLen, 2)
+		c.Check(string(seq[7][1].Sequence), check.Equals, "gg")
+		// Appending to one tag's slice must not clobber
+		// another tag's variants.
+		seq[5] = append(seq[5], TileVariant{Variant: 99})
+		c.Check(string(seq[7][1].Sequence), check.Equals, "gg")
+		putTileVariantArena(a)
+	}
+}
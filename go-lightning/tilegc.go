@@ -0,0 +1,170 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// tagGCState tracks which of a tag's variants have been referenced,
+// and (once CollectGarbage has removed some variants) the variant
+// IDs of the remaining entries in tilelib.variant[tag].
+type tagGCState struct {
+	// ids[i] is the variant ID of tilelib.variant[tag][i]. If
+	// nil, the ID is i+1.
+	ids []tileVariantID
+	// used[i] is true if tilelib.variant[tag][i] has been
+	// passed to MarkReferenced.
+	used []bool
+	// variants at index >= seen were added since the last
+	// CollectGarbage, and are not eligible for collection yet.
+	seen int
+}
+
+// add records a newly appended variant whose default ID (i.e., its
+// 1-based position in tilelib.variant[tag]) is dflt, and returns its
+// actual ID. Caller must have vlock[tag].
+func (st *tagGCState) add(dflt tileVariantID) tileVariantID {
+	st.used = append(st.used, false)
+	if st.ids == nil {
+		return dflt
+	}
+	id := st.ids[len(st.ids)-1] + 1
+	st.ids = append(st.ids, id)
+	return id
+}
+
+// variantID returns the variant ID of tilelib.variant[tag][i].
+// Caller must have vlock[tag].
+func (tilelib *tileLibrary) variantID(tag tagID, i int) tileVariantID {
+	if tilelib.trackReferences && tilelib.gcstate[tag].ids != nil {
+		return tilelib.gcstate[tag].ids[i]
+	}
+	return tileVariantID(i + 1)
+}
+
+// variantIndex returns the position of the given variant in
+// tilelib.variant[tag], or false if it is not there (either it never
+// existed, or it was removed by CollectGarbage).
+func (tilelib *tileLibrary) variantIndex(tag tagID, variant tileVariantID) (int, bool) {
+	if variant == 0 {
+		return 0, false
+	}
+	if tilelib.trackReferences && int(tag) < len(tilelib.gcstate) && tilelib.gcstate[tag].ids != nil {
+		ids := tilelib.gcstate[tag].ids
+		i := sort.Search(len(ids), func(i int) bool { return ids[i] >= variant })
+		return i, i < len(ids) && ids[i] == variant
+	}
+	i := int(variant) - 1
+	return i, i < len(tilelib.variant[tag])
+}
+
+// MarkReferenced records that the given variant is referenced by a
+// genome or reference sequence, so CollectGarbage will not remove
+// it. It has no effect unless trackReferences is true.
+func (tilelib *tileLibrary) MarkReferenced(libref tileLibRef) {
+	if !tilelib.trackReferences || libref.Variant == 0 {
+		return
+	}
+	tilelib.mtx.RLock()
+	defer tilelib.mtx.RUnlock()
+	if int(libref.Tag) >= len(tilelib.vlock) {
+		return
+	}
+	vlock := tilelib.vlock[libref.Tag]
+	vlock.Lock()
+	defer vlock.Unlock()
+	if i, ok := tilelib.variantIndex(libref.Tag, libref.Variant); ok {
+		tilelib.gcstate[libref.Tag].used[i] = true
+	}
+}
+
+// CollectGarbage removes variants that have not been passed to
+// MarkReferenced, and returns the number of variants removed.
+//
+// It is safe to call while other goroutines are adding tiles. To
+// avoid removing variants that are about to be referenced by a
+// genome that is still being tiled, a variant is only eligible for
+// removal once it has survived one previous CollectGarbage call.
+//
+// Removed variants keep their IDs reserved, so IDs that have already
+// been written to tilelib.encoder remain valid. If a removed variant
+// is seen again, it is added with a new ID and written to the encoder
+// again, so the output can list the same tile sequence under two
+// IDs. The old ID stays reserved and is never reused; readers do not
+// merge the duplicates.
+//
+// CollectGarbage is meant for libraries that stream their output to
+// an encoder. After it has removed any variants, Tidy and WriteDir
+// must not be used.
+func (tilelib *tileLibrary) CollectGarbage() int {
+	if !tilelib.trackReferences {
+		return 0
+	}
+	tilelib.mtx.RLock()
+	defer tilelib.mtx.RUnlock()
+	dropped := 0
+	for tag := range tilelib.variant {
+		tilelib.vlock[tag].Lock()
+		dropped += tilelib.collectTagGarbage(tagID(tag))
+		tilelib.vlock[tag].Unlock()
+	}
+	atomic.AddInt64(&tilelib.variants, -int64(dropped))
+	return dropped
+}
+
+// Caller must have vlock[tag].
+func (tilelib *tileLibrary) collectTagGarbage(tag tagID) int {
+	st := &tilelib.gcstate[tag]
+	variants := tilelib.variant[tag]
+	// Never remove the last variant: we need its ID to assign
+	// the next one.
+	eligible := st.seen
+	if eligible > len(variants)-1 {
+		eligible = len(variants) - 1
+	}
+	dropped := 0
+	for i := 0; i < eligible; i++ {
+		if !st.used[i] {
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		st.seen = len(variants)
+		return 0
+	}
+	newvariants := make([]tileHash, 0, len(variants)-dropped)
+	newids := make([]tileVariantID, 0, len(variants)-dropped)
+	newused := make([]bool, 0, len(variants)-dropped)
+	for i, hash := range variants {
+		if i < eligible && !st.used[i] {
+			tilelib.forgetSequence(hash)
+			continue
+		}
+		newvariants = append(newvariants, hash)
+		newids = append(newids, tilelib.variantID(tag, i))
+		newused = append(newused, st.used[i])
+	}
+	tilelib.variant[tag] = newvariants
+	st.ids = newids
+	st.used = newused
+	st.seen = len(newvariants)
+	return dropped
+}
+
+// forgetSequence releases the in-memory copy (if any) of the tile
+// sequence with the given hash.
+func (tilelib *tileLibrary) forgetSequence(hash tileHash) {
+	if tilelib.seq2 == nil {
+		return
+	}
+	var k [2]byte
+	copy(k[:], hash[:])
+	locker := tilelib.seq2lock[k]
+	locker.Lock()
+	delete(tilelib.seq2[k], hash)
+	locker.Unlock()
+}
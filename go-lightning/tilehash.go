@@ -0,0 +1,43 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+//go:build !shorthash
+
+package lightning
+
+import (
+	"golang.org/x/crypto/blake2b"
+)
+
+// tileHash is the in-memory hash used to identify distinct tile
+// variant sequences. By default it is the same blake2b-256 hash that
+// is stored in library files. Build with "-tags shorthash" to use a
+// faster 128-bit hash instead (see tilehash_short.go).
+type tileHash = [blake2b.Size256]byte
+
+const (
+	tileHashName = "blake2b-256"
+
+	// tileHashVerify is true if hashTile is not collision
+	// resistant, i.e., getRef should compare retained sequences
+	// when the hash of a new sequence matches an existing one.
+	tileHashVerify = false
+)
+
+func hashTile(seq []byte) tileHash {
+	return blake2b.Sum256(seq)
+}
+
+// fallbackTileHash returns the hash used for a sequence whose
+// hashTile value collides with a different sequence.
+func fallbackTileHash(seq []byte) tileHash {
+	return blake2b.Sum256(seq)
+}
+
+// libraryHash returns the blake2b-256 hash to store in a library file
+// for a tile variant with the given in-memory hash and sequence
+// (which may be nil if it was not retained).
+func libraryHash(hash tileHash, seq []byte) ([blake2b.Size256]byte, error) {
+	return hash, nil
+}
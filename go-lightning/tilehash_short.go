@@ -0,0 +1,58 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+//go:build shorthash
+
+package lightning
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/spaolacci/murmur3"
+	"golang.org/x/crypto/blake2b"
+)
+
+// tileHash is a 128-bit murmur3 hash, which is much cheaper to
+// compute than blake2b-256 and halves the memory used by the
+// in-memory variant tables. It is not collision resistant, so
+// getRef checks retained sequences for collisions (see
+// checkTileHash) and uses fallbackTileHash to disambiguate.
+//
+// The saving is in hashing every tile of every input genome to look
+// up its variant. Library files still store blake2b-256 hashes, so
+// each new variant written to a library is hashed a second time, and
+// writing a library requires the tile sequences to be retained (see
+// libraryHash).
+type tileHash = [16]byte
+
+const (
+	tileHashName   = "murmur3-128"
+	tileHashVerify = true
+)
+
+func hashTile(seq []byte) (hash tileHash) {
+	h1, h2 := murmur3.Sum128(seq)
+	binary.LittleEndian.PutUint64(hash[:8], h1)
+	binary.LittleEndian.PutUint64(hash[8:], h2)
+	return
+}
+
+func fallbackTileHash(seq []byte) (hash tileHash) {
+	full := blake2b.Sum256(seq)
+	copy(hash[:], full[:])
+	return
+}
+
+// libraryHash returns the blake2b-256 hash to store in a library
+// file, so files written by shorthash and default builds are
+// interchangeable. The hash cannot be computed from the in-memory
+// short hash, so it returns an error if the sequence was not
+// retained.
+func libraryHash(hash tileHash, seq []byte) ([blake2b.Size256]byte, error) {
+	if seq == nil {
+		return [blake2b.Size256]byte{}, errors.New("cannot write library: shorthash build requires tile sequences to be retained")
+	}
+	return blake2b.Sum256(seq), nil
+}
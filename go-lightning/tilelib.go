@@ -19,18 +19,16 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/arvados/lightning/go-lightning/libio"
 	"github.com/klauspost/pgzip"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/blake2b"
 )
 
-type tileVariantID uint16 // 1-based
+type tileVariantID = libio.TileVariantID // 1-based
 
-type tileLibRef struct {
-	Tag     tagID
-	Variant tileVariantID
-}
+type tileLibRef = libio.TileLibRef
 
 type tileSeq map[string][]tileLibRef
 
@@ -63,23 +61,44 @@ type tileLibrary struct {
 	skipOOO             bool
 	retainTileSequences bool
 	useDups             bool
+	// if non-empty, retained tile sequences are stored in a
+	// temp file in this directory instead of in memory
+	seqSpillDir string
+	// track which variants are referenced (see MarkReferenced
+	// and CollectGarbage)
+	trackReferences bool
+	// record the source of each tile variant (see TileFasta
+	// and Provenance), and include it when writing new variants
+	// to encoder
+	trackProvenance bool
+	provenance      map[tileLibRef]tileVariantSource
+	provenanceMtx   sync.Mutex
+	// don't store non-reference tile variants for these tags
+	// (getRef returns variant 0, i.e., no-call)
+	excludeTags excludeTags
 
 	taglib         *tagLibrary
-	variant        [][][blake2b.Size256]byte
+	variant        [][]tileHash
 	refseqs        map[string]map[string][]tileLibRef
 	compactGenomes map[string][]tileVariantID
-	seq2           map[[2]byte]map[[blake2b.Size256]byte][]byte
+	seq2           map[[2]byte]map[tileHash][]byte
 	seq2lock       map[[2]byte]sync.Locker
+	seqSpill       *seqSpillStore
+	seqSpillErr    error
 	variants       int64
 	// if non-nil, write out any tile variants added while tiling
-	encoder *gob.Encoder
+	encoder libraryEncoder
 	// set Ref flag when writing new variants to encoder
 	encodeRef bool
 
-	onAddTileVariant func(libref tileLibRef, hash [blake2b.Size256]byte, seq []byte) error
+	onAddTileVariant func(libref tileLibRef, hash tileHash, seq []byte) error
 	onAddGenome      func(CompactGenome) error
 	onAddRefseq      func(CompactSequence) error
 
+	// if trackReferences, gcstate[tag] holds GC bookkeeping
+	// for variant[tag]
+	gcstate []tagGCState
+
 	mtx   sync.RWMutex
 	vlock []sync.Locker
 }
@@ -100,9 +119,7 @@ func (tilelib *tileLibrary) loadTagSet(newtagset [][]byte) error {
 			return err
 		}
 		if tilelib.encoder != nil {
-			err = tilelib.encoder.Encode(LibraryEntry{
-				TagSet: newtagset,
-			})
+			err = encodeTagSet(tilelib.encoder, newtagset)
 			if err != nil {
 				return err
 			}
@@ -124,7 +141,7 @@ func (tilelib *tileLibrary) loadTileVariants(tvs []TileVariant, variantmap map[t
 	for _, tv := range tvs {
 		// Assign a new variant ID (unique across all inputs)
 		// for each input variant.
-		variantmap[tileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = tilelib.getRef(tv.Tag, tv.Sequence, tv.Ref).Variant
+		variantmap[tileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = tilelib.getRefFrom(tv.Tag, tv.Sequence, tv.Ref, tileVariantSource{tv.Source, tv.SourceTime}).Variant
 	}
 	return nil
 }
@@ -274,6 +291,9 @@ func (tilelib *tileLibrary) LoadDir(ctx context.Context, path string) error {
 	if err != nil {
 		return err
 	}
+	if err = checkTagSets(files); err != nil {
+		return err
+	}
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	var mtx sync.Mutex
@@ -314,7 +334,7 @@ func (tilelib *tileLibrary) LoadDir(ctx context.Context, path string) error {
 					mtx.Unlock()
 				}
 				for _, tv := range ent.TileVariants {
-					variantmap[tileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = tilelib.getRef(tv.Tag, tv.Sequence, tv.Ref).Variant
+					variantmap[tileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = tilelib.getRefFrom(tv.Tag, tv.Sequence, tv.Ref, tileVariantSource{tv.Source, tv.SourceTime}).Variant
 				}
 				cgs = append(cgs, ent.CompactGenomes...)
 				cseqs = append(cseqs, ent.CompactSequences...)
@@ -356,6 +376,10 @@ func (tilelib *tileLibrary) LoadDir(ctx context.Context, path string) error {
 	if err != nil {
 		return err
 	}
+	err = tilelib.sequenceStoreErr()
+	if err != nil {
+		return err
+	}
 
 	log.Info("LoadDir done")
 	return nil
@@ -406,7 +430,7 @@ func (tilelib *tileLibrary) WriteDir(dir string) error {
 	for start := range files {
 		start := start
 		go func() {
-			err := encoders[start].Encode(LibraryEntry{TagSet: tilelib.taglib.Tags()})
+			err := encodeTagSet(encoders[start], tilelib.taglib.Tags())
 			if err != nil {
 				errs <- err
 				return
@@ -435,11 +459,17 @@ func (tilelib *tileLibrary) WriteDir(dir string) error {
 			for tag := start; tag < len(tilelib.variant) && ctx.Err() == nil; tag += ntilefiles {
 				tvs = tvs[:0]
 				for idx, hash := range tilelib.variant[tag] {
+					seq := tilelib.hashSequence(hash)
+					libhash, err := libraryHash(hash, seq)
+					if err != nil {
+						errs <- fmt.Errorf("tag %d variant %d: %w", tag, idx+1, err)
+						return
+					}
 					tvs = append(tvs, TileVariant{
 						Tag:      tagID(tag),
 						Variant:  tileVariantID(idx + 1),
-						Blake2b:  hash,
-						Sequence: tilelib.hashSequence(hash),
+						Blake2b:  libhash,
+						Sequence: seq,
 					})
 				}
 				err := encoders[start].Encode(LibraryEntry{TileVariants: tvs})
@@ -511,7 +541,7 @@ func (tilelib *tileLibrary) LoadGob(ctx context.Context, rdr io.Reader, gz bool)
 	if err != nil {
 		return err
 	}
-	return nil
+	return tilelib.sequenceStoreErr()
 }
 
 func (tilelib *tileLibrary) dump(out io.Writer) {
@@ -552,21 +582,28 @@ type importStats struct {
 	PathLength            int
 	DroppedRepeatedTags   int
 	DroppedOutOfOrderTags int
+	// Only used for assembly contigs (see TileAssembly)
+	Reversed         bool `json:",omitempty"`
+	UnanchoredLength int  `json:",omitempty"`
 }
 
 func (tilelib *tileLibrary) TileFasta(filelabel string, rdr io.Reader, matchChromosome *regexp.Regexp, isRef bool) (tileSeq, []importStats, error) {
 	ret := tileSeq{}
 	type foundtag struct {
-		pos   int
-		tagid tagID
+		pos    int
+		tagid  tagID
+		taglen int
 	}
 	found := make([]foundtag, 2000000)
 	path := make([]tileLibRef, 2000000)
 	totalFoundTags := 0
 	totalPathLen := 0
 	skippedSequences := 0
-	taglen := tilelib.taglib.TagLen()
 	var stats []importStats
+	var src tileVariantSource
+	if tilelib.trackProvenance {
+		src = tileVariantSource{Source: filelabel, Time: time.Now().Unix()}
+	}
 
 	in := bufio.NewReader(rdr)
 readall:
@@ -603,7 +640,7 @@ readall:
 		fasta := bytes.NewBuffer(nil)
 		found = found[:0]
 		err := tilelib.taglib.FindAll(in, fasta, func(tagid tagID, pos, taglen int) {
-			found = append(found, foundtag{pos: pos, tagid: tagid})
+			found = append(found, foundtag{pos: pos, tagid: tagid, taglen: taglen})
 		})
 		if err != nil {
 			return nil, nil, err
@@ -665,9 +702,9 @@ readall:
 			if i == len(found)-1 {
 				endpos = fasta.Len()
 			} else {
-				endpos = found[i+1].pos + taglen
+				endpos = found[i+1].pos + found[i+1].taglen
 			}
-			path[i] = tilelib.getRef(f.tagid, fasta.Bytes()[startpos:endpos], isRef)
+			path[i] = tilelib.getRefFrom(f.tagid, fasta.Bytes()[startpos:endpos], isRef, src)
 			if countBases(fasta.Bytes()[startpos:endpos]) != endpos-startpos {
 				lowquality++
 			}
@@ -704,6 +741,16 @@ func (tilelib *tileLibrary) Len() int64 {
 // Return a tileLibRef for a tile with the given tag and sequence,
 // adding the sequence to the library if needed.
 func (tilelib *tileLibrary) getRef(tag tagID, seq []byte, usedByRef bool) tileLibRef {
+	return tilelib.getRefFrom(tag, seq, usedByRef, tileVariantSource{})
+}
+
+// getRefFrom is like getRef, but also records src as the provenance
+// of the tile variant (if trackProvenance is enabled and src is
+// earlier than any previously recorded provenance).
+func (tilelib *tileLibrary) getRefFrom(tag tagID, seq []byte, usedByRef bool, src tileVariantSource) tileLibRef {
+	if !usedByRef && tilelib.excludeTags[tag] {
+		return tileLibRef{Tag: tag}
+	}
 	dropSeq := false
 	if !tilelib.retainNoCalls {
 		for _, b := range seq {
@@ -713,7 +760,7 @@ func (tilelib *tileLibrary) getRef(tag tagID, seq []byte, usedByRef bool) tileLi
 			}
 		}
 	}
-	seqhash := blake2b.Sum256(seq)
+	seqhash := tilelib.checkTileHash(tag, seq)
 	var vlock sync.Locker
 
 	tilelib.mtx.RLock()
@@ -726,16 +773,21 @@ func (tilelib *tileLibrary) getRef(tag tagID, seq []byte, usedByRef bool) tileLi
 		vlock.Lock()
 		for i, varhash := range tilelib.variant[tag] {
 			if varhash == seqhash {
+				variant := tilelib.variantID(tag, i)
 				vlock.Unlock()
-				return tileLibRef{Tag: tag, Variant: tileVariantID(i + 1)}
+				tilelib.noteSource(tileLibRef{Tag: tag, Variant: variant}, src)
+				return tileLibRef{Tag: tag, Variant: variant}
 			}
 		}
 		vlock.Unlock()
 	} else {
 		tilelib.mtx.Lock()
 		if tilelib.variant == nil && tilelib.taglib != nil {
-			tilelib.variant = make([][][blake2b.Size256]byte, tilelib.taglib.Len())
+			tilelib.variant = make([][]tileHash, tilelib.taglib.Len())
 			tilelib.vlock = make([]sync.Locker, tilelib.taglib.Len())
+			if tilelib.trackReferences {
+				tilelib.gcstate = make([]tagGCState, tilelib.taglib.Len())
+			}
 			for i := range tilelib.vlock {
 				tilelib.vlock[i] = new(sync.Mutex)
 			}
@@ -752,17 +804,25 @@ func (tilelib *tileLibrary) getRef(tag tagID, seq []byte, usedByRef bool) tileLi
 			// tilelib.vlock slices as needed.
 			if int(tag) >= cap(tilelib.variant) {
 				// Allocate 2x capacity.
-				newslice := make([][][blake2b.Size256]byte, int(tag)+1, (int(tag)+1)*2)
+				newslice := make([][]tileHash, int(tag)+1, (int(tag)+1)*2)
 				copy(newslice, tilelib.variant)
 				tilelib.variant = newslice[:int(tag)+1]
 				newvlock := make([]sync.Locker, int(tag)+1, (int(tag)+1)*2)
 				copy(newvlock, tilelib.vlock)
 				tilelib.vlock = newvlock[:int(tag)+1]
+				if tilelib.trackReferences {
+					newgcstate := make([]tagGCState, int(tag)+1, (int(tag)+1)*2)
+					copy(newgcstate, tilelib.gcstate)
+					tilelib.gcstate = newgcstate[:int(tag)+1]
+				}
 			} else {
 				// Use previously allocated capacity,
 				// avoiding copy.
 				tilelib.variant = tilelib.variant[:int(tag)+1]
 				tilelib.vlock = tilelib.vlock[:int(tag)+1]
+				if tilelib.trackReferences {
+					tilelib.gcstate = tilelib.gcstate[:int(tag)+1]
+				}
 			}
 			for i := oldlen; i < len(tilelib.vlock); i++ {
 				tilelib.vlock[i] = new(sync.Mutex)
@@ -778,41 +838,27 @@ func (tilelib *tileLibrary) getRef(tag tagID, seq []byte, usedByRef bool) tileLi
 	vlock.Lock()
 	for i, varhash := range tilelib.variant[tag] {
 		if varhash == seqhash {
+			variant := tilelib.variantID(tag, i)
 			vlock.Unlock()
-			return tileLibRef{Tag: tag, Variant: tileVariantID(i + 1)}
+			tilelib.noteSource(tileLibRef{Tag: tag, Variant: variant}, src)
+			return tileLibRef{Tag: tag, Variant: variant}
 		}
 	}
 	atomic.AddInt64(&tilelib.variants, 1)
 	tilelib.variant[tag] = append(tilelib.variant[tag], seqhash)
 	variant := tileVariantID(len(tilelib.variant[tag]))
+	if tilelib.trackReferences {
+		variant = tilelib.gcstate[tag].add(variant)
+	}
 	vlock.Unlock()
+	tilelib.noteSource(tileLibRef{Tag: tag, Variant: variant}, src)
 
 	if tilelib.retainTileSequences && !dropSeq {
-		seqCopy := append([]byte(nil), seq...)
-		if tilelib.seq2 == nil {
-			tilelib.mtx.Lock()
-			if tilelib.seq2 == nil {
-				tilelib.seq2lock = map[[2]byte]sync.Locker{}
-				m := map[[2]byte]map[[blake2b.Size256]byte][]byte{}
-				var k [2]byte
-				for i := 0; i < 256; i++ {
-					k[0] = byte(i)
-					for j := 0; j < 256; j++ {
-						k[1] = byte(j)
-						m[k] = map[[blake2b.Size256]byte][]byte{}
-						tilelib.seq2lock[k] = &sync.Mutex{}
-					}
-				}
-				tilelib.seq2 = m
-			}
-			tilelib.mtx.Unlock()
+		if tilelib.seqSpillDir != "" {
+			tilelib.spillSequence(seqhash, seq)
+		} else {
+			tilelib.retainSequence(seqhash, seq)
 		}
-		var k [2]byte
-		copy(k[:], seqhash[:])
-		locker := tilelib.seq2lock[k]
-		locker.Lock()
-		tilelib.seq2[k][seqhash] = seqCopy
-		locker.Unlock()
 	}
 
 	saveSeq := seq
@@ -821,13 +867,17 @@ func (tilelib *tileLibrary) getRef(tag tagID, seq []byte, usedByRef bool) tileLi
 		saveSeq = nil
 	}
 	if tilelib.encoder != nil {
+		// seq is not nil, so libraryHash can't fail
+		libhash, _ := libraryHash(seqhash, seq)
 		tilelib.encoder.Encode(LibraryEntry{
 			TileVariants: []TileVariant{{
-				Tag:      tag,
-				Ref:      usedByRef,
-				Variant:  variant,
-				Blake2b:  seqhash,
-				Sequence: saveSeq,
+				Tag:        tag,
+				Ref:        usedByRef,
+				Variant:    variant,
+				Blake2b:    libhash,
+				Sequence:   saveSeq,
+				Source:     src.Source,
+				SourceTime: src.Time,
 			}},
 		})
 	}
@@ -837,17 +887,126 @@ func (tilelib *tileLibrary) getRef(tag tagID, seq []byte, usedByRef bool) tileLi
 	return tileLibRef{Tag: tag, Variant: variant}
 }
 
-func (tilelib *tileLibrary) hashSequence(hash [blake2b.Size256]byte) []byte {
+func (tilelib *tileLibrary) retainSequence(seqhash tileHash, seq []byte) {
+	seqCopy := append([]byte(nil), seq...)
+	if tilelib.seq2 == nil {
+		tilelib.mtx.Lock()
+		if tilelib.seq2 == nil {
+			tilelib.seq2lock = map[[2]byte]sync.Locker{}
+			m := map[[2]byte]map[tileHash][]byte{}
+			var k [2]byte
+			for i := 0; i < 256; i++ {
+				k[0] = byte(i)
+				for j := 0; j < 256; j++ {
+					k[1] = byte(j)
+					m[k] = map[tileHash][]byte{}
+					tilelib.seq2lock[k] = &sync.Mutex{}
+				}
+			}
+			tilelib.seq2 = m
+		}
+		tilelib.mtx.Unlock()
+	}
+	var k [2]byte
+	copy(k[:], seqhash[:])
+	locker := tilelib.seq2lock[k]
+	locker.Lock()
+	tilelib.seq2[k][seqhash] = seqCopy
+	locker.Unlock()
+}
+
+func (tilelib *tileLibrary) spillSequence(seqhash tileHash, seq []byte) {
+	if tilelib.seqSpill == nil {
+		tilelib.mtx.Lock()
+		if tilelib.seqSpill == nil && tilelib.seqSpillErr == nil {
+			tilelib.seqSpill, tilelib.seqSpillErr = newSeqSpillStore(tilelib.seqSpillDir)
+		}
+		tilelib.mtx.Unlock()
+		if tilelib.seqSpill == nil {
+			return
+		}
+	}
+	tilelib.seqSpill.Put(seqhash, seq)
+}
+
+// sequenceStoreErr returns the first error encountered while
+// spilling tile sequences to disk, if any.
+func (tilelib *tileLibrary) sequenceStoreErr() error {
+	tilelib.mtx.RLock()
+	defer tilelib.mtx.RUnlock()
+	if tilelib.seqSpillErr != nil {
+		return tilelib.seqSpillErr
+	}
+	if tilelib.seqSpill != nil {
+		return tilelib.seqSpill.Err()
+	}
+	return nil
+}
+
+// Close releases the temp file used to store tile sequences (see
+// seqSpillDir), if any. Retained tile sequences are not available
+// after Close. It is safe to call Close more than once.
+func (tilelib *tileLibrary) Close() error {
+	tilelib.mtx.Lock()
+	defer tilelib.mtx.Unlock()
+	if tilelib.seqSpill == nil {
+		return nil
+	}
+	err := tilelib.seqSpill.Close()
+	tilelib.seqSpill = nil
+	return err
+}
+
+func (tilelib *tileLibrary) hashSequence(hash tileHash) []byte {
+	if tilelib.seqSpill != nil {
+		return tilelib.seqSpill.Get(hash)
+	}
 	var partition [2]byte
 	copy(partition[:], hash[:])
 	return tilelib.seq2[partition][hash]
 }
 
+// checkTileHash returns the in-memory hash for the given tile
+// sequence. If the hash function is not collision resistant (see
+// tileHashVerify) and a different sequence with the same hash has
+// already been retained, it logs a warning and returns the fallback
+// hash instead. Collisions with sequences that were not retained
+// cannot be detected.
+func (tilelib *tileLibrary) checkTileHash(tag tagID, seq []byte) tileHash {
+	hash := hashTile(seq)
+	if !tileHashVerify || !tilelib.retainTileSequences {
+		return hash
+	}
+	tilelib.mtx.RLock()
+	spill, seq2 := tilelib.seqSpill, tilelib.seq2
+	tilelib.mtx.RUnlock()
+	var retained []byte
+	if spill != nil {
+		retained = spill.Get(hash)
+	} else if seq2 != nil {
+		var k [2]byte
+		copy(k[:], hash[:])
+		locker := tilelib.seq2lock[k]
+		locker.Lock()
+		retained = seq2[k][hash]
+		locker.Unlock()
+	}
+	if retained != nil && !bytes.Equal(retained, seq) {
+		log.Warnf("tag %d: %s hash collision (%x), using fallback hash", tag, tileHashName, hash)
+		return fallbackTileHash(seq)
+	}
+	return hash
+}
+
 func (tilelib *tileLibrary) TileVariantSequence(libref tileLibRef) []byte {
-	if libref.Variant == 0 || len(tilelib.variant) <= int(libref.Tag) || len(tilelib.variant[libref.Tag]) < int(libref.Variant) {
+	if libref.Variant == 0 || len(tilelib.variant) <= int(libref.Tag) {
+		return nil
+	}
+	i, ok := tilelib.variantIndex(libref.Tag, libref.Variant)
+	if !ok {
 		return nil
 	}
-	return tilelib.hashSequence(tilelib.variant[libref.Tag][libref.Variant-1])
+	return tilelib.hashSequence(tilelib.variant[libref.Tag][i])
 }
 
 // Tidy deletes unreferenced tile variants and renumbers variants so
@@ -902,7 +1061,7 @@ func (tilelib *tileLibrary) Tidy() {
 			// re-ordered slice of hashes, and make a
 			// mapping from old to new variant IDs.
 			remaptag := make([]tileVariantID, len(oldvariants)+1)
-			newvariants := make([][blake2b.Size256]byte, 0, len(neworder))
+			newvariants := make([]tileHash, 0, len(neworder))
 			for _, oldi := range neworder {
 				if uses[oldi] > 0 || inref[tileLibRef{Tag: tag, Variant: tileVariantID(oldi + 1)}] {
 					newvariants = append(newvariants, oldvariants[oldi])
@@ -6,9 +6,11 @@ package lightning
 
 import (
 	"bytes"
+	"encoding/gob"
 	"regexp"
 	"strings"
 
+	"golang.org/x/crypto/blake2b"
 	"gopkg.in/check.v1"
 )
 
@@ -141,3 +143,121 @@ func (s *tilelibSuite) TestSkipOOO(c *check.C) {
 	c.Assert(err, check.IsNil)
 	c.Check(tseq, check.DeepEquals, tileSeq{"test-seq": []tileLibRef{{0, 1}, {1, 1}, {3, 1}}})
 }
+
+func (s *tilelibSuite) TestSequenceSpill(c *check.C) {
+	matchAllChromosomes := regexp.MustCompile(".")
+	tilelib := &tileLibrary{taglib: &s.taglib, retainTileSequences: true, seqSpillDir: c.MkDir()}
+	tseq, _, err := tilelib.TileFasta("test-label", bytes.NewBufferString(">test-seq\n"+
+		s.tag[0]+
+		"cccccccccccccccccccc\n"+
+		s.tag[1]+
+		"ggggggggggggggggggggggg\n"+
+		s.tag[2]+
+		"\n"), matchAllChromosomes, false)
+	c.Assert(err, check.IsNil)
+	c.Check(tseq, check.DeepEquals, tileSeq{"test-seq": []tileLibRef{{0, 1}, {1, 1}, {2, 1}}})
+	c.Check(tilelib.seq2, check.IsNil)
+	c.Assert(tilelib.seqSpill, check.NotNil)
+	c.Check(tilelib.seqSpill.Len(), check.Equals, 3)
+	c.Check(string(tilelib.TileVariantSequence(tileLibRef{0, 1})), check.Equals, strings.TrimSpace(s.tag[0])+"cccccccccccccccccccc"+strings.TrimSpace(s.tag[1]))
+	c.Check(tilelib.TileVariantSequence(tileLibRef{0, 2}), check.IsNil)
+	c.Check(tilelib.sequenceStoreErr(), check.IsNil)
+
+	spill := tilelib.seqSpill
+	c.Check(tilelib.Close(), check.IsNil)
+	c.Check(tilelib.seqSpill, check.IsNil)
+	_, err = spill.file.Stat()
+	c.Check(err, check.ErrorMatches, `.*file already closed`)
+	// second Close is a no-op
+	c.Check(tilelib.Close(), check.IsNil)
+	// closing an in-memory library is a no-op
+	c.Check((&tileLibrary{taglib: &s.taglib}).Close(), check.IsNil)
+}
+
+func (s *tilelibSuite) TestTileHashCollision(c *check.C) {
+	seq := []byte("acgtacgtacgt")
+	h, err := libraryHash(hashTile(seq), seq)
+	c.Check(err, check.IsNil)
+	c.Check(h, check.Equals, blake2b.Sum256(seq))
+	_, err = libraryHash(hashTile(seq), nil)
+	if tileHashVerify {
+		// shorthash can't compute the library hash without
+		// the sequence
+		c.Check(err, check.NotNil)
+	} else {
+		c.Check(err, check.IsNil)
+	}
+
+	tilelib := &tileLibrary{taglib: &s.taglib, retainTileSequences: true}
+	tilelib.retainSequence(hashTile(seq), seq)
+	c.Check(tilelib.checkTileHash(0, seq), check.Equals, hashTile(seq))
+
+	// Pretend a different sequence was retained with the same
+	// hash.
+	tilelib.retainSequence(hashTile(seq), []byte("tttt"))
+	if tileHashVerify {
+		c.Check(tilelib.checkTileHash(0, seq), check.Equals, fallbackTileHash(seq))
+	} else {
+		c.Check(tilelib.checkTileHash(0, seq), check.Equals, hashTile(seq))
+	}
+}
+
+func (s *tilelibSuite) TestCollectGarbage(c *check.C) {
+	tilelib := &tileLibrary{taglib: &s.taglib, retainNoCalls: true, trackReferences: true}
+	seq := func(i int) []byte { return []byte(strings.TrimSpace(s.tag[0]) + strings.Repeat("a", i)) }
+	for i := 0; i < 4; i++ {
+		c.Check(tilelib.getRef(0, seq(i), false), check.Equals, tileLibRef{0, tileVariantID(i + 1)})
+	}
+	tilelib.MarkReferenced(tileLibRef{0, 2})
+
+	// first GC: all variants are new, nothing is dropped
+	c.Check(tilelib.CollectGarbage(), check.Equals, 0)
+	c.Check(tilelib.Len(), check.Equals, int64(4))
+
+	// second GC: unreferenced variants 1 and 3 are dropped;
+	// variant 4 is kept because it's the last one
+	c.Check(tilelib.CollectGarbage(), check.Equals, 2)
+	c.Check(tilelib.Len(), check.Equals, int64(2))
+	c.Check(tilelib.getRef(0, seq(1), false), check.Equals, tileLibRef{0, 2})
+	c.Check(tilelib.getRef(0, seq(3), false), check.Equals, tileLibRef{0, 4})
+
+	// dropped variants get new IDs if they're seen again
+	c.Check(tilelib.getRef(0, seq(0), false), check.Equals, tileLibRef{0, 5})
+	c.Check(tilelib.getRef(0, seq(5), false), check.Equals, tileLibRef{0, 6})
+	c.Check(tilelib.Len(), check.Equals, int64(4))
+}
+
+func (s *tilelibSuite) TestProvenance(c *check.C) {
+	var buf bytes.Buffer
+	tilelib := &tileLibrary{taglib: &s.taglib, retainNoCalls: true, trackProvenance: true, encoder: gob.NewEncoder(&buf)}
+	seq := func(i int) []byte { return []byte(strings.TrimSpace(s.tag[0]) + strings.Repeat("a", i)) }
+	tilelib.getRefFrom(0, seq(1), false, tileVariantSource{"input2", 200})
+	tilelib.getRefFrom(0, seq(1), false, tileVariantSource{"input1", 100})
+	tilelib.getRefFrom(0, seq(1), false, tileVariantSource{"input3", 300})
+	tilelib.getRefFrom(0, seq(2), false, tileVariantSource{"input3", 300})
+	tilelib.getRef(0, seq(3), false)
+
+	src, ok := tilelib.Provenance(tileLibRef{0, 1})
+	c.Check(ok, check.Equals, true)
+	c.Check(src, check.Equals, tileVariantSource{"input1", 100})
+	c.Check(src.csvFields(), check.Equals, "input1,1970-01-01T00:01:40Z")
+	src, _ = tilelib.Provenance(tileLibRef{0, 2})
+	c.Check(src, check.Equals, tileVariantSource{"input3", 300})
+	_, ok = tilelib.Provenance(tileLibRef{0, 3})
+	c.Check(ok, check.Equals, false)
+	c.Check(tileVariantSource{}.csvFields(), check.Equals, ",")
+
+	// New variants are written with the source that introduced
+	// them.
+	var tvs []TileVariant
+	err := DecodeLibrary(&buf, false, func(ent *LibraryEntry) error {
+		tvs = append(tvs, ent.TileVariants...)
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(tvs, check.HasLen, 3)
+	c.Check(tvs[0].Source, check.Equals, "input2")
+	c.Check(tvs[0].SourceTime, check.Equals, int64(200))
+	c.Check(tvs[1].Source, check.Equals, "input3")
+	c.Check(tvs[2].Source, check.Equals, "")
+}
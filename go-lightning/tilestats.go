@@ -36,9 +36,11 @@ func (cmd *tilingStats) RunCommand(prog string, args []string, stdin io.Reader,
 	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
 	projectUUID := flags.String("project", "", "project `UUID` for output data")
 	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
 	inputDir := flags.String("input-dir", "./in", "input `directory`")
 	outputDir := flags.String("output-dir", "./out", "output `directory`")
-	err = flags.Parse(args)
+	err = parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		err = nil
 		return 0
@@ -66,6 +68,7 @@ func (cmd *tilingStats) RunCommand(prog string, args []string, stdin io.Reader,
 			KeepCache:   2,
 			APIAccess:   true,
 		}
+		containerOpts.Apply(&runner, stdout)
 		err = runner.TranslatePaths(inputDir)
 		if err != nil {
 			return 1
@@ -77,7 +80,10 @@ func (cmd *tilingStats) RunCommand(prog string, args []string, stdin io.Reader,
 		}
 		var output string
 		output, err = runner.Run()
-		if err != nil {
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
 			return 1
 		}
 		fmt.Fprintln(stdout, output)
@@ -101,10 +107,10 @@ func (cmd *tilingStats) RunCommand(prog string, args []string, stdin io.Reader,
 		return 1
 	}
 	defer in0.Close()
-	var taglen int
+	var taglen []int
 	err = DecodeLibrary(in0, strings.HasSuffix(infiles[0], ".gz"), func(ent *LibraryEntry) error {
 		if len(ent.TagSet) > 0 {
-			taglen = len(ent.TagSet[0])
+			taglen = tagLengths(ent.TagSet)
 		}
 		refseqs = append(refseqs, ent.CompactSequences...)
 		for _, tv := range ent.TileVariants {
@@ -122,7 +128,7 @@ func (cmd *tilingStats) RunCommand(prog string, args []string, stdin io.Reader,
 		err = fmt.Errorf("%s: reference sequence not found", infiles[0])
 		return 1
 	}
-	if taglen == 0 {
+	if len(taglen) == 0 {
 		err = fmt.Errorf("%s: tagset not found", infiles[0])
 		return 1
 	}
@@ -157,13 +163,15 @@ func (cmd *tilingStats) RunCommand(prog string, args []string, stdin io.Reader,
 		}
 		for _, seqname := range seqnames {
 			pos := 0
-			for _, libref := range cseq.TileSequences[seqname] {
+			path := cseq.TileSequences[seqname]
+			for i, libref := range path {
 				if duptag[libref.Tag] {
 					continue
 				}
 				tiledata := reftiledata[libref]
-				if len(tiledata) <= taglen {
-					err = fmt.Errorf("bogus input data: ref tile libref %v has len %d < taglen %d", libref, len(tiledata), taglen)
+				overlap := pathOverlap(taglen, path, i)
+				if len(tiledata) <= taglen[libref.Tag] || len(tiledata) <= overlap {
+					err = fmt.Errorf("bogus input data: ref tile libref %v has len %d < taglen %d", libref, len(tiledata), taglen[libref.Tag])
 					return 1
 				}
 				score := 1000 * countBases(tiledata) / len(tiledata)
@@ -172,11 +180,11 @@ func (cmd *tilingStats) RunCommand(prog string, args []string, stdin io.Reader,
 					pos, pos+len(tiledata),
 					libref.Tag,
 					score,
-					pos+taglen, pos+len(tiledata)-taglen)
+					pos+taglen[libref.Tag], pos+len(tiledata)-overlap)
 				if err != nil {
 					return 1
 				}
-				pos += len(tiledata) - taglen
+				pos += len(tiledata) - overlap
 			}
 		}
 		err = bufw.Flush()
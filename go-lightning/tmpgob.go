@@ -0,0 +1,104 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"os"
+
+	"github.com/klauspost/pgzip"
+)
+
+// tempGobFile is a temporary file of gob-encoded values, optionally
+// gzip-compressed, that is written once and then read back from the
+// beginning.
+type tempGobFile struct {
+	f        *os.File
+	bufw     *bufio.Writer
+	zw       *pgzip.Writer // nil if not compressed
+	enc      *gob.Encoder
+	nraw     int64 // bytes encoded, before compression
+	compress bool  // file content is gzip-compressed
+}
+
+// createTempGobFile creates a temporary file with the given name in
+// dir, truncating any existing file with that name.
+func createTempGobFile(dir, name string, compress bool) (*tempGobFile, error) {
+	f, err := os.Create(dir + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	t := &tempGobFile{f: f, bufw: bufio.NewWriterSize(f, 1<<24), compress: compress}
+	var w io.Writer = t.bufw
+	if compress {
+		t.zw = pgzip.NewWriter(t.bufw)
+		w = t.zw
+	}
+	t.enc = gob.NewEncoder(&tempGobCounter{w: w, n: &t.nraw})
+	return t, nil
+}
+
+// tempGobCounter passes writes through to w, adding the number of
+// bytes written to *n.
+type tempGobCounter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *tempGobCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+// Encode writes v to the file. It must not be called concurrently.
+func (t *tempGobFile) Encode(v interface{}) error {
+	return t.enc.Encode(v)
+}
+
+// Flush finishes writing. After Flush, Encode must not be called.
+func (t *tempGobFile) Flush() error {
+	if t.zw != nil {
+		err := t.zw.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return t.bufw.Flush()
+}
+
+// Decoder returns a decoder that reads the file from the beginning.
+func (t *tempGobFile) Decoder() (*gob.Decoder, error) {
+	_, err := t.f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = bufio.NewReaderSize(t.f, 1<<24)
+	if t.compress {
+		r, err = pgzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return gob.NewDecoder(r), nil
+}
+
+// Size returns the size of the file on disk, and the number of bytes
+// encoded before compression.
+func (t *tempGobFile) Size() (disk, raw int64, err error) {
+	fi, err := t.f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	return fi.Size(), t.nraw, nil
+}
+
+// Remove closes and deletes the file.
+func (t *tempGobFile) Remove() error {
+	t.f.Close()
+	return os.Remove(t.f.Name())
+}
@@ -0,0 +1,54 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"io"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type tempGobSuite struct{}
+
+var _ = check.Suite(&tempGobSuite{})
+
+func (s *tempGobSuite) TestRoundTrip(c *check.C) {
+	tmpdir := c.MkDir()
+	for _, compress := range []bool{false, true} {
+		tmp, err := createTempGobFile(tmpdir, "tmp.test.gob", compress)
+		c.Assert(err, check.IsNil)
+		for i := 0; i < 1000; i++ {
+			c.Assert(tmp.Encode(map[string]int{"x": i}), check.IsNil)
+		}
+		c.Assert(tmp.Flush(), check.IsNil)
+		disk, raw, err := tmp.Size()
+		c.Assert(err, check.IsNil)
+		c.Check(raw > 0, check.Equals, true)
+		if compress {
+			c.Check(disk < raw, check.Equals, true, check.Commentf("disk %d raw %d", disk, raw))
+		} else {
+			c.Check(disk, check.Equals, raw)
+		}
+
+		dec, err := tmp.Decoder()
+		c.Assert(err, check.IsNil)
+		n := 0
+		for ; ; n++ {
+			var m map[string]int
+			err = dec.Decode(&m)
+			if err == io.EOF {
+				break
+			}
+			c.Assert(err, check.IsNil)
+			c.Check(m["x"], check.Equals, n)
+		}
+		c.Check(n, check.Equals, 1000)
+
+		c.Check(tmp.Remove(), check.IsNil)
+		_, err = os.Stat(tmpdir + "/tmp.test.gob")
+		c.Check(os.IsNotExist(err), check.Equals, true)
+	}
+}
@@ -0,0 +1,462 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"sort"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/kshedden/gonpy"
+	log "github.com/sirupsen/logrus"
+)
+
+// traincmd fits a regularized logistic regression model to the
+// one-hot matrix written by "slice-numpy -single-onehot".
+type traincmd struct {
+	lambda        float64
+	alpha         float64
+	maxIterations int
+	tolerance     float64
+}
+
+func (cmd *traincmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
+	inputDir := flags.String("input-dir", "./in", "input `directory` (output of slice-numpy -single-onehot, including onehot.npy, onehot-columns.npy, and samples.csv)")
+	outputDir := flags.String("output-dir", "./out", "output `directory`")
+	phenotype := flags.String("phenotype", "", "use the named phenotype column from samples.csv instead of CaseControl")
+	flags.Float64Var(&cmd.lambda, "lambda", 0.01, "regularization strength")
+	flags.Float64Var(&cmd.alpha, "alpha", 1, "elastic net mixing parameter: 1 = L1 (lasso), 0 = L2 (ridge)")
+	flags.IntVar(&cmd.maxIterations, "max-iterations", 1000, "maximum number of optimization iterations")
+	flags.Float64Var(&cmd.tolerance, "tolerance", 1e-6, "stop when no coefficient changes by more than this amount in an iteration")
+	err = parseFlags(flags, prog, args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() > 0 {
+		err = fmt.Errorf("errant command line arguments after parsed flags: %v", flags.Args())
+		return 2
+	} else if cmd.lambda < 0 {
+		err = fmt.Errorf("invalid -lambda %v: must not be negative", cmd.lambda)
+		return 2
+	} else if cmd.alpha < 0 || cmd.alpha > 1 {
+		err = fmt.Errorf("invalid -alpha %v: must be between 0 and 1", cmd.alpha)
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		runner := arvadosContainerRunner{
+			Name:        "lightning train",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         64000000000,
+			VCPUs:       4,
+			Priority:    *priority,
+			KeepCache:   2,
+			APIAccess:   true,
+		}
+		containerOpts.Apply(&runner, stdout)
+		err = runner.TranslatePaths(inputDir)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"train", "-local=true",
+			"-pprof", ":6060",
+			"-input-dir", *inputDir,
+			"-output-dir", "/mnt/output",
+			"-phenotype", *phenotype,
+			"-lambda", fmt.Sprintf("%v", cmd.lambda),
+			"-alpha", fmt.Sprintf("%v", cmd.alpha),
+			"-max-iterations", fmt.Sprintf("%d", cmd.maxIterations),
+			"-tolerance", fmt.Sprintf("%v", cmd.tolerance),
+		}
+		var output string
+		output, err = runner.Run()
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output)
+		return 0
+	}
+
+	err = cmd.train(*inputDir, *outputDir, *phenotype)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func (cmd *traincmd) train(inputDir, outputDir, phenotype string) error {
+	samples, err := loadSampleInfo(inputDir + "/samples.csv")
+	if err != nil {
+		return err
+	}
+	if phenotype != "" {
+		err = selectPhenotype(samples, phenotype)
+		if err != nil {
+			return err
+		}
+	}
+	onehot, _, err := readNumpyUint32(inputDir + "/onehot.npy")
+	if err != nil {
+		return err
+	}
+	xrefs, xshape, err := readNumpyInt32(inputDir + "/onehot-columns.npy")
+	if err != nil {
+		return err
+	}
+	ncols := xshape[1]
+
+	// Convert [row,row,...,col,col,...] to a list of columns
+	// for each row.
+	rowcols := make([][]int, len(samples))
+	nz := len(onehot) / 2
+	for i := 0; i < nz; i++ {
+		row, col := int(onehot[i]), int(onehot[nz+i])
+		if row >= len(samples) || col >= ncols {
+			return fmt.Errorf("onehot.npy entry %d (%d,%d) out of range (%d samples, %d columns)", i, row, col, len(samples), ncols)
+		}
+		rowcols[row] = append(rowcols[row], col)
+	}
+
+	var trainX, valX [][]int
+	var trainY, valY []float64
+	for i, si := range samples {
+		if !si.isCase && !si.isControl {
+			continue
+		}
+		y := 0.0
+		if si.isCase {
+			y = 1
+		}
+		if si.isTraining {
+			trainX = append(trainX, rowcols[i])
+			trainY = append(trainY, y)
+		} else if si.isValidation {
+			valX = append(valX, rowcols[i])
+			valY = append(valY, y)
+		}
+	}
+	if len(trainX) == 0 {
+		return errors.New("no case/control samples in training set")
+	}
+	log.Printf("training on %d samples, %d columns (lambda=%v alpha=%v)", len(trainX), ncols, cmd.lambda, cmd.alpha)
+	model := fitLogistic(trainX, trainY, ncols, cmd.lambda, cmd.alpha, cmd.maxIterations, cmd.tolerance)
+
+	var selected []int
+	for col, coef := range model.coef {
+		if coef != 0 {
+			selected = append(selected, col)
+		}
+	}
+	log.Printf("selected %d of %d columns after %d iterations", len(selected), ncols, model.iterations)
+
+	metrics := map[string]interface{}{
+		"Lambda":          cmd.lambda,
+		"Alpha":           cmd.alpha,
+		"Iterations":      model.iterations,
+		"Intercept":       model.intercept,
+		"SelectedColumns": len(selected),
+		"Training":        model.evaluate(trainX, trainY),
+	}
+	if len(valX) > 0 {
+		metrics["Validation"] = model.evaluate(valX, valY)
+	}
+	log.Printf("metrics: %v", metrics)
+	j, err := json.MarshalIndent(metrics, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(outputDir+"/metrics.json", append(j, '\n'), 0666)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(outputDir + "/coefficients.csv")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriter(f)
+	fmt.Fprintf(bufw, "Index,Column,Tag,Variant,Hom,Coefficient\n")
+	selectedCoef := make([]float64, len(selected))
+	selectedCols := make([]int32, len(selected))
+	for i, col := range selected {
+		selectedCoef[i] = model.coef[col]
+		selectedCols[i] = int32(col)
+		fmt.Fprintf(bufw, "%d,%d,%d,%d,%d,%g\n", i, col, xrefs[col], xrefs[ncols+col], xrefs[ncols*2+col], model.coef[col])
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	err = writeNumpyInt32(outputDir+"/selected-columns.npy", selectedCols, 1, len(selectedCols))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(outputDir+"/model.onnx", onnxLogisticModel(selectedCoef, model.intercept), 0666)
+}
+
+func readNumpyUint32(fnm string) ([]uint32, []int, error) {
+	f, err := os.Open(fnm)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	npy, err := gonpy.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	data, err := npy.GetUint32()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	return data, npy.Shape, nil
+}
+
+func readNumpyInt32(fnm string) ([]int32, []int, error) {
+	f, err := os.Open(fnm)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	npy, err := gonpy.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	data, err := npy.GetInt32()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", fnm, err)
+	}
+	if len(npy.Shape) != 2 {
+		return nil, nil, fmt.Errorf("%s: expected 2-dimensional array, got shape %v", fnm, npy.Shape)
+	}
+	return data, npy.Shape, nil
+}
+
+// logisticModel is a logistic regression model on binary features.
+type logisticModel struct {
+	intercept  float64
+	coef       []float64
+	iterations int
+}
+
+func (m *logisticModel) predict(cols []int) float64 {
+	z := m.intercept
+	for _, c := range cols {
+		z += m.coef[c]
+	}
+	return 1 / (1 + math.Exp(-z))
+}
+
+type logisticMetrics struct {
+	Samples  int
+	LogLoss  float64
+	Accuracy float64
+	AUC      float64
+}
+
+func (m *logisticModel) evaluate(X [][]int, y []float64) logisticMetrics {
+	p := make([]float64, len(X))
+	var loss float64
+	correct := 0
+	for i, cols := range X {
+		p[i] = m.predict(cols)
+		pc := math.Min(math.Max(p[i], 1e-15), 1-1e-15)
+		loss -= y[i]*math.Log(pc) + (1-y[i])*math.Log(1-pc)
+		if (p[i] >= 0.5) == (y[i] == 1) {
+			correct++
+		}
+	}
+	return logisticMetrics{
+		Samples:  len(X),
+		LogLoss:  loss / float64(len(X)),
+		Accuracy: float64(correct) / float64(len(X)),
+		AUC:      rocAUC(p, y),
+	}
+}
+
+// rocAUC returns the area under the ROC curve (the probability that
+// a random case has a higher score than a random control, counting
+// ties as 1/2), or NaN if there are no cases or no controls.
+func rocAUC(score, y []float64) float64 {
+	idx := make([]int, len(score))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool { return score[idx[i]] < score[idx[j]] })
+	var ncase, ncontrol, ranksum float64
+	for i := 0; i < len(idx); {
+		// Assign average rank to tied scores.
+		j := i
+		for j < len(idx) && score[idx[j]] == score[idx[i]] {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for _, k := range idx[i:j] {
+			if y[k] == 1 {
+				ncase++
+				ranksum += rank
+			} else {
+				ncontrol++
+			}
+		}
+		i = j
+	}
+	if ncase == 0 || ncontrol == 0 {
+		return math.NaN()
+	}
+	return (ranksum - ncase*(ncase+1)/2) / (ncase * ncontrol)
+}
+
+// fitLogistic fits an elastic net regularized logistic regression
+// model using proximal gradient descent (FISTA) with backtracking.
+// X[i] lists the columns that are 1 for sample i; all other columns
+// are 0. The objective is
+//
+//	mean(logloss) + lambda * (alpha*|coef|₁ + (1-alpha)/2*|coef|₂²)
+//
+// The intercept is not regularized.
+func fitLogistic(X [][]int, y []float64, ncols int, lambda, alpha float64, maxIterations int, tolerance float64) logisticModel {
+	n := float64(len(X))
+	l1 := lambda * alpha
+	l2 := lambda * (1 - alpha)
+
+	// smooth returns the smooth part of the objective (logloss +
+	// L2 penalty) at (b, w), and (if grad != nil) stores its
+	// gradient with respect to w in grad and returns the
+	// gradient with respect to b.
+	smooth := func(b float64, w, grad []float64) (float64, float64) {
+		var loss, gradb float64
+		for i := range grad {
+			grad[i] = l2 * w[i]
+		}
+		for i, cols := range X {
+			z := b
+			for _, c := range cols {
+				z += w[c]
+			}
+			// log(1+exp(z)) - y*z, computed stably
+			if z > 0 {
+				loss += z + math.Log1p(math.Exp(-z)) - y[i]*z
+			} else {
+				loss += math.Log1p(math.Exp(z)) - y[i]*z
+			}
+			if grad != nil {
+				r := (1/(1+math.Exp(-z)) - y[i]) / n
+				gradb += r
+				for _, c := range cols {
+					grad[c] += r
+				}
+			}
+		}
+		var sq float64
+		for _, v := range w {
+			sq += v * v
+		}
+		return loss/n + l2/2*sq, gradb
+	}
+
+	w := make([]float64, ncols)     // current estimate
+	wPrev := make([]float64, ncols) // previous estimate
+	v := make([]float64, ncols)     // extrapolated point
+	next := make([]float64, ncols)
+	grad := make([]float64, ncols)
+	var b, bPrev, bv float64
+	step := 1.0
+	theta := 1.0
+	iter := 0
+	for iter = 1; iter <= maxIterations; iter++ {
+		fv, gradb := smooth(bv, v, grad)
+		var bNext float64
+		for {
+			// Proximal step from (bv, v)
+			bNext = bv - step*gradb
+			for j := range next {
+				next[j] = softThreshold(v[j]-step*grad[j], step*l1)
+			}
+			fnext, _ := smooth(bNext, next, nil)
+			// Quadratic upper bound check
+			q := fv + (bNext-bv)*gradb + (bNext-bv)*(bNext-bv)/(2*step)
+			for j := range next {
+				d := next[j] - v[j]
+				q += d*grad[j] + d*d/(2*step)
+			}
+			if fnext <= q+1e-12 || step < 1e-12 {
+				break
+			}
+			step /= 2
+		}
+		maxDelta := math.Abs(bNext - b)
+		for j := range next {
+			if d := math.Abs(next[j] - w[j]); d > maxDelta {
+				maxDelta = d
+			}
+		}
+		copy(wPrev, w)
+		copy(w, next)
+		bPrev, b = b, bNext
+		if maxDelta < tolerance {
+			break
+		}
+		thetaNext := (1 + math.Sqrt(1+4*theta*theta)) / 2
+		mom := (theta - 1) / thetaNext
+		theta = thetaNext
+		for j := range v {
+			v[j] = w[j] + mom*(w[j]-wPrev[j])
+		}
+		bv = b + mom*(b-bPrev)
+	}
+	if iter > maxIterations {
+		iter = maxIterations
+	}
+	return logisticModel{intercept: b, coef: w, iterations: iter}
+}
+
+func softThreshold(x, t float64) float64 {
+	if x > t {
+		return x - t
+	} else if x < -t {
+		return x + t
+	}
+	return 0
+}
@@ -0,0 +1,82 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+
+	"gopkg.in/check.v1"
+)
+
+type trainSuite struct{}
+
+var _ = check.Suite(&trainSuite{})
+
+func (s *trainSuite) TestFitLogistic(c *check.C) {
+	// Column 0 determines the outcome (with a little noise),
+	// columns 1-4 are random.
+	rnd := rand.New(rand.NewSource(1))
+	var X [][]int
+	var y []float64
+	for i := 0; i < 400; i++ {
+		var cols []int
+		label := 0.0
+		if rnd.Intn(2) == 1 {
+			cols = append(cols, 0)
+			label = 1
+		}
+		if rnd.Intn(20) == 0 {
+			label = 1 - label
+		}
+		for col := 1; col < 5; col++ {
+			if rnd.Intn(2) == 1 {
+				cols = append(cols, col)
+			}
+		}
+		X = append(X, cols)
+		y = append(y, label)
+	}
+
+	model := fitLogistic(X, y, 5, 0.05, 1, 1000, 1e-8)
+	c.Logf("intercept %v coef %v iterations %d", model.intercept, model.coef, model.iterations)
+	c.Check(model.coef[0] > 1, check.Equals, true)
+	for col := 1; col < 5; col++ {
+		c.Check(model.coef[col], check.Equals, 0.0)
+	}
+	metrics := model.evaluate(X, y)
+	c.Logf("%+v", metrics)
+	c.Check(metrics.Accuracy > 0.9, check.Equals, true)
+	c.Check(metrics.AUC > 0.9, check.Equals, true)
+
+	// Without L1 penalty, all coefficients are nonzero, but the
+	// uninformative ones are small.
+	model = fitLogistic(X, y, 5, 0.05, 0, 1000, 1e-8)
+	c.Logf("intercept %v coef %v iterations %d", model.intercept, model.coef, model.iterations)
+	c.Check(model.coef[0] > 1, check.Equals, true)
+	for col := 1; col < 5; col++ {
+		c.Check(model.coef[col] != 0, check.Equals, true)
+		c.Check(math.Abs(model.coef[col]) < 0.2, check.Equals, true)
+	}
+}
+
+func (s *trainSuite) TestROCAUC(c *check.C) {
+	c.Check(rocAUC([]float64{0.1, 0.2, 0.3, 0.4}, []float64{0, 0, 1, 1}), check.Equals, 1.0)
+	c.Check(rocAUC([]float64{0.4, 0.3, 0.2, 0.1}, []float64{0, 0, 1, 1}), check.Equals, 0.0)
+	c.Check(rocAUC([]float64{0.5, 0.5, 0.5, 0.5}, []float64{0, 1, 0, 1}), check.Equals, 0.5)
+	c.Check(rocAUC([]float64{0.1, 0.3, 0.2, 0.4}, []float64{0, 0, 1, 1}), check.Equals, 0.75)
+	c.Check(math.IsNaN(rocAUC([]float64{0.1, 0.2}, []float64{1, 1})), check.Equals, true)
+}
+
+func (s *trainSuite) TestONNXModel(c *check.C) {
+	buf := onnxLogisticModel([]float64{0.5, -1.5}, 0.25)
+	c.Check(buf[:2], check.DeepEquals, []byte{0x08, onnxIRVersion})
+	for _, s := range []string{"MatMul", "Add", "Sigmoid", "coef", "intercept", "probability"} {
+		c.Check(bytes.Contains(buf, []byte(s)), check.Equals, true, check.Commentf("%q", s))
+	}
+	// coef tensor data is little-endian float32
+	c.Check(bytes.Contains(buf, []byte{0, 0, 0, 0x3f, 0, 0, 0xc0, 0xbf}), check.Equals, true)
+}
@@ -24,23 +24,21 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"syscall"
 
 	"github.com/klauspost/pgzip"
 	log "github.com/sirupsen/logrus"
 )
 
 type vcf2fasta struct {
-	refFile           string
-	genomeFile        string
-	mask              bool
-	gvcfRegionsPy     string
-	gvcfRegionsPyData []byte
-	gvcfType          string
-	projectUUID       string
-	outputDir         string
-	runLocal          bool
-	vcpus             int
+	refFile     string
+	genomeFile  string
+	mask        bool
+	gvcfType    string
+	projectUUID string
+	outputDir   string
+	runLocal    bool
+	vcpus       int
+	genotypes   genotypePolicy
 	batchArgs
 
 	stderr io.Writer
@@ -58,16 +56,19 @@ func (cmd *vcf2fasta) RunCommand(prog string, args []string, stdin io.Reader, st
 	flags.StringVar(&cmd.refFile, "ref", "", "reference fasta `file`")
 	flags.StringVar(&cmd.genomeFile, "genome", "", "reference genome `file`")
 	flags.BoolVar(&cmd.mask, "mask", false, "mask uncalled regions (default: output hom ref)")
-	flags.StringVar(&cmd.gvcfRegionsPy, "gvcf-regions.py", "https://raw.githubusercontent.com/lijiayong/gvcf_regions/master/gvcf_regions.py", "source of gvcf_regions.py")
-	flags.StringVar(&cmd.gvcfType, "gvcf-type", "gatk", "gvcf_type argument to gvcf_regions.py: gatk, complete_genomics, freebayes")
+	flags.String("gvcf-regions.py", "", "ignored (gvcf regions are now computed without python)")
+	flags.StringVar(&cmd.gvcfType, "gvcf-type", "gatk", "gvcf `type`, used to determine which regions are called when masking: gatk, complete_genomics, complete_genomics_pass_all, freebayes")
 	flags.StringVar(&cmd.projectUUID, "project", "", "project `UUID` for containers and output data")
 	flags.StringVar(&cmd.outputDir, "output-dir", "", "output directory")
 	flags.IntVar(&cmd.vcpus, "vcpus", 0, "number of VCPUs to request for arvados container (default: 2*number of input files, max 32)")
 	flags.BoolVar(&cmd.runLocal, "local", false, "run on local host (default: run in an arvados container)")
+	cmd.genotypes.Flags(flags)
 	cmd.batchArgs.Flags(flags)
 	priority := flags.Int("priority", 500, "container request priority")
+	var containerOpts containerOptions
+	containerOpts.Flags(flags)
 	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
-	err = flags.Parse(args)
+	err = parseFlags(flags, prog, args)
 	if err == flag.ErrHelp {
 		err = nil
 		return 0
@@ -88,11 +89,12 @@ func (cmd *vcf2fasta) RunCommand(prog string, args []string, stdin io.Reader, st
 		}()
 	}
 
-	if cmd.mask {
-		err = cmd.loadRegionsPy()
-		if err != nil {
-			return 1
-		}
+	if _, ok := gvcfTypes[cmd.gvcfType]; !ok {
+		err = fmt.Errorf("invalid -gvcf-type %q", cmd.gvcfType)
+		return 2
+	}
+	if err = cmd.genotypes.Check(); err != nil {
+		return 2
 	}
 
 	if !cmd.runLocal {
@@ -120,13 +122,8 @@ func (cmd *vcf2fasta) RunCommand(prog string, args []string, stdin io.Reader, st
 			Priority:    *priority,
 			KeepCache:   2,
 			APIAccess:   true,
-			Mounts: map[string]map[string]interface{}{
-				"/gvcf_regions.py": map[string]interface{}{
-					"kind":    "text",
-					"content": string(cmd.gvcfRegionsPyData),
-				},
-			},
 		}
+		containerOpts.Apply(&runner, stdout)
 		err = runner.TranslatePaths(&cmd.refFile, &cmd.genomeFile)
 		if err != nil {
 			return 1
@@ -148,16 +145,19 @@ func (cmd *vcf2fasta) RunCommand(prog string, args []string, stdin io.Reader, st
 				"-local=true",
 				"-ref", cmd.refFile, fmt.Sprintf("-mask=%v", cmd.mask),
 				"-genome", cmd.genomeFile,
-				"-gvcf-regions.py", "/gvcf_regions.py",
 				"-gvcf-type", cmd.gvcfType,
 				"-output-dir", "/mnt/output",
 			}
+			runner.Args = append(runner.Args, cmd.genotypes.Args()...)
 			runner.Args = append(runner.Args, cmd.batchArgs.Args(batch)...)
 			runner.Args = append(runner.Args, inputs...)
 			log.Printf("batch %d: %v", batch, runner.Args)
 			return runner.RunContext(ctx)
 		})
-		if err != nil {
+		if err == errDryRun {
+			err = nil
+			return 0
+		} else if err != nil {
 			return 1
 		}
 		fmt.Fprintln(stdout, strings.Join(outputs, " "))
@@ -215,7 +215,11 @@ func (cmd *vcf2fasta) RunCommand(prog string, args []string, stdin io.Reader, st
 	return 0
 }
 
-func maybeInDocker(args, mountfiles []string) []string {
+// maybeInDocker returns a command that runs args in the
+// lightning-runtime docker image, if it is available, with the given
+// files mounted read-only and rwdirs mounted read-write. Otherwise it
+// returns args unchanged.
+func maybeInDocker(args, mountfiles []string, rwdirs ...string) []string {
 	if out, err := exec.Command("docker", "image", "ls", "-q", "lightning-runtime").Output(); err != nil || len(out) == 0 {
 		return args
 	}
@@ -226,6 +230,9 @@ func maybeInDocker(args, mountfiles []string) []string {
 	for _, f := range mountfiles {
 		dockerrun = append(dockerrun, "--volume="+f+":"+f+":ro")
 	}
+	for _, d := range rwdirs {
+		dockerrun = append(dockerrun, "--volume="+d+":"+d)
+	}
 	dockerrun = append(dockerrun, "lightning-runtime")
 	dockerrun = append(dockerrun, args...)
 	return dockerrun
@@ -246,10 +253,16 @@ func (cmd *vcf2fasta) vcf2fasta(infile string, phase int) error {
 	gzipw := pgzip.NewWriter(bufw)
 	defer gzipw.Close()
 
-	var maskfifo string // filename of mask fifo if we're running bedtools, otherwise ""
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		return fmt.Errorf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	var maskfile string // filename of mask bed file if masking, otherwise ""
 
 	var wg sync.WaitGroup
-	errs := make(chan error, 2)
+	errs := make(chan error, 1)
 	if cmd.mask {
 		chrSize := map[string]int{}
 
@@ -288,23 +301,7 @@ func (cmd *vcf2fasta) vcf2fasta(infile string, phase int) error {
 		}
 
 		var regions bytes.Buffer
-		bedargs := []string{"python2", "-"}
-		if cmd.gvcfType == "complete_genomics_pass_all" {
-			bedargs = append(bedargs,
-				"--ignore_phrases", "CNV", "INS:ME",
-				"--unreported_is_called",
-			)
-		} else if cmd.gvcfType != "" {
-			bedargs = append(bedargs, "--gvcf_type", cmd.gvcfType)
-		}
-		bedargs = append(bedargs, infile)
-		bed := exec.CommandContext(ctx, bedargs[0], bedargs[1:]...)
-		bed.Stdin = bytes.NewBuffer(cmd.gvcfRegionsPyData)
-		bed.Stdout = &regions
-		bed.Stderr = cmd.stderr
-		log.Printf("running %v", bed.Args)
-		err = bed.Run()
-		log.Printf("exited %v", bed.Args)
+		err = cmd.gvcfRegions(infile, &regions)
 		if err != nil {
 			return fmt.Errorf("gvcf_regions: %s", err)
 		}
@@ -334,102 +331,69 @@ func (cmd *vcf2fasta) vcf2fasta(infile string, phase int) error {
 			}
 		}
 
-		// "bedtools complement" expects the chromosome sizes
-		// ("genome file") to appear in the same order as the
-		// chromosomes in the input vcf, so we need to sort
-		// them.
-		scanner = bufio.NewScanner(bytes.NewBuffer(append([]byte(nil), regions.Bytes()...)))
-		var sortedGenomeFile bytes.Buffer
-		for scanner.Scan() {
-			var chr string
-			var size int
-			_, err := fmt.Sscanf(scanner.Text(), "%s\t%d", &chr, &size)
-			if err != nil {
-				return fmt.Errorf("error parsing gvcf_regions output: %s", err)
-			}
-			if size, ok := chrSize[chr]; ok {
-				fmt.Fprintf(&sortedGenomeFile, "%s\t%d\n", chr, size)
-				delete(chrSize, chr)
-			}
-		}
-
 		// The bcftools --mask argument needs to end in ".bed"
-		// in order to be parsed as a BED file, so we need to
-		// use a named pipe instead of stdin.
-		tempdir, err := ioutil.TempDir("", "")
+		// in order to be parsed as a BED file.
+		maskfile = filepath.Join(tempdir, "mask.bed")
+		maskf, err := os.OpenFile(maskfile, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
 		if err != nil {
-			return fmt.Errorf("TempDir: %s", err)
+			return err
 		}
-		defer os.RemoveAll(tempdir)
-		maskfifo = filepath.Join(tempdir, "fifo.bed")
-		err = syscall.Mkfifo(maskfifo, 0600)
+		defer maskf.Close()
+		maskbufw := bufio.NewWriter(maskf)
+		err = bedComplement(&regions, maskbufw, chrSize)
 		if err != nil {
-			return fmt.Errorf("mkfifo: %s", err)
+			return fmt.Errorf("computing mask from gvcf regions: %s", err)
 		}
-
-		// bedtools complement can't seem to read from a pipe
-		// reliably -- "Error: line number 1 of file
-		// /dev/stdin has 1 fields, but 3 were expected." --
-		// so we stage to a temp file.
-		regionsFile := filepath.Join(tempdir, "gvcf_regions.bed")
-		err = ioutil.WriteFile(regionsFile, regions.Bytes(), 0644)
+		err = maskbufw.Flush()
 		if err != nil {
 			return err
 		}
+		err = maskf.Close()
+		if err != nil {
+			return err
+		}
+	}
 
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-
-			maskfifow, err := os.OpenFile(maskfifo, os.O_WRONLY, 0)
-			if err != nil {
-				errs <- err
-				return
-			}
-			defer maskfifow.Close()
-
-			bedcompargs := []string{"bedtools", "complement", "-i", regionsFile, "-g", "/dev/stdin"}
-			bedcompargs = maybeInDocker(bedcompargs, []string{cmd.genomeFile})
-			bedcomp := exec.CommandContext(ctx, bedcompargs[0], bedcompargs[1:]...)
-			bedcomp.Stdin = &sortedGenomeFile
-			bedcomp.Stdout = maskfifow
-			bedcomp.Stderr = cmd.stderr
-			log.Printf("running %v", bedcomp.Args)
-			err = bedcomp.Run()
-			log.Printf("exited %v", bedcomp.Args)
-			if err != nil {
-				errs <- fmt.Errorf("bedtools complement: %s", err)
-				return
-			}
-			err = maskfifow.Close()
-			if err != nil {
-				errs <- err
-				return
-			}
-		}()
+	consensusInput := infile // vcf file to pass to bcftools consensus
+	var consensusOut io.Writer = gzipw
+	if cmd.genotypes.active() {
+		var logfile string
+		if phase == 1 {
+			// Both phases make the same decisions, so
+			// only one of them needs to log them.
+			logfile = filepath.Join(cmd.outputDir, basename+".genotypes.tsv")
+		}
+		consensusInput = filepath.Join(tempdir, "resolved.vcf.gz")
+		haploid, err := cmd.resolveGenotypes(ctx, infile, consensusInput, logfile)
+		if err != nil {
+			return fmt.Errorf("resolving genotypes: %s", err)
+		}
+		if phase == 2 && cmd.genotypes.haploid == "once" && len(haploid) > 0 {
+			consensusOut = &fastaFilterWriter{w: gzipw, drop: haploid}
+		}
 	}
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		consargs := []string{"bcftools", "consensus", "--fasta-ref", cmd.refFile, "-H", fmt.Sprint(phase)}
-		if maskfifo != "" {
-			consargs = append(consargs, "--mask", maskfifo)
+		if maskfile != "" {
+			consargs = append(consargs, "--mask", maskfile)
 		}
-		consargs = append(consargs, infile)
+		consargs = append(consargs, consensusInput)
 		indexsuffix := ".tbi"
-		if _, err := os.Stat(infile + ".csi"); err == nil {
+		if _, err := os.Stat(consensusInput + ".csi"); err == nil {
 			indexsuffix = ".csi"
 		}
-		mounts := []string{infile, infile + indexsuffix, cmd.refFile}
-		if maskfifo != "" {
-			mounts = append(mounts, maskfifo)
+		mounts := []string{consensusInput, consensusInput + indexsuffix, cmd.refFile}
+		if maskfile != "" {
+			mounts = append(mounts, maskfile)
 		}
 		consargs = maybeInDocker(consargs, mounts)
 
 		consensus := exec.CommandContext(ctx, consargs[0], consargs[1:]...)
 		consensus.Stderr = os.Stderr
-		consensus.Stdout = gzipw
+		consensus.Stdout = consensusOut
 		consensus.Stderr = cmd.stderr
 		log.Printf("running %v", consensus.Args)
 		err = consensus.Run()
@@ -466,27 +430,104 @@ func (cmd *vcf2fasta) vcf2fasta(infile string, phase int) error {
 	return nil
 }
 
-func (cmd *vcf2fasta) loadRegionsPy() error {
-	if strings.HasPrefix(cmd.gvcfRegionsPy, "http") {
-		resp, err := http.Get(cmd.gvcfRegionsPy)
+// gvcfRegions writes the called regions of the given gVCF file to
+// bedw in BED format.
+func (cmd *vcf2fasta) gvcfRegions(infile string, bedw io.Writer) error {
+	f, err := open(infile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var rdr io.Reader = bufio.NewReaderSize(f, 8*1024*1024)
+	if strings.HasSuffix(infile, ".gz") {
+		gz, err := pgzip.NewReader(rdr)
 		if err != nil {
 			return err
 		}
-		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("get %q: http status %d", cmd.gvcfRegionsPy, resp.StatusCode)
+		defer gz.Close()
+		rdr = gz
+	}
+	log.Printf("finding called regions in %s (gvcf type %q)", infile, cmd.gvcfType)
+	return gvcfRegions(rdr, bedw, gvcfTypes[cmd.gvcfType])
+}
+
+// resolveGenotypes writes a bgzipped and indexed copy of infile to
+// outfile, with genotypes resolved according to cmd.genotypes, and
+// (if logfile is not "") writes a log of the changed genotypes to
+// logfile. It returns the set of chromosomes whose genotypes are all
+// haploid.
+func (cmd *vcf2fasta) resolveGenotypes(ctx context.Context, infile, outfile, logfile string) (map[string]bool, error) {
+	f, err := open(infile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rdr io.Reader = bufio.NewReaderSize(f, 8*1024*1024)
+	if strings.HasSuffix(infile, ".gz") {
+		gz, err := pgzip.NewReader(rdr)
+		if err != nil {
+			return nil, err
 		}
-		buf, err := io.ReadAll(resp.Body)
+		defer gz.Close()
+		rdr = gz
+	}
+
+	var logw *bufio.Writer
+	if logfile != "" {
+		logf, err := os.Create(logfile)
 		if err != nil {
-			return fmt.Errorf("get %q: read body: %s", cmd.gvcfRegionsPy, err)
+			return nil, err
 		}
-		cmd.gvcfRegionsPyData = buf
-		return nil
+		defer logf.Close()
+		logw = bufio.NewWriter(logf)
+	}
+
+	tempdir := filepath.Dir(outfile)
+	viewargs := maybeInDocker([]string{"bcftools", "view", "--no-version", "-Oz", "-o", outfile, "-"}, nil, tempdir)
+	view := exec.CommandContext(ctx, viewargs[0], viewargs[1:]...)
+	view.Stderr = cmd.stderr
+	viewin, err := view.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("running %v", view.Args)
+	err = view.Start()
+	if err != nil {
+		return nil, fmt.Errorf("bcftools view: %s", err)
+	}
+	bufw := bufio.NewWriterSize(viewin, 8*1024*1024)
+	var haploid map[string]bool
+	if logw != nil {
+		haploid, err = cmd.genotypes.resolveGenotypes(rdr, bufw, logw)
 	} else {
-		buf, err := ioutil.ReadFile(cmd.gvcfRegionsPy)
+		haploid, err = cmd.genotypes.resolveGenotypes(rdr, bufw, nil)
+	}
+	if err == nil {
+		err = bufw.Flush()
+	}
+	viewin.Close()
+	if err != nil {
+		view.Wait()
+		return nil, err
+	}
+	err = view.Wait()
+	if err != nil {
+		return nil, fmt.Errorf("bcftools view: %s", err)
+	}
+	if logw != nil {
+		err = logw.Flush()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		cmd.gvcfRegionsPyData = buf
-		return nil
 	}
+
+	indexargs := maybeInDocker([]string{"bcftools", "index", outfile}, nil, tempdir)
+	index := exec.CommandContext(ctx, indexargs[0], indexargs[1:]...)
+	index.Stderr = cmd.stderr
+	log.Printf("running %v", index.Args)
+	err = index.Run()
+	if err != nil {
+		return nil, fmt.Errorf("bcftools index: %s", err)
+	}
+	return haploid, nil
 }
@@ -0,0 +1,240 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+)
+
+// genotypePolicy determines how vcf2fasta resolves unphased and
+// haploid genotypes before passing them to bcftools consensus. The
+// default flag values leave genotypes as they are, i.e., rely on
+// bcftools's default behavior.
+type genotypePolicy struct {
+	unphased string // "keep", "ref", "alt", or "random-seeded"
+	seed     int64  // seed for "random-seeded"
+	haploid  string // "keep", "duplicate", or "once"
+}
+
+func (gp *genotypePolicy) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&gp.unphased, "unphased", "keep", "how to resolve unphased heterozygous genotypes: keep (use alleles in the order given), ref (use ref allele in both haplotypes), alt (use non-ref alleles in both haplotypes), or random-seeded (assign alleles to haplotypes pseudo-randomly using -unphased-seed)")
+	flags.Int64Var(&gp.seed, "unphased-seed", 0, "random `seed` for -unphased=random-seeded")
+	flags.StringVar(&gp.haploid, "haploid", "keep", "how to handle haploid genotypes: keep (bcftools default), duplicate (same allele in both haplotypes), or once (like duplicate, but omit haploid chromosomes from the second haplotype's output)")
+}
+
+// Args returns command line arguments that reproduce the policy
+// (see Flags).
+func (gp *genotypePolicy) Args() []string {
+	return []string{
+		"-unphased=" + gp.unphased,
+		fmt.Sprintf("-unphased-seed=%d", gp.seed),
+		"-haploid=" + gp.haploid,
+	}
+}
+
+func (gp *genotypePolicy) Check() error {
+	switch gp.unphased {
+	case "keep", "ref", "alt", "random-seeded":
+	default:
+		return fmt.Errorf("invalid -unphased %q: must be keep, ref, alt, or random-seeded", gp.unphased)
+	}
+	switch gp.haploid {
+	case "keep", "duplicate", "once":
+	default:
+		return fmt.Errorf("invalid -haploid %q: must be keep, duplicate, or once", gp.haploid)
+	}
+	return nil
+}
+
+// active returns true if genotypes need to be rewritten before
+// running bcftools consensus.
+func (gp *genotypePolicy) active() bool {
+	return gp.unphased != "keep" || gp.haploid != "keep"
+}
+
+// resolveGenotypes copies a VCF from rdr to w, replacing the first
+// sample's GT with a phased genotype according to the policy. Each
+// changed genotype is recorded in logw (if not nil) as a TSV line
+// with chromosome, position, ref, alt, original GT, new GT, and the
+// reason for the change.
+//
+// It returns the set of chromosomes where all genotypes are haploid.
+func (gp *genotypePolicy) resolveGenotypes(rdr io.Reader, w io.Writer, logw io.Writer) (map[string]bool, error) {
+	haploid := map[string]bool{}
+	if logw != nil {
+		_, err := fmt.Fprintf(logw, "## unphased=%s unphased-seed=%d haploid=%s\n#CHROM\tPOS\tREF\tALT\tGT\tRESOLVED\tREASON\n", gp.unphased, gp.seed, gp.haploid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	scanner := bufio.NewScanner(rdr)
+	scanner.Buffer(make([]byte, 1<<20), 1<<30)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Bytes()
+		if len(line) > 0 && line[0] != '#' {
+			fields := bytes.Split(line, []byte{'\t'})
+			if len(fields) >= 10 {
+				gtIdx := -1
+				for i, key := range bytes.Split(fields[8], []byte{':'}) {
+					if string(key) == "GT" {
+						gtIdx = i
+						break
+					}
+				}
+				if gtIdx >= 0 {
+					sample := bytes.Split(fields[9], []byte{':'})
+					if gtIdx >= len(sample) {
+						return nil, fmt.Errorf("line %d: GT field missing from sample column", lineno)
+					}
+					chrom := string(fields[0])
+					gt := string(sample[gtIdx])
+					resolved, reason := gp.resolveGT(gt, chrom, string(fields[1]))
+					ishaploid := !strings.ContainsAny(gt, "/|")
+					if prev, seen := haploid[chrom]; !seen || prev {
+						haploid[chrom] = ishaploid
+					}
+					if resolved != gt {
+						if logw != nil {
+							_, err := fmt.Fprintf(logw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", fields[0], fields[1], fields[3], fields[4], gt, resolved, reason)
+							if err != nil {
+								return nil, err
+							}
+						}
+						sample[gtIdx] = []byte(resolved)
+						fields[9] = bytes.Join(sample, []byte{':'})
+						line = bytes.Join(fields, []byte{'\t'})
+					}
+				}
+			}
+		}
+		_, err := w.Write(line)
+		if err == nil {
+			_, err = w.Write([]byte{'\n'})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for chrom, ishaploid := range haploid {
+		if !ishaploid {
+			delete(haploid, chrom)
+		}
+	}
+	return haploid, nil
+}
+
+// resolveGT returns the phased genotype to use in place of gt, and
+// a short description of the decision.
+func (gp *genotypePolicy) resolveGT(gt, chrom, pos string) (string, string) {
+	if strings.Contains(gt, ".") {
+		// missing calls are left for bcftools to handle
+		return gt, ""
+	}
+	if !strings.ContainsAny(gt, "/|") {
+		if gp.haploid == "keep" {
+			return gt, ""
+		}
+		return gt + "|" + gt, "haploid"
+	}
+	alleles := strings.Split(gt, "/")
+	if len(alleles) != 2 {
+		// phased, or not diploid
+		return gt, ""
+	}
+	a, b := alleles[0], alleles[1]
+	if a == b {
+		// homozygous, nothing to resolve
+		return gt, ""
+	}
+	switch gp.unphased {
+	case "ref":
+		if a == "0" || b == "0" {
+			return "0|0", "unphased-ref"
+		}
+		// no ref allele, so keep both alts as given
+		return a + "|" + b, "unphased-ref-no-ref-allele"
+	case "alt":
+		if a == "0" {
+			return b + "|" + b, "unphased-alt"
+		} else if b == "0" {
+			return a + "|" + a, "unphased-alt"
+		}
+		return a + "|" + b, "unphased-alt"
+	case "random-seeded":
+		h := fnv.New64a()
+		binary.Write(h, binary.LittleEndian, gp.seed)
+		io.WriteString(h, chrom+":"+pos)
+		if h.Sum64()&1 == 1 {
+			return b + "|" + a, "unphased-random-swap"
+		}
+		return a + "|" + b, "unphased-random"
+	}
+	return gt, ""
+}
+
+// fastaFilterWriter copies FASTA data to w, omitting sequences whose
+// names are in drop.
+type fastaFilterWriter struct {
+	w    io.Writer
+	drop map[string]bool
+
+	midLine  bool   // previous write ended in the middle of a line
+	inHeader bool   // currently reading a header line
+	header   []byte // partial header line
+	skipping bool   // current sequence is being dropped
+}
+
+func (fw *fastaFilterWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if fw.inHeader {
+			i := bytes.IndexByte(p, '\n')
+			if i < 0 {
+				fw.header = append(fw.header, p...)
+				break
+			}
+			fw.header = append(fw.header, p[:i+1]...)
+			p = p[i+1:]
+			fw.inHeader = false
+			name := bytes.Fields(fw.header[1:])
+			fw.skipping = len(name) > 0 && fw.drop[string(name[0])]
+			if !fw.skipping {
+				if _, err := fw.w.Write(fw.header); err != nil {
+					return 0, err
+				}
+			}
+			fw.header = fw.header[:0]
+			continue
+		}
+		if !fw.midLine && p[0] == '>' {
+			fw.inHeader = true
+			continue
+		}
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line, p = p[:i+1], p[i+1:]
+			fw.midLine = false
+		} else {
+			p = nil
+			fw.midLine = true
+		}
+		if !fw.skipping {
+			if _, err := fw.w.Write(line); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
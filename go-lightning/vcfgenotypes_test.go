@@ -0,0 +1,102 @@
+// Copyright (C) The Lightning Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package lightning
+
+import (
+	"bytes"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type vcfGenotypesSuite struct{}
+
+var _ = check.Suite(&vcfGenotypesSuite{})
+
+const genotypesTestVCF = `##fileformat=VCFv4.2
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	sample
+chr1	10	.	A	G	.	PASS	.	GT:GQ	0/1:30
+chr1	20	.	C	T	.	PASS	.	GT	1|0
+chr1	30	.	G	A,C	.	PASS	.	GT	1/2
+chr1	40	.	T	C	.	PASS	.	GT	1/1
+chr1	50	.	T	C	.	PASS	.	GT	./.
+chrX	10	.	A	G	.	PASS	.	GT	1
+chrX	20	.	A	G	.	PASS	.	GT	0
+chrY	10	.	A	G	.	PASS	.	GT	1
+chrY	20	.	A	G	.	PASS	.	GT	0/1
+`
+
+func (s *vcfGenotypesSuite) resolve(c *check.C, gp genotypePolicy) (string, string, map[string]bool) {
+	c.Assert(gp.Check(), check.IsNil)
+	var out, logbuf bytes.Buffer
+	haploid, err := gp.resolveGenotypes(strings.NewReader(genotypesTestVCF), &out, &logbuf)
+	c.Assert(err, check.IsNil)
+	return out.String(), logbuf.String(), haploid
+}
+
+func (s *vcfGenotypesSuite) TestKeep(c *check.C) {
+	gp := genotypePolicy{unphased: "keep", haploid: "keep"}
+	c.Check(gp.active(), check.Equals, false)
+	out, logtext, haploid := s.resolve(c, gp)
+	c.Check(out, check.Equals, genotypesTestVCF)
+	c.Check(strings.Count(logtext, "\n"), check.Equals, 2)
+	c.Check(haploid, check.DeepEquals, map[string]bool{"chrX": true})
+}
+
+func (s *vcfGenotypesSuite) TestRef(c *check.C) {
+	out, logtext, _ := s.resolve(c, genotypePolicy{unphased: "ref", haploid: "duplicate"})
+	c.Check(out, check.Matches, `(?ms).*\tGT:GQ\t0\|0:30\n.*`)
+	c.Check(out, check.Matches, `(?ms).*\tGT\t1\|0\n.*`)
+	c.Check(out, check.Matches, `(?ms).*\tGT\t1\|2\n.*`)
+	c.Check(out, check.Matches, `(?ms).*\tGT\t1/1\n.*`)
+	c.Check(out, check.Matches, `(?ms).*\tGT\t\./\.\n.*`)
+	c.Check(out, check.Matches, `(?ms).*chrX\t10\t.*\tGT\t1\|1\n.*`)
+	c.Check(logtext, check.Matches, `(?ms).*chr1\t10\tA\tG\t0/1\t0\|0\tunphased-ref\n.*`)
+	c.Check(logtext, check.Matches, `(?ms).*chrX\t20\tA\tG\t0\t0\|0\thaploid\n.*`)
+}
+
+func (s *vcfGenotypesSuite) TestAlt(c *check.C) {
+	out, _, _ := s.resolve(c, genotypePolicy{unphased: "alt", haploid: "keep"})
+	c.Check(out, check.Matches, `(?ms).*\tGT:GQ\t1\|1:30\n.*`)
+	c.Check(out, check.Matches, `(?ms).*chrX\t10\t.*\tGT\t1\n.*`)
+}
+
+func (s *vcfGenotypesSuite) TestRandomSeeded(c *check.C) {
+	swapped := map[string]bool{}
+	for seed := int64(0); seed < 16; seed++ {
+		gp := genotypePolicy{unphased: "random-seeded", seed: seed, haploid: "keep"}
+		out1, log1, _ := s.resolve(c, gp)
+		out2, log2, _ := s.resolve(c, gp)
+		c.Check(out1, check.Equals, out2)
+		c.Check(log1, check.Equals, log2)
+		gt, _ := gp.resolveGT("0/1", "chr1", "10")
+		swapped[gt] = true
+	}
+	// Different seeds should produce different results.
+	c.Check(swapped, check.DeepEquals, map[string]bool{"0|1": true, "1|0": true})
+}
+
+func (s *vcfGenotypesSuite) TestInvalidPolicy(c *check.C) {
+	c.Check((&genotypePolicy{unphased: "maybe", haploid: "keep"}).Check(), check.ErrorMatches, `invalid -unphased.*`)
+	c.Check((&genotypePolicy{unphased: "keep", haploid: "twice"}).Check(), check.ErrorMatches, `invalid -haploid.*`)
+}
+
+func (s *vcfGenotypesSuite) TestFastaFilterWriter(c *check.C) {
+	fasta := ">chr1 desc\nACGT\nAC\n>chrX\nGGGG\nGG\n>chrY\nTTTT\n"
+	for _, chunk := range []int{1, 3, 5, len(fasta)} {
+		var out bytes.Buffer
+		fw := &fastaFilterWriter{w: &out, drop: map[string]bool{"chrX": true}}
+		for i := 0; i < len(fasta); i += chunk {
+			end := i + chunk
+			if end > len(fasta) {
+				end = len(fasta)
+			}
+			n, err := fw.Write([]byte(fasta[i:end]))
+			c.Assert(err, check.IsNil)
+			c.Check(n, check.Equals, end-i)
+		}
+		c.Check(out.String(), check.Equals, ">chr1 desc\nACGT\nAC\n>chrY\nTTTT\n")
+	}
+}